@@ -0,0 +1,206 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/codeaucafe/snippetbox/greenlight/internal/data"
+	"github.com/codeaucafe/snippetbox/greenlight/internal/validator"
+)
+
+// reportReviewHandler handles the "POST /v1/reviews/:id/report" endpoint and reports a review
+// which breaks the rules, with a reason and optional details. Each user can report a review
+// once, and only the reviews which are shown to other users (the approved ones) can be reported.
+// The moderators are emailed about the review when its first open report is made.
+func (app *application) reportReviewHandler(w http.ResponseWriter, r *http.Request) {
+	reviewID, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	var input struct {
+		Reason  string `json:"reason"`
+		Details string `json:"details"`
+	}
+
+	err = app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	review, err := app.models.Reviews.Get(r.Context(), reviewID)
+	if err == nil && review.Status != data.ReviewStatusApproved {
+		err = data.ErrRecordNotFound
+	}
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	report := &data.AbuseReport{
+		ReviewID: review.ID,
+		UserID:   user.ID,
+		Reason:   input.Reason,
+		Details:  input.Details,
+	}
+
+	v := validator.New()
+
+	v.Check(review.UserID != user.ID, "review", "you cannot report your own review")
+
+	if data.ValidateAbuseReport(v, report); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	email := func(recipient string) *data.OutboxEmail {
+		return &data.OutboxEmail{
+			Recipient: recipient,
+			Template:  "review_reported.tmpl",
+			Data: map[string]interface{}{
+				"reviewID": review.ID,
+				"movieID":  review.MovieID,
+				"reason":   report.Reason,
+				"details":  report.Details,
+			},
+		}
+	}
+
+	err = app.models.AbuseReports.Insert(r.Context(), report, email)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		case errors.Is(err, data.ErrDuplicateAbuseReport):
+			v.AddError("review", "you have already reported this review")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"report": report}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// listAbuseReportsHandler handles the "GET /v1/admin/abuse-reports" endpoint and returns a page of
+// the report queue: the open reports, oldest first by default, along with the reviews they're
+// about. The status query string parameter can be used to list the closed reports instead.
+func (app *application) listAbuseReportsHandler(w http.ResponseWriter, r *http.Request) {
+	v := validator.New()
+	qs := r.URL.Query()
+
+	status := app.readStrings(qs, "status", data.AbuseReportStatusOpen)
+
+	filters := data.Filters{
+		Page:     app.readInt(qs, "page", 1, v),
+		PageSize: app.readInt(qs, "page_size", 20, v),
+		Sort:     app.readStrings(qs, "sort", "created_at"),
+		SortSafeList: []string{
+			"created_at", "updated_at",
+			"-created_at", "-updated_at",
+		},
+	}
+
+	v.Check(validator.In(status, data.AbuseReportStatuses...), "status", "must be one of open, resolved or dismissed")
+
+	if data.ValidateFilters(v, filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	reports, metadata, err := app.models.AbuseReports.GetAll(r.Context(), status, filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"reports": reports, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// resolveAbuseReportHandler handles the "PATCH /v1/admin/abuse-reports/:id" endpoint and closes
+// an open report as resolved or dismissed, with an optional note. The other open reports of the
+// same review are closed along with it. Closing a report doesn't change the review itself: a
+// moderator who agrees with the report rejects the review with "PATCH /v1/admin/reviews/:id".
+func (app *application) resolveAbuseReportHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	var input struct {
+		Status string `json:"status"`
+		Note   string `json:"note"`
+	}
+
+	err = app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	report, err := app.models.AbuseReports.Get(r.Context(), id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	v := validator.New()
+
+	v.Check(validator.In(input.Status, data.AbuseReportStatusResolved, data.AbuseReportStatusDismissed), "status",
+		"must be one of resolved or dismissed")
+	v.Check(report.Status == data.AbuseReportStatusOpen, "status", "the report is already "+report.Status)
+	data.ValidateModerationNote(v, input.Note)
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	report.Status = input.Status
+	report.ResolutionNote = input.Note
+
+	closed, err := app.models.AbuseReports.Resolve(r.Context(), report, app.contextGetUser(r).ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// Fetch the report again to get the resolution details which were filled in by the database.
+	report, err = app.models.AbuseReports.Get(r.Context(), id)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"report": report, "closed": closed}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
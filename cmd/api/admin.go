@@ -0,0 +1,195 @@
+package main
+
+import (
+	"expvar"
+	"net/http"
+	"net/http/pprof"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/codeaucafe/snippetbox/greenlight/internal/data"
+)
+
+// operationalRouteTable returns the healthcheck, metrics and admin routes. These are served by
+// the public listener unless the -admin-addr flag is set, in which case they're served by the
+// admin listener instead (see adminRoutes()) and the public listener doesn't expose them at all.
+func (app *application) operationalRouteTable() []route {
+	publicCORS := newCORSPolicy(app.config.cors.publicOrigins)
+
+	// The request body of the incident endpoints.
+	incident := func() *openAPISchema {
+		return objectSchema(map[string]*openAPISchema{
+			"title":      stringSchema(200),
+			"message":    stringSchema(5000),
+			"impact":     enumSchema(data.IncidentImpacts...),
+			"started_at": formatSchema("date-time"),
+		})
+	}
+
+	webhook := func() *openAPISchema {
+		return objectSchema(map[string]*openAPISchema{
+			"url":         stringSchema(2000),
+			"event_types": arraySchema(enumSchema(data.WebhookEventTypes...), 1, 0).unique(),
+			"active":      booleanSchema(),
+		})
+	}
+
+	return []route{
+		// Healthcheck
+		{method: http.MethodGet, path: "/v1/healthcheck", handler: app.healthcheckHandler,
+			summary: "Check the health of the application", cors: publicCORS, cache: cacheNoCache},
+
+		// Application metrics
+		{method: http.MethodGet, path: "/debug/vars", handler: expvar.Handler().ServeHTTP,
+			summary: "Show application metrics"},
+		{method: http.MethodGet, path: "/metrics", handler: promhttp.Handler().ServeHTTP,
+			summary: "Show application metrics in the Prometheus format"},
+
+		// Admin
+		{method: http.MethodGet, path: "/v1/admin/settings", handler: app.showSettingsHandler,
+			summary: "Show the runtime settings", permission: "settings:admin"},
+		{method: http.MethodPatch, path: "/v1/admin/settings", handler: app.updateSettingsHandler,
+			summary: "Update the runtime settings", permission: "settings:admin",
+			body: objectSchema(map[string]*openAPISchema{
+				"limiter_rps":          {Type: "number"},
+				"limiter_burst":        integerSchema(0),
+				"limiter_enabled":      booleanSchema(),
+				"maintenance_mode":     booleanSchema(),
+				"log_level":            enumSchema(data.LogLevels...),
+				"cors_trusted_origins": arraySchema(stringSchema(0), 0, 0).nullable(),
+			})},
+
+		{method: http.MethodGet, path: "/v1/admin/usage", handler: app.showUsageHandler,
+			summary: "Show API usage", permission: "usage:admin"},
+		{method: http.MethodPost, path: "/v1/admin/stats/refresh", handler: app.refreshStatsHandler,
+			summary: "Refresh the statistics", permission: "stats:admin"},
+
+		{method: http.MethodGet, path: "/v1/admin/backups", handler: app.listBackupsHandler,
+			summary: "List database backups", permission: "backups:admin"},
+		{method: http.MethodPost, path: "/v1/admin/backups", handler: app.createBackupHandler,
+			summary: "Back up the database", permission: "backups:admin"},
+
+		{method: http.MethodGet, path: "/v1/admin/announcements", handler: app.listAllAnnouncementsHandler,
+			summary: "List all announcements", permission: "announcements:admin"},
+		{method: http.MethodPost, path: "/v1/admin/announcements", handler: app.createAnnouncementHandler,
+			summary: "Broadcast an announcement", permission: "announcements:admin",
+			body: objectSchema(map[string]*openAPISchema{
+				"title":     stringSchema(200),
+				"body":      stringSchema(5000),
+				"severity":  enumSchema(data.AnnouncementSeverities...),
+				"starts_at": formatSchema("date-time").nullable(),
+				"ends_at":   formatSchema("date-time").nullable(),
+				"email":     booleanSchema(),
+			}).required("title", "body")},
+		{method: http.MethodDelete, path: "/v1/admin/announcements/:id", handler: app.deleteAnnouncementHandler,
+			summary: "Delete an announcement", permission: "announcements:admin"},
+
+		{method: http.MethodPost, path: "/v1/admin/incidents", handler: app.createIncidentHandler,
+			summary: "Post an incident on the status page", permission: "status:admin",
+			body: incident().required("title", "message", "impact").
+				withProperty("resolved_at", formatSchema("date-time").nullable())},
+		{method: http.MethodPatch, path: "/v1/admin/incidents/:id", handler: app.updateIncidentHandler,
+			summary: "Update or resolve an incident", permission: "status:admin",
+			body: incident().withProperty("resolved", booleanSchema())},
+		{method: http.MethodDelete, path: "/v1/admin/incidents/:id", handler: app.deleteIncidentHandler,
+			summary: "Delete an incident", permission: "status:admin"},
+
+		{method: http.MethodPost, path: "/v1/admin/webhooks", handler: app.createWebhookHandler,
+			summary: "Register a webhook", permission: "webhooks:admin",
+			body: webhook().required("url", "event_types").withProperty("secret", textSchema(200))},
+		{method: http.MethodGet, path: "/v1/admin/webhooks", handler: app.listWebhooksHandler,
+			summary: "List webhooks", permission: "webhooks:admin"},
+		{method: http.MethodPatch, path: "/v1/admin/webhooks/:id", handler: app.updateWebhookHandler,
+			summary: "Update or pause a webhook", permission: "webhooks:admin", body: webhook()},
+		{method: http.MethodDelete, path: "/v1/admin/webhooks/:id", handler: app.deleteWebhookHandler,
+			summary: "Delete a webhook", permission: "webhooks:admin"},
+		{method: http.MethodGet, path: "/v1/admin/webhooks/:id/deliveries", handler: app.listWebhookDeliveriesHandler,
+			summary: "List the deliveries to a webhook", permission: "webhooks:admin",
+			query: queryParams(map[string]*openAPISchema{
+				"status": enumSchema(data.WebhookDeliveryPending, data.WebhookDeliveryDelivered,
+					data.WebhookDeliveryFailed),
+				"page":      integerSchema(1).atMost(10_000_000),
+				"page_size": integerSchema(1).atMost(100),
+			})},
+
+		{method: http.MethodGet, path: "/v1/admin/reviews", handler: app.listModerationQueueHandler,
+			summary: "List the review moderation queue", permission: "reviews:moderate"},
+		{method: http.MethodPatch, path: "/v1/admin/reviews/:id", handler: app.moderateReviewHandler,
+			summary: "Approve or reject a review", permission: "reviews:moderate",
+			body: objectSchema(map[string]*openAPISchema{
+				"status": enumSchema(data.ReviewStatusApproved, data.ReviewStatusRejected),
+				"note":   textSchema(1000),
+			}).required("status")},
+		{method: http.MethodGet, path: "/v1/admin/abuse-reports", handler: app.listAbuseReportsHandler,
+			summary: "List the reported reviews", permission: "reviews:moderate"},
+		{method: http.MethodPatch, path: "/v1/admin/abuse-reports/:id", handler: app.resolveAbuseReportHandler,
+			summary: "Resolve or dismiss an abuse report", permission: "reviews:moderate",
+			body: objectSchema(map[string]*openAPISchema{
+				"status": enumSchema(data.AbuseReportStatusResolved, data.AbuseReportStatusDismissed),
+				"note":   textSchema(1000),
+			}).required("status")},
+
+		{method: http.MethodPost, path: "/v1/admin/duplicates/scan", handler: app.scanDuplicatesHandler,
+			summary: "Scan the catalog for duplicate movies", permission: "duplicates:admin",
+			body: objectSchema(map[string]*openAPISchema{"runtime_tolerance": integerSchema(0).atMost(30)})},
+		{method: http.MethodGet, path: "/v1/admin/duplicates", handler: app.listDuplicatesHandler,
+			summary: "List probable duplicate movies", permission: "duplicates:admin"},
+		{method: http.MethodPatch, path: "/v1/admin/duplicates/:id", handler: app.updateDuplicateHandler,
+			summary: "Review a probable duplicate", permission: "duplicates:admin",
+			body: objectSchema(map[string]*openAPISchema{
+				"status": enumSchema(data.DuplicateStatuses...),
+			}).required("status")},
+
+		{method: http.MethodGet, path: "/v1/audit", handler: app.listAuditLogHandler,
+			summary: "List the audit log", permission: "audit:admin",
+			query: queryParams(map[string]*openAPISchema{
+				"resource_type": enumSchema(data.AuditResourceTypes()...),
+				"resource_id":   integerSchema(1),
+				"from":          formatSchema("date"),
+				"to":            formatSchema("date"),
+				"page":          integerSchema(1).atMost(10_000_000),
+				"page_size":     integerSchema(1).atMost(100),
+			})},
+	}
+}
+
+// adminRoutes returns the handler for the admin listener. It serves the operational routes, along
+// with the pprof profiling endpoints, which are never served by the public listener. The admin
+// endpoints still require an authentication token with the right permissions, but the admin
+// listener skips the rate limiting, quotas and maintenance mode of the public listener, so that
+// operators can always reach it.
+func (app *application) adminRoutes() http.Handler {
+	router := httprouter.New()
+	router.NotFound = http.HandlerFunc(app.notFoundResponse)
+	router.MethodNotAllowed = http.HandlerFunc(app.methodNotAllowedResponse)
+
+	cr := newCORSRouter(router, app.defaultCORSPolicy())
+
+	routes := app.operationalRouteTable()
+	app.registerRoutes(cr, routes)
+
+	// pprof profiling handlers
+	router.HandlerFunc(http.MethodGet, "/debug/pprof/*profile", pprofHandler)
+	router.HandlerFunc(http.MethodPost, "/debug/pprof/*profile", pprofHandler)
+
+	return app.requestID(app.trace(app.logRequest(app.recoverPanic(app.cacheControl(cachePolicies(routes), app.authenticate(router))))))
+}
+
+// pprofHandler serves the net/http/pprof endpoints under /debug/pprof/. httprouter doesn't allow
+// static routes alongside a catch-all parameter, so we dispatch on the profile name ourselves.
+// pprof.Index() serves the index page and any named profiles, such as heap and goroutine.
+func pprofHandler(w http.ResponseWriter, r *http.Request) {
+	switch httprouter.ParamsFromContext(r.Context()).ByName("profile") {
+	case "/cmdline":
+		pprof.Cmdline(w, r)
+	case "/profile":
+		pprof.Profile(w, r)
+	case "/symbol":
+		pprof.Symbol(w, r)
+	case "/trace":
+		pprof.Trace(w, r)
+	default:
+		pprof.Index(w, r)
+	}
+}
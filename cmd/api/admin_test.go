@@ -0,0 +1,38 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+// TestAdminRoutes tests that the admin listener serves the operational endpoints, including the
+// pprof handlers which are never served by the public listener.
+func TestAdminRoutes(t *testing.T) {
+	app := newTestApp()
+	app.config.admin.addr = "localhost:4001"
+
+	ts := newTestServer(app.adminRoutes())
+	defer ts.Close()
+
+	tests := []struct {
+		path     string
+		wantCode int
+	}{
+		{"/v1/healthcheck", http.StatusOK},
+		{"/debug/vars", http.StatusOK},
+		{"/debug/pprof/", http.StatusOK},
+		{"/debug/pprof/cmdline", http.StatusOK},
+		{"/v1/admin/settings", http.StatusUnauthorized},
+		{"/v1/movies", http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			code, _, body := ts.get(t, tt.path)
+
+			if code != tt.wantCode {
+				t.Errorf("want %d; got %d: %s", tt.wantCode, code, body)
+			}
+		})
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/codeaucafe/snippetbox/greenlight/internal/data"
+	"github.com/codeaucafe/snippetbox/greenlight/internal/validator"
+)
+
+// announcementBatchSize is the most subscribers who are emailed an announcement in one
+// transaction. Any more are emailed straight afterwards, in further batches.
+const announcementBatchSize = 100
+
+// listAnnouncementsHandler handles the "GET /v1/announcements" endpoint and returns the
+// announcements which are currently showing. It's public, so that clients can show them before
+// the user has logged in.
+func (app *application) listAnnouncementsHandler(w http.ResponseWriter, r *http.Request) {
+	announcements, err := app.models.Announcements.GetActive(r.Context(), app.clock.Now())
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"announcements": announcements}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// createAnnouncementHandler handles the "POST /v1/admin/announcements" endpoint and broadcasts
+// an announcement. It shows from starts_at (or straight away) until ends_at (or until it's
+// deleted). If email is true then once it starts it's also emailed to the users who have
+// subscribed to announcements with "PUT /v1/users/me/announcements" (see sendAnnouncementEmails()).
+func (app *application) createAnnouncementHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Title    string     `json:"title"`
+		Body     string     `json:"body"`
+		Severity string     `json:"severity"`
+		StartsAt *time.Time `json:"starts_at"`
+		EndsAt   *time.Time `json:"ends_at"`
+		Email    bool       `json:"email"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	announcement := &data.Announcement{
+		CreatedBy: &user.ID,
+		Title:     input.Title,
+		Body:      input.Body,
+		Severity:  input.Severity,
+		StartsAt:  app.clock.Now(),
+		EndsAt:    input.EndsAt,
+		Email:     input.Email,
+	}
+
+	if announcement.Severity == "" {
+		announcement.Severity = "info"
+	}
+	if input.StartsAt != nil {
+		announcement.StartsAt = *input.StartsAt
+	}
+
+	v := validator.New()
+
+	if data.ValidateAnnouncement(v, announcement); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Announcements.Insert(r.Context(), announcement)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"announcement": announcement}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// listAllAnnouncementsHandler handles the "GET /v1/admin/announcements" endpoint and returns
+// every announcement, including the ones which have ended or haven't started yet.
+func (app *application) listAllAnnouncementsHandler(w http.ResponseWriter, r *http.Request) {
+	announcements, err := app.models.Announcements.GetAll(r.Context())
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"announcements": announcements}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// deleteAnnouncementHandler handles the "DELETE /v1/admin/announcements/:id" endpoint.
+func (app *application) deleteAnnouncementHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	err = app.models.Announcements.Delete(r.Context(), id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "announcement successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// subscribeAnnouncementsHandler handles the "PUT /v1/users/me/announcements" endpoint and opts
+// the current user in to receiving announcements by email.
+func (app *application) subscribeAnnouncementsHandler(w http.ResponseWriter, r *http.Request) {
+	err := app.models.Announcements.Subscribe(r.Context(), app.contextGetUser(r).ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"subscribed": true}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// unsubscribeAnnouncementsHandler handles the "DELETE /v1/users/me/announcements" endpoint and
+// opts the current user out of receiving announcements by email.
+func (app *application) unsubscribeAnnouncementsHandler(w http.ResponseWriter, r *http.Request) {
+	err := app.models.Announcements.Unsubscribe(r.Context(), app.contextGetUser(r).ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"subscribed": false}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// sendAnnouncementEmails queues the emails for the announcements which have started and are to be
+// emailed to the subscribers, in batches, until there are none left. Each batch is saved in its
+// own transaction, so a large number of subscribers doesn't hold one long transaction open, and
+// an interrupted run carries on from the last batch the next time.
+func (app *application) sendAnnouncementEmails() {
+	job := startJob("announcement_emails")
+	defer job.finish()
+
+	email := func(announcement *data.Announcement, recipient string) *data.OutboxEmail {
+		return &data.OutboxEmail{
+			Recipient: recipient,
+			Template:  "announcement.tmpl",
+			Data: map[string]interface{}{
+				"title":    announcement.Title,
+				"body":     announcement.Body,
+				"severity": announcement.Severity,
+			},
+		}
+	}
+
+	for {
+		more, err := app.models.Announcements.SendEmails(context.Background(), app.clock.Now(), announcementBatchSize, email)
+		if err != nil {
+			job.fail()
+			app.logger.PrintError(err, nil)
+			return
+		}
+
+		if !more {
+			return
+		}
+	}
+}
+
+// sendAnnouncementEmailsPeriodically calls sendAnnouncementEmails() once every interval, as long
+// as this instance is the leader. It runs until the application exits.
+func (app *application) sendAnnouncementEmailsPeriodically(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+
+		if !app.isLeader() {
+			continue
+		}
+
+		app.sendAnnouncementEmails()
+	}
+}
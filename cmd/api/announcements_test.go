@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/codeaucafe/snippetbox/greenlight/internal/clock"
+	"github.com/codeaucafe/snippetbox/greenlight/internal/data"
+	"github.com/codeaucafe/snippetbox/greenlight/internal/mailer"
+	"github.com/codeaucafe/snippetbox/greenlight/internal/testutil"
+)
+
+// TestAnnouncements tests broadcasting announcements: only the announcements inside their active
+// window are listed, and subscribers are emailed when the admin asks for it, once the
+// announcement starts.
+func TestAnnouncements(t *testing.T) {
+	app, fx := newTestDBApp(t)
+	ts := newTestServer(app.routes())
+	defer ts.Close()
+
+	admin := fx.Token(fx.User(nil, "announcements:admin"), data.ScopeAuthentication)
+
+	subscriber := fx.User(nil)
+	fx.User(nil)
+
+	code, _, body := ts.request(t, http.MethodPut, "/v1/users/me/announcements",
+		fx.Token(subscriber, data.ScopeAuthentication).Plaintext, "")
+	testutil.Status(t, code, body, http.StatusOK)
+
+	code, _, body = ts.request(t, http.MethodPost, "/v1/admin/announcements", admin.Plaintext,
+		`{"title": "Maintenance", "body": "Down for an hour from 10pm UTC.", "severity": "warning", "email": true}`)
+	testutil.Status(t, code, body, http.StatusCreated)
+
+	code, _, body = ts.request(t, http.MethodPost, "/v1/admin/announcements", admin.Plaintext,
+		`{"title": "Later", "body": "Not yet.", "starts_at": "2030-01-01T00:00:00Z", "email": true}`)
+	testutil.Status(t, code, body, http.StatusCreated)
+
+	code, _, body = ts.request(t, http.MethodPost, "/v1/admin/announcements", admin.Plaintext,
+		`{"title": "Bad", "body": "Bad.", "severity": "apocalyptic"}`)
+	testutil.Status(t, code, body, http.StatusUnprocessableEntity)
+
+	// Nothing is emailed until the emails are queued, and then only the subscriber is emailed,
+	// and only about the announcement which asked for it and has started.
+	testutil.Equal(t, app.processOutbox(), 0)
+
+	app.sendAnnouncementEmails()
+	testutil.Equal(t, app.processOutbox(), 1)
+
+	emails := app.mailer.(*mailer.Recorder).SentTo(subscriber.Email)
+	testutil.Equal(t, len(emails), 1)
+	testutil.StringContains(t, emails[0].PlainBody, "Down for an hour from 10pm UTC.")
+
+	app.sendAnnouncementEmails()
+	testutil.Equal(t, app.processOutbox(), 0)
+
+	code, _, body = ts.request(t, http.MethodGet, "/v1/announcements", "", "")
+	testutil.Status(t, code, body, http.StatusOK)
+
+	var got struct {
+		Announcements []data.Announcement `json:"announcements"`
+	}
+	testutil.DecodeJSON(t, body, &got)
+
+	testutil.Equal(t, len(got.Announcements), 1)
+	testutil.Equal(t, got.Announcements[0].Title, "Maintenance")
+
+	// The scheduled announcement is emailed once it starts.
+	app.clock.(*clock.Mock).Set(time.Date(2030, time.January, 1, 0, 0, 0, 0, time.UTC))
+
+	app.sendAnnouncementEmails()
+	testutil.Equal(t, app.processOutbox(), 1)
+
+	emails = app.mailer.(*mailer.Recorder).SentTo(subscriber.Email)
+	testutil.Equal(t, len(emails), 2)
+	testutil.StringContains(t, emails[1].PlainBody, "Not yet.")
+}
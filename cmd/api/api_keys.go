@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/codeaucafe/snippetbox/greenlight/internal/data"
+	"github.com/codeaucafe/snippetbox/greenlight/internal/validator"
+)
+
+// The headers of a signed request, which are sent along with an "Authorization: Signature
+// <key-id>" header. The timestamp is in Unix seconds, and the nonce is a random string of up to
+// 64 characters which the client doesn't use again. See signatureBase() for what's signed.
+const (
+	signatureTimestampHeader = "Greenlight-Timestamp"
+	signatureNonceHeader     = "Greenlight-Nonce"
+	signatureHeader          = "Greenlight-Signature"
+)
+
+// createAPIKeyHandler handles the "POST /v1/users/me/api-keys" endpoint and creates a named API
+// key, which a machine client can use to sign its requests rather than sending a bearer token.
+// The response is the only time the key's secret is shown.
+func (app *application) createAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Name string `json:"name"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	key := &data.APIKey{
+		UserID: app.contextGetUser(r).ID,
+		Name:   input.Name,
+	}
+
+	v := validator.New()
+
+	if data.ValidateAPIKey(v, key); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.APIKeys.Insert(r.Context(), key, app.config.signing.secret)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrTooManyAPIKeys):
+			v.AddError("name", "you cannot have more than "+strconv.Itoa(data.MaxAPIKeysPerUser)+" api keys")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"api_key": key, "secret": key.Secret}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// listAPIKeysHandler handles the "GET /v1/users/me/api-keys" endpoint and returns all of the
+// current user's API keys, without their secrets.
+func (app *application) listAPIKeysHandler(w http.ResponseWriter, r *http.Request) {
+	keys, err := app.models.APIKeys.GetAllForUser(r.Context(), app.contextGetUser(r).ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"api_keys": keys}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// deleteAPIKeyHandler handles the "DELETE /v1/users/me/api-keys/:id" endpoint and revokes an
+// API key.
+func (app *application) deleteAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	err = app.models.APIKeys.Delete(r.Context(), id, app.contextGetUser(r).ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "api key successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// signatureBase returns the string which is signed for a request: the method, the path and query
+// string, the timestamp and nonce headers, and the hex-encoded SHA-256 hash of the body, each on
+// its own line.
+func signatureBase(method, requestURI, timestamp, nonce string, body []byte) string {
+	bodyHash := sha256.Sum256(body)
+
+	return strings.Join([]string{method, requestURI, timestamp, nonce, hex.EncodeToString(bodyHash[:])}, "\n")
+}
+
+// signRequest returns the hex-encoded HMAC-SHA256 signature of a signature base with an API key's
+// secret.
+func signRequest(secret, base string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(base))
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// authenticateSignature authenticates a request signed with the API key with the given key ID,
+// and then calls the next handler in the chain. Requests whose timestamp is further than the
+// -signature-max-skew flag from the server's clock are rejected, and so are requests which reuse
+// a nonce, so that a captured request can't be replayed. Nonces are only checked once the
+// signature has been, so that nobody else can use up a client's nonces.
+func (app *application) authenticateSignature(w http.ResponseWriter, r *http.Request, next http.Handler, keyID string) {
+	timestamp := r.Header.Get(signatureTimestampHeader)
+	nonce := r.Header.Get(signatureNonceHeader)
+	signature := r.Header.Get(signatureHeader)
+
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil || nonce == "" || len(nonce) > 64 || signature == "" {
+		app.invalidSignatureResponse(w, r, "missing or malformed request signature headers")
+		return
+	}
+
+	maxSkew := app.config.signing.maxSkew
+	now := app.clock.Now()
+
+	skew := now.Sub(time.Unix(unix, 0))
+	if skew > maxSkew || skew < -maxSkew {
+		app.invalidSignatureResponse(w, r, "the request timestamp is too far from the current time")
+		return
+	}
+
+	key, err := app.models.APIKeys.GetForKeyID(r.Context(), keyID, app.config.signing.secret)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidSignatureResponse(w, r, "invalid request signature")
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// Read the body to check the signature, and then replace it so that the handler can read it
+	// too. The body is limited to the same size as readJSON() allows.
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 1_048_576))
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	expected := signRequest(key.Secret, signatureBase(r.Method, r.URL.RequestURI(), timestamp, nonce, body))
+
+	if !hmac.Equal([]byte(expected), []byte(strings.ToLower(signature))) {
+		app.invalidSignatureResponse(w, r, "invalid request signature")
+		return
+	}
+
+	// Keep the nonce until the request's timestamp is too old to be accepted.
+	err = app.models.APIKeys.UseNonce(r.Context(), key, nonce, now, time.Unix(unix, 0).Add(maxSkew))
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrReplayedNonce):
+			app.invalidSignatureResponse(w, r, "the request nonce has already been used")
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	user, err := app.models.Users.Get(r.Context(), key.UserID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidSignatureResponse(w, r, "invalid request signature")
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	r = app.contextSetUser(r, user)
+
+	next.ServeHTTP(w, r)
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/codeaucafe/snippetbox/greenlight/internal/data"
+	"github.com/codeaucafe/snippetbox/greenlight/internal/testutil"
+)
+
+// TestSignedRequests tests requests signed with an API key, including the rejection of stale,
+// replayed and tampered requests.
+func TestSignedRequests(t *testing.T) {
+	app, fx := newTestDBApp(t)
+	ts := newTestServer(app.routes())
+	defer ts.Close()
+
+	user := fx.User(nil, "movies:read")
+	session := fx.Token(user, data.ScopeAuthentication)
+
+	code, _, body := ts.request(t, http.MethodPost, "/v1/users/me/api-keys", session.Plaintext, `{"name": "ci"}`)
+	testutil.Status(t, code, body, http.StatusCreated)
+
+	var created struct {
+		APIKey data.APIKey `json:"api_key"`
+		Secret string      `json:"secret"`
+	}
+	testutil.DecodeJSON(t, body, &created)
+
+	// send makes a request signed with the given secret at the given time. If sentBody isn't
+	// empty it's sent in place of the body which was signed.
+	send := func(method, path, body, nonce, secret string, at time.Time, sentBody string) int {
+		t.Helper()
+
+		if sentBody == "" {
+			sentBody = body
+		}
+
+		req, err := http.NewRequest(method, ts.URL+path, strings.NewReader(sentBody))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		timestamp := strconv.FormatInt(at.Unix(), 10)
+
+		req.Header.Set("Authorization", "Signature "+created.APIKey.KeyID)
+		req.Header.Set(signatureTimestampHeader, timestamp)
+		req.Header.Set(signatureNonceHeader, nonce)
+		req.Header.Set(signatureHeader, signRequest(secret, signatureBase(method, path, timestamp, nonce, []byte(body))))
+
+		rs, err := ts.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rs.Body.Close()
+
+		_, _ = io.Copy(io.Discard, rs.Body)
+
+		return rs.StatusCode
+	}
+
+	testutil.Equal(t, send(http.MethodGet, "/v1/users/me/api-keys", "", "n1", created.Secret, testTime, ""), http.StatusOK)
+
+	// The same request can't be replayed.
+	testutil.Equal(t, send(http.MethodGet, "/v1/users/me/api-keys", "", "n1", created.Secret, testTime, ""),
+		http.StatusUnauthorized)
+
+	testutil.Equal(t, send(http.MethodGet, "/v1/users/me/api-keys", "", "n2", created.Secret,
+		testTime.Add(-10*time.Minute), ""), http.StatusUnauthorized)
+	testutil.Equal(t, send(http.MethodGet, "/v1/users/me/api-keys", "", "n3", "wrong", testTime, ""),
+		http.StatusUnauthorized)
+
+	// The body is signed, and the handler can still read it.
+	second := `{"name": "second"}`
+	testutil.Equal(t, send(http.MethodPost, "/v1/users/me/api-keys", second, "n4", created.Secret, testTime,
+		`{"name": "tampered"}`), http.StatusUnauthorized)
+	testutil.Equal(t, send(http.MethodPost, "/v1/users/me/api-keys", second, "n5", created.Secret, testTime, ""),
+		http.StatusCreated)
+
+	// Once the key is deleted its requests are rejected.
+	code, _, body = ts.request(t, http.MethodDelete, fmt.Sprintf("/v1/users/me/api-keys/%d", created.APIKey.ID),
+		session.Plaintext, "")
+	testutil.Status(t, code, body, http.StatusOK)
+
+	testutil.Equal(t, send(http.MethodGet, "/v1/users/me/api-keys", "", "n6", created.Secret, testTime, ""),
+		http.StatusUnauthorized)
+
+	// Deactivating the user revokes the rest of their keys.
+	err := app.models.Users.SetActivated(context.Background(), user, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys, err := app.models.APIKeys.GetAllForUser(context.Background(), user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testutil.Equal(t, len(keys), 0)
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/codeaucafe/snippetbox/greenlight/internal/data"
+	"github.com/codeaucafe/snippetbox/greenlight/internal/validator"
+)
+
+// listAuditLogHandler handles the "GET /v1/audit" endpoint and returns a paginated list of the
+// audit log entries, newest first by default. The entries can be filtered by the user who made
+// the write (user_id, which also accepts "me"), by resource (resource_type and resource_id), and
+// by date range (from and to, both inclusive, in the format YYYY-MM-DD).
+func (app *application) listAuditLogHandler(w http.ResponseWriter, r *http.Request) {
+	v := validator.New()
+	qs := r.URL.Query()
+
+	auditFilters := data.AuditFilters{
+		UserID:       app.readUserFilter(r, qs, "user_id", v),
+		ResourceType: app.readStrings(qs, "resource_type", ""),
+		ResourceID:   int64(app.readInt(qs, "resource_id", 0, v)),
+		From:         app.readDate(qs, "from", time.Time{}, v),
+		To:           app.readDate(qs, "to", time.Time{}, v),
+	}
+
+	filters := data.Filters{
+		Page:         app.readInt(qs, "page", 1, v),
+		PageSize:     app.readInt(qs, "page_size", 20, v),
+		Sort:         app.readStrings(qs, "sort", "-id"),
+		SortSafeList: []string{"id", "-id"},
+	}
+
+	data.ValidateAuditFilters(v, auditFilters)
+
+	if data.ValidateFilters(v, filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	entries, metadata, err := app.models.Audit.GetAll(r.Context(), auditFilters, filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"audit_log": entries, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
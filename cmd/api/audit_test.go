@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/codeaucafe/snippetbox/greenlight/internal/data"
+	"github.com/codeaucafe/snippetbox/greenlight/internal/testutil"
+)
+
+// TestAuditLog tests that creating and updating a movie are recorded in the audit log with the
+// user who made them and the fields which changed, and that only admins can list the log.
+func TestAuditLog(t *testing.T) {
+	app, fx := newTestDBApp(t)
+	ts := newTestServer(app.routes())
+	defer ts.Close()
+
+	user := fx.User(nil, "movies:read", "movies:write")
+	writer := fx.Token(user, data.ScopeAuthentication)
+	admin := fx.Token(fx.User(nil, "audit:admin"), data.ScopeAuthentication)
+
+	code, _, body := ts.request(t, http.MethodPost, "/v1/movies", writer.Plaintext,
+		`{"title": "Moana", "year": 2016, "runtime": "107 mins", "genres": ["animation"]}`)
+	testutil.Status(t, code, body, http.StatusCreated)
+
+	var created struct {
+		Movie data.Movie `json:"movie"`
+	}
+	testutil.DecodeJSON(t, body, &created)
+
+	code, _, body = ts.requestWithHeaders(t, http.MethodPatch, fmt.Sprintf("/v1/movies/%d", created.Movie.ID),
+		writer.Plaintext, `{"year": 2017}`, http.Header{"If-Match": {`"1"`}})
+	testutil.Status(t, code, body, http.StatusOK)
+
+	path := fmt.Sprintf("/v1/audit?resource_type=movies&resource_id=%d&user_id=%d", created.Movie.ID, user.ID)
+
+	code, _, body = ts.request(t, http.MethodGet, path, writer.Plaintext, "")
+	testutil.Status(t, code, body, http.StatusForbidden)
+
+	code, _, body = ts.request(t, http.MethodGet, path, admin.Plaintext, "")
+	testutil.Status(t, code, body, http.StatusOK)
+
+	var got struct {
+		Entries []data.AuditEntry `json:"audit_log"`
+	}
+	testutil.DecodeJSON(t, body, &got)
+
+	testutil.Equal(t, len(got.Entries), 2)
+	testutil.Equal(t, got.Entries[0].Action, data.AuditUpdate)
+	testutil.Equal(t, string(got.Entries[0].Changes["year"].Before), "2016")
+	testutil.Equal(t, string(got.Entries[0].Changes["year"].After), "2017")
+	testutil.Equal(t, got.Entries[1].Action, data.AuditCreate)
+	testutil.Equal(t, string(got.Entries[1].Changes["title"].After), `"Moana"`)
+
+	code, _, body = ts.request(t, http.MethodGet, "/v1/audit?resource_type=nonsense", admin.Plaintext, "")
+	testutil.Status(t, code, body, http.StatusUnprocessableEntity)
+}
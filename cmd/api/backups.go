@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/codeaucafe/snippetbox/greenlight/internal/backup"
+	"github.com/codeaucafe/snippetbox/greenlight/internal/data"
+	"github.com/codeaucafe/snippetbox/greenlight/internal/jsonlog"
+	"github.com/codeaucafe/snippetbox/greenlight/internal/storage"
+)
+
+// runCommand runs the subcommand given after the flags, instead of starting the server:
+//
+//   - backup and restore back up and restore the database (see runBackupCommand()).
+//   - routes lists the routes (see runRoutesCommand()).
+//   - openapi writes the OpenAPI document (see runOpenAPICommand()).
+//
+// The backup and restore subcommands only need the database DSN and the backup and storage
+// settings, and the others don't touch the database at all.
+func runCommand(cfg config, logger *jsonlog.Logger, args []string) error {
+	switch args[0] {
+	case "backup", "restore":
+		return runBackupCommand(cfg, logger, args)
+	case "routes":
+		return runRoutesCommand(cfg, os.Stdout)
+	case "openapi":
+		return runOpenAPICommand(cfg, os.Stdout)
+	default:
+		return fmt.Errorf("unknown command %q", args[0])
+	}
+}
+
+// backupTimeout is the longest that a single backup or restore is allowed to run for.
+const backupTimeout = time.Hour
+
+// runBackupCommand runs the "backup" and "restore" subcommands, which let an operator back up
+// and restore the database from the command line without starting the API server. For example:
+//
+//	$ go run ./cmd/api -db-dsn=$GREENLIGHT_DB_DSN backup
+//	$ go run ./cmd/api -db-dsn=$GREENLIGHT_DB_DSN restore greenlight-20220601T120000Z.dump
+//	$ go run ./cmd/api -db-dsn=$GREENLIGHT_DB_DSN restore ./greenlight.dump
+//
+// Backups are kept in the configured object store. A backup to restore is named as it's listed
+// by the "GET /v1/admin/backups" endpoint, or given as a path to a local file. It returns an
+// error if the subcommand fails or its arguments are invalid.
+func runBackupCommand(cfg config, logger *jsonlog.Logger, args []string) error {
+	objects, err := openStorage(cfg)
+	if err != nil {
+		return err
+	}
+
+	store := newBackupStore(cfg, objects)
+
+	ctx, cancel := context.WithTimeout(context.Background(), backupTimeout)
+	defer cancel()
+
+	switch args[0] {
+	case "backup":
+		if len(args) != 1 {
+			return errors.New("usage: backup")
+		}
+
+		file, err := store.Backup(ctx)
+		if err != nil {
+			return err
+		}
+
+		logger.PrintInfo("backup completed", map[string]string{
+			"file": file.Name,
+			"size": fmt.Sprintf("%d", file.Size),
+		})
+	case "restore":
+		if len(args) != 2 {
+			return errors.New("usage: restore <backup file>")
+		}
+
+		err := store.Restore(ctx, args[1])
+		if err != nil {
+			return err
+		}
+
+		logger.PrintInfo("restore completed", map[string]string{"file": args[1]})
+	default:
+		return fmt.Errorf("unknown command %q", args[0])
+	}
+
+	return nil
+}
+
+// newBackupStore returns the backup.Store for the configured database, which keeps its backups in
+// the given object store.
+func newBackupStore(cfg config, objects storage.Store) backup.Store {
+	return backup.Store{
+		DSN:       cfg.db.dsn,
+		Objects:   objects,
+		Retention: cfg.backup.retention,
+	}
+}
+
+// backupHeartbeat is how often a running backup task records that it's still alive, so that it
+// isn't mistaken for an abandoned task (see taskStaleAfter) while pg_dump is running.
+const backupHeartbeat = time.Minute
+
+// createBackupHandler handles the "POST /v1/admin/backups" endpoint. It queues a task which backs
+// up the database, and returns a 202 Accepted response with the task straight away. Only one
+// backup can be queued or running at a time, so a 409 Conflict response is sent if there's one
+// already. Old backups are pruned according to the -backup-retention flag once the new one is
+// written.
+func (app *application) createBackupHandler(w http.ResponseWriter, r *http.Request) {
+	task := &data.Task{
+		UserID: app.contextGetUser(r).ID,
+		Kind:   data.TaskKindBackup,
+	}
+
+	err := app.models.Tasks.InsertExclusive(r.Context(), task)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrTaskInProgress):
+			app.backupInProgressResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.taskAcceptedResponse(w, r, task, nil)
+}
+
+// runBackupTask runs a backup task, and returns the location of the list of backups. A backup
+// doesn't report its progress as it goes, so the progress is left at 0 until it completes, but
+// it's recorded regularly to show that the task is still running.
+func (app *application) runBackupTask(_ *data.Task, progress func(int)) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), backupTimeout)
+	defer cancel()
+
+	go func() {
+		ticker := time.NewTicker(backupHeartbeat)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				progress(0)
+			}
+		}
+	}()
+
+	file, err := newBackupStore(app.config, app.storage).Backup(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	app.logger.PrintInfo("backup completed", map[string]string{
+		"file": file.Name,
+		"size": fmt.Sprintf("%d", file.Size),
+	})
+
+	return "/v1/admin/backups", nil
+}
+
+// listBackupsHandler handles the "GET /v1/admin/backups" endpoint and returns the backups which
+// are currently kept in object storage, newest first.
+func (app *application) listBackupsHandler(w http.ResponseWriter, r *http.Request) {
+	files, err := newBackupStore(app.config, app.storage).List(r.Context())
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"backups": files}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
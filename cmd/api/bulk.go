@@ -0,0 +1,468 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/codeaucafe/snippetbox/greenlight/internal/data"
+	"github.com/codeaucafe/snippetbox/greenlight/internal/validator"
+)
+
+const (
+	// maxBulkImportBytes is the largest request body accepted by the bulk import endpoint.
+	maxBulkImportBytes = 50 << 20
+	// maxBulkImportRecords is the most movies which can be imported in a single request.
+	maxBulkImportRecords = 10_000
+	// bulkImportBatchSize is the number of movies inserted in each transaction.
+	bulkImportBatchSize = 500
+	// bulkExportFlushRows is how many movies the bulk export writes between flushes, so that
+	// the client receives the export steadily rather than when the write buffer fills.
+	bulkExportFlushRows = 100
+)
+
+// bulkMovieInput holds a single movie record from a bulk import. It has the same fields as the
+// body of the "POST /v1/movies" endpoint.
+type bulkMovieInput struct {
+	Title   string       `json:"title"`
+	Year    int32        `json:"year"`
+	Runtime data.Runtime `json:"runtime"`
+	Genres  []string     `json:"genres"`
+}
+
+// bulkImportResult is the outcome of importing a single record. Row is the position of the
+// record in the body, starting at 1 and not counting the CSV header row or blank NDJSON lines.
+// ID is set if the movie was created, and Errors if it wasn't.
+type bulkImportResult struct {
+	Row    int               `json:"row"`
+	ID     int64             `json:"id,omitempty"`
+	Errors map[string]string `json:"errors,omitempty"`
+}
+
+// bulkRecordFunc is called by the bulk readers with each record in turn. If the record couldn't
+// be parsed then input is nil and errs says why.
+type bulkRecordFunc func(row int, input *bulkMovieInput, errs map[string]string) error
+
+// errExportInterrupted is returned from the bulk export's callback when the server starts shutting
+// down part way through an export.
+var errExportInterrupted = errors.New("export interrupted by server shutdown")
+
+// errTooManyBulkRecords is returned by the bulk readers when the body holds more than
+// maxBulkImportRecords records.
+var errTooManyBulkRecords = fmt.Errorf("body must not contain more than %d records", maxBulkImportRecords)
+
+// bulkImportMoviesHandler handles the "POST /v1/movies/bulk" endpoint and imports a batch of
+// movies. The body can be NDJSON (one JSON movie per line), CSV (with a header row naming the
+// title, year, runtime and genres columns, and the genres separated by semicolons, in the same
+// layout as the CSV exports) or a JSON array of movies, according to its Content-Type.
+//
+// Each record is validated in the same way as for "POST /v1/movies", and the valid ones are
+// inserted in transactions of bulkImportBatchSize movies. A record which can't be parsed or is
+// invalid doesn't stop the rest from being imported: the response holds a result for every
+// record, with either the ID of the created movie or the errors which kept it out. The body as a
+// whole is only rejected if it's the wrong type, too large, or can't be read at all.
+func (app *application) bulkImportMoviesHandler(w http.ResponseWriter, r *http.Request) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+
+	var results []*bulkImportResult
+	var movies []*data.Movie
+	var created []*bulkImportResult
+
+	record := func(row int, input *bulkMovieInput, errs map[string]string) error {
+		if row > maxBulkImportRecords {
+			return errTooManyBulkRecords
+		}
+
+		result := &bulkImportResult{Row: row, Errors: errs}
+		results = append(results, result)
+
+		if input == nil {
+			return nil
+		}
+
+		movie := &data.Movie{
+			Title:   input.Title,
+			Year:    input.Year,
+			Runtime: input.Runtime,
+			Genres:  input.Genres,
+		}
+
+		v := validator.New()
+
+		if data.ValidateMovie(v, movie, app.config.movieLimits); !v.Valid() {
+			result.Errors = v.Errors
+			return nil
+		}
+
+		movies = append(movies, movie)
+		created = append(created, result)
+		return nil
+	}
+
+	var err error
+
+	switch mediaType {
+	case "application/x-ndjson", "application/ndjson":
+		err = readNDJSONMovies(w, r, record)
+	case "text/csv":
+		err = readCSVMovies(w, r, record)
+	case "application/json":
+		err = readJSONArray(w, r, maxBulkImportBytes, func(i int, input *bulkMovieInput) error {
+			return record(i+1, input, nil)
+		})
+	default:
+		app.unsupportedMediaTypeResponse(w, r, "application/x-ndjson, text/csv or application/json")
+		return
+	}
+
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	// Insert the valid movies a batch at a time. If a batch fails then the earlier batches have
+	// already been committed, so the error is logged along with the number of movies which were
+	// created.
+	for start := 0; start < len(movies); start += bulkImportBatchSize {
+		end := start + bulkImportBatchSize
+		if end > len(movies) {
+			end = len(movies)
+		}
+
+		err := app.models.Movies.InsertBatch(r.Context(), movies[start:end])
+		if err != nil {
+			app.logger.PrintInfo("bulk import failed part way through", map[string]string{
+				"created": strconv.Itoa(start),
+			})
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		for i, movie := range movies[start:end] {
+			created[start+i].ID = movie.ID
+		}
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{
+		"results": results,
+		"created": len(movies),
+		"failed":  len(results) - len(movies),
+	}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// readNDJSONMovies reads a body of newline-delimited JSON movies, calling fn with each one. A line
+// which isn't a valid movie is passed to fn with the reason, so that the rest of the lines can
+// still be imported.
+func readNDJSONMovies(w http.ResponseWriter, r *http.Request, fn bulkRecordFunc) error {
+	r.Body = http.MaxBytesReader(w, r.Body, maxBulkImportBytes)
+
+	scanner := bufio.NewScanner(r.Body)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1_048_576)
+
+	row := 0
+
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+
+		row++
+
+		var input bulkMovieInput
+
+		dec := json.NewDecoder(bytes.NewReader(line))
+		dec.DisallowUnknownFields()
+
+		err := dec.Decode(&input)
+		if err == nil && dec.More() {
+			err = errors.New("line must only contain a single JSON value")
+		}
+
+		if err != nil {
+			err = fn(row, nil, map[string]string{"record": decodeJSONError(err, len(line)).Error()})
+		} else {
+			err = fn(row, &input, nil)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	err := scanner.Err()
+	if err != nil {
+		switch {
+		case err.Error() == "http: request body too large":
+			return fmt.Errorf("body must not be larger than %d bytes", maxBulkImportBytes)
+		case errors.Is(err, bufio.ErrTooLong):
+			return fmt.Errorf("line %d is longer than 1048576 bytes", row+1)
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
+
+// readCSVMovies reads a CSV body of movies, calling fn with each one. The first row must be a
+// header naming the columns, which can be any of title, year, runtime and genres in any order.
+// An id column is ignored, so that a CSV export can be imported as it is. A row which can't be
+// parsed is passed to fn with the reasons, so that the rest of the rows can still be imported.
+func readCSVMovies(w http.ResponseWriter, r *http.Request, fn bulkRecordFunc) error {
+	r.Body = http.MaxBytesReader(w, r.Body, maxBulkImportBytes)
+
+	cr := csv.NewReader(r.Body)
+	cr.TrimLeadingSpace = true
+
+	header, err := cr.Read()
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			return errors.New("body must contain a CSV header row")
+		}
+		return csvBodyError(err)
+	}
+
+	columns := make(map[string]int, len(header))
+
+	for i, name := range header {
+		name = strings.ToLower(strings.TrimSpace(name))
+
+		if name == "id" {
+			continue
+		}
+
+		if !validator.In(name, "title", "year", "runtime", "genres") {
+			return fmt.Errorf("unknown CSV column %q: must be one of title, year, runtime or genres", name)
+		}
+
+		if _, ok := columns[name]; ok {
+			return fmt.Errorf("duplicate CSV column %q", name)
+		}
+
+		columns[name] = i
+	}
+
+	for row := 1; ; row++ {
+		fields, err := cr.Read()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+
+		if err != nil {
+			// A row with the wrong number of fields is only a problem with that row, and the
+			// reader carries on from the next one.
+			if errors.Is(err, csv.ErrFieldCount) {
+				err = fn(row, nil, map[string]string{"record": fmt.Sprintf("must have %d fields", len(header))})
+				if err != nil {
+					return err
+				}
+				continue
+			}
+			return csvBodyError(err)
+		}
+
+		input, errs := parseCSVMovie(columns, fields)
+		if len(errs) > 0 {
+			err = fn(row, nil, errs)
+		} else {
+			err = fn(row, input, nil)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// parseCSVMovie converts the fields of a CSV row into a bulkMovieInput, returning the errors for
+// any fields which can't be parsed. The runtime can be a number of minutes or any of the formats
+// accepted in JSON, such as "102 mins".
+func parseCSVMovie(columns map[string]int, fields []string) (*bulkMovieInput, map[string]string) {
+	v := validator.New()
+	input := &bulkMovieInput{}
+
+	field := func(name string) string {
+		if i, ok := columns[name]; ok {
+			return strings.TrimSpace(fields[i])
+		}
+		return ""
+	}
+
+	input.Title = field("title")
+
+	if year := field("year"); year != "" {
+		n, err := strconv.ParseInt(year, 10, 32)
+		v.Check(err == nil, "year", "must be an integer value")
+		input.Year = int32(n)
+	}
+
+	if runtime := field("runtime"); runtime != "" {
+		js := runtime
+		if _, err := strconv.Atoi(runtime); err != nil {
+			js = strconv.Quote(runtime)
+		}
+
+		err := input.Runtime.UnmarshalJSON([]byte(js))
+		v.Check(err == nil, "runtime", "must be a number of minutes or in the format \"<runtime> mins\"")
+	}
+
+	if genres := field("genres"); genres != "" {
+		for _, genre := range strings.Split(genres, ";") {
+			input.Genres = append(input.Genres, strings.TrimSpace(genre))
+		}
+	}
+
+	return input, v.Errors
+}
+
+// csvBodyError converts an error from reading a CSV body into one which can be sent to the
+// client.
+func csvBodyError(err error) error {
+	if err.Error() == "http: request body too large" {
+		return fmt.Errorf("body must not be larger than %d bytes", maxBulkImportBytes)
+	}
+
+	return fmt.Errorf("body contains badly-formed CSV: %w", err)
+}
+
+// exportMoviesHandler handles the "GET /v1/movies/export" endpoint and streams every movie which
+// matches the title, genres and created_by filters (as for "GET /v1/movies"), in the order given
+// by the sort parameter. The format parameter chooses between NDJSON (the default), with one movie
+// per line in the same shape as the other endpoints, and CSV, in the same layout as the scheduled
+// exports. The response is a file download, named after the format and today's date.
+//
+// The movies are written as they're read from the database, so the export never holds the whole
+// catalog in memory. That means the response has already started by the time anything can go
+// wrong part way through, so the status code can't be changed: instead the connection is aborted,
+// so that the client sees a failed download rather than a file which looks complete but isn't.
+// The same happens if the server starts shutting down during an export. Exports are still subject
+// to the server's write timeout.
+func (app *application) exportMoviesHandler(w http.ResponseWriter, r *http.Request) {
+	v := validator.New()
+	qs := r.URL.Query()
+
+	format := app.readStrings(qs, "format", "ndjson")
+	title := app.readStrings(qs, "title", "")
+	genres := app.readCSV(qs, "genres", []string{})
+	createdBy := app.readUserFilter(r, qs, "created_by", v)
+
+	// The whole catalog is exported, so the page and page size are only set to pass validation.
+	filters := data.Filters{
+		Page:     1,
+		PageSize: 1,
+		Sort:     app.readStrings(qs, "sort", "id"),
+		SortSafeList: []string{
+			"id", "title", "year", "runtime",
+			"-id", "-title", "-year", "-runtime",
+		},
+	}
+
+	v.Check(validator.In(format, "ndjson", "csv"), "format", "must be one of ndjson or csv")
+
+	if data.ValidateFilters(v, filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	closing, done := app.streams.track("export")
+	defer done()
+
+	flusher, _ := w.(http.Flusher)
+	cw := csv.NewWriter(w)
+	rows := 0
+
+	// start writes the response headers, along with the CSV header row. It's called before the
+	// first movie is written, or once the stream has finished if there were no movies at all.
+	start := func() error {
+		contentType := "application/x-ndjson"
+		if format == "csv" {
+			contentType = "text/csv"
+		}
+
+		filename := fmt.Sprintf("movies-%s.%s", app.clock.Now().UTC().Format("20060102"), format)
+
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`"`)
+		w.WriteHeader(http.StatusOK)
+
+		if format == "csv" {
+			return cw.Write(movieCSVHeader)
+		}
+		return nil
+	}
+
+	err := app.models.Movies.Stream(r.Context(), title, genres, createdBy, filters, func(movie *data.Movie) error {
+		select {
+		case <-closing:
+			return errExportInterrupted
+		default:
+		}
+
+		if rows == 0 {
+			if err := start(); err != nil {
+				return err
+			}
+		}
+
+		rows++
+
+		switch format {
+		case "csv":
+			err := cw.Write(movieCSVRecord(movie))
+			if err != nil {
+				return err
+			}
+		default:
+			shaped, err := shapeResponse(movie, w.Header())
+			if err != nil {
+				return err
+			}
+
+			js, err := json.Marshal(shaped)
+			if err != nil {
+				return err
+			}
+
+			_, err = w.Write(append(js, '\n'))
+			if err != nil {
+				return err
+			}
+		}
+
+		if rows%bulkExportFlushRows == 0 {
+			cw.Flush()
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+
+		return cw.Error()
+	})
+	if err == nil && rows == 0 {
+		err = start()
+	}
+	if err == nil {
+		cw.Flush()
+		err = cw.Error()
+	}
+
+	if err != nil {
+		if rows == 0 {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		app.logError(r, err)
+		panic(http.ErrAbortHandler)
+	}
+}
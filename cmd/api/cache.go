@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/felixge/httpsnoop"
+)
+
+// Cache-Control policies for routes which shouldn't be cached publicly. Responses which could
+// hold user-specific or sensitive data (such as tokens) use no-store, which is also the default
+// for any route without a policy of its own.
+const (
+	cacheNoStore = "no-store"
+	cacheNoCache = "no-cache"
+)
+
+// cachePublic returns a Cache-Control policy which allows any cache (including shared caches,
+// such as CDNs) to store a response for up to maxAge. It's only for routes which anonymous
+// clients can use, as a shared cache would serve a response to a route which needs a permission
+// to clients who haven't been authenticated.
+func cachePublic(maxAge time.Duration) string {
+	return fmt.Sprintf("public, max-age=%d", int(maxAge.Seconds()))
+}
+
+// cachePrivate returns a Cache-Control policy which allows the client's own cache, but not shared
+// caches, to store a response for up to maxAge. It's for routes which need a permission, whose
+// responses can be reused by the client which was allowed to see them.
+func cachePrivate(maxAge time.Duration) string {
+	return fmt.Sprintf("private, max-age=%d", int(maxAge.Seconds()))
+}
+
+// cacheControl sets the Cache-Control header on every response, using the policy for the
+// matched route pattern (such as "GET /v1/movies/:id") from the policies map. Routes without a
+// policy, and any response which isn't successful, get the cacheNoStore policy, so that errors
+// are never cached. Handlers which set their own Cache-Control header are left alone.
+//
+// The route is only known once the router has matched the request, which is after this
+// middleware has run, so we wrap the ResponseWriter and set the header just before the response
+// headers are written.
+func (app *application) cacheControl(policies map[string]string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r, route := app.contextSetRouteInfo(r)
+
+		applied := false
+		apply := func(status int) {
+			if applied {
+				return
+			}
+			applied = true
+
+			if w.Header().Get("Cache-Control") != "" {
+				return
+			}
+
+			policy := cacheNoStore
+			if p, ok := policies[route.pattern]; ok && (status < 300 || status == http.StatusNotModified) {
+				policy = p
+			}
+
+			w.Header().Set("Cache-Control", policy)
+		}
+
+		hooks := httpsnoop.Hooks{
+			WriteHeader: func(next httpsnoop.WriteHeaderFunc) httpsnoop.WriteHeaderFunc {
+				return func(code int) {
+					apply(code)
+					next(code)
+				}
+			},
+			Write: func(next httpsnoop.WriteFunc) httpsnoop.WriteFunc {
+				return func(b []byte) (int, error) {
+					apply(http.StatusOK)
+					return next(b)
+				}
+			},
+			ReadFrom: func(next httpsnoop.ReadFromFunc) httpsnoop.ReadFromFunc {
+				return func(src io.Reader) (int64, error) {
+					apply(http.StatusOK)
+					return next(src)
+				}
+			},
+		}
+
+		next.ServeHTTP(httpsnoop.Wrap(w, hooks), r)
+	})
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// TestCacheControl checks that the route's policy is only used for successful responses, and
+// that everything else gets no-store.
+func TestCacheControl(t *testing.T) {
+	policies := map[string]string{"GET /v1/movies": "private, max-age=60"}
+
+	tests := []struct {
+		name    string
+		pattern string
+		status  int
+		want    string
+	}{
+		{name: "policy", pattern: "GET /v1/movies", status: http.StatusOK, want: "private, max-age=60"},
+		{name: "not modified", pattern: "GET /v1/movies", status: http.StatusNotModified, want: "private, max-age=60"},
+		{name: "error", pattern: "GET /v1/movies", status: http.StatusNotFound, want: cacheNoStore},
+		{name: "no policy", pattern: "POST /v1/tokens/authentication", status: http.StatusCreated, want: cacheNoStore},
+		{name: "unmatched", pattern: "", status: http.StatusNotFound, want: cacheNoStore},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApp()
+
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if tt.pattern != "" {
+					_, route := app.contextSetRouteInfo(r)
+					route.pattern = tt.pattern
+				}
+				w.WriteHeader(tt.status)
+			})
+
+			rr := httptest.NewRecorder()
+			app.cacheControl(policies, next).ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/", nil))
+
+			if got := rr.Header().Get("Cache-Control"); got != tt.want {
+				t.Errorf("want %q; got %q", tt.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,430 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"math"
+	"net/http"
+	"runtime/metrics"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/felixge/httpsnoop"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	// compressedResponses counts the responses which were gzipped.
+	compressedResponses = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "greenlight",
+		Name:      "compressed_responses_total",
+		Help:      "Number of responses compressed with gzip.",
+	})
+
+	// compressionSkipped counts the responses which the client would have accepted gzipped, but
+	// which weren't compressed because the CPU was constrained.
+	compressionSkipped = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "greenlight",
+		Name:      "compression_skipped_total",
+		Help:      "Number of responses left uncompressed because the CPU was constrained.",
+	})
+
+	// schedulingLatency is the average time that goroutines waited to be run over the last
+	// cpuSampleInterval, in seconds.
+	schedulingLatency = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "greenlight",
+		Name:      "scheduling_latency_seconds",
+		Help:      "Average time goroutines waited to be scheduled over the last sample interval.",
+	})
+)
+
+// cpuSampleInterval is how often the cpuMonitor samples the scheduling latency.
+const cpuSampleInterval = time.Second
+
+// schedLatencyMetric is the runtime metric holding the distribution of the time goroutines have
+// spent runnable before they were run.
+const schedLatencyMetric = "/sched/latencies:seconds"
+
+// cpuMonitor tracks whether the CPU is constrained, so that optional work like compression can
+// be skipped while it is. It goes by the scheduling latency: the time that goroutines spend
+// waiting to run once they're runnable. That stays close to zero while there are idle cores,
+// and climbs as soon as there is more work than the CPUs (or the container's CPU quota) can keep
+// up with, whatever the cause.
+//
+// A nil *cpuMonitor is valid, and never reports that the CPU is constrained.
+type cpuMonitor struct {
+	maxLatency time.Duration
+	latency    int64
+	sample     []metrics.Sample
+	last       *metrics.Float64Histogram
+}
+
+// newCPUMonitor returns a new cpuMonitor, which reports that the CPU is constrained while the
+// average scheduling latency is above maxLatency.
+func newCPUMonitor(maxLatency time.Duration) *cpuMonitor {
+	return &cpuMonitor{
+		maxLatency: maxLatency,
+		sample:     []metrics.Sample{{Name: schedLatencyMetric}},
+	}
+}
+
+// record samples the scheduling latency histogram and works out the average latency since the
+// previous sample. It's only called from the monitorCPUPeriodically() goroutine.
+func (m *cpuMonitor) record() {
+	metrics.Read(m.sample)
+
+	// The metric isn't available on every Go runtime, in which case the CPU is never reported
+	// as constrained.
+	if m.sample[0].Value.Kind() != metrics.KindFloat64Histogram {
+		return
+	}
+
+	current := m.sample[0].Value.Float64Histogram()
+
+	if m.last != nil {
+		if mean, ok := histogramMeanSince(m.last, current); ok {
+			atomic.StoreInt64(&m.latency, int64(mean*float64(time.Second)))
+			schedulingLatency.Set(mean)
+		}
+	}
+
+	m.last = current
+}
+
+// constrained reports whether the average scheduling latency over the last sample interval was
+// above the maximum.
+func (m *cpuMonitor) constrained() bool {
+	if m == nil {
+		return false
+	}
+
+	return time.Duration(atomic.LoadInt64(&m.latency)) > m.maxLatency
+}
+
+// histogramMeanSince returns the approximate mean of the values added to a cumulative runtime
+// histogram between two readings of it, taking each value as the middle of its bucket (or the
+// finite edge, for the open-ended buckets at either end). It returns false if no values were
+// added.
+func histogramMeanSince(prev, cur *metrics.Float64Histogram) (float64, bool) {
+	var count uint64
+	var sum float64
+
+	for i, n := range cur.Counts {
+		if i < len(prev.Counts) {
+			n -= prev.Counts[i]
+		}
+		if n == 0 {
+			continue
+		}
+
+		lower, upper := cur.Buckets[i], cur.Buckets[i+1]
+
+		var value float64
+		switch {
+		case math.IsInf(lower, -1):
+			value = upper
+		case math.IsInf(upper, 1):
+			value = lower
+		default:
+			value = (lower + upper) / 2
+		}
+
+		count += n
+		sum += float64(n) * value
+	}
+
+	if count == 0 {
+		return 0, false
+	}
+
+	return sum / float64(count), true
+}
+
+// monitorCPUPeriodically samples the scheduling latency once every cpuSampleInterval, for the
+// cpuMonitor.
+func (app *application) monitorCPUPeriodically() {
+	for {
+		app.cpu.record()
+		time.Sleep(cpuSampleInterval)
+	}
+}
+
+// acceptsGzip reports whether an Accept-Encoding header value allows a gzipped response, either
+// by naming gzip or with the "*" wildcard, without a q-value of zero.
+func acceptsGzip(header string) bool {
+	for _, part := range strings.Split(header, ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		coding = strings.ToLower(strings.TrimSpace(coding))
+
+		if coding != "gzip" && coding != "*" {
+			continue
+		}
+
+		params = strings.TrimSpace(params)
+		if strings.HasPrefix(params, "q=") {
+			if v, err := strconv.ParseFloat(strings.TrimPrefix(params, "q="), 64); err == nil && v == 0 {
+				return false
+			}
+		}
+
+		return true
+	}
+
+	return false
+}
+
+// compressible reports whether a response with the given Content-Type is worth compressing.
+// Images, audio, video and archives are already compressed, so gzipping them just burns CPU.
+func compressible(contentType string) bool {
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	mediaType = strings.ToLower(strings.TrimSpace(mediaType))
+
+	switch {
+	case strings.HasPrefix(mediaType, "image/") && mediaType != "image/svg+xml",
+		strings.HasPrefix(mediaType, "audio/"),
+		strings.HasPrefix(mediaType, "video/"):
+		return false
+	}
+
+	switch mediaType {
+	case "application/gzip", "application/zip", "application/zstd", "application/x-bzip2":
+		return false
+	}
+
+	return true
+}
+
+// compress is middleware which gzips responses for clients that accept it, as long as they're at
+// least -compression-min-size bytes long. Smaller responses, like most error messages, are
+// barely shrunk by gzip, so compressing them is a waste of CPU. Compression is skipped entirely
+// while the CPU is constrained (see cpuMonitor), as sending a few more bytes is cheaper than
+// making every request wait longer to be scheduled.
+//
+// The response is held back until either -compression-min-size bytes have been written or the
+// handler finishes, so that we know whether to compress it before the headers are sent. Streaming
+// handlers which flush early are only compressed if enough had been written by the first flush.
+func (app *application) compress(next http.Handler) http.Handler {
+	if !app.config.compression.enabled {
+		return next
+	}
+
+	minSize := app.config.compression.minSize
+	level := app.config.compression.level
+
+	pool := sync.Pool{
+		New: func() interface{} {
+			gz, _ := gzip.NewWriterLevel(io.Discard, level)
+			return gz
+		},
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The response varies by Accept-Encoding whether or not this one is compressed, so
+		// that caches don't hand a gzipped response to a client which didn't ask for one.
+		w.Header().Add("Vary", "Accept-Encoding")
+
+		if !acceptsGzip(r.Header.Get("Accept-Encoding")) || r.Method == http.MethodHead {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if app.cpu.constrained() {
+			compressionSkipped.Inc()
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		cw := &compressWriter{w: w, minSize: minSize, pool: &pool}
+
+		hooks := httpsnoop.Hooks{
+			WriteHeader: func(httpsnoop.WriteHeaderFunc) httpsnoop.WriteHeaderFunc {
+				return cw.writeHeader
+			},
+			Write: func(httpsnoop.WriteFunc) httpsnoop.WriteFunc {
+				return cw.write
+			},
+			ReadFrom: func(httpsnoop.ReadFromFunc) httpsnoop.ReadFromFunc {
+				return func(src io.Reader) (int64, error) {
+					return io.Copy(writerFunc(cw.write), src)
+				}
+			},
+			Flush: func(httpsnoop.FlushFunc) httpsnoop.FlushFunc {
+				return cw.flush
+			},
+		}
+
+		next.ServeHTTP(httpsnoop.Wrap(w, hooks), r)
+
+		// This isn't deferred: if the handler panics then whatever has been buffered is
+		// dropped, and the panic recovery middleware sends its error response instead.
+		err := cw.close()
+		if err != nil {
+			app.logger.PrintError(err, nil)
+		}
+	})
+}
+
+// writerFunc adapts a write function to the io.Writer interface.
+type writerFunc func([]byte) (int, error)
+
+func (f writerFunc) Write(b []byte) (int, error) {
+	return f(b)
+}
+
+// compressWriter buffers the start of a response until it knows whether to gzip it: as soon as
+// minSize bytes have been written the response is compressed, and if the handler finishes (or
+// flushes) first it's sent as it is.
+type compressWriter struct {
+	w       http.ResponseWriter
+	minSize int
+	pool    *sync.Pool
+
+	status  int
+	buf     []byte
+	decided bool
+	gz      *gzip.Writer
+}
+
+// writeHeader records the status code, to be sent once we've decided whether to compress the
+// response. Responses without a body are decided straight away.
+func (cw *compressWriter) writeHeader(code int) {
+	if cw.decided {
+		cw.w.WriteHeader(code)
+		return
+	}
+
+	// Informational responses are sent straight through, as they come before the real one.
+	if code >= 100 && code < 200 {
+		cw.w.WriteHeader(code)
+		return
+	}
+
+	if cw.status == 0 {
+		cw.status = code
+	}
+
+	if code == http.StatusNoContent || code == http.StatusNotModified {
+		cw.decide(false)
+	}
+}
+
+// write buffers b until the decision has been made, and then writes it through the gzip writer
+// or straight to the client.
+func (cw *compressWriter) write(b []byte) (int, error) {
+	if !cw.decided {
+		cw.buf = append(cw.buf, b...)
+		if len(cw.buf) >= cw.minSize {
+			cw.decide(true)
+			return len(b), cw.flushBuffer()
+		}
+		return len(b), nil
+	}
+
+	if cw.gz != nil {
+		return cw.gz.Write(b)
+	}
+	return cw.w.Write(b)
+}
+
+// flush decides whether to compress a streamed response, if that hasn't happened yet, and then
+// sends everything written so far to the client.
+func (cw *compressWriter) flush() {
+	if !cw.decided {
+		cw.decide(len(cw.buf) >= cw.minSize)
+		if err := cw.flushBuffer(); err != nil {
+			return
+		}
+	}
+
+	if cw.gz != nil {
+		if err := cw.gz.Flush(); err != nil {
+			return
+		}
+	}
+
+	if f, ok := cw.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// close finishes the response: a short response is sent uncompressed, and a compressed one has
+// its gzip footer written.
+func (cw *compressWriter) close() error {
+	if !cw.decided {
+		// The status code is only sent if something was written, so that handlers which
+		// never write anything still get net/http's implicit 200 OK.
+		if cw.status == 0 && len(cw.buf) == 0 {
+			return nil
+		}
+		cw.decide(false)
+		if err := cw.flushBuffer(); err != nil {
+			return err
+		}
+	}
+
+	if cw.gz == nil {
+		return nil
+	}
+
+	err := cw.gz.Close()
+	cw.gz.Reset(io.Discard)
+	cw.pool.Put(cw.gz)
+	cw.gz = nil
+
+	return err
+}
+
+// decide sends the response headers, with a gzip Content-Encoding if want is true and the
+// response is suitable for compression.
+func (cw *compressWriter) decide(want bool) {
+	cw.decided = true
+
+	status := cw.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+
+	h := cw.w.Header()
+
+	if h.Get("Content-Type") == "" && len(cw.buf) > 0 {
+		h.Set("Content-Type", http.DetectContentType(cw.buf))
+	}
+
+	// Responses which already have an encoding, partial content responses and responses which
+	// are already compressed are left alone.
+	if want && h.Get("Content-Encoding") == "" && status != http.StatusPartialContent &&
+		compressible(h.Get("Content-Type")) {
+		h.Set("Content-Encoding", "gzip")
+		h.Del("Content-Length")
+		h.Del("Accept-Ranges")
+
+		cw.gz = cw.pool.Get().(*gzip.Writer)
+		cw.gz.Reset(cw.w)
+		compressedResponses.Inc()
+	}
+
+	cw.w.WriteHeader(status)
+}
+
+// flushBuffer writes out the buffered start of the response, once the decision has been made.
+func (cw *compressWriter) flushBuffer() error {
+	buf := cw.buf
+	cw.buf = nil
+
+	if len(buf) == 0 {
+		return nil
+	}
+
+	var err error
+	if cw.gz != nil {
+		_, err = cw.gz.Write(buf)
+	} else {
+		_, err = cw.w.Write(buf)
+	}
+
+	return err
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"runtime/metrics"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/codeaucafe/snippetbox/greenlight/internal/testutil"
+)
+
+// TestCompress tests that only responses above the minimum size are gzipped, that the client's
+// Accept-Encoding header and the response's Content-Type are respected, and that compression is
+// skipped while the CPU is constrained.
+func TestCompress(t *testing.T) {
+	app := newTestApp()
+	app.config.compression.enabled = true
+	app.config.compression.minSize = 100
+	app.config.compression.level = gzip.DefaultCompression
+
+	large := strings.Repeat(`{"title":"Casablanca"}`, 20)
+
+	handler := app.compress(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/small":
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"error":"not found"}`))
+		case "/image":
+			w.Header().Set("Content-Type", "image/png")
+			_, _ = w.Write([]byte(large))
+		default:
+			w.Header().Set("Content-Type", "application/json")
+			// Write the body in pieces, so that the decision is made partway through.
+			for i := 0; i < len(large); i += 30 {
+				end := i + 30
+				if end > len(large) {
+					end = len(large)
+				}
+				_, _ = w.Write([]byte(large[i:end]))
+			}
+		}
+	}))
+
+	send := func(path, acceptEncoding string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		if acceptEncoding != "" {
+			r.Header.Set("Accept-Encoding", acceptEncoding)
+		}
+		handler.ServeHTTP(rr, r)
+		return rr
+	}
+
+	rr := send("/large", "br, gzip")
+	testutil.Equal(t, rr.Header().Get("Content-Encoding"), "gzip")
+	testutil.Equal(t, rr.Header().Get("Vary"), "Accept-Encoding")
+
+	gz, err := gzip.NewReader(rr.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.Equal(t, string(body), large)
+
+	rr = send("/small", "gzip")
+	testutil.Equal(t, rr.Code, http.StatusNotFound)
+	testutil.Equal(t, rr.Header().Get("Content-Encoding"), "")
+	testutil.Equal(t, rr.Body.String(), `{"error":"not found"}`)
+
+	testutil.Equal(t, send("/large", "").Header().Get("Content-Encoding"), "")
+	testutil.Equal(t, send("/large", "gzip;q=0").Header().Get("Content-Encoding"), "")
+	testutil.Equal(t, send("/image", "gzip").Header().Get("Content-Encoding"), "")
+
+	// While goroutines are waiting too long to be scheduled, nothing is compressed.
+	app.cpu = newCPUMonitor(time.Millisecond)
+	app.cpu.latency = int64(5 * time.Millisecond)
+
+	rr = send("/large", "gzip")
+	testutil.Equal(t, rr.Header().Get("Content-Encoding"), "")
+	testutil.Equal(t, rr.Body.String(), large)
+}
+
+// TestHistogramMeanSince tests that the mean scheduling latency only covers the values added to
+// the histogram since the previous reading.
+func TestHistogramMeanSince(t *testing.T) {
+	buckets := []float64{math.Inf(-1), 0, 0.002, 0.004, math.Inf(1)}
+
+	prev := &metrics.Float64Histogram{Counts: []uint64{0, 10, 0, 0}, Buckets: buckets}
+	cur := &metrics.Float64Histogram{Counts: []uint64{0, 10, 2, 2}, Buckets: buckets}
+
+	mean, ok := histogramMeanSince(prev, cur)
+	testutil.Equal(t, ok, true)
+	testutil.Equal(t, math.Round(mean*1e4)/1e4, 0.0035)
+
+	_, ok = histogramMeanSince(cur, cur)
+	testutil.Equal(t, ok, false)
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/codeaucafe/snippetbox/greenlight/internal/data"
+)
+
+// collectionETag returns a weak ETag for a page of a collection, built from the collection
+// version and the values of the parameters which select the page (such as the filters, page
+// number and sort order). It is weak because the same data could be encoded differently, for
+// example with a different response envelope.
+func collectionETag(version string, params ...string) string {
+	return `W/"` + data.FiltersFingerprint(append([]string{version}, params...)...) + `"`
+}
+
+// etagMatches reports whether an If-None-Match or If-Match header value matches the given
+// ETag. The header can hold a comma-separated list of ETags, or "*" to match any ETag. We use the
+// weak comparison from RFC 7232, ignoring any W/ prefix, which is what If-None-Match requires.
+func etagMatches(header, etag string) bool {
+	if header == "" {
+		return false
+	}
+
+	etag = strings.TrimPrefix(etag, "W/")
+
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+
+	return false
+}
+
+// etagMatchesStrong reports whether an If-Match header value matches the given ETag, using the
+// strong comparison from RFC 7232 which If-Match requires: weak ETags never match.
+func etagMatchesStrong(header, etag string) bool {
+	if strings.HasPrefix(etag, "W/") {
+		return false
+	}
+
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+
+	return false
+}
+
+// versionETag returns the strong ETag for a resource with an optimistic locking version number,
+// such as a movie. The version changes every time the resource is updated, so it identifies
+// the current state of the resource.
+func versionETag(version int32) string {
+	return `"` + strconv.FormatInt(int64(version), 10) + `"`
+}
+
+// movieETag returns the strong ETag for a movie. It's the movie's version ETag, along with its
+// average rating if it has one, as the average rating is part of the movie's representation but
+// changes with its reviews rather than its version.
+func movieETag(movie *data.Movie) string {
+	if movie.AverageRating == nil {
+		return versionETag(movie.Version)
+	}
+
+	return fmt.Sprintf(`"%d-%s"`, movie.Version, strconv.FormatFloat(*movie.AverageRating, 'f', -1, 64))
+}
+
+// movieETagMatches reports whether an If-Match header value matches a movie, for an update or
+// delete. Only the version part of each movie ETag is compared: the average rating changes with
+// every new review, and a review doesn't conflict with a change to the movie itself. As with
+// etagMatchesStrong, weak ETags never match.
+func movieETagMatches(header string, movie *data.Movie) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+
+		if candidate == "*" {
+			return true
+		}
+
+		if len(candidate) < 2 || !strings.HasPrefix(candidate, `"`) || !strings.HasSuffix(candidate, `"`) {
+			continue
+		}
+
+		version, _, _ := strings.Cut(candidate[1:len(candidate)-1], "-")
+		if version == strconv.FormatInt(int64(movie.Version), 10) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// notModifiedResponse sends a 304 Not Modified response with the given ETag, when the client's
+// cached copy of a resource (identified by the If-None-Match header) is still current.
+func (app *application) notModifiedResponse(w http.ResponseWriter, etag string) {
+	w.Header().Set("ETag", etag)
+	w.WriteHeader(http.StatusNotModified)
+}
+
+// bodyETag returns a strong ETag for a response body, built from its SHA-256 hash. Unlike the
+// version and collection ETags, it changes whenever the bytes of the response do, so it's
+// different for each representation of a resource (such as each response envelope).
+func bodyETag(body []byte) string {
+	sum := sha256.Sum256(body)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// bufferedResponseWriter holds back the status code and body written by a handler, so that
+// they can be inspected before they're sent. Headers are written straight to the underlying
+// http.ResponseWriter, but aren't sent until flush() is called.
+type bufferedResponseWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+// WriteHeader records the status code.
+func (bw *bufferedResponseWriter) WriteHeader(status int) {
+	if bw.status == 0 {
+		bw.status = status
+	}
+}
+
+// Write buffers the body, recording a 200 OK status code if one hasn't been written yet.
+func (bw *bufferedResponseWriter) Write(b []byte) (int, error) {
+	bw.WriteHeader(http.StatusOK)
+	return bw.body.Write(b)
+}
+
+// flush sends the status code and body to the underlying http.ResponseWriter.
+func (bw *bufferedResponseWriter) flush() error {
+	if bw.status == 0 {
+		bw.status = http.StatusOK
+	}
+
+	bw.ResponseWriter.WriteHeader(bw.status)
+	_, err := bw.ResponseWriter.Write(bw.body.Bytes())
+	return err
+}
+
+// conditionalGET is middleware for the routes which support conditional GET requests. It buffers
+// successful responses and, unless the handler has set an ETag of its own (such as a movie's
+// version ETag), gives them a strong ETag built from the body. A 304 Not Modified response is
+// sent instead of the body when the ETag matches the request's If-None-Match header, so clients
+// which revalidate their cached copy don't download it again. Handlers which can check the
+// If-None-Match header more cheaply, before doing the work of building the response, are free to
+// send the 304 response themselves, and it's passed through untouched.
+//
+// Because the response is buffered, this mustn't be used for routes which stream their responses.
+func (app *application) conditionalGET(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			next(w, r)
+			return
+		}
+
+		bw := &bufferedResponseWriter{ResponseWriter: w}
+		next(bw, r)
+
+		if bw.status == 0 || bw.status == http.StatusOK {
+			etag := w.Header().Get("ETag")
+			if etag == "" {
+				etag = bodyETag(bw.body.Bytes())
+			}
+
+			if etagMatches(r.Header.Get("If-None-Match"), etag) {
+				w.Header().Del("Content-Type")
+				app.notModifiedResponse(w, etag)
+				return
+			}
+
+			w.Header().Set("ETag", etag)
+		}
+
+		if err := bw.flush(); err != nil {
+			app.logger.PrintError(err, nil)
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/codeaucafe/snippetbox/greenlight/internal/data"
+	"github.com/codeaucafe/snippetbox/greenlight/internal/testutil"
+)
+
+// TestETagMatches checks the handling of ETag lists, wildcards and weak ETags in conditional
+// request headers.
+func TestETagMatches(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		etag   string
+		want   bool
+	}{
+		{name: "empty", header: "", etag: `"abc"`, want: false},
+		{name: "exact", header: `"abc"`, etag: `"abc"`, want: true},
+		{name: "weak", header: `W/"abc"`, etag: `"abc"`, want: true},
+		{name: "weak etag", header: `"abc"`, etag: `W/"abc"`, want: true},
+		{name: "list", header: `"xyz", W/"abc"`, etag: `W/"abc"`, want: true},
+		{name: "wildcard", header: "*", etag: `"abc"`, want: true},
+		{name: "mismatch", header: `"xyz"`, etag: `"abc"`, want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := etagMatches(tt.header, tt.etag); got != tt.want {
+				t.Errorf("want %t; got %t", tt.want, got)
+			}
+		})
+	}
+}
+
+// TestETagMatchesStrong checks that If-Match uses the strong comparison, so weak ETags never
+// match.
+func TestETagMatchesStrong(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		etag   string
+		want   bool
+	}{
+		{name: "exact", header: `"3"`, etag: `"3"`, want: true},
+		{name: "list", header: `"2", "3"`, etag: `"3"`, want: true},
+		{name: "wildcard", header: "*", etag: `"3"`, want: true},
+		{name: "weak header", header: `W/"3"`, etag: `"3"`, want: false},
+		{name: "weak etag", header: `"3"`, etag: `W/"3"`, want: false},
+		{name: "mismatch", header: `"2"`, etag: `"3"`, want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := etagMatchesStrong(tt.header, tt.etag); got != tt.want {
+				t.Errorf("want %t; got %t", tt.want, got)
+			}
+		})
+	}
+}
+
+// TestMovieETagMatches checks that If-Match is compared against the version part of a movie's
+// ETag, so that a new review doesn't make an update or delete fail.
+func TestMovieETagMatches(t *testing.T) {
+	rating := 7.5
+	movie := &data.Movie{Version: 3, AverageRating: &rating}
+
+	tests := []struct {
+		name   string
+		header string
+		want   bool
+	}{
+		{name: "current etag", header: movieETag(movie), want: true},
+		{name: "etag before a review", header: `"3-6"`, want: true},
+		{name: "etag before the first review", header: `"3"`, want: true},
+		{name: "list", header: `"2-7.5", "3-6"`, want: true},
+		{name: "wildcard", header: "*", want: true},
+		{name: "weak", header: `W/"3-7.5"`, want: false},
+		{name: "older version", header: `"2-7.5"`, want: false},
+		{name: "unquoted", header: "3", want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := movieETagMatches(tt.header, movie); got != tt.want {
+				t.Errorf("want %t; got %t", tt.want, got)
+			}
+		})
+	}
+}
+
+// TestConditionalGET checks that successful responses are given an ETag built from their body
+// unless the handler sets one itself, and that a matching If-None-Match header gets a 304 Not
+// Modified response without the body.
+func TestConditionalGET(t *testing.T) {
+	app := newTestApp()
+
+	tests := []struct {
+		name        string
+		etag        string
+		status      int
+		ifNoneMatch string
+		wantStatus  int
+		wantETag    string
+		wantBody    string
+	}{
+		{name: "body etag", status: http.StatusOK, wantStatus: http.StatusOK,
+			wantETag: bodyETag([]byte("hello")), wantBody: "hello"},
+		{name: "body etag matches", status: http.StatusOK, ifNoneMatch: bodyETag([]byte("hello")),
+			wantStatus: http.StatusNotModified, wantETag: bodyETag([]byte("hello"))},
+		{name: "handler etag", etag: `"3"`, status: http.StatusOK, ifNoneMatch: `"2"`,
+			wantStatus: http.StatusOK, wantETag: `"3"`, wantBody: "hello"},
+		{name: "handler etag matches", etag: `"3"`, status: http.StatusOK, ifNoneMatch: `W/"3"`,
+			wantStatus: http.StatusNotModified, wantETag: `"3"`},
+		{name: "error", status: http.StatusNotFound, ifNoneMatch: "*", wantStatus: http.StatusNotFound,
+			wantBody: "hello"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			next := func(w http.ResponseWriter, r *http.Request) {
+				if tt.etag != "" {
+					w.Header().Set("ETag", tt.etag)
+				}
+				w.WriteHeader(tt.status)
+				_, _ = w.Write([]byte("hello"))
+			}
+
+			r := httptest.NewRequest(http.MethodGet, "/v1/movies/1", nil)
+			if tt.ifNoneMatch != "" {
+				r.Header.Set("If-None-Match", tt.ifNoneMatch)
+			}
+
+			rr := httptest.NewRecorder()
+			app.conditionalGET(next)(rr, r)
+
+			testutil.Equal(t, rr.Code, tt.wantStatus)
+			testutil.Equal(t, rr.Header().Get("ETag"), tt.wantETag)
+			testutil.Equal(t, rr.Body.String(), tt.wantBody)
+		})
+	}
+}
@@ -0,0 +1,563 @@
+package main
+
+import (
+	"compress/gzip"
+	"flag"
+	"fmt"
+	"net"
+	"net/mail"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/codeaucafe/snippetbox/greenlight/internal/storage"
+	"github.com/codeaucafe/snippetbox/greenlight/internal/validator"
+	"github.com/redis/go-redis/v9"
+	"gopkg.in/yaml.v3"
+)
+
+// The environments for the -env flag.
+const (
+	envDevelopment = "development"
+	envStaging     = "staging"
+	envProduction  = "production"
+)
+
+// envPrefix is the prefix of the environment variables which configure the application.
+const envPrefix = "GREENLIGHT_"
+
+// envName returns the name of the environment variable for a command-line flag. For example,
+// the -db-dsn flag can be set with the GREENLIGHT_DB_DSN environment variable.
+func envName(flagName string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// applyEnv sets every flag in the flag set which wasn't given on the command line from its
+// environment variable (see envName()), if there is one. It must be called after the flags have
+// been parsed, so that flags given on the command line take precedence over the environment,
+// which in turn takes precedence over the defaults. The values are parsed by the flags
+// themselves, so an environment variable accepts exactly the same values as its flag.
+//
+// The environment is read through the lookup function (usually os.LookupEnv), so that tests
+// don't have to change the real environment. The flags which are set are recorded in sources.
+// Every invalid value is reported, together in a *configError, rather than just the first.
+func applyEnv(fs *flag.FlagSet, lookup func(string) (string, bool), sources configSources) error {
+	// Record which flags were given on the command line. fs.Visit() only visits those.
+	set := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+
+	problems := map[string]string{}
+
+	fs.VisitAll(func(f *flag.Flag) {
+		// The -version flag only makes sense on the command line.
+		if set[f.Name] || f.Name == "version" {
+			return
+		}
+
+		name := envName(f.Name)
+
+		val, ok := lookup(name)
+		if !ok {
+			return
+		}
+
+		sources[f.Name] = "from " + name
+
+		if err := f.Value.Set(val); err != nil {
+			problems[f.Name] = fmt.Sprintf("invalid value %q: %v", val, err)
+		}
+	})
+
+	if len(problems) > 0 {
+		return newConfigError(problems, sources)
+	}
+
+	return nil
+}
+
+// applyConfigFile sets every flag in the flag set which wasn't given on the command line from
+// the config file at the given path. YAML (.yaml or .yml) and TOML (.toml) files are supported.
+//
+// The keys in the file are the flag names, and they can be nested in sections which are joined
+// to the key with a hyphen. A dot in a key is a section separator too, in YAML as well as in
+// TOML, so all of these set the -db-max-open-conns flag:
+//
+//	db-max-open-conns: 50
+//
+//	db:
+//	  max-open-conns: 50
+//
+//	db.max-open-conns: 50
+//
+// Setting the same flag more than once, in different forms, is an error.
+//
+// Lists, such as the CORS origins, are joined with spaces. As with applyEnv(), the values are
+// parsed by the flags themselves. An unknown key is an error, so that a typo in the file fails
+// fast at startup rather than being silently ignored. A file which can't be read or decoded is
+// reported on its own, and otherwise every unknown key and invalid value is reported, together
+// in a *configError.
+//
+// It must be called after the flags have been parsed and before applyEnv(), which gives the
+// documented precedence: command-line flags, then environment variables, then the config file,
+// then the defaults. As with applyEnv(), the flags which are set are recorded in sources.
+func applyConfigFile(fs *flag.FlagSet, path string, sources configSources) error {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	settings := map[string]interface{}{}
+
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(raw, &settings)
+	case ".toml":
+		err = toml.Unmarshal(raw, &settings)
+	default:
+		return fmt.Errorf("config file %s: unsupported file extension %q (want .yaml, .yml or .toml)", path, ext)
+	}
+	if err != nil {
+		return fmt.Errorf("config file %s: %w", path, err)
+	}
+
+	values := map[string]string{}
+	problems := map[string]string{}
+
+	flattenConfig("", settings, values, problems)
+
+	// Record which flags were given on the command line, which take precedence over the file.
+	set := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+
+	for key, value := range values {
+		f := fs.Lookup(key)
+		if f == nil || key == "config" || key == "version" {
+			problems[key] = "unknown setting"
+			continue
+		}
+
+		if set[key] {
+			continue
+		}
+
+		err := f.Value.Set(value)
+		if err != nil {
+			problems[key] = fmt.Sprintf("invalid value %q: %v", value, err)
+			continue
+		}
+
+		sources[key] = "from " + path
+	}
+
+	// The problems are reported as coming from the file, so that it's clear where to fix them.
+	for key := range problems {
+		sources[key] = "from " + path
+	}
+
+	if len(problems) > 0 {
+		return newConfigError(problems, sources)
+	}
+
+	return nil
+}
+
+// flattenConfig flattens the nested sections of a decoded config file into the values map,
+// keyed by flag name. Dots in keys are treated as section separators. Keys without a value, and
+// flags which are set more than once, are added to problems instead.
+func flattenConfig(prefix string, settings map[string]interface{}, values, problems map[string]string) {
+	for key, value := range settings {
+		key = strings.ReplaceAll(key, ".", "-")
+		if prefix != "" {
+			key = prefix + "-" + key
+		}
+
+		var item string
+
+		switch v := value.(type) {
+		case map[string]interface{}:
+			flattenConfig(key, v, values, problems)
+			continue
+		case []interface{}:
+			items := make([]string, len(v))
+			for i := range v {
+				items[i] = fmt.Sprint(v[i])
+			}
+			item = strings.Join(items, " ")
+		case nil:
+			problems[key] = "has no value"
+			continue
+		default:
+			item = fmt.Sprint(v)
+		}
+
+		if _, ok := values[key]; ok {
+			problems[key] = "is set more than once"
+			continue
+		}
+
+		values[key] = item
+	}
+}
+
+// envProfiles holds the profile of settings for each environment, keyed by flag name. A profile
+// only changes the defaults: any setting given on the command line, in the environment or in the
+// config file takes precedence over it, so each setting can still be overridden on its own.
+//
+// Development favours convenience, with verbose errors, CORS open to any origin, webhooks allowed
+// to point at local receivers and requests validated against the OpenAPI document to catch
+// mistakes early. Production favours safety,
+// with the strict security headers, and the rate limiter, load shedding and schema check all
+// enforced. Staging is production with request validation, so that problems show up before
+// they're released.
+var envProfiles = map[string]map[string]string{
+	envDevelopment: {
+		"errors-verbose":        "true",
+		"cors-trusted-origins":  "*",
+		"openapi-validate":      "true",
+		"schema-check":          schemaCheckWarn,
+		"webhook-allow-private": "true",
+	},
+	envStaging: {
+		"strict-headers":   "true",
+		"openapi-validate": "true",
+		"limiter-enabled":  "true",
+		"shed-enabled":     "true",
+		"schema-check":     schemaCheckStrict,
+	},
+	envProduction: {
+		"errors-verbose":  "false",
+		"strict-headers":  "true",
+		"limiter-enabled": "true",
+		"shed-enabled":    "true",
+		"schema-check":    schemaCheckStrict,
+	},
+}
+
+// applyProfile sets every flag in the profile of the given environment (see envProfiles) which
+// hasn't already been set, according to sources, and records that it came from the profile. It
+// must be called after applyEnv(), once the environment is known. An unknown environment has no
+// profile; it's reported by validateConfig().
+func applyProfile(fs *flag.FlagSet, env string, sources configSources) error {
+	profile := envProfiles[env]
+
+	// Sort the names, so that the first error reported is always the same.
+	names := make([]string, 0, len(profile))
+	for name := range profile {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if _, ok := sources[name]; ok {
+			continue
+		}
+
+		f := fs.Lookup(name)
+		if f == nil {
+			return fmt.Errorf("%s profile: unknown setting %q", env, name)
+		}
+
+		err := f.Value.Set(profile[name])
+		if err != nil {
+			return fmt.Errorf("%s profile: invalid value %q for %s: %w", env, profile[name], name, err)
+		}
+
+		sources[name] = "from the " + env + " profile"
+	}
+
+	return nil
+}
+
+// deprecatedFlags maps the old names of renamed settings to their current names. The old names
+// are still accepted, as aliases of the current ones, wherever settings can be given (see
+// aliasDeprecatedFlags()), so that existing deployments keep working after an upgrade.
+var deprecatedFlags = map[string]string{
+	"report-workers":       "task-workers",
+	"report-poll-interval": "task-poll-interval",
+}
+
+// aliasDeprecatedFlags registers each of the deprecated names in fs as an alias which sets the
+// value of its current flag. It must be called once the current flags have been defined, and
+// before any of them are set.
+func aliasDeprecatedFlags(fs *flag.FlagSet) {
+	for old, current := range deprecatedFlags {
+		f := fs.Lookup(current)
+		fs.Var(f.Value, old, fmt.Sprintf("Deprecated: use -%s instead", current))
+	}
+}
+
+// usedDeprecatedFlags returns the deprecated names which were given, according to sources, in
+// alphabetical order. Unless the current name was given too, where the deprecated one came from is
+// recorded against the current name, so that problems with its value point at the right place.
+func usedDeprecatedFlags(sources configSources) []string {
+	var used []string
+
+	for old, current := range deprecatedFlags {
+		source, ok := sources[old]
+		if !ok {
+			continue
+		}
+
+		used = append(used, old)
+
+		if _, ok := sources[current]; !ok {
+			sources[current] = source + " as " + old
+		}
+	}
+
+	sort.Strings(used)
+
+	return used
+}
+
+// configSources records where each setting which wasn't left at its default came from, keyed by
+// flag name: the command line, an environment variable or the config file. It's filled in as
+// the settings are read, so that the problems found by validateConfig() can say where to look.
+type configSources map[string]string
+
+// describe returns the name of a setting for an error message, along with where it came from.
+func (s configSources) describe(name string) string {
+	source, ok := s[name]
+	if !ok {
+		source = "default"
+	}
+
+	return fmt.Sprintf("%s (%s)", name, source)
+}
+
+// configError is the error returned by validateConfig(). It holds every problem that was found
+// with the settings, rather than just the first, so that they can all be fixed in one go.
+type configError struct {
+	problems []string
+}
+
+// newConfigError returns a configError for the errors collected by a validator, which are keyed
+// by flag name. The problems are sorted by flag name, so that they're always reported in the
+// same order.
+func newConfigError(errs map[string]string, sources configSources) *configError {
+	names := make([]string, 0, len(errs))
+	for name := range errs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	problems := make([]string, len(names))
+	for i, name := range names {
+		problems[i] = sources.describe(name) + ": " + errs[name]
+	}
+
+	return &configError{problems: problems}
+}
+
+func (e *configError) Error() string {
+	return "invalid configuration: " + strings.Join(e.problems, "; ")
+}
+
+// validateConfig checks the settings which can't be checked when they're parsed, so that an
+// invalid flag, environment variable or config file fails fast at startup, rather than when the
+// setting is first used. Every setting is checked, and the problems are returned together as a
+// *configError, each one naming the flag and where its value came from (see configSources).
+func validateConfig(cfg config, sources configSources) error {
+	v := validator.New()
+
+	// positive checks the many intervals, timeouts and lifetimes which must be greater than zero.
+	positive := func(name string, d time.Duration) {
+		v.Check(d > 0, name, fmt.Sprintf("must be greater than zero, got %s", d))
+	}
+
+	// oneOf checks the settings which take one of a fixed set of values.
+	oneOf := func(name, value string, allowed ...string) {
+		v.Check(validator.In(value, allowed...), name,
+			fmt.Sprintf("must be one of %s, got %q", strings.Join(allowed, ", "), value))
+	}
+
+	v.Check(cfg.port >= 1 && cfg.port <= 65535, "port", fmt.Sprintf("must be between 1 and 65535, got %d", cfg.port))
+
+	oneOf("env", cfg.env, envDevelopment, envStaging, envProduction)
+	oneOf("mode", cfg.mode, modeAPI, modeWorker, modeAll)
+	oneOf("schema-check", cfg.schemaCheck, schemaCheckStrict, schemaCheckWarn, schemaCheckOff)
+	oneOf("access-denied", cfg.accessDenied, accessDeniedForbidden, accessDeniedNotFound)
+
+	if cfg.admin.addr != "" {
+		_, _, err := net.SplitHostPort(cfg.admin.addr)
+		v.Check(err == nil, "admin-addr", fmt.Sprintf("must be a host:port address, got %q", cfg.admin.addr))
+	}
+
+	// The database.
+	v.Check(cfg.db.dsn != "", "db-dsn", "must be provided")
+
+	_, err := time.ParseDuration(cfg.db.maxIdleTime)
+	v.Check(err == nil, "db-max-idle-time", fmt.Sprintf("must be a duration such as 15m, got %q", cfg.db.maxIdleTime))
+
+	v.Check(cfg.db.connectRetries >= 0, "db-connect-retries", fmt.Sprintf("must not be negative, got %d", cfg.db.connectRetries))
+	positive("db-connect-timeout", cfg.db.connectTimeout)
+
+	// The rate limiters.
+	oneOf("limiter-store", cfg.limiter.store, limiterStoreMemory, limiterStoreRedis)
+	oneOf("limiter-key", cfg.limiter.key, limiterKeyIP, limiterKeyUser)
+
+	if cfg.limiter.store == limiterStoreRedis {
+		v.Check(cfg.redis.url != "", "redis-url", "must be provided for the redis limiter-store")
+	}
+
+	if cfg.redis.url != "" {
+		_, err := redis.ParseURL(cfg.redis.url)
+		v.Check(err == nil, "redis-url", fmt.Sprintf("must be a redis:// or rediss:// URL, got %q", cfg.redis.url))
+	}
+
+	if cfg.limiter.enabled {
+		v.Check(cfg.limiter.rps > 0, "limiter-rps", fmt.Sprintf("must be greater than zero, got %v", cfg.limiter.rps))
+		v.Check(cfg.limiter.burst >= 1, "limiter-burst", fmt.Sprintf("must be at least 1, got %d", cfg.limiter.burst))
+	}
+
+	if cfg.limiter.key == limiterKeyUser {
+		v.Check(cfg.limiter.userRPS > 0, "limiter-user-rps", fmt.Sprintf("must be greater than zero, got %v", cfg.limiter.userRPS))
+		v.Check(cfg.limiter.userBurst >= 1, "limiter-user-burst", fmt.Sprintf("must be at least 1, got %d", cfg.limiter.userBurst))
+	}
+
+	v.Check(cfg.limiter.authRPS > 0, "limiter-auth-rps", fmt.Sprintf("must be greater than zero, got %v", cfg.limiter.authRPS))
+	v.Check(cfg.limiter.authBurst >= 1, "limiter-auth-burst", fmt.Sprintf("must be at least 1, got %d", cfg.limiter.authBurst))
+	positive("limiter-email-interval", cfg.limiter.emailInterval)
+	v.Check(cfg.limiter.emailBurst >= 1, "limiter-email-burst", fmt.Sprintf("must be at least 1, got %d", cfg.limiter.emailBurst))
+	positive("limiter-email-purge-interval", cfg.limiter.emailPurgeInterval)
+
+	v.Check(cfg.quota.daily >= 0, "quota-daily", fmt.Sprintf("must not be negative, got %d", cfg.quota.daily))
+	v.Check(cfg.quota.monthly >= 0, "quota-monthly", fmt.Sprintf("must not be negative, got %d", cfg.quota.monthly))
+
+	// Compression.
+	v.Check(cfg.compression.minSize >= 0, "compression-min-size",
+		fmt.Sprintf("must not be negative, got %d", cfg.compression.minSize))
+	v.Check(cfg.compression.level == gzip.DefaultCompression ||
+		(cfg.compression.level >= gzip.BestSpeed && cfg.compression.level <= gzip.BestCompression), "compression-level",
+		fmt.Sprintf("must be between %d and %d, or %d for the default, got %d",
+			gzip.BestSpeed, gzip.BestCompression, gzip.DefaultCompression, cfg.compression.level))
+	v.Check(cfg.compression.maxSchedLatency >= 0, "compression-max-sched-latency",
+		fmt.Sprintf("must not be negative, got %s", cfg.compression.maxSchedLatency))
+
+	// Public search.
+	v.Check(cfg.search.rps > 0, "search-rps", fmt.Sprintf("must be greater than zero, got %v", cfg.search.rps))
+	v.Check(cfg.search.burst >= 1, "search-burst", fmt.Sprintf("must be at least 1, got %d", cfg.search.burst))
+	v.Check(cfg.search.dailyQuota >= 0, "search-daily-quota", fmt.Sprintf("must not be negative, got %d", cfg.search.dailyQuota))
+	positive("search-cache-ttl", cfg.search.cacheTTL)
+	v.Check(cfg.search.cacheSize >= 1, "search-cache-size", fmt.Sprintf("must be at least 1, got %d", cfg.search.cacheSize))
+	v.Check(cfg.search.maxAge >= 0, "search-max-age", fmt.Sprintf("must not be negative, got %s", cfg.search.maxAge))
+
+	// Authentication.
+	oneOf("auth-mode", cfg.auth.mode, authModeToken, authModeJWT)
+
+	if cfg.auth.mode == authModeJWT {
+		v.Check(len(cfg.jwt.secret) >= 32, "jwt-secret", "must be at least 32 bytes long in jwt auth-mode")
+	}
+
+	positive("token-access-ttl", cfg.tokens.accessTTL)
+	v.Check(cfg.tokens.refreshTTL > cfg.tokens.accessTTL, "token-refresh-ttl",
+		fmt.Sprintf("must be longer than token-access-ttl (%s), got %s", cfg.tokens.accessTTL, cfg.tokens.refreshTTL))
+	positive("token-password-reset-ttl", cfg.tokens.passwordResetTTL)
+	positive("signature-max-skew", cfg.signing.maxSkew)
+
+	// The signing secrets. In development a random one is generated for each secret which isn't
+	// given, but anything signed with it stops working on restart and isn't accepted by any other
+	// instance, so outside development they have to be provided.
+	if cfg.env != envDevelopment {
+		secret := func(name, value string) {
+			v.Check(value != "", name, fmt.Sprintf("must be provided in %s", cfg.env))
+		}
+
+		secret("cursor-secret", cfg.cursor.secret)
+		secret("signature-secret", cfg.signing.secret)
+		secret("digest-unsubscribe-secret", cfg.digest.unsubscribeSecret)
+
+		if cfg.storage.driver == "local" {
+			secret("storage-url-secret", cfg.storage.urlSecret)
+		}
+	}
+
+	// Email. Every process sends email (the API for account activation and password resets, and
+	// the workers for digests and notifications), so the SMTP settings are always needed.
+	v.Check(cfg.smtp.host != "", "smtp-host", "must be provided")
+	v.Check(cfg.smtp.port >= 1 && cfg.smtp.port <= 65535, "smtp-port",
+		fmt.Sprintf("must be between 1 and 65535, got %d", cfg.smtp.port))
+	v.Check(cfg.smtp.username != "" || cfg.smtp.password == "", "smtp-username", "must be provided along with smtp-password")
+	v.Check(cfg.smtp.password != "" || cfg.smtp.username == "", "smtp-password", "must be provided along with smtp-username")
+
+	_, err = mail.ParseAddress(cfg.smtp.sender)
+	v.Check(err == nil, "smtp-sender", fmt.Sprintf("must be an email address such as \"Greenlight <no-reply@example.com>\", got %q",
+		cfg.smtp.sender))
+
+	// Load shedding.
+	if cfg.shedding.enabled {
+		positive("shed-check-interval", cfg.shedding.checkInterval)
+		v.Check(cfg.shedding.window >= 1, "shed-window", fmt.Sprintf("must be at least 1, got %d", cfg.shedding.window))
+		positive("shed-db-latency", cfg.shedding.dbLatency)
+		v.Check(cfg.shedding.errorRate >= 0 && cfg.shedding.errorRate <= 1, "shed-error-rate",
+			fmt.Sprintf("must be between 0 and 1, got %g", cfg.shedding.errorRate))
+	}
+
+	// Storage.
+	oneOf("storage-driver", cfg.storage.driver, storage.Drivers...)
+
+	if cfg.storage.driver != "local" && validator.In(cfg.storage.driver, storage.Drivers...) {
+		v.Check(cfg.storage.bucket != "", "storage-bucket", fmt.Sprintf("must be provided for the %s storage-driver", cfg.storage.driver))
+	}
+
+	positive("storage-signed-url-expiry", cfg.storage.signedURLExpiry)
+	positive("storage-cleanup-interval", cfg.storage.cleanupInterval)
+	positive("storage-orphan-age", cfg.storage.orphanAge)
+	v.Check(cfg.posters.maxSizeMB >= 1, "poster-max-size-mb", fmt.Sprintf("must be at least 1, got %d", cfg.posters.maxSizeMB))
+
+	// Movies.
+	v.Check(cfg.movieLimits.MaxTitleBytes >= 1, "movie-max-title-bytes",
+		fmt.Sprintf("must be at least 1, got %d", cfg.movieLimits.MaxTitleBytes))
+	v.Check(cfg.movieLimits.MaxGenres >= 1, "movie-max-genres", fmt.Sprintf("must be at least 1, got %d", cfg.movieLimits.MaxGenres))
+	v.Check(cfg.movieLimits.EarliestYear >= 1 && cfg.movieLimits.EarliestYear <= time.Now().Year(), "movie-earliest-year",
+		fmt.Sprintf("must be between 1 and the current year, got %d", cfg.movieLimits.EarliestYear))
+
+	// The background jobs.
+	positive("table-growth-interval", cfg.tableGrowth.interval)
+	positive("release-notify-interval", cfg.releases.notifyInterval)
+	positive("announcement-email-interval", cfg.announcements.emailInterval)
+	positive("account-deletion-grace-period", cfg.accounts.deletionGracePeriod)
+	positive("movie-trash-retention", cfg.trash.retention)
+	positive("movie-trash-purge-interval", cfg.trash.purgeInterval)
+	positive("digest-interval", cfg.digest.interval)
+	v.Check(cfg.tasks.workers >= 1, "task-workers", fmt.Sprintf("must be at least 1, got %d", cfg.tasks.workers))
+	v.Check(cfg.backup.retention >= 0, "backup-retention", fmt.Sprintf("must not be negative, got %d", cfg.backup.retention))
+
+	v.Check(cfg.status.heartbeatInterval > 0 && cfg.status.heartbeatInterval <= time.Minute, "status-heartbeat-interval",
+		fmt.Sprintf("must be greater than zero and at most 1m, got %s", cfg.status.heartbeatInterval))
+
+	positive("webhook-poll-interval", cfg.webhooks.pollInterval)
+	positive("webhook-delivery-retention", cfg.webhooks.retention)
+	positive("webhook-purge-interval", cfg.webhooks.purgeInterval)
+
+	// The lease on a batch of deliveries has to outlast the requests for the whole batch, or they
+	// could be sent twice at once.
+	v.Check(cfg.webhooks.timeout > 0 && cfg.webhooks.timeout*webhookBatchSize < webhookLease, "webhook-timeout",
+		fmt.Sprintf("must be greater than zero and less than %s, got %s", webhookLease/webhookBatchSize, cfg.webhooks.timeout))
+
+	// Tracing.
+	if cfg.tracing.endpoint != "" {
+		u, err := url.Parse(cfg.tracing.endpoint)
+		v.Check(err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "", "tracing-endpoint",
+			fmt.Sprintf("must be an http or https URL, got %q", cfg.tracing.endpoint))
+	}
+
+	v.Check(cfg.tracing.sampleRatio >= 0 && cfg.tracing.sampleRatio <= 1, "tracing-sample-ratio",
+		fmt.Sprintf("must be between 0 and 1, got %v", cfg.tracing.sampleRatio))
+
+	validateServerTimeouts(v, cfg)
+
+	if !v.Valid() {
+		return newConfigError(v.Errors, sources)
+	}
+
+	return nil
+}
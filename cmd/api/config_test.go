@@ -0,0 +1,351 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/codeaucafe/snippetbox/greenlight/internal/testutil"
+)
+
+// TestApplyEnv tests that settings are read from environment variables, and that command-line
+// flags take precedence over them.
+func TestApplyEnv(t *testing.T) {
+	env := map[string]string{
+		"GREENLIGHT_PORT":          "8080",
+		"GREENLIGHT_DB_DSN":        "postgres://env",
+		"GREENLIGHT_LIMITER_RPS":   "10",
+		"GREENLIGHT_USAGE_ENABLED": "false",
+		"GREENLIGHT_VERSION":       "true",
+	}
+	lookup := func(name string) (string, bool) {
+		val, ok := env[name]
+		return val, ok
+	}
+
+	newFlagSet := func() (*flag.FlagSet, *config, *bool) {
+		var cfg config
+
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		fs.SetOutput(io.Discard)
+		fs.IntVar(&cfg.port, "port", 4000, "")
+		fs.StringVar(&cfg.db.dsn, "db-dsn", "postgres://default", "")
+		fs.Float64Var(&cfg.limiter.rps, "limiter-rps", 2, "")
+		fs.BoolVar(&cfg.usage.enabled, "usage-enabled", true, "")
+		fs.DurationVar(&cfg.usage.flushInterval, "usage-flush-interval", time.Minute, "")
+		displayVersion := fs.Bool("version", false, "")
+
+		return fs, &cfg, displayVersion
+	}
+
+	fs, cfg, displayVersion := newFlagSet()
+
+	err := fs.Parse([]string{"-db-dsn", "postgres://flag"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sources := configSources{}
+
+	err = applyEnv(fs, lookup, sources)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.port != 8080 {
+		t.Errorf("want port 8080 from the environment; got %d", cfg.port)
+	}
+	if cfg.db.dsn != "postgres://flag" {
+		t.Errorf("want dsn from the flag; got %q", cfg.db.dsn)
+	}
+	if cfg.limiter.rps != 10 {
+		t.Errorf("want limiter rps 10 from the environment; got %v", cfg.limiter.rps)
+	}
+	if cfg.usage.enabled {
+		t.Error("want usage disabled by the environment")
+	}
+	if cfg.usage.flushInterval != time.Minute {
+		t.Errorf("want default usage flush interval; got %s", cfg.usage.flushInterval)
+	}
+	if *displayVersion {
+		t.Error("want -version to ignore the environment")
+	}
+
+	testutil.Equal(t, sources.describe("port"), "port (from GREENLIGHT_PORT)")
+	testutil.Equal(t, sources.describe("db-dsn"), "db-dsn (default)")
+
+	// Every invalid value is reported, along with the name of its environment variable.
+	env["GREENLIGHT_USAGE_FLUSH_INTERVAL"] = "soon"
+	env["GREENLIGHT_PORT"] = "http"
+
+	fs, _, _ = newFlagSet()
+
+	err = fs.Parse(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = applyEnv(fs, lookup, configSources{})
+	if err == nil {
+		t.Fatal("want an error for an invalid duration")
+	}
+
+	testutil.StringContains(t, err.Error(), `port (from GREENLIGHT_PORT): invalid value "http"`)
+	testutil.StringContains(t, err.Error(),
+		`usage-flush-interval (from GREENLIGHT_USAGE_FLUSH_INTERVAL): invalid value "soon"`)
+}
+
+// TestApplyConfigFile tests that settings are read from YAML and TOML config files, including
+// nested sections and lists, and that the command line and environment take precedence.
+func TestApplyConfigFile(t *testing.T) {
+	files := map[string]string{
+		"greenlight.yaml": `
+port: 8080
+db:
+  dsn: postgres://file
+db.max-open-conns: 50
+cors-public-origins:
+  - https://a.example.com
+  - https://b.example.com
+limiter:
+  rps: 10
+`,
+		"greenlight.toml": `
+port = 8080
+cors-public-origins = ["https://a.example.com", "https://b.example.com"]
+
+[db]
+dsn = "postgres://file"
+max-open-conns = 50
+
+[limiter]
+rps = 10
+`,
+	}
+
+	for name, contents := range files {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), name)
+			if err := os.WriteFile(path, []byte(contents), 0o600); err != nil {
+				t.Fatal(err)
+			}
+
+			var cfg config
+
+			fs := flag.NewFlagSet("test", flag.ContinueOnError)
+			fs.IntVar(&cfg.port, "port", 4000, "")
+			fs.StringVar(&cfg.db.dsn, "db-dsn", "postgres://default", "")
+			fs.IntVar(&cfg.db.maxOpenConns, "db-max-open-conns", 25, "")
+			fs.Float64Var(&cfg.limiter.rps, "limiter-rps", 2, "")
+			fs.Func("cors-public-origins", "", func(val string) error {
+				cfg.cors.publicOrigins = strings.Fields(val)
+				return nil
+			})
+
+			err := fs.Parse([]string{"-limiter-rps", "20"})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			sources := configSources{}
+
+			err = applyConfigFile(fs, path, sources)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = applyEnv(fs, func(name string) (string, bool) {
+				if name == "GREENLIGHT_DB_DSN" {
+					return "postgres://env", true
+				}
+				return "", false
+			}, sources)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			testutil.Equal(t, cfg.port, 8080)
+			testutil.Equal(t, cfg.db.maxOpenConns, 50)
+			testutil.Equal(t, cfg.db.dsn, "postgres://env")
+			testutil.Equal(t, cfg.limiter.rps, 20)
+			testutil.Equal(t, strings.Join(cfg.cors.publicOrigins, " "), "https://a.example.com https://b.example.com")
+			testutil.Equal(t, sources.describe("db-max-open-conns"), "db-max-open-conns (from "+path+")")
+			testutil.Equal(t, sources.describe("db-dsn"), "db-dsn (from GREENLIGHT_DB_DSN)")
+		})
+	}
+}
+
+// TestApplyConfigFileErrors tests that mistakes in a config file are reported.
+func TestApplyConfigFileErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		file     string
+		contents string
+		wantErr  string
+	}{
+		{"Unknown key", "greenlight.yaml", "db:\n  dns: postgres://file\n", "db-dns (from PATH): unknown setting"},
+		{"Invalid value", "greenlight.yaml", "port: http\n", `port (from PATH): invalid value "http"`},
+		{"No value", "greenlight.yaml", "db-dsn:\n", "db-dsn (from PATH): has no value"},
+		{"Set twice", "greenlight.yaml", "db-dsn: postgres://a\ndb:\n  dsn: postgres://b\n", "db-dsn (from PATH): is set more than once"},
+		{"Several mistakes", "greenlight.yaml", "db:\n  dns: postgres://file\nport: http\n",
+			`db-dns (from PATH): unknown setting; port (from PATH): invalid value "http"`},
+		{"Syntax error", "greenlight.toml", "port = \n", "greenlight.toml"},
+		{"Unsupported extension", "greenlight.json", "{}", `unsupported file extension ".json"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), tt.file)
+			if err := os.WriteFile(path, []byte(tt.contents), 0o600); err != nil {
+				t.Fatal(err)
+			}
+
+			var port int
+
+			fs := flag.NewFlagSet("test", flag.ContinueOnError)
+			fs.IntVar(&port, "port", 4000, "")
+			fs.String("db-dsn", "", "")
+
+			err := applyConfigFile(fs, path, configSources{})
+			if err == nil {
+				t.Fatalf("want error containing %q; got nil", tt.wantErr)
+			}
+
+			testutil.StringContains(t, err.Error(), strings.ReplaceAll(tt.wantErr, "PATH", path))
+		})
+	}
+}
+
+// TestValidateConfig tests that every problem with the settings is reported at once, along with
+// where each setting came from.
+func TestValidateConfig(t *testing.T) {
+	var cfg config
+	cfg.env = "prod"
+	cfg.mode = modeAll
+	cfg.smtp.username = "mailer"
+
+	sources := configSources{"port": "from GREENLIGHT_PORT", "env": "from /etc/greenlight.yaml"}
+
+	err := validateConfig(cfg, sources)
+
+	var cfgErr *configError
+	if !errors.As(err, &cfgErr) {
+		t.Fatalf("got error %v; want a *configError", err)
+	}
+
+	for _, want := range []string{
+		"port (from GREENLIGHT_PORT): must be between 1 and 65535, got 0",
+		`env (from /etc/greenlight.yaml): must be one of development, staging, production, got "prod"`,
+		"smtp-host (default): must be provided",
+		"smtp-password (default): must be provided along with smtp-username",
+		"server-read-timeout (default): must be greater than zero, got 0s",
+		"digest-unsubscribe-secret (default): must be provided in prod",
+	} {
+		testutil.StringContains(t, err.Error(), want)
+	}
+
+	for _, problem := range cfgErr.problems {
+		if strings.HasPrefix(problem, "mode ") {
+			t.Errorf("got a problem with the valid mode: %s", problem)
+		}
+	}
+
+	// In development the signing secrets can be left out, and random ones are used instead.
+	cfg.env = envDevelopment
+
+	err = validateConfig(cfg, sources)
+	testutil.Equal(t, strings.Contains(err.Error(), "digest-unsubscribe-secret"), false)
+}
+
+// TestApplyProfile tests that an environment's profile fills in the settings which weren't given
+// any other way, and leaves the rest alone.
+func TestApplyProfile(t *testing.T) {
+	newFlagSet := func() (*flag.FlagSet, *config) {
+		var cfg config
+
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		fs.BoolVar(&cfg.errors.verbose, "errors-verbose", false, "")
+		fs.BoolVar(&cfg.headers.strict, "strict-headers", false, "")
+		fs.BoolVar(&cfg.openapi.validate, "openapi-validate", false, "")
+		fs.BoolVar(&cfg.limiter.enabled, "limiter-enabled", true, "")
+		fs.BoolVar(&cfg.shedding.enabled, "shed-enabled", true, "")
+		fs.StringVar(&cfg.schemaCheck, "schema-check", schemaCheckStrict, "")
+		fs.BoolVar(&cfg.webhooks.allowPrivate, "webhook-allow-private", false, "")
+		fs.Func("cors-trusted-origins", "", func(val string) error {
+			cfg.cors.trustedOrigins = strings.Fields(val)
+			return nil
+		})
+
+		return fs, &cfg
+	}
+
+	fs, cfg := newFlagSet()
+	sources := configSources{"limiter-enabled": "from GREENLIGHT_LIMITER_ENABLED"}
+	cfg.limiter.enabled = false
+
+	err := applyProfile(fs, envProduction, sources)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testutil.Equal(t, cfg.headers.strict, true)
+	testutil.Equal(t, cfg.limiter.enabled, false)
+	testutil.Equal(t, sources.describe("strict-headers"), "strict-headers (from the production profile)")
+
+	fs, cfg = newFlagSet()
+
+	err = applyProfile(fs, envDevelopment, configSources{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testutil.Equal(t, cfg.errors.verbose, true)
+	testutil.Equal(t, cfg.headers.strict, false)
+	testutil.Equal(t, cfg.schemaCheck, schemaCheckWarn)
+	testutil.Equal(t, cfg.webhooks.allowPrivate, true)
+	testutil.Equal(t, strings.Join(cfg.cors.trustedOrigins, " "), "*")
+}
+
+// TestDeprecatedFlags tests that the old names of renamed settings still set the current ones,
+// from the command line and the environment, and that their use is reported.
+func TestDeprecatedFlags(t *testing.T) {
+	var cfg config
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	fs.IntVar(&cfg.tasks.workers, "task-workers", 2, "")
+	fs.DurationVar(&cfg.tasks.pollInterval, "task-poll-interval", 5*time.Second, "")
+	aliasDeprecatedFlags(fs)
+
+	err := fs.Parse([]string{"-report-workers", "4"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sources := configSources{}
+	fs.Visit(func(f *flag.Flag) {
+		sources[f.Name] = "from the command line"
+	})
+
+	lookup := func(name string) (string, bool) {
+		if name == "GREENLIGHT_REPORT_POLL_INTERVAL" {
+			return "1s", true
+		}
+		return "", false
+	}
+
+	err = applyEnv(fs, lookup, sources)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testutil.Equal(t, cfg.tasks.workers, 4)
+	testutil.Equal(t, cfg.tasks.pollInterval, time.Second)
+	testutil.Equal(t, strings.Join(usedDeprecatedFlags(sources), " "), "report-poll-interval report-workers")
+	testutil.Equal(t, sources.describe("task-workers"), "task-workers (from the command line as report-workers)")
+}
@@ -9,14 +9,22 @@ import (
 
 type contextKey string
 
-// userContextKey is used as a key for getting and setting user information in the request
-// context.
-const userContextKey = contextKey("user")
+// routeContextKey is used as a key for getting and setting the routeInfo for a request.
+const routeContextKey = contextKey("route")
+
+// routeInfo holds the route pattern (such as "GET /v1/movies/:id") matched for a request. The
+// router is the innermost handler, so middleware adds an empty routeInfo to the request context
+// on the way in, and the route handler fills it in. This lets the middleware group requests by
+// route without the cardinality of the raw URL path.
+type routeInfo struct {
+	pattern string
+}
 
 // contextSetUser returns a new copy of the request with the provided User struct added to the
-// context.
+// context. The user is stored with data.ContextWithUser(), so that the model methods which are
+// passed the request context can read it too.
 func (app *application) contextSetUser(r *http.Request, user *data.User) *http.Request {
-	ctx := context.WithValue(r.Context(), userContextKey, user)
+	ctx := data.ContextWithUser(r.Context(), user)
 	return r.WithContext(ctx)
 }
 
@@ -24,10 +32,30 @@ func (app *application) contextSetUser(r *http.Request, user *data.User) *http.R
 // this helper should be used is when we logically expect there to be a User struct value
 // in the context, and if it doesn't exist it will firmly be an 'unexpected' error, upon we panic.
 func (app *application) contextGetUser(r *http.Request) *data.User {
-	user, ok := r.Context().Value(userContextKey).(*data.User)
+	user, ok := data.UserFromContext(r.Context())
 	if !ok {
 		panic("missing user value in request context")
 	}
 
 	return user
 }
+
+// contextSetRouteInfo returns a new copy of the request with an empty routeInfo added to the
+// context, along with the routeInfo itself. If the request already has a routeInfo then it is
+// reused.
+func (app *application) contextSetRouteInfo(r *http.Request) (*http.Request, *routeInfo) {
+	if info, ok := r.Context().Value(routeContextKey).(*routeInfo); ok {
+		return r, info
+	}
+
+	info := &routeInfo{}
+	ctx := context.WithValue(r.Context(), routeContextKey, info)
+	return r.WithContext(ctx), info
+}
+
+// setRoutePattern records the matched route pattern in the request's routeInfo, if it has one.
+func setRoutePattern(r *http.Request, method, path string) {
+	if info, ok := r.Context().Value(routeContextKey).(*routeInfo); ok {
+		info.pattern = method + " " + path
+	}
+}
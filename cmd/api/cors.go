@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// corsPolicy holds the CORS rules for a group of routes. The trusted origins are returned by a
+// function, so that a policy can follow settings which change at runtime. A trusted origin of
+// "*" means that requests from any origin are permitted.
+type corsPolicy struct {
+	trustedOrigins func() []string
+}
+
+// newCORSPolicy returns a corsPolicy which always trusts the given origins.
+func newCORSPolicy(trustedOrigins []string) corsPolicy {
+	return corsPolicy{trustedOrigins: func() []string { return trustedOrigins }}
+}
+
+// allowsOrigin returns true if the policy trusts the given request origin.
+func (p corsPolicy) allowsOrigin(origin string) bool {
+	trustedOrigins := p.trustedOrigins()
+
+	for i := range trustedOrigins {
+		if trustedOrigins[i] == "*" || trustedOrigins[i] == origin {
+			return true
+		}
+	}
+
+	return false
+}
+
+// setAllowOrigin sets the "Access-Control-Allow-Origin" response header if the request origin
+// is trusted by the policy, and returns true if it was set. Any header set by a previous policy
+// is removed first, so that a route-level policy always replaces the default one. The
+// "Access-Control-Expose-Headers" header is set along with it, so that browser clients can read
+// the ETag they need to send in an If-Match header.
+func (p corsPolicy) setAllowOrigin(w http.ResponseWriter, r *http.Request) bool {
+	w.Header().Del("Access-Control-Allow-Origin")
+	w.Header().Del("Access-Control-Expose-Headers")
+
+	origin := r.Header.Get("Origin")
+	if origin == "" || !p.allowsOrigin(origin) {
+		return false
+	}
+
+	w.Header().Set("Access-Control-Allow-Origin", origin)
+	w.Header().Set("Access-Control-Expose-Headers", corsExposedHeaders)
+	return true
+}
+
+// corsAllowedHeaders lists the request headers which cross-origin requests are allowed to send.
+var corsAllowedHeaders = strings.Join([]string{
+	"Authorization", "Content-Type", "If-Match", "If-None-Match", apiVersionHeader, runtimeFormatHeader, idFormatHeader,
+	requestIDHeader,
+}, ", ")
+
+// corsExposedHeaders lists the response headers, beyond the CORS-safelisted ones, which
+// cross-origin requests are allowed to read.
+var corsExposedHeaders = strings.Join([]string{"ETag", "Retry-After", requestIDHeader}, ", ")
+
+// preflight responds to a CORS preflight request using the policy. Note that we only list the
+// method the client asked for in the "Access-Control-Allow-Methods" header, because each route
+// (and so each method on a path) can be registered with a different policy.
+func (p corsPolicy) preflight(w http.ResponseWriter, r *http.Request) {
+	if p.setAllowOrigin(w, r) {
+		w.Header().Set("Access-Control-Allow-Methods", r.Header.Get("Access-Control-Request-Method"))
+		w.Header().Set("Access-Control-Allow-Headers", corsAllowedHeaders)
+
+		// Set max cached times for headers for 60 seconds.
+		w.Header().Set("Access-Control-Max-Age", "60")
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// defaultCORSPolicy returns the policy used for any route that isn't registered with its own
+// policy. The trusted origins start out as the -cors-trusted-origins command-line flag, and can
+// be changed at runtime through the admin settings endpoint.
+func (app *application) defaultCORSPolicy() corsPolicy {
+	return corsPolicy{trustedOrigins: func() []string {
+		return app.settings.get().CORSTrustedOrigins
+	}}
+}
+
+// corsRouter wraps a httprouter.Router so that routes can be registered alongside the CORS
+// policy that applies to them. A second router holds a preflight handler for each registered
+// method and path, which lets the GlobalOPTIONS handler answer preflight requests using the
+// policy of the route that the client actually intends to call. GET routes are automatically
+// registered for HEAD requests too, so that the Allow header derived from the router is
+// accurate for them.
+type corsRouter struct {
+	*httprouter.Router
+	preflights *httprouter.Router
+	fallback   corsPolicy
+	// literals holds the static routes which are served through a wildcard route (see
+	// handleLiteral()), keyed by method and wildcard path.
+	literals map[string]*literalRoute
+}
+
+// literalRoute dispatches the requests for a wildcard path to the static routes registered in
+// its place, by the value of the wildcard parameter. Requests for any other value go to the
+// wildcard route for the path itself, if there is one. The static routes don't have the wildcard
+// parameter, so it's removed from the request before they're called, which leaves any of their
+// own parameters (even one with the same name) as they expect.
+type literalRoute struct {
+	// index is the position of the wildcard among the path's parameters.
+	index      int
+	handlers   map[string]http.HandlerFunc
+	preflights map[string]http.HandlerFunc
+	handler    http.HandlerFunc
+	preflight  http.HandlerFunc
+}
+
+// newCORSRouter returns a new corsRouter for the given router, using the fallback policy for
+// preflight requests to routes which weren't registered with a policy.
+func newCORSRouter(router *httprouter.Router, fallback corsPolicy) *corsRouter {
+	cr := &corsRouter{
+		Router:     router,
+		preflights: httprouter.New(),
+		fallback:   fallback,
+		literals:   map[string]*literalRoute{},
+	}
+
+	router.GlobalOPTIONS = http.HandlerFunc(cr.handleOptions)
+
+	return cr
+}
+
+// handleWithPolicy registers a handler for the given method and path, with the CORS policy
+// applied to both the handler and any preflight requests for the route. The handler also records
+// the route pattern in the request's routeInfo for our middleware.
+func (cr *corsRouter) handleWithPolicy(policy corsPolicy, method, path string, handler http.HandlerFunc) {
+	fn := policy.wrap(method, path, handler)
+
+	cr.register(method, path, fn, policy.preflight)
+
+	// Go's HTTP server discards the response body for HEAD requests, so we can simply reuse
+	// the GET handler.
+	if method == http.MethodGet {
+		cr.register(http.MethodHead, path, fn, policy.preflight)
+	}
+}
+
+// handleLiteral registers a route with a static segment which httprouter can't register
+// alongside a wildcard route, such as "POST /v1/movies/search" alongside "POST
+// /v1/movies/:id/reviews", or "GET /v1/users/me/searches" alongside "GET /v1/users/:id". The
+// route is served through the path with the wildcard in place of the static segment (here "POST
+// /v1/movies/:id" and "GET /v1/users/:id/searches") instead, which dispatches on the value of the
+// wildcard, so it must be registered before any route for that path itself. The route pattern
+// recorded for our middleware is still the route's own path.
+func (cr *corsRouter) handleLiteral(policy corsPolicy, method, path, wildcard string, handler http.HandlerFunc) {
+	fn := policy.wrap(method, path, handler)
+
+	cr.registerLiteral(method, path, wildcard, fn, policy.preflight)
+
+	if method == http.MethodGet {
+		cr.registerLiteral(http.MethodHead, path, wildcard, fn, policy.preflight)
+	}
+}
+
+// wrap returns the handler for a route, which records the route pattern in the request's
+// routeInfo and applies the policy.
+func (p corsPolicy) wrap(method, path string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		setRoutePattern(r, method, path)
+		p.setAllowOrigin(w, r)
+		handler.ServeHTTP(w, r)
+	}
+}
+
+// register adds a handler and its preflight handler to the routers. If static routes are
+// already being served through the path (see handleLiteral()), it becomes the fallback for the
+// values of the wildcard which don't match any of them.
+func (cr *corsRouter) register(method, path string, handler, preflight http.HandlerFunc) {
+	if lr, ok := cr.literals[method+" "+path]; ok {
+		lr.handler = handler
+		lr.preflight = preflight
+		return
+	}
+
+	cr.Router.HandlerFunc(method, path, handler)
+	cr.preflights.HandlerFunc(method, path, preflight)
+}
+
+// registerLiteral adds a static route to the literalRoute for the wildcard path, registering the
+// literalRoute with the routers the first time.
+func (cr *corsRouter) registerLiteral(method, path, wildcard string, handler, preflight http.HandlerFunc) {
+	key := method + " " + wildcard
+
+	// Find the static segment which the wildcard replaces, and the wildcard's position.
+	segments := strings.Split(path, "/")
+	wildcardSegments := strings.Split(wildcard, "/")
+
+	i, index := 0, 0
+	for segments[i] == wildcardSegments[i] {
+		if strings.HasPrefix(segments[i], ":") {
+			index++
+		}
+		i++
+	}
+
+	lr, ok := cr.literals[key]
+	if !ok {
+		lr = &literalRoute{
+			index:      index,
+			handlers:   map[string]http.HandlerFunc{},
+			preflights: map[string]http.HandlerFunc{},
+		}
+		cr.literals[key] = lr
+
+		fallback := cr.fallback.preflight
+
+		cr.Router.HandlerFunc(method, wildcard, func(w http.ResponseWriter, r *http.Request) {
+			lr.dispatch(lr.handlers, lr.handler, cr.notFound)(w, r)
+		})
+		cr.preflights.HandlerFunc(method, wildcard, func(w http.ResponseWriter, r *http.Request) {
+			lr.dispatch(lr.preflights, lr.preflight, fallback)(w, r)
+		})
+	}
+
+	lr.handlers[segments[i]] = handler
+	lr.preflights[segments[i]] = preflight
+}
+
+// notFound sends the router's 404 Not Found response.
+func (cr *corsRouter) notFound(w http.ResponseWriter, r *http.Request) {
+	if cr.Router.NotFound != nil {
+		cr.Router.NotFound.ServeHTTP(w, r)
+		return
+	}
+
+	http.NotFound(w, r)
+}
+
+// dispatch returns the handler for the request's wildcard value: the static route's handler if
+// there is one, and otherwise the wildcard route's handler or, failing that, the fallback.
+func (lr *literalRoute) dispatch(handlers map[string]http.HandlerFunc, wildcard, fallback http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		params := httprouter.ParamsFromContext(r.Context())
+		value := params[lr.index].Value
+
+		switch {
+		case handlers[value] != nil:
+			params = append(append(httprouter.Params{}, params[:lr.index]...), params[lr.index+1:]...)
+			handlers[value](w, r.WithContext(context.WithValue(r.Context(), httprouter.ParamsKey, params)))
+		case wildcard != nil:
+			wildcard(w, r)
+		default:
+			fallback(w, r)
+		}
+	}
+}
+
+// handleOptions is used as the router's GlobalOPTIONS handler. It only runs for paths which
+// don't have an explicit OPTIONS handler registered, and by the time it is called the router
+// has already set the Allow header to the methods registered for the path. Plain OPTIONS
+// requests get a 204 No Content response, while CORS preflight requests are handled using
+// the policy for the requested route.
+func (cr *corsRouter) handleOptions(w http.ResponseWriter, r *http.Request) {
+	method := r.Header.Get("Access-Control-Request-Method")
+	if method == "" || r.Header.Get("Origin") == "" {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	// Look up the preflight handler for the method and path that the client intends to call.
+	// If there isn't one, the route wasn't registered with its own policy and we fall back to
+	// the default policy instead.
+	handle, params, _ := cr.preflights.Lookup(method, r.URL.Path)
+	if handle == nil {
+		cr.fallback.preflight(w, r)
+		return
+	}
+
+	handle(w, r, params)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+
+	"github.com/codeaucafe/snippetbox/greenlight/internal/testutil"
+)
+
+// TestCORSPolicies tests that each route's CORS policy applies to its own requests and to the
+// preflight requests for it, and that routes without a policy use the default trusted origins.
+func TestCORSPolicies(t *testing.T) {
+	app := newTestApp()
+
+	settings := app.settings.get()
+	settings.CORSTrustedOrigins = []string{"https://app.example.com"}
+	app.settings.set(settings)
+
+	ok := func(w http.ResponseWriter, r *http.Request) {}
+
+	routes := []route{
+		{method: http.MethodGet, path: "/v1/movies", handler: ok, cors: newCORSPolicy([]string{"*"})},
+		{method: http.MethodPost, path: "/v1/movies", handler: ok},
+		{method: http.MethodPost, path: "/v1/tokens/authentication", handler: ok,
+			cors: newCORSPolicy([]string{"https://login.example.com"})},
+	}
+
+	cr := newCORSRouter(httprouter.New(), app.defaultCORSPolicy())
+	app.registerRoutes(cr, routes)
+
+	tests := []struct {
+		name            string
+		method          string
+		path            string
+		origin          string
+		preflightMethod string
+		wantCode        int
+		wantOrigin      string
+		wantMethods     string
+	}{
+		{"public route", http.MethodGet, "/v1/movies", "https://other.example.com", "", http.StatusOK,
+			"https://other.example.com", ""},
+		{"default policy", http.MethodPost, "/v1/movies", "https://app.example.com", "", http.StatusOK,
+			"https://app.example.com", ""},
+		{"default policy untrusted", http.MethodPost, "/v1/movies", "https://other.example.com", "", http.StatusOK,
+			"", ""},
+		{"route policy replaces the default", http.MethodPost, "/v1/tokens/authentication", "https://app.example.com",
+			"", http.StatusOK, "", ""},
+		{"preflight for public route", http.MethodOptions, "/v1/movies", "https://other.example.com",
+			http.MethodGet, http.StatusNoContent, "https://other.example.com", http.MethodGet},
+		{"preflight for default policy", http.MethodOptions, "/v1/movies", "https://other.example.com",
+			http.MethodPost, http.StatusNoContent, "", ""},
+		{"preflight for route policy", http.MethodOptions, "/v1/tokens/authentication", "https://login.example.com",
+			http.MethodPost, http.StatusNoContent, "https://login.example.com", http.MethodPost},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, tt.path, nil)
+			r.Header.Set("Origin", tt.origin)
+			if tt.preflightMethod != "" {
+				r.Header.Set("Access-Control-Request-Method", tt.preflightMethod)
+			}
+
+			rr := httptest.NewRecorder()
+			r, _ = app.contextSetRouteInfo(r)
+			cr.ServeHTTP(rr, r)
+
+			testutil.Equal(t, rr.Code, tt.wantCode)
+			testutil.Equal(t, rr.Header().Get("Access-Control-Allow-Origin"), tt.wantOrigin)
+			testutil.Equal(t, rr.Header().Get("Access-Control-Allow-Methods"), tt.wantMethods)
+		})
+	}
+}
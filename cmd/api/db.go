@@ -0,0 +1,37 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"math/rand"
+	"time"
+)
+
+// pingDB checks that a connection to the database can be established within the timeout.
+func pingDB(db *sql.DB, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	return db.PingContext(ctx)
+}
+
+// dbConnectMaxBackoff is the longest we wait between attempts to connect to the database.
+const dbConnectMaxBackoff = 30 * time.Second
+
+// dbConnectBackoff returns how long to wait before retrying the database connection after the
+// given (zero-based) failed attempt. The delay starts at 500ms and doubles with each attempt up
+// to dbConnectMaxBackoff, and a random jitter of up to half the delay is taken off, so that
+// several instances started together don't all retry in lockstep.
+func dbConnectBackoff(attempt int) time.Duration {
+	backoff := 500 * time.Millisecond
+
+	for i := 0; i < attempt && backoff < dbConnectMaxBackoff; i++ {
+		backoff *= 2
+	}
+
+	if backoff > dbConnectMaxBackoff {
+		backoff = dbConnectMaxBackoff
+	}
+
+	return backoff - time.Duration(rand.Int63n(int64(backoff/2)+1))
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// TestDBConnectBackoff checks that the delay between attempts to connect to the database doubles
+// up to the maximum, with no more than half of it taken off as jitter.
+func TestDBConnectBackoff(t *testing.T) {
+	tests := []struct {
+		attempt int
+		max     time.Duration
+	}{
+		{attempt: 0, max: 500 * time.Millisecond},
+		{attempt: 1, max: time.Second},
+		{attempt: 3, max: 4 * time.Second},
+		{attempt: 20, max: dbConnectMaxBackoff},
+	}
+
+	for _, tt := range tests {
+		for i := 0; i < 100; i++ {
+			got := dbConnectBackoff(tt.attempt)
+
+			if got < tt.max/2 || got > tt.max {
+				t.Fatalf("attempt %d: got %s; want between %s and %s", tt.attempt, got, tt.max/2, tt.max)
+			}
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/codeaucafe/snippetbox/greenlight/internal/data"
+	"github.com/codeaucafe/snippetbox/greenlight/internal/validator"
+)
+
+const (
+	// digestBatchSize is the most subscribers whose digests are sent in one go. Any more are sent
+	// straight afterwards, in further batches.
+	digestBatchSize = 100
+
+	// digestMaxMovies is the most new movies listed in a digest.
+	digestMaxMovies = 20
+)
+
+// showDigestHandler handles the "GET /v1/users/me/digest" endpoint and returns whether the
+// current user is subscribed to the weekly digest, and their favorite genres.
+func (app *application) showDigestHandler(w http.ResponseWriter, r *http.Request) {
+	settings, err := app.models.Digests.Get(r.Context(), app.contextGetUser(r).ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"digest": settings}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// updateDigestHandler handles the "PUT /v1/users/me/digest" endpoint, which opts the current user
+// in to (or out of) the weekly digest and sets the genres that its new movies are picked from.
+// Either field can be left out of the request body to keep its current value. The first digest
+// is sent a week after subscribing.
+func (app *application) updateDigestHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Subscribed     *bool    `json:"subscribed"`
+		FavoriteGenres []string `json:"favorite_genres"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if input.FavoriteGenres != nil {
+		data.ValidateFavoriteGenres(v, input.FavoriteGenres, app.config.movieLimits)
+	}
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	err = app.models.Digests.Update(r.Context(), user.ID, input.Subscribed, input.FavoriteGenres, app.clock.Now())
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrUnknownGenre):
+			v.AddError("favorite_genres", "must only contain existing genres")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	settings, err := app.models.Digests.Get(r.Context(), user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"digest": settings}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// unsubscribeDigestHandler handles the "GET /v1/digest/unsubscribe" and
+// "POST /v1/digest/unsubscribe" endpoints, which the unsubscribe link in each digest points to.
+// The user is identified by the signed token query string parameter rather than by
+// authenticating, so that the link works straight from the email. GET is for following the link,
+// and POST is for the mail clients which unsubscribe with one click.
+func (app *application) unsubscribeDigestHandler(w http.ResponseWriter, r *http.Request) {
+	userID, err := data.DecodeUnsubscribeToken([]byte(app.config.digest.unsubscribeSecret),
+		r.URL.Query().Get("token"))
+	if err != nil {
+		v := validator.New()
+		v.AddError("token", "invalid unsubscribe token")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Digests.Unsubscribe(r.Context(), userID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "you have been unsubscribed from the weekly digest"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// digestUnsubscribeLink returns the unsubscribe link for a user's digest.
+func (app *application) digestUnsubscribeLink(userID int64) string {
+	token := data.EncodeUnsubscribeToken([]byte(app.config.digest.unsubscribeSecret), userID)
+	return app.config.digest.unsubscribeURL + "?token=" + url.QueryEscape(token)
+}
+
+// sendDigests sends the weekly digest to every subscriber whose digest is due, in batches, until
+// there are none left. A digest lists the movies added in the subscriber's favorite genres and
+// the activity on their reviews since their last digest. If there's nothing to tell a subscriber
+// then no email is sent, but their digest is still marked as sent so that they're next checked
+// in a week.
+func (app *application) sendDigests() {
+	job := startJob("weekly_digests")
+	defer job.finish()
+
+	now := app.clock.Now()
+
+	for {
+		recipients, err := app.models.Digests.GetDue(context.Background(), now.Add(-data.DigestPeriod), digestBatchSize)
+		if err != nil {
+			job.fail()
+			app.logger.PrintError(err, nil)
+			return
+		}
+
+		for _, recipient := range recipients {
+			err := app.sendDigest(recipient, now)
+			if err != nil {
+				job.fail()
+				app.logger.PrintError(err, map[string]string{"user_id": strconv.FormatInt(recipient.UserID, 10)})
+				return
+			}
+		}
+
+		if len(recipients) < digestBatchSize {
+			return
+		}
+	}
+}
+
+// sendDigest queues one subscriber's digest in the outbox and marks it as sent.
+func (app *application) sendDigest(recipient *data.DigestRecipient, now time.Time) error {
+	movies, err := app.models.Digests.NewMovies(context.Background(), recipient.UserID, recipient.Since, digestMaxMovies)
+	if err != nil {
+		return err
+	}
+
+	reviews, err := app.models.Digests.ReviewActivity(context.Background(), recipient.UserID, recipient.Since)
+	if err != nil {
+		return err
+	}
+
+	var email *data.OutboxEmail
+
+	if len(movies) > 0 || len(reviews) > 0 {
+		email = &data.OutboxEmail{
+			Recipient: recipient.Email,
+			Template:  "weekly_digest.tmpl",
+			Data: map[string]interface{}{
+				"name":            recipient.Name,
+				"movies":          movies,
+				"reviews":         reviews,
+				"unsubscribeLink": app.digestUnsubscribeLink(recipient.UserID),
+			},
+		}
+	}
+
+	return app.models.Digests.MarkSent(context.Background(), recipient.UserID, now, email)
+}
+
+// sendDigestsPeriodically calls sendDigests() once every interval, as long as this instance is
+// the leader. It runs until the application exits.
+func (app *application) sendDigestsPeriodically(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+
+		if !app.isLeader() {
+			continue
+		}
+
+		app.sendDigests()
+	}
+}
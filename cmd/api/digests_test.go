@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/codeaucafe/snippetbox/greenlight/internal/clock"
+	"github.com/codeaucafe/snippetbox/greenlight/internal/data"
+	"github.com/codeaucafe/snippetbox/greenlight/internal/mailer"
+	"github.com/codeaucafe/snippetbox/greenlight/internal/testutil"
+)
+
+// TestWeeklyDigest tests that a subscriber is sent a digest of the new movies in their favorite
+// genres once a week, and that the signed link in it unsubscribes them.
+func TestWeeklyDigest(t *testing.T) {
+	app, fx := newTestDBApp(t)
+	ts := newTestServer(app.routes())
+	defer ts.Close()
+
+	user := fx.User(nil, "movies:read")
+	reader := fx.Token(user, data.ScopeAuthentication)
+
+	fx.Movie(func(m *data.Movie) { m.Title = "Moonlight"; m.Genres = []string{"drama"} })
+
+	code, _, body := ts.request(t, http.MethodPut, "/v1/users/me/digest", reader.Plaintext,
+		`{"subscribed": true, "favorite_genres": ["no such genre"]}`)
+	testutil.Status(t, code, body, http.StatusUnprocessableEntity)
+
+	code, _, body = ts.request(t, http.MethodPut, "/v1/users/me/digest", reader.Plaintext,
+		`{"subscribed": true, "favorite_genres": ["Drama"]}`)
+	testutil.Status(t, code, body, http.StatusOK)
+	testutil.StringContains(t, string(body), `"subscribed": true`)
+
+	// Nothing is sent until a week after subscribing. The movie was created by the database's
+	// clock, which is ahead of the test clock, so it counts as new.
+	app.sendDigests()
+	testutil.Equal(t, app.processOutbox(), 0)
+
+	app.clock.(*clock.Mock).Set(time.Now().Add(data.DigestPeriod))
+	app.sendDigests()
+	testutil.Equal(t, app.processOutbox(), 1)
+
+	emails := app.mailer.(*mailer.Recorder).SentTo(user.Email)
+	testutil.Equal(t, len(emails), 1)
+	testutil.Equal(t, emails[0].Template, "weekly_digest.tmpl")
+	testutil.StringContains(t, emails[0].PlainBody, "Moonlight")
+
+	link, ok := emails[0].Data.(map[string]interface{})["unsubscribeLink"].(string)
+	if !ok {
+		t.Fatalf("digest email data has no unsubscribe link: %#v", emails[0].Data)
+	}
+	testutil.StringContains(t, emails[0].PlainBody, link)
+
+	u, err := url.Parse(link)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	code, _, body = ts.request(t, http.MethodGet, "/v1/digest/unsubscribe?token=tampered"+u.Query().Get("token"), "", "")
+	testutil.Status(t, code, body, http.StatusUnprocessableEntity)
+
+	code, _, body = ts.request(t, http.MethodGet, "/v1/digest/unsubscribe?"+u.RawQuery, "", "")
+	testutil.Status(t, code, body, http.StatusOK)
+
+	code, _, body = ts.request(t, http.MethodGet, "/v1/users/me/digest", reader.Plaintext, "")
+	testutil.Status(t, code, body, http.StatusOK)
+	testutil.StringContains(t, string(body), `"subscribed": false`)
+}
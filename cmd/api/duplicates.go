@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/codeaucafe/snippetbox/greenlight/internal/data"
+	"github.com/codeaucafe/snippetbox/greenlight/internal/validator"
+)
+
+// defaultDuplicateTolerance is the runtime tolerance, in minutes, of a duplicate scan which
+// doesn't set one. It allows for the same movie being listed with and without its credits.
+const defaultDuplicateTolerance = 5
+
+// scanDuplicatesHandler handles the "POST /v1/admin/duplicates/scan" endpoint. It queues a task
+// which scans the whole catalog for probable duplicates and adds them to the review queue at
+// "GET /v1/admin/duplicates", and returns a 202 Accepted response with the task.
+func (app *application) scanDuplicatesHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		RuntimeTolerance *int `json:"runtime_tolerance"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	tolerance := defaultDuplicateTolerance
+	if input.RuntimeTolerance != nil {
+		tolerance = *input.RuntimeTolerance
+	}
+
+	v := validator.New()
+
+	if data.ValidateDuplicateTolerance(v, tolerance); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	task := &data.Task{
+		UserID: app.contextGetUser(r).ID,
+		Kind:   data.TaskKindDuplicateScan,
+		Params: map[string]string{"runtime_tolerance": strconv.Itoa(tolerance)},
+	}
+
+	err = app.models.Tasks.Insert(r.Context(), task)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.taskAcceptedResponse(w, r, task, nil)
+}
+
+// runDuplicateScanTask runs a duplicate scan task, and returns the location of the review queue.
+func (app *application) runDuplicateScanTask(task *data.Task, progress func(int)) (string, error) {
+	tolerance, err := strconv.Atoi(task.Params["runtime_tolerance"])
+	if err != nil {
+		return "", fmt.Errorf("invalid runtime_tolerance %q", task.Params["runtime_tolerance"])
+	}
+
+	added, err := app.models.Duplicates.Scan(context.Background(), tolerance, progress)
+	if err != nil {
+		return "", err
+	}
+
+	app.logger.PrintInfo("duplicate scan completed", map[string]string{
+		"task_id": strconv.FormatInt(task.ID, 10),
+		"added":   strconv.FormatInt(added, 10),
+	})
+
+	return "/v1/admin/duplicates", nil
+}
+
+// listDuplicatesHandler handles the "GET /v1/admin/duplicates" endpoint and returns a page of the
+// review queue of probable duplicates. Only the pending candidates are returned, unless the
+// status query string parameter asks for the confirmed or dismissed ones.
+func (app *application) listDuplicatesHandler(w http.ResponseWriter, r *http.Request) {
+	v := validator.New()
+	qs := r.URL.Query()
+
+	status := app.readStrings(qs, "status", data.DuplicateStatusPending)
+
+	filters := data.Filters{
+		Page:     app.readInt(qs, "page", 1, v),
+		PageSize: app.readInt(qs, "page_size", 20, v),
+		Sort:     app.readStrings(qs, "sort", "id"),
+		SortSafeList: []string{
+			"id", "runtime_difference",
+			"-id", "-runtime_difference",
+		},
+	}
+
+	v.Check(validator.In(status, data.DuplicateStatuses...), "status", "must be one of pending, confirmed or dismissed")
+
+	if data.ValidateFilters(v, filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	candidates, metadata, err := app.models.Duplicates.GetAll(r.Context(), status, filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"duplicates": candidates, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// updateDuplicateHandler handles the "PATCH /v1/admin/duplicates/:id" endpoint and records the
+// outcome of reviewing a duplicate candidate. Reviewed candidates stay in the table, so that
+// later scans don't add the same pair to the queue again.
+func (app *application) updateDuplicateHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	var input struct {
+		Status string `json:"status"`
+	}
+
+	err = app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	v.Check(validator.In(input.Status, data.DuplicateStatuses...), "status", "must be one of pending, confirmed or dismissed")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Duplicates.UpdateStatus(r.Context(), id, input.Status)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"status": input.Status}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/codeaucafe/snippetbox/greenlight/internal/data"
+	"github.com/codeaucafe/snippetbox/greenlight/internal/testutil"
+)
+
+// TestDuplicateScan tests that the duplicate scan finds movies with the same normalized title
+// and year and a similar runtime, and that reviewed pairs aren't added to the queue again.
+func TestDuplicateScan(t *testing.T) {
+	app, fx := newTestDBApp(t)
+	ts := newTestServer(app.routes())
+	defer ts.Close()
+
+	movie := func(title string, year, runtime int) *data.Movie {
+		return fx.Movie(func(m *data.Movie) {
+			m.Title = title
+			m.Year = int32(year)
+			m.Runtime = data.Runtime(runtime)
+		})
+	}
+
+	original := movie("The Matrix", 1999, 136)
+	duplicate := movie("Matrix, The", 1999, 138)
+	movie("The Matrix", 2021, 136)          // different year
+	movie("The Matrix!", 1999, 150)         // runtime too different
+	movie("The Matrix Reloaded", 1999, 136) // different title
+
+	token := fx.Token(fx.User(nil, "duplicates:admin"), data.ScopeAuthentication)
+
+	scan := func() {
+		t.Helper()
+
+		code, _, body := ts.request(t, http.MethodPost, "/v1/admin/duplicates/scan", token.Plaintext, `{}`)
+		testutil.Status(t, code, body, http.StatusAccepted)
+
+		task, err := app.models.Tasks.ClaimNext(context.Background(), taskStaleAfter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		app.runTask(task)
+	}
+
+	list := func() []*data.DuplicateCandidate {
+		t.Helper()
+
+		code, _, body := ts.request(t, http.MethodGet, "/v1/admin/duplicates", token.Plaintext, "")
+		testutil.Status(t, code, body, http.StatusOK)
+
+		var got struct {
+			Duplicates []*data.DuplicateCandidate `json:"duplicates"`
+		}
+		testutil.DecodeJSON(t, body, &got)
+
+		return got.Duplicates
+	}
+
+	scan()
+
+	candidates := list()
+	testutil.Equal(t, len(candidates), 1)
+	testutil.Equal(t, candidates[0].Movie.ID, original.ID)
+	testutil.Equal(t, candidates[0].Duplicate.ID, duplicate.ID)
+	testutil.Equal(t, candidates[0].RuntimeDifference, 2)
+
+	code, _, body := ts.request(t, http.MethodPatch, fmt.Sprintf("/v1/admin/duplicates/%d", candidates[0].ID),
+		token.Plaintext, `{"status": "dismissed"}`)
+	testutil.Status(t, code, body, http.StatusOK)
+
+	scan()
+
+	testutil.Equal(t, len(list()), 0)
+}
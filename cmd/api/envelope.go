@@ -0,0 +1,111 @@
+package main
+
+import "fmt"
+
+// Define an envelope type.
+type envelope map[string]interface{}
+
+// envelopeEncoder is the hook used by writeJSON() and errorResponse() to decide the structure of
+// JSON response bodies. Data receives the envelope passed to writeJSON() by a handler, and Error
+// receives the status code and message passed to errorResponse(). Both return the value which is
+// encoded as the response body.
+type envelopeEncoder interface {
+	Data(data envelope) interface{}
+	Error(status int, message interface{}) interface{}
+}
+
+// defaultEnvelope encodes response bodies exactly as the handlers describe them, with errors
+// under an "error" key.
+type defaultEnvelope struct{}
+
+func (defaultEnvelope) Data(data envelope) interface{} {
+	return data
+}
+
+func (defaultEnvelope) Error(status int, message interface{}) interface{} {
+	return envelope{"error": message}
+}
+
+// dataMetaEnvelope wraps response bodies in a {"data": ..., "meta": ...} structure. Any
+// "metadata" key in the handler's envelope is moved under "meta", and errors are returned as
+// {"error": {"status": ..., "message": ...}}.
+type dataMetaEnvelope struct{}
+
+func (dataMetaEnvelope) Data(data envelope) interface{} {
+	body := envelope{}
+	inner := envelope{}
+
+	for key, value := range data {
+		if key == "metadata" {
+			body["meta"] = value
+			continue
+		}
+		inner[key] = value
+	}
+
+	body["data"] = inner
+
+	return body
+}
+
+func (dataMetaEnvelope) Error(status int, message interface{}) interface{} {
+	return envelope{
+		"error": envelope{
+			"status":  status,
+			"message": message,
+		},
+	}
+}
+
+// flatEnvelope removes the envelope from responses which only contain a single key, so that a
+// request for a movie returns the movie object itself. Responses with more than one key (such as
+// a list with its metadata) are left as they are. Errors are returned as {"error": ...}.
+type flatEnvelope struct{}
+
+func (flatEnvelope) Data(data envelope) interface{} {
+	if len(data) != 1 {
+		return data
+	}
+
+	for _, value := range data {
+		return value
+	}
+
+	return data
+}
+
+func (flatEnvelope) Error(status int, message interface{}) interface{} {
+	return envelope{"error": message}
+}
+
+// newEnvelopeEncoder returns the envelopeEncoder with the given name, as used by the
+// -response-envelope command-line flag.
+func newEnvelopeEncoder(name string) (envelopeEncoder, error) {
+	switch name {
+	case "default":
+		return defaultEnvelope{}, nil
+	case "data":
+		return dataMetaEnvelope{}, nil
+	case "flat":
+		return flatEnvelope{}, nil
+	default:
+		return nil, fmt.Errorf("unknown response envelope %q", name)
+	}
+}
+
+// responseEnvelope returns the envelopeEncoder configured on the application, falling back to
+// the default encoder if none has been set.
+func (app *application) responseEnvelope() envelopeEncoder {
+	if app.envelope == nil {
+		return defaultEnvelope{}
+	}
+
+	return app.envelope
+}
+
+// Make sure that each of our encoders satisfies the envelopeEncoder interface.
+var (
+	_ envelopeEncoder = defaultEnvelope{}
+	_ envelopeEncoder = dataMetaEnvelope{}
+	_ envelopeEncoder = flatEnvelope{}
+)
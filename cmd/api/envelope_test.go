@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/codeaucafe/snippetbox/greenlight/internal/testutil"
+)
+
+// TestEnvelopeEncoders tests the structure of the response bodies and error bodies for each of
+// the -response-envelope options.
+func TestEnvelopeEncoders(t *testing.T) {
+	tests := []struct {
+		name      string
+		encoder   string
+		data      envelope
+		wantData  string
+		wantError string
+	}{
+		{
+			name:      "default",
+			encoder:   "default",
+			data:      envelope{"movie": envelope{"id": 1}},
+			wantData:  `{"movie":{"id":1}}`,
+			wantError: `{"error":"the requested resource could not be found"}`,
+		},
+		{
+			name:      "data",
+			encoder:   "data",
+			data:      envelope{"movies": []int{1}, "metadata": envelope{"total_records": 1}},
+			wantData:  `{"data":{"movies":[1]},"meta":{"total_records":1}}`,
+			wantError: `{"error":{"message":"the requested resource could not be found","status":404}}`,
+		},
+		{
+			name:      "flat",
+			encoder:   "flat",
+			data:      envelope{"movie": envelope{"id": 1}},
+			wantData:  `{"id":1}`,
+			wantError: `{"error":"the requested resource could not be found"}`,
+		},
+		{
+			name:      "flat with several keys",
+			encoder:   "flat",
+			data:      envelope{"movies": []int{1}, "metadata": envelope{"total_records": 1}},
+			wantData:  `{"metadata":{"total_records":1},"movies":[1]}`,
+			wantError: `{"error":"the requested resource could not be found"}`,
+		},
+	}
+
+	compact := func(t *testing.T, body []byte) string {
+		t.Helper()
+
+		var buf bytes.Buffer
+		if err := json.Compact(&buf, body); err != nil {
+			t.Fatal(err)
+		}
+		return buf.String()
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			encoder, err := newEnvelopeEncoder(tt.encoder)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			app := newTestApp()
+			app.envelope = encoder
+
+			rr := httptest.NewRecorder()
+			if err := app.writeJSON(rr, http.StatusOK, tt.data, nil); err != nil {
+				t.Fatal(err)
+			}
+			testutil.Equal(t, compact(t, rr.Body.Bytes()), tt.wantData)
+
+			rr = httptest.NewRecorder()
+			app.notFoundResponse(rr, httptest.NewRequest(http.MethodGet, "/v1/movies/1", nil))
+			testutil.Equal(t, rr.Code, http.StatusNotFound)
+			testutil.Equal(t, compact(t, rr.Body.Bytes()), tt.wantError)
+		})
+	}
+
+	_, err := newEnvelopeEncoder("nonsense")
+	if err == nil {
+		t.Error("want an error for an unknown envelope")
+	}
+}
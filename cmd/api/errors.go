@@ -1,17 +1,47 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"math"
 	"net/http"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/codeaucafe/snippetbox/greenlight/internal/data"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // logError method is a generic helper for logging an error message in *application, as well
-// as the requested method and request URL.
+// as the requested method, request URL, request ID and trace ID.
 func (app *application) logError(r *http.Request, err error) {
-	app.logger.PrintError(err, map[string]string{
+	app.logger.PrintError(err, requestLogProperties(r, nil))
+}
+
+// requestLogProperties returns the properties for a log entry written while handling a request:
+// the given properties (which can be nil) along with the request method, URL and ID, and the ID
+// of the trace which the request is part of, if any.
+func requestLogProperties(r *http.Request, properties map[string]string) map[string]string {
+	merged := map[string]string{
 		"request_method": r.Method,
 		"request_url":    r.URL.String(),
-	})
+	}
+
+	if requestID := data.RequestIDFromContext(r.Context()); requestID != "" {
+		merged["request_id"] = requestID
+	}
+
+	if sc := trace.SpanContextFromContext(r.Context()); sc.IsValid() {
+		merged["trace_id"] = sc.TraceID().String()
+	}
+
+	for key, value := range properties {
+		merged[key] = value
+	}
+
+	return merged
 }
 
 // errorResponse method is a generic helper for sending JSON-formatted error messages to the
@@ -19,12 +49,21 @@ func (app *application) logError(r *http.Request, err error) {
 // parameter, rather than just a string type, as this gives us more flexibility over the values
 // that we can include in the response.
 func (app *application) errorResponse(w http.ResponseWriter, r *http.Request, status int, message interface{}) {
-	env := envelope{"error": message}
+	// Use the application's envelopeEncoder to build the error body.
+	body := app.responseEnvelope().Error(status, message)
 
-	// Write the response using the writeJSON() helper. If this happens to return an error
+	// Include the request ID, so that the client can quote it in a support request and we can
+	// find the request in the logs.
+	if env, ok := body.(envelope); ok {
+		if requestID := data.RequestIDFromContext(r.Context()); requestID != "" {
+			env["request_id"] = requestID
+		}
+	}
+
+	// Write the response using the writeResponse() helper. If this happens to return an error
 	// then log it, and fall back to sending the client an empty response with a 500 Internal
 	// Server Error status code
-	err := app.writeJSON(w, status, env, nil)
+	err := app.writeResponse(w, status, body, nil)
 	if err != nil {
 		app.logError(r, err)
 		w.WriteHeader(500)
@@ -38,10 +77,55 @@ func (app *application) errorResponse(w http.ResponseWriter, r *http.Request, st
 func (app *application) serverErrorResponse(w http.ResponseWriter, r *http.Request, err error) {
 	app.logError(r, err)
 
+	// If the error was caused by a database failover then the request can be retried shortly,
+	// so let the client know that instead.
+	if errors.Is(err, data.ErrFailover) {
+		app.databaseFailoverResponse(w, r)
+		return
+	}
+
 	message := "the server encountered a problem and could not process your request"
+
+	// With the -errors-verbose flag (as in the development profile), the client is told what
+	// went wrong and where, to save a trip to the logs.
+	if app.config.errors.verbose {
+		app.errorResponse(w, r, http.StatusInternalServerError, map[string]interface{}{
+			"message": message,
+			"detail":  err.Error(),
+			"stack":   stackTrace(),
+		})
+		return
+	}
+
 	app.errorResponse(w, r, 500, message)
 }
 
+// stackTrace returns the current goroutine's stack trace, one line per element, for the verbose
+// error responses. When called while recovering from a panic, it includes the panic's stack.
+func stackTrace() []string {
+	return strings.Split(strings.TrimSpace(string(debug.Stack())), "\n")
+}
+
+// panicResponse sends a 500 Internal Server Error status code and JSON response to the client
+// after recovering from a panic. The response includes the incident ID that the panic was
+// logged with, in the body and the X-Incident-ID header, and with the -errors-verbose flag the
+// panic value and its stack trace too.
+func (app *application) panicResponse(w http.ResponseWriter, r *http.Request, incidentID string, recovered interface{}) {
+	w.Header().Set("X-Incident-ID", incidentID)
+
+	message := map[string]interface{}{
+		"message":     "the server encountered a problem and could not process your request",
+		"incident_id": incidentID,
+	}
+
+	if app.config.errors.verbose {
+		message["detail"] = fmt.Sprintf("panic: %v", recovered)
+		message["stack"] = stackTrace()
+	}
+
+	app.errorResponse(w, r, http.StatusInternalServerError, message)
+}
+
 // notFoundResponse method is used to send a 404 Not Found status code and JSON response to the
 // client.
 func (app *application) notFoundResponse(w http.ResponseWriter, r *http.Request) {
@@ -50,9 +134,15 @@ func (app *application) notFoundResponse(w http.ResponseWriter, r *http.Request)
 }
 
 // methodNotAllowedResponse method is used to send a 405 Method Not Allowed status code and
-// JSON response to the client.
+// JSON response to the client. The router sets the Allow header to the methods which are
+// registered for the requested path before calling this, so we include them in the message too.
 func (app *application) methodNotAllowedResponse(w http.ResponseWriter, r *http.Request) {
-	message := fmt.Sprintf("the %s method is not supported this resource", r.Method)
+	message := fmt.Sprintf("the %s method is not supported by this resource", r.Method)
+
+	if allow := w.Header().Get("Allow"); allow != "" {
+		message = fmt.Sprintf("%s (allowed methods: %s)", message, allow)
+	}
+
 	app.errorResponse(w, r, http.StatusMethodNotAllowed, message)
 }
 
@@ -61,6 +151,13 @@ func (app *application) badRequestResponse(w http.ResponseWriter, r *http.Reques
 	app.errorResponse(w, r, http.StatusBadRequest, err.Error())
 }
 
+// unsupportedMediaTypeResponse sends a JSON-formatted error message with a 415 Unsupported Media
+// Type status code to the client, when the request body isn't one of the supported types.
+func (app *application) unsupportedMediaTypeResponse(w http.ResponseWriter, r *http.Request, supported string) {
+	message := fmt.Sprintf("the Content-Type must be %s", supported)
+	app.errorResponse(w, r, http.StatusUnsupportedMediaType, message)
+}
+
 // failedValidationResponse sends JSON-formatted error message to client with UnprocessableEntity
 // 422 status code when Validation fails.
 // Note that the errors parameter here has the type map[string]string,
@@ -79,10 +176,92 @@ func (app *application) editConflictResponse(w http.ResponseWriter, r *http.Requ
 // rateLimitExceedResponse sends a JSON-formatted error message with a 429 Too Many Requests
 // status code to the client.
 func (app *application) rateLimitExceededResponse(w http.ResponseWriter, r *http.Request) {
+	rateLimitRejections.WithLabelValues("ip").Inc()
+
+	message := "rate limited exceeded"
+	app.errorResponse(w, r, http.StatusTooManyRequests, message)
+}
+
+// userRateLimitExceededResponse sends a JSON-formatted error message with a 429 Too Many Requests
+// status code to the client, when the authenticated user has used up their rate limit.
+func (app *application) userRateLimitExceededResponse(w http.ResponseWriter, r *http.Request) {
+	rateLimitRejections.WithLabelValues("user").Inc()
+
 	message := "rate limited exceeded"
 	app.errorResponse(w, r, http.StatusTooManyRequests, message)
 }
 
+// emailRateLimitExceededResponse sends a JSON-formatted error message with a 429 Too Many Requests
+// status code to the client, when too many emails have recently been sent to the address in
+// their request.
+func (app *application) emailRateLimitExceededResponse(w http.ResponseWriter, r *http.Request, retryAfter time.Duration) {
+	rateLimitRejections.WithLabelValues("email").Inc()
+
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+
+	message := "too many emails have been sent to this address, please try again later"
+	app.errorResponse(w, r, http.StatusTooManyRequests, message)
+}
+
+// maintenanceModeResponse sends a JSON-formatted error message with a 503 Service Unavailable
+// status code to the client while maintenance mode is enabled.
+func (app *application) maintenanceModeResponse(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Retry-After", "60")
+
+	message := "the server is undergoing maintenance, please try again later"
+	app.errorResponse(w, r, http.StatusServiceUnavailable, message)
+}
+
+// loadSheddingResponse sends a JSON-formatted error message with a 503 Service Unavailable status
+// code to the client when a low priority request is turned away because load is being shed.
+func (app *application) loadSheddingResponse(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Retry-After", "30")
+
+	message := "the server is under heavy load, please try again later"
+	app.errorResponse(w, r, http.StatusServiceUnavailable, message)
+}
+
+// databaseFailoverResponse sends a JSON-formatted error message with a 503 Service Unavailable
+// status code to the client when a request fails because the database is failing over. Unlike
+// maintenance mode, the message includes a "database_failover" code so that clients can tell
+// the two apart, and the Retry-After is short because failovers usually complete in seconds.
+func (app *application) databaseFailoverResponse(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Retry-After", "5")
+
+	message := map[string]string{
+		"code":    "database_failover",
+		"message": "the database is temporarily unavailable, please try again shortly",
+	}
+	app.errorResponse(w, r, http.StatusServiceUnavailable, message)
+}
+
+// quotaExceededResponse sends a JSON-formatted error message with a 429 Too Many Requests status
+// code to the client, along with the time at which their request quota resets.
+func (app *application) quotaExceededResponse(w http.ResponseWriter, r *http.Request, reset time.Time) {
+	rateLimitRejections.WithLabelValues("quota").Inc()
+
+	w.Header().Set("Retry-After", strconv.Itoa(int(reset.Sub(app.clock.Now()).Seconds())+1))
+
+	message := fmt.Sprintf("request quota exceeded, the quota resets at %s", reset.Format(time.RFC3339))
+	app.errorResponse(w, r, http.StatusTooManyRequests, message)
+}
+
+// searchQuotaExceededResponse sends a JSON-formatted error message with a 429 Too Many Requests
+// status code to the client, when they have used up their daily quota of public searches.
+func (app *application) searchQuotaExceededResponse(w http.ResponseWriter, r *http.Request) {
+	rateLimitRejections.WithLabelValues("search_quota").Inc()
+
+	message := "daily search quota exceeded, please try again later"
+	app.errorResponse(w, r, http.StatusTooManyRequests, message)
+}
+
+// botDetectedResponse sends a JSON-formatted error message with a 403 Forbidden status code to
+// the client, when their request to a public endpoint looks like it comes from a bot.
+func (app *application) botDetectedResponse(w http.ResponseWriter, r *http.Request) {
+	message := "automated requests are not allowed on this endpoint"
+	app.errorResponse(w, r, http.StatusForbidden, message)
+}
+
 // invalidCredentialsResponse sends a JSON-formatted error with a 401 Unauthorized status code
 // to the client.
 func (app *application) invalidCredentialsResponse(w http.ResponseWriter, r *http.Request) {
@@ -99,6 +278,23 @@ func (app *application) invalidAuthenticationTokenResponse(w http.ResponseWriter
 	app.errorResponse(w, r, http.StatusUnauthorized, message)
 }
 
+// invalidSignatureResponse sends a JSON-formatted error with a 401 Unauthorized status code to the
+// client, when a request signed with an API key has a missing, stale, replayed or invalid
+// signature. The message says which, to help the developers of machine clients.
+func (app *application) invalidSignatureResponse(w http.ResponseWriter, r *http.Request, message string) {
+	w.Header().Set("WWW-Authenticate", "Signature")
+
+	app.errorResponse(w, r, http.StatusUnauthorized, message)
+}
+
+// invalidRefreshTokenResponse sends a JSON-formatted error with a 401 Unauthorized status code to
+// the client, when the refresh token they sent doesn't exist, has expired, or has already been
+// used.
+func (app *application) invalidRefreshTokenResponse(w http.ResponseWriter, r *http.Request) {
+	message := "invalid or expired refresh token"
+	app.errorResponse(w, r, http.StatusUnauthorized, message)
+}
+
 // authenticationRequiredResponse sends a JSON-formatted error with a 401 Unauthorized status code
 // to the client.
 func (app *application) authenticationRequiredResponse(w http.ResponseWriter, r *http.Request) {
@@ -113,7 +309,66 @@ func (app *application) inactiveAccountResponse(w http.ResponseWriter, r *http.R
 	app.errorResponse(w, r, http.StatusForbidden, message)
 }
 
+// The policies for the -access-denied flag, which decides how requests that the caller doesn't
+// have permission for are answered. With forbidden they get a 403 Forbidden response, which tells
+// the client what's wrong. With not_found they get exactly the same 404 Not Found response as a
+// request for something which doesn't exist, so that probing status codes can't tell the two
+// apart, for instance to find out which admin endpoints a token could use.
+//
+// Resources which belong to a user, such as saved searches, tasks and reviews awaiting
+// moderation, are looked up by their owner, so other users always get a 404 for them whatever
+// the policy. Authentication (401) and inactive account (403) errors are about the caller rather
+// than the resource, so they aren't affected either.
+const (
+	accessDeniedForbidden = "forbidden"
+	accessDeniedNotFound  = "not_found"
+)
+
+// notPermittedResponse sends the response for a request which the caller doesn't have the
+// permission for, as set by the -access-denied flag: a JSON-formatted error with a 403 Forbidden
+// status code, or the same 404 Not Found response as notFoundResponse().
 func (app *application) notPermittedResponse(w http.ResponseWriter, r *http.Request) {
+	if app.config.accessDenied == accessDeniedNotFound {
+		app.notFoundResponse(w, r)
+		return
+	}
+
 	message := "your user account doesn't have the necessary permissions to access this resource"
 	app.errorResponse(w, r, http.StatusForbidden, message)
 }
+
+// reportNotReadyResponse sends a JSON-formatted error with a 409 Conflict status code to the
+// client, when they try to download a report which hasn't completed.
+func (app *application) reportNotReadyResponse(w http.ResponseWriter, r *http.Request, status string) {
+	message := fmt.Sprintf("the report cannot be downloaded as its status is %s", status)
+	app.errorResponse(w, r, http.StatusConflict, message)
+}
+
+// preconditionFailedResponse sends a JSON-formatted error with a 412 Precondition Failed status
+// code to the client, when the resource has changed since the version named in their If-Match
+// header.
+func (app *application) preconditionFailedResponse(w http.ResponseWriter, r *http.Request) {
+	message := "the resource has been modified since you last fetched it, please fetch it again"
+	app.errorResponse(w, r, http.StatusPreconditionFailed, message)
+}
+
+// preconditionRequiredResponse sends a JSON-formatted error with a 428 Precondition Required
+// status code to the client, when they try to change a resource without an If-Match header.
+func (app *application) preconditionRequiredResponse(w http.ResponseWriter, r *http.Request) {
+	message := "this request must include an If-Match header with the resource's ETag"
+	app.errorResponse(w, r, http.StatusPreconditionRequired, message)
+}
+
+// backupInProgressResponse sends a JSON-formatted error with a 409 Conflict status code to the
+// client, when they try to start a backup while another one is still running.
+func (app *application) backupInProgressResponse(w http.ResponseWriter, r *http.Request) {
+	message := "a backup is already in progress, please try again later"
+	app.errorResponse(w, r, http.StatusConflict, message)
+}
+
+// invalidSignedURLResponse sends a JSON-formatted error with a 403 Forbidden status code to the
+// client, when they use a storage URL whose signature is wrong or has expired.
+func (app *application) invalidSignedURLResponse(w http.ResponseWriter, r *http.Request) {
+	message := "this link is invalid or has expired"
+	app.errorResponse(w, r, http.StatusForbidden, message)
+}
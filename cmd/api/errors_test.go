@@ -0,0 +1,132 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+
+	"github.com/codeaucafe/snippetbox/greenlight/internal/data"
+	"github.com/codeaucafe/snippetbox/greenlight/internal/testutil"
+)
+
+// TestServerErrorResponseFailover checks that errors caused by a database failover are sent as a
+// 503 with the database_failover code, while other errors are still a 500.
+func TestServerErrorResponseFailover(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		wantCode int
+	}{
+		{name: "failover", err: fmt.Errorf("%w: pq: terminating connection due to administrator command", data.ErrFailover), wantCode: http.StatusServiceUnavailable},
+		{name: "other", err: errors.New("boom"), wantCode: http.StatusInternalServerError},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApp()
+
+			rr := httptest.NewRecorder()
+			app.serverErrorResponse(rr, httptest.NewRequest(http.MethodPost, "/v1/movies", nil), tt.err)
+
+			testutil.Equal(t, rr.Code, tt.wantCode)
+
+			if tt.wantCode == http.StatusServiceUnavailable {
+				testutil.Equal(t, rr.Header().Get("Retry-After"), "5")
+				testutil.StringContains(t, rr.Body.String(), `"code": "database_failover"`)
+			}
+		})
+	}
+}
+
+// TestNotPermittedResponse tests that requests without the permission they need get a 403 by
+// default, and the very same response as a missing resource under the not_found policy.
+func TestNotPermittedResponse(t *testing.T) {
+	send := func(app *application, respond func(http.ResponseWriter, *http.Request)) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		respond(rr, httptest.NewRequest(http.MethodGet, "/v1/users/1", nil))
+		return rr
+	}
+
+	app := newTestApp()
+	app.config.accessDenied = accessDeniedForbidden
+
+	testutil.Equal(t, send(app, app.notPermittedResponse).Code, http.StatusForbidden)
+
+	app.config.accessDenied = accessDeniedNotFound
+
+	denied := send(app, app.notPermittedResponse)
+	missing := send(app, app.notFoundResponse)
+
+	testutil.Equal(t, denied.Code, http.StatusNotFound)
+	testutil.Equal(t, denied.Body.String(), missing.Body.String())
+	testutil.Equal(t, fmt.Sprint(denied.Header()), fmt.Sprint(missing.Header()))
+}
+
+// TestVerboseErrors tests that the error and a stack trace are only sent to the client with the
+// -errors-verbose flag.
+func TestVerboseErrors(t *testing.T) {
+	send := func(verbose bool) *httptest.ResponseRecorder {
+		app := newTestApp()
+		app.config.errors.verbose = verbose
+
+		rr := httptest.NewRecorder()
+		app.serverErrorResponse(rr, httptest.NewRequest(http.MethodGet, "/v1/movies", nil), errors.New("boom"))
+		testutil.Equal(t, rr.Code, http.StatusInternalServerError)
+		return rr
+	}
+
+	if body := send(false).Body.String(); strings.Contains(body, "boom") || strings.Contains(body, "stack") {
+		t.Errorf("got error details without -errors-verbose: %s", body)
+	}
+
+	var got struct {
+		Error struct {
+			Message string   `json:"message"`
+			Detail  string   `json:"detail"`
+			Stack   []string `json:"stack"`
+		} `json:"error"`
+	}
+	testutil.DecodeJSON(t, send(true).Body.Bytes(), &got)
+
+	testutil.Equal(t, got.Error.Message, "the server encountered a problem and could not process your request")
+	testutil.Equal(t, got.Error.Detail, "boom")
+	testutil.StringContains(t, strings.Join(got.Error.Stack, "\n"), "TestVerboseErrors")
+}
+
+// TestMethodNotAllowed tests that a request with a method which the path doesn't support gets a
+// 405 Method Not Allowed response listing the allowed methods, and that a plain OPTIONS request
+// gets a 204 No Content response with the same Allow header.
+func TestMethodNotAllowed(t *testing.T) {
+	app := newTestApp()
+
+	// Build the router in the same way as routes(), but without the middleware chain, as the
+	// metrics middleware can only be set up once per process.
+	router := httprouter.New()
+	router.MethodNotAllowed = http.HandlerFunc(app.methodNotAllowedResponse)
+
+	cr := newCORSRouter(router, app.defaultCORSPolicy())
+	app.registerRoutes(cr, app.operationalRouteTable())
+
+	send := func(method string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		r, _ := app.contextSetRouteInfo(httptest.NewRequest(method, "/v1/healthcheck", nil))
+		cr.ServeHTTP(rr, r)
+		return rr
+	}
+
+	rr := send(http.MethodDelete)
+	testutil.Status(t, rr.Code, rr.Body.Bytes(), http.StatusMethodNotAllowed)
+	testutil.Equal(t, rr.Header().Get("Allow"), "GET, HEAD, OPTIONS")
+	testutil.StringContains(t, rr.Body.String(),
+		"the DELETE method is not supported by this resource (allowed methods: GET, HEAD, OPTIONS)")
+
+	rr = send(http.MethodOptions)
+	testutil.Status(t, rr.Code, rr.Body.Bytes(), http.StatusNoContent)
+	testutil.Equal(t, rr.Header().Get("Allow"), "GET, HEAD, OPTIONS")
+	testutil.Equal(t, rr.Body.Len(), 0)
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/codeaucafe/snippetbox/greenlight/internal/data"
+	"github.com/codeaucafe/snippetbox/greenlight/internal/validator"
+)
+
+const (
+	// movieEventsBuffer is the number of events which can be waiting to be sent to a client of
+	// the movie events stream. A client which falls further behind than this is disconnected, and
+	// catches up from the events table when it reconnects.
+	movieEventsBuffer = 256
+	// movieEventsHeartbeat is how often a comment is sent on an idle stream, so that proxies
+	// don't close the connection, and so that we notice clients which have gone away.
+	movieEventsHeartbeat = 15 * time.Second
+	// movieEventsRetry is how long clients are told to wait before reconnecting.
+	movieEventsRetry = 2 * time.Second
+	// movieEventsReplayBatch is the number of events read at once when a client resumes.
+	movieEventsReplayBatch = 500
+)
+
+// replayEventsHandler handles the "GET /v1/events/replay" endpoint and returns a page of the
+// domain events (movies being created, updated and deleted), oldest first, for consumers which
+// need to catch up on events they've missed. The since query string parameter is the cursor
+// returned as next_cursor by the previous page, and is left out to start from the first event.
+//
+// Events are in commit order (see data.EventModel), so following next_cursor visits every event
+// exactly once, in the same order for every consumer. When has_more is false the consumer has
+// caught up, and can poll again later with the same next_cursor for any newer events.
+func (app *application) replayEventsHandler(w http.ResponseWriter, r *http.Request) {
+	v := validator.New()
+	qs := r.URL.Query()
+
+	since := app.readStrings(qs, "since", "0")
+	limit := app.readInt(qs, "limit", 100, v)
+
+	after, err := strconv.ParseInt(since, 10, 64)
+	v.Check(err == nil && after >= 0, "since", "must be a cursor returned by this endpoint")
+	v.Check(limit > 0, "limit", "must be greater than zero")
+	v.Check(limit <= 1000, "limit", "must be a maximum of 1000")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// Fetch one more event than asked for, to find out if there are any more after this page.
+	events, err := app.models.Events.GetAfter(r.Context(), after, limit+1)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	hasMore := len(events) > limit
+	if hasMore {
+		events = events[:limit]
+	}
+
+	next := after
+	if len(events) > 0 {
+		next = events[len(events)-1].ID
+	}
+
+	metadata := envelope{
+		"next_cursor": strconv.FormatInt(next, 10),
+		"has_more":    hasMore,
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"events": events, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// movieEventsHandler handles the "GET /v1/movies/events" endpoint, which streams the movie.*
+// events as server-sent events while they happen. Each event's id is the ID of the domain event,
+// its event name is the event type, and its data is the event as JSON, in the same shape as the
+// replay endpoint.
+//
+// Live events come from the broker that the movie model publishes to, so they only cover the
+// writes made through this instance. A client which reconnects sends the ID of the last event it
+// received in the Last-Event-ID header (browsers' EventSource does this on its own), and is sent
+// every event since then from the events table before the live ones, so nothing is missed
+// whichever instance it reconnects to. Events may occasionally be sent twice around a reconnect,
+// so clients should ignore IDs they've already seen.
+//
+// The stream ends shortly before the server's write timeout would cut it off, when the client
+// falls too far behind, and when the server shuts down; in each case the client reconnects and
+// resumes where it left off.
+func (app *application) movieEventsHandler(w http.ResponseWriter, r *http.Request) {
+	started := time.Now()
+
+	after := int64(-1)
+
+	if lastEventID := r.Header.Get("Last-Event-ID"); lastEventID != "" {
+		id, err := strconv.ParseInt(lastEventID, 10, 64)
+		if err != nil || id < 0 {
+			v := validator.New()
+			v.AddError("Last-Event-ID", "must be the ID of an event sent by this endpoint")
+			app.failedValidationResponse(w, r, v.Errors)
+			return
+		}
+
+		after = id
+	}
+
+	// Subscribe before catching up from the events table, so that no event which commits in
+	// between is missed.
+	sub := app.models.Movies.Broker.Subscribe(movieEventsBuffer)
+	defer sub.Close()
+
+	closing, done := app.streams.track("sse")
+	defer done()
+
+	flusher, _ := w.(http.Flusher)
+
+	flush := func() {
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	_, err := fmt.Fprintf(w, "retry: %d\n\n", movieEventsRetry.Milliseconds())
+	if err != nil {
+		return
+	}
+	flush()
+
+	// Catch up on the events since the Last-Event-ID. Events become visible in ID order, so once
+	// we've read up to an ID, every live event with an ID at or below it has already been sent.
+	sent := after
+
+	for after >= 0 {
+		events, err := app.models.Events.GetAfter(r.Context(), sent, movieEventsReplayBatch)
+		if err != nil {
+			// The response has already started, so all we can do is end the stream, and let
+			// the client try again.
+			app.logger.PrintError(err, nil)
+			return
+		}
+
+		for _, event := range events {
+			if err := writeServerSentEvent(w, event); err != nil {
+				return
+			}
+			sent = event.ID
+		}
+		flush()
+
+		if len(events) < movieEventsReplayBatch {
+			break
+		}
+	}
+
+	heartbeat := time.NewTicker(movieEventsHeartbeat)
+	defer heartbeat.Stop()
+
+	// End the stream before the write timeout does, so that the client gets a clean end of
+	// stream rather than a broken connection.
+	var deadline <-chan time.Time
+	if timeout := app.config.server.writeTimeout; timeout > 0 {
+		timer := time.NewTimer(timeout - timeout/10 - time.Since(started))
+		defer timer.Stop()
+		deadline = timer.C
+	}
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-closing:
+			return
+		case <-deadline:
+			return
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+			flush()
+		case event, ok := <-sub.Events():
+			if !ok {
+				return
+			}
+
+			if event.ID <= sent {
+				continue
+			}
+
+			if err := writeServerSentEvent(w, event); err != nil {
+				return
+			}
+			flush()
+		}
+	}
+}
+
+// writeServerSentEvent writes an event in the text/event-stream format. json.Marshal() output
+// never contains a newline, so the data fits on a single data line.
+func writeServerSentEvent(w http.ResponseWriter, event *data.Event) error {
+	js, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Type, js)
+	return err
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/codeaucafe/snippetbox/greenlight/internal/data"
+	"github.com/codeaucafe/snippetbox/greenlight/internal/testutil"
+)
+
+// TestReplayEvents tests that creating, updating and deleting a movie records events, and that
+// the "GET /v1/events/replay" endpoint pages through them in order by following next_cursor.
+func TestReplayEvents(t *testing.T) {
+	app, fx := newTestDBApp(t)
+	ts := newTestServer(app.routes())
+	defer ts.Close()
+
+	writer := fx.Token(fx.User(nil, "movies:read", "movies:write"), data.ScopeAuthentication)
+
+	code, _, body := ts.request(t, http.MethodPost, "/v1/movies", writer.Plaintext,
+		`{"title": "Moana", "year": 2016, "runtime": "107 mins", "genres": ["animation"]}`)
+	testutil.Status(t, code, body, http.StatusCreated)
+
+	var created struct {
+		Movie data.Movie `json:"movie"`
+	}
+	testutil.DecodeJSON(t, body, &created)
+
+	moviePath := fmt.Sprintf("/v1/movies/%d", created.Movie.ID)
+
+	code, _, body = ts.requestWithHeaders(t, http.MethodPatch, moviePath, writer.Plaintext, `{"year": 2017}`,
+		http.Header{"If-Match": {`"1"`}})
+	testutil.Status(t, code, body, http.StatusOK)
+
+	code, _, body = ts.request(t, http.MethodDelete, moviePath, writer.Plaintext, "")
+	testutil.Status(t, code, body, http.StatusOK)
+
+	type page struct {
+		Events   []data.Event `json:"events"`
+		Metadata struct {
+			NextCursor string `json:"next_cursor"`
+			HasMore    bool   `json:"has_more"`
+		} `json:"metadata"`
+	}
+
+	var types []string
+	cursor := ""
+
+	for i := 0; i < 5; i++ {
+		code, _, body = ts.request(t, http.MethodGet, "/v1/events/replay?limit=2&since="+cursor, writer.Plaintext, "")
+		testutil.Status(t, code, body, http.StatusOK)
+
+		var got page
+		testutil.DecodeJSON(t, body, &got)
+
+		for _, event := range got.Events {
+			testutil.Equal(t, event.ResourceID, created.Movie.ID)
+			types = append(types, event.Type)
+		}
+
+		cursor = got.Metadata.NextCursor
+		if !got.Metadata.HasMore {
+			break
+		}
+	}
+
+	testutil.Equal(t, fmt.Sprint(types), fmt.Sprint([]string{
+		data.EventMovieCreated, data.EventMovieUpdated, data.EventMovieDeleted,
+	}))
+
+	// Once caught up, polling with the same cursor returns nothing new.
+	code, _, body = ts.request(t, http.MethodGet, "/v1/events/replay?since="+cursor, writer.Plaintext, "")
+	testutil.Status(t, code, body, http.StatusOK)
+
+	var caughtUp page
+	testutil.DecodeJSON(t, body, &caughtUp)
+	testutil.Equal(t, len(caughtUp.Events), 0)
+	testutil.Equal(t, caughtUp.Metadata.NextCursor, cursor)
+
+	code, _, body = ts.request(t, http.MethodGet, "/v1/events/replay?since=abc", writer.Plaintext, "")
+	testutil.Status(t, code, body, http.StatusUnprocessableEntity)
+}
+
+// TestMovieEventsStream tests that the "GET /v1/movies/events" endpoint resumes from the
+// Last-Event-ID by replaying the events since then, and then streams new events as movies are
+// written.
+func TestMovieEventsStream(t *testing.T) {
+	app, fx := newTestDBApp(t)
+	ts := newTestServer(app.routes())
+	defer ts.Close()
+
+	writer := fx.Token(fx.User(nil, "movies:read", "movies:write"), data.ScopeAuthentication)
+
+	create := func(title string) {
+		code, _, body := ts.request(t, http.MethodPost, "/v1/movies", writer.Plaintext,
+			fmt.Sprintf(`{"title": %q, "year": 2016, "runtime": "107 mins", "genres": ["animation"]}`, title))
+		testutil.Status(t, code, body, http.StatusCreated)
+	}
+
+	create("Moana")
+
+	req, err := http.NewRequest(http.MethodGet, ts.URL+"/v1/movies/events", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+writer.Plaintext)
+	req.Header.Set("Last-Event-ID", "0")
+
+	res, err := ts.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	testutil.Equal(t, res.StatusCode, http.StatusOK)
+	testutil.Equal(t, res.Header.Get("Content-Type"), "text/event-stream")
+
+	// Read the data lines of the stream in the background, so that the test can time out.
+	lines := make(chan string)
+	go func() {
+		scanner := bufio.NewScanner(res.Body)
+		for scanner.Scan() {
+			if strings.HasPrefix(scanner.Text(), "data: ") {
+				lines <- scanner.Text()
+			}
+		}
+		close(lines)
+	}()
+
+	next := func() string {
+		select {
+		case line := <-lines:
+			return line
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for an event")
+			return ""
+		}
+	}
+
+	testutil.StringContains(t, next(), `"title":"Moana"`)
+
+	create("Soul")
+
+	line := next()
+	testutil.StringContains(t, line, `"type":"movie.created"`)
+	testutil.StringContains(t, line, `"title":"Soul"`)
+
+	code, _, body := ts.requestWithHeaders(t, http.MethodGet, "/v1/movies/events", writer.Plaintext, "",
+		http.Header{"Last-Event-ID": {"abc"}})
+	testutil.Status(t, code, body, http.StatusUnprocessableEntity)
+}
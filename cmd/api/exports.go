@@ -0,0 +1,286 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/codeaucafe/snippetbox/greenlight/internal/data"
+	"github.com/codeaucafe/snippetbox/greenlight/internal/validator"
+)
+
+// createExportHandler handles the "POST /v1/users/me/exports" endpoint and schedules a
+// recurring export of the movies matching a search filter for the current user. The first
+// export is sent one period (day, week or month) after it is scheduled.
+func (app *application) createExportHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Name      string             `json:"name"`
+		Filter    *data.SearchFilter `json:"filter"`
+		Format    string             `json:"format"`
+		Frequency string             `json:"frequency"`
+		NewOnly   *bool              `json:"new_only"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if input.Filter == nil {
+		v.AddError("filter", "must be provided")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	now := app.clock.Now()
+
+	export := &data.ScheduledExport{
+		UserID:    app.contextGetUser(r).ID,
+		Name:      input.Name,
+		Filter:    *input.Filter,
+		Format:    input.Format,
+		Frequency: input.Frequency,
+		NewOnly:   true,
+		NextRunAt: data.NextExportRun(input.Frequency, now, now),
+	}
+
+	if input.NewOnly != nil {
+		export.NewOnly = *input.NewOnly
+	}
+
+	if data.ValidateScheduledExport(v, export); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Exports.Insert(r.Context(), export)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"export": export}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// listExportsHandler handles the "GET /v1/users/me/exports" endpoint and returns all of the
+// current user's scheduled exports.
+func (app *application) listExportsHandler(w http.ResponseWriter, r *http.Request) {
+	exports, err := app.models.Exports.GetAllForUser(r.Context(), app.contextGetUser(r).ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"exports": exports}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// deleteExportHandler handles the "DELETE /v1/users/me/exports/:id" endpoint and cancels a
+// scheduled export.
+func (app *application) deleteExportHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	err = app.models.Exports.Delete(r.Context(), id, app.contextGetUser(r).ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "export successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// downloadExportHandler handles the "GET /v1/users/me/exports/:id/download" endpoint and sends the
+// most recent run of one of the current user's scheduled exports as a file download. A 404 Not
+// Found response is sent if the export hasn't run yet.
+func (app *application) downloadExportHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	key, err := app.models.Exports.GetArtifactKey(r.Context(), id, app.contextGetUser(r).ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.sendObject(w, r, key, "greenlight-export-"+path.Base(key))
+}
+
+// runScheduledExports generates every scheduled export which is due, and emails their users.
+// Each export is claimed before it is run, so that only one instance of the application sends it.
+func (app *application) runScheduledExports() {
+	job := startJob("scheduled_exports")
+	defer job.finish()
+
+	now := app.clock.Now()
+
+	due, err := app.models.Exports.GetDue(context.Background(), now)
+	if err != nil {
+		job.fail()
+		app.logger.PrintError(err, nil)
+		return
+	}
+
+	for _, d := range due {
+		export := d.Export
+
+		err := app.models.Exports.Claim(context.Background(), export, now)
+		if err != nil {
+			if !errors.Is(err, data.ErrEditConflict) {
+				job.fail()
+				app.logger.PrintError(err, nil)
+			}
+			continue
+		}
+
+		err = app.sendExport(export, d.Email, now)
+		if err != nil {
+			job.fail()
+			app.logger.PrintError(err, map[string]string{
+				"export_id": strconv.FormatInt(export.ID, 10),
+			})
+		}
+	}
+}
+
+// sendExport generates a single export, writes it to storage and emails the user to let them know
+// that it's ready to download. The previous run of the export is replaced, and its object is left
+// for the storage cleanup to delete.
+func (app *application) sendExport(export *data.ScheduledExport, email string, now time.Time) error {
+	filters := data.Filters{Page: 1, PageSize: data.MaxExportRows, Sort: "id", SortSafeList: []string{"id"}}
+
+	movies, _, err := app.models.Movies.Search(context.Background(), export.ExportFilter(), filters)
+	if err != nil {
+		return err
+	}
+
+	contentType := "application/json"
+	if export.Format == "csv" {
+		contentType = "text/csv"
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), storagePutTimeout)
+	defer cancel()
+
+	key := fmt.Sprintf("exports/%d/%s.%s", export.ID, now.UTC().Format("20060102T150405Z"), export.Format)
+
+	_, err = app.putObject(ctx, key, contentType, func(w io.Writer) error {
+		return renderExport(w, export.Format, movies)
+	})
+	if err != nil {
+		return err
+	}
+
+	err = app.models.Exports.SetArtifactKey(ctx, export.ID, key)
+	if err != nil {
+		return err
+	}
+
+	err = app.sendEmail(email, "scheduled_export.tmpl", map[string]interface{}{
+		"exportID":   export.ID,
+		"exportName": export.Name,
+		"frequency":  export.Frequency,
+		"count":      len(movies),
+		"newOnly":    export.NewOnly,
+	})
+	if err != nil {
+		return err
+	}
+
+	if len(movies) > 0 {
+		return app.models.Exports.UpdateLastMovieID(context.Background(), export.ID, movies[len(movies)-1].ID)
+	}
+
+	return nil
+}
+
+// runScheduledExportsPeriodically calls runScheduledExports() once every interval. It runs
+// until the application exits.
+func (app *application) runScheduledExportsPeriodically(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		app.runScheduledExports()
+	}
+}
+
+// renderExport writes a list of movies to w in the given export format, a movie at a time.
+func renderExport(w io.Writer, format string, movies []*data.Movie) error {
+	switch format {
+	case "json":
+		return writeJSONArray(w, len(movies), func(i int) interface{} {
+			return movies[i]
+		})
+
+	case "csv":
+		cw := csv.NewWriter(w)
+
+		err := cw.Write(movieCSVHeader)
+		if err != nil {
+			return err
+		}
+
+		for _, movie := range movies {
+			err := cw.Write(movieCSVRecord(movie))
+			if err != nil {
+				return err
+			}
+		}
+
+		cw.Flush()
+
+		return cw.Error()
+
+	default:
+		return fmt.Errorf("unsupported export format %q", format)
+	}
+}
+
+// movieCSVHeader is the header row of the CSV exports of movies.
+var movieCSVHeader = []string{"id", "title", "year", "runtime", "genres"}
+
+// movieCSVRecord returns the CSV row for a movie, with the columns in movieCSVHeader. The runtime
+// is a number of minutes and the genres are separated by semicolons, which is the layout that the
+// bulk import endpoint reads.
+func movieCSVRecord(movie *data.Movie) []string {
+	return []string{
+		strconv.FormatInt(movie.ID, 10),
+		movie.Title,
+		strconv.Itoa(int(movie.Year)),
+		strconv.Itoa(int(movie.Runtime)),
+		strings.Join(movie.Genres, ";"),
+	}
+}
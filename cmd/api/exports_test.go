@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/codeaucafe/snippetbox/greenlight/internal/clock"
+	"github.com/codeaucafe/snippetbox/greenlight/internal/data"
+	"github.com/codeaucafe/snippetbox/greenlight/internal/mailer"
+	"github.com/codeaucafe/snippetbox/greenlight/internal/testutil"
+)
+
+// TestScheduledExports tests that a scheduled export is only run once it's due, that each run is
+// claimed so that it's sent once, that a new_only export only contains the movies added since its
+// last run, and that only its owner can download or delete it.
+func TestScheduledExports(t *testing.T) {
+	app, fx := newTestDBApp(t)
+	ts := newTestServer(app.routes())
+	defer ts.Close()
+
+	existing := fx.Movie(func(m *data.Movie) { m.Title = "Existing"; m.Year = 2005 })
+	user := fx.User(nil, "movies:read")
+	owner := fx.Token(user, data.ScopeAuthentication)
+	other := fx.Token(fx.User(nil, "movies:read"), data.ScopeAuthentication)
+
+	code, _, body := ts.request(t, http.MethodPost, "/v1/users/me/exports", owner.Plaintext,
+		`{"name": "Recent", "filter": {"field": "year", "op": "gte", "value": 2000}, "format": "csv",
+		"frequency": "hourly"}`)
+	testutil.Status(t, code, body, http.StatusUnprocessableEntity)
+
+	code, _, body = ts.request(t, http.MethodPost, "/v1/users/me/exports", owner.Plaintext,
+		`{"name": "Recent", "filter": {"field": "year", "op": "gte", "value": 2000}, "format": "csv",
+		"frequency": "daily"}`)
+	testutil.Status(t, code, body, http.StatusCreated)
+
+	var created struct {
+		Export data.ScheduledExport `json:"export"`
+	}
+	testutil.DecodeJSON(t, body, &created)
+
+	exportPath := fmt.Sprintf("/v1/users/me/exports/%d", created.Export.ID)
+
+	code, _, body = ts.request(t, http.MethodGet, exportPath+"/download", owner.Plaintext, "")
+	testutil.Status(t, code, body, http.StatusNotFound)
+
+	recorder := app.mailer.(*mailer.Recorder)
+	mock := app.clock.(*clock.Mock)
+
+	// The first export isn't due until a day after it was scheduled.
+	app.runScheduledExports()
+	testutil.Equal(t, len(recorder.SentTo(user.Email)), 0)
+
+	mock.Advance(24 * time.Hour)
+	app.runScheduledExports()
+	app.runScheduledExports()
+
+	emails := recorder.SentTo(user.Email)
+	testutil.Equal(t, len(emails), 1)
+	testutil.Equal(t, emails[0].Template, "scheduled_export.tmpl")
+	testutil.Equal(t, emails[0].Data.(map[string]interface{})["count"].(int), 1)
+
+	code, _, body = ts.request(t, http.MethodGet, exportPath+"/download", other.Plaintext, "")
+	testutil.Status(t, code, body, http.StatusNotFound)
+
+	code, header, body := ts.request(t, http.MethodGet, exportPath+"/download", owner.Plaintext, "")
+	testutil.Status(t, code, body, http.StatusOK)
+	testutil.Equal(t, header.Get("Content-Type"), "text/csv")
+	testutil.StringContains(t, string(body), existing.Title)
+
+	// The next run only has the movies added since the first one.
+	added := fx.Movie(func(m *data.Movie) { m.Title = "Brand New"; m.Year = 2010 })
+
+	mock.Advance(24 * time.Hour)
+	app.runScheduledExports()
+
+	emails = recorder.SentTo(user.Email)
+	testutil.Equal(t, len(emails), 2)
+	testutil.Equal(t, emails[1].Data.(map[string]interface{})["count"].(int), 1)
+
+	code, _, body = ts.request(t, http.MethodGet, exportPath+"/download", owner.Plaintext, "")
+	testutil.Status(t, code, body, http.StatusOK)
+	testutil.StringContains(t, string(body), added.Title)
+
+	code, _, body = ts.request(t, http.MethodDelete, exportPath, other.Plaintext, "")
+	testutil.Status(t, code, body, http.StatusNotFound)
+
+	code, _, body = ts.request(t, http.MethodDelete, exportPath, owner.Plaintext, "")
+	testutil.Status(t, code, body, http.StatusOK)
+
+	mock.Advance(24 * time.Hour)
+	app.runScheduledExports()
+	testutil.Equal(t, len(recorder.SentTo(user.Email)), 2)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/codeaucafe/snippetbox/greenlight/internal/validator"
+)
+
+// fieldsHeader is the response header which holds the fields that the client selected with the
+// fields query string parameter, such as "title,year". Like the API version, it's echoed back to
+// the client, and it's how writeJSON() knows which fields to keep.
+const fieldsHeader = "Greenlight-Fields"
+
+// movieFields holds the fields of a movie which can be selected with the fields parameter.
+var movieFields = []string{
+	"id", "ulid", "title", "year", "runtime", "release_date", "poster_url", "genres", "version", "created_by", "updated_by",
+	"average_rating",
+}
+
+// movieDetailFields holds the fields of a movie which can be selected on the movie detail
+// endpoint, which also includes the movie's top-billed cast.
+var movieDetailFields = append(movieFields[:len(movieFields):len(movieFields)], "cast")
+
+// selectableFields is middleware for the routes which support partial responses. It reads the
+// fields query string parameter, such as ?fields=title,year, and checks that each field is one of
+// the allowed fields (or the new name of one of them, for clients using a later API version). The
+// fields are then recorded in the Greenlight-Fields header for writeJSON(). A request without the
+// parameter gets every field.
+func (app *application) selectableFields(allowed []string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		fields := app.readCSV(r.URL.Query(), "fields", nil)
+		if fields == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		v := validator.New()
+
+		for i, field := range fields {
+			fields[i] = strings.TrimSpace(field)
+
+			if !validator.In(fields[i], allowed...) && !validator.In(originalFieldName(fields[i]), allowed...) {
+				v.AddError("fields", fmt.Sprintf("unknown field %q: must be one of %s", fields[i],
+					strings.Join(allowed, ", ")))
+				break
+			}
+		}
+
+		if !v.Valid() {
+			app.failedValidationResponse(w, r, v.Errors)
+			return
+		}
+
+		w.Header().Set(fieldsHeader, strings.Join(fields, ","))
+
+		next.ServeHTTP(w, r)
+	}
+}
+
+// originalFieldName returns the name that handlers use for a response field which has been
+// renamed in a later API version (see fieldShims), or the name unchanged if it hasn't been.
+func originalFieldName(name string) string {
+	for _, shim := range fieldShims {
+		if shim.new == name {
+			return shim.old
+		}
+	}
+
+	return name
+}
+
+// selectFields returns the envelope with only the fields selected in the Greenlight-Fields
+// header kept in each resource, or the envelope unchanged if no fields were selected. Every
+// entry of the envelope other than the metadata is taken to be a resource, or a list of them, so
+// envelope{"movie": movie} and envelope{"movies": movies, "metadata": metadata} both work. Only
+// the top-level fields of each resource are selected.
+func selectFields(env envelope, header http.Header) (envelope, error) {
+	selected := header.Get(fieldsHeader)
+	if selected == "" {
+		return env, nil
+	}
+
+	keep := make(map[string]bool)
+	for _, field := range strings.Split(selected, ",") {
+		keep[originalFieldName(field)] = true
+	}
+
+	result := make(envelope, len(env))
+
+	for key, value := range env {
+		if key == "metadata" {
+			result[key] = value
+			continue
+		}
+
+		tree, err := jsonTree(value)
+		if err != nil {
+			return nil, err
+		}
+
+		switch tree := tree.(type) {
+		case map[string]interface{}:
+			pruneFields(tree, keep)
+		case []interface{}:
+			for _, elem := range tree {
+				if object, ok := elem.(map[string]interface{}); ok {
+					pruneFields(object, keep)
+				}
+			}
+		}
+
+		result[key] = tree
+	}
+
+	return result, nil
+}
+
+// pruneFields deletes the fields of a decoded JSON object which aren't in keep.
+func pruneFields(object map[string]interface{}, keep map[string]bool) {
+	for field := range object {
+		if !keep[field] {
+			delete(object, field)
+		}
+	}
+}
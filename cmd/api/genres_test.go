@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/codeaucafe/snippetbox/greenlight/internal/data"
+	"github.com/codeaucafe/snippetbox/greenlight/internal/testutil"
+)
+
+// TestGenres tests that movies share genres whichever way they spell them, and that the genres
+// can be listed and their movies paged through.
+func TestGenres(t *testing.T) {
+	app, fx := newTestDBApp(t)
+	ts := newTestServer(app.routes())
+	defer ts.Close()
+
+	reader := fx.Token(fx.User(nil, "movies:read"), data.ScopeAuthentication)
+
+	first := fx.Movie(func(m *data.Movie) { m.Genres = []string{"Sci-Fi", "drama"} })
+	second := fx.Movie(func(m *data.Movie) { m.Genres = []string{"sci-fi"} })
+
+	// The second movie gets the spelling of the genre which was already stored.
+	testutil.Equal(t, fmt.Sprint(first.Genres), "[Sci-Fi drama]")
+	testutil.Equal(t, fmt.Sprint(second.Genres), "[Sci-Fi]")
+
+	code, _, body := ts.request(t, http.MethodGet, "/v1/genres?sort=-movies", reader.Plaintext, "")
+	testutil.Status(t, code, body, http.StatusOK)
+
+	var list struct {
+		Genres []data.Genre `json:"genres"`
+	}
+	testutil.DecodeJSON(t, body, &list)
+
+	testutil.Equal(t, len(list.Genres), 2)
+	testutil.Equal(t, list.Genres[0].Name, "Sci-Fi")
+	testutil.Equal(t, list.Genres[0].Movies, int64(2))
+
+	code, _, body = ts.request(t, http.MethodGet, fmt.Sprintf("/v1/genres/%d/movies?sort=-id", list.Genres[0].ID),
+		reader.Plaintext, "")
+	testutil.Status(t, code, body, http.StatusOK)
+
+	var movies struct {
+		Genre  data.Genre   `json:"genre"`
+		Movies []data.Movie `json:"movies"`
+	}
+	testutil.DecodeJSON(t, body, &movies)
+
+	testutil.Equal(t, movies.Genre.Name, "Sci-Fi")
+	testutil.Equal(t, len(movies.Movies), 2)
+	testutil.Equal(t, movies.Movies[0].ID, second.ID)
+
+	// Filtering the movies by genre ignores case too.
+	code, _, body = ts.request(t, http.MethodGet, "/v1/movies?genres=SCI-FI,Drama", reader.Plaintext, "")
+	testutil.Status(t, code, body, http.StatusOK)
+	testutil.StringContains(t, string(body), first.Title)
+
+	code, _, body = ts.request(t, http.MethodGet, "/v1/genres/999999/movies", reader.Plaintext, "")
+	testutil.Status(t, code, body, http.StatusNotFound)
+}
@@ -0,0 +1,517 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	gqlgen "github.com/99designs/gqlgen/graphql"
+	"github.com/99designs/gqlgen/graphql/executor"
+	"github.com/99designs/gqlgen/graphql/handler/extension"
+	"github.com/codeaucafe/snippetbox/greenlight/internal/data"
+	"github.com/codeaucafe/snippetbox/greenlight/internal/graphql"
+	"github.com/codeaucafe/snippetbox/greenlight/internal/validator"
+	"github.com/graph-gophers/dataloader/v7"
+	"github.com/vektah/gqlparser/v2/ast"
+	"github.com/vektah/gqlparser/v2/gqlerror"
+)
+
+// The limits on the GraphQL queries which we execute, which are checked before a query is
+// executed. The deepest useful query (the reviews of a movie, along with their author and movie,
+// inside a page of movies) is well within the depth limit. The complexity of a query is an
+// estimate of the objects it returns, counting every field (and every alias of a field) once, and
+// multiplying the fields inside a paginated field by its page size. The limit covers a page of
+// movies at the default page size with a page of reviews each many times over, while stopping
+// clients asking for every page size at its maximum.
+const (
+	graphqlMaxDepth      = 8
+	graphqlMaxComplexity = 5000
+)
+
+// graphqlBatchWait is how long the loaders wait for more IDs to be queued up before they fetch a
+// batch. The resolvers of the items in a list run at the same time, so they're all queued up well
+// within it.
+const graphqlBatchWait = 2 * time.Millisecond
+
+// graphqlContextKey is used as a key for getting and setting the graphqlState for a request.
+const graphqlContextKey = contextKey("graphql")
+
+// errGraphQLServer is the error reported for a field whose resolver ran into an unexpected error.
+// The error itself is logged rather than sent to the client, just like serverErrorResponse does.
+var errGraphQLServer = errors.New("the server encountered a problem and could not process your request")
+
+// graphqlState holds the state of a single GraphQL request: the user making it, and the loaders
+// which batch up the lookups made while executing it. The loaders for the pages of movies'
+// reviews are keyed by the page and sort order, as the reviews of each movie are fetched a page
+// at a time.
+type graphqlState struct {
+	viewer      *data.User
+	movies      *dataloader.Loader[int64, *data.Movie]
+	reviewsByID *dataloader.Loader[int64, *data.Review]
+
+	mu      sync.Mutex
+	reviews map[string]*dataloader.Loader[int64, *graphql.ReviewPage]
+}
+
+// graphqlHandler returns the handler for the "POST /v1/graphql" and "GET /v1/graphql" endpoints,
+// which execute a GraphQL query with the given executor. POST requests send the query in a JSON
+// body and GET requests in the query string, with the variables as a JSON object. As is usual
+// for GraphQL, errors in the query itself are reported in the "errors" member of a 200 OK
+// response, rather than with an error status code.
+func (app *application) graphqlHandler(exec *executor.Executor) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := gqlgen.Now()
+
+		var input struct {
+			Query         string                 `json:"query"`
+			OperationName string                 `json:"operationName"`
+			Variables     map[string]interface{} `json:"variables"`
+			Extensions    json.RawMessage        `json:"extensions"`
+		}
+
+		if r.Method == http.MethodGet {
+			qs := r.URL.Query()
+			input.Query = qs.Get("query")
+			input.OperationName = qs.Get("operationName")
+
+			if variables := qs.Get("variables"); variables != "" {
+				if err := json.Unmarshal([]byte(variables), &input.Variables); err != nil {
+					app.badRequestResponse(w, r, errors.New("variables must be a JSON object"))
+					return
+				}
+			}
+		} else {
+			if err := app.readJSON(w, r, &input); err != nil {
+				app.badRequestResponse(w, r, err)
+				return
+			}
+		}
+
+		v := validator.New()
+		if v.Check(strings.TrimSpace(input.Query) != "", "query", "must be provided"); !v.Valid() {
+			app.failedValidationResponse(w, r, v.Errors)
+			return
+		}
+
+		state := app.newGraphQLState(app.contextGetUser(r))
+		ctx := gqlgen.StartOperationTrace(context.WithValue(r.Context(), graphqlContextKey, state))
+
+		params := &gqlgen.RawParams{
+			Query:         input.Query,
+			OperationName: input.OperationName,
+			Variables:     input.Variables,
+			ReadTime:      gqlgen.TraceTiming{Start: start, End: gqlgen.Now()},
+		}
+
+		// The query is parsed and validated, and its depth and complexity are checked, before
+		// any of it is executed.
+		var res *gqlgen.Response
+
+		rc, errs := exec.CreateOperationContext(ctx, params)
+		if errs != nil {
+			res = exec.DispatchError(gqlgen.WithOperationContext(ctx, rc), errs)
+		} else {
+			responses, ctx := exec.DispatchOperation(ctx, rc)
+			res = responses(ctx)
+		}
+
+		// The response is written as it is, rather than with writeJSON(), as GraphQL clients pick
+		// the fields they want in the query itself.
+		js, err := json.Marshal(res)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write(js)
+	}
+}
+
+// graphqlSchemaHandler handles the "GET /v1/graphql/schema" endpoint, which sends the schema in
+// the GraphQL schema definition language, for client code generators.
+func (app *application) graphqlSchemaHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	_, _ = w.Write([]byte(graphql.SDL))
+}
+
+// newGraphQLExecutor returns the executor for the GraphQL endpoint, with the limits on the depth
+// and complexity of queries. Panics in resolvers are logged and reported in the same way as
+// other unexpected errors.
+func (app *application) newGraphQLExecutor() *executor.Executor {
+	cfg := graphql.Config{Resolvers: &graphqlResolver{app: app}}
+
+	cfg.Complexity.Query.Movies = func(childComplexity int, title string, genres []string, page, pageSize int, sort string) int {
+		return graphqlPageComplexity(childComplexity, pageSize)
+	}
+	cfg.Complexity.Movie.Reviews = func(childComplexity int, page, pageSize int, sort string) int {
+		return graphqlPageComplexity(childComplexity, pageSize)
+	}
+
+	exec := executor.New(graphql.NewExecutableSchema(cfg))
+	exec.Use(graphqlDepthLimit(graphqlMaxDepth))
+	exec.Use(extension.FixedComplexityLimit(graphqlMaxComplexity))
+	exec.SetRecoverFunc(func(ctx context.Context, err interface{}) error {
+		return app.graphqlServerError(fmt.Errorf("%v", err))
+	})
+
+	return exec
+}
+
+// graphqlPageComplexity returns the complexity of a paginated field: the complexity of its
+// selections once for each item on the page. Page sizes outside of the allowed range are counted
+// as the nearest one which is allowed, as the field's resolver rejects them anyway.
+func graphqlPageComplexity(childComplexity, pageSize int) int {
+	switch {
+	case pageSize < 1:
+		pageSize = 1
+	case pageSize > 100:
+		pageSize = 100
+	}
+
+	return 1 + pageSize*childComplexity
+}
+
+// graphqlDepthLimit is an extension for the GraphQL executor which rejects queries whose fields
+// are nested more deeply than the limit, counting the fields in fragments where they're used.
+type graphqlDepthLimit int
+
+// ExtensionName returns the name of the extension.
+func (l graphqlDepthLimit) ExtensionName() string {
+	return "DepthLimit"
+}
+
+// Validate checks that the extension can be used with the schema, which it always can.
+func (l graphqlDepthLimit) Validate(schema gqlgen.ExecutableSchema) error {
+	return nil
+}
+
+// MutateOperationContext checks the depth of the operation once it has been validated.
+func (l graphqlDepthLimit) MutateOperationContext(ctx context.Context, rc *gqlgen.OperationContext) *gqlerror.Error {
+	if depth := selectionDepth(rc.Operation.SelectionSet); depth > int(l) {
+		return gqlerror.Errorf("query has depth %d, which exceeds the limit of %d", depth, int(l))
+	}
+	return nil
+}
+
+// selectionDepth returns the depth of the most deeply nested field in a selection set.
+func selectionDepth(set ast.SelectionSet) int {
+	depth := 0
+
+	for _, sel := range set {
+		d := 0
+
+		switch sel := sel.(type) {
+		case *ast.Field:
+			d = 1 + selectionDepth(sel.SelectionSet)
+		case *ast.InlineFragment:
+			d = selectionDepth(sel.SelectionSet)
+		case *ast.FragmentSpread:
+			if sel.Definition != nil {
+				d = selectionDepth(sel.Definition.SelectionSet)
+			}
+		}
+
+		if d > depth {
+			depth = d
+		}
+	}
+
+	return depth
+}
+
+// newGraphQLState returns the state for a GraphQL request made by the given user. The movie
+// and review loaders look up every movie or review asked for on the same level of the query
+// (such as the movies of a page of reviews, or aliased movie fields) with a single query.
+func (app *application) newGraphQLState(viewer *data.User) *graphqlState {
+	return &graphqlState{
+		viewer:      viewer,
+		movies:      newGraphQLLoader(app, app.models.Movies.GetMany),
+		reviewsByID: newGraphQLLoader(app, app.models.Reviews.GetMany),
+		reviews:     make(map[string]*dataloader.Loader[int64, *graphql.ReviewPage]),
+	}
+}
+
+// newGraphQLLoader returns a loader which fetches each batch of IDs with getMany. IDs which
+// getMany leaves out of its results load as nil.
+func newGraphQLLoader[V any](app *application, getMany func(ctx context.Context, ids []int64) (map[int64]V, error)) *dataloader.Loader[int64, V] {
+	return dataloader.NewBatchedLoader(func(ctx context.Context, ids []int64) []*dataloader.Result[V] {
+		results := make([]*dataloader.Result[V], len(ids))
+
+		values, err := getMany(ctx, ids)
+		if err != nil {
+			err = app.graphqlServerError(err)
+		}
+
+		for i, id := range ids {
+			results[i] = &dataloader.Result[V]{Data: values[id], Error: err}
+		}
+		return results
+	}, dataloader.WithWait[int64, V](graphqlBatchWait))
+}
+
+// graphqlStateFrom returns the state of the GraphQL request which a resolver is running for.
+func graphqlStateFrom(ctx context.Context) *graphqlState {
+	state, ok := ctx.Value(graphqlContextKey).(*graphqlState)
+	if !ok {
+		panic("missing graphql state in request context")
+	}
+
+	return state
+}
+
+// reviewLoader returns the loader for the given page of the reviews of movies, creating it the
+// first time that page is asked for. It fetches that page of the reviews of every movie queued up
+// with a single query. Every movie gets a page, even when it has no reviews.
+func (app *application) reviewLoader(state *graphqlState, filters data.Filters) *dataloader.Loader[int64, *graphql.ReviewPage] {
+	key := fmt.Sprintf("%d/%d/%s", filters.Page, filters.PageSize, filters.Sort)
+
+	state.mu.Lock()
+	defer state.mu.Unlock()
+
+	if loader, ok := state.reviews[key]; ok {
+		return loader
+	}
+
+	loader := dataloader.NewBatchedLoader(func(ctx context.Context, ids []int64) []*dataloader.Result[*graphql.ReviewPage] {
+		results := make([]*dataloader.Result[*graphql.ReviewPage], len(ids))
+
+		reviews, metadata, err := app.models.Reviews.GetAllForMovies(ctx, ids, filters)
+		if err != nil {
+			err = app.graphqlServerError(err)
+		}
+
+		for i, id := range ids {
+			results[i] = &dataloader.Result[*graphql.ReviewPage]{
+				Data:  &graphql.ReviewPage{Items: reviews[id], Metadata: metadata[id]},
+				Error: err,
+			}
+		}
+		return results
+	}, dataloader.WithWait[int64, *graphql.ReviewPage](graphqlBatchWait))
+
+	state.reviews[key] = loader
+	return loader
+}
+
+// graphqlServerError logs an unexpected error from a resolver and returns errGraphQLServer to
+// report in its place.
+func (app *application) graphqlServerError(err error) error {
+	app.logger.PrintError(err, map[string]string{"handler": "graphql"})
+	return errGraphQLServer
+}
+
+// graphqlFilters reads the page, pageSize and sort arguments of a paginated field into a Filters
+// struct and validates them, returning the validation errors as a single error.
+func graphqlFilters(page, pageSize int, sort string, safelist []string) (data.Filters, error) {
+	filters := data.Filters{
+		Page:         page,
+		PageSize:     pageSize,
+		Sort:         sort,
+		SortSafeList: safelist,
+	}
+
+	v := validator.New()
+	if data.ValidateFilters(v, filters); !v.Valid() {
+		return filters, graphqlValidationError(v.Errors)
+	}
+
+	return filters, nil
+}
+
+// graphqlValidationError turns the errors from a validator into a single error naming the
+// arguments which failed, using their GraphQL names.
+func graphqlValidationError(errs map[string]string) error {
+	names := map[string]string{"page_size": "pageSize"}
+
+	var problems []string
+	for key, message := range errs {
+		if name, ok := names[key]; ok {
+			key = name
+		}
+		problems = append(problems, key+" "+message)
+	}
+	sort.Strings(problems)
+
+	return fmt.Errorf("invalid arguments: %s", strings.Join(problems, "; "))
+}
+
+// The sort orders allowed for the paginated fields.
+var (
+	graphqlMovieSafeList  = []string{"id", "title", "year", "runtime", "-id", "-title", "-year", "-runtime"}
+	graphqlReviewSafeList = []string{"created_at", "rating", "-created_at", "-rating"}
+)
+
+// graphqlResolver implements the resolvers for the schema in the graphql package. It covers the
+// same ground as the REST endpoints for reading movies and reviews, and the same rules apply:
+// only approved reviews are listed, and users can only see their own names and email addresses.
+type graphqlResolver struct {
+	app *application
+}
+
+func (r *graphqlResolver) Query() graphql.QueryResolver   { return (*graphqlQuery)(r) }
+func (r *graphqlResolver) Movie() graphql.MovieResolver   { return (*graphqlMovie)(r) }
+func (r *graphqlResolver) Review() graphql.ReviewResolver { return (*graphqlReview)(r) }
+func (r *graphqlResolver) User() graphql.UserResolver     { return (*graphqlUser)(r) }
+
+// graphqlQuery resolves the fields of the Query type.
+type graphqlQuery graphqlResolver
+
+// Movie returns the movie with the given ID, or nil if there isn't one. It's fetched along with
+// any other movies in the query.
+func (r *graphqlQuery) Movie(ctx context.Context, id int64) (*data.Movie, error) {
+	return graphqlStateFrom(ctx).movies.Load(ctx, id)()
+}
+
+// Movies returns a page of the movies matching the title and genres.
+func (r *graphqlQuery) Movies(ctx context.Context, title string, genres []string, page, pageSize int, sort string) (*graphql.MoviePage, error) {
+	filters, err := graphqlFilters(page, pageSize, sort, graphqlMovieSafeList)
+	if err != nil {
+		return nil, err
+	}
+
+	movies, metadata, err := r.app.models.Movies.GetAll(ctx, title, genres, 0, filters)
+	if err != nil {
+		return nil, r.app.graphqlServerError(err)
+	}
+	return &graphql.MoviePage{Items: movies, Metadata: metadata}, nil
+}
+
+// Review returns the review with the given ID, or nil if there isn't one. It's fetched along with
+// any other reviews asked for by ID in the query. Reviews which haven't been approved are only
+// returned to their author.
+func (r *graphqlQuery) Review(ctx context.Context, id int64) (*data.Review, error) {
+	state := graphqlStateFrom(ctx)
+
+	review, err := state.reviewsByID.Load(ctx, id)()
+	if err != nil || review == nil {
+		return nil, err
+	}
+
+	if review.Status != data.ReviewStatusApproved && review.UserID != state.viewer.ID {
+		return nil, nil
+	}
+	return review, nil
+}
+
+// Me returns the user making the request.
+func (r *graphqlQuery) Me(ctx context.Context) (*data.User, error) {
+	return graphqlStateFrom(ctx).viewer, nil
+}
+
+// graphqlMovie resolves the fields of the Movie type which aren't fields of data.Movie.
+type graphqlMovie graphqlResolver
+
+// Year returns the movie's year, or nil if it isn't known.
+func (r *graphqlMovie) Year(ctx context.Context, obj *data.Movie) (*int, error) {
+	if obj.Year == 0 {
+		return nil, nil
+	}
+	year := int(obj.Year)
+	return &year, nil
+}
+
+// Runtime returns the movie's runtime in minutes, or nil if it isn't known.
+func (r *graphqlMovie) Runtime(ctx context.Context, obj *data.Movie) (*int, error) {
+	if obj.Runtime == 0 {
+		return nil, nil
+	}
+	runtime := int(obj.Runtime)
+	return &runtime, nil
+}
+
+// ReleaseDate returns the movie's release date, or nil if it isn't known.
+func (r *graphqlMovie) ReleaseDate(ctx context.Context, obj *data.Movie) (*string, error) {
+	if obj.ReleaseDate == nil {
+		return nil, nil
+	}
+	date := obj.ReleaseDate.String()
+	return &date, nil
+}
+
+// PosterURL returns the URL of the movie's poster, or nil if it doesn't have one.
+func (r *graphqlMovie) PosterURL(ctx context.Context, obj *data.Movie) (*string, error) {
+	if obj.PosterURL == "" {
+		return nil, nil
+	}
+	return &obj.PosterURL, nil
+}
+
+// CreatedBy returns the user who added the movie, or nil if they aren't known.
+func (r *graphqlMovie) CreatedBy(ctx context.Context, obj *data.Movie) (*data.User, error) {
+	if obj.CreatedBy == nil {
+		return nil, nil
+	}
+	return &data.User{ID: *obj.CreatedBy}, nil
+}
+
+// Reviews returns a page of the movie's approved reviews, which is fetched along with the same
+// page of the reviews of the other movies in the query.
+func (r *graphqlMovie) Reviews(ctx context.Context, obj *data.Movie, page, pageSize int, sort string) (*graphql.ReviewPage, error) {
+	filters, err := graphqlFilters(page, pageSize, sort, graphqlReviewSafeList)
+	if err != nil {
+		return nil, err
+	}
+
+	return r.app.reviewLoader(graphqlStateFrom(ctx), filters).Load(ctx, obj.ID)()
+}
+
+// graphqlReview resolves the fields of the Review type which aren't fields of data.Review.
+type graphqlReview graphqlResolver
+
+// CreatedAt returns when the review was written, in RFC 3339 format.
+func (r *graphqlReview) CreatedAt(ctx context.Context, obj *data.Review) (string, error) {
+	return obj.CreatedAt.Format(time.RFC3339), nil
+}
+
+// UpdatedAt returns when the review was last changed, in RFC 3339 format.
+func (r *graphqlReview) UpdatedAt(ctx context.Context, obj *data.Review) (string, error) {
+	return obj.UpdatedAt.Format(time.RFC3339), nil
+}
+
+// Movie returns the movie which was reviewed, which is fetched along with the movies of the other
+// reviews in the query, or nil if it has since been deleted.
+func (r *graphqlReview) Movie(ctx context.Context, obj *data.Review) (*data.Movie, error) {
+	return graphqlStateFrom(ctx).movies.Load(ctx, obj.MovieID)()
+}
+
+// Author returns the user who wrote the review. Only their ID is filled in, as that's all that
+// other users can see.
+func (r *graphqlReview) Author(ctx context.Context, obj *data.Review) (*data.User, error) {
+	return &data.User{ID: obj.UserID}, nil
+}
+
+// graphqlUser resolves the fields of the User type which only the user themselves can see. They
+// resolve to nil for anyone else.
+type graphqlUser graphqlResolver
+
+// Name returns the user's name.
+func (r *graphqlUser) Name(ctx context.Context, obj *data.User) (*string, error) {
+	if obj.ID != graphqlStateFrom(ctx).viewer.ID {
+		return nil, nil
+	}
+	return &obj.Name, nil
+}
+
+// Email returns the user's email address.
+func (r *graphqlUser) Email(ctx context.Context, obj *data.User) (*string, error) {
+	if obj.ID != graphqlStateFrom(ctx).viewer.ID {
+		return nil, nil
+	}
+	return &obj.Email, nil
+}
+
+// Activated returns whether the user is activated.
+func (r *graphqlUser) Activated(ctx context.Context, obj *data.User) (*bool, error) {
+	if obj.ID != graphqlStateFrom(ctx).viewer.ID {
+		return nil, nil
+	}
+	return &obj.Activated, nil
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/codeaucafe/snippetbox/greenlight/internal/data"
+	"github.com/codeaucafe/snippetbox/greenlight/internal/testutil"
+)
+
+// TestGraphQLHandler tests the GraphQL endpoint with queries which don't need the database: the
+// errors in invalid queries, the limits on their depth and complexity, and the viewer's own
+// details.
+func TestGraphQLHandler(t *testing.T) {
+	app := newTestApp()
+	handler := app.graphqlHandler(app.newGraphQLExecutor())
+
+	viewer := &data.User{ID: 7, Name: "Alice", Email: "alice@example.com", Activated: true}
+
+	run := func(r *http.Request) (int, string) {
+		rr := httptest.NewRecorder()
+		handler(rr, app.contextSetUser(r, viewer))
+		return rr.Code, rr.Body.String()
+	}
+
+	post := func(body string) (int, string) {
+		return run(httptest.NewRequest(http.MethodPost, "/v1/graphql", strings.NewReader(body)))
+	}
+
+	tests := []struct {
+		name     string
+		body     string
+		wantCode int
+		wantBody string
+	}{
+		{"Viewer", `{"query": "{ me { id name } }"}`, http.StatusOK, `{"data":{"me":{"id":"7","name":"Alice"}}}`},
+		{"Fragment and alias", `{"query": "query Me { who: me { ...u } } fragment u on User { email }", "operationName": "Me"}`,
+			http.StatusOK, `{"data":{"who":{"email":"alice@example.com"}}}`},
+		{"Skip", `{"query": "query($skip: Boolean!) { me { id activated @skip(if: $skip) } }", "variables": {"skip": true}}`,
+			http.StatusOK, `{"data":{"me":{"id":"7"}}}`},
+		{"Unknown field", `{"query": "{ me { password } }"}`, http.StatusOK, `Cannot query field \"password\" on type \"User\"`},
+		{"Syntax error", `{"query": "{ me { id }"}`, http.StatusOK, `"locations":[{"line":1,"column":12}]`},
+		{"Mutation", `{"query": "mutation { me { id } }"}`, http.StatusOK, `"errors"`},
+		{"Missing query", `{"query": ""}`, http.StatusUnprocessableEntity, `"must be provided"`},
+		{"Unknown member", `{"query": "{ me { id } }", "extra": true}`, http.StatusBadRequest, `unknown key`},
+		{"Too deep", `{"query": "{ movie(id: 1) { reviews(pageSize: 1) { items { movie { reviews(pageSize: 1) { items ` +
+			`{ movie { reviews(pageSize: 1) { items { id } } } } } } } } } }"}`,
+			http.StatusOK, `query has depth 10, which exceeds the limit of 8`},
+		{"Too complex", `{"query": "{ movies(pageSize: 100) { items { reviews(pageSize: 100) { items { id } } } } }"}`,
+			http.StatusOK, `operation has complexity 20201, which exceeds the limit of 5000`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, body := post(tt.body)
+			testutil.Equal(t, code, tt.wantCode)
+			testutil.StringContains(t, body, tt.wantBody)
+		})
+	}
+
+	// Queries can also be sent in the query string.
+	qs := url.Values{"query": {"query($f: Boolean!) { me { id @include(if: $f) } }"}, "variables": {`{"f": true}`}}
+	code, body := run(httptest.NewRequest(http.MethodGet, "/v1/graphql?"+qs.Encode(), nil))
+	testutil.Equal(t, code, http.StatusOK)
+	testutil.Equal(t, body, `{"data":{"me":{"id":"7"}}}`)
+}
+
+// TestGraphQL tests that the movies, their reviews and the reviews' movies can be fetched in one
+// query, and that other users' details are hidden.
+func TestGraphQL(t *testing.T) {
+	app, fx := newTestDBApp(t)
+	ts := newTestServer(app.routes())
+	defer ts.Close()
+
+	first := fx.Movie(func(m *data.Movie) { m.Title = "GraphQL First" })
+	second := fx.Movie(func(m *data.Movie) { m.Title = "GraphQL Second" })
+
+	alice := fx.User(nil, "movies:read")
+	aliceToken := fx.Token(alice, data.ScopeAuthentication)
+	bobToken := fx.Token(fx.User(nil, "movies:read"), data.ScopeAuthentication)
+
+	for _, movie := range []*data.Movie{first, second} {
+		path := fmt.Sprintf("/v1/movies/%d/reviews", movie.ID)
+
+		code, _, body := ts.request(t, http.MethodPost, path, aliceToken.Plaintext, `{"rating": 8, "body": "Great"}`)
+		testutil.Status(t, code, body, http.StatusCreated)
+		code, _, body = ts.request(t, http.MethodPost, path, bobToken.Plaintext, `{"rating": 4}`)
+		testutil.Status(t, code, body, http.StatusCreated)
+	}
+
+	query := `{"query": "{ movies(title: \"GraphQL\", sort: \"title\") { metadata { totalRecords } items { title ` +
+		`reviews(sort: \"-rating\", pageSize: 1) { metadata { totalRecords lastPage } items { rating ` +
+		`author { name } movie { id title } } } } } }"}`
+
+	code, _, body := ts.request(t, http.MethodPost, "/v1/graphql", aliceToken.Plaintext, query)
+	testutil.Status(t, code, body, http.StatusOK)
+
+	var got struct {
+		Data struct {
+			Movies struct {
+				Metadata struct{ TotalRecords, LastPage int }
+				Items    []struct {
+					Title   string
+					Reviews struct {
+						Metadata struct{ TotalRecords, LastPage int }
+						Items    []struct {
+							Rating int
+							Author struct{ Name *string }
+							Movie  struct{ ID, Title string }
+						}
+					}
+				}
+			}
+		}
+		Errors []interface{}
+	}
+	testutil.DecodeJSON(t, body, &got)
+
+	if len(got.Errors) > 0 {
+		t.Fatalf("got errors %v", got.Errors)
+	}
+
+	movies := got.Data.Movies
+	testutil.Equal(t, movies.Metadata.TotalRecords, 2)
+	testutil.Equal(t, len(movies.Items), 2)
+
+	for i, want := range []*data.Movie{first, second} {
+		movie := movies.Items[i]
+		testutil.Equal(t, movie.Title, want.Title)
+		testutil.Equal(t, movie.Reviews.Metadata.TotalRecords, 2)
+		testutil.Equal(t, movie.Reviews.Metadata.LastPage, 2)
+		testutil.Equal(t, len(movie.Reviews.Items), 1)
+
+		review := movie.Reviews.Items[0]
+		testutil.Equal(t, review.Rating, 8)
+		testutil.Equal(t, review.Movie.ID, fmt.Sprint(want.ID))
+		testutil.Equal(t, review.Movie.Title, want.Title)
+
+		// The top review is Alice's own, so she can see her name on it.
+		if review.Author.Name == nil || *review.Author.Name != alice.Name {
+			t.Errorf("got author name %v; want %q", review.Author.Name, alice.Name)
+		}
+	}
+
+	// Bob only sees the ID of the users who wrote the reviews, other than himself.
+	code, _, body = ts.request(t, http.MethodPost, "/v1/graphql", bobToken.Plaintext, query)
+	testutil.Status(t, code, body, http.StatusOK)
+	testutil.StringContains(t, string(body), `"author":{"name":null}`)
+
+	// Invalid pagination arguments are reported as field errors.
+	code, _, body = ts.request(t, http.MethodPost, "/v1/graphql", aliceToken.Plaintext,
+		`{"query": "{ movies(pageSize: 1000) { metadata { totalRecords } } }"}`)
+	testutil.Status(t, code, body, http.StatusOK)
+	testutil.StringContains(t, string(body), "pageSize must be a maximum of 100")
+}
@@ -1,21 +1,181 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
 	"net/http"
+	"sync/atomic"
+	"time"
 )
 
+// Health statuses reported for the application as a whole and for each individual check.
+const (
+	healthStatusHealthy   = "healthy"
+	healthStatusDegraded  = "degraded"
+	healthStatusUnhealthy = "unhealthy"
+)
+
+// errHealthDegraded is returned (or wrapped) by a health check function when the dependency is
+// working, but not as well as it should be.
+var errHealthDegraded = errors.New("degraded")
+
+// healthMetrics publishes the result of the most recent healthcheck in the expvar handler, so
+// that degraded states show up in our metrics as well as in the response body.
+var healthMetrics = expvar.NewMap("healthcheck")
+
+// healthCheck describes a single dependency which is checked by the healthcheck endpoint.
+type healthCheck struct {
+	name string
+	// degradedLatency is the latency above which a successful check is reported as degraded.
+	// A zero value means that latency is never considered.
+	degradedLatency time.Duration
+	// run performs the check. It should return nil if the dependency is healthy, an error
+	// wrapping errHealthDegraded if it is degraded, and any other error if it is unhealthy.
+	run func() error
+}
+
+// healthCheckResult holds the outcome of running a healthCheck.
+type healthCheckResult struct {
+	Status  string `json:"status"`
+	Latency string `json:"latency"`
+	Error   string `json:"error,omitempty"`
+}
+
+// defaultHealthChecks returns the health checks for the application's dependencies, using the
+// thresholds from the config struct.
+func (app *application) defaultHealthChecks() []healthCheck {
+	checks := []healthCheck{
+		{
+			// The database is unhealthy if it can't be reached within the timeout, and degraded
+			// if it is reachable but slow.
+			name:            "database",
+			degradedLatency: app.config.health.dbDegradedLatency,
+			run: func() error {
+				_, err := app.models.System.Ping(context.Background(), app.config.health.dbTimeout)
+				return err
+			},
+		},
+		{
+			// Emails (and any other background work) are processed by goroutines launched with
+			// the background() helper, so a large number of them still in flight means that the
+			// queue is backing up.
+			name: "background_tasks",
+			run: func() error {
+				n := atomic.LoadInt64(&app.backgroundTasks)
+				if n > int64(app.config.health.backgroundDegradedTasks) {
+					return fmt.Errorf("%w: %d background tasks in flight", errHealthDegraded, n)
+				}
+				return nil
+			},
+		},
+	}
+
+	// Load shedding is only reported if it's enabled.
+	if app.shedder != nil {
+		checks = append(checks, app.loadSheddingHealthCheck())
+	}
+
+	// Redis is only checked if it's configured.
+	if app.redis != nil {
+		checks = append(checks, app.redisStatus.healthCheck(app.redis, app.config.health.dbTimeout))
+	}
+
+	return checks
+}
+
+// runHealthChecks runs each of the application's health checks and returns the individual
+// results along with the overall status, which is the worst status of any check.
+func (app *application) runHealthChecks() (string, map[string]healthCheckResult) {
+	status := healthStatusHealthy
+	results := make(map[string]healthCheckResult, len(app.healthChecks))
+
+	for _, check := range app.healthChecks {
+		start := time.Now()
+		err := check.run()
+		latency := time.Since(start)
+
+		result := healthCheckResult{
+			Status:  healthStatusHealthy,
+			Latency: latency.String(),
+		}
+
+		switch {
+		case err == nil && check.degradedLatency > 0 && latency > check.degradedLatency:
+			result.Status = healthStatusDegraded
+			result.Error = fmt.Sprintf("latency exceeded %s", check.degradedLatency)
+		case errors.Is(err, errHealthDegraded):
+			result.Status = healthStatusDegraded
+			result.Error = err.Error()
+		case err != nil:
+			result.Status = healthStatusUnhealthy
+			result.Error = err.Error()
+		}
+
+		// Keep track of the worst status seen so far.
+		if result.Status == healthStatusUnhealthy ||
+			(result.Status == healthStatusDegraded && status == healthStatusHealthy) {
+			status = result.Status
+		}
+
+		results[check.name] = result
+
+		// Record the status and latency (in microseconds) of the check in our metrics.
+		healthMetrics.Set(check.name+"_status", expvarString(result.Status))
+		healthMetrics.Set(check.name+"_latency_µs", expvarInt(latency.Microseconds()))
+	}
+
+	healthMetrics.Set("status", expvarString(status))
+
+	return status, results
+}
+
+// expvarString returns a new expvar.String holding the given value.
+func expvarString(value string) *expvar.String {
+	v := new(expvar.String)
+	v.Set(value)
+	return v
+}
+
+// expvarInt returns a new expvar.Int holding the given value.
+func expvarInt(value int64) *expvar.Int {
+	v := new(expvar.Int)
+	v.Set(value)
+	return v
+}
+
+// healthcheckHandler reports the status of the application and its dependencies. A degraded
+// application still returns a 200 OK status code, because it can continue to serve requests,
+// but an unhealthy one returns 503 Service Unavailable so that load balancers stop routing to it.
 func (app *application) healthcheckHandler(w http.ResponseWriter, r *http.Request) {
+	health, checks := app.runHealthChecks()
+
+	// We keep reporting "available" for a healthy application, which is what clients of this
+	// endpoint have always been given.
+	status := http.StatusOK
+	env := envelope{"status": "available"}
+
+	switch health {
+	case healthStatusDegraded:
+		env["status"] = healthStatusDegraded
+	case healthStatusUnhealthy:
+		status = http.StatusServiceUnavailable
+		env["status"] = "unavailable"
+	}
+
 	// Declare an envelope map containing the data for the response. Note,
 	// environment and version data are now nested under system_info key.
-	env := envelope{
-		"status": "available",
-		"system_info": map[string]string{
-			"environment": app.config.env,
-			"version":     version,
-		},
+	env["system_info"] = map[string]string{
+		"environment": app.config.env,
+		"version":     version,
+	}
+
+	if len(checks) > 0 {
+		env["checks"] = checks
 	}
 
-	err := app.writeJSON(w, http.StatusOK, env, nil)
+	err := app.writeJSON(w, status, env, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
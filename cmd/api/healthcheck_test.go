@@ -1,7 +1,11 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
+	"net/http/httptest"
 	"testing"
 )
 
@@ -31,3 +35,64 @@ func TestHealthcheck(t *testing.T) {
 		t.Errorf("want body to equal %q,\n but got %q", expResp, string(body))
 	}
 }
+
+// TestHealthcheckStatuses tests that the healthcheck reports the worst status of its checks, and
+// only returns a 503 Service Unavailable status code when a check is unhealthy.
+func TestHealthcheckStatuses(t *testing.T) {
+	tests := []struct {
+		name       string
+		checks     []healthCheck
+		wantCode   int
+		wantStatus string
+	}{
+		{
+			name:       "healthy",
+			checks:     []healthCheck{{name: "a", run: func() error { return nil }}},
+			wantCode:   http.StatusOK,
+			wantStatus: "available",
+		},
+		{
+			name: "degraded",
+			checks: []healthCheck{
+				{name: "a", run: func() error { return nil }},
+				{name: "b", run: func() error { return fmt.Errorf("%w: slow", errHealthDegraded) }},
+			},
+			wantCode:   http.StatusOK,
+			wantStatus: "degraded",
+		},
+		{
+			name: "unhealthy",
+			checks: []healthCheck{
+				{name: "a", run: func() error { return fmt.Errorf("%w: slow", errHealthDegraded) }},
+				{name: "b", run: func() error { return errors.New("connection refused") }},
+			},
+			wantCode:   http.StatusServiceUnavailable,
+			wantStatus: "unavailable",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApp()
+			app.healthChecks = tt.checks
+
+			rr := httptest.NewRecorder()
+			app.healthcheckHandler(rr, httptest.NewRequest(http.MethodGet, "/v1/healthcheck", nil))
+
+			if rr.Code != tt.wantCode {
+				t.Errorf("want %d; got %d", tt.wantCode, rr.Code)
+			}
+
+			var body struct {
+				Status string `json:"status"`
+			}
+			if err := json.NewDecoder(rr.Body).Decode(&body); err != nil {
+				t.Fatal(err)
+			}
+
+			if body.Status != tt.wantStatus {
+				t.Errorf("want status %q; got %q", tt.wantStatus, body.Status)
+			}
+		})
+	}
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -9,14 +11,14 @@ import (
 	"net/url"
 	"strconv"
 	"strings"
+	"sync/atomic"
+	"time"
 
+	"github.com/codeaucafe/snippetbox/greenlight/internal/data"
 	"github.com/codeaucafe/snippetbox/greenlight/internal/validator"
 	"github.com/julienschmidt/httprouter"
 )
 
-// Define an envelope type.
-type envelope map[string]interface{}
-
 // readIDParam reads interpolated "id" from request URL and returns it and nil. If there is an error
 // it returns and 0 and an error.
 func (app *application) readIDParam(r *http.Request) (int64, error) {
@@ -30,13 +32,52 @@ func (app *application) readIDParam(r *http.Request) (int64, error) {
 	return id, nil
 }
 
+// readMovieIDParam reads the interpolated "id" of a movie route, which can be either the movie's
+// integer ID or its ULID, and returns the movie's integer ID. A ULID is looked up in the database.
+// data.ErrRecordNotFound is returned if the parameter is neither, or there's no movie with the
+// ULID, so that the caller can send a 404 Not Found response.
+func (app *application) readMovieIDParam(r *http.Request) (int64, error) {
+	id, err := app.readIDParam(r)
+	if err == nil {
+		return id, nil
+	}
+
+	param := httprouter.ParamsFromContext(r.Context()).ByName("id")
+	if !data.IsULID(param) {
+		return 0, data.ErrRecordNotFound
+	}
+
+	return app.models.Movies.GetID(r.Context(), param)
+}
+
 // writeJSON marshals data structure to encoded JSON response. It returns an error if there are
-// any issues, else error is nil.
+// any issues, else error is nil. If the client selected some fields of the resources (see
+// selectableFields()) then the others are left out. The envelope is then passed through the
+// application's envelopeEncoder, so that the final structure of the response body can be
+// customized.
 func (app *application) writeJSON(w http.ResponseWriter, status int, data envelope,
 	headers http.Header) error {
+	data, err := selectFields(data, w.Header())
+	if err != nil {
+		return err
+	}
+
+	return app.writeResponse(w, status, app.responseEnvelope().Data(data), headers)
+}
+
+// writeResponse marshals the given body to encoded JSON and writes it as the response. Handlers
+// should use writeJSON() (or errorResponse()) rather than calling this directly.
+func (app *application) writeResponse(w http.ResponseWriter, status int, body interface{},
+	headers http.Header) error {
+	// Shape the body for the API version and runtime format that the client asked for.
+	body, err := shapeResponse(body, w.Header())
+	if err != nil {
+		return err
+	}
+
 	// Use the json.MarshalIndent() function so that whitespace is added to the encoded JSON. Use
 	// no line prefix and tab indents for each element.
-	js, err := json.MarshalIndent(data, "", "\t")
+	js, err := json.MarshalIndent(body, "", "\t")
 	if err != nil {
 		return err
 	}
@@ -82,70 +123,7 @@ func (app *application) readJSON(w http.ResponseWriter, r *http.Request, dst int
 	// Decode the request body to the destination.
 	err := dec.Decode(dst)
 	if err != nil {
-		// If there is an error during decoding, start the error triage...
-		var syntaxError *json.SyntaxError
-		var unmarshalTypeError *json.UnmarshalTypeError
-		var invalidUnmarshalError *json.InvalidUnmarshalError
-
-		switch {
-		// Use the error.As() function to check whether the error has the type *json.SyntaxError.
-		// If it does, then return a plain-english error message which includes the location
-		// of the problem.
-		case errors.As(err, &syntaxError):
-			return fmt.Errorf("body contains badly-formed JSON at (charcter %d)", syntaxError.Offset)
-
-		// In some circumstances Decode() may also return an io.ErrUnexpectedEOF error
-		// for syntax error in the JSON. So, we check for this using errors.Is() and return
-		// a generic error message. There is an open issue regarding this at
-		// https://github.com/golang/go/issues/25956
-		case errors.Is(err, io.ErrUnexpectedEOF):
-			return errors.New("body contains badly-formed JSON")
-
-		// Likewise, catch any *json.UnmarshalTypeError errors.
-		// These occur when the JSON value is the wrong type for the target destination.
-		// If the error relates to a specific field, then we include that in our error message
-		// to make it easier for the client to debug.
-		case errors.As(err, &unmarshalTypeError):
-			if unmarshalTypeError.Field != "" {
-				return fmt.Errorf("body contains incorrect JSON type for field %q",
-					unmarshalTypeError.Field)
-			}
-			return fmt.Errorf("body contains incorrect JSON type (at character %d)",
-				unmarshalTypeError.Offset)
-
-		// An io.EOF error will be returned by Decode() if the request body is empty. We check
-		// for this with errors.Is() and return a plain-english error message instead.
-		case errors.Is(err, io.EOF):
-			return errors.New("body must not be empty")
-
-		// If the JSON contains a field which cannot be mapped to the target destination
-		// then Decode() will now return an error message in the format "json: unknown
-		// field "<name>"". We check for this, extract the field name from the error,
-		// and interpolate it into our custom error message.
-		// Note, that there's an open issue at https://github.com/golang/go/issues/29035
-		// regarding turning this into a distinct error type in the future.
-		case strings.HasPrefix(err.Error(), "json: unknown field "):
-			fieldName := strings.TrimPrefix(err.Error(), "json: unknown field ")
-			return fmt.Errorf("body contains unknown key %s", fieldName)
-
-		// If the request body exceeds 1MB in size then decode will now fail with the
-		// error "http: request body too large". There is an open issue about turning
-		// this into a distinct error type at https://github.com/golang/go/issues/30715.
-		case err.Error() == "http: request body too large":
-			return fmt.Errorf("body must not be larger than %d bytes", maxBytes)
-
-		// A json.InvalidUnmarshalError error will be returned if we pass a non-nil
-		// pointer to Decode(). We catch this and panic, rather than returning an error
-		// to our handler. At the end of this chapter we'll talk about panicking
-		// versus returning, and discuss why it's an appropriate thing to do in this specific
-		// situation.
-		case errors.As(err, &invalidUnmarshalError):
-			panic(err)
-
-		// For anything else, return the error message as-is.
-		default:
-			return err
-		}
+		return decodeJSONError(err, maxBytes)
 	}
 
 	// Call Decode() again, using a pointer to an empty anonymous struct as the
@@ -160,6 +138,75 @@ func (app *application) readJSON(w http.ResponseWriter, r *http.Request, dst int
 	return nil
 }
 
+// decodeJSONError triages an error from decoding a JSON request body, and returns an error with a
+// plain-english message which is suitable for sending to the client.
+func decodeJSONError(err error, maxBytes int) error {
+	// If there is an error during decoding, start the error triage...
+	var syntaxError *json.SyntaxError
+	var unmarshalTypeError *json.UnmarshalTypeError
+	var invalidUnmarshalError *json.InvalidUnmarshalError
+
+	switch {
+	// Use the error.As() function to check whether the error has the type *json.SyntaxError.
+	// If it does, then return a plain-english error message which includes the location
+	// of the problem.
+	case errors.As(err, &syntaxError):
+		return fmt.Errorf("body contains badly-formed JSON at (charcter %d)", syntaxError.Offset)
+
+	// In some circumstances Decode() may also return an io.ErrUnexpectedEOF error
+	// for syntax error in the JSON. So, we check for this using errors.Is() and return
+	// a generic error message. There is an open issue regarding this at
+	// https://github.com/golang/go/issues/25956
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		return errors.New("body contains badly-formed JSON")
+
+	// Likewise, catch any *json.UnmarshalTypeError errors.
+	// These occur when the JSON value is the wrong type for the target destination.
+	// If the error relates to a specific field, then we include that in our error message
+	// to make it easier for the client to debug.
+	case errors.As(err, &unmarshalTypeError):
+		if unmarshalTypeError.Field != "" {
+			return fmt.Errorf("body contains incorrect JSON type for field %q",
+				unmarshalTypeError.Field)
+		}
+		return fmt.Errorf("body contains incorrect JSON type (at character %d)",
+			unmarshalTypeError.Offset)
+
+	// An io.EOF error will be returned by Decode() if the request body is empty. We check
+	// for this with errors.Is() and return a plain-english error message instead.
+	case errors.Is(err, io.EOF):
+		return errors.New("body must not be empty")
+
+	// If the JSON contains a field which cannot be mapped to the target destination
+	// then Decode() will now return an error message in the format "json: unknown
+	// field "<name>"". We check for this, extract the field name from the error,
+	// and interpolate it into our custom error message.
+	// Note, that there's an open issue at https://github.com/golang/go/issues/29035
+	// regarding turning this into a distinct error type in the future.
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		fieldName := strings.TrimPrefix(err.Error(), "json: unknown field ")
+		return fmt.Errorf("body contains unknown key %s", fieldName)
+
+	// If the request body exceeds the size limit then decode will now fail with the
+	// error "http: request body too large". There is an open issue about turning
+	// this into a distinct error type at https://github.com/golang/go/issues/30715.
+	case err.Error() == "http: request body too large":
+		return fmt.Errorf("body must not be larger than %d bytes", maxBytes)
+
+	// A json.InvalidUnmarshalError error will be returned if we pass a non-nil
+	// pointer to Decode(). We catch this and panic, rather than returning an error
+	// to our handler. At the end of this chapter we'll talk about panicking
+	// versus returning, and discuss why it's an appropriate thing to do in this specific
+	// situation.
+	case errors.As(err, &invalidUnmarshalError):
+		panic(err)
+
+	// For anything else, return the error message as-is.
+	default:
+		return err
+	}
+}
+
 // readString is a helper method on application type that returns a string value from the URL query
 // string, or the provided default value if no matching key is found.
 func (app *application) readStrings(qs url.Values, key string, defaultValue string) string {
@@ -217,15 +264,86 @@ func (app *application) readInt(qs url.Values, key string, defaultValue int, v *
 	return i
 }
 
+// readBool reads a boolean from the URL query string, for filters such as ?activated=false. If
+// no matching key is found then it returns nil, which means no filter. If the value isn't true
+// or false, then we record an error message in the provided Validator instance, and return nil.
+func (app *application) readBool(qs url.Values, key string, v *validator.Validator) *bool {
+	s := qs.Get(key)
+
+	if s == "" {
+		return nil
+	}
+
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		v.AddError(key, "must be true or false")
+		return nil
+	}
+
+	return &b
+}
+
+// readUserFilter reads a user ID from the URL query string, for filters such as ?created_by=42 on
+// the list endpoints. The value "me" stands for the authenticated user. If no matching key is
+// found then it returns zero, which means no filter. If the value isn't a positive integer, or
+// it's "me" but the request is anonymous, then we record an error message in the provided
+// Validator instance, and return zero.
+func (app *application) readUserFilter(r *http.Request, qs url.Values, key string, v *validator.Validator) int64 {
+	s := qs.Get(key)
+
+	switch s {
+	case "":
+		return 0
+	case "me":
+		user := app.contextGetUser(r)
+		if user.IsAnonymous() {
+			v.AddError(key, "must be a user ID when not authenticated")
+			return 0
+		}
+		return user.ID
+	}
+
+	id, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || id < 1 {
+		v.AddError(key, `must be a user ID or "me"`)
+		return 0
+	}
+
+	return id
+}
+
+// readDate is a helper method on application type that reads a date in the format YYYY-MM-DD from
+// the URL query string. If no matching key is found then it returns the provided default value.
+// If the value couldn't be parsed, then we record an error message in the provided Validator
+// instance, and return the default value.
+func (app *application) readDate(qs url.Values, key string, defaultValue time.Time, v *validator.Validator) time.Time {
+	s := qs.Get(key)
+
+	if s == "" {
+		return defaultValue
+	}
+
+	t, err := time.Parse("2006-01-02", s)
+	if err != nil {
+		v.AddError(key, "must be a date in the format YYYY-MM-DD")
+		return defaultValue
+	}
+
+	return t
+}
+
 // background is a helper that accepts an arbitrary function as a parameter and runs it in a
 // in goroutine in the background.
 func (app *application) background(fn func()) {
-	// Increment the WaitGroup counter
+	// Increment the WaitGroup counter, and the count of in-flight tasks that the healthcheck
+	// reports on.
 	app.wg.Add(1)
+	atomic.AddInt64(&app.backgroundTasks, 1)
 
 	go func() {
 		// Use defer to decrement the WaitGroup counter before the goroutine returns.
 		defer app.wg.Done()
+		defer atomic.AddInt64(&app.backgroundTasks, -1)
 
 		// Recover from any panic
 		defer func() {
@@ -238,3 +356,30 @@ func (app *application) background(fn func()) {
 		fn()
 	}()
 }
+
+// newIncidentID returns a random identifier for an incident, such as a recovered panic, which can
+// be shown to the client and searched for in the logs. It's 16 hex characters long, which is
+// short enough to read out over the phone but still unique in practice.
+func newIncidentID() string {
+	return randomHexID(8)
+}
+
+// newRequestID returns a random identifier for a request which didn't come with its own
+// X-Request-ID header.
+func newRequestID() string {
+	return randomHexID(16)
+}
+
+// randomHexID returns n random bytes encoded as hex.
+func randomHexID(n int) string {
+	b := make([]byte, n)
+
+	_, err := rand.Read(b)
+	if err != nil {
+		// This should never happen, but if it does then the current time is still a good way to
+		// find the log entry.
+		return strconv.FormatInt(time.Now().UnixNano(), 16)
+	}
+
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// readJSONArray decodes a request body containing a JSON array one element at a time, calling fn
+// with the index and value of each element as it is decoded. Unlike readJSON(), the body is never
+// held in memory all at once, so bulk endpoints can accept multi-megabyte payloads within bounded
+// memory. The body is still limited to maxBytes in total.
+//
+// Each element is decoded into a new T with unknown fields disallowed, and decoding errors are
+// triaged in the same way as for readJSON(), prefixed with the index of the element. If fn
+// returns an error then decoding stops and that error is returned unchanged, so handlers can
+// return their own error types (for example, to report a validation failure). Note that fn has
+// already been called for the earlier elements by then, so bulk handlers should either make
+// their processing of each element independent, or collect the elements (or their results) and
+// only act on them once readJSONArray has returned successfully.
+func readJSONArray[T any](w http.ResponseWriter, r *http.Request, maxBytes int, fn func(i int, elem *T) error) error {
+	r.Body = http.MaxBytesReader(w, r.Body, int64(maxBytes))
+
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+
+	// Read the opening bracket of the array.
+	tok, err := dec.Token()
+	if err != nil {
+		return decodeJSONError(err, maxBytes)
+	}
+
+	if delim, ok := tok.(json.Delim); !ok || delim != '[' {
+		return errors.New("body must contain a JSON array")
+	}
+
+	// Decode each element in turn while there are more elements in the array.
+	for i := 0; dec.More(); i++ {
+		var elem T
+
+		err := dec.Decode(&elem)
+		if err != nil {
+			return fmt.Errorf("element %d: %w", i, decodeJSONError(err, maxBytes))
+		}
+
+		err = fn(i, &elem)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Read the closing bracket of the array. dec.More() returns false for a syntax error as
+	// well as the end of the array, so this is also where those are reported.
+	_, err = dec.Token()
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return decodeJSONError(err, maxBytes)
+	}
+
+	// As in readJSON(), make sure that there's nothing else in the body after the array.
+	_, err = dec.Token()
+	if err != io.EOF {
+		return errors.New("body must only contain a single JSON value")
+	}
+
+	return nil
+}
+
+// writeJSONArray writes a JSON array of n elements to w one element at a time, getting each one
+// from elem, so that large arrays never have to be held in memory all at once. The array is
+// indented in the same way as by json.MarshalIndent(v, "", "\t").
+func writeJSONArray(w io.Writer, n int, elem func(i int) interface{}) error {
+	if n == 0 {
+		_, err := io.WriteString(w, "[]")
+		return err
+	}
+
+	bw := bufio.NewWriter(w)
+
+	_, _ = bw.WriteString("[\n\t")
+
+	for i := 0; i < n; i++ {
+		if i > 0 {
+			_, _ = bw.WriteString(",\n\t")
+		}
+
+		js, err := json.MarshalIndent(elem(i), "\t", "\t")
+		if err != nil {
+			return err
+		}
+
+		_, _ = bw.Write(js)
+	}
+
+	_, _ = bw.WriteString("\n]")
+
+	return bw.Flush()
+}
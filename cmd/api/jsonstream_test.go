@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/codeaucafe/snippetbox/greenlight/internal/testutil"
+)
+
+// TestReadJSONArray checks that the elements of a JSON array are passed to the callback one at a
+// time, and that malformed bodies are rejected with the same messages as readJSON.
+func TestReadJSONArray(t *testing.T) {
+	type elem struct {
+		Title string `json:"title"`
+	}
+
+	tests := []struct {
+		name      string
+		body      string
+		maxBytes  int
+		wantTitle []string
+		wantErr   string
+	}{
+		{name: "valid", body: `[{"title": "a"}, {"title": "b"}]`, wantTitle: []string{"a", "b"}},
+		{name: "empty array", body: `[]`},
+		{name: "empty body", body: ``, wantErr: "body must not be empty"},
+		{name: "not an array", body: `{"title": "a"}`, wantErr: "body must contain a JSON array"},
+		{name: "unknown field", body: `[{"title": "a"}, {"name": "b"}]`, wantTitle: []string{"a"}, wantErr: `element 1: body contains unknown key "name"`},
+		{name: "wrong type", body: `[{"title": 1}]`, wantErr: `element 0: body contains incorrect JSON type for field "title"`},
+		{name: "unterminated", body: `[{"title": "a"}`, wantTitle: []string{"a"}, wantErr: "element 1: body contains badly-formed JSON at (charcter 15)"},
+		{name: "trailing data", body: `[] {}`, wantErr: "body must only contain a single JSON value"},
+		{name: "too large", body: `[{"title": "` + strings.Repeat("a", 100) + `"}]`, maxBytes: 50, wantErr: "element 0: body must not be larger than 50 bytes"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			maxBytes := tt.maxBytes
+			if maxBytes == 0 {
+				maxBytes = 1_048_576
+			}
+
+			r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(tt.body))
+
+			var titles []string
+
+			err := readJSONArray(httptest.NewRecorder(), r, maxBytes, func(i int, e *elem) error {
+				titles = append(titles, e.Title)
+				return nil
+			})
+
+			gotErr := ""
+			if err != nil {
+				gotErr = err.Error()
+			}
+
+			testutil.Equal(t, gotErr, tt.wantErr)
+			testutil.Equal(t, strings.Join(titles, ","), strings.Join(tt.wantTitle, ","))
+		})
+	}
+}
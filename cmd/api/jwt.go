@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+
+	"github.com/codeaucafe/snippetbox/greenlight/internal/data"
+)
+
+// Authentication modes, set with the -auth-mode flag. In token mode, authentication tokens are
+// random strings whose hashes are stored in the tokens table. In jwt mode, they're signed JWTs
+// which are verified without touching the tokens table. Refresh tokens are stored in the tokens
+// table in both modes.
+const (
+	authModeToken = "token"
+	authModeJWT   = "jwt"
+)
+
+// errInvalidJWT is returned by parseJWT for any token which isn't a valid authentication JWT.
+var errInvalidJWT = errors.New("invalid authentication JWT")
+
+// jwtSigningMethod is the algorithm used to sign the JWTs that we issue.
+var jwtSigningMethod = jwt.SigningMethodHS256
+
+// jwtKeyFunc returns the key used to verify a JWT. It's a jwt.Keyfunc, so that verification
+// doesn't depend on where the keys come from. For now it returns the -jwt-secret for HS256
+// tokens, but it could equally look the key up in a JWKS by the token's "kid" header.
+//
+// It rejects tokens signed with any other algorithm, including "none", so that a client can't
+// choose how its token is verified.
+func (app *application) jwtKeyFunc() jwt.Keyfunc {
+	secret := []byte(app.config.jwt.secret)
+
+	return func(token *jwt.Token) (interface{}, error) {
+		if token.Method != jwtSigningMethod {
+			return nil, fmt.Errorf("unexpected signing method %q", token.Header["alg"])
+		}
+
+		return secret, nil
+	}
+}
+
+// jwtClaims are the claims of the JWTs that we issue. Generation is the user's token generation
+// when the token was issued (see data.User.TokenGeneration), so that resetting the password
+// revokes the tokens issued before it.
+type jwtClaims struct {
+	jwt.RegisteredClaims
+	Generation int `json:"gen"`
+}
+
+// newJWT issues a signed JWT authentication token for the user, valid for the -token-access-ttl
+// duration. It's returned as a data.Token so that the response is the same shape in both
+// authentication modes.
+func (app *application) newJWT(user *data.User) (*data.Token, error) {
+	now := app.clock.Now()
+	expiry := now.Add(app.config.tokens.accessTTL)
+
+	claims := jwtClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   strconv.FormatInt(user.ID, 10),
+			Issuer:    app.config.jwt.issuer,
+			Audience:  jwt.ClaimStrings{app.config.jwt.audience},
+			IssuedAt:  jwt.NewNumericDate(now),
+			NotBefore: jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(expiry),
+		},
+		Generation: user.TokenGeneration,
+	}
+
+	signed, err := jwt.NewWithClaims(jwtSigningMethod, claims).SignedString([]byte(app.config.jwt.secret))
+	if err != nil {
+		return nil, err
+	}
+
+	return &data.Token{
+		Plaintext: signed,
+		UserID:    user.ID,
+		Expiry:    expiry,
+		Scope:     data.ScopeAuthentication,
+	}, nil
+}
+
+// parseJWT verifies a JWT authentication token and its claims, and returns the ID of the user
+// that it was issued to and the user's token generation at the time. The claims are checked
+// against app.clock rather than the jwt package's own clock, so that expiry behaves in the same
+// way as for stateful tokens.
+func (app *application) parseJWT(tokenString string) (int64, int, error) {
+	var claims jwtClaims
+
+	parser := jwt.NewParser(jwt.WithValidMethods([]string{jwtSigningMethod.Alg()}), jwt.WithoutClaimsValidation())
+
+	_, err := parser.ParseWithClaims(tokenString, &claims, app.jwtKeyFunc())
+	if err != nil {
+		return 0, 0, fmt.Errorf("%w: %s", errInvalidJWT, err)
+	}
+
+	now := app.clock.Now()
+
+	switch {
+	case !claims.VerifyExpiresAt(now, true):
+		return 0, 0, fmt.Errorf("%w: expired", errInvalidJWT)
+	case !claims.VerifyNotBefore(now, true):
+		return 0, 0, fmt.Errorf("%w: not valid yet", errInvalidJWT)
+	case !claims.VerifyIssuer(app.config.jwt.issuer, true):
+		return 0, 0, fmt.Errorf("%w: unexpected issuer", errInvalidJWT)
+	case !claims.VerifyAudience(app.config.jwt.audience, true):
+		return 0, 0, fmt.Errorf("%w: unexpected audience", errInvalidJWT)
+	}
+
+	userID, err := strconv.ParseInt(claims.Subject, 10, 64)
+	if err != nil || userID < 1 {
+		return 0, 0, fmt.Errorf("%w: invalid subject", errInvalidJWT)
+	}
+
+	return userID, claims.Generation, nil
+}
+
+// statefulAccessTTL returns the lifetime of the authentication tokens to store in the tokens
+// table: the -token-access-ttl duration in token mode, and zero in jwt mode, where the
+// authentication tokens are JWTs issued by newJWT() instead.
+func (app *application) statefulAccessTTL() time.Duration {
+	if app.config.auth.mode == authModeJWT {
+		return 0
+	}
+
+	return app.config.tokens.accessTTL
+}
+
+// issueAccessToken fills in the authentication token for a pair returned by the token model. In
+// jwt mode the model doesn't create one, so it issues a JWT for the user instead. The user is
+// looked up by the new refresh token, so that if their password is reset concurrently either
+// the refresh token is gone (and ErrRecordNotFound is returned) or the JWT carries the token
+// generation from before the reset, and is revoked along with it.
+func (app *application) issueAccessToken(ctx context.Context, access, refresh *data.Token) (*data.Token, error) {
+	if access != nil {
+		return access, nil
+	}
+
+	user, err := app.models.Users.GetForToken(ctx, data.ScopeRefresh, refresh.Plaintext)
+	if err != nil {
+		return nil, err
+	}
+
+	return app.newJWT(user)
+}
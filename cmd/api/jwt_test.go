@@ -0,0 +1,83 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+
+	"github.com/codeaucafe/snippetbox/greenlight/internal/clock"
+	"github.com/codeaucafe/snippetbox/greenlight/internal/data"
+	"github.com/codeaucafe/snippetbox/greenlight/internal/testutil"
+)
+
+// TestJWT tests that the JWTs issued by newJWT are accepted by parseJWT until they expire and
+// carry the user's token generation, and that tokens which are tampered with or signed in any
+// other way are rejected.
+func TestJWT(t *testing.T) {
+	app := newTestApp()
+	app.config.auth.mode = authModeJWT
+	app.config.jwt.secret = strings.Repeat("s", 32)
+	app.config.jwt.issuer = "greenlight"
+	app.config.jwt.audience = "greenlight"
+	app.config.tokens.accessTTL = 15 * time.Minute
+
+	user := &data.User{ID: 42, TokenGeneration: 3}
+
+	token, err := app.newJWT(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.Equal(t, token.Expiry, testTime.Add(15*time.Minute))
+
+	userID, generation, err := app.parseJWT(token.Plaintext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.Equal(t, userID, int64(42))
+	testutil.Equal(t, generation, 3)
+
+	// A token signed with "none" is rejected.
+	unsigned, err := jwt.NewWithClaims(jwt.SigningMethodNone, jwt.RegisteredClaims{Subject: "42"}).
+		SignedString(jwt.UnsafeAllowNoneSignatureType)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A token issued by someone else, or with a tampered signature, is rejected.
+	other := newTestApp()
+	other.config = app.config
+	other.config.jwt.secret = strings.Repeat("x", 32)
+	forged, err := other.newJWT(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wrongAudience := newTestApp()
+	wrongAudience.config = app.config
+	wrongAudience.config.jwt.audience = "elsewhere"
+	elsewhere, err := wrongAudience.newJWT(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, tokenString := range map[string]string{
+		"none":           unsigned,
+		"wrong secret":   forged.Plaintext,
+		"wrong audience": elsewhere.Plaintext,
+		"tampered":       token.Plaintext + "x",
+	} {
+		if _, _, err := app.parseJWT(tokenString); !errors.Is(err, errInvalidJWT) {
+			t.Errorf("%s: want errInvalidJWT; got %v", name, err)
+		}
+	}
+
+	// The token stops working once it has expired.
+	app.clock.(*clock.Mock).Advance(16 * time.Minute)
+
+	if _, _, err := app.parseJWT(token.Plaintext); !errors.Is(err, errInvalidJWT) {
+		t.Errorf("expired: want errInvalidJWT; got %v", err)
+	}
+}
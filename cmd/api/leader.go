@@ -0,0 +1,84 @@
+package main
+
+import (
+	"expvar"
+	"sync/atomic"
+	"time"
+)
+
+// schedulerLockKey is the key of the PostgreSQL advisory lock that the worker processes compete
+// for. The instance holding it is the leader, and is the only one to run the singleton
+// scheduled jobs. The value is arbitrary, it just has to be the same for every instance.
+const schedulerLockKey = 4012001
+
+// leaderMetrics publishes the leader election state in the expvar handler, in the same way as
+// statsMetrics.
+var leaderMetrics = expvar.NewMap("leader_election")
+
+// isLeader returns true if this instance should run the singleton scheduled jobs, such as the
+// materialized view refresh and the saved search notifications. If leader election is disabled
+// then every instance is the leader.
+func (app *application) isLeader() bool {
+	return atomic.LoadInt32(&app.leading) == 1
+}
+
+// setLeader records whether this instance is the leader, and updates the leadership metrics
+// when that changes.
+func (app *application) setLeader(leading bool) {
+	var value int32
+	if leading {
+		value = 1
+	}
+
+	previous := atomic.SwapInt32(&app.leading, value)
+
+	leaderMetrics.Set("is_leader", expvarInt(int64(value)))
+
+	switch {
+	case previous == 0 && leading:
+		leaderMetrics.Add("elected", 1)
+		leaderMetrics.Set("leader_since", expvarInt(time.Now().Unix()))
+		app.logger.PrintInfo("elected as leader for scheduled jobs", nil)
+	case previous == 1 && !leading:
+		leaderMetrics.Add("lost", 1)
+		app.logger.PrintInfo("lost leadership for scheduled jobs", nil)
+	}
+}
+
+// electLeaderPeriodically tries to become the leader (or checks that this instance still is)
+// once every interval. If the leader stops or loses its database connection then another
+// instance will take over within one interval. It runs until the application exits.
+func (app *application) electLeaderPeriodically(interval time.Duration) {
+	for {
+		app.electLeader()
+
+		time.Sleep(interval)
+	}
+}
+
+// electLeader tries to take the leader lock, or checks that it's still held, and records the
+// result. An error holding the lock means that this instance isn't the leader.
+func (app *application) electLeader() {
+	leading, err := app.leaderLock.Hold()
+	if err != nil {
+		leaderMetrics.Add("errors", 1)
+		app.logger.PrintError(err, nil)
+	}
+
+	app.setLeader(leading)
+}
+
+// stepDown gives up leadership during a graceful shutdown, so that another instance can take
+// over the scheduled jobs straight away.
+func (app *application) stepDown() {
+	if app.leaderLock == nil {
+		return
+	}
+
+	err := app.leaderLock.Release()
+	if err != nil {
+		app.logger.PrintError(err, nil)
+	}
+
+	app.setLeader(false)
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/codeaucafe/snippetbox/greenlight/internal/clock"
+	"github.com/codeaucafe/snippetbox/greenlight/internal/data"
+	"github.com/codeaucafe/snippetbox/greenlight/internal/testutil"
+)
+
+// terminateLockHolder kills the database connection holding the advisory lock with the given key,
+// as if the leader's connection had been lost.
+func terminateLockHolder(t *testing.T, db *sql.DB, key int64) {
+	t.Helper()
+
+	// A bigint advisory lock key is split between the classid and objid columns of pg_locks.
+	var terminated bool
+	err := db.QueryRow(`
+		SELECT pg_terminate_backend(pid) FROM pg_locks
+		WHERE locktype = 'advisory' AND granted AND classid = $1 AND objid = $2 AND objsubid = 1`,
+		key>>32, key&0xffffffff).Scan(&terminated)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.Equal(t, terminated, true)
+}
+
+// holdEventually calls Hold until it succeeds, as PostgreSQL releases the lock of a terminated
+// connection asynchronously.
+func holdEventually(t *testing.T, lock *data.LeaderLock) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		leading, _ := lock.Hold()
+		if leading {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the leader lock")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestLeaderLock tests that only one instance can hold the leader lock at a time, and that
+// another instance can take it over once it's released or its connection is lost.
+func TestLeaderLock(t *testing.T) {
+	db := testutil.NewDB(t)
+
+	first := data.NewLeaderLock(db, schedulerLockKey)
+	second := data.NewLeaderLock(db, schedulerLockKey)
+	t.Cleanup(func() {
+		_ = first.Release()
+		_ = second.Release()
+	})
+
+	leading, err := first.Hold()
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.Equal(t, leading, true)
+
+	// The second instance can't take the lock, and the first still holds it.
+	leading, err = second.Hold()
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.Equal(t, leading, false)
+
+	leading, err = first.Hold()
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.Equal(t, leading, true)
+
+	// Once the first instance releases the lock, the second takes over straight away.
+	if err := first.Release(); err != nil {
+		t.Fatal(err)
+	}
+
+	leading, err = second.Hold()
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.Equal(t, leading, true)
+
+	// When the second instance loses its connection, it finds out on its next check, and the
+	// first can take over again.
+	terminateLockHolder(t, db, schedulerLockKey)
+
+	leading, err = second.Hold()
+	testutil.Equal(t, err != nil, true)
+	testutil.Equal(t, leading, false)
+
+	holdEventually(t, first)
+}
+
+// TestLeaderSingletonJobs tests that the singleton scheduled jobs are skipped while another
+// instance is the leader, run once this instance is elected, and stop again when it loses the
+// lock's connection.
+func TestLeaderSingletonJobs(t *testing.T) {
+	app, fx := newTestDBApp(t)
+	app.config.trash.retention = 24 * time.Hour
+	app.clock.(*clock.Mock).Set(time.Now().Add(48 * time.Hour))
+
+	db := app.models.System.DB
+	app.leaderLock = data.NewLeaderLock(db, schedulerLockKey)
+
+	other := data.NewLeaderLock(db, schedulerLockKey)
+	t.Cleanup(func() {
+		_ = other.Release()
+		app.stepDown()
+	})
+
+	// trashedMovie returns the ID of a new movie which is in the trash and due to be purged.
+	trashedMovie := func() int64 {
+		movie := fx.Movie()
+		if err := app.models.Movies.Delete(context.Background(), movie.ID); err != nil {
+			t.Fatal(err)
+		}
+		return movie.ID
+	}
+
+	exists := func(id int64) bool {
+		var exists bool
+		err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM movies WHERE id = $1)", id).Scan(&exists)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return exists
+	}
+
+	leading, err := other.Hold()
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.Equal(t, leading, true)
+
+	app.electLeader()
+	testutil.Equal(t, app.isLeader(), false)
+
+	// The loop carries on after the test finishes, but only logs errors once the database has
+	// gone.
+	go app.purgeDeletedMoviesPeriodically(time.Millisecond)
+
+	id := trashedMovie()
+	time.Sleep(100 * time.Millisecond)
+	testutil.Equal(t, exists(id), true)
+
+	// Once the other instance steps down, this one is elected and runs the job.
+	if err := other.Release(); err != nil {
+		t.Fatal(err)
+	}
+
+	app.electLeader()
+	testutil.Equal(t, app.isLeader(), true)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for exists(id) {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the movie to be purged")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// When this instance loses the lock's connection, it stops being the leader on its next
+	// check and stops running the job.
+	terminateLockHolder(t, db, schedulerLockKey)
+
+	app.electLeader()
+	testutil.Equal(t, app.isLeader(), false)
+
+	id = trashedMovie()
+	time.Sleep(100 * time.Millisecond)
+	testutil.Equal(t, exists(id), true)
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/codeaucafe/snippetbox/greenlight/internal/clock"
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/time/rate"
+)
+
+// The stores for the -limiter-store flag. The memory store keeps each client's token bucket in
+// the process, so every replica of the API enforces its own limits and a client can get through
+// a multiple of its limit behind a load balancer. The redis store keeps the buckets in Redis,
+// where they're shared by all of the replicas.
+const (
+	limiterStoreMemory = "memory"
+	limiterStoreRedis  = "redis"
+)
+
+// limiterStore is where rate limiters keep their token buckets. Each key names the bucket of one
+// client of one limiter, and allow takes a token from it if there's one left, while check only
+// reports whether there is one. The rps and burst are passed on every call, so that they can
+// follow settings which change at runtime, and a client keeps any tokens it has already used up
+// when they change.
+type limiterStore interface {
+	allow(key string, rps float64, burst int) (bool, error)
+	check(key string, rps float64, burst int) (bool, error)
+}
+
+// newLimiterStore returns the limiter store selected by the -limiter-store flag. The redis store
+// falls back to a memory store of its own while Redis is unavailable.
+func (app *application) newLimiterStore() limiterStore {
+	if app.config.limiter.store == limiterStoreRedis {
+		return &fallbackLimiterStore{
+			primary:  &redisLimiterStore{client: app.redis},
+			fallback: newMemoryLimiterStore(app.clock),
+			redis:    app.redisStatus,
+		}
+	}
+
+	return newMemoryLimiterStore(app.clock)
+}
+
+// fallbackLimiterStore uses the redis store while Redis is available, and the memory store while
+// it isn't, so that requests are still rate limited rather than failed. Each replica then
+// enforces its own limits, as with the memory store, until Redis is back. The buckets aren't
+// carried over either way, so clients start with a full burst when the store changes.
+type fallbackLimiterStore struct {
+	primary  limiterStore
+	fallback limiterStore
+	redis    *redisStatus
+}
+
+// allow takes a token from the client's bucket in the primary store, or in the fallback store if
+// Redis is unavailable.
+func (s *fallbackLimiterStore) allow(key string, rps float64, burst int) (bool, error) {
+	if s.redis.available() {
+		allowed, err := s.primary.allow(key, rps, burst)
+		if err == nil {
+			s.redis.succeeded()
+			return allowed, nil
+		}
+
+		s.redis.failed("rate_limiter", err)
+	}
+
+	redisFallbacks.WithLabelValues("rate_limiter").Inc()
+
+	return s.fallback.allow(key, rps, burst)
+}
+
+// check reports whether there's a token left in the client's bucket in the primary store, or in
+// the fallback store if Redis is unavailable.
+func (s *fallbackLimiterStore) check(key string, rps float64, burst int) (bool, error) {
+	if s.redis.available() {
+		allowed, err := s.primary.check(key, rps, burst)
+		if err == nil {
+			s.redis.succeeded()
+			return allowed, nil
+		}
+
+		s.redis.failed("rate_limiter", err)
+	}
+
+	redisFallbacks.WithLabelValues("rate_limiter").Inc()
+
+	return s.fallback.check(key, rps, burst)
+}
+
+// memoryLimiterStore keeps the token buckets in memory, using the rate package.
+type memoryLimiterStore struct {
+	clock clock.Clock
+
+	mu      sync.Mutex
+	clients map[string]*rateLimitClient
+}
+
+// rateLimitClient holds the rate limiter and last seen time for each client.
+type rateLimitClient struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// newMemoryLimiterStore returns a new memoryLimiterStore, and launches a background goroutine
+// which removes old entries from its clients map once every minute.
+func newMemoryLimiterStore(c clock.Clock) *memoryLimiterStore {
+	s := &memoryLimiterStore{
+		clock:   c,
+		clients: make(map[string]*rateLimitClient),
+	}
+
+	go func() {
+		for {
+			time.Sleep(time.Minute)
+
+			// Lock the mutex to prevent any rate limiter checks from happening while the cleanup
+			// is taking place.
+			s.mu.Lock()
+
+			// Loop through all clients. if they haven't been seen within the last three minutes,
+			// then delete the corresponding entry from the clients map.
+			for key, client := range s.clients {
+				if s.clock.Now().Sub(client.lastSeen) > 3*time.Minute {
+					delete(s.clients, key)
+				}
+			}
+
+			// Importantly, unlock the mutex when the cleanup is complete.
+			s.mu.Unlock()
+		}
+	}()
+
+	return s
+}
+
+// allow takes a token from the client's bucket, if there's one left.
+func (s *memoryLimiterStore) allow(key string, rps float64, burst int) (bool, error) {
+	// Lock the mutex to prevent this code from being executed concurrently.
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.clock.Now()
+
+	return s.client(key, rps, burst, now).limiter.AllowN(now, 1), nil
+}
+
+// check reports whether there's a token left in the client's bucket, without taking it. The rate
+// package has no way to read the tokens directly, so it reserves one and cancels the reservation
+// straight away, which gives the token back.
+func (s *memoryLimiterStore) check(key string, rps float64, burst int) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.clock.Now()
+
+	reservation := s.client(key, rps, burst, now).limiter.ReserveN(now, 1)
+	defer reservation.CancelAt(now)
+
+	return reservation.OK() && reservation.DelayFrom(now) == 0, nil
+}
+
+// client returns the client with the given key, adding it to the map if it isn't there, with its
+// limiter updated to the given limits. The mutex must be held by the caller.
+func (s *memoryLimiterStore) client(key string, rps float64, burst int, now time.Time) *rateLimitClient {
+	// Check to see if the client already exists in the map. If it doesn't, then initialize a new
+	// rate limiter and add the client and limiter to the map.
+	if _, found := s.clients[key]; !found {
+		s.clients[key] = &rateLimitClient{limiter: rate.NewLimiter(rate.Limit(rps), burst)}
+	}
+
+	client := s.clients[key]
+
+	// If the limits have changed since the limiter was created, update it in place so that the
+	// client keeps any tokens it has already used up.
+	if client.limiter.Limit() != rate.Limit(rps) {
+		client.limiter.SetLimit(rate.Limit(rps))
+	}
+	if client.limiter.Burst() != burst {
+		client.limiter.SetBurst(burst)
+	}
+
+	// Update the last seen time for the client.
+	client.lastSeen = now
+
+	return client
+}
+
+// tokenBucketScript implements a token bucket in Redis, with the same behaviour as the rate
+// package. Each bucket is a hash holding the number of tokens left and when it was last updated,
+// which expires once the bucket would be full again. The time comes from the Redis server, so
+// that the replicas' clocks don't have to agree (this needs Redis 5 or later, which replicates
+// the script's effects rather than the script). The cost is the number of tokens to take when
+// there's one left: 1 for allow, and 0 for check.
+var tokenBucketScript = redis.NewScript(`
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local cost = tonumber(ARGV[3])
+
+local time = redis.call("TIME")
+local now = tonumber(time[1]) * 1000 + math.floor(tonumber(time[2]) / 1000)
+
+local bucket = redis.call("HMGET", KEYS[1], "tokens", "updated")
+local tokens = tonumber(bucket[1])
+local updated = tonumber(bucket[2])
+
+if tokens == nil then
+	tokens = burst
+	updated = now
+end
+
+tokens = math.min(burst, tokens + math.max(0, now - updated) / 1000 * rate)
+
+local allowed = 0
+if tokens >= 1 then
+	tokens = tokens - cost
+	allowed = 1
+end
+
+redis.call("HSET", KEYS[1], "tokens", tokens, "updated", now)
+redis.call("PEXPIRE", KEYS[1], math.ceil(burst / rate * 1000) + 1000)
+
+return allowed
+`)
+
+// redisLimiterStore keeps the token buckets in Redis, so that they're shared by all of the
+// replicas of the API.
+type redisLimiterStore struct {
+	client *redis.Client
+}
+
+// allow takes a token from the client's bucket, if there's one left. An error is returned if
+// Redis can't be reached.
+func (s *redisLimiterStore) allow(key string, rps float64, burst int) (bool, error) {
+	return s.run(key, rps, burst, 1)
+}
+
+// check reports whether there's a token left in the client's bucket, without taking it.
+func (s *redisLimiterStore) check(key string, rps float64, burst int) (bool, error) {
+	return s.run(key, rps, burst, 0)
+}
+
+// run runs the token bucket script on the client's bucket with the given cost.
+func (s *redisLimiterStore) run(key string, rps float64, burst int, cost int) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	allowed, err := tokenBucketScript.Run(ctx, s.client, []string{"greenlight:ratelimit:" + key}, rps, burst, cost).Int()
+	if err != nil {
+		return false, err
+	}
+
+	return allowed == 1, nil
+}
+
+// purgeEmailLimits deletes the per-address email rate limit buckets which have filled up again,
+// so that the table only holds the addresses which have been emailed recently.
+func (app *application) purgeEmailLimits() {
+	job := startJob("purge_email_limits")
+	defer job.finish()
+
+	full := app.config.limiter.emailInterval * time.Duration(app.config.limiter.emailBurst)
+
+	purged, err := app.models.EmailLimits.Purge(context.Background(), app.clock.Now().Add(-full))
+	if err != nil {
+		job.fail()
+		app.logger.PrintError(err, nil)
+		return
+	}
+
+	if purged > 0 {
+		app.logger.PrintInfo("purged email rate limits", map[string]string{
+			"count": strconv.FormatInt(purged, 10),
+		})
+	}
+}
+
+// purgeEmailLimitsPeriodically calls purgeEmailLimits() once every interval, as long as this
+// instance is the leader. It runs until the application exits.
+func (app *application) purgeEmailLimitsPeriodically(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+
+		if !app.isLeader() {
+			continue
+		}
+
+		app.purgeEmailLimits()
+	}
+}
@@ -1,21 +1,32 @@
 package main
 
 import (
+	"compress/gzip"
 	"context"
+	"crypto/rand"
 	"database/sql"
+	"encoding/hex"
 	"expvar"
 	"flag"
 	"fmt"
+	"net"
+	"net/http"
 	"os"
 	"runtime"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/codeaucafe/snippetbox/greenlight/internal/clock"
 	"github.com/codeaucafe/snippetbox/greenlight/internal/data"
 	"github.com/codeaucafe/snippetbox/greenlight/internal/jsonlog"
 	"github.com/codeaucafe/snippetbox/greenlight/internal/mailer"
+	"github.com/codeaucafe/snippetbox/greenlight/internal/storage"
 	"github.com/codeaucafe/snippetbox/greenlight/internal/vcs"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/redis/go-redis/v9"
 
 	// Import the pq driver so that it can register itself with the database/sql
 	// package. Note that we alias this import to the blank identifier, to stop the Go
@@ -31,7 +42,76 @@ var (
 // Define a config struct.
 type config struct {
 	port int
-	env  string
+	// env is the environment which the application is running in. Each environment has a profile
+	// of settings (see envProfiles), which are used unless they're set some other way.
+	env string
+	// errors holds whether the responses to unexpected errors include the error and a stack
+	// trace, for debugging. It must never be enabled where the API is open to the public.
+	errors struct {
+		verbose bool
+	}
+	// headers holds whether the strict security headers (see securityHeaders()) are sent with
+	// every response.
+	headers struct {
+		strict bool
+	}
+	// server holds the timeouts for the HTTP server. ReadHeaderTimeout guards against slow
+	// clients trickling in headers, and WriteTimeout caps how long a response (including a long
+	// export) can take to write.
+	server struct {
+		idleTimeout       time.Duration
+		readTimeout       time.Duration
+		readHeaderTimeout time.Duration
+		writeTimeout      time.Duration
+	}
+	// admin holds the address of the admin listener, which serves the healthcheck, metrics,
+	// profiling and admin endpoints. It's disabled when the address is empty, and those endpoints
+	// (apart from profiling) are served by the public listener instead.
+	admin struct {
+		addr string
+	}
+	// tracing holds the OTLP/HTTP endpoint of the collector that traces are exported to, such as
+	// "http://localhost:4318", and the fraction of traces which are sampled. Tracing is disabled
+	// when the endpoint is empty.
+	tracing struct {
+		endpoint    string
+		sampleRatio float64
+	}
+	// auth holds the authentication mode: "token" for stateful authentication tokens stored in
+	// the database, or "jwt" for signed JWTs.
+	auth struct {
+		mode string
+	}
+	// jwt holds the settings for JWT authentication tokens, which are signed with HS256 using
+	// the secret, and carry the issuer and audience claims.
+	jwt struct {
+		secret   string
+		issuer   string
+		audience string
+	}
+	// tokens holds the lifetimes of the authentication tokens, which are short, and the refresh
+	// tokens which are exchanged for new ones, which are long. Password reset tokens are emailed,
+	// so they last long enough for the email to arrive, but no longer.
+	tokens struct {
+		accessTTL        time.Duration
+		refreshTTL       time.Duration
+		passwordResetTTL time.Duration
+	}
+	// redis holds the URL of the Redis server, such as "redis://localhost:6379/0", for the
+	// features which can use Redis. It's empty if there isn't one.
+	redis struct {
+		url string
+	}
+	// signing holds how far the timestamp of a request signed with an API key can be from the
+	// server's clock, in either direction, before the request is rejected as stale, and the
+	// secret which each API key's own secret is derived from.
+	signing struct {
+		maxSkew time.Duration
+		secret  string
+	}
+	// mode is whether the process serves HTTP requests, runs the background jobs, or both
+	// (api|worker|all).
+	mode string
 	// db struct field holds the configuration settings for our database connection pool.
 	// For now this only holds the DSN, which we read in from a command-line flag.
 	db struct {
@@ -39,6 +119,12 @@ type config struct {
 		maxOpenConns int
 		maxIdleConns int
 		maxIdleTime  string
+		// connectRetries is how many more times we try to connect to the database at startup if
+		// the first attempt fails, and connectTimeout is how long each attempt can take. This
+		// gives the database time to start when they're started together, such as by
+		// docker-compose.
+		connectRetries int
+		connectTimeout time.Duration
 	}
 	// Add a new limiter struct containing fields for the request-per-second and burst
 	// values, and a boolean field which we can use to enable/disable rate limiting.
@@ -46,6 +132,211 @@ type config struct {
 		rps     float64
 		burst   int
 		enabled bool
+		// store is where the rate limiters keep their state (memory|redis). The redis store
+		// shares the limits between all of the replicas of the API, and falls back to the
+		// memory store while Redis is unavailable.
+		store string
+		// key is what the default limit is keyed by (ip|user). In user mode, userRPS and
+		// userBurst are the limits for authenticated users, and rps and burst only apply to
+		// anonymous clients.
+		key       string
+		userRPS   float64
+		userBurst int
+		// authRPS and authBurst are the stricter limits shared by the routes in the
+		// rateLimitAuth class, such as the authentication token endpoint.
+		authRPS   float64
+		authBurst int
+		// emailInterval and emailBurst are the limits on the emails sent to each address by
+		// the endpoints which send emails on request, independent of the client's IP address.
+		// Their buckets are deleted from the database once every emailPurgeInterval, once
+		// they've filled up again.
+		emailInterval      time.Duration
+		emailBurst         int
+		emailPurgeInterval time.Duration
+		// trustedProxies are the networks of the proxies in front of the API. The limiters
+		// only believe the X-Forwarded-For and X-Real-IP headers on requests from them, and
+		// key every other request by its remote address.
+		trustedProxies []*net.IPNet
+	}
+	// usage holds the settings for usage metering. Usage is aggregated in memory and written to
+	// the database once every flush interval.
+	usage struct {
+		enabled       bool
+		flushInterval time.Duration
+	}
+	// savedSearches holds how often saved searches with notifications enabled are checked for
+	// new matching movies.
+	savedSearches struct {
+		notifyInterval time.Duration
+	}
+	// releases holds how often to check for released movies whose subscribers haven't been
+	// notified yet, when this instance hasn't written a movie event in the meantime (see
+	// watchMovieReleases()).
+	releases struct {
+		notifyInterval time.Duration
+	}
+	// announcements holds how often to check for announcements which have started and still
+	// have subscribers to email.
+	announcements struct {
+		emailInterval time.Duration
+	}
+	// outbox holds how often the outbox workers check for messages to deliver.
+	outbox struct {
+		pollInterval time.Duration
+	}
+	// exports holds how often to check for scheduled exports which are due to be sent.
+	exports struct {
+		checkInterval time.Duration
+	}
+	// accounts holds how long a deleted account can be restored for before it's purged, and how
+	// often to check for accounts to purge.
+	accounts struct {
+		deletionGracePeriod time.Duration
+		purgeInterval       time.Duration
+	}
+	// trash holds how long a deleted movie stays in the trash, where it can be restored, before
+	// it's purged, and how often to check for movies to purge.
+	trash struct {
+		retention     time.Duration
+		purgeInterval time.Duration
+	}
+	// digest holds how often to check for weekly digests which are due, the URL of the
+	// unsubscribe endpoint that digests link to, and the secret used to sign the links' tokens.
+	digest struct {
+		interval          time.Duration
+		unsubscribeURL    string
+		unsubscribeSecret string
+	}
+	// openapi holds whether requests are validated against the OpenAPI schemas of their routes
+	// before the handlers run.
+	openapi struct {
+		validate bool
+	}
+	// status holds how often the API processes write a heartbeat, which the uptime on the status
+	// page is worked out from.
+	status struct {
+		heartbeatInterval time.Duration
+	}
+	// webhooks holds how often the webhook workers check for deliveries to send, how long to wait
+	// for a webhook to respond, how long to keep the log of sent deliveries, how often to purge
+	// it, and whether webhooks may point at private addresses.
+	webhooks struct {
+		pollInterval  time.Duration
+		timeout       time.Duration
+		retention     time.Duration
+		purgeInterval time.Duration
+		allowPrivate  bool
+	}
+	// tasks holds the number of task workers to run, and how often idle workers check the queue
+	// for new tasks (such as reports to generate).
+	tasks struct {
+		workers      int
+		pollInterval time.Duration
+	}
+	// cache holds the max-age used in the Cache-Control header for the catalog routes, which
+	// clients can cache privately.
+	cache struct {
+		catalogMaxAge time.Duration
+	}
+	// compression holds the settings for gzip compression of responses. Only responses of at
+	// least minSize bytes are compressed, at the given gzip level, and compression is skipped
+	// while the average scheduling latency is above maxSchedLatency (0 = never skip).
+	compression struct {
+		enabled         bool
+		minSize         int
+		level           int
+		maxSchedLatency time.Duration
+	}
+	// search holds the settings for the public search endpoint: its per-IP rate limit and daily
+	// quota (0 = unlimited), how long results are kept in the in-memory result cache and how
+	// many of them, the max-age of its Cache-Control header, and the words which mark a
+	// User-Agent as a bot.
+	search struct {
+		rps           float64
+		burst         int
+		dailyQuota    int
+		cacheTTL      time.Duration
+		cacheSize     int
+		maxAge        time.Duration
+		blockedAgents []string
+	}
+	// stats holds how often the materialized views behind the stats endpoints are refreshed,
+	// and how often buffered movie view counts and recently viewed movies are written to the
+	// database.
+	stats struct {
+		refreshInterval    time.Duration
+		viewsFlushInterval time.Duration
+	}
+	// tableGrowth holds how often the watched tables are measured, and their soft limits on
+	// rows and size in megabytes (see checkTableGrowth()).
+	tableGrowth struct {
+		interval  time.Duration
+		maxRows   tableLimits
+		maxSizeMB tableLimits
+	}
+	// shedding holds the settings for load shedding. The database is probed once every
+	// checkInterval, and low priority requests are shed while the average latency of the last
+	// window probes is above dbLatency, or the fraction of them which failed is above errorRate.
+	shedding struct {
+		enabled       bool
+		checkInterval time.Duration
+		window        int
+		dbLatency     time.Duration
+		errorRate     float64
+	}
+	// leader holds whether leader election is used to pick the single instance which runs the
+	// singleton scheduled jobs, and how often instances try to become (or stay) the leader.
+	leader struct {
+		enabled       bool
+		checkInterval time.Duration
+	}
+	// shutdown holds how long streaming connections are given to finish during a graceful
+	// shutdown, after they've been told that the server is closing.
+	shutdown struct {
+		streamGrace time.Duration
+	}
+	// backup holds the number of database backups to keep in object storage (0 keeps them all).
+	backup struct {
+		retention int
+	}
+	// storage holds the settings for object storage, where files such as rendered reports are
+	// kept. The driver is local, s3 or gcs: the local driver keeps objects in dir and serves its
+	// signed URLs under baseURL, signing them with urlSecret, and the bucket drivers use the
+	// bucket, endpoint, region and keys. Signed URLs are valid for signedURLExpiry, and objects
+	// which nothing refers to any more are deleted once every cleanupInterval, once they're older
+	// than orphanAge.
+	storage struct {
+		driver          string
+		dir             string
+		baseURL         string
+		urlSecret       string
+		bucket          string
+		endpoint        string
+		region          string
+		accessKey       string
+		secretKey       string
+		insecure        bool
+		signedURLExpiry time.Duration
+		cleanupInterval time.Duration
+		orphanAge       time.Duration
+	}
+	// posters holds the largest poster image which can be uploaded, in megabytes.
+	posters struct {
+		maxSizeMB int
+	}
+	// movieLimits holds the limits that movies are validated against, such as the earliest
+	// release year allowed.
+	movieLimits data.MovieLimits
+	// cursor holds the secret used to sign opaque pagination cursors, so that clients can't
+	// tamper with them.
+	cursor struct {
+		secret string
+	}
+	// quota holds the daily and monthly request quotas for each authenticated user. A value of
+	// 0 means that there is no quota for that period.
+	quota struct {
+		daily   int64
+		monthly int64
 	}
 	smtp struct {
 		host     string
@@ -54,19 +345,66 @@ type config struct {
 		password string
 		sender   string
 	}
+	// responseEnvelope holds the name of the envelopeEncoder used to structure JSON responses.
+	responseEnvelope string
+	// health holds the thresholds used by the healthcheck endpoint to decide whether a
+	// dependency is degraded or unhealthy.
+	health struct {
+		dbTimeout               time.Duration
+		dbDegradedLatency       time.Duration
+		backgroundDegradedTasks int
+	}
+	// accessDenied is how requests which the caller isn't allowed to make are answered
+	// (forbidden|not_found).
+	accessDenied string
+	// schemaCheck is how the application reacts to a database schema which doesn't match the
+	// migrations it was built with (strict|warn|off).
+	schemaCheck string
+	// settingsRefreshInterval is how often the runtime settings are reloaded from the database,
+	// to pick up changes made through other instances of the application.
+	settingsRefreshInterval time.Duration
+	// reviews holds the moderation settings for reviews. If autoApprove is false then every
+	// review waits for a moderator, and reviews containing any of the blockedWords always do.
+	reviews struct {
+		autoApprove  bool
+		blockedWords []string
+	}
 	cors struct {
-		trustedOrigins []string
+		trustedOrigins    []string
+		publicOrigins     []string
+		firstPartyOrigins []string
 	}
 }
 
 // Define an application struct to hold dependencies for our HTTP handlers, helpers, and
 // middleware.
 type application struct {
-	config config
-	logger *jsonlog.Logger
-	models data.Models
-	mailer mailer.Mailer
-	wg     sync.WaitGroup
+	config          config
+	logger          *jsonlog.Logger
+	clock           clock.Clock
+	models          data.Models
+	redis           *redis.Client
+	redisStatus     *redisStatus
+	mailer          mailer.Mailer
+	envelope        envelopeEncoder
+	healthChecks    []healthCheck
+	reviewFilters   []reviewFilter
+	botDetectors    []botDetector
+	searchCache     *searchCache
+	cpu             *cpuMonitor
+	settings        *runtimeSettings
+	usage           *usageMeter
+	views           *viewCounter
+	streams         *streamTracker
+	hub             *notificationHub
+	shedder         *loadShedder
+	storage         storage.Store
+	webhookClient   *http.Client
+	statsRefresh    sync.Mutex
+	leaderLock      *data.LeaderLock
+	leading         int32
+	wg              sync.WaitGroup
+	backgroundTasks int64
 }
 
 func main() {
@@ -75,9 +413,26 @@ func main() {
 
 	// Read the value of the port and env command-line flags into the config struct.
 	// We default to using the port number 4000 and the environment "development" if no
-	// corresponding flags are provided.
+	// corresponding flags are provided. The development profile turns on verbose errors and
+	// opens CORS to any origin, so production deployments must pass -env=production.
 	flag.IntVar(&cfg.port, "port", 4000, "API server port")
-	flag.StringVar(&cfg.env, "env", "development", "Environment (development|staging|production")
+	flag.StringVar(&cfg.env, "env", envDevelopment,
+		"Environment (development|staging|production), which picks the profile of default settings")
+	flag.StringVar(&cfg.mode, "mode", modeAll, "Process mode (api|worker|all)")
+
+	// Read the admin listener address from the command-line flags, e.g. "localhost:4001".
+	flag.StringVar(&cfg.admin.addr, "admin-addr", "", "Admin listener address (disabled if empty)")
+
+	// Read the tracing settings from the command-line flags.
+	flag.StringVar(&cfg.tracing.endpoint, "tracing-endpoint", "", "OTLP/HTTP trace collector URL (disabled if empty)")
+	flag.Float64Var(&cfg.tracing.sampleRatio, "tracing-sample-ratio", 1, "Fraction of traces to sample (0-1)")
+
+	// Read the HTTP server timeouts from the command-line flags.
+	flag.DurationVar(&cfg.server.idleTimeout, "server-idle-timeout", time.Minute, "HTTP server idle timeout")
+	flag.DurationVar(&cfg.server.readTimeout, "server-read-timeout", 10*time.Second, "HTTP server read timeout")
+	flag.DurationVar(&cfg.server.readHeaderTimeout, "server-read-header-timeout", 5*time.Second,
+		"HTTP server read header timeout")
+	flag.DurationVar(&cfg.server.writeTimeout, "server-write-timeout", 30*time.Second, "HTTP server write timeout")
 
 	// Read the DSN Value from the db-dsn command-line flag into the config struct.
 	// We default to using our development DSN if no flag is provided.
@@ -94,12 +449,81 @@ func main() {
 		"PostgreSQL max open idle connections")
 	flag.StringVar(&cfg.db.maxIdleTime, "db-max-idle-time", "15m",
 		"PostgreSQL max connection idle time")
+	flag.IntVar(&cfg.db.connectRetries, "db-connect-retries", 5,
+		"PostgreSQL connection retries at startup")
+	flag.DurationVar(&cfg.db.connectTimeout, "db-connect-timeout", 5*time.Second,
+		"PostgreSQL connection timeout for each attempt")
 
 	// Read the limiter settings from the command-line flags into the config struct.
 	// We use true as the default for 'enabled' setting.
 	flag.Float64Var(&cfg.limiter.rps, "limiter-rps", 2, "Rate limiter maximum requests per second")
 	flag.IntVar(&cfg.limiter.burst, "limiter-burst", 4, "Rate limiter maximum burst")
 	flag.BoolVar(&cfg.limiter.enabled, "limiter-enabled", true, "Enable rate limiter")
+	flag.StringVar(&cfg.limiter.store, "limiter-store", limiterStoreMemory,
+		"Rate limiter store (memory|redis); redis shares the limits between replicas and needs -redis-url")
+	flag.StringVar(&cfg.limiter.key, "limiter-key", limiterKeyIP,
+		"Rate limiter key for authenticated requests (ip|user); anonymous requests are always limited by IP")
+	flag.Float64Var(&cfg.limiter.userRPS, "limiter-user-rps", 10,
+		"Rate limiter maximum requests per second for each authenticated user, when keyed by user")
+	flag.IntVar(&cfg.limiter.userBurst, "limiter-user-burst", 20,
+		"Rate limiter maximum burst for each authenticated user, when keyed by user")
+	flag.Float64Var(&cfg.limiter.authRPS, "limiter-auth-rps", 0.2,
+		"Rate limiter maximum requests per second for authentication endpoints")
+	flag.IntVar(&cfg.limiter.authBurst, "limiter-auth-burst", 5, "Rate limiter maximum burst for authentication endpoints")
+	flag.DurationVar(&cfg.limiter.emailInterval, "limiter-email-interval", 20*time.Minute,
+		"Rate limiter interval between emails sent to the same address")
+	flag.IntVar(&cfg.limiter.emailBurst, "limiter-email-burst", 3, "Rate limiter maximum burst of emails sent to the same address")
+	flag.DurationVar(&cfg.limiter.emailPurgeInterval, "limiter-email-purge-interval", time.Hour,
+		"Interval between purges of the email rate limits which have filled up again")
+	flag.Func("limiter-trusted-proxies",
+		"Proxies whose X-Forwarded-For header is trusted by the rate limiters (space separated IP addresses or CIDRs)",
+		func(val string) error {
+			proxies, err := parseNetworks(strings.Fields(val))
+			if err != nil {
+				return err
+			}
+			cfg.limiter.trustedProxies = proxies
+			return nil
+		})
+
+	flag.StringVar(&cfg.redis.url, "redis-url", "", "Redis URL (redis://[user:password@]host:port/db)")
+
+	// Read the authentication mode and JWT settings from the command-line flags.
+	flag.StringVar(&cfg.auth.mode, "auth-mode", authModeToken, "Authentication token mode (token|jwt)")
+	flag.StringVar(&cfg.jwt.secret, "jwt-secret", "", "Secret used to sign JWT authentication tokens")
+	flag.StringVar(&cfg.jwt.issuer, "jwt-issuer", "greenlight", "Issuer claim of JWT authentication tokens")
+	flag.StringVar(&cfg.jwt.audience, "jwt-audience", "greenlight", "Audience claim of JWT authentication tokens")
+
+	// Read the token lifetimes from the command-line flags.
+	flag.DurationVar(&cfg.tokens.accessTTL, "token-access-ttl", 24*time.Hour, "Lifetime of authentication tokens")
+	flag.DurationVar(&cfg.tokens.refreshTTL, "token-refresh-ttl", 30*24*time.Hour, "Lifetime of refresh tokens")
+	flag.DurationVar(&cfg.tokens.passwordResetTTL, "token-password-reset-ttl", 45*time.Minute,
+		"Lifetime of password reset tokens")
+	flag.DurationVar(&cfg.signing.maxSkew, "signature-max-skew", 5*time.Minute,
+		"Maximum difference between the timestamp of a signed request and the server's clock")
+	flag.StringVar(&cfg.signing.secret, "signature-secret", "", "Secret which API key secrets are derived from")
+
+	// Read the request quota settings from the command-line flags.
+	flag.Int64Var(&cfg.quota.daily, "quota-daily", 0, "Daily request quota per user (0 = unlimited)")
+	flag.Int64Var(&cfg.quota.monthly, "quota-monthly", 0, "Monthly request quota per user (0 = unlimited)")
+
+	// Read the movie validation limits from the command-line flags.
+	flag.IntVar(&cfg.movieLimits.MaxTitleBytes, "movie-max-title-bytes", data.DefaultMovieLimits.MaxTitleBytes,
+		"Maximum length of a movie title in bytes")
+	flag.IntVar(&cfg.movieLimits.MaxGenres, "movie-max-genres", data.DefaultMovieLimits.MaxGenres,
+		"Maximum number of genres for a movie")
+	flag.IntVar(&cfg.movieLimits.EarliestYear, "movie-earliest-year", data.DefaultMovieLimits.EarliestYear,
+		"Earliest release year allowed for a movie")
+
+	// Read the pagination cursor signing secret. In development, if it isn't provided then a
+	// random secret is generated at startup, which means that cursors stop working when the
+	// application restarts (and aren't shared between instances). Elsewhere it's required.
+	flag.StringVar(&cfg.cursor.secret, "cursor-secret", "", "Secret used to sign pagination cursors")
+
+	// Read the usage metering settings from the command-line flags.
+	flag.BoolVar(&cfg.usage.enabled, "usage-enabled", true, "Enable usage metering")
+	flag.DurationVar(&cfg.usage.flushInterval, "usage-flush-interval", time.Minute,
+		"How often to write metered usage to the database")
 
 	// Read the SMTP server configuration settings into the config struct, using the
 	// Mailtrap settings as teh default values.
@@ -111,6 +535,14 @@ func main() {
 	flag.StringVar(&cfg.smtp.password, "smtp-password", mtPw, "SMTP password")
 	flag.StringVar(&cfg.smtp.sender, "smtp-sender", "DoNotReply <3fc3f54366-09689f+1@inbox.mailtrap.io>", "SMTP sender")
 
+	// Read the review moderation settings from the command-line flags.
+	flag.BoolVar(&cfg.reviews.autoApprove, "reviews-auto-approve", true,
+		"Publish reviews without waiting for a moderator")
+	flag.Func("reviews-blocked-words", "Words which hold reviews for a moderator (space separated)", func(val string) error {
+		cfg.reviews.blockedWords = strings.Fields(val)
+		return nil
+	})
+
 	// Use flag.Func function to process the -cors-trusted-origins command line flag. In this we
 	// use the strings.Field function to split the flag value into slice based on whitespace
 	// characters and assign it to our config struct. Importantly, if the -cors-trusted-origins
@@ -121,10 +553,264 @@ func main() {
 		return nil
 	})
 
+	// The public read endpoints are open to any origin unless the -cors-public-origins flag says
+	// otherwise. The first-party origins are used for the token endpoints, and fall back to the
+	// trusted origins if the -cors-first-party-origins flag isn't provided.
+	cfg.cors.publicOrigins = []string{"*"}
+	flag.Func("cors-public-origins", "Origins allowed to call public read endpoints (space separated)", func(val string) error {
+		cfg.cors.publicOrigins = strings.Fields(val)
+		return nil
+	})
+
+	firstPartyOriginsSet := false
+	flag.Func("cors-first-party-origins", "First-party web app origins allowed to call token endpoints (space separated)", func(val string) error {
+		cfg.cors.firstPartyOrigins = strings.Fields(val)
+		firstPartyOriginsSet = true
+		return nil
+	})
+
+	// Read the healthcheck thresholds from the command-line flags.
+	flag.DurationVar(&cfg.health.dbTimeout, "health-db-timeout", time.Second,
+		"Healthcheck timeout after which the database is unhealthy")
+	flag.DurationVar(&cfg.health.dbDegradedLatency, "health-db-degraded-latency", 100*time.Millisecond,
+		"Healthcheck database latency above which it is degraded")
+	flag.IntVar(&cfg.health.backgroundDegradedTasks, "health-background-degraded-tasks", 100,
+		"Healthcheck number of in-flight background tasks above which they are degraded")
+
+	// Read the load shedding settings from the command-line flags.
+	flag.BoolVar(&cfg.shedding.enabled, "shed-enabled", true, "Shed low priority requests while the database is struggling")
+	flag.DurationVar(&cfg.shedding.checkInterval, "shed-check-interval", 5*time.Second,
+		"How often to probe the database for load shedding")
+	flag.IntVar(&cfg.shedding.window, "shed-window", 12, "Number of recent database probes that load shedding considers")
+	flag.DurationVar(&cfg.shedding.dbLatency, "shed-db-latency", 500*time.Millisecond,
+		"Average database latency above which low priority requests are shed")
+	flag.Float64Var(&cfg.shedding.errorRate, "shed-error-rate", 0.5,
+		"Fraction of failed database probes above which low priority requests are shed (0-1)")
+
+	flag.DurationVar(&cfg.settingsRefreshInterval, "settings-refresh-interval", 30*time.Second,
+		"How often to reload runtime settings from the database")
+
+	flag.StringVar(&cfg.responseEnvelope, "response-envelope", "default", "JSON response envelope (default|data|flat)")
+
+	flag.DurationVar(&cfg.savedSearches.notifyInterval, "saved-search-notify-interval", time.Hour,
+		"How often to check saved searches for newly added matching movies")
+
+	flag.DurationVar(&cfg.releases.notifyInterval, "release-notify-interval", 5*time.Minute,
+		"How often to check for movie events from other instances, and release dates arriving, to notify subscribers")
+
+	flag.DurationVar(&cfg.announcements.emailInterval, "announcement-email-interval", time.Minute,
+		"How often to check for announcements which have started and still need emailing to subscribers")
+
+	flag.DurationVar(&cfg.outbox.pollInterval, "outbox-poll-interval", 5*time.Second,
+		"How often to check the outbox for emails to deliver")
+
+	flag.DurationVar(&cfg.exports.checkInterval, "export-check-interval", 5*time.Minute,
+		"How often to check for scheduled exports which are due")
+
+	flag.DurationVar(&cfg.accounts.deletionGracePeriod, "account-deletion-grace-period", 30*24*time.Hour,
+		"How long a deleted account can be restored before it is purged")
+	flag.DurationVar(&cfg.accounts.purgeInterval, "account-purge-interval", time.Hour,
+		"How often to purge deleted accounts whose grace period has passed")
+
+	flag.DurationVar(&cfg.trash.retention, "movie-trash-retention", 30*24*time.Hour,
+		"How long a deleted movie can be restored from the trash before it is purged")
+	flag.DurationVar(&cfg.trash.purgeInterval, "movie-trash-purge-interval", time.Hour,
+		"How often to purge the movies whose trash retention period has passed")
+
+	// Read the weekly digest settings. As with the cursor secret, the unsubscribe secret is
+	// required outside development, and in development a random one is generated at startup if
+	// it isn't provided, which means that the unsubscribe links in digests sent before a restart
+	// stop working.
+	flag.DurationVar(&cfg.digest.interval, "digest-interval", time.Hour,
+		"How often to check for weekly digest emails which are due")
+	flag.StringVar(&cfg.digest.unsubscribeURL, "digest-unsubscribe-url", "",
+		"URL of the digest unsubscribe endpoint, used in digest emails (default: this API)")
+	flag.StringVar(&cfg.digest.unsubscribeSecret, "digest-unsubscribe-secret", "",
+		"Secret used to sign digest unsubscribe links")
+
+	// Read the debugging and security header settings. Both are set by the environment's profile
+	// unless they're given explicitly.
+	flag.BoolVar(&cfg.errors.verbose, "errors-verbose", false,
+		"Include the error and a stack trace in the responses to unexpected errors (for development only)")
+	flag.BoolVar(&cfg.headers.strict, "strict-headers", false,
+		"Send strict security headers (HSTS, CSP, X-Frame-Options and so on) with every response")
+
+	flag.BoolVar(&cfg.openapi.validate, "openapi-validate", false,
+		"Validate request parameters and bodies against the OpenAPI document before the handlers run")
+
+	// Read the status page settings. The heartbeat interval must be at most a minute, so that
+	// every minute which the API is up for has a heartbeat.
+	flag.DurationVar(&cfg.status.heartbeatInterval, "status-heartbeat-interval", 20*time.Second,
+		"How often API processes record a heartbeat for the status page uptime")
+
+	flag.DurationVar(&cfg.webhooks.pollInterval, "webhook-poll-interval", 5*time.Second,
+		"How often to check for webhook deliveries to send")
+	flag.DurationVar(&cfg.webhooks.timeout, "webhook-timeout", 10*time.Second,
+		"How long to wait for a webhook to respond before the delivery attempt fails")
+	flag.DurationVar(&cfg.webhooks.retention, "webhook-delivery-retention", 30*24*time.Hour,
+		"How long to keep sent and failed webhook deliveries in the delivery log")
+	flag.DurationVar(&cfg.webhooks.purgeInterval, "webhook-purge-interval", time.Hour,
+		"How often to purge the webhook deliveries whose retention period has passed")
+	flag.BoolVar(&cfg.webhooks.allowPrivate, "webhook-allow-private", false,
+		"Allow webhooks to point at private, loopback and internal addresses")
+
+	flag.IntVar(&cfg.tasks.workers, "task-workers", 2, "Number of task workers")
+	flag.DurationVar(&cfg.tasks.pollInterval, "task-poll-interval", 5*time.Second,
+		"How often idle task workers check for queued tasks")
+
+	flag.DurationVar(&cfg.stats.refreshInterval, "stats-refresh-interval", 10*time.Minute,
+		"How often to refresh the materialized views behind the stats endpoints")
+	flag.DurationVar(&cfg.stats.viewsFlushInterval, "stats-views-flush-interval", time.Minute,
+		"How often to write counted movie views and recently viewed movies to the database")
+
+	// Read the table growth settings from the command-line flags. The limits are soft limits,
+	// which are only warned about, on the tables which a broken retention job would let grow.
+	flag.DurationVar(&cfg.tableGrowth.interval, "table-growth-interval", 15*time.Minute,
+		"How often to measure the tables with a soft limit")
+	cfg.tableGrowth.maxRows = tableLimits{"tokens": 1_000_000, "events": 10_000_000, "outbox": 100_000, "tasks": 100_000,
+		"audit_log": 10_000_000, "webhook_deliveries": 1_000_000}
+	flag.Var(&cfg.tableGrowth.maxRows, "table-growth-max-rows",
+		"Soft limits on the rows in each table, warned about when exceeded (space separated table=rows, 0 = no limit)")
+	cfg.tableGrowth.maxSizeMB = tableLimits{"events": 10_240}
+	flag.Var(&cfg.tableGrowth.maxSizeMB, "table-growth-max-size-mb",
+		"Soft limits on the size of each table in MB, warned about when exceeded (space separated table=MB, 0 = no limit)")
+
+	flag.DurationVar(&cfg.cache.catalogMaxAge, "cache-catalog-max-age", time.Minute,
+		"How long clients can cache catalog responses for (they're never cached by shared caches)")
+
+	// Read the response compression settings from the command-line flags.
+	flag.BoolVar(&cfg.compression.enabled, "compression-enabled", true, "Compress responses with gzip")
+	flag.IntVar(&cfg.compression.minSize, "compression-min-size", 1024,
+		"Minimum size in bytes of the responses which are compressed")
+	flag.IntVar(&cfg.compression.level, "compression-level", gzip.DefaultCompression,
+		"Gzip compression level (1-9, or -1 for the default)")
+	flag.DurationVar(&cfg.compression.maxSchedLatency, "compression-max-sched-latency", 10*time.Millisecond,
+		"Skip compression while goroutines wait longer than this on average to be scheduled (0 = never skip)")
+
+	// Read the public search settings from the command-line flags.
+	flag.Float64Var(&cfg.search.rps, "search-rps", 0.5, "Rate limiter maximum requests per second for public search")
+	flag.IntVar(&cfg.search.burst, "search-burst", 5, "Rate limiter maximum burst for public search")
+	flag.IntVar(&cfg.search.dailyQuota, "search-daily-quota", 1000,
+		"Daily public search quota per IP address (0 = unlimited)")
+	flag.DurationVar(&cfg.search.cacheTTL, "search-cache-ttl", 5*time.Minute,
+		"How long public search results are kept in the in-memory result cache")
+	flag.IntVar(&cfg.search.cacheSize, "search-cache-size", 10000,
+		"Maximum number of pages of public search results in the in-memory result cache")
+	flag.DurationVar(&cfg.search.maxAge, "search-max-age", 10*time.Minute,
+		"How long public search responses can be cached for")
+	flag.Func("search-blocked-agents", "Words which mark a User-Agent as a bot on public search (space separated)",
+		func(val string) error {
+			cfg.search.blockedAgents = strings.Fields(val)
+			return nil
+		})
+
+	flag.DurationVar(&cfg.shutdown.streamGrace, "shutdown-stream-grace", 10*time.Second,
+		"How long streaming connections are given to finish during a graceful shutdown")
+
+	flag.BoolVar(&cfg.leader.enabled, "leader-election-enabled", true,
+		"Elect a single leader to run the singleton scheduled jobs")
+	flag.DurationVar(&cfg.leader.checkInterval, "leader-check-interval", 15*time.Second,
+		"How often to try to become, or check that we are still, the leader")
+
+	flag.StringVar(&cfg.accessDenied, "access-denied", accessDeniedForbidden,
+		"How to answer requests which the caller doesn't have permission for (forbidden|not_found)")
+
+	flag.StringVar(&cfg.schemaCheck, "schema-check", schemaCheckStrict,
+		"Database schema version check at startup (strict|warn|off)")
+
+	// Backups used to be written to -backup-dir, but are now kept in object storage. The flag is
+	// still accepted, so that existing deployments keep starting, but it's ignored.
+	flag.String("backup-dir", "", "Deprecated and ignored: database backups are kept in object storage under backups/")
+	flag.IntVar(&cfg.backup.retention, "backup-retention", 7, "Number of database backups to keep (0 = all)")
+
+	// Read the object storage settings from the command-line flags.
+	flag.StringVar(&cfg.storage.driver, "storage-driver", "local", "Object storage driver (local|s3|gcs)")
+	flag.StringVar(&cfg.storage.dir, "storage-dir", "./storage", "Directory for the local storage driver")
+	flag.StringVar(&cfg.storage.baseURL, "storage-base-url", "",
+		"Base URL of local storage signed URLs (defaults to http://localhost:<port>/v1/storage)")
+	flag.StringVar(&cfg.storage.urlSecret, "storage-url-secret", "", "Secret used to sign local storage URLs")
+	flag.StringVar(&cfg.storage.bucket, "storage-bucket", "", "Bucket for the s3 and gcs storage drivers")
+	flag.StringVar(&cfg.storage.endpoint, "storage-endpoint", "s3.amazonaws.com", "Endpoint for the s3 storage driver")
+	flag.StringVar(&cfg.storage.region, "storage-region", "", "Region for the s3 storage driver")
+	flag.StringVar(&cfg.storage.accessKey, "storage-access-key", "",
+		"Access key (or GCS HMAC key) for the s3 and gcs storage drivers")
+	flag.StringVar(&cfg.storage.secretKey, "storage-secret-key", "",
+		"Secret key (or GCS HMAC secret) for the s3 and gcs storage drivers")
+	flag.BoolVar(&cfg.storage.insecure, "storage-insecure", false, "Use plain HTTP for the s3 storage driver endpoint")
+	flag.DurationVar(&cfg.storage.signedURLExpiry, "storage-signed-url-expiry", 15*time.Minute,
+		"How long signed storage URLs are valid for")
+	flag.DurationVar(&cfg.storage.cleanupInterval, "storage-cleanup-interval", time.Hour,
+		"How often to delete orphaned storage objects")
+	flag.DurationVar(&cfg.storage.orphanAge, "storage-orphan-age", 24*time.Hour,
+		"How old an orphaned storage object must be before it's deleted")
+	flag.IntVar(&cfg.posters.maxSizeMB, "poster-max-size-mb", 5, "Largest poster image which can be uploaded, in megabytes")
+
 	displayVersion := flag.Bool("version", false, "Display version and exit")
 
+	selfCheck := flag.Bool("check", false,
+		"Run the startup self-checks, print a JSON report and exit (non-zero if any check fails)")
+
+	// Accept the old names of the settings which have been renamed.
+	aliasDeprecatedFlags(flag.CommandLine)
+
+	configFile := flag.String("config", "", "Path to a YAML or TOML config file, whose keys are the flag names")
+
 	flag.Parse()
 
+	// Settings are read in the following order of precedence, highest first:
+	//
+	//  1. Command-line flags.
+	//  2. Environment variables, such as GREENLIGHT_PORT or GREENLIGHT_DB_DSN.
+	//  3. The config file given by the -config flag (or GREENLIGHT_CONFIG), if any.
+	//  4. The profile of the environment given by the -env flag (see envProfiles).
+	//  5. The defaults above.
+	//
+	// Environment variables and config files make running the API in a container much easier.
+	// The config file is applied first, so that the environment overrides it. As with an invalid
+	// flag, an invalid value is reported along with the usage message.
+	//
+	// Where each setting came from is recorded, so that validateConfig() can point at the flag,
+	// environment variable or config file key behind any problem it finds.
+	sources := configSources{}
+	flag.Visit(func(f *flag.Flag) {
+		sources[f.Name] = "from the command line"
+	})
+
+	if *configFile == "" {
+		*configFile = os.Getenv(envName("config"))
+	}
+
+	// The config file and the environment are both read before any problems are reported, so
+	// that the mistakes in each of them can be fixed in one go.
+	var configErr error
+
+	if *configFile != "" {
+		configErr = applyConfigFile(flag.CommandLine, *configFile, sources)
+	}
+
+	err := applyEnv(flag.CommandLine, os.LookupEnv, sources)
+	if err != nil || configErr != nil {
+		for _, e := range []error{configErr, err} {
+			if e != nil {
+				fmt.Fprintln(flag.CommandLine.Output(), e)
+			}
+		}
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	// Fill in the settings which weren't given any of the ways above from the environment's
+	// profile, so that -env changes how the application behaves rather than being a label.
+	err = applyProfile(flag.CommandLine, cfg.env, sources)
+	if err != nil {
+		fmt.Fprintln(flag.CommandLine.Output(), err)
+		os.Exit(2)
+	}
+
+	if !firstPartyOriginsSet {
+		cfg.cors.firstPartyOrigins = cfg.cors.trustedOrigins
+	}
+
 	// If the version flag value is true, then print out the version number and immediately exit.
 	if *displayVersion {
 		fmt.Printf("Version:\t%s\n", version)
@@ -135,10 +821,133 @@ func main() {
 	// severity level to the standard out stream.
 	logger := jsonlog.NewLogger(os.Stdout, jsonlog.LevelInfo)
 
+	for _, name := range usedDeprecatedFlags(sources) {
+		logger.PrintInfo("the "+name+" setting is deprecated, use "+deprecatedFlags[name]+" instead",
+			map[string]string{"source": sources[name]})
+	}
+
+	if source, ok := sources["backup-dir"]; ok {
+		logger.PrintInfo("the backup-dir setting is deprecated and ignored, backups are kept in object storage",
+			map[string]string{"source": source})
+	}
+
+	// If a subcommand was given after the flags, run it instead of starting the server.
+	if flag.NArg() > 0 {
+		err := runCommand(cfg, logger, flag.Args())
+		if err != nil {
+			logger.PrintFatal(err, nil)
+		}
+		os.Exit(0)
+	}
+
+	// Check the settings before connecting to anything, so that a mistake fails fast. Every
+	// problem is reported at once, rather than one per restart. The signing secrets are checked
+	// before the random ones below are generated, which validateConfig() only allows in
+	// development.
+	err = validateConfig(cfg, sources)
+	if err != nil {
+		logger.PrintFatal(err, nil)
+	}
+
+	if cfg.cursor.secret == "" {
+		secret := make([]byte, 32)
+
+		_, err := rand.Read(secret)
+		if err != nil {
+			logger.PrintFatal(err, nil)
+		}
+
+		cfg.cursor.secret = hex.EncodeToString(secret)
+		logger.PrintInfo("no cursor secret provided, using a random one", nil)
+	}
+
+	// API key secrets are derived from the signature secret, so with a random one every API key
+	// stops working when the application restarts.
+	if cfg.signing.secret == "" {
+		secret := make([]byte, 32)
+
+		_, err := rand.Read(secret)
+		if err != nil {
+			logger.PrintFatal(err, nil)
+		}
+
+		cfg.signing.secret = hex.EncodeToString(secret)
+		logger.PrintInfo("no signature secret provided, using a random one", nil)
+	}
+
+	if cfg.digest.unsubscribeURL == "" {
+		cfg.digest.unsubscribeURL = fmt.Sprintf("http://localhost:%d/v1/digest/unsubscribe", cfg.port)
+	}
+
+	if cfg.digest.unsubscribeSecret == "" {
+		secret := make([]byte, 32)
+
+		_, err := rand.Read(secret)
+		if err != nil {
+			logger.PrintFatal(err, nil)
+		}
+
+		cfg.digest.unsubscribeSecret = hex.EncodeToString(secret)
+		logger.PrintInfo("no digest unsubscribe secret provided, using a random one", nil)
+	}
+
+	// Local storage signed URLs are served by this API, so they point at it by default. As with
+	// the cursor secret, a random signing secret only works for a single instance.
+	if cfg.storage.baseURL == "" {
+		cfg.storage.baseURL = fmt.Sprintf("http://localhost:%d/v1/storage", cfg.port)
+	}
+
+	if cfg.storage.driver == "local" && cfg.storage.urlSecret == "" {
+		secret := make([]byte, 32)
+
+		_, err := rand.Read(secret)
+		if err != nil {
+			logger.PrintFatal(err, nil)
+		}
+
+		cfg.storage.urlSecret = hex.EncodeToString(secret)
+		logger.PrintInfo("no storage URL secret provided, using a random one", nil)
+	}
+
+	// Verbose errors can be turned on in production, to track down a problem, but they should
+	// never be left on by mistake.
+	if cfg.env == envProduction && cfg.errors.verbose {
+		logger.PrintInfo("verbose errors are enabled in production, so stack traces are sent to clients",
+			map[string]string{"source": sources.describe("errors-verbose")})
+	}
+
+	// With the -check flag, only run the self-checks (see selfChecker) and report the result.
+	if *selfCheck {
+		os.Exit(runSelfCheckCommand(cfg, os.Stdout))
+	}
+
+	// Look up the envelopeEncoder named by the -response-envelope flag before doing anything
+	// else, so that a typo fails fast.
+	encoder, err := newEnvelopeEncoder(cfg.responseEnvelope)
+	if err != nil {
+		logger.PrintFatal(err, nil)
+	}
+
+	// Set up tracing before opening the connection pool, so that the SQL query spans are
+	// exported too, and flush any remaining spans before exiting.
+	shutdownTracing, err := setupTracing(cfg)
+	if err != nil {
+		logger.PrintFatal(err, nil)
+	}
+
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		if err := shutdownTracing(ctx); err != nil {
+			logger.PrintError(err, nil)
+		}
+	}()
+
 	// Call the openDB() helper function (see below) to create teh connection pool,
 	// passing in the config struct. If this returns an error,
 	// we log it and exit the application immediately.
-	db, err := openDB(cfg)
+	db, err := openDB(cfg, logger)
 	if err != nil {
 		logger.PrintFatal(err, nil)
 	}
@@ -153,6 +962,12 @@ func main() {
 
 	logger.PrintInfo("database connection pool established", nil)
 
+	// Check that the migrations have been applied to the database before we go any further.
+	err = checkSchemaVersion(cfg.schemaCheck, data.SystemModel{DB: db}, logger)
+	if err != nil {
+		logger.PrintFatal(err, nil)
+	}
+
 	// Publish a new "version" varaible in the expar var handler containing our application
 	// version number.
 	expvar.NewString("version").Set(version)
@@ -167,6 +982,9 @@ func main() {
 		return db.Stats()
 	}))
 
+	// Collect the database connection pool statistics for the Prometheus metrics too.
+	prometheus.MustRegister(collectors.NewDBStatsCollector(db, "greenlight"))
+
 	// Publish the current Unix timestamp.
 	expvar.Publish("timestamp", expvar.Func(func() interface{} {
 		return time.Now().Unix()
@@ -174,10 +992,102 @@ func main() {
 
 	// Declare an instance of the application struct, containing the config struct and the infoLog.
 	app := &application{
-		config: cfg,
-		logger: logger,
-		models: data.NewModels(db),
-		mailer: mailer.New(cfg.smtp.host, cfg.smtp.port, cfg.smtp.username, cfg.smtp.password, cfg.smtp.sender),
+		config:   cfg,
+		logger:   logger,
+		clock:    clock.Real{},
+		models:   data.NewModels(db),
+		mailer:   mailer.New(cfg.smtp.host, cfg.smtp.port, cfg.smtp.username, cfg.smtp.password, cfg.smtp.sender),
+		envelope: encoder,
+		streams:  newStreamTracker(),
+	}
+
+	app.webhookClient = newWebhookClient(cfg)
+
+	// Open the object store, where files such as rendered reports and backups are kept.
+	app.storage, err = openStorage(cfg)
+	if err != nil {
+		logger.PrintFatal(err, nil)
+	}
+
+	// Report the depth of the outbox, task and webhook queues in the Prometheus metrics.
+	prometheus.MustRegister(newQueueCollector(app.models))
+
+	// Connect to Redis if it's configured. It's only needed by the features which are set up to
+	// use it, such as the redis rate limiter store, and they fall back to working without it
+	// while it's unavailable, so the application starts (degraded) even if it can't be reached.
+	if cfg.redis.url != "" {
+		app.redis, err = newRedisClient(cfg.redis.url)
+		if err != nil {
+			logger.PrintFatal(err, nil)
+		}
+
+		defer func() {
+			if err := app.redis.Close(); err != nil {
+				logger.PrintError(err, nil)
+			}
+		}()
+
+		app.redisStatus = newRedisStatus(logger, app.clock)
+
+		err = pingRedis(app.redis, 5*time.Second)
+		if err != nil {
+			app.redisStatus.failed("startup", err)
+		} else {
+			logger.PrintInfo("redis connection established", nil)
+		}
+	}
+
+	// Run through the startup checklist, so that any problems with the environment are logged
+	// up front.
+	logSelfChecks(selfChecker{cfg: cfg, db: db, redis: app.redis, store: app.storage}, logger)
+
+	serveHTTP, _ := processRoles(cfg.mode)
+
+	// API processes shed low priority requests while the database is struggling. This has to be
+	// set up before the health checks, so that the shedding state is included in them.
+	if cfg.shedding.enabled && serveHTTP {
+		app.shedder = newLoadShedder(cfg.shedding.window, cfg.shedding.dbLatency, cfg.shedding.errorRate)
+	}
+
+	app.healthChecks = app.defaultHealthChecks()
+	app.reviewFilters = app.defaultReviewFilters()
+	app.botDetectors = app.defaultBotDetectors()
+	app.settings = newRuntimeSettings(settingsFromConfig(cfg))
+
+	// Apply any runtime settings which have been saved through the admin settings endpoint,
+	// overriding the values from the command-line flags. A background loop keeps them up to
+	// date.
+	err = app.loadSettings()
+	if err != nil {
+		logger.PrintFatal(err, nil)
+	}
+
+	// If usage metering is enabled, initialize the usage meter. Only API processes meter usage.
+	if cfg.usage.enabled && serveHTTP {
+		app.usage = newUsageMeter()
+	}
+
+	// API processes count movie views and cache the public search results.
+	if serveHTTP {
+		app.searchCache = newSearchCache(cfg.search.cacheTTL, cfg.search.cacheSize, app.clock.Now)
+		app.views = newViewCounter()
+	}
+
+	// API processes which compress responses keep an eye on the CPU, so that compression can
+	// be skipped while it's constrained.
+	if cfg.compression.enabled && cfg.compression.maxSchedLatency > 0 && serveHTTP {
+		app.cpu = newCPUMonitor(cfg.compression.maxSchedLatency)
+	}
+
+	// Start the background loops for this process's mode (see backgroundLoops()).
+	app.startBackgroundLoops()
+
+	// Worker processes don't serve HTTP requests, so they just run until they're told to stop.
+	if !serveHTTP {
+		if err := app.runWorker(); err != nil {
+			logger.PrintFatal(err, nil)
+		}
+		return
 	}
 
 	// Call app.server() to start the server.
@@ -186,10 +1096,12 @@ func main() {
 	}
 }
 
-// openDB returns a sql.DB connection pool to postgres database
-func openDB(cfg config) (*sql.DB, error) {
-	// Use sql.Open() to create an empty connection pool, using the DSN from the config struct.
-	db, err := sql.Open("postgres", cfg.db.dsn)
+// openDB returns a sql.DB connection pool to postgres database. If the database can't be reached
+// it retries up to cfg.db.connectRetries times, logging each failed attempt.
+func openDB(cfg config, logger *jsonlog.Logger) (*sql.DB, error) {
+	// Create an empty connection pool, using the DSN from the config struct. Its queries are
+	// traced (see openTracedDB()), which costs next to nothing when tracing is disabled.
+	db, err := openTracedDB(cfg.db.dsn)
 	if err != nil {
 		return nil, err
 	}
@@ -212,17 +1124,27 @@ func openDB(cfg config) (*sql.DB, error) {
 	// Set the maximum idle timeout.
 	db.SetConnMaxIdleTime(duration)
 
-	// Create a context with a 5-second timeout deadline.
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
+	// Use PingContext() to establish a new connection to the database. If the database isn't
+	// up yet, keep trying with exponential backoff until we run out of retries.
+	for attempt := 0; ; attempt++ {
+		err = pingDB(db, cfg.db.connectTimeout)
+		if err == nil {
+			break
+		}
+
+		if attempt >= cfg.db.connectRetries {
+			_ = db.Close()
+			return nil, err
+		}
 
-	// Use PingContext() to establish a new connection to the database,
-	// passing in the context we created above as a parameter.
-	// If connection couldn't be established successfully within the 5-second deadline,
-	// then this will return an error.
-	err = db.PingContext(ctx)
-	if err != nil {
-		return nil, err
+		backoff := dbConnectBackoff(attempt)
+
+		logger.PrintError(err, map[string]string{
+			"attempt":  strconv.Itoa(attempt + 1),
+			"retry_in": backoff.String(),
+		})
+
+		time.Sleep(backoff)
 	}
 
 	// Return the sql.DB connection pool.
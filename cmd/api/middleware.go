@@ -4,23 +4,50 @@ import (
 	"errors"
 	"expvar"
 	"fmt"
+	"net"
 	"net/http"
+	"regexp"
 	"strconv"
 	"strings"
-	"sync"
 	"time"
 
 	"github.com/felixge/httpsnoop"
 	"github.com/tomasen/realip"
-	"golang.org/x/time/rate"
+	"go.opentelemetry.io/otel/trace"
 
 	"github.com/codeaucafe/snippetbox/greenlight/internal/data"
 	"github.com/codeaucafe/snippetbox/greenlight/internal/validator"
 )
 
+// requestIDHeader is the header which carries the request ID, on both requests and responses.
+const requestIDHeader = "X-Request-ID"
+
+// validRequestIDRX matches the incoming request IDs which we're willing to use, so that clients
+// (or proxies in front of us) can't fill the logs with arbitrary text.
+var validRequestIDRX = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+// requestID is middleware that gives every request an ID. It uses the X-Request-ID header of the
+// request if it has one (for example, from a load balancer) and it looks reasonable, and
+// otherwise generates a new one. The ID is added to the request context, where it's picked up by
+// the log entries and error responses for the request, and echoed back in the X-Request-ID
+// response header so that users can quote it when they report a problem.
+func (app *application) requestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !validRequestIDRX.MatchString(id) {
+			id = newRequestID()
+		}
+
+		w.Header().Set(requestIDHeader, id)
+
+		next.ServeHTTP(w, r.WithContext(data.ContextWithRequestID(r.Context(), id)))
+	})
+}
+
 // recoverPanic is middleware that recovers from a panic by responding with a 500 Internal Server
-// Error before closing the connection. It will also log the error using our custom Logger at
-// the ERROR level.
+// Error before closing the connection. Each panic is given an incident ID, which is logged
+// along with the error and stack trace at the ERROR level, and returned to the client so that
+// they can quote it in a support request and we can find the exact log entry.
 func (app *application) recoverPanic(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// Create a deferred function (which will always be run in the event of a panic as
@@ -28,92 +55,323 @@ func (app *application) recoverPanic(next http.Handler) http.Handler {
 		defer func() {
 			// Use the builtin recover function to check if there has been a panic or not.
 			if err := recover(); err != nil {
+				// http.ErrAbortHandler is how a handler aborts a response which it has already
+				// started, such as a streamed export which fails part way through. It isn't a
+				// bug, so pass it on to the server, which closes the connection quietly.
+				if err == http.ErrAbortHandler {
+					panic(err)
+				}
+
 				// If there was a panic, set a "Connection: close" header on the response. This
 				// acts a trigger to make Go's HTTP server automatically close the current
 				// connection after a response has been sent.
-				w.Header().Set("Connection:", "close")
+				w.Header().Set("Connection", "close")
+
 				// The value returned by recover() has the type interface{}, so we use
-				// fmt.Errorf() to normalize it into an error and call our
-				// serverErrorResponse() helper. In turn, this will log the error using our
-				// custom Logger type at the ERROR level and send the client a
-				// 500 Internal Server Error response.
-				app.serverErrorResponse(w, r, fmt.Errorf("%s", err))
+				// fmt.Errorf() to normalize it into an error. Our logger includes a stack trace
+				// for entries at the ERROR level, and because we're still in the deferred
+				// function it is the stack of the panic.
+				incidentID := newIncidentID()
+
+				app.logger.PrintError(fmt.Errorf("panic: %s", err), requestLogProperties(r, map[string]string{
+					"incident_id": incidentID,
+				}))
+
+				app.panicResponse(w, r, incidentID, err)
 			}
 		}()
 		next.ServeHTTP(w, r)
 	})
 }
 
+// securityHeaders sets the strict security headers on every response when the -strict-headers
+// flag is set, as it is in the staging and production profiles. The API only serves JSON and
+// plain text, so the content security policy doesn't let anything be loaded, and no page can
+// frame it. Strict-Transport-Security tells browsers to only ever use HTTPS for a year, so the
+// flag should only be set when the API is served over TLS.
+func (app *application) securityHeaders(next http.Handler) http.Handler {
+	if !app.config.headers.strict {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h := w.Header()
+		h.Set("Strict-Transport-Security", "max-age=31536000; includeSubDomains")
+		h.Set("Content-Security-Policy", "default-src 'none'; frame-ancestors 'none'")
+		h.Set("X-Content-Type-Options", "nosniff")
+		h.Set("X-Frame-Options", "DENY")
+		h.Set("Referrer-Policy", "no-referrer")
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// rateLimiter holds a token-bucket rate limiter for each client, keyed by the client's IP address
+// or user ID, in the limiter store selected by the -limiter-store flag. The limits are read from
+// the limits function on every request, so that they can follow settings which change at
+// runtime.
+type rateLimiter struct {
+	app *application
+	// name distinguishes the limiter's clients from those of the other limiters in the store.
+	name   string
+	limits func() (enabled bool, rps float64, burst int)
+	store  limiterStore
+}
+
+// newRateLimiter returns a new rateLimiter with the given name.
+func (app *application) newRateLimiter(name string, limits func() (enabled bool, rps float64, burst int)) *rateLimiter {
+	return &rateLimiter{
+		app:    app,
+		name:   name,
+		limits: limits,
+		store:  app.newLimiterStore(),
+	}
+}
+
+// allow reports whether a request from the client with the given key (its IP address or user
+// ID) is allowed by its rate limiter. An error is returned if the limiter store fails.
+func (l *rateLimiter) allow(key string) (bool, error) {
+	enabled, rps, burst := l.limits()
+
+	// Only carry out the check if rate limited is enabled.
+	if !enabled {
+		return true, nil
+	}
+
+	return l.store.allow(l.name+":"+key, rps, burst)
+}
+
+// check reports whether the client with the given key has any of its rate limit left, without
+// using it up.
+func (l *rateLimiter) check(key string) (bool, error) {
+	enabled, rps, burst := l.limits()
+
+	if !enabled {
+		return true, nil
+	}
+
+	return l.store.check(l.name+":"+key, rps, burst)
+}
+
+// limit is middleware which sends a 429 Too Many Requests response if the client's IP address
+// has used up its rate limit.
+func (l *rateLimiter) limit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		allowed, err := l.allow(l.app.clientIP(r))
+		if err != nil {
+			l.app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		if !allowed {
+			l.app.rateLimitExceededResponse(w, r)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// clientIP returns the IP address which the rate limiters key a request by, and which is recorded
+// in the access log. The X-Forwarded-For and X-Real-IP headers are set by the client unless a
+// proxy replaces them, so they're only believed (using the realip.FromRequest function) when the
+// request comes from one of the proxies in the -limiter-trusted-proxies flag. Otherwise a client
+// could get a fresh limit on every request, or hide in the logs, by making up a new address.
+func (app *application) clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		for _, proxy := range app.config.limiter.trustedProxies {
+			if proxy.Contains(ip) {
+				return realip.FromRequest(r)
+			}
+		}
+	}
+
+	return host
+}
+
+// parseNetworks parses a list of IP addresses and CIDRs, such as the -limiter-trusted-proxies
+// flag. An IP address is treated as a network of one address.
+func parseNetworks(values []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(values))
+
+	for _, value := range values {
+		if !strings.Contains(value, "/") {
+			ip := net.ParseIP(value)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address %q", value)
+			}
+
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q", value)
+		}
+
+		networks = append(networks, network)
+	}
+
+	return networks, nil
+}
+
+// The keys for the -limiter-key flag. With limiterKeyIP every request is limited by the client's
+// IP address. With limiterKeyUser authenticated requests are limited by the user instead, so
+// that users behind the same NAT gateway or proxy don't share a limit, and only anonymous
+// requests are limited by IP address.
+const (
+	limiterKeyIP   = "ip"
+	limiterKeyUser = "user"
+)
+
+// rateLimit applies the default rate limit to every request. The limiter settings start out as
+// the values from the command-line flags, but can be changed at runtime through the admin
+// settings endpoint. It runs before the request is authenticated, so it's keyed by IP address.
+// When the limiter is keyed by user, requests with an Authorization header are left to
+// rateLimitUsers() once they've been authenticated, but they're still limited by IP address
+// here for their failed attempts: each 401 Unauthorized response takes a token from the IP
+// address's "credentials" bucket, and once it's empty further requests with credentials are
+// rejected before their token is looked up.
 func (app *application) rateLimit(next http.Handler) http.Handler {
-	// Define a client struct to hold the rate limiter and last seen time for reach client
-	type client struct {
-		limiter  *rate.Limiter
-		lastSeen time.Time
+	limits := func() (bool, float64, int) {
+		settings := app.settings.get()
+		return settings.LimiterEnabled, settings.LimiterRPS, settings.LimiterBurst
 	}
 
-	// Declare a mutex and a map to hold pointers to a client struct.
-	var (
-		mu      sync.Mutex
-		clients = make(map[string]*client)
-	)
-
-	// Launch a background goroutine which removes old entries from the clients map once every
-	// minute.
-	go func() {
-		for {
-			time.Sleep(time.Minute)
-
-			// Lock the mutex to prevent any rate limiter checks from happening while the cleanup
-			// is taking place.
-			mu.Lock()
-
-			// Loop through all clients. if they haven't been seen within the last three minutes,
-			// then delete the corresponding entry from the clients map.
-			for ip, client := range clients {
-				if time.Since(client.lastSeen) > 3*time.Minute {
-					delete(clients, ip)
+	limited := app.newRateLimiter("default", limits).limit(next)
+	failures := app.newRateLimiter("credentials", limits)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if app.config.limiter.key != limiterKeyUser || r.Header.Get("Authorization") == "" {
+			limited.ServeHTTP(w, r)
+			return
+		}
+
+		ip := app.clientIP(r)
+
+		allowed, err := failures.check(ip)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		if !allowed {
+			app.rateLimitExceededResponse(w, r)
+			return
+		}
+
+		status := http.StatusOK
+		hooks := httpsnoop.Hooks{
+			WriteHeader: func(next httpsnoop.WriteHeaderFunc) httpsnoop.WriteHeaderFunc {
+				return func(code int) {
+					status = code
+					next(code)
 				}
+			},
+		}
+
+		next.ServeHTTP(httpsnoop.Wrap(w, hooks), r)
+
+		if status == http.StatusUnauthorized {
+			if _, err := failures.allow(ip); err != nil {
+				app.logger.PrintError(err, nil)
 			}
+		}
+	})
+}
+
+// rateLimitUsers applies the rate limit for authenticated users, keyed by user ID, when the
+// limiter is keyed by user. It has its own limits, set with the -limiter-user-rps and
+// -limiter-user-burst flags, which are usually higher than the limits for anonymous clients.
+// It must run after authenticate(), and does nothing when the limiter is keyed by IP address.
+func (app *application) rateLimitUsers(next http.Handler) http.Handler {
+	if app.config.limiter.key != limiterKeyUser {
+		return next
+	}
+
+	limiter := app.newRateLimiter("user", func() (bool, float64, int) {
+		return app.settings.get().LimiterEnabled, app.config.limiter.userRPS, app.config.limiter.userBurst
+	})
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user := app.contextGetUser(r)
+
+		if user.IsAnonymous() {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		allowed, err := limiter.allow(strconv.FormatInt(user.ID, 10))
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
 
-			// Importantly, unlock the mutex when the cleanup is complete.
-			mu.Unlock()
+		if !allowed {
+			app.userRateLimitExceededResponse(w, r)
+			return
 		}
-	}()
 
+		next.ServeHTTP(w, r)
+	})
+}
+
+// allowEmail applies the per-address email rate limit, for handlers which send an email to an
+// address given in the request, such as an activation email. The IP rate limits don't protect a
+// victim's address from being mail-bombed from many IP addresses, so this limits the emails sent
+// to each address instead, using the -limiter-email-interval and -limiter-email-burst flags. If
+// the address has used up its limit, it sends a 429 Too Many Requests response and returns false.
+func (app *application) allowEmail(w http.ResponseWriter, r *http.Request, email string) bool {
+	if !app.settings.get().LimiterEnabled {
+		return true
+	}
+
+	retryAfter, err := app.models.EmailLimits.Take(r.Context(), email, app.config.limiter.emailInterval,
+		app.config.limiter.emailBurst, app.clock.Now())
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return false
+	}
+
+	if retryAfter > 0 {
+		app.emailRateLimitExceededResponse(w, r, retryAfter)
+		return false
+	}
+
+	return true
+}
+
+// maintenanceMode sends a 503 Service Unavailable response to every request while maintenance
+// mode is enabled in the runtime settings. The healthcheck, metrics, token and admin endpoints
+// are exempt, so that operators can still log in and turn maintenance mode off.
+func (app *application) maintenanceMode(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// Only carry out the check if rate limited is enabled.
-		if app.config.limiter.enabled {
-			// Use the realip.FromRequest function to get the client's real IP address.
-			ip := realip.FromRequest(r)
-
-			// Lock the mutex to prevent this code from being executed concurrently.
-			mu.Lock()
-
-			// Check to see if the IP address already exists in the map. If it doesn't,
-			// then initialize a new rate limiter and add the IP address and limiter to the map.
-			if _, found := clients[ip]; !found {
-				// Use the requests-per-second and burst values from the app.config struct.
-				clients[ip] = &client{
-					limiter: rate.NewLimiter(rate.Limit(app.config.limiter.rps), app.config.limiter.burst)}
-			}
+		if app.settings.get().MaintenanceMode {
+			path := r.URL.Path
 
-			// Update the last seen time for the client.
-			clients[ip].lastSeen = time.Now()
+			exempt := path == "/v1/healthcheck" ||
+				path == "/debug/vars" ||
+				path == "/v1/tokens/authentication" ||
+				path == "/v1/tokens/refresh" ||
+				strings.HasPrefix(path, "/v1/admin/")
 
-			// Call the limiter.Allow() method on the rate limiter for the current IP address.
-			// If the request isn't allowed, unlock the mutex and send a 429 Too Many Requests
-			// response.
-			if !clients[ip].limiter.Allow() {
-				mu.Unlock()
-				app.rateLimitExceededResponse(w, r)
+			if !exempt {
+				app.maintenanceModeResponse(w, r)
 				return
 			}
-
-			// Very importantly, unlock the mutex before calling the next handler in the chain.
-			// Notice that we DON'T use defer to unlock the mutex, as that would mean that the mutex
-			// isn't unlocked until all handlers downstream of this middleware have also returned.
-			mu.Unlock()
 		}
+
 		next.ServeHTTP(w, r)
 	})
 }
@@ -122,7 +380,7 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// Add the "Vary: Authorization" header to the response. This indicates to any caches
 		// that the response may vary based on the value of the Authorization header in the request.
-		w.Header().Set("Vary", "Authorization")
+		w.Header().Add("Vary", "Authorization")
 
 		// Retrieve the value of the Authorization header from teh request. This will return the
 		// empty string "" if there is no such header found.
@@ -130,8 +388,14 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 
 		// If there is no Authorization header found, use the contextSetUser() helper to add
 		// an AnonymousUser to the request context. Then we call the next handler in the chain
-		// and return without executing any of the code below.
+		// and return without executing any of the code below. Browsers can't send the header
+		// when they open a WebSocket, so those requests can carry a ticket instead.
 		if authorizationHeader == "" {
+			if ticket := r.URL.Query().Get("ticket"); ticket != "" && isWebSocketUpgrade(r) {
+				app.authenticateSocketTicket(w, r, next, ticket)
+				return
+			}
+
 			r = app.contextSetUser(r, data.AnonymousUser)
 			next.ServeHTTP(w, r)
 			return
@@ -140,8 +404,14 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 		// Otherwise, we expect the value of the Authorization header to be in the format
 		// "Bearer <token>". We try to split this into its constituent parts, and if the header
 		// isn't in the expected format we return a 401 Unauthorized response using the
-		// invalidAuthenticationTokenResponse helper.
+		// invalidAuthenticationTokenResponse helper. Requests signed with an API key have a
+		// "Signature <key-id>" header instead, and are handled separately.
 		headerParts := strings.Split(authorizationHeader, " ")
+		if len(headerParts) == 2 && headerParts[0] == "Signature" {
+			app.authenticateSignature(w, r, next, headerParts[1])
+			return
+		}
+
 		if len(headerParts) != 2 || headerParts[0] != "Bearer" {
 			app.invalidAuthenticationTokenResponse(w, r)
 			return
@@ -150,6 +420,12 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 		// Extract the actual authentication toekn from the header parts
 		token := headerParts[1]
 
+		// In jwt mode the token is a JWT, which is handled separately.
+		if app.config.auth.mode == authModeJWT {
+			app.authenticateJWT(w, r, next, token)
+			return
+		}
+
 		// Validate the token to make sure it is in a sensible format.
 		v := validator.New()
 
@@ -162,7 +438,7 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 
 		// Retrieve the details of the user associated with the authentication token.
 		// call invalidAuthenticationTokenResponse if no matching record was found.
-		user, err := app.models.Users.GetForToken(data.ScopeAuthentication, token)
+		user, err := app.models.Users.GetForToken(r.Context(), data.ScopeAuthentication, token)
 		if err != nil {
 			switch {
 			case errors.Is(err, data.ErrRecordNotFound):
@@ -181,6 +457,111 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 	})
 }
 
+// authenticateJWT authenticates a request with a JWT authentication token, and then calls the
+// next handler in the chain. The user is looked up by the ID in the token, so that changes to
+// the user (such as activation) take effect straight away, and tokens issued before the user's
+// token generation last changed are rejected.
+func (app *application) authenticateJWT(w http.ResponseWriter, r *http.Request, next http.Handler, token string) {
+	userID, generation, err := app.parseJWT(token)
+	if err != nil {
+		app.invalidAuthenticationTokenResponse(w, r)
+		return
+	}
+
+	user, err := app.models.Users.Get(r.Context(), userID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidAuthenticationTokenResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if user.TokenGeneration != generation {
+		app.invalidAuthenticationTokenResponse(w, r)
+		return
+	}
+
+	r = app.contextSetUser(r, user)
+
+	next.ServeHTTP(w, r)
+}
+
+// enforceQuota counts the requests made by each authenticated user against their daily and
+// monthly request quotas, independently of the per-second rate limiter. The usage for the most
+// restrictive quota is returned in the X-Quota-Limit, X-Quota-Remaining and X-Quota-Reset
+// headers, and once a quota has been used up the user gets a 429 Too Many Requests response
+// until it resets. Anonymous requests aren't counted, as they are only rate limited by IP.
+func (app *application) enforceQuota(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		quota := app.config.quota
+		user := app.contextGetUser(r)
+
+		// A quota of 0 means unlimited, so if neither quota is set there's nothing to do.
+		if user.IsAnonymous() || (quota.daily <= 0 && quota.monthly <= 0) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		now := app.clock.Now()
+
+		usage, err := app.models.Quotas.Increment(r.Context(), user.ID, now)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		// Work out which quota has the fewest requests remaining. This is the one that we report
+		// in the headers, and the one which is enforced first.
+		var (
+			limit, remaining int64
+			reset            time.Time
+			found            bool
+		)
+
+		for _, q := range []struct {
+			period string
+			limit  int64
+			used   int64
+		}{
+			{data.QuotaPeriodDay, quota.daily, usage.Day},
+			{data.QuotaPeriodMonth, quota.monthly, usage.Month},
+		} {
+			if q.limit <= 0 {
+				continue
+			}
+
+			left := q.limit - q.used
+			if !found || left < remaining {
+				limit, remaining, reset, found = q.limit, left, data.QuotaPeriodReset(q.period, now), true
+			}
+		}
+
+		// Note that the count includes this request, so the quota is only exceeded once the
+		// remaining value drops below zero.
+		w.Header().Set("X-Quota-Limit", strconv.FormatInt(limit, 10))
+		w.Header().Set("X-Quota-Remaining", strconv.FormatInt(max64(remaining, 0), 10))
+		w.Header().Set("X-Quota-Reset", strconv.FormatInt(reset.Unix(), 10))
+
+		if remaining < 0 {
+			app.quotaExceededResponse(w, r, reset)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// max64 returns the larger of two int64 values.
+func max64(a, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
 // requireAuthenticatedUser checks that the user is not anonymous (i.e., they are authenticated).
 func (app *application) requireAuthenticatedUser(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -223,7 +604,7 @@ func (app *application) requirePermissions(code string, next http.HandlerFunc) h
 		user := app.contextGetUser(r)
 
 		// Get the slice of permission for the user
-		permissions, err := app.models.Permissions.GetAllForUser(user.ID)
+		permissions, err := app.models.Permissions.GetAllForUser(r.Context(), user.ID)
 		if err != nil {
 			app.serverErrorResponse(w, r, err)
 			return
@@ -245,50 +626,21 @@ func (app *application) requirePermissions(code string, next http.HandlerFunc) h
 }
 
 // enableCORS sets the Vary: Origin and Access-Control-Allow-Origin response headers in order to
-// enabled CORS for trusted origins.
+// enabled CORS for trusted origins. The default policy is applied here so that responses which
+// never reach a route (such as authentication errors) are still readable by trusted origins;
+// routes registered with their own policy replace it, and preflight requests are answered by
+// the router (see corsRouter) using the policy of the requested route.
 func (app *application) enableCORS(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// Add the "Vary: Origin" header.
-		w.Header().Set("Vary", "Origin")
+		w.Header().Add("Vary", "Origin")
 
 		// Add the "Vary: Access-Control-Request-Method" header.
-		w.Header().Set("Vary", "Access-Control-Request-Method")
-
-		// Get the value of the request's Origin header.
-		origin := r.Header.Get("Origin")
-
-		// On run this if there's an Origin request header present.
-		if origin != "" {
-			// Loop through the list of trusted origins, checking to see if the request
-			// origin exactly matches one of them. If there are no trusted origins, then the
-			// loop won't be iterated.
-			for i := range app.config.cors.trustedOrigins {
-				if origin == app.config.cors.trustedOrigins[i] {
-					// If there is a match, then set an "Access-Control-Allow-Origin" response
-					// header with the request origin as the value and break out of the loop.
-					w.Header().Set("Access-Control-Allow-Origin", origin)
-
-					// Check if the request has the HTTP method OPTIONS and contains the
-					// "Access-Control-Request-Method" header. If it does, then we treat it as a
-					// preflight request.
-					if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
-						// Set the necessary preflight response headers.
-						w.Header().Set("Access-Control-Allow-Methods", "OPTIONS, PUT, PATCH, DELETE")
-						w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
-
-						// Set max cached times for headers for 60 seconds.
-						w.Header().Set("Access-Control-Max-Age", "60")
-
-						// Write the headers along with a 200 OK status and return from the
-						// middleware with no further action.
-						w.WriteHeader(http.StatusOK)
-						return
-					}
-
-					break
-				}
-			}
-		}
+		w.Header().Add("Vary", "Access-Control-Request-Method")
+
+		// Set the "Access-Control-Allow-Origin" header if the request origin is trusted by the
+		// default policy.
+		app.defaultCORSPolicy().setAllowOrigin(w, r)
 
 		next.ServeHTTP(w, r)
 	})
@@ -324,3 +676,34 @@ func (app *application) metrics(next http.Handler) http.Handler {
 		totalResponsesSentbyStatus.Add(strconv.Itoa(metrics.Code), 1)
 	})
 }
+
+// logRequest is middleware that writes an access log entry at the INFO level for every request,
+// once the response has been sent. The entry holds the method, path, status code, number of
+// bytes written, duration and client IP address, along with the request ID if there is one, so
+// that a request can be found in the logs and tied to any errors logged while handling it.
+func (app *application) logRequest(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		metrics := httpsnoop.CaptureMetrics(next, w, r)
+
+		properties := map[string]string{
+			"method":      r.Method,
+			"path":        r.URL.Path,
+			"status":      strconv.Itoa(metrics.Code),
+			"bytes":       strconv.FormatInt(metrics.Written, 10),
+			"duration_ms": strconv.FormatFloat(float64(metrics.Duration.Microseconds())/1000, 'f', 3, 64),
+			"client_ip":   app.clientIP(r),
+		}
+
+		if requestID := data.RequestIDFromContext(r.Context()); requestID != "" {
+			properties["request_id"] = requestID
+		}
+
+		// Include the trace ID when the request is part of a trace, either one of ours or one
+		// passed on by the caller, so that the trace can be found from the log entry.
+		if sc := trace.SpanContextFromContext(r.Context()); sc.IsValid() {
+			properties["trace_id"] = sc.TraceID().String()
+		}
+
+		app.logger.PrintInfo("request", properties)
+	})
+}
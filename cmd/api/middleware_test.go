@@ -0,0 +1,585 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/codeaucafe/snippetbox/greenlight/internal/clock"
+	"github.com/codeaucafe/snippetbox/greenlight/internal/data"
+	"github.com/codeaucafe/snippetbox/greenlight/internal/jsonlog"
+	"github.com/codeaucafe/snippetbox/greenlight/internal/testutil"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// TestRateLimit checks that a client is limited once it has used up its burst, and that its
+// tokens are refilled as the clock moves on.
+func TestRateLimit(t *testing.T) {
+	app := newTestApp()
+
+	settings := app.settings.get()
+	settings.LimiterEnabled = true
+	settings.LimiterRPS = 1
+	settings.LimiterBurst = 1
+	app.settings.set(settings)
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	handler := app.rateLimit(next)
+
+	send := func() int {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/", nil))
+		return rr.Code
+	}
+
+	testutil.Equal(t, send(), http.StatusOK)
+	testutil.Equal(t, send(), http.StatusTooManyRequests)
+
+	app.clock.(*clock.Mock).Advance(time.Second)
+
+	testutil.Equal(t, send(), http.StatusOK)
+}
+
+// TestClientIP checks that the X-Forwarded-For header is only believed on requests from a
+// trusted proxy.
+func TestClientIP(t *testing.T) {
+	app := newTestApp()
+
+	proxies, err := parseNetworks([]string{"10.0.0.0/8", "192.0.2.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	app.config.limiter.trustedProxies = proxies
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		want       string
+	}{
+		{"Trusted proxy", "10.1.2.3:5000", "203.0.113.9"},
+		{"Trusted proxy address", "192.0.2.1:5000", "203.0.113.9"},
+		{"Untrusted client", "198.51.100.7:5000", "198.51.100.7"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = tt.remoteAddr
+			r.Header.Set("X-Forwarded-For", "203.0.113.9")
+
+			testutil.Equal(t, app.clientIP(r), tt.want)
+		})
+	}
+
+	_, err = parseNetworks([]string{"10.0.0.0/33"})
+	testutil.Equal(t, err != nil, true)
+}
+
+// TestRateLimitUsers checks that when the limiter is keyed by user, each authenticated user has
+// their own limit, separate from the IP address limit which anonymous clients share, and that
+// requests with invalid credentials are still limited by IP address.
+func TestRateLimitUsers(t *testing.T) {
+	app := newTestApp()
+	app.config.limiter.key = limiterKeyUser
+	app.config.limiter.userRPS = 1
+	app.config.limiter.userBurst = 1
+
+	settings := app.settings.get()
+	settings.LimiterEnabled = true
+	settings.LimiterRPS = 1
+	settings.LimiterBurst = 1
+	app.settings.set(settings)
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	// Stand in for authenticate(), treating the bearer token as the user's ID.
+	authenticate := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			user := data.AnonymousUser
+			if token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "); token != "" {
+				id, err := strconv.ParseInt(token, 10, 64)
+				if err != nil {
+					app.invalidAuthenticationTokenResponse(w, r)
+					return
+				}
+				user = &data.User{ID: id}
+			}
+			next.ServeHTTP(w, app.contextSetUser(r, user))
+		})
+	}
+
+	handler := app.rateLimit(authenticate(app.rateLimitUsers(next)))
+
+	send := func(userID string) int {
+		rr := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		if userID != "" {
+			r.Header.Set("Authorization", "Bearer "+userID)
+		}
+		handler.ServeHTTP(rr, r)
+		return rr.Code
+	}
+
+	testutil.Equal(t, send("1"), http.StatusOK)
+	testutil.Equal(t, send("1"), http.StatusTooManyRequests)
+	testutil.Equal(t, send("2"), http.StatusOK)
+
+	testutil.Equal(t, send(""), http.StatusOK)
+	testutil.Equal(t, send(""), http.StatusTooManyRequests)
+	testutil.Equal(t, send("3"), http.StatusOK)
+
+	// A failed attempt uses up the IP address's limit for credentials, so the next request with
+	// credentials is rejected before it's authenticated, even for a user with limit left.
+	testutil.Equal(t, send("invalid"), http.StatusUnauthorized)
+	testutil.Equal(t, send("4"), http.StatusTooManyRequests)
+}
+
+// TestEnforceQuota tests that each user's requests are counted against the daily and monthly
+// quotas, that the headers report the most restrictive one, and that the daily quota resets at
+// midnight UTC while the monthly one doesn't.
+func TestEnforceQuota(t *testing.T) {
+	app, fx := newTestDBApp(t)
+	app.config.quota.daily = 2
+	app.config.quota.monthly = 3
+
+	ts := newTestServer(app.routes())
+	defer ts.Close()
+
+	alice := fx.Token(fx.User(nil, "movies:read"), data.ScopeAuthentication)
+	bob := fx.Token(fx.User(nil, "movies:read"), data.ScopeAuthentication)
+
+	tests := []struct {
+		token         string
+		wantCode      int
+		wantLimit     string
+		wantRemaining string
+		wantRetry     string
+	}{
+		{alice.Plaintext, http.StatusOK, "2", "1", ""},
+		{alice.Plaintext, http.StatusOK, "2", "0", ""},
+		{alice.Plaintext, http.StatusTooManyRequests, "2", "0", "43201"},
+		{bob.Plaintext, http.StatusOK, "2", "1", ""},
+	}
+
+	send := func(token string) (int, http.Header) {
+		t.Helper()
+
+		code, header, _ := ts.request(t, http.MethodGet, "/v1/movies", token, "")
+		return code, header
+	}
+
+	for _, tt := range tests {
+		code, header := send(tt.token)
+		testutil.Equal(t, code, tt.wantCode)
+		testutil.Equal(t, header.Get("X-Quota-Limit"), tt.wantLimit)
+		testutil.Equal(t, header.Get("X-Quota-Remaining"), tt.wantRemaining)
+		testutil.Equal(t, header.Get("Retry-After"), tt.wantRetry)
+	}
+
+	// The next day Alice has daily quota left, but she has used up her monthly quota, which
+	// includes the rejected request.
+	app.clock.(*clock.Mock).Advance(12 * time.Hour)
+
+	code, header := send(alice.Plaintext)
+	testutil.Equal(t, code, http.StatusTooManyRequests)
+	testutil.Equal(t, header.Get("X-Quota-Limit"), "3")
+	testutil.Equal(t, header.Get("X-Quota-Reset"), strconv.FormatInt(time.Date(2022, 7, 1, 0, 0, 0, 0, time.UTC).Unix(), 10))
+
+	code, _ = send(bob.Plaintext)
+	testutil.Equal(t, code, http.StatusOK)
+
+	// Anonymous requests aren't counted.
+	_, header = send("")
+	testutil.Equal(t, header.Get("X-Quota-Limit"), "")
+}
+
+// TestRedisLimiterStore checks that the redis limiter store limits a client once it has used up
+// its burst, in the same way as the memory store. It's skipped unless a test Redis server is
+// configured (see testutil.NewRedis).
+func TestRedisLimiterStore(t *testing.T) {
+	store := &redisLimiterStore{client: testutil.NewRedis(t)}
+	key := testutil.RandomKey(t, "test:")
+
+	for _, want := range []bool{true, true, false} {
+		allowed, err := store.allow(key, 0.01, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		testutil.Equal(t, allowed, want)
+	}
+
+	// Other clients have buckets of their own.
+	allowed, err := store.allow(key+":other", 0.01, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.Equal(t, allowed, true)
+}
+
+// flakyLimiterStore is a limiterStore which fails while down is set, and allows everything
+// otherwise. It counts the calls it gets.
+type flakyLimiterStore struct {
+	down  bool
+	calls int
+}
+
+func (s *flakyLimiterStore) allow(key string, rps float64, burst int) (bool, error) {
+	s.calls++
+	if s.down {
+		return false, errors.New("connection refused")
+	}
+	return true, nil
+}
+
+func (s *flakyLimiterStore) check(key string, rps float64, burst int) (bool, error) {
+	return s.allow(key, rps, burst)
+}
+
+// TestFallbackLimiterStore checks that clients are still rate limited by the memory store while
+// Redis is unavailable, that Redis is only retried every redisRetryInterval, and that it's used
+// again once it's back.
+func TestFallbackLimiterStore(t *testing.T) {
+	app := newTestApp()
+	mock := app.clock.(*clock.Mock)
+
+	primary := &flakyLimiterStore{down: true}
+	store := &fallbackLimiterStore{
+		primary:  primary,
+		fallback: newMemoryLimiterStore(app.clock),
+		redis:    newRedisStatus(app.logger, app.clock),
+	}
+
+	for _, want := range []bool{true, true, false} {
+		allowed, err := store.allow("client", 0.01, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		testutil.Equal(t, allowed, want)
+	}
+
+	// Only the first request tried Redis.
+	testutil.Equal(t, primary.calls, 1)
+	testutil.Equal(t, store.redis.degraded, true)
+
+	primary.down = false
+	mock.Advance(redisRetryInterval)
+
+	allowed, err := store.allow("client", 0.01, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.Equal(t, allowed, true)
+	testutil.Equal(t, primary.calls, 2)
+	testutil.Equal(t, store.redis.degraded, false)
+}
+
+// TestAuthenticateTokenExpiry checks that an authentication token stops working once it has
+// expired.
+func TestAuthenticateTokenExpiry(t *testing.T) {
+	app, fx := newTestDBApp(t)
+	ts := newTestServer(app.routes())
+	defer ts.Close()
+
+	token := fx.Token(fx.User(nil, "movies:read"), data.ScopeAuthentication)
+
+	code, _, body := ts.request(t, http.MethodGet, "/v1/movies", token.Plaintext, "")
+	testutil.Status(t, code, body, http.StatusOK)
+
+	app.clock.(*clock.Mock).Advance(25 * time.Hour)
+
+	code, _, body = ts.request(t, http.MethodGet, "/v1/movies", token.Plaintext, "")
+	testutil.Status(t, code, body, http.StatusUnauthorized)
+}
+
+// TestRecoverPanic checks that a panic is turned into a 500 response containing an incident ID,
+// which is also sent in the X-Incident-ID header.
+func TestRecoverPanic(t *testing.T) {
+	app := newTestApp()
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("boom")
+	})
+
+	rr := httptest.NewRecorder()
+	app.recoverPanic(next).ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	testutil.Equal(t, rr.Code, http.StatusInternalServerError)
+	testutil.Equal(t, rr.Header().Get("Connection"), "close")
+
+	incidentID := rr.Header().Get("X-Incident-ID")
+	testutil.Equal(t, len(incidentID), 16)
+	testutil.StringContains(t, rr.Body.String(), `"incident_id": "`+incidentID+`"`)
+}
+
+// TestSecurityHeaders checks that the strict security headers are only sent with the
+// -strict-headers flag.
+func TestSecurityHeaders(t *testing.T) {
+	app := newTestApp()
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	rr := httptest.NewRecorder()
+	app.securityHeaders(next).ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/", nil))
+	testutil.Equal(t, rr.Header().Get("Strict-Transport-Security"), "")
+
+	app.config.headers.strict = true
+
+	rr = httptest.NewRecorder()
+	app.securityHeaders(next).ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/", nil))
+	testutil.Equal(t, rr.Header().Get("Strict-Transport-Security"), "max-age=31536000; includeSubDomains")
+	testutil.Equal(t, rr.Header().Get("X-Content-Type-Options"), "nosniff")
+	testutil.Equal(t, rr.Header().Get("X-Frame-Options"), "DENY")
+}
+
+// TestLogRequest checks that an access log entry is written for each request, with the status
+// code and size of the response, and the client IP address without believing a forwarding header
+// from a client which isn't a trusted proxy.
+func TestLogRequest(t *testing.T) {
+	app := newTestApp()
+
+	var buf bytes.Buffer
+	app.logger = jsonlog.NewLogger(&buf, jsonlog.LevelInfo)
+
+	handler := app.logRequest(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+		_, _ = w.Write([]byte("short and stout"))
+	}))
+
+	r := httptest.NewRequest(http.MethodGet, "/v1/teapot?brew=1", nil)
+	r = r.WithContext(data.ContextWithRequestID(r.Context(), "abc123"))
+	r.Header.Set("X-Forwarded-For", "203.0.113.9")
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+
+	var entry struct {
+		Message    string            `json:"message"`
+		Properties map[string]string `json:"properties"`
+	}
+	testutil.DecodeJSON(t, buf.Bytes(), &entry)
+
+	testutil.Equal(t, entry.Message, "request")
+	testutil.Equal(t, entry.Properties["method"], http.MethodGet)
+	testutil.Equal(t, entry.Properties["path"], "/v1/teapot")
+	testutil.Equal(t, entry.Properties["status"], "418")
+	testutil.Equal(t, entry.Properties["bytes"], "15")
+	testutil.Equal(t, entry.Properties["request_id"], "abc123")
+	testutil.Equal(t, entry.Properties["client_ip"], "192.0.2.1")
+}
+
+// TestInstrument checks that requests are counted in the Prometheus metrics by their route
+// pattern, and that requests which don't match a route share a single label.
+func TestInstrument(t *testing.T) {
+	app := newTestApp()
+
+	handler := app.instrument(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v1/movies/42" {
+			_, route := app.contextSetRouteInfo(r)
+			route.pattern = "GET /v1/movies/:id"
+			w.WriteHeader(http.StatusTeapot)
+			return
+		}
+		app.notFoundResponse(w, r)
+	}))
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/v1/movies/42", nil))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/wp-login.php", nil))
+
+	rr := httptest.NewRecorder()
+	promhttp.Handler().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	body := rr.Body.String()
+	testutil.StringContains(t, body, `greenlight_http_requests_total{route="GET /v1/movies/:id",status="418"} 1`)
+	testutil.StringContains(t, body, `greenlight_http_requests_total{route="unmatched",status="404"} 1`)
+	testutil.StringContains(t, body, `greenlight_http_request_duration_seconds_count{route="GET /v1/movies/:id"} 1`)
+	testutil.StringContains(t, body, "greenlight_http_requests_in_flight 0")
+}
+
+// TestJobMetrics checks that background job runs are counted by result, and that the last success
+// timestamp is only set by successful runs. It also checks that the queue collector reports each
+// queue, and flags the queues which can't be read.
+func TestJobMetrics(t *testing.T) {
+	job := startJob("test_job")
+	job.finish()
+
+	job = startJob("test_job")
+	job.fail()
+	job.finish()
+
+	job = startJob("test_failing_job")
+	job.fail()
+	job.finish()
+
+	rr := httptest.NewRecorder()
+	promhttp.Handler().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	body := rr.Body.String()
+	testutil.StringContains(t, body, `greenlight_job_runs_total{job="test_job",result="success"} 1`)
+	testutil.StringContains(t, body, `greenlight_job_runs_total{job="test_job",result="failure"} 1`)
+	testutil.StringContains(t, body, `greenlight_job_duration_seconds_count{job="test_job"} 2`)
+	testutil.StringContains(t, body, `greenlight_job_last_run_timestamp_seconds{job="test_failing_job"}`)
+	testutil.Equal(t, strings.Contains(body, `greenlight_job_last_success_timestamp_seconds{job="test_failing_job"}`), false)
+
+	collector := newQueueCollector(data.Models{})
+	for _, queue := range []string{"outbox", "tasks", "webhooks"} {
+		if _, ok := collector.queues[queue]; !ok {
+			t.Errorf("got no %s queue", queue)
+		}
+	}
+
+	collector.queues = map[string]func(context.Context) (data.QueueStats, error){
+		"outbox": func(context.Context) (data.QueueStats, error) {
+			return data.QueueStats{Depth: 3, OldestAge: 90 * time.Second}, nil
+		},
+		"tasks": func(context.Context) (data.QueueStats, error) {
+			return data.QueueStats{}, errors.New("connection refused")
+		},
+	}
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(collector)
+
+	rr = httptest.NewRecorder()
+	promhttp.HandlerFor(registry, promhttp.HandlerOpts{}).ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	body = rr.Body.String()
+	testutil.StringContains(t, body, `greenlight_queue_depth{queue="outbox"} 3`)
+	testutil.StringContains(t, body, `greenlight_queue_oldest_age_seconds{queue="outbox"} 90`)
+	testutil.StringContains(t, body, `greenlight_queue_scrape_error{queue="tasks"} 1`)
+	testutil.Equal(t, strings.Contains(body, `greenlight_queue_depth{queue="tasks"}`), false)
+}
+
+// TestTrace checks that each request gets a server span named after its route pattern, and that
+// the span is marked as an error when the request fails with a 5xx status.
+func TestTrace(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	defer otel.SetTracerProvider(previous)
+
+	app := newTestApp()
+
+	handler := app.trace(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, route := app.contextSetRouteInfo(r)
+		route.pattern = "GET /v1/movies/:id"
+		app.serverErrorResponse(w, r, errors.New("boom"))
+	}))
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/v1/movies/42", nil))
+
+	spans := recorder.Ended()
+	testutil.Equal(t, len(spans), 1)
+	testutil.Equal(t, spans[0].Name(), "GET /v1/movies/:id")
+	testutil.Equal(t, spans[0].Status().Code, codes.Error)
+}
+
+// TestTracePropagation checks that the trace context of an incoming request is picked up from its
+// W3C or B3 headers, even when tracing is disabled, and that the W3C headers win if a request has
+// both.
+func TestTracePropagation(t *testing.T) {
+	const (
+		w3cTraceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+		b3TraceID  = "80f198ee56343ba864fe8b2a57d3eff7"
+	)
+
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(trace.NewNoopTracerProvider())
+	defer otel.SetTracerProvider(previous)
+
+	app := newTestApp()
+
+	tests := []struct {
+		name    string
+		headers map[string]string
+		want    string
+	}{
+		{name: "none", want: ""},
+		{name: "traceparent", headers: map[string]string{
+			"traceparent": "00-" + w3cTraceID + "-00f067aa0ba902b7-01",
+		}, want: w3cTraceID},
+		{name: "b3 single", headers: map[string]string{
+			"b3": b3TraceID + "-e457b5a2e4d86bd1-1",
+		}, want: b3TraceID},
+		{name: "b3 multi", headers: map[string]string{
+			"X-B3-TraceId": b3TraceID,
+			"X-B3-SpanId":  "e457b5a2e4d86bd1",
+			"X-B3-Sampled": "1",
+		}, want: b3TraceID},
+		{name: "both", headers: map[string]string{
+			"traceparent": "00-" + w3cTraceID + "-00f067aa0ba902b7-01",
+			"b3":          b3TraceID + "-e457b5a2e4d86bd1-1",
+		}, want: w3cTraceID},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got string
+
+			handler := app.trace(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if sc := trace.SpanContextFromContext(r.Context()); sc.IsValid() {
+					got = sc.TraceID().String()
+				}
+			}))
+
+			r := httptest.NewRequest(http.MethodGet, "/v1/movies/42", nil)
+			for key, value := range tt.headers {
+				r.Header.Set(key, value)
+			}
+
+			handler.ServeHTTP(httptest.NewRecorder(), r)
+
+			testutil.Equal(t, got, tt.want)
+		})
+	}
+}
+
+// TestRequestID checks that requests are given an ID, or keep the one in their X-Request-ID
+// header if it's valid, and that the ID is echoed back and included in error responses.
+func TestRequestID(t *testing.T) {
+	app := newTestApp()
+
+	handler := app.requestID(http.HandlerFunc(app.notFoundResponse))
+
+	tests := []struct {
+		name     string
+		incoming string
+		wantSame bool
+	}{
+		{name: "none", incoming: ""},
+		{name: "valid", incoming: "lb-1234.abcd", wantSame: true},
+		{name: "invalid", incoming: "bad id\nwith newlines"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/v1/nowhere", nil)
+			if tt.incoming != "" {
+				r.Header.Set(requestIDHeader, tt.incoming)
+			}
+
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, r)
+
+			id := rr.Header().Get(requestIDHeader)
+			if id == "" {
+				t.Fatal("got no request ID")
+			}
+			testutil.Equal(t, id == tt.incoming, tt.wantSame)
+			testutil.StringContains(t, rr.Body.String(), `"request_id": "`+id+`"`)
+		})
+	}
+}
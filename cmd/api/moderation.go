@@ -0,0 +1,174 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/codeaucafe/snippetbox/greenlight/internal/data"
+	"github.com/codeaucafe/snippetbox/greenlight/internal/validator"
+)
+
+// reviewFilter is a hook which checks a review before it's published. If the review should be
+// held for a moderator then it returns true, along with the reason, which is recorded as the
+// review's moderation note. Filters only ever hold reviews back: they can't reject them.
+type reviewFilter func(review *data.Review) (reason string, held bool)
+
+// defaultReviewFilters returns the review filters enabled by the configuration. At the moment
+// that's the blocked words filter, if the -reviews-blocked-words flag is set.
+func (app *application) defaultReviewFilters() []reviewFilter {
+	var filters []reviewFilter
+
+	if len(app.config.reviews.blockedWords) > 0 {
+		filters = append(filters, blockedWordsFilter(app.config.reviews.blockedWords))
+	}
+
+	return filters
+}
+
+// blockedWordsFilter returns a review filter which holds reviews containing any of the words,
+// ignoring case. The words only match whole words, so that blocking "ass" doesn't hold reviews
+// which mention a "classic".
+func blockedWordsFilter(words []string) reviewFilter {
+	quoted := make([]string, len(words))
+	for i, word := range words {
+		quoted[i] = regexp.QuoteMeta(word)
+	}
+
+	rx := regexp.MustCompile(`(?i)\b(` + strings.Join(quoted, "|") + `)\b`)
+
+	return func(review *data.Review) (string, bool) {
+		if rx.MatchString(review.Body) {
+			return "contains a blocked word", true
+		}
+		return "", false
+	}
+}
+
+// moderateReview sets the moderation status of a new or edited review. Reviews which are held by
+// one of the review filters are pending, with the filter's reason as their note. Otherwise they
+// are approved straight away if the -reviews-auto-approve flag is set, and pending if it isn't.
+// Any earlier decision by a moderator no longer applies, so it's cleared.
+func (app *application) moderateReview(review *data.Review) {
+	review.ModerationNote = ""
+	review.ModeratedBy = nil
+
+	for _, filter := range app.reviewFilters {
+		if reason, held := filter(review); held {
+			review.Status = data.ReviewStatusPending
+			review.ModerationNote = reason
+			return
+		}
+	}
+
+	if app.config.reviews.autoApprove {
+		review.Status = data.ReviewStatusApproved
+	} else {
+		review.Status = data.ReviewStatusPending
+	}
+}
+
+// listModerationQueueHandler handles the "GET /v1/admin/reviews" endpoint and returns a page of
+// the moderation queue: the pending reviews, oldest first by default. The status query string
+// parameter can be used to list the approved or rejected reviews instead.
+func (app *application) listModerationQueueHandler(w http.ResponseWriter, r *http.Request) {
+	v := validator.New()
+	qs := r.URL.Query()
+
+	status := app.readStrings(qs, "status", data.ReviewStatusPending)
+
+	filters := data.Filters{
+		Page:     app.readInt(qs, "page", 1, v),
+		PageSize: app.readInt(qs, "page_size", 20, v),
+		Sort:     app.readStrings(qs, "sort", "created_at"),
+		SortSafeList: []string{
+			"created_at", "updated_at",
+			"-created_at", "-updated_at",
+		},
+	}
+
+	v.Check(validator.In(status, data.ReviewStatuses...), "status", "must be one of pending, approved or rejected")
+
+	if data.ValidateFilters(v, filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	reviews, metadata, err := app.models.Reviews.GetAllWithStatus(r.Context(), status, filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"reviews": reviews, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// moderateReviewHandler handles the "PATCH /v1/admin/reviews/:id" endpoint and approves or
+// rejects a review, with an optional note explaining the decision, which is shown to the
+// review's author. The decision has to be allowed by the review's current status (see
+// data.Review.CanTransition()).
+func (app *application) moderateReviewHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	var input struct {
+		Status string `json:"status"`
+		Note   string `json:"note"`
+	}
+
+	err = app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	review, err := app.models.Reviews.Get(r.Context(), id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	v := validator.New()
+
+	v.Check(validator.In(input.Status, data.ReviewStatusApproved, data.ReviewStatusRejected), "status",
+		"must be one of approved or rejected")
+	v.Check(input.Status == "" || review.CanTransition(input.Status), "status",
+		"the review is already "+review.Status)
+	data.ValidateModerationNote(v, input.Note)
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	review.Status = input.Status
+	review.ModerationNote = input.Note
+
+	err = app.models.Reviews.Moderate(r.Context(), review, app.contextGetUser(r).ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"review": review}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -1,10 +1,13 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/codeaucafe/snippetbox/greenlight/internal/data"
 	"github.com/codeaucafe/snippetbox/greenlight/internal/validator"
@@ -18,10 +21,11 @@ func (app *application) createMovieHandler(w http.ResponseWriter, r *http.Reques
 	// request body (not that the field names and types in the struct are a subset of the Movie
 	// struct). This struct will be our *target decode destination*.
 	var input struct {
-		Title   string       `json:"title"`
-		Year    int32        `json:"year"`
-		Runtime data.Runtime `json:"runtime"`
-		Genres  []string     `json:"genres"`
+		Title       string       `json:"title"`
+		Year        int32        `json:"year"`
+		Runtime     data.Runtime `json:"runtime"`
+		ReleaseDate *data.Date   `json:"release_date"`
+		Genres      []string     `json:"genres"`
 	}
 
 	// Use the readJSON() helper to decode the request body into the struct.
@@ -35,10 +39,11 @@ func (app *application) createMovieHandler(w http.ResponseWriter, r *http.Reques
 
 	// Copy the values from the input struct to a new Movie struct.
 	movie := &data.Movie{
-		Title:   input.Title,
-		Year:    input.Year,
-		Runtime: input.Runtime,
-		Genres:  input.Genres,
+		Title:       input.Title,
+		Year:        input.Year,
+		Runtime:     input.Runtime,
+		ReleaseDate: input.ReleaseDate,
+		Genres:      input.Genres,
 	}
 
 	// Initialize a new Validator instance.
@@ -46,7 +51,7 @@ func (app *application) createMovieHandler(w http.ResponseWriter, r *http.Reques
 
 	// Call the ValidateMovie() function and return a response containing the errors if any of
 	// the checks fail.
-	if data.ValidateMovie(v, movie); !v.Valid() {
+	if data.ValidateMovie(v, movie, app.config.movieLimits); !v.Valid() {
 		app.failedValidationResponse(w, r, v.Errors)
 		return
 	}
@@ -54,7 +59,7 @@ func (app *application) createMovieHandler(w http.ResponseWriter, r *http.Reques
 	// Call the Insert() method on our movies model, passing in a pointer to the validated movie
 	// struct. This will create a record in the database and update the movie struct with the
 	// system-generated information.
-	err = app.models.Movies.Insert(movie)
+	err = app.models.Movies.Insert(r.Context(), movie)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
@@ -66,6 +71,7 @@ func (app *application) createMovieHandler(w http.ResponseWriter, r *http.Reques
 	// interpolating the system-generated ID for our new movie in the URL.
 	headers := make(http.Header)
 	headers.Set("Location", fmt.Sprintf("/v1/movies/%d", movie.ID))
+	headers.Set("ETag", movieETag(movie))
 
 	// Write a JSON response with a 201 Created status code, the movie data in the response body,
 	// and the Location header.
@@ -82,9 +88,14 @@ func (app *application) showMovieHandler(w http.ResponseWriter, r *http.Request)
 	// When httprouter is parsing a request, any interpolated URL Parameters will be stored
 	// in the request context. We can use the ParamsFromContext() function to retrieve a slice
 	// containing these parameter names and values.
-	id, err := app.readIDParam(r)
-	if err != nil || id < 1 {
-		app.notFoundResponse(w, r)
+	id, err := app.readMovieIDParam(r)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
 		return
 	}
 
@@ -92,7 +103,7 @@ func (app *application) showMovieHandler(w http.ResponseWriter, r *http.Request)
 	// We also need to use the errors.Is()
 	// function to check if it returns a data.ErrRecordNotFound error,
 	// in which case we send a 404 Not Found response to the client.
-	movie, err := app.models.Movies.Get(id)
+	movie, err := app.models.Movies.Get(r.Context(), id)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -103,9 +114,26 @@ func (app *application) showMovieHandler(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	// Include the movie's top-billed cast. The movie's version changes whenever they do, so they
+	// are covered by its ETag.
+	movie.Cast, err = app.models.Credits.GetTopCast(r.Context(), movie.ID, topBilledCast)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// Count the view for the trending movies stats and the user's recently viewed movies.
+	if app.views != nil {
+		app.views.add(app.contextGetUser(r).ID, movie.ID, app.clock.Now())
+	}
+
+	// Include the movie's ETag, so that clients can make conditional requests to change it.
+	headers := make(http.Header)
+	headers.Set("ETag", movieETag(movie))
+
 	// Create an envelope{"movie": movie} instance and pass it to writeJSON(), instead of passing
 	// the plain movie struct.
-	err = app.writeJSON(w, http.StatusOK, envelope{"movie": movie}, nil)
+	err = app.writeJSON(w, http.StatusOK, envelope{"movie": movie}, headers)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
@@ -116,15 +144,32 @@ func (app *application) showMovieHandler(w http.ResponseWriter, r *http.Request)
 // returned.
 func (app *application) updateMovieHandler(w http.ResponseWriter, r *http.Request) {
 	// Extract the movie ID from the URL.
-	id, err := app.readIDParam(r)
+	id, err := app.readMovieIDParam(r)
 	if err != nil {
-		app.notFoundResponse(w, r)
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// The client must say which version of the movie they're updating with an If-Match header
+	// holding the ETag they last read, so that they can't overwrite someone else's changes
+	// without knowing it. The X-Expected-Version header, which clients used before ETags were
+	// supported, is checked against the movie's version instead.
+	ifMatch := r.Header.Get("If-Match")
+	expectedVersion := r.Header.Get("X-Expected-Version")
+
+	if ifMatch == "" && expectedVersion == "" {
+		app.preconditionRequiredResponse(w, r)
 		return
 	}
 
 	// Fetch the existing movie record from the database.
 	// Send a 404 Not Found response to the client if we couldn't find a matching record.
-	movie, err := app.models.Movies.Get(id)
+	movie, err := app.models.Movies.Get(r.Context(), id)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -135,22 +180,27 @@ func (app *application) updateMovieHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	// If the request contains an X-Expected-Version, verify that the movie version in the database
-	// matches the expected version specified in the header.
-	if r.Header.Get("X-Expected-Version") != "" {
-		if strconv.FormatInt(int64(movie.Version), 10) != r.Header.Get("X-Expected-Version") {
-			app.editConflictResponse(w, r)
-			return
-		}
+	// Only update the movie if it hasn't been changed since the client last read it, sending a
+	// 412 Precondition Failed response if it has. As with the DELETE endpoint, the update itself
+	// is still conditional on the version, in case the movie is changed in the meantime.
+	matched := movieETagMatches(ifMatch, movie)
+	if ifMatch == "" {
+		matched = expectedVersion == strconv.FormatInt(int64(movie.Version), 10)
+	}
+
+	if !matched {
+		app.preconditionFailedResponse(w, r)
+		return
 	}
 
 	// Use pointers for Title, Year, and Runtime fields, so that we can use their zero values of
 	// nil as part of the partial record update logic. Slice's zero value is already nil.
 	var input struct {
-		Title   *string       `json:"title"`
-		Year    *int32        `json:"year"`
-		Runtime *data.Runtime `json:"runtime"`
-		Genres  []string      `json:"genres"`
+		Title       *string       `json:"title"`
+		Year        *int32        `json:"year"`
+		Runtime     *data.Runtime `json:"runtime"`
+		ReleaseDate *data.Date    `json:"release_date"`
+		Genres      []string      `json:"genres"`
 	}
 
 	// Read the JSON request body data into the input struct.
@@ -178,6 +228,10 @@ func (app *application) updateMovieHandler(w http.ResponseWriter, r *http.Reques
 		movie.Runtime = *input.Runtime
 	}
 
+	if input.ReleaseDate != nil {
+		movie.ReleaseDate = input.ReleaseDate
+	}
+
 	if input.Genres != nil {
 		movie.Genres = input.Genres // Note that we don't need to dereference a slice because its zero is already nil
 	}
@@ -186,17 +240,17 @@ func (app *application) updateMovieHandler(w http.ResponseWriter, r *http.Reques
 	// sending the client a 422 Unprocessable Entity response if any checks fails
 	v := validator.New()
 
-	if data.ValidateMovie(v, movie); !v.Valid() {
+	if data.ValidateMovie(v, movie, app.config.movieLimits); !v.Valid() {
 		app.failedValidationResponse(w, r, v.Errors)
 		return
 	}
 
 	// Pass the updated movie record to the Update() method.
-	err = app.models.Movies.Update(movie)
+	err = app.models.Movies.Update(r.Context(), movie)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrEditConflict):
-			app.editConflictResponse(w, r)
+			app.preconditionFailedResponse(w, r)
 		default:
 			app.serverErrorResponse(w, r, err)
 
@@ -205,7 +259,10 @@ func (app *application) updateMovieHandler(w http.ResponseWriter, r *http.Reques
 	}
 
 	// Write the updated movie record in a JSON response.
-	err = app.writeJSON(w, http.StatusOK, envelope{"movie": movie}, nil)
+	headers := make(http.Header)
+	headers.Set("ETag", movieETag(movie))
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"movie": movie}, headers)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
@@ -214,18 +271,11 @@ func (app *application) updateMovieHandler(w http.ResponseWriter, r *http.Reques
 
 // deleteMovieHandler handles "DELETE /v1/movies/:id" endpoint and returns a 200 OK status code
 // with a success message in a JSON response. If there is an error a JSON formatted error is
-// returned.
+// returned. The movie is moved to the trash, where it can be restored with "POST
+// /v1/movies/:id/restore" until it's purged (see purgeDeletedMovies).
 func (app *application) deleteMovieHandler(w http.ResponseWriter, r *http.Request) {
 	// Extract the movie ID from the URL.
-	id, err := app.readIDParam(r)
-	if err != nil {
-		app.notFoundResponse(w, r)
-		return
-	}
-
-	// Delete the movie from the database. Send a 404 Not Found response to the client if
-	// there isn't a matching record.
-	err = app.models.Movies.Delete(id)
+	id, err := app.readMovieIDParam(r)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -236,8 +286,54 @@ func (app *application) deleteMovieHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
+	// If the client sent an If-Match header, only delete the movie if it hasn't been changed
+	// since they last read it. We check the ETag first, so that we can send a 412 Precondition
+	// Failed response, and then delete the movie only if it still has the same version, in case
+	// it was updated in the meantime.
+	if ifMatch := r.Header.Get("If-Match"); ifMatch != "" {
+		movie, err := app.models.Movies.Get(r.Context(), id)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrRecordNotFound):
+				app.notFoundResponse(w, r)
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+
+		if !movieETagMatches(ifMatch, movie) {
+			app.preconditionFailedResponse(w, r)
+			return
+		}
+
+		err = app.models.Movies.DeleteVersion(r.Context(), id, movie.Version)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrEditConflict):
+				app.preconditionFailedResponse(w, r)
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+	} else {
+		// Delete the movie from the database. Send a 404 Not Found response to the client if
+		// there isn't a matching record.
+		err = app.models.Movies.Delete(r.Context(), id)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrRecordNotFound):
+				app.notFoundResponse(w, r)
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+	}
+
 	// Return a 200 OK status code along with a success message.
-	err = app.writeJSON(w, 200, envelope{"message": "movie successfully deleted"}, nil)
+	err = app.writeJSON(w, 200, envelope{"message": "movie successfully moved to the trash"}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
@@ -247,6 +343,7 @@ func (app *application) listMoviesHandler(w http.ResponseWriter, r *http.Request
 	var input struct {
 		Title        string
 		Genres       []string
+		CreatedBy    int64
 		data.Filters // Embed the Filters struct type which holds fields for filtering and sorting.
 	}
 
@@ -262,6 +359,10 @@ func (app *application) listMoviesHandler(w http.ResponseWriter, r *http.Request
 	input.Title = app.readStrings(qs, "title", "")
 	input.Genres = app.readCSV(qs, "genres", []string{})
 
+	// Read the created_by filter, which is either a user ID or "me" for the authenticated user.
+	// Zero means the movies created by anyone.
+	input.CreatedBy = app.readUserFilter(r, qs, "created_by", v)
+
 	// Ge the page and page_size query string value as integers. Notice that we set the default
 	// page value to 1 and default page_size to 20, and that we pass the validator instance
 	// as the final argument.
@@ -287,16 +388,261 @@ func (app *application) listMoviesHandler(w http.ResponseWriter, r *http.Request
 		return
 	}
 
+	// A cursor parameter (which is empty for the first page) switches the endpoint to keyset
+	// pagination, which stays fast however deep the client pages.
+	keyset := qs.Has("cursor")
+	if keyset && qs.Has("page") {
+		v.AddError("page", "must not be provided with cursor")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// Get the current version of the movie collection, and combine it with the query string
+	// (which includes the filters, page and sort order) to build the ETag for this response. If
+	// the client already has this version, there is no need to fetch the movies.
+	collectionVersion, err := app.models.Movies.CollectionVersion(r.Context())
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	etag := collectionETag(collectionVersion, input.Title, strings.Join(input.Genres, ","),
+		strconv.FormatInt(input.CreatedBy, 10), strconv.Itoa(input.Filters.Page),
+		strconv.Itoa(input.Filters.PageSize), input.Filters.Sort, qs.Get("cursor"), qs.Get("fields"))
+
+	// The response to created_by=me depends on who is asking, so it mustn't be stored by shared
+	// caches under the public catalog policy.
+	if qs.Get("created_by") == "me" {
+		w.Header().Set("Cache-Control", "private, "+cacheNoCache)
+	}
+
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		app.notModifiedResponse(w, etag)
+		return
+	}
+
+	headers := make(http.Header)
+	headers.Set("ETag", etag)
+
+	if keyset {
+		app.listMoviesAfter(w, r, input.Title, input.Genres, input.CreatedBy, input.Filters, qs.Get("cursor"), headers)
+		return
+	}
+
 	// Call the MovieModel.GetAll method to retrieve the movies, passing in the various filter
 	// parameters.
-	movies, metadata, err := app.models.Movies.GetAll(input.Title, input.Genres, input.Filters)
+	movies, metadata, err := app.models.Movies.GetAll(r.Context(), input.Title, input.Genres, input.CreatedBy, input.Filters)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
 	// Send a JSON response containing the movie data.
-	if err := app.writeJSON(w, http.StatusOK, envelope{"movies": movies, "metadata": metadata}, nil); err != nil {
+	if err := app.writeJSON(w, http.StatusOK, envelope{"movies": movies, "metadata": metadata}, headers); err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
 }
+
+// listMoviesAfter sends the page of movies after the given cursor for listMoviesHandler, in
+// keyset pagination mode. The metadata holds the cursor for the next page, which is signed and
+// tied to the sort order and filters so that it can't be tampered with or reused with a
+// different query. An empty cursor means the first page.
+func (app *application) listMoviesAfter(w http.ResponseWriter, r *http.Request, title string, genres []string,
+	createdBy int64, filters data.Filters, cursor string, headers http.Header) {
+	secret := []byte(app.config.cursor.secret)
+	fingerprint := data.FiltersFingerprint(title, strings.Join(genres, ","), strconv.FormatInt(createdBy, 10))
+
+	var after *data.Cursor
+
+	if cursor != "" {
+		c, err := data.DecodeCursor(secret, cursor, filters.Sort, fingerprint)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrInvalidCursor), errors.Is(err, data.ErrCursorMismatch):
+				v := validator.New()
+				v.AddError("cursor", err.Error())
+				app.failedValidationResponse(w, r, v.Errors)
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+		after = &c
+	}
+
+	movies, next, err := app.models.Movies.GetAllAfter(r.Context(), title, genres, createdBy, filters, after)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrInvalidCursor):
+			v := validator.New()
+			v.AddError("cursor", err.Error())
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	metadata := data.Metadata{PageSize: filters.PageSize}
+
+	if next != nil {
+		next.Filters = fingerprint
+
+		metadata.NextCursor, err = data.EncodeCursor(secret, *next)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"movies": movies, "metadata": metadata}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// searchMoviesHandler handles the "POST /v1/movies/search" endpoint. It accepts a JSON filter
+// document combining field predicates with and/or/not, for searches which can't be expressed
+// with the query string parameters supported by listMoviesHandler. For example:
+//
+//	{"filter": {"or": [{"field": "year", "op": "lt", "value": 1960},
+//		{"field": "genres", "op": "contains", "value": ["sci-fi"]}]}, "sort": "-year"}
+func (app *application) searchMoviesHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Filter   *data.SearchFilter `json:"filter"`
+		Sort     string             `json:"sort"`
+		Page     int                `json:"page"`
+		PageSize int                `json:"page_size"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	// Apply the same defaults and sort safelist as listMoviesHandler.
+	filters := data.Filters{
+		Page:     input.Page,
+		PageSize: input.PageSize,
+		Sort:     input.Sort,
+		SortSafeList: []string{
+			"id", "title", "year", "runtime",
+			"-id", "-title", "-year", "-runtime",
+		},
+	}
+
+	if filters.Page == 0 {
+		filters.Page = 1
+	}
+
+	if filters.PageSize == 0 {
+		filters.PageSize = 20
+	}
+
+	if filters.Sort == "" {
+		filters.Sort = "id"
+	}
+
+	v := validator.New()
+
+	if input.Filter == nil {
+		v.AddError("filter", "must be provided")
+	} else {
+		data.ValidateSearchFilter(v, input.Filter)
+	}
+
+	if data.ValidateFilters(v, filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	movies, metadata, err := app.models.Movies.Search(r.Context(), *input.Filter, filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"movies": movies, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// textSearchMoviesHandler handles the "GET /v1/movies/search" endpoint, which is a full-text
+// search of the movie titles. The results are ranked by relevance, each word in the q parameter
+// matches as a prefix (so that it can back a search-as-you-type box), and each result includes
+// the title with the matching words highlighted in <mark> tags. For example:
+//
+//	GET /v1/movies/search?q=star+wa&page=1&page_size=10
+func (app *application) textSearchMoviesHandler(w http.ResponseWriter, r *http.Request) {
+	v := validator.New()
+	qs := r.URL.Query()
+
+	q := app.readStrings(qs, "q", "")
+
+	// The results are always ordered by relevance, so there's only one sort value.
+	filters := data.Filters{
+		Page:         app.readInt(qs, "page", 1, v),
+		PageSize:     app.readInt(qs, "page_size", 20, v),
+		Sort:         "-rank",
+		SortSafeList: []string{"-rank"},
+	}
+
+	data.ValidateTextQuery(v, q)
+
+	if data.ValidateFilters(v, filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	matches, metadata, err := app.models.Movies.TextSearch(r.Context(), q, filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"results": matches, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// ulidBackfillBatchSize is the number of movies given a ULID at a time by backfillULIDs().
+const ulidBackfillBatchSize = 500
+
+// backfillULIDs gives ULIDs to the movies which were created before they were added, one batch
+// every interval, and returns once there are none left. It's run by the leader, so the other
+// instances wait in case they become the leader before it's done. Movies are given a ULID when
+// they're created, so it only has to run once, but it's started whenever a worker starts (and
+// returns straight away after the first check) in case an older instance created some movies
+// during a deployment.
+func (app *application) backfillULIDs(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+
+		if !app.isLeader() {
+			continue
+		}
+
+		job := startJob("ulid_backfill")
+
+		updated, err := app.models.Movies.BackfillULIDs(context.Background(), ulidBackfillBatchSize)
+		if err != nil {
+			job.fail()
+			job.finish()
+			app.logger.PrintError(err, nil)
+			continue
+		}
+
+		job.finish()
+
+		if updated == 0 {
+			return
+		}
+
+		app.logger.PrintInfo("backfilled movie ULIDs", map[string]string{
+			"count": strconv.FormatInt(updated, 10),
+		})
+	}
+}
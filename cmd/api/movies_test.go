@@ -0,0 +1,569 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/codeaucafe/snippetbox/greenlight/internal/data"
+	"github.com/codeaucafe/snippetbox/greenlight/internal/testutil"
+)
+
+// TestShowMovie tests the "GET /v1/movies/:id" endpoint against a real database, including the
+// permission check.
+func TestShowMovie(t *testing.T) {
+	app, fx := newTestDBApp(t)
+	ts := newTestServer(app.routes())
+	defer ts.Close()
+
+	movie := fx.Movie(func(m *data.Movie) { m.Title = "Moana" })
+	reader := fx.Token(fx.User(nil, "movies:read"), data.ScopeAuthentication)
+	nobody := fx.Token(fx.User(nil), data.ScopeAuthentication)
+
+	tests := []struct {
+		name     string
+		urlPath  string
+		token    string
+		wantCode int
+	}{
+		{name: "valid", urlPath: fmt.Sprintf("/v1/movies/%d", movie.ID), token: reader.Plaintext, wantCode: http.StatusOK},
+		{name: "not found", urlPath: "/v1/movies/999999", token: reader.Plaintext, wantCode: http.StatusNotFound},
+		{name: "invalid id", urlPath: "/v1/movies/abc", token: reader.Plaintext, wantCode: http.StatusNotFound},
+		{name: "ulid", urlPath: "/v1/movies/" + movie.ULID, token: reader.Plaintext, wantCode: http.StatusOK},
+		{name: "unknown ulid", urlPath: "/v1/movies/01ARZ3NDEKTSV4RRFFQ69G5FAV", token: reader.Plaintext, wantCode: http.StatusNotFound},
+		{name: "no permission", urlPath: fmt.Sprintf("/v1/movies/%d", movie.ID), token: nobody.Plaintext, wantCode: http.StatusForbidden},
+		{name: "anonymous", urlPath: fmt.Sprintf("/v1/movies/%d", movie.ID), wantCode: http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, _, body := ts.request(t, http.MethodGet, tt.urlPath, tt.token, "")
+			testutil.Status(t, code, body, tt.wantCode)
+
+			if tt.wantCode != http.StatusOK {
+				return
+			}
+
+			var got struct {
+				Movie data.Movie `json:"movie"`
+			}
+			testutil.DecodeJSON(t, body, &got)
+
+			testutil.Equal(t, got.Movie.ID, movie.ID)
+			testutil.Equal(t, got.Movie.Title, "Moana")
+		})
+	}
+}
+
+// TestUpdateMovieIfMatch tests that "PATCH /v1/movies/:id" requires an If-Match header, and only
+// updates the movie when it holds the movie's current ETag, and that the ETag follows the
+// movie's average rating without new reviews making updates fail.
+func TestUpdateMovieIfMatch(t *testing.T) {
+	app, fx := newTestDBApp(t)
+	ts := newTestServer(app.routes())
+	defer ts.Close()
+
+	movie := fx.Movie()
+	writer := fx.Token(fx.User(nil, "movies:read", "movies:write"), data.ScopeAuthentication)
+	reviewer := fx.Token(fx.User(nil, "movies:read"), data.ScopeAuthentication)
+	moviePath := fmt.Sprintf("/v1/movies/%d", movie.ID)
+
+	code, headers, body := ts.request(t, http.MethodGet, moviePath, writer.Plaintext, "")
+	testutil.Status(t, code, body, http.StatusOK)
+	etag := headers.Get("ETag")
+	testutil.Equal(t, etag, movieETag(movie))
+
+	update := func(header, value string) (int, http.Header, []byte) {
+		h := http.Header{}
+		if header != "" {
+			h.Set(header, value)
+		}
+		return ts.requestWithHeaders(t, http.MethodPatch, moviePath, writer.Plaintext, `{"title": "Renamed"}`, h)
+	}
+
+	code, _, body = update("", "")
+	testutil.Status(t, code, body, http.StatusPreconditionRequired)
+
+	code, headers, body = update("If-Match", etag)
+	testutil.Status(t, code, body, http.StatusOK)
+	testutil.Equal(t, headers.Get("ETag"), versionETag(movie.Version+1))
+
+	// The ETag is stale now that the movie has been updated.
+	code, _, body = update("If-Match", etag)
+	testutil.Status(t, code, body, http.StatusPreconditionFailed)
+
+	code, _, body = update("X-Expected-Version", fmt.Sprint(movie.Version+1))
+	testutil.Status(t, code, body, http.StatusOK)
+
+	// A cached copy of the current version is revalidated without being sent again.
+	code, _, _ = ts.requestWithHeaders(t, http.MethodGet, moviePath, writer.Plaintext, "",
+		http.Header{"If-None-Match": {versionETag(movie.Version + 2)}})
+	testutil.Equal(t, code, http.StatusNotModified)
+
+	// A review changes the movie's average rating, but not its version, so the ETag changes too.
+	code, _, body = ts.request(t, http.MethodPost, moviePath+"/reviews", writer.Plaintext, `{"rating": 7}`)
+	testutil.Status(t, code, body, http.StatusCreated)
+
+	code, headers, body = ts.requestWithHeaders(t, http.MethodGet, moviePath, writer.Plaintext, "",
+		http.Header{"If-None-Match": {versionETag(movie.Version + 2)}})
+	testutil.Status(t, code, body, http.StatusOK)
+	testutil.Equal(t, headers.Get("ETag"), `"`+fmt.Sprint(movie.Version+2)+`-7"`)
+	etag = headers.Get("ETag")
+
+	// Another review changes the ETag again, but the movie itself hasn't changed, so an update
+	// with the ETag read before the review still goes through.
+	code, _, body = ts.request(t, http.MethodPost, moviePath+"/reviews", reviewer.Plaintext, `{"rating": 9}`)
+	testutil.Status(t, code, body, http.StatusCreated)
+
+	code, _, body = update("If-Match", etag)
+	testutil.Status(t, code, body, http.StatusOK)
+}
+
+// TestListMoviesETag tests that a list of movies can be revalidated with its ETag, and that the
+// ETag changes when a movie is updated or reviewed.
+func TestListMoviesETag(t *testing.T) {
+	app, fx := newTestDBApp(t)
+	ts := newTestServer(app.routes())
+	defer ts.Close()
+
+	movie := fx.Movie()
+	writer := fx.Token(fx.User(nil, "movies:read", "movies:write"), data.ScopeAuthentication)
+
+	list := func(etag string) (int, string) {
+		t.Helper()
+
+		code, headers, body := ts.requestWithHeaders(t, http.MethodGet, "/v1/movies", writer.Plaintext, "",
+			http.Header{"If-None-Match": {etag}})
+		if code != http.StatusNotModified {
+			testutil.Status(t, code, body, http.StatusOK)
+		}
+		return code, headers.Get("ETag")
+	}
+
+	code, etag := list("")
+	testutil.Equal(t, code, http.StatusOK)
+
+	code, _ = list(etag)
+	testutil.Equal(t, code, http.StatusNotModified)
+
+	code, _, body := ts.request(t, http.MethodPost, fmt.Sprintf("/v1/movies/%d/reviews", movie.ID), writer.Plaintext,
+		`{"rating": 7}`)
+	testutil.Status(t, code, body, http.StatusCreated)
+
+	code, reviewed := list(etag)
+	testutil.Equal(t, code, http.StatusOK)
+
+	code, _, body = ts.requestWithHeaders(t, http.MethodPatch, fmt.Sprintf("/v1/movies/%d", movie.ID), writer.Plaintext,
+		`{"title": "Renamed"}`, http.Header{"X-Expected-Version": {fmt.Sprint(movie.Version)}})
+	testutil.Status(t, code, body, http.StatusOK)
+
+	code, _ = list(reviewed)
+	testutil.Equal(t, code, http.StatusOK)
+}
+
+// TestBulkImportMovies tests the "POST /v1/movies/bulk" endpoint with each of the body formats,
+// checking that the valid records are created and the others are reported with their errors.
+func TestBulkImportMovies(t *testing.T) {
+	app, fx := newTestDBApp(t)
+	ts := newTestServer(app.routes())
+	defer ts.Close()
+
+	writer := fx.Token(fx.User(nil, "movies:read", "movies:write"), data.ScopeAuthentication)
+
+	ndjson := `{"title": "Moana", "year": 2016, "runtime": 107, "genres": ["animation"]}
+
+{"title": "", "year": 2016, "runtime": 107, "genres": ["animation"]}
+{"title": "Broken"
+{"title": "Up", "year": 2009, "runtime": "96 mins", "genres": ["animation", "adventure"]}
+`
+
+	csvBody := `id,title,year,runtime,genres
+1,Moana,2016,107,animation
+2,Up,2009,abc,animation
+3,Coco,2017
+`
+
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		wantCode    int
+		wantCreated int
+		wantErrors  map[int]string
+	}{
+		{name: "ndjson", contentType: "application/x-ndjson", body: ndjson, wantCode: http.StatusOK,
+			wantCreated: 2, wantErrors: map[int]string{2: "title", 3: "record"}},
+		{name: "csv", contentType: "text/csv; charset=utf-8", body: csvBody, wantCode: http.StatusOK,
+			wantCreated: 1, wantErrors: map[int]string{2: "runtime", 3: "record"}},
+		{name: "json", contentType: "application/json",
+			body:     `[{"title": "Coco", "year": 2017, "runtime": 105, "genres": ["animation"]}]`,
+			wantCode: http.StatusOK, wantCreated: 1, wantErrors: map[int]string{}},
+		{name: "unknown column", contentType: "text/csv", body: "title,director\nMoana,Musker\n",
+			wantCode: http.StatusBadRequest},
+		{name: "unsupported", contentType: "text/plain", body: "Moana", wantCode: http.StatusUnsupportedMediaType},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, _, body := ts.requestWithHeaders(t, http.MethodPost, "/v1/movies/bulk", writer.Plaintext, tt.body,
+				http.Header{"Content-Type": {tt.contentType}})
+			testutil.Status(t, code, body, tt.wantCode)
+
+			if tt.wantCode != http.StatusOK {
+				return
+			}
+
+			var got struct {
+				Results []bulkImportResult `json:"results"`
+				Created int                `json:"created"`
+			}
+			testutil.DecodeJSON(t, body, &got)
+
+			testutil.Equal(t, got.Created, tt.wantCreated)
+
+			for _, result := range got.Results {
+				field, wantError := tt.wantErrors[result.Row]
+				if !wantError {
+					testutil.Equal(t, result.ID > 0, true)
+					continue
+				}
+
+				testutil.Equal(t, result.ID, int64(0))
+				testutil.Equal(t, result.Errors[field] != "", true)
+			}
+		})
+	}
+}
+
+// TestBackfillULIDs tests that movies without a ULID are given one by BackfillULIDs, a batch at a
+// time.
+func TestBackfillULIDs(t *testing.T) {
+	app, fx := newTestDBApp(t)
+
+	movie := fx.Movie()
+	fx.Movie()
+	fx.Movie()
+
+	_, err := app.models.Movies.DB.Exec("UPDATE movies SET ulid = NULL")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []int64{2, 1, 0} {
+		updated, err := app.models.Movies.BackfillULIDs(context.Background(), 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		testutil.Equal(t, updated, want)
+	}
+
+	movie, err = app.models.Movies.Get(context.Background(), movie.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.Equal(t, data.IsULID(movie.ULID), true)
+}
+
+// TestMovieCreatedBy tests that movies are stamped with the user who created them, and that the
+// "GET /v1/movies" endpoint can be filtered by creator with ?created_by=me.
+func TestMovieCreatedBy(t *testing.T) {
+	app, fx := newTestDBApp(t)
+	ts := newTestServer(app.routes())
+	defer ts.Close()
+
+	writer := fx.User(nil, "movies:read", "movies:write")
+	token := fx.Token(writer, data.ScopeAuthentication)
+	fx.Movie()
+
+	code, _, body := ts.request(t, http.MethodPost, "/v1/movies", token.Plaintext,
+		`{"title": "Moana", "year": 2016, "runtime": "107 mins", "genres": ["animation"]}`)
+	testutil.Status(t, code, body, http.StatusCreated)
+
+	var created struct {
+		Movie data.Movie `json:"movie"`
+	}
+	testutil.DecodeJSON(t, body, &created)
+
+	if created.Movie.CreatedBy == nil || created.Movie.UpdatedBy == nil {
+		t.Fatalf("got created_by %v and updated_by %v; want both set", created.Movie.CreatedBy, created.Movie.UpdatedBy)
+	}
+	testutil.Equal(t, *created.Movie.CreatedBy, writer.ID)
+	testutil.Equal(t, *created.Movie.UpdatedBy, writer.ID)
+
+	code, header, body := ts.request(t, http.MethodGet, "/v1/movies?created_by=me", token.Plaintext, "")
+	testutil.Status(t, code, body, http.StatusOK)
+	testutil.Equal(t, header.Get("Cache-Control"), "private, no-cache")
+
+	var list struct {
+		Movies []data.Movie `json:"movies"`
+	}
+	testutil.DecodeJSON(t, body, &list)
+
+	testutil.Equal(t, len(list.Movies), 1)
+	testutil.Equal(t, list.Movies[0].ID, created.Movie.ID)
+
+	code, _, body = ts.request(t, http.MethodGet, "/v1/movies?created_by=someone", token.Plaintext, "")
+	testutil.Status(t, code, body, http.StatusUnprocessableEntity)
+}
+
+// TestMovieLimits tests that movies are validated against the limits configured for the
+// deployment, rather than fixed ones.
+func TestMovieLimits(t *testing.T) {
+	app, fx := newTestDBApp(t)
+	app.config.movieLimits.EarliestYear = 1870
+	app.config.movieLimits.MaxGenres = 2
+
+	ts := newTestServer(app.routes())
+	defer ts.Close()
+
+	token := fx.Token(fx.User(nil, "movies:read", "movies:write"), data.ScopeAuthentication)
+
+	code, _, body := ts.request(t, http.MethodPost, "/v1/movies", token.Plaintext,
+		`{"title": "The Horse in Motion", "year": 1878, "runtime": "1 mins", "genres": ["documentary"]}`)
+	testutil.Status(t, code, body, http.StatusCreated)
+
+	code, _, body = ts.request(t, http.MethodPost, "/v1/movies", token.Plaintext,
+		`{"title": "Moana", "year": 2016, "runtime": "107 mins", "genres": ["animation", "adventure", "comedy"]}`)
+	testutil.Status(t, code, body, http.StatusUnprocessableEntity)
+	testutil.StringContains(t, string(body), "must not contain more than 2 genres")
+}
+
+// TestListMoviesKeyset tests paging through the movies with the cursor parameter of
+// "GET /v1/movies", and that cursors can't be reused with a different sort order.
+func TestListMoviesKeyset(t *testing.T) {
+	app, fx := newTestDBApp(t)
+	ts := newTestServer(app.routes())
+	defer ts.Close()
+
+	for _, year := range []int32{2001, 1999, 2001, 1985, 2010} {
+		fx.Movie(func(m *data.Movie) { m.Year = year })
+	}
+	token := fx.Token(fx.User(nil, "movies:read"), data.ScopeAuthentication)
+
+	type page struct {
+		Movies   []data.Movie  `json:"movies"`
+		Metadata data.Metadata `json:"metadata"`
+	}
+
+	var (
+		years  []int32
+		cursor string
+	)
+
+	for i := 0; i < 3; i++ {
+		code, _, body := ts.request(t, http.MethodGet,
+			"/v1/movies?sort=-year&page_size=2&cursor="+cursor, token.Plaintext, "")
+		testutil.Status(t, code, body, http.StatusOK)
+
+		var got page
+		testutil.DecodeJSON(t, body, &got)
+
+		for _, movie := range got.Movies {
+			years = append(years, movie.Year)
+		}
+
+		cursor = got.Metadata.NextCursor
+		if i < 2 && cursor == "" {
+			t.Fatalf("got no next_cursor on page %d", i+1)
+		}
+	}
+
+	testutil.Equal(t, fmt.Sprint(years), "[2010 2001 2001 1999 1985]")
+	testutil.Equal(t, cursor, "")
+
+	code, _, body := ts.request(t, http.MethodGet, "/v1/movies?sort=-year&page_size=2&cursor=", token.Plaintext, "")
+	testutil.Status(t, code, body, http.StatusOK)
+
+	var first page
+	testutil.DecodeJSON(t, body, &first)
+
+	code, _, body = ts.request(t, http.MethodGet, "/v1/movies?sort=year&cursor="+first.Metadata.NextCursor,
+		token.Plaintext, "")
+	testutil.Status(t, code, body, http.StatusUnprocessableEntity)
+
+	code, _, body = ts.request(t, http.MethodGet, "/v1/movies?page=2&cursor=", token.Plaintext, "")
+	testutil.Status(t, code, body, http.StatusUnprocessableEntity)
+}
+
+// TestCursors tests that a pagination cursor decodes to the position it was encoded with, and
+// that it's rejected if it has been tampered with, was signed with another secret, or is used
+// with a different sort order or filters.
+func TestCursors(t *testing.T) {
+	secret := []byte("testing")
+	fingerprint := data.FiltersFingerprint("moana", "animation", "0")
+
+	position := data.Cursor{Sort: "-year", SortKey: []byte("2016"), ID: 7, Filters: fingerprint}
+
+	cursor, err := data.EncodeCursor(secret, position)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := data.DecodeCursor(secret, cursor, "-year", fingerprint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.Equal(t, c.ID, int64(7))
+	testutil.Equal(t, string(c.SortKey), "2016")
+
+	payload, signature, _ := strings.Cut(cursor, ".")
+	forged, err := data.EncodeCursor([]byte("other"), position)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		cursor  string
+		sort    string
+		filters string
+		wantErr error
+	}{
+		{"tampered", "x" + payload[1:] + "." + signature, "-year", fingerprint, data.ErrInvalidCursor},
+		{"other secret", forged, "-year", fingerprint, data.ErrInvalidCursor},
+		{"malformed", "nonsense", "-year", fingerprint, data.ErrInvalidCursor},
+		{"other sort", cursor, "year", fingerprint, data.ErrCursorMismatch},
+		{"other filters", cursor, "-year", data.FiltersFingerprint("", "", "0"), data.ErrCursorMismatch},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := data.DecodeCursor(secret, tt.cursor, tt.sort, tt.filters)
+			testutil.Equal(t, errors.Is(err, tt.wantErr), true)
+		})
+	}
+}
+
+// TestSearchMovies tests the filter documents of the "POST /v1/movies/search" endpoint,
+// including that the text of contains and prefix filters is matched literally.
+func TestSearchMovies(t *testing.T) {
+	app, fx := newTestDBApp(t)
+	ts := newTestServer(app.routes())
+	defer ts.Close()
+
+	half := fx.Movie(func(m *data.Movie) { m.Title = "50% Off"; m.Year = 1999 })
+	days := fx.Movie(func(m *data.Movie) { m.Title = "500 Days"; m.Year = 2009 })
+	token := fx.Token(fx.User(nil, "movies:read"), data.ScopeAuthentication)
+
+	search := func(filter string) []int64 {
+		t.Helper()
+
+		code, _, body := ts.request(t, http.MethodPost, "/v1/movies/search", token.Plaintext, `{"filter": `+filter+`}`)
+		testutil.Status(t, code, body, http.StatusOK)
+
+		var got struct {
+			Movies []data.Movie `json:"movies"`
+		}
+		testutil.DecodeJSON(t, body, &got)
+
+		ids := make([]int64, len(got.Movies))
+		for i, movie := range got.Movies {
+			ids[i] = movie.ID
+		}
+		return ids
+	}
+
+	testutil.Equal(t, fmt.Sprint(search(`{"field": "title", "op": "prefix", "value": "50"}`)), fmt.Sprint([]int64{half.ID, days.ID}))
+	testutil.Equal(t, fmt.Sprint(search(`{"field": "title", "op": "contains", "value": "%"}`)), fmt.Sprint([]int64{half.ID}))
+	testutil.Equal(t, fmt.Sprint(search(`{"field": "title", "op": "prefix", "value": "50_"}`)), fmt.Sprint([]int64{}))
+	testutil.Equal(t, fmt.Sprint(search(`{"and": [{"field": "title", "op": "prefix", "value": "50"},
+		{"not": {"field": "year", "op": "lt", "value": 2000}}]}`)), fmt.Sprint([]int64{days.ID}))
+}
+
+// TestTextSearchMovies tests the full-text search of the "GET /v1/movies/search" endpoint,
+// including prefix matching and highlighting (with the rest of the title escaped), and that it
+// doesn't clash with "GET /v1/movies/:id".
+func TestTextSearchMovies(t *testing.T) {
+	app, fx := newTestDBApp(t)
+	ts := newTestServer(app.routes())
+	defer ts.Close()
+
+	wars := fx.Movie(func(m *data.Movie) { m.Title = "Star Wars" })
+	fx.Movie(func(m *data.Movie) { m.Title = "Starship Troopers" })
+	fx.Movie(func(m *data.Movie) { m.Title = "Moana" })
+	token := fx.Token(fx.User(nil, "movies:read"), data.ScopeAuthentication)
+
+	code, _, body := ts.request(t, http.MethodGet, "/v1/movies/search?q=star+wa", token.Plaintext, "")
+	testutil.Status(t, code, body, http.StatusOK)
+
+	var got struct {
+		Results []data.MovieMatch `json:"results"`
+	}
+	testutil.DecodeJSON(t, body, &got)
+
+	testutil.Equal(t, len(got.Results), 1)
+	testutil.Equal(t, got.Results[0].Movie.ID, wars.ID)
+	testutil.Equal(t, got.Results[0].Highlight, "<mark>Star</mark> <mark>Wars</mark>")
+
+	code, _, body = ts.request(t, http.MethodGet, "/v1/movies/search?q=star", token.Plaintext, "")
+	testutil.Status(t, code, body, http.StatusOK)
+	testutil.DecodeJSON(t, body, &got)
+	testutil.Equal(t, len(got.Results), 2)
+
+	// The title is escaped, so that only the highlighting is HTML.
+	fx.Movie(func(m *data.Movie) { m.Title = "Xanadu <img src=x>" })
+
+	code, _, body = ts.request(t, http.MethodGet, "/v1/movies/search?q=xanadu", token.Plaintext, "")
+	testutil.Status(t, code, body, http.StatusOK)
+	testutil.DecodeJSON(t, body, &got)
+	testutil.Equal(t, len(got.Results), 1)
+	testutil.Equal(t, got.Results[0].Highlight, "<mark>Xanadu</mark> &lt;img src=x&gt;")
+
+	code, _, body = ts.request(t, http.MethodGet, "/v1/movies/search?q=%26%7C", token.Plaintext, "")
+	testutil.Status(t, code, body, http.StatusUnprocessableEntity)
+
+	code, _, body = ts.request(t, http.MethodGet, fmt.Sprintf("/v1/movies/%d", wars.ID), token.Plaintext, "")
+	testutil.Status(t, code, body, http.StatusOK)
+}
+
+// TestExportMovies tests that the "GET /v1/movies/export" endpoint streams the filtered catalog
+// as NDJSON and as CSV, as a file download.
+func TestExportMovies(t *testing.T) {
+	app, fx := newTestDBApp(t)
+	ts := newTestServer(app.routes())
+	defer ts.Close()
+
+	fx.Movie(func(m *data.Movie) { m.Title = "Moana"; m.Genres = []string{"animation"} })
+	fx.Movie(func(m *data.Movie) { m.Title = "Up"; m.Genres = []string{"animation", "adventure"} })
+	fx.Movie(func(m *data.Movie) { m.Title = "Heat"; m.Genres = []string{"crime"} })
+
+	reader := fx.Token(fx.User(nil, "movies:read"), data.ScopeAuthentication)
+
+	code, header, body := ts.request(t, http.MethodGet, "/v1/movies/export?genres=animation&sort=-title",
+		reader.Plaintext, "")
+	testutil.Status(t, code, body, http.StatusOK)
+	testutil.Equal(t, header.Get("Content-Type"), "application/x-ndjson")
+	testutil.StringContains(t, header.Get("Content-Disposition"), `.ndjson"`)
+
+	lines := strings.Split(strings.TrimSpace(string(body)), "\n")
+	testutil.Equal(t, len(lines), 2)
+
+	var first data.Movie
+	testutil.DecodeJSON(t, []byte(lines[0]), &first)
+	testutil.Equal(t, first.Title, "Up")
+
+	code, header, body = ts.request(t, http.MethodGet, "/v1/movies/export?format=csv", reader.Plaintext, "")
+	testutil.Status(t, code, body, http.StatusOK)
+	testutil.Equal(t, header.Get("Content-Type"), "text/csv")
+
+	records, err := csv.NewReader(bytes.NewReader(body)).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.Equal(t, len(records), 4)
+	testutil.Equal(t, records[0][1], "title")
+	testutil.Equal(t, records[2][4], "animation;adventure")
+
+	// An export with no matching movies is an empty file, with just the CSV header row.
+	code, _, body = ts.request(t, http.MethodGet, "/v1/movies/export?format=csv&title=nothing", reader.Plaintext, "")
+	testutil.Status(t, code, body, http.StatusOK)
+	testutil.Equal(t, string(body), "id,title,year,runtime,genres\n")
+
+	code, _, body = ts.request(t, http.MethodGet, "/v1/movies/export?format=xml", reader.Plaintext, "")
+	testutil.Status(t, code, body, http.StatusUnprocessableEntity)
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/codeaucafe/snippetbox/greenlight/internal/data"
+	"github.com/codeaucafe/snippetbox/greenlight/internal/validator"
+)
+
+// apiVersionHeader is the request header which clients use to choose the version of the response
+// shapes, and which is echoed back on every response. Clients which don't send it get version 1,
+// so existing clients keep working when fields are renamed in a later version.
+const apiVersionHeader = "Greenlight-Version"
+
+// latestAPIVersion is the newest version that clients can ask for.
+const latestAPIVersion = 2
+
+// fieldShim describes a response field which is renamed (and possibly changes format) in API
+// version since and later. Handlers and models always produce the original field, and writeJSON()
+// maps it to the new one for clients which ask for version since or later. The convert function
+// returns the new value for the field, and false if the value isn't the field it's looking for
+// (for example, a field with the same name on another type of resource), in which case it's left
+// alone.
+type fieldShim struct {
+	old, new string
+	since    int
+	convert  func(value interface{}) (interface{}, bool)
+}
+
+// fieldShims holds the renamed response fields, in the order they were renamed.
+var fieldShims = []fieldShim{
+	// Version 2 returns movie runtimes as a number of minutes, rather than "<n> mins".
+	{old: "runtime", new: "runtime_minutes", since: 2, convert: runtimeMinutes},
+}
+
+// runtimeMinutes converts a movie runtime in the "<n> mins" format to the number of minutes.
+func runtimeMinutes(value interface{}) (interface{}, bool) {
+	return formatRuntime(data.RuntimeFormatMinutes)(value)
+}
+
+// formatRuntime returns a function which converts a movie runtime in the "<n> mins" format to
+// the given format.
+func formatRuntime(format string) func(value interface{}) (interface{}, bool) {
+	return func(value interface{}) (interface{}, bool) {
+		s, ok := value.(string)
+		if !ok || !strings.HasSuffix(s, " mins") {
+			return nil, false
+		}
+
+		var runtime data.Runtime
+
+		err := runtime.UnmarshalJSON([]byte(strconv.Quote(s)))
+		if err != nil {
+			return nil, false
+		}
+
+		return runtime.Format(format), true
+	}
+}
+
+// runtimeFormatHeader is the request header which clients use to choose the format of movie
+// runtimes in responses: "mins" for the default "<n> mins" string, "minutes" for a plain number
+// of minutes, or "iso8601" for an ISO 8601 duration. Like the API version, it's echoed back on
+// every response. Requests accept runtimes in any of the formats, whatever the header says.
+const runtimeFormatHeader = "Greenlight-Runtime-Format"
+
+// idFormatHeader is the request header which clients use to choose how IDs and other 64-bit
+// integer fields are written in responses: "number" for JSON numbers, which is the default, or
+// "string" for strings holding the number. JavaScript can't represent integers above 2^53
+// exactly, so clients written in it should ask for strings. Like the runtime format, it's echoed
+// back on every response.
+const idFormatHeader = "Greenlight-ID-Format"
+
+// The formats which clients can choose with the Greenlight-ID-Format header.
+const (
+	idFormatNumber = "number"
+	idFormatString = "string"
+)
+
+// idFormats holds the formats which clients can choose with the Greenlight-ID-Format header.
+var idFormats = []string{idFormatNumber, idFormatString}
+
+// int64Fields returns the JSON names of the fields which hold 64-bit integers anywhere in a
+// response body, such as the IDs of resources and the counters which can grow past 2^53. They're
+// found from the Go types of the values in the body, so that a new field is covered as soon as
+// it's added to a type, and they're written as strings for clients which ask for the "string" ID
+// format. Fields with the same names which aren't integers are left alone by int64String.
+func int64Fields(body interface{}) []string {
+	names := map[string]bool{}
+	collectInt64Fields(reflect.ValueOf(body), names)
+
+	fields := make([]string, 0, len(names))
+	for name := range names {
+		fields = append(fields, name)
+	}
+	sort.Strings(fields)
+
+	return fields
+}
+
+// collectInt64Fields adds the JSON names of the int64 and *int64 struct fields in a value, and
+// in any values it holds, to names. The values are walked rather than just the types, so that
+// the values held by interfaces, such as those in an envelope, are covered.
+func collectInt64Fields(v reflect.Value, names map[string]bool) {
+	switch v.Kind() {
+	case reflect.Interface, reflect.Pointer:
+		if !v.IsNil() {
+			collectInt64Fields(v.Elem(), names)
+		}
+	case reflect.Map:
+		iter := v.MapRange()
+		for iter.Next() {
+			collectInt64Fields(iter.Value(), names)
+		}
+	case reflect.Slice, reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			return
+		}
+
+		for i := 0; i < v.Len(); i++ {
+			collectInt64Fields(v.Index(i), names)
+		}
+	case reflect.Struct:
+		t := v.Type()
+
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			if !field.IsExported() {
+				continue
+			}
+
+			name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+			if name == "-" {
+				continue
+			}
+
+			// Embedded structs without a name of their own have their fields promoted.
+			if name == "" && !field.Anonymous {
+				name = field.Name
+			}
+
+			fieldType := field.Type
+			if fieldType.Kind() == reflect.Pointer {
+				fieldType = fieldType.Elem()
+			}
+
+			if name != "" && fieldType.Kind() == reflect.Int64 {
+				names[name] = true
+			}
+
+			collectInt64Fields(v.Field(i), names)
+		}
+	}
+}
+
+// int64String converts an integer in a decoded JSON value to a string.
+func int64String(value interface{}) (interface{}, bool) {
+	n, ok := value.(json.Number)
+	if !ok {
+		return nil, false
+	}
+
+	if _, err := n.Int64(); err != nil {
+		return nil, false
+	}
+
+	return n.String(), true
+}
+
+// negotiateResponse reads the API version, runtime format and ID format that the client wants
+// from the Greenlight-Version, Greenlight-Runtime-Format and Greenlight-ID-Format request
+// headers, sending a 400 Bad Request response for unknown values. The choices are set in the
+// same headers on the response, where writeJSON() picks them up, and since the response depends
+// on them we add them to Vary.
+func (app *application) negotiateResponse(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", apiVersionHeader)
+		w.Header().Add("Vary", runtimeFormatHeader)
+		w.Header().Add("Vary", idFormatHeader)
+
+		w.Header().Set(apiVersionHeader, "1")
+		w.Header().Set(runtimeFormatHeader, data.RuntimeFormatMins)
+		w.Header().Set(idFormatHeader, idFormatNumber)
+
+		if value := r.Header.Get(apiVersionHeader); value != "" {
+			version, err := strconv.Atoi(value)
+			if err != nil || version < 1 || version > latestAPIVersion {
+				app.badRequestResponse(w, r, fmt.Errorf("%s must be between 1 and %d", apiVersionHeader, latestAPIVersion))
+				return
+			}
+
+			w.Header().Set(apiVersionHeader, value)
+		}
+
+		if value := r.Header.Get(runtimeFormatHeader); value != "" {
+			if !validator.In(value, data.RuntimeFormats...) {
+				app.badRequestResponse(w, r, fmt.Errorf("%s must be one of %s", runtimeFormatHeader,
+					strings.Join(data.RuntimeFormats, ", ")))
+				return
+			}
+
+			w.Header().Set(runtimeFormatHeader, value)
+		}
+
+		if value := r.Header.Get(idFormatHeader); value != "" {
+			if !validator.In(value, idFormats...) {
+				app.badRequestResponse(w, r, fmt.Errorf("%s must be one of %s", idFormatHeader,
+					strings.Join(idFormats, ", ")))
+				return
+			}
+
+			w.Header().Set(idFormatHeader, value)
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// responseAPIVersion returns the API version of the response being written, as set in its
+// headers by the negotiateResponse middleware, or 1 if it hasn't been set.
+func responseAPIVersion(header http.Header) int {
+	version, err := strconv.Atoi(header.Get(apiVersionHeader))
+	if err != nil {
+		return 1
+	}
+
+	return version
+}
+
+// shapeResponse returns the response body in the shape that the client negotiated, going by the
+// headers set by the negotiateResponse middleware: with the fields renamed up to its API
+// version, movie runtimes in its runtime format, and 64-bit integers in its ID format. Responses
+// in the default shape are returned unchanged, so they don't pay for the extra encoding.
+func shapeResponse(body interface{}, header http.Header) (interface{}, error) {
+	version := responseAPIVersion(header)
+
+	var shims []fieldShim
+
+	for _, shim := range fieldShims {
+		if version >= shim.since {
+			shims = append(shims, shim)
+		}
+	}
+
+	// The runtime format applies to the "runtime" field, so it only makes a difference to
+	// versions which haven't renamed it.
+	if format := header.Get(runtimeFormatHeader); format != "" && format != data.RuntimeFormatMins {
+		shims = append(shims, fieldShim{old: "runtime", new: "runtime", convert: formatRuntime(format)})
+	}
+
+	if header.Get(idFormatHeader) == idFormatString {
+		for _, field := range int64Fields(body) {
+			shims = append(shims, fieldShim{old: field, new: field, convert: int64String})
+		}
+	}
+
+	if len(shims) == 0 {
+		return body, nil
+	}
+
+	// Round-trip the body through JSON, so that the shims work on the field names and values
+	// which the client would see.
+	tree, err := jsonTree(body)
+	if err != nil {
+		return nil, err
+	}
+
+	renameFields(tree, shims)
+
+	return tree, nil
+}
+
+// jsonTree round-trips a value through JSON, returning the decoded maps, slices and values that
+// a client would see. Numbers are decoded as json.Number so that they're written back exactly as
+// they were.
+func jsonTree(value interface{}) (interface{}, error) {
+	js, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(js))
+	dec.UseNumber()
+
+	var tree interface{}
+
+	err = dec.Decode(&tree)
+	if err != nil {
+		return nil, err
+	}
+
+	return tree, nil
+}
+
+// renameFields applies the shims to every object in a decoded JSON value.
+func renameFields(value interface{}, shims []fieldShim) {
+	switch value := value.(type) {
+	case map[string]interface{}:
+		for _, shim := range shims {
+			old, ok := value[shim.old]
+			if !ok {
+				continue
+			}
+
+			if converted, ok := shim.convert(old); ok {
+				delete(value, shim.old)
+				value[shim.new] = converted
+			}
+		}
+
+		for _, child := range value {
+			renameFields(child, shims)
+		}
+	case []interface{}:
+		for _, child := range value {
+			renameFields(child, shims)
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/codeaucafe/snippetbox/greenlight/internal/data"
+	"github.com/codeaucafe/snippetbox/greenlight/internal/testutil"
+)
+
+// TestNegotiateResponse checks that movie runtimes keep their original shape for version 1
+// clients, are returned as runtime_minutes to clients which ask for version 2, and are returned
+// in the runtime format that the client asks for, and that IDs are returned as strings to
+// clients which ask for them.
+func TestNegotiateResponse(t *testing.T) {
+	app := newTestApp()
+
+	createdBy := int64(9007199254740993)
+	movie := &data.Movie{ID: 1, Title: "Moana", Runtime: 107, CreatedBy: &createdBy}
+
+	handler := app.negotiateResponse(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		err := app.writeJSON(w, http.StatusOK, envelope{"movies": []*data.Movie{movie}}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}))
+
+	tests := []struct {
+		version  string
+		format   string
+		ids      string
+		wantCode int
+		want     string
+		notWant  string
+	}{
+		{version: "", wantCode: http.StatusOK, want: `"runtime": "107 mins"`, notWant: "runtime_minutes"},
+		{version: "1", wantCode: http.StatusOK, want: `"runtime": "107 mins"`, notWant: "runtime_minutes"},
+		{version: "2", wantCode: http.StatusOK, want: `"runtime_minutes": 107`, notWant: `"runtime"`},
+		{version: "3", wantCode: http.StatusBadRequest, want: apiVersionHeader},
+		{format: "minutes", wantCode: http.StatusOK, want: `"runtime": 107`},
+		{format: "iso8601", wantCode: http.StatusOK, want: `"runtime": "PT1H47M"`},
+		{version: "2", format: "iso8601", wantCode: http.StatusOK, want: `"runtime_minutes": 107`},
+		{format: "fortnights", wantCode: http.StatusBadRequest, want: runtimeFormatHeader},
+		{ids: "number", wantCode: http.StatusOK, want: `"created_by": 9007199254740993`, notWant: `"id": "1"`},
+		{ids: "string", wantCode: http.StatusOK, want: `"created_by": "9007199254740993"`, notWant: `"id": 1`},
+		{ids: "string", format: "minutes", wantCode: http.StatusOK, want: `"runtime": 107`},
+		{ids: "hex", wantCode: http.StatusBadRequest, want: idFormatHeader},
+	}
+
+	for _, tt := range tests {
+		t.Run("version "+tt.version+" format "+tt.format+" ids "+tt.ids, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/v1/movies", nil)
+			if tt.version != "" {
+				r.Header.Set(apiVersionHeader, tt.version)
+			}
+			if tt.format != "" {
+				r.Header.Set(runtimeFormatHeader, tt.format)
+			}
+			if tt.ids != "" {
+				r.Header.Set(idFormatHeader, tt.ids)
+			}
+
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, r)
+
+			body := rr.Body.String()
+			testutil.Status(t, rr.Code, rr.Body.Bytes(), tt.wantCode)
+			testutil.StringContains(t, body, tt.want)
+
+			if tt.notWant != "" && strings.Contains(body, tt.notWant) {
+				t.Errorf("got %s; want no %s", body, tt.notWant)
+			}
+		})
+	}
+}
+
+// TestInt64Fields checks that the 64-bit integer fields of a response are found from the types of
+// its values, including those which aren't resource IDs.
+func TestInt64Fields(t *testing.T) {
+	createdBy := int64(1)
+	body := envelope{
+		"movie":    &data.Movie{ID: 1, CreatedBy: &createdBy},
+		"credits":  []data.Credit{{PersonID: 2}},
+		"delivery": data.WebhookDelivery{WebhookID: 3},
+	}
+
+	fields := strings.Join(int64Fields(body), " ")
+
+	for _, want := range []string{"id", "created_by", "person_id", "webhook_id"} {
+		testutil.StringContains(t, " "+fields+" ", " "+want+" ")
+	}
+
+	if strings.Contains(" "+fields+" ", " billing ") {
+		t.Errorf("got %s; want no billing, which isn't an int64", fields)
+	}
+}
+
+// TestRuntimeInputFormats checks that runtimes are accepted in each of the formats that they
+// can be written in.
+func TestRuntimeInputFormats(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    data.Runtime
+		wantErr bool
+	}{
+		{input: `"107 mins"`, want: 107},
+		{input: `107`, want: 107},
+		{input: `"PT1H47M"`, want: 107},
+		{input: `"PT107M"`, want: 107},
+		{input: `"PT2H"`, want: 120},
+		{input: `"P1D"`, wantErr: true},
+		{input: `"PT1H30S"`, wantErr: true},
+		{input: `"107"`, wantErr: true},
+		{input: `1.5`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			var got data.Runtime
+
+			err := json.Unmarshal([]byte(tt.input), &got)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("got %d; want an error", got)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+			testutil.Equal(t, got, tt.want)
+		})
+	}
+}
+
+// TestSelectableFields checks that the fields parameter keeps only the selected fields of each
+// movie, leaves the metadata alone, works with the renamed fields of later API versions, and
+// rejects fields which the route doesn't have.
+func TestSelectableFields(t *testing.T) {
+	app := newTestApp()
+
+	movie := &data.Movie{ID: 1, Title: "Moana", Year: 2016, Runtime: 107, Genres: []string{"animation"}}
+
+	handler := app.negotiateResponse(app.selectableFields(movieFields, func(w http.ResponseWriter, r *http.Request) {
+		err := app.writeJSON(w, http.StatusOK, envelope{
+			"movies":   []*data.Movie{movie},
+			"metadata": data.Metadata{CurrentPage: 1},
+		}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}))
+
+	tests := []struct {
+		name     string
+		fields   string
+		version  string
+		wantCode int
+		want     []string
+		notWant  []string
+	}{
+		{name: "all", wantCode: http.StatusOK, want: []string{`"genres"`, `"version"`}},
+		{name: "some", fields: "title,year", wantCode: http.StatusOK,
+			want: []string{`"title": "Moana"`, `"year": 2016`, `"current_page": 1`}, notWant: []string{`"id"`, `"genres"`}},
+		{name: "renamed", fields: "id,runtime_minutes", version: "2", wantCode: http.StatusOK,
+			want: []string{`"runtime_minutes": 107`}, notWant: []string{`"title"`}},
+		{name: "unknown", fields: "title,director", wantCode: http.StatusUnprocessableEntity,
+			want: []string{`unknown field \"director\"`}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/v1/movies?fields="+tt.fields, nil)
+			if tt.version != "" {
+				r.Header.Set(apiVersionHeader, tt.version)
+			}
+
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, r)
+
+			testutil.Status(t, rr.Code, rr.Body.Bytes(), tt.wantCode)
+
+			for _, want := range tt.want {
+				testutil.StringContains(t, rr.Body.String(), want)
+			}
+			for _, notWant := range tt.notWant {
+				testutil.Equal(t, strings.Contains(rr.Body.String(), notWant), false)
+			}
+		})
+	}
+}
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/codeaucafe/snippetbox/greenlight/internal/data"
+	"github.com/codeaucafe/snippetbox/greenlight/internal/validator"
+)
+
+// releaseNotifyBatchSize is the most subscribers that are notified in one transaction. Any more
+// are notified straight afterwards, in further batches.
+const releaseNotifyBatchSize = 500
+
+// subscribeMovieHandler handles the "PUT /v1/movies/:id/subscription" endpoint and subscribes the
+// current user to be notified when a movie that hasn't been released yet comes out. Only movies
+// with a release date in the future can be subscribed to.
+func (app *application) subscribeMovieHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readMovieIDParam(r)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	movie, err := app.models.Movies.Get(r.Context(), id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	today := data.NewDate(app.clock.Now())
+
+	v := validator.New()
+	v.Check(movie.ReleaseDate != nil && movie.ReleaseDate.After(today.Time), "release_date",
+		"the movie has already been released")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Notifications.Subscribe(r.Context(), app.contextGetUser(r).ID, movie.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"subscribed": true}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// unsubscribeMovieHandler handles the "DELETE /v1/movies/:id/subscription" endpoint and removes
+// the current user's subscription to a movie, if they have one.
+func (app *application) unsubscribeMovieHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readMovieIDParam(r)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.models.Notifications.Unsubscribe(r.Context(), app.contextGetUser(r).ID, id)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"subscribed": false}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// listNotificationsHandler handles the "GET /v1/users/me/notifications" endpoint and returns a
+// page of the current user's in-app notifications, newest first. The unread query string
+// parameter leaves out the notifications which have been read when it's true.
+func (app *application) listNotificationsHandler(w http.ResponseWriter, r *http.Request) {
+	v := validator.New()
+	qs := r.URL.Query()
+
+	unread := app.readBool(qs, "unread", v)
+
+	filters := data.Filters{
+		Page:         app.readInt(qs, "page", 1, v),
+		PageSize:     app.readInt(qs, "page_size", 20, v),
+		Sort:         "id",
+		SortSafeList: []string{"id"},
+	}
+
+	if data.ValidateFilters(v, filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	notifications, metadata, err := app.models.Notifications.GetAllForUser(r.Context(), app.contextGetUser(r).ID,
+		unread != nil && *unread, filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"notifications": notifications, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// readNotificationHandler handles the "PUT /v1/users/me/notifications/:id/read" endpoint and
+// marks one of the current user's notifications as read.
+func (app *application) readNotificationHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	err = app.models.Notifications.MarkRead(r.Context(), id, app.contextGetUser(r).ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "notification marked as read"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// showNotificationPreferencesHandler handles the "GET /v1/users/me/notification-preferences"
+// endpoint and returns how the current user wants to be notified.
+func (app *application) showNotificationPreferencesHandler(w http.ResponseWriter, r *http.Request) {
+	prefs, err := app.models.Notifications.GetPreferences(r.Context(), app.contextGetUser(r).ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"preferences": prefs}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// updateNotificationPreferencesHandler handles the "PUT /v1/users/me/notification-preferences"
+// endpoint. Either preference can be left out of the request body to keep its current value.
+// The preferences apply to both movie release and saved search notifications.
+func (app *application) updateNotificationPreferencesHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Email *bool `json:"email"`
+		InApp *bool `json:"in_app"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	prefs, err := app.models.Notifications.GetPreferences(r.Context(), user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if input.Email != nil {
+		prefs.Email = *input.Email
+	}
+	if input.InApp != nil {
+		prefs.InApp = *input.InApp
+	}
+
+	err = app.models.Notifications.SetPreferences(r.Context(), user.ID, prefs)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"preferences": prefs}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// releaseEvents are the types of movie event which can release a movie without waiting for the
+// date to change: a movie being added, or restored from the trash, with a release date which has
+// already arrived, or having its release date moved to today or earlier.
+var releaseEvents = map[string]bool{
+	data.EventMovieCreated:  true,
+	data.EventMovieUpdated:  true,
+	data.EventMovieRestored: true,
+}
+
+// releaseCheck records how far the release notifications have got: the date on which every
+// subscription was last checked, and the ID of the last movie event checked since then. The zero
+// value means that every subscription needs checking.
+type releaseCheck struct {
+	date    data.Date
+	afterID int64
+}
+
+// notifyReleasedMovies notifies the subscribers of the movies which have been released since the
+// last check. Every subscription is checked the first time, and again whenever the date changes,
+// since that's when release dates arrive. In between, only the movies in the movie events since
+// the last check are, which picks up the movies whose release date was set to one which has
+// already arrived. Each subscriber is notified once, after which their subscription is removed.
+func (app *application) notifyReleasedMovies(last *releaseCheck) {
+	job := startJob("release_notifications")
+	defer job.finish()
+
+	ctx := context.Background()
+	today := data.NewDate(app.clock.Now())
+
+	if !today.Equal(last.date.Time) {
+		// Note the last event before checking, so that any movie changed while we're checking is
+		// checked again afterwards.
+		afterID, err := app.models.Events.LastID(ctx)
+		if err != nil {
+			job.fail()
+			app.logger.PrintError(err, nil)
+			return
+		}
+
+		err = app.notifyMovieSubscribers(today, 0)
+		if err != nil {
+			job.fail()
+			app.logger.PrintError(err, nil)
+			return
+		}
+
+		*last = releaseCheck{date: today, afterID: afterID}
+		return
+	}
+
+	for {
+		events, err := app.models.Events.GetAfter(ctx, last.afterID, movieEventsReplayBatch)
+		if err != nil {
+			job.fail()
+			app.logger.PrintError(err, nil)
+			return
+		}
+
+		movieIDs := map[int64]bool{}
+		for _, event := range events {
+			if releaseEvents[event.Type] {
+				movieIDs[event.ResourceID] = true
+			}
+		}
+
+		for movieID := range movieIDs {
+			err := app.notifyMovieSubscribers(today, movieID)
+			if err != nil {
+				job.fail()
+				app.logger.PrintError(err, nil)
+				return
+			}
+		}
+
+		if len(events) > 0 {
+			last.afterID = events[len(events)-1].ID
+		}
+
+		if len(events) < movieEventsReplayBatch {
+			return
+		}
+	}
+}
+
+// notifyMovieSubscribers notifies the subscribers of the movies which have been released by
+// today, or of just the given movie if movieID isn't 0, in batches until there are none left.
+func (app *application) notifyMovieSubscribers(today data.Date, movieID int64) error {
+	email := func(recipient string, movie data.ReleasedMovie) *data.OutboxEmail {
+		return &data.OutboxEmail{
+			Recipient: recipient,
+			Template:  "movie_released.tmpl",
+			Data: map[string]interface{}{
+				"movieID": movie.ID,
+				"title":   movie.Title,
+				"year":    movie.Year,
+			},
+		}
+	}
+
+	for {
+		notified, err := app.models.Notifications.NotifyReleased(context.Background(), today, movieID,
+			releaseNotifyBatchSize, email)
+		if err != nil {
+			return err
+		}
+
+		if notified < releaseNotifyBatchSize {
+			return nil
+		}
+	}
+}
+
+// watchMovieReleases calls notifyReleasedMovies() whenever this instance publishes a movie event,
+// and otherwise once every interval, which picks up the date changing and the movie events
+// written by other instances. It only does so while this instance is the leader, and starts again
+// from a full check when it becomes the leader. It runs until the application exits.
+func (app *application) watchMovieReleases(interval time.Duration) {
+	sub := app.models.Movies.Broker.Subscribe(movieEventsBuffer)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var last releaseCheck
+
+	for {
+		select {
+		case _, ok := <-sub.Events():
+			if !ok {
+				// We fell behind, but the events we missed are read from the events table.
+				sub = app.models.Movies.Broker.Subscribe(movieEventsBuffer)
+			}
+		case <-ticker.C:
+		}
+
+		if !app.isLeader() {
+			last = releaseCheck{}
+			continue
+		}
+
+		app.notifyReleasedMovies(&last)
+	}
+}
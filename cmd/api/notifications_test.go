@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/codeaucafe/snippetbox/greenlight/internal/clock"
+	"github.com/codeaucafe/snippetbox/greenlight/internal/data"
+	"github.com/codeaucafe/snippetbox/greenlight/internal/testutil"
+)
+
+// TestReleaseNotifications tests that users can only subscribe to movies which haven't been
+// released yet, and that subscribers are notified once, in the app, when the movie comes out.
+func TestReleaseNotifications(t *testing.T) {
+	app, fx := newTestDBApp(t)
+	ts := newTestServer(app.routes())
+	defer ts.Close()
+
+	reader := fx.Token(fx.User(nil, "movies:read"), data.ScopeAuthentication)
+
+	releaseDate := data.NewDate(testTime.Add(10 * 24 * time.Hour))
+	upcoming := fx.Movie(func(m *data.Movie) { m.ReleaseDate = &releaseDate })
+	released := fx.Movie()
+
+	code, _, body := ts.request(t, http.MethodPut, fmt.Sprintf("/v1/movies/%d/subscription", released.ID),
+		reader.Plaintext, "")
+	testutil.Status(t, code, body, http.StatusUnprocessableEntity)
+
+	// Movies can be subscribed to by their ULID, as with the other movie routes.
+	code, _, body = ts.request(t, http.MethodPut, "/v1/movies/"+upcoming.ULID+"/subscription",
+		reader.Plaintext, "")
+	testutil.Status(t, code, body, http.StatusOK)
+
+	var list struct {
+		Notifications []data.Notification `json:"notifications"`
+	}
+
+	// A movie without a release date hasn't been released.
+	undated := fx.Movie(func(m *data.Movie) { m.ReleaseDate = nil })
+	err := app.models.Notifications.Subscribe(context.Background(), reader.UserID, undated.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing happens before the release date.
+	var last releaseCheck
+	app.notifyReleasedMovies(&last)
+
+	code, _, body = ts.request(t, http.MethodGet, "/v1/users/me/notifications", reader.Plaintext, "")
+	testutil.Status(t, code, body, http.StatusOK)
+	testutil.DecodeJSON(t, body, &list)
+	testutil.Equal(t, len(list.Notifications), 0)
+
+	app.clock.(*clock.Mock).Advance(10 * 24 * time.Hour)
+	app.notifyReleasedMovies(&last)
+	app.notifyReleasedMovies(&last)
+
+	code, _, body = ts.request(t, http.MethodGet, "/v1/users/me/notifications?unread=true", reader.Plaintext, "")
+	testutil.Status(t, code, body, http.StatusOK)
+	testutil.DecodeJSON(t, body, &list)
+	testutil.Equal(t, len(list.Notifications), 1)
+	testutil.Equal(t, list.Notifications[0].Kind, data.NotificationMovieReleased)
+
+	code, _, body = ts.request(t, http.MethodPut,
+		fmt.Sprintf("/v1/users/me/notifications/%d/read", list.Notifications[0].ID), reader.Plaintext, "")
+	testutil.Status(t, code, body, http.StatusOK)
+
+	code, _, body = ts.request(t, http.MethodGet, "/v1/users/me/notifications?unread=true", reader.Plaintext, "")
+	testutil.Status(t, code, body, http.StatusOK)
+	testutil.DecodeJSON(t, body, &list)
+	testutil.Equal(t, len(list.Notifications), 0)
+
+	// Moving a movie's release date to today releases it straight away, without waiting for the
+	// date to change.
+	laterDate := data.NewDate(app.clock.Now().Add(30 * 24 * time.Hour))
+	later := fx.Movie(func(m *data.Movie) { m.ReleaseDate = &laterDate })
+
+	code, _, body = ts.request(t, http.MethodPut, fmt.Sprintf("/v1/movies/%d/subscription", later.ID),
+		reader.Plaintext, "")
+	testutil.Status(t, code, body, http.StatusOK)
+
+	today := data.NewDate(app.clock.Now())
+	later.ReleaseDate = &today
+	err = app.models.Movies.Update(context.Background(), later)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	app.notifyReleasedMovies(&last)
+
+	code, _, body = ts.request(t, http.MethodGet, "/v1/users/me/notifications?unread=true", reader.Plaintext, "")
+	testutil.Status(t, code, body, http.StatusOK)
+	testutil.DecodeJSON(t, body, &list)
+	testutil.Equal(t, len(list.Notifications), 1)
+	testutil.Equal(t, *list.Notifications[0].MovieID, later.ID)
+
+	// Preferences default to both kinds of notification, and can be changed one at a time.
+	code, _, body = ts.request(t, http.MethodPut, "/v1/users/me/notification-preferences", reader.Plaintext,
+		`{"email": false}`)
+	testutil.Status(t, code, body, http.StatusOK)
+
+	var prefs struct {
+		Preferences data.NotificationPreferences `json:"preferences"`
+	}
+	testutil.DecodeJSON(t, body, &prefs)
+	testutil.Equal(t, prefs.Preferences, data.NotificationPreferences{Email: false, InApp: true})
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"sort"
+	"strings"
+)
+
+// openAPIDocument is an OpenAPI 3 document describing the API. It's generated from the route
+// tables, so it always lists exactly the routes that the application serves, along with who can
+// call them, and the query string parameters and request bodies of the routes which describe
+// them. Response bodies aren't described yet.
+type openAPIDocument struct {
+	OpenAPI    string                                 `json:"openapi"`
+	Info       openAPIInfo                            `json:"info"`
+	Paths      map[string]map[string]openAPIOperation `json:"paths"`
+	Components openAPIComponents                      `json:"components"`
+}
+
+type openAPIInfo struct {
+	Title   string `json:"title"`
+	Version string `json:"version"`
+}
+
+type openAPIComponents struct {
+	SecuritySchemes map[string]openAPISecurityScheme `json:"securitySchemes"`
+}
+
+type openAPISecurityScheme struct {
+	Type   string `json:"type"`
+	Scheme string `json:"scheme"`
+}
+
+// openAPIOperation describes a single route. The x-permission and x-rate-limit extensions hold
+// the permission code required to call the route (if any) and its rate limit class.
+type openAPIOperation struct {
+	Summary     string                     `json:"summary,omitempty"`
+	Parameters  []openAPIParameter         `json:"parameters,omitempty"`
+	RequestBody *openAPIRequestBody        `json:"requestBody,omitempty"`
+	Security    []map[string][]string      `json:"security,omitempty"`
+	Responses   map[string]openAPIResponse `json:"responses"`
+	XPermission string                     `json:"x-permission,omitempty"`
+	XRateLimit  string                     `json:"x-rate-limit"`
+}
+
+type openAPIParameter struct {
+	Name     string         `json:"name"`
+	In       string         `json:"in"`
+	Required bool           `json:"required"`
+	Schema   *openAPISchema `json:"schema"`
+}
+
+type openAPIRequestBody struct {
+	Required bool                        `json:"required"`
+	Content  map[string]openAPIMediaType `json:"content"`
+}
+
+type openAPIMediaType struct {
+	Schema *openAPISchema `json:"schema"`
+}
+
+// openAPISchema is the subset of the OpenAPI schema object that the routes use to describe their
+// query string parameters and request bodies. As well as going in the OpenAPI document, the
+// schemas are what requests are checked against when request validation is enabled (see
+// validateRequest()), so any keyword added here needs to be checked there too.
+type openAPISchema struct {
+	Type       string                    `json:"type,omitempty"`
+	Format     string                    `json:"format,omitempty"`
+	Nullable   bool                      `json:"nullable,omitempty"`
+	Enum       []string                  `json:"enum,omitempty"`
+	Minimum    *int64                    `json:"minimum,omitempty"`
+	Maximum    *int64                    `json:"maximum,omitempty"`
+	MinLength  *int                      `json:"minLength,omitempty"`
+	MaxLength  *int                      `json:"maxLength,omitempty"`
+	Pattern    string                    `json:"pattern,omitempty"`
+	Items      *openAPISchema            `json:"items,omitempty"`
+	MinItems   *int                      `json:"minItems,omitempty"`
+	MaxItems   *int                      `json:"maxItems,omitempty"`
+	Unique     bool                      `json:"uniqueItems,omitempty"`
+	Properties map[string]*openAPISchema `json:"properties,omitempty"`
+	Required   []string                  `json:"required,omitempty"`
+}
+
+// The helpers below build the schemas for the route tables. Each returns a new schema, which can
+// be narrowed down with the methods that follow.
+
+// stringSchema returns the schema for a string of at most maxLength characters, or of any length
+// if maxLength is zero.
+func stringSchema(maxLength int) *openAPISchema {
+	s := &openAPISchema{Type: "string", MinLength: intPtr(1)}
+	if maxLength > 0 {
+		s.MaxLength = intPtr(maxLength)
+	}
+	return s
+}
+
+// textSchema returns the schema for a string of at most maxLength characters which can be empty.
+func textSchema(maxLength int) *openAPISchema {
+	return &openAPISchema{Type: "string", MaxLength: intPtr(maxLength)}
+}
+
+// integerSchema returns the schema for an integer of at least min.
+func integerSchema(min int64) *openAPISchema {
+	return &openAPISchema{Type: "integer", Minimum: &min}
+}
+
+// enumSchema returns the schema for a string which must be one of the given values.
+func enumSchema(values ...string) *openAPISchema {
+	return &openAPISchema{Type: "string", Enum: values}
+}
+
+// formatSchema returns the schema for a string in the given format, such as "date" or
+// "date-time".
+func formatSchema(format string) *openAPISchema {
+	return &openAPISchema{Type: "string", Format: format}
+}
+
+// booleanSchema returns the schema for a boolean.
+func booleanSchema() *openAPISchema {
+	return &openAPISchema{Type: "boolean"}
+}
+
+// arraySchema returns the schema for an array of between minItems and maxItems values (or any
+// number, if maxItems is zero) which each match items.
+func arraySchema(items *openAPISchema, minItems, maxItems int) *openAPISchema {
+	s := &openAPISchema{Type: "array", Items: items, MinItems: intPtr(minItems)}
+	if maxItems > 0 {
+		s.MaxItems = intPtr(maxItems)
+	}
+	return s
+}
+
+// objectSchema returns the schema for an object with the given properties. None of them are
+// required unless they're listed with required().
+func objectSchema(properties map[string]*openAPISchema) *openAPISchema {
+	return &openAPISchema{Type: "object", Properties: properties}
+}
+
+// required marks properties of an object schema as required.
+func (s *openAPISchema) required(names ...string) *openAPISchema {
+	s.Required = append(s.Required, names...)
+	return s
+}
+
+// withProperty adds a property to an object schema.
+func (s *openAPISchema) withProperty(name string, property *openAPISchema) *openAPISchema {
+	s.Properties[name] = property
+	return s
+}
+
+// nullable allows a schema's value to be null, as well as its own type.
+func (s *openAPISchema) nullable() *openAPISchema {
+	s.Nullable = true
+	return s
+}
+
+// unique requires the values of an array schema to be distinct.
+func (s *openAPISchema) unique() *openAPISchema {
+	s.Unique = true
+	return s
+}
+
+// atMost sets the maximum of an integer schema.
+func (s *openAPISchema) atMost(max int64) *openAPISchema {
+	s.Maximum = &max
+	return s
+}
+
+// matching requires a string schema's value to match the regular expression.
+func (s *openAPISchema) matching(pattern string) *openAPISchema {
+	s.Pattern = pattern
+	return s
+}
+
+// queryParams returns the descriptions of a route's query string parameters, none of which are
+// required.
+func queryParams(params map[string]*openAPISchema) []openAPIParameter {
+	names := make([]string, 0, len(params))
+	for name := range params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	described := make([]openAPIParameter, 0, len(params))
+	for _, name := range names {
+		described = append(described, openAPIParameter{Name: name, In: "query", Schema: params[name]})
+	}
+
+	return described
+}
+
+// intPtr returns a pointer to n.
+func intPtr(n int) *int {
+	return &n
+}
+
+type openAPIResponse struct {
+	Description string `json:"description"`
+}
+
+// newOpenAPIDocument generates the OpenAPI document for the given routes.
+func newOpenAPIDocument(routes []route) *openAPIDocument {
+	doc := &openAPIDocument{
+		OpenAPI: "3.0.3",
+		Info:    openAPIInfo{Title: "Greenlight API", Version: version},
+		Paths:   map[string]map[string]openAPIOperation{},
+		Components: openAPIComponents{
+			SecuritySchemes: map[string]openAPISecurityScheme{
+				"bearerAuth": {Type: "http", Scheme: "bearer"},
+			},
+		},
+	}
+
+	for _, rt := range routes {
+		path, params := openAPIPath(rt.path)
+
+		op := openAPIOperation{
+			Summary:    rt.summary,
+			Parameters: append(params, rt.query...),
+			Responses: map[string]openAPIResponse{
+				"default": {Description: "A JSON response, or a JSON error response"},
+			},
+			XPermission: rt.permission,
+			XRateLimit:  rt.rateLimit.String(),
+		}
+
+		if rt.body != nil {
+			op.RequestBody = &openAPIRequestBody{
+				Required: true,
+				Content:  map[string]openAPIMediaType{"application/json": {Schema: rt.body}},
+			}
+		}
+
+		if rt.permission != "" || rt.activated {
+			op.Security = []map[string][]string{{"bearerAuth": {}}}
+		}
+
+		if doc.Paths[path] == nil {
+			doc.Paths[path] = map[string]openAPIOperation{}
+		}
+
+		doc.Paths[path][strings.ToLower(rt.method)] = op
+	}
+
+	return doc
+}
+
+// openAPIPath converts a httprouter path, such as "/v1/movies/:id", into an OpenAPI path, such
+// as "/v1/movies/{id}", and returns the path parameters. Catch-all parameters, such as "*key", are
+// converted in the same way. Parameters named id are integers, apart from those of the movie
+// routes, which can also be ULIDs (see readMovieIDParam).
+func openAPIPath(path string) (string, []openAPIParameter) {
+	var params []openAPIParameter
+
+	segments := strings.Split(path, "/")
+
+	for i, segment := range segments {
+		if !strings.HasPrefix(segment, ":") && !strings.HasPrefix(segment, "*") {
+			continue
+		}
+
+		name := segment[1:]
+
+		schema := &openAPISchema{Type: "string"}
+		if name == "id" && !strings.HasPrefix(path, "/v1/movies/") {
+			schema = integerSchema(1)
+		}
+
+		params = append(params, openAPIParameter{
+			Name:     name,
+			In:       "path",
+			Required: true,
+			Schema:   schema,
+		})
+
+		segments[i] = "{" + name + "}"
+	}
+
+	return strings.Join(segments, "/"), params
+}
+
+// runOpenAPICommand runs the "openapi" subcommand, which writes the OpenAPI document for every
+// route, including the operational routes, as JSON.
+func runOpenAPICommand(cfg config, w io.Writer) error {
+	app := &application{config: cfg}
+
+	doc := newOpenAPIDocument(append(app.routeTable(), app.operationalRouteTable()...))
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "\t")
+
+	return enc.Encode(doc)
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/codeaucafe/snippetbox/greenlight/internal/data"
+)
+
+const (
+	// outboxBatchSize is the number of outbox messages claimed by a worker at once.
+	outboxBatchSize = 20
+	// outboxLease is how long a worker has to deliver the messages it has claimed before they
+	// are delivered again by another worker.
+	outboxLease = 2 * time.Minute
+	// outboxMaxBackoff is the longest we wait between attempts to deliver a message.
+	outboxMaxBackoff = time.Hour
+)
+
+// outboxMetrics publishes the number of outbox messages delivered ("delivered"), the number of
+// failed delivery attempts ("retries"), and the number of messages given up on ("failed").
+var outboxMetrics = expvar.NewMap("outbox")
+
+// processOutbox claims a batch of messages which are due for delivery and delivers them. Failed
+// deliveries are retried with exponential backoff, up to data.MaxOutboxAttempts times. It
+// returns the number of messages claimed.
+func (app *application) processOutbox() int {
+	job := startJob("outbox")
+	defer job.finish()
+
+	messages, err := app.models.Outbox.ClaimDue(context.Background(), outboxBatchSize, outboxLease)
+	if err != nil {
+		job.fail()
+		app.logger.PrintError(err, nil)
+		return 0
+	}
+
+	for _, msg := range messages {
+		properties := map[string]string{
+			"outbox_id": strconv.FormatInt(msg.ID, 10),
+			"kind":      msg.Kind,
+			"attempt":   strconv.Itoa(msg.Attempts),
+		}
+
+		err := app.deliverOutboxMessage(msg)
+		if err != nil {
+			job.fail()
+			app.logger.PrintError(err, properties)
+
+			if msg.Attempts >= data.MaxOutboxAttempts {
+				outboxMetrics.Add("failed", 1)
+				outboxMessages.WithLabelValues(msg.Kind, "failed").Inc()
+			} else {
+				outboxMetrics.Add("retries", 1)
+				outboxMessages.WithLabelValues(msg.Kind, "retried").Inc()
+			}
+
+			err = app.models.Outbox.Retry(context.Background(), msg, outboxBackoff(msg.Attempts), err)
+			if err != nil {
+				app.logger.PrintError(err, properties)
+			}
+			continue
+		}
+
+		outboxMetrics.Add("delivered", 1)
+		outboxMessages.WithLabelValues(msg.Kind, "delivered").Inc()
+
+		err = app.models.Outbox.Delete(context.Background(), msg.ID)
+		if err != nil {
+			app.logger.PrintError(err, properties)
+		}
+	}
+
+	return len(messages)
+}
+
+// deliverOutboxMessage delivers a single outbox message according to its kind.
+func (app *application) deliverOutboxMessage(msg *data.OutboxMessage) error {
+	switch msg.Kind {
+	case data.OutboxKindEmail:
+		email, err := msg.DecodeEmail()
+		if err != nil {
+			return err
+		}
+
+		return app.sendEmail(email.Recipient, email.Template, email.Data)
+	default:
+		return fmt.Errorf("unknown outbox message kind %q", msg.Kind)
+	}
+}
+
+// outboxBackoff returns how long to wait before the next delivery attempt, after the given
+// number of attempts: 30 seconds after the first, doubling each time up to outboxMaxBackoff.
+func outboxBackoff(attempts int) time.Duration {
+	backoff := 30 * time.Second
+
+	for i := 1; i < attempts && backoff < outboxMaxBackoff; i++ {
+		backoff *= 2
+	}
+
+	if backoff > outboxMaxBackoff {
+		backoff = outboxMaxBackoff
+	}
+
+	return backoff
+}
+
+// processOutboxPeriodically delivers outbox messages until the application exits. If a full batch
+// was claimed there may be more messages waiting, so it carries on straight away, and otherwise
+// it waits for the poll interval.
+func (app *application) processOutboxPeriodically(interval time.Duration) {
+	for {
+		if app.processOutbox() < outboxBatchSize {
+			time.Sleep(interval)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/codeaucafe/snippetbox/greenlight/internal/data"
+	"github.com/codeaucafe/snippetbox/greenlight/internal/testutil"
+)
+
+// TestOutboxBackoff checks that the delay between delivery attempts doubles, up to the maximum.
+func TestOutboxBackoff(t *testing.T) {
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{attempts: 1, want: 30 * time.Second},
+		{attempts: 2, want: time.Minute},
+		{attempts: 4, want: 4 * time.Minute},
+		{attempts: 8, want: outboxMaxBackoff},
+		{attempts: 50, want: outboxMaxBackoff},
+	}
+
+	for _, tt := range tests {
+		testutil.Equal(t, outboxBackoff(tt.attempts), tt.want)
+	}
+}
+
+// TestOutboxRedactsFailedEmails checks that the secret data of an email is removed once it's been
+// given up on, and the rest of it is kept.
+func TestOutboxRedactsFailedEmails(t *testing.T) {
+	app, _ := newTestDBApp(t)
+
+	_, err := app.models.Outbox.DB.Exec(`
+		INSERT INTO outbox (kind, payload, attempts)
+		VALUES ('email', '{"recipient": "alice@example.com", "template": "user_welcome.tmpl",
+			"data": {"activationToken": "TOKEN", "userID": 1}, "secret": ["activationToken"]}', $1)`,
+		data.MaxOutboxAttempts-1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	messages, err := app.models.Outbox.ClaimDue(context.Background(), outboxBatchSize, outboxLease)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.Equal(t, len(messages), 1)
+
+	err = app.models.Outbox.Retry(context.Background(), messages[0], time.Minute, errors.New("mail server unavailable"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var payload []byte
+
+	err = app.models.Outbox.DB.QueryRow("SELECT payload FROM outbox WHERE id = $1", messages[0].ID).Scan(&payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg := data.OutboxMessage{Payload: payload}
+
+	email, err := msg.DecodeEmail()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, ok := email.Data["activationToken"]
+	testutil.Equal(t, ok, false)
+	testutil.Equal(t, email.Recipient, "alice@example.com")
+	testutil.Equal(t, len(email.Data), 1)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/codeaucafe/snippetbox/greenlight/internal/data"
+	"github.com/codeaucafe/snippetbox/greenlight/internal/testutil"
+)
+
+// TestPeople tests that people can be credited on a movie, that the cast are billed in the order
+// they're given and the top-billed cast are shown with the movie, and that changing a person
+// changes the version of the movies they're credited on.
+func TestPeople(t *testing.T) {
+	app, fx := newTestDBApp(t)
+	ts := newTestServer(app.routes())
+	defer ts.Close()
+
+	writer := fx.Token(fx.User(nil, "movies:read", "movies:write"), data.ScopeAuthentication)
+	movie := fx.Movie()
+
+	createPerson := func(name string) int64 {
+		t.Helper()
+
+		code, _, body := ts.request(t, http.MethodPost, "/v1/people", writer.Plaintext,
+			fmt.Sprintf(`{"name": %q}`, name))
+		testutil.Status(t, code, body, http.StatusCreated)
+
+		var created struct {
+			Person data.Person `json:"person"`
+		}
+		testutil.DecodeJSON(t, body, &created)
+
+		return created.Person.ID
+	}
+
+	bogart := createPerson("Humphrey Bogart")
+	bergman := createPerson("Ingrid Bergman")
+	curtiz := createPerson("Michael Curtiz")
+
+	creditsPath := fmt.Sprintf("/v1/movies/%d/credits", movie.ID)
+
+	code, _, body := ts.request(t, http.MethodPut, creditsPath, writer.Plaintext, fmt.Sprintf(`{"credits": [
+		{"person_id": %d, "role": "director"},
+		{"person_id": %d, "role": "cast", "character": "Rick Blaine"},
+		{"person_id": %d, "role": "cast", "character": "Ilsa Lund"}]}`, curtiz, bogart, bergman))
+	testutil.Status(t, code, body, http.StatusOK)
+
+	var credits struct {
+		Credits []data.Credit `json:"credits"`
+	}
+	testutil.DecodeJSON(t, body, &credits)
+
+	testutil.Equal(t, len(credits.Credits), 3)
+	testutil.Equal(t, credits.Credits[0].Name, "Humphrey Bogart")
+	testutil.Equal(t, credits.Credits[0].Billing, 1)
+	testutil.Equal(t, credits.Credits[1].Name, "Ingrid Bergman")
+	testutil.Equal(t, credits.Credits[2].Role, data.CreditRoleDirector)
+
+	moviePath := fmt.Sprintf("/v1/movies/%d", movie.ID)
+
+	code, headers, body := ts.request(t, http.MethodGet, moviePath, writer.Plaintext, "")
+	testutil.Status(t, code, body, http.StatusOK)
+
+	var shown struct {
+		Movie data.Movie `json:"movie"`
+	}
+	testutil.DecodeJSON(t, body, &shown)
+
+	testutil.Equal(t, len(shown.Movie.Cast), 2)
+	testutil.Equal(t, shown.Movie.Cast[0].Character, "Rick Blaine")
+
+	// Renaming one of the cast changes the movie's ETag.
+	code, _, body = ts.request(t, http.MethodPatch, fmt.Sprintf("/v1/people/%d", bogart), writer.Plaintext,
+		`{"name": "Humphrey DeForest Bogart"}`)
+	testutil.Status(t, code, body, http.StatusOK)
+
+	code, _, body = ts.requestWithHeaders(t, http.MethodGet, moviePath, writer.Plaintext, "",
+		http.Header{"If-None-Match": {headers.Get("ETag")}})
+	testutil.Status(t, code, body, http.StatusOK)
+	testutil.StringContains(t, string(body), "Humphrey DeForest Bogart")
+
+	// Credits can only be given to people who exist.
+	code, _, body = ts.request(t, http.MethodPut, creditsPath, writer.Plaintext,
+		`{"credits": [{"person_id": 999999, "role": "cast"}]}`)
+	testutil.Status(t, code, body, http.StatusUnprocessableEntity)
+
+	code, _, body = ts.request(t, http.MethodPut, creditsPath, writer.Plaintext,
+		fmt.Sprintf(`{"credits": [{"person_id": %d, "role": "director", "character": "Rick"}]}`, curtiz))
+	testutil.Status(t, code, body, http.StatusUnprocessableEntity)
+
+	// Deleting a person deletes their credits.
+	code, _, body = ts.request(t, http.MethodDelete, fmt.Sprintf("/v1/people/%d", bergman), writer.Plaintext, "")
+	testutil.Status(t, code, body, http.StatusOK)
+
+	code, _, body = ts.request(t, http.MethodGet, creditsPath, writer.Plaintext, "")
+	testutil.Status(t, code, body, http.StatusOK)
+	testutil.DecodeJSON(t, body, &credits)
+	testutil.Equal(t, len(credits.Credits), 2)
+
+	code, _, body = ts.request(t, http.MethodGet, "/v1/movies/999999/credits", writer.Plaintext, "")
+	testutil.Status(t, code, body, http.StatusNotFound)
+}
@@ -0,0 +1,403 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	_ "image/png" // Register the PNG decoder with image.Decode.
+	"io"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/codeaucafe/snippetbox/greenlight/internal/data"
+	"github.com/codeaucafe/snippetbox/greenlight/internal/validator"
+)
+
+const (
+	// posterStorageTimeout is how long the images of an uploaded poster can take to be written
+	// to storage.
+	posterStorageTimeout = time.Minute
+	// maxPosterPixels is the largest poster accepted, in pixels. The image is decoded in memory
+	// at 4 bytes a pixel, so this stops a small, highly compressed file from using up the memory.
+	maxPosterPixels = 25_000_000
+	// posterJPEGQuality is the quality the resized posters are encoded with.
+	posterJPEGQuality = 85
+)
+
+// posterSize is one of the standard sizes that posters are resized to.
+type posterSize struct {
+	name  string
+	width int
+}
+
+// posterSizes are the sizes that each poster is stored in, along with the original image. A
+// poster which is narrower than a size is stored at its own width instead of being enlarged.
+var posterSizes = []posterSize{
+	{name: "small", width: 185},
+	{name: "medium", width: 342},
+	{name: "large", width: 780},
+}
+
+// posterOriginal is the name the uploaded image is stored under, as it was uploaded.
+const posterOriginal = "original"
+
+// posterContentTypes are the types of image which can be uploaded as posters.
+var posterContentTypes = []string{"image/jpeg", "image/png"}
+
+// uploadPosterHandler handles the "POST /v1/movies/:id/poster" endpoint, which takes a
+// multipart/form-data body with the image in a "poster" field. The image must be a JPEG or PNG
+// no larger than -poster-max-size-mb; its type is worked out from its contents rather than
+// trusting the client. It's stored as it was uploaded and resized to each of the posterSizes,
+// and then replaces the movie's poster.
+//
+// As with "DELETE /v1/movies/:id", the client can send an If-Match header to only change the
+// poster if the movie hasn't been changed since they last read it.
+func (app *application) uploadPosterHandler(w http.ResponseWriter, r *http.Request) {
+	movie, ok := app.getMovieForPoster(w, r)
+	if !ok {
+		return
+	}
+
+	maxBytes := int64(app.config.posters.maxSizeMB) << 20
+
+	upload, err := readPosterUpload(w, r, maxBytes)
+	if err != nil {
+		switch {
+		case errors.Is(err, http.ErrNotMultipart):
+			app.unsupportedMediaTypeResponse(w, r, "multipart/form-data")
+		default:
+			app.badRequestResponse(w, r, err)
+		}
+		return
+	}
+
+	contentType := http.DetectContentType(upload)
+
+	v := validator.New()
+	v.Check(len(upload) > 0, "poster", "must be provided")
+	v.Check(int64(len(upload)) <= maxBytes, "poster",
+		fmt.Sprintf("must not be more than %d MB", app.config.posters.maxSizeMB))
+
+	if v.Valid() {
+		v.Check(validator.In(contentType, posterContentTypes...), "poster", "must be a JPEG or PNG image")
+	}
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	img, err := decodePoster(upload)
+	if err != nil {
+		v.AddError("poster", err.Error())
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	key := data.NewPosterKey(movie.ID, app.clock.Now())
+
+	err = app.storePoster(key, upload, contentType, img)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// If the movie can't be updated, the images which were just stored are left for the orphan
+	// cleanup to delete.
+	err = app.models.Movies.SetPoster(r.Context(), movie, key)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	headers := make(http.Header)
+	headers.Set("ETag", movieETag(movie))
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"movie": movie}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// deletePosterHandler handles the "DELETE /v1/movies/:id/poster" endpoint and removes a movie's
+// poster. Its images are deleted from storage by the orphan cleanup.
+func (app *application) deletePosterHandler(w http.ResponseWriter, r *http.Request) {
+	movie, ok := app.getMovieForPoster(w, r)
+	if !ok {
+		return
+	}
+
+	if movie.PosterKey == "" {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	err := app.models.Movies.SetPoster(r.Context(), movie, "")
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	headers := make(http.Header)
+	headers.Set("ETag", movieETag(movie))
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"movie": movie}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// showPosterHandler handles the "GET /v1/movies/:id/poster" endpoint, which is the poster_url of
+// a movie with a poster. It redirects to a signed URL for the poster image, so that the image is
+// downloaded straight from storage. The size query string parameter picks one of the
+// posterSizes, or "original" for the image as it was uploaded, and defaults to "medium".
+func (app *application) showPosterHandler(w http.ResponseWriter, r *http.Request) {
+	v := validator.New()
+
+	size := app.readStrings(r.URL.Query(), "size", "medium")
+
+	names := []string{posterOriginal}
+	for _, s := range posterSizes {
+		names = append(names, s.name)
+	}
+
+	if v.Check(validator.In(size, names...), "size", "must be one of small, medium, large or original"); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	id, err := app.readMovieIDParam(r)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	movie, err := app.models.Movies.Get(r.Context(), id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if movie.PosterKey == "" {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	url, err := app.signedURL(r, movie.PosterKey+"/"+size)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	http.Redirect(w, r, url, http.StatusFound)
+}
+
+// getMovieForPoster fetches the movie named by the request for changing its poster, checking
+// the request's If-Match header against it if there is one. If the movie can't be found, or
+// has changed, or anything else goes wrong, it sends the error response and returns false.
+func (app *application) getMovieForPoster(w http.ResponseWriter, r *http.Request) (*data.Movie, bool) {
+	id, err := app.readMovieIDParam(r)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil, false
+	}
+
+	movie, err := app.models.Movies.Get(r.Context(), id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil, false
+	}
+
+	if ifMatch := r.Header.Get("If-Match"); ifMatch != "" && !movieETagMatches(ifMatch, movie) {
+		app.preconditionFailedResponse(w, r)
+		return nil, false
+	}
+
+	return movie, true
+}
+
+// readPosterUpload reads the "poster" field of a multipart/form-data request body. The body is
+// streamed rather than parsed with ParseMultipartForm, so that the upload is never written to a
+// temporary file. At most maxBytes+1 bytes of the poster are read, so that the caller can tell
+// whether it was too large. http.ErrNotMultipart is returned if the body isn't multipart.
+func readPosterUpload(w http.ResponseWriter, r *http.Request, maxBytes int64) ([]byte, error) {
+	// Allow a little extra room in the body for the multipart headers and any other fields.
+	r.Body = http.MaxBytesReader(w, r.Body, maxBytes+64*1024)
+
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		part, err := mr.NextPart()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil, nil
+			}
+			return nil, posterBodyError(err, maxBytes)
+		}
+
+		if part.FormName() != "poster" {
+			continue
+		}
+
+		upload, err := io.ReadAll(io.LimitReader(part, maxBytes+1))
+		if err != nil {
+			return nil, posterBodyError(err, maxBytes)
+		}
+
+		return upload, nil
+	}
+}
+
+// posterBodyError turns an error from reading a poster upload into a message for the client.
+func posterBodyError(err error, maxBytes int64) error {
+	switch {
+	case err.Error() == "http: request body too large":
+		return fmt.Errorf("body must not be larger than %d bytes", maxBytes)
+	default:
+		return fmt.Errorf("body contains badly-formed multipart data: %w", err)
+	}
+}
+
+// decodePoster decodes an uploaded poster image, checking its dimensions before decoding it, so
+// that an image which is too large is never held in memory.
+func decodePoster(upload []byte) (image.Image, error) {
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(upload))
+	if err != nil {
+		return nil, errors.New("must be a valid JPEG or PNG image")
+	}
+
+	if cfg.Width*cfg.Height > maxPosterPixels {
+		return nil, fmt.Errorf("must not be more than %d pixels", maxPosterPixels)
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(upload))
+	if err != nil {
+		return nil, errors.New("must be a valid JPEG or PNG image")
+	}
+
+	return img, nil
+}
+
+// storePoster writes a poster to storage under key: the upload as it is, and a JPEG of each of
+// the posterSizes.
+func (app *application) storePoster(key string, upload []byte, contentType string, img image.Image) error {
+	ctx, cancel := context.WithTimeout(context.Background(), posterStorageTimeout)
+	defer cancel()
+
+	_, err := app.storage.Put(ctx, key+"/"+posterOriginal, bytes.NewReader(upload), contentType)
+	if err != nil {
+		return err
+	}
+
+	src := toRGBA(img)
+
+	for _, size := range posterSizes {
+		var buf bytes.Buffer
+
+		err = jpeg.Encode(&buf, resizeImage(src, size.width), &jpeg.Options{Quality: posterJPEGQuality})
+		if err != nil {
+			return err
+		}
+
+		_, err = app.storage.Put(ctx, key+"/"+size.name, &buf, "image/jpeg")
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// toRGBA converts an image to an RGBA image with its origin at (0, 0).
+func toRGBA(img image.Image) *image.RGBA {
+	b := img.Bounds()
+	rgba := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(rgba, rgba.Bounds(), img, b.Min, draw.Src)
+
+	return rgba
+}
+
+// resizeImage scales an image down to the given width, keeping its aspect ratio. Each pixel of
+// the result is the average of the pixels it covers in the source (a box filter), which is
+// simple and gives good results when shrinking. An image which is already no wider than width
+// is returned as it is.
+func resizeImage(src *image.RGBA, width int) *image.RGBA {
+	sw, sh := src.Bounds().Dx(), src.Bounds().Dy()
+	if sw <= width {
+		return src
+	}
+
+	height := int(math.Max(1, math.Round(float64(sh)*float64(width)/float64(sw))))
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+
+	for y := 0; y < height; y++ {
+		y0, y1 := y*sh/height, (y+1)*sh/height
+		if y1 == y0 {
+			y1 = y0 + 1
+		}
+
+		for x := 0; x < width; x++ {
+			x0, x1 := x*sw/width, (x+1)*sw/width
+			if x1 == x0 {
+				x1 = x0 + 1
+			}
+
+			var sum [4]int
+			for sy := y0; sy < y1; sy++ {
+				off := src.PixOffset(x0, sy)
+				for sx := x0; sx < x1; sx++ {
+					for c := 0; c < 4; c++ {
+						sum[c] += int(src.Pix[off+c])
+					}
+					off += 4
+				}
+			}
+
+			n := (y1 - y0) * (x1 - x0)
+			off := dst.PixOffset(x, y)
+			for c := 0; c < 4; c++ {
+				dst.Pix[off+c] = uint8(sum[c] / n)
+			}
+		}
+	}
+
+	return dst
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"mime/multipart"
+	"net/http"
+	"testing"
+
+	"github.com/codeaucafe/snippetbox/greenlight/internal/data"
+	"github.com/codeaucafe/snippetbox/greenlight/internal/testutil"
+)
+
+// TestResizeImage tests that images are scaled down to the given width, keeping their aspect
+// ratio, that each pixel is the average of the pixels it covers, and that narrower images are
+// left as they are.
+func TestResizeImage(t *testing.T) {
+	src := image.NewRGBA(image.Rect(0, 0, 400, 600))
+	for y := 0; y < 600; y++ {
+		for x := 0; x < 400; x++ {
+			// Alternate black and white columns, which average to grey.
+			if x%2 == 0 {
+				src.Set(x, y, color.RGBA{R: 255, G: 255, B: 255, A: 255})
+			} else {
+				src.Set(x, y, color.RGBA{A: 255})
+			}
+		}
+	}
+
+	resized := resizeImage(src, 200)
+	testutil.Equal(t, resized.Bounds().Dx(), 200)
+	testutil.Equal(t, resized.Bounds().Dy(), 300)
+	testutil.Equal(t, resized.RGBAAt(10, 10), color.RGBA{R: 127, G: 127, B: 127, A: 255})
+
+	testutil.Equal(t, resizeImage(src, 780), src)
+}
+
+// TestUploadPoster tests that a poster can be uploaded for a movie, that it's served in each
+// size from the movie's poster_url, and that uploads which aren't images are rejected.
+func TestUploadPoster(t *testing.T) {
+	app, fx := newTestDBApp(t)
+	ts := newTestServer(app.routes())
+	defer ts.Close()
+
+	writer := fx.Token(fx.User(nil, "movies:read", "movies:write"), data.ScopeAuthentication)
+	movie := fx.Movie()
+
+	upload := func(contents []byte) (int, []byte) {
+		t.Helper()
+
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+
+		part, err := mw.CreateFormFile("poster", "poster.png")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = part.Write(contents); err != nil {
+			t.Fatal(err)
+		}
+		if err = mw.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		code, _, respBody := ts.requestWithHeaders(t, http.MethodPost, fmt.Sprintf("/v1/movies/%d/poster", movie.ID),
+			writer.Plaintext, body.String(), http.Header{"Content-Type": {mw.FormDataContentType()}})
+		return code, respBody
+	}
+
+	var img bytes.Buffer
+	if err := png.Encode(&img, image.NewRGBA(image.Rect(0, 0, 500, 750))); err != nil {
+		t.Fatal(err)
+	}
+
+	code, body := upload([]byte("not an image"))
+	testutil.Status(t, code, body, http.StatusUnprocessableEntity)
+
+	code, body = upload(img.Bytes())
+	testutil.Status(t, code, body, http.StatusOK)
+
+	var uploaded struct {
+		Movie data.Movie `json:"movie"`
+	}
+	testutil.DecodeJSON(t, body, &uploaded)
+	testutil.Equal(t, uploaded.Movie.PosterURL, fmt.Sprintf("/v1/movies/%d/poster", movie.ID))
+	testutil.Equal(t, uploaded.Movie.Version, movie.Version+1)
+
+	for size, width := range map[string]int{"small": 185, "large": 500, "original": 500} {
+		code, headers, body := ts.request(t, http.MethodGet, uploaded.Movie.PosterURL+"?size="+size,
+			writer.Plaintext, "")
+		testutil.Status(t, code, body, http.StatusFound)
+
+		code, _, body = ts.get(t, headers.Get("Location"))
+		testutil.Status(t, code, body, http.StatusOK)
+
+		cfg, _, err := image.DecodeConfig(bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		testutil.Equal(t, cfg.Width, width)
+	}
+
+	code, _, body = ts.request(t, http.MethodGet, uploaded.Movie.PosterURL+"?size=huge", writer.Plaintext, "")
+	testutil.Status(t, code, body, http.StatusUnprocessableEntity)
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/codeaucafe/snippetbox/greenlight/internal/data"
+	"github.com/codeaucafe/snippetbox/greenlight/internal/mailer"
+	"github.com/felixge/httpsnoop"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// The Prometheus metrics are registered with the default registry, which also holds the Go
+// runtime and process metrics, and are served in the Prometheus text format by "GET /metrics".
+// They supplement the expvar metrics served by "GET /debug/vars", which are kept for existing
+// dashboards.
+var (
+	// httpRequestsTotal counts the responses sent, by route pattern and status code.
+	httpRequestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "greenlight",
+		Name:      "http_requests_total",
+		Help:      "Number of HTTP requests handled, by route and status code.",
+	}, []string{"route", "status"})
+
+	// httpRequestDuration observes how long requests take to handle, by route pattern.
+	httpRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "greenlight",
+		Name:      "http_request_duration_seconds",
+		Help:      "Time taken to handle HTTP requests, by route.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route"})
+
+	// httpRequestsInFlight is the number of requests currently being handled.
+	httpRequestsInFlight = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "greenlight",
+		Name:      "http_requests_in_flight",
+		Help:      "Number of HTTP requests currently being handled.",
+	})
+
+	// rateLimitRejections counts the requests rejected with a 429 Too Many Requests response, by
+	// the limit which rejected them: "ip" for the per-IP rate limits, "user" for the per-user rate
+	// limit, "email" for the per-address email limit, "quota" for the usage quotas, and
+	// "search_quota" for the daily quota of the public search endpoint.
+	rateLimitRejections = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "greenlight",
+		Name:      "rate_limit_rejections_total",
+		Help:      "Number of requests rejected by a rate limit or quota, by limit.",
+	}, []string{"limit"})
+
+	// botRejections counts the requests to public endpoints rejected by a bot detector, by the
+	// reason the detector gave.
+	botRejections = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "greenlight",
+		Name:      "bot_rejections_total",
+		Help:      "Number of requests rejected as coming from a bot, by reason.",
+	}, []string{"reason"})
+
+	// searchCacheHits counts the public searches served from the search result cache.
+	searchCacheHits = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "greenlight",
+		Name:      "search_cache_hits_total",
+		Help:      "Number of public searches served from the result cache.",
+	})
+
+	// emailFailures counts the emails which the background jobs failed to send, by template.
+	// Outbox emails which are retried are counted on each failed attempt.
+	emailFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "greenlight",
+		Name:      "email_failures_total",
+		Help:      "Number of failed attempts to send an email in the background, by template.",
+	}, []string{"template"})
+
+	// outboxMessages counts the outbox delivery attempts, by message kind and result: "delivered",
+	// "retried" (the attempt failed and will be tried again) or "failed" (the message has been
+	// given up on).
+	outboxMessages = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "greenlight",
+		Name:      "outbox_messages_total",
+		Help:      "Number of outbox delivery attempts, by message kind and result.",
+	}, []string{"kind", "result"})
+
+	// jobRuns counts the runs of the background jobs, by job and result ("success" or "failure").
+	jobRuns = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "greenlight",
+		Name:      "job_runs_total",
+		Help:      "Number of background job runs, by job and result.",
+	}, []string{"job", "result"})
+
+	// jobDuration observes how long the background jobs take to run, by job.
+	jobDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "greenlight",
+		Name:      "job_duration_seconds",
+		Help:      "Time taken to run background jobs, by job.",
+		Buckets:   prometheus.ExponentialBuckets(0.01, 4, 8),
+	}, []string{"job"})
+
+	// jobLastRun and jobLastSuccess hold the Unix time at which each background job last finished
+	// and last succeeded, so that operators can alert on jobs which have stopped running or keep
+	// failing.
+	jobLastRun = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "greenlight",
+		Name:      "job_last_run_timestamp_seconds",
+		Help:      "Unix time at which each background job last finished.",
+	}, []string{"job"})
+
+	jobLastSuccess = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "greenlight",
+		Name:      "job_last_success_timestamp_seconds",
+		Help:      "Unix time at which each background job last succeeded.",
+	}, []string{"job"})
+)
+
+// unmatchedRoute is the route label used for requests which don't match any route, so that
+// scanning for random paths can't create an unbounded number of time series.
+const unmatchedRoute = "unmatched"
+
+// instrument is middleware which records the Prometheus request metrics. Requests are labelled
+// by their route pattern (such as "GET /v1/movies/:id") rather than their URL path, which is
+// read from the routeInfo that the router fills in, so it must wrap the cacheControl middleware
+// (or add the routeInfo itself).
+func (app *application) instrument(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r, route := app.contextSetRouteInfo(r)
+
+		httpRequestsInFlight.Inc()
+		defer httpRequestsInFlight.Dec()
+
+		metrics := httpsnoop.CaptureMetrics(next, w, r)
+
+		pattern := route.pattern
+		if pattern == "" {
+			pattern = unmatchedRoute
+		}
+
+		httpRequestsTotal.WithLabelValues(pattern, strconv.Itoa(metrics.Code)).Inc()
+		httpRequestDuration.WithLabelValues(pattern).Observe(metrics.Duration.Seconds())
+	})
+}
+
+// sendEmail sends an email from a background job with app.mailer, tracing the send in an
+// "smtp.send" span and counting the failures in the greenlight_email_failures_total metric.
+func (app *application) sendEmail(recipient, templateFile string, data interface{}, attachments ...mailer.Attachment) error {
+	_, span := tracer().Start(context.Background(), "smtp.send",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("email.template", templateFile)),
+	)
+	defer span.End()
+
+	err := app.mailer.Send(recipient, templateFile, data, attachments...)
+	if err != nil {
+		emailFailures.WithLabelValues(templateFile).Inc()
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "send failed")
+	}
+
+	return err
+}
+
+// jobRun records a single run of a background job in the job metrics. A job calls startJob()
+// when it starts, fail() for anything which goes wrong, and finish() (usually deferred) when
+// it's done.
+type jobRun struct {
+	name   string
+	start  time.Time
+	failed bool
+}
+
+// startJob starts recording a run of the named job.
+func startJob(name string) *jobRun {
+	return &jobRun{name: name, start: time.Now()}
+}
+
+// fail marks the run as failed. The run carries on, so that a job which works through a batch
+// can fail once for each item and still be recorded as a single failed run.
+func (j *jobRun) fail() {
+	j.failed = true
+}
+
+// finish records the result and duration of the run.
+func (j *jobRun) finish() {
+	now := time.Now()
+
+	jobDuration.WithLabelValues(j.name).Observe(now.Sub(j.start).Seconds())
+	jobLastRun.WithLabelValues(j.name).Set(float64(now.Unix()))
+
+	if j.failed {
+		jobRuns.WithLabelValues(j.name, "failure").Inc()
+		return
+	}
+
+	jobRuns.WithLabelValues(j.name, "success").Inc()
+	jobLastSuccess.WithLabelValues(j.name).Set(float64(now.Unix()))
+}
+
+// queueCollector is a Prometheus collector which reports the depth of the outbox, the task queue
+// and the webhook deliveries, and the age of the oldest item in each, so that operators can alert
+// on a backlog which isn't being worked through. The queues are read from the database each time
+// the metrics are scraped.
+type queueCollector struct {
+	queues    map[string]func(context.Context) (data.QueueStats, error)
+	depth     *prometheus.Desc
+	oldestAge *prometheus.Desc
+	errors    *prometheus.Desc
+}
+
+// newQueueCollector returns a queueCollector for the queues in the given models.
+func newQueueCollector(models data.Models) *queueCollector {
+	return &queueCollector{
+		queues: map[string]func(context.Context) (data.QueueStats, error){
+			"outbox":   models.Outbox.Stats,
+			"tasks":    models.Tasks.Stats,
+			"webhooks": models.Webhooks.Stats,
+		},
+		depth: prometheus.NewDesc("greenlight_queue_depth",
+			"Number of items waiting in each queue.", []string{"queue"}, nil),
+		oldestAge: prometheus.NewDesc("greenlight_queue_oldest_age_seconds",
+			"Age of the oldest item waiting in each queue.", []string{"queue"}, nil),
+		errors: prometheus.NewDesc("greenlight_queue_scrape_error",
+			"Whether reading each queue failed (1) or not (0) during the scrape.", []string{"queue"}, nil),
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (c *queueCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.depth
+	ch <- c.oldestAge
+	ch <- c.errors
+}
+
+// Collect implements prometheus.Collector. A queue which can't be read is reported through the
+// scrape error metric rather than failing the whole scrape.
+func (c *queueCollector) Collect(ch chan<- prometheus.Metric) {
+	for queue, stats := range c.queues {
+		s, err := stats(context.Background())
+		if err != nil {
+			ch <- prometheus.MustNewConstMetric(c.errors, prometheus.GaugeValue, 1, queue)
+			continue
+		}
+
+		ch <- prometheus.MustNewConstMetric(c.errors, prometheus.GaugeValue, 0, queue)
+		ch <- prometheus.MustNewConstMetric(c.depth, prometheus.GaugeValue, float64(s.Depth), queue)
+		ch <- prometheus.MustNewConstMetric(c.oldestAge, prometheus.GaugeValue, s.OldestAge.Seconds(), queue)
+	}
+}
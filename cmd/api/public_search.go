@@ -0,0 +1,319 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/codeaucafe/snippetbox/greenlight/internal/data"
+	"github.com/codeaucafe/snippetbox/greenlight/internal/validator"
+)
+
+// The public search endpoint is unauthenticated, so it only serves the first few pages of
+// results, a few at a time. That's plenty for a search box on the public website, but makes it
+// slow work to scrape the whole catalog through it.
+const (
+	publicSearchMaxPage     = 10
+	publicSearchMaxPageSize = 20
+)
+
+// publicSearchResult is a movie in the results of the public search endpoint. It only has the
+// fields which the public website shows, and identifies the movie by its ULID, so that the
+// sequential IDs and the rest of the movie's details stay behind the authenticated API.
+type publicSearchResult struct {
+	ID        string   `json:"id"`
+	Title     string   `json:"title"`
+	Year      int32    `json:"year,omitempty"`
+	Genres    []string `json:"genres,omitempty"`
+	Highlight string   `json:"highlight"`
+}
+
+// publicSearchPage is a page of public search results, as it's kept in the searchCache.
+type publicSearchPage struct {
+	Results  []publicSearchResult
+	Metadata data.Metadata
+}
+
+// publicSearchHandler handles the "GET /v1/search" endpoint, which is an unauthenticated
+// full-text search of the movie titles for the public website. It works in the same way as
+// "GET /v1/movies/search", but only returns a few fields of each movie, and only the first
+// publicSearchMaxPage pages of results. For example:
+//
+//	GET /v1/search?q=star+wa&page=1&page_size=10
+//
+// The same searches come up again and again, so the results are kept in the searchCache for the
+// -search-cache-ttl duration, as well as being cacheable by any HTTP cache for the
+// -search-max-age duration. Clients are held to the stricter rateLimitSearch limits, and
+// requests which look like they come from bots are turned away (see detectBots()).
+func (app *application) publicSearchHandler(w http.ResponseWriter, r *http.Request) {
+	v := validator.New()
+	qs := r.URL.Query()
+
+	q := app.readStrings(qs, "q", "")
+
+	filters := data.Filters{
+		Page:         app.readInt(qs, "page", 1, v),
+		PageSize:     app.readInt(qs, "page_size", 10, v),
+		Sort:         "-rank",
+		SortSafeList: []string{"-rank"},
+	}
+
+	data.ValidateTextQuery(v, q)
+	v.Check(filters.Page <= publicSearchMaxPage, "page",
+		fmt.Sprintf("must be a maximum of %d", publicSearchMaxPage))
+	v.Check(filters.PageSize <= publicSearchMaxPageSize, "page_size",
+		fmt.Sprintf("must be a maximum of %d", publicSearchMaxPageSize))
+
+	if data.ValidateFilters(v, filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// Searches which only differ in case or punctuation match the same movies, so they share a
+	// cache entry.
+	key := fmt.Sprintf("%s|%d|%d", normalizeSearchQuery(q), filters.Page, filters.PageSize)
+
+	page, ok := app.searchCache.get(key)
+	if !ok {
+		matches, metadata, err := app.models.Movies.TextSearch(r.Context(), q, filters)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		page = publicSearchPage{Results: make([]publicSearchResult, len(matches)), Metadata: metadata}
+
+		for i, match := range matches {
+			page.Results[i] = publicSearchResult{
+				ID:        match.Movie.ULID,
+				Title:     match.Movie.Title,
+				Year:      match.Movie.Year,
+				Genres:    match.Movie.Genres,
+				Highlight: match.Highlight,
+			}
+		}
+
+		app.searchCache.set(key, page)
+	}
+
+	err := app.writeJSON(w, http.StatusOK, envelope{"results": page.Results, "metadata": page.Metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// normalizeSearchQuery returns a full-text search query in a canonical form: lower case, with
+// anything other than letters and digits treated as a word separator.
+func normalizeSearchQuery(q string) string {
+	return strings.Join(strings.FieldsFunc(strings.ToLower(q), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}), " ")
+}
+
+// searchCache is a small in-memory cache of public search results, which expire after a fixed
+// TTL. Each instance of the API has its own cache, which is fine as the results are the same
+// whichever instance serves them; they may just be up to one TTL out of date.
+//
+// A nil *searchCache is valid, and never caches anything.
+type searchCache struct {
+	mu      sync.Mutex
+	now     func() time.Time
+	ttl     time.Duration
+	size    int
+	entries map[string]searchCacheEntry
+}
+
+// searchCacheEntry is a page of results in the searchCache, along with the time it expires.
+type searchCacheEntry struct {
+	page    publicSearchPage
+	expires time.Time
+}
+
+// newSearchCache returns a new searchCache which holds up to size pages of results for ttl,
+// using now to tell the time.
+func newSearchCache(ttl time.Duration, size int, now func() time.Time) *searchCache {
+	return &searchCache{
+		now:     now,
+		ttl:     ttl,
+		size:    size,
+		entries: make(map[string]searchCacheEntry),
+	}
+}
+
+// get returns the cached page of results for key, if there is one and it hasn't expired.
+func (c *searchCache) get(key string) (publicSearchPage, bool) {
+	if c == nil {
+		return publicSearchPage{}, false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[key]
+	if !ok || !c.now().Before(entry.expires) {
+		return publicSearchPage{}, false
+	}
+
+	searchCacheHits.Inc()
+	return entry.page, true
+}
+
+// set caches a page of results for key. If the cache is full then the expired entries are
+// removed first, and if it's still full an arbitrary entry is evicted to make room.
+func (c *searchCache) set(key string, page publicSearchPage) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.now()
+
+	if _, ok := c.entries[key]; !ok && len(c.entries) >= c.size {
+		for k, entry := range c.entries {
+			if !now.Before(entry.expires) {
+				delete(c.entries, k)
+			}
+		}
+
+		for k := range c.entries {
+			if len(c.entries) < c.size {
+				break
+			}
+			delete(c.entries, k)
+		}
+	}
+
+	c.entries[key] = searchCacheEntry{page: page, expires: now.Add(c.ttl)}
+}
+
+// publicSearchLimiter enforces the limits on the routes in the rateLimitSearch class: a
+// per-second rate limit from the -search-rps and -search-burst flags, and a daily quota from
+// the -search-daily-quota flag. Both are keyed by the client's IP address (see clientIP()), as
+// the clients are anonymous.
+type publicSearchLimiter struct {
+	app   *application
+	rate  *rateLimiter
+	quota *rateLimiter
+}
+
+// newPublicSearchLimiter returns a new publicSearchLimiter. The daily quota is a token bucket
+// which holds a whole day's requests and refills at the rate of one day's quota per day, so a
+// client which uses up its quota gets a little of it back over the course of the day, rather
+// than all of it at midnight.
+func (app *application) newPublicSearchLimiter() *publicSearchLimiter {
+	return &publicSearchLimiter{
+		app: app,
+		rate: app.newRateLimiter("search", func() (bool, float64, int) {
+			return app.settings.get().LimiterEnabled, app.config.search.rps, app.config.search.burst
+		}),
+		quota: app.newRateLimiter("search-quota", func() (bool, float64, int) {
+			daily := app.config.search.dailyQuota
+			return app.settings.get().LimiterEnabled && daily > 0, float64(daily) / (24 * time.Hour).Seconds(), daily
+		}),
+	}
+}
+
+// limit is middleware which sends a 429 Too Many Requests response to clients which have used
+// up their rate limit or their daily quota.
+func (l *publicSearchLimiter) limit(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ip := l.app.clientIP(r)
+
+		allowed, err := l.rate.allow(ip)
+		if err != nil {
+			l.app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		if !allowed {
+			l.app.rateLimitExceededResponse(w, r)
+			return
+		}
+
+		allowed, err = l.quota.allow(ip)
+		if err != nil {
+			l.app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		if !allowed {
+			// The bucket gets a request back every day/quota, so that's when the client can
+			// try again.
+			retryAfter := math.Ceil((24 * time.Hour).Seconds() / float64(l.app.config.search.dailyQuota))
+			w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter)))
+			l.app.searchQuotaExceededResponse(w, r)
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+// botDetector is a hook which checks whether a request to a public endpoint looks like it comes
+// from a bot, such as a scraper working through the catalog. If it does then it returns true,
+// along with a short reason, which is used as the label of the bot_rejections_total metric.
+type botDetector func(r *http.Request) (reason string, bot bool)
+
+// defaultBotDetectors returns the bot detectors enabled by the configuration: requests without
+// a User-Agent header are always rejected, and so are those whose User-Agent contains one of the
+// words in the -search-blocked-agents flag, if it's set.
+func (app *application) defaultBotDetectors() []botDetector {
+	detectors := []botDetector{missingUserAgentDetector}
+
+	if len(app.config.search.blockedAgents) > 0 {
+		detectors = append(detectors, blockedAgentsDetector(app.config.search.blockedAgents))
+	}
+
+	return detectors
+}
+
+// missingUserAgentDetector treats requests without a User-Agent header as bots. Browsers always
+// send one, so these are scripts.
+func missingUserAgentDetector(r *http.Request) (string, bool) {
+	if strings.TrimSpace(r.UserAgent()) == "" {
+		return "missing_user_agent", true
+	}
+	return "", false
+}
+
+// blockedAgentsDetector returns a bot detector which treats requests as bots if their
+// User-Agent header contains any of the words, ignoring case.
+func blockedAgentsDetector(words []string) botDetector {
+	lowered := make([]string, len(words))
+	for i, word := range words {
+		lowered[i] = strings.ToLower(word)
+	}
+
+	return func(r *http.Request) (string, bool) {
+		agent := strings.ToLower(r.UserAgent())
+		for _, word := range lowered {
+			if strings.Contains(agent, word) {
+				return "blocked_user_agent", true
+			}
+		}
+		return "", false
+	}
+}
+
+// detectBots is middleware which runs the bot detectors, and sends a 403 Forbidden response to
+// requests that any of them flag.
+func (app *application) detectBots(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		for _, detect := range app.botDetectors {
+			if reason, bot := detect(r); bot {
+				botRejections.WithLabelValues(reason).Inc()
+				app.botDetectedResponse(w, r)
+				return
+			}
+		}
+
+		next(w, r)
+	}
+}
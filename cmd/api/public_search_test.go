@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+
+	"github.com/codeaucafe/snippetbox/greenlight/internal/clock"
+	"github.com/codeaucafe/snippetbox/greenlight/internal/data"
+	"github.com/codeaucafe/snippetbox/greenlight/internal/testutil"
+)
+
+// TestPublicSearch tests that the public search endpoint turns away bots, holds clients to its
+// rate limit and daily quota, and that its results expire from the search cache.
+func TestPublicSearch(t *testing.T) {
+	app := newTestApp()
+	app.config.search.rps = 1
+	app.config.search.burst = 3
+	app.config.search.dailyQuota = 2
+	app.config.search.blockedAgents = []string{"Scrapy"}
+	app.botDetectors = app.defaultBotDetectors()
+
+	settings := app.settings.get()
+	settings.LimiterEnabled = true
+	app.settings.set(settings)
+
+	cr := newCORSRouter(httprouter.New(), app.defaultCORSPolicy())
+	app.registerRoutes(cr, append(app.routeTable(), app.operationalRouteTable()...))
+
+	send := func(target, agent string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		r := app.contextSetUser(httptest.NewRequest(http.MethodGet, target, nil), data.AnonymousUser)
+		r.Header.Set("User-Agent", agent)
+		cr.ServeHTTP(rr, r)
+		return rr
+	}
+
+	// Bots are turned away before they count against the limits.
+	testutil.Equal(t, send("/v1/search?q=star", "").Code, http.StatusForbidden)
+	testutil.Equal(t, send("/v1/search?q=star", "Scrapy/2.11 (+https://scrapy.org)").Code, http.StatusForbidden)
+
+	// Only the first few pages can be read. These requests fail validation, so they don't reach
+	// the database, but they still count towards the quota, and the third one is over it.
+	rr := send("/v1/search?q=star&page=11", "Mozilla/5.0")
+	testutil.Status(t, rr.Code, rr.Body.Bytes(), http.StatusUnprocessableEntity)
+	testutil.StringContains(t, rr.Body.String(), "must be a maximum of 10")
+
+	testutil.Equal(t, send("/v1/search?q=star&page_size=21", "Mozilla/5.0").Code, http.StatusUnprocessableEntity)
+
+	rr = send("/v1/search?q=star&page=11", "Mozilla/5.0")
+	testutil.Equal(t, rr.Code, http.StatusTooManyRequests)
+	testutil.Equal(t, rr.Header().Get("Retry-After"), "43200")
+
+	testutil.Equal(t, cachePolicies(app.routeTable())["GET /v1/search"], cachePublic(app.config.search.maxAge))
+
+	// Searches which only differ in case and punctuation share a cache entry, until it expires.
+	cache := newSearchCache(time.Minute, 2, app.clock.Now)
+
+	cache.set(normalizeSearchQuery("Star  Wars!")+"|1|10", publicSearchPage{Results: []publicSearchResult{{Title: "Star Wars"}}})
+
+	page, ok := cache.get(normalizeSearchQuery("star wars") + "|1|10")
+	testutil.Equal(t, ok, true)
+	testutil.Equal(t, page.Results[0].Title, "Star Wars")
+
+	app.clock.(*clock.Mock).Advance(time.Minute)
+
+	_, ok = cache.get(normalizeSearchQuery("star wars") + "|1|10")
+	testutil.Equal(t, ok, false)
+}
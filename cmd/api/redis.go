@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/redis/go-redis/v9"
+
+	"github.com/codeaucafe/snippetbox/greenlight/internal/clock"
+	"github.com/codeaucafe/snippetbox/greenlight/internal/jsonlog"
+)
+
+// redisRetryInterval is how long the features which use Redis stick to their fallback after Redis
+// fails, before they try it again.
+const redisRetryInterval = 5 * time.Second
+
+var (
+	// redisDegraded is 1 while Redis is unavailable and the features which use it are falling
+	// back, and 0 otherwise.
+	redisDegraded = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "greenlight",
+		Name:      "redis_degraded",
+		Help:      "Whether Redis is unavailable and its features are falling back (1) or not (0).",
+	})
+
+	// redisFallbacks counts the operations which used the fallback rather than Redis, by
+	// feature.
+	redisFallbacks = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "greenlight",
+		Name:      "redis_fallbacks_total",
+		Help:      "Number of operations which fell back because Redis was unavailable, by feature.",
+	}, []string{"feature"})
+)
+
+// newRedisClient returns a client for the Redis server at the given URL. The client connects
+// lazily, so this only fails if the URL is invalid.
+func newRedisClient(url string) (*redis.Client, error) {
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, err
+	}
+
+	return redis.NewClient(opts), nil
+}
+
+// pingRedis checks that the Redis server can be reached within the timeout.
+func pingRedis(client *redis.Client, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	return client.Ping(ctx).Err()
+}
+
+// redisStatus tracks whether Redis is available. Redis is a soft dependency: the features which
+// use it (such as the redis rate limiter store) fall back to working without it when it fails,
+// rather than failing the request, and report the failure here. The application is then
+// degraded, which is logged once when it starts and once when it ends, and shows up in the
+// redis_degraded metric and the healthcheck.
+//
+// While Redis is degraded the features don't wait on it for every request. Only one operation
+// every redisRetryInterval tries Redis, and the rest go straight to their fallback, until Redis
+// answers again.
+type redisStatus struct {
+	logger *jsonlog.Logger
+	clock  clock.Clock
+
+	mu       sync.Mutex
+	degraded bool
+	since    time.Time
+	retryAt  time.Time
+	lastErr  error
+}
+
+// newRedisStatus returns a redisStatus which starts out assuming that Redis is available.
+func newRedisStatus(logger *jsonlog.Logger, c clock.Clock) *redisStatus {
+	return &redisStatus{logger: logger, clock: c}
+}
+
+// available reports whether an operation should try Redis. It's always true unless Redis is
+// degraded, in which case it's true for one caller every redisRetryInterval.
+func (s *redisStatus) available() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.degraded {
+		return true
+	}
+
+	now := s.clock.Now()
+	if now.Before(s.retryAt) {
+		return false
+	}
+
+	s.retryAt = now.Add(redisRetryInterval)
+	return true
+}
+
+// failed records that a feature couldn't use Redis, and is falling back.
+func (s *redisStatus) failed(feature string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.clock.Now()
+
+	if !s.degraded {
+		s.degraded = true
+		s.since = now
+		redisDegraded.Set(1)
+
+		s.logger.PrintError(fmt.Errorf("redis unavailable, falling back: %w", err), map[string]string{
+			"feature": feature,
+		})
+	}
+
+	s.retryAt = now.Add(redisRetryInterval)
+	s.lastErr = err
+}
+
+// succeeded records that Redis answered, which ends a degraded state.
+func (s *redisStatus) succeeded() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.degraded {
+		return
+	}
+
+	s.degraded = false
+	redisDegraded.Set(0)
+
+	s.logger.PrintInfo("redis available again", map[string]string{
+		"degraded_for": s.clock.Now().Sub(s.since).Round(time.Second).String(),
+	})
+}
+
+// healthCheck returns a health check which pings Redis. Redis being unavailable only makes the
+// application degraded, as the features which use it fall back.
+func (s *redisStatus) healthCheck(client *redis.Client, timeout time.Duration) healthCheck {
+	return healthCheck{
+		name: "redis",
+		run: func() error {
+			err := pingRedis(client, timeout)
+			if err != nil {
+				s.failed("healthcheck", err)
+				return fmt.Errorf("%w: %s (falling back)", errHealthDegraded, err)
+			}
+
+			s.succeeded()
+			return nil
+		},
+	}
+}
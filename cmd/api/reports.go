@@ -0,0 +1,427 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+
+	"github.com/codeaucafe/snippetbox/greenlight/internal/data"
+	"github.com/codeaucafe/snippetbox/greenlight/internal/validator"
+)
+
+// reportTable holds the generated contents of a report, before it is rendered in the requested
+// format.
+type reportTable struct {
+	columns []string
+	rows    [][]interface{}
+}
+
+// reportType describes a kind of report which can be requested through the "POST /v1/reports"
+// endpoint: the permission needed to request it, how to validate its parameters, and how to
+// generate it. The generate function should call progress with the percentage complete as it
+// goes, for long-running reports.
+type reportType struct {
+	permission string
+	validate   func(app *application, v *validator.Validator, params url.Values)
+	generate   func(app *application, params url.Values, progress func(int)) (*reportTable, error)
+}
+
+// reportTypes holds the reports which can be requested, keyed by the name used in the API.
+var reportTypes = map[string]reportType{
+	"catalog_summary": {
+		permission: "movies:read",
+		generate:   (*application).generateCatalogSummaryReport,
+	},
+	"user_activity": {
+		permission: "usage:admin",
+		validate:   (*application).validateUserActivityReport,
+		generate:   (*application).generateUserActivityReport,
+	},
+}
+
+// reportTypeNames returns the names of the report types, in alphabetical order.
+func reportTypeNames() []string {
+	names := make([]string, 0, len(reportTypes))
+	for name := range reportTypes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// generateCatalogSummaryReport generates a report with the number of movies, average runtime and
+// range of release years for each genre in the catalog.
+func (app *application) generateCatalogSummaryReport(_ url.Values, _ func(int)) (*reportTable, error) {
+	summary, err := app.models.Reports.GenreSummary(context.Background())
+	if err != nil {
+		return nil, err
+	}
+
+	table := &reportTable{columns: []string{"genre", "movies", "average_runtime", "earliest_year", "latest_year"}}
+
+	for _, genre := range summary {
+		table.rows = append(table.rows, []interface{}{
+			genre.Genre, genre.Movies, genre.AverageRuntime, genre.EarliestYear, genre.LatestYear,
+		})
+	}
+
+	return table, nil
+}
+
+// validateUserActivityReport checks the from and to parameters of a user activity report, in the
+// same way as for the "GET /v1/admin/usage" endpoint.
+func (app *application) validateUserActivityReport(v *validator.Validator, params url.Values) {
+	data.ValidateUsageFilters(v, app.userActivityFilters(v, params))
+}
+
+// generateUserActivityReport generates a report with the number of requests made by each user
+// on each day between the from and to parameters.
+func (app *application) generateUserActivityReport(params url.Values, _ func(int)) (*reportTable, error) {
+	filters := app.userActivityFilters(validator.New(), params)
+
+	usage, err := app.models.Usage.GetReport(context.Background(), filters)
+	if err != nil {
+		return nil, err
+	}
+
+	table := &reportTable{columns: []string{"day", "user_id", "requests", "bytes_in", "bytes_out"}}
+
+	for _, row := range usage {
+		table.rows = append(table.rows, []interface{}{row.Day, row.UserID, row.Requests, row.BytesIn, row.BytesOut})
+	}
+
+	return table, nil
+}
+
+// userActivityFilters returns the usage filters for a user activity report, which defaults to
+// the last 30 days.
+func (app *application) userActivityFilters(v *validator.Validator, params url.Values) data.UsageFilters {
+	today := data.QuotaPeriodStart(data.QuotaPeriodDay, app.clock.Now())
+
+	return data.UsageFilters{
+		From:    app.readDate(params, "from", today.AddDate(0, 0, -30), v),
+		To:      app.readDate(params, "to", today, v),
+		GroupBy: []string{"day", "user"},
+		Limit:   1000,
+	}
+}
+
+// createReportHandler handles the "POST /v1/reports" endpoint. It validates the request and
+// queues a task to generate the report, returning a 202 Accepted response with the task, which
+// the client can poll for the progress of the report.
+func (app *application) createReportHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Type   string            `json:"type"`
+		Format string            `json:"format"`
+		Params map[string]string `json:"params"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	if input.Format == "" {
+		input.Format = "json"
+	}
+
+	v := validator.New()
+
+	rt, ok := reportTypes[input.Type]
+	v.Check(ok, "type", "invalid report type")
+	v.Check(validator.In(input.Format, data.ReportFormats...), "format", "must be one of csv or json")
+
+	if ok && rt.validate != nil {
+		rt.validate(app, v, reportParams(input.Params))
+	}
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	// Check that the user has the permission needed for this type of report.
+	permissions, err := app.models.Permissions.GetAllForUser(r.Context(), user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if !permissions.Include(rt.permission) {
+		app.notPermittedResponse(w, r)
+		return
+	}
+
+	report := &data.Report{
+		UserID: user.ID,
+		Type:   input.Type,
+		Format: input.Format,
+		Params: input.Params,
+	}
+
+	task := &data.Task{}
+
+	err = app.models.Reports.Insert(r.Context(), report, task)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.taskAcceptedResponse(w, r, task, envelope{"report": report})
+}
+
+// showReportHandler handles the "GET /v1/reports/:id" endpoint and returns the status and
+// progress of a report. Once the report has completed, the response includes a signed
+// download_url, which can be handed to something that doesn't have the user's credentials (such
+// as a browser) to download the report directly from storage.
+func (app *application) showReportHandler(w http.ResponseWriter, r *http.Request) {
+	report, ok := app.getReport(w, r)
+	if !ok {
+		return
+	}
+
+	env := envelope{"report": report}
+
+	if report.ArtifactKey != "" {
+		downloadURL, err := app.signedURL(r, report.ArtifactKey)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		env["download_url"] = downloadURL
+	}
+
+	err := app.writeJSON(w, http.StatusOK, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// downloadReportHandler handles the "GET /v1/reports/:id/download" endpoint and sends the
+// rendered report as a file download, once it has completed.
+func (app *application) downloadReportHandler(w http.ResponseWriter, r *http.Request) {
+	report, ok := app.getReport(w, r)
+	if !ok {
+		return
+	}
+
+	if report.Status != data.ReportStatusCompleted {
+		app.reportNotReadyResponse(w, r, report.Status)
+		return
+	}
+
+	filename := fmt.Sprintf("report-%d.%s", report.ID, report.Format)
+
+	if report.ArtifactKey != "" {
+		app.sendObject(w, r, report.ArtifactKey, filename)
+		return
+	}
+
+	// Reports which were completed before rendered reports were moved to object storage are
+	// still in the database.
+	artifact, err := app.models.Reports.GetArtifact(r.Context(), report.ID, report.UserID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	contentType := "application/json"
+	if report.Format == "csv" {
+		contentType = "text/csv"
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`"`)
+	w.Header().Set("Content-Length", strconv.Itoa(len(artifact)))
+
+	_, err = w.Write(artifact)
+	if err != nil {
+		app.logError(r, err)
+	}
+}
+
+// getReport reads the ID parameter from the request and fetches the matching report for the
+// current user. If the report can't be found, or anything else goes wrong, it sends the error
+// response and returns false.
+func (app *application) getReport(w http.ResponseWriter, r *http.Request) (*data.Report, bool) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return nil, false
+	}
+
+	report, err := app.models.Reports.Get(r.Context(), id, app.contextGetUser(r).ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil, false
+	}
+
+	return report, true
+}
+
+// runReportTask runs a report task: it generates the report named in the task's params, and
+// returns the location where the report can be downloaded.
+func (app *application) runReportTask(task *data.Task, progress func(int)) (string, error) {
+	id, err := strconv.ParseInt(task.Params["report_id"], 10, 64)
+	if err != nil {
+		return "", fmt.Errorf("invalid report_id %q", task.Params["report_id"])
+	}
+
+	report, err := app.models.Reports.Start(context.Background(), id)
+	if err != nil {
+		return "", err
+	}
+
+	err = app.generateReport(report, progress)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("/v1/reports/%d/download", report.ID), nil
+}
+
+// generateReport generates and renders a single report, recording the result (or the failure)
+// against it. Progress is reported to the report and to the task that's generating it.
+func (app *application) generateReport(report *data.Report, taskProgress func(int)) (err error) {
+	properties := map[string]string{
+		"report_id": strconv.FormatInt(report.ID, 10),
+		"type":      report.Type,
+	}
+
+	fail := func(cause error) error {
+		err := app.models.Reports.Fail(context.Background(), report.ID, cause.Error())
+		if err != nil {
+			app.logger.PrintError(err, properties)
+		}
+
+		return cause
+	}
+
+	// Recover any panic in the report generator, so that it fails the report rather than
+	// bringing down the worker.
+	defer func() {
+		if rec := recover(); rec != nil {
+			err = fail(fmt.Errorf("%s", rec))
+		}
+	}()
+
+	rt, ok := reportTypes[report.Type]
+	if !ok {
+		return fail(fmt.Errorf("unknown report type %q", report.Type))
+	}
+
+	progress := func(percent int) {
+		err := app.models.Reports.UpdateProgress(context.Background(), report.ID, percent)
+		if err != nil {
+			app.logger.PrintError(err, properties)
+		}
+
+		taskProgress(percent)
+	}
+
+	table, err := rt.generate(app, reportParams(report.Params), progress)
+	if err != nil {
+		return fail(err)
+	}
+
+	contentType := "application/json"
+	if report.Format == "csv" {
+		contentType = "text/csv"
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), storagePutTimeout)
+	defer cancel()
+
+	key := fmt.Sprintf("reports/%d.%s", report.ID, report.Format)
+
+	_, err = app.putObject(ctx, key, contentType, func(w io.Writer) error {
+		return table.render(w, report.Format)
+	})
+	if err != nil {
+		return fail(err)
+	}
+
+	err = app.models.Reports.Complete(ctx, report.ID, key)
+	if err != nil {
+		return fail(err)
+	}
+
+	app.logger.PrintInfo("report generated", properties)
+
+	return nil
+}
+
+// render writes the report table to w in the given format, a row at a time. JSON reports are an
+// array with an object for each row.
+func (t *reportTable) render(w io.Writer, format string) error {
+	switch format {
+	case "json":
+		return writeJSONArray(w, len(t.rows), func(i int) interface{} {
+			row := make(map[string]interface{}, len(t.columns))
+			for j, column := range t.columns {
+				row[column] = t.rows[i][j]
+			}
+			return row
+		})
+
+	case "csv":
+		cw := csv.NewWriter(w)
+
+		err := cw.Write(t.columns)
+		if err != nil {
+			return err
+		}
+
+		for _, row := range t.rows {
+			record := make([]string, len(row))
+			for i, value := range row {
+				record[i] = fmt.Sprint(value)
+			}
+
+			err := cw.Write(record)
+			if err != nil {
+				return err
+			}
+		}
+
+		cw.Flush()
+
+		return cw.Error()
+
+	default:
+		return fmt.Errorf("unsupported report format %q", format)
+	}
+}
+
+// reportParams converts the parameters of a report to url.Values, so that we can read them with
+// the same helpers as query string parameters.
+func reportParams(params map[string]string) url.Values {
+	values := make(url.Values, len(params))
+
+	for key, value := range params {
+		values.Set(key, value)
+	}
+
+	return values
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/codeaucafe/snippetbox/greenlight/internal/data"
+	"github.com/codeaucafe/snippetbox/greenlight/internal/testutil"
+)
+
+// TestReports tests that reports are validated and checked against the permission for their type
+// when they're requested, and that they can only be downloaded by their owner once they have
+// been generated.
+func TestReports(t *testing.T) {
+	app, fx := newTestDBApp(t)
+	ts := newTestServer(app.routes())
+	defer ts.Close()
+
+	fx.Movie(func(m *data.Movie) { m.Genres = []string{"sci-fi"} })
+	token := fx.Token(fx.User(nil, "movies:read"), data.ScopeAuthentication)
+	other := fx.Token(fx.User(nil, "movies:read"), data.ScopeAuthentication)
+
+	tests := []struct {
+		name     string
+		body     string
+		wantCode int
+	}{
+		{"unknown type", `{"type": "nonsense"}`, http.StatusUnprocessableEntity},
+		{"unknown format", `{"type": "catalog_summary", "format": "xml"}`, http.StatusUnprocessableEntity},
+		{"invalid params", `{"type": "user_activity", "params": {"from": "yesterday"}}`, http.StatusUnprocessableEntity},
+		{"missing permission", `{"type": "user_activity"}`, http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, _, body := ts.request(t, http.MethodPost, "/v1/reports", token.Plaintext, tt.body)
+			testutil.Status(t, code, body, tt.wantCode)
+		})
+	}
+
+	code, _, body := ts.request(t, http.MethodPost, "/v1/reports", token.Plaintext,
+		`{"type": "catalog_summary", "format": "csv"}`)
+	testutil.Status(t, code, body, http.StatusAccepted)
+
+	var accepted struct {
+		Report data.Report `json:"report"`
+	}
+	testutil.DecodeJSON(t, body, &accepted)
+
+	reportPath := fmt.Sprintf("/v1/reports/%d", accepted.Report.ID)
+
+	code, _, body = ts.request(t, http.MethodGet, reportPath+"/download", token.Plaintext, "")
+	testutil.Status(t, code, body, http.StatusConflict)
+
+	task, err := app.models.Tasks.ClaimNext(context.Background(), taskStaleAfter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	app.runTask(task)
+
+	code, _, body = ts.request(t, http.MethodGet, reportPath, other.Plaintext, "")
+	testutil.Status(t, code, body, http.StatusNotFound)
+
+	code, _, body = ts.request(t, http.MethodGet, reportPath, token.Plaintext, "")
+	testutil.Status(t, code, body, http.StatusOK)
+
+	var shown struct {
+		Report      data.Report `json:"report"`
+		DownloadURL string      `json:"download_url"`
+	}
+	testutil.DecodeJSON(t, body, &shown)
+	testutil.Equal(t, shown.Report.Status, data.ReportStatusCompleted)
+	testutil.Equal(t, shown.DownloadURL != "", true)
+
+	code, _, body = ts.request(t, http.MethodGet, reportPath+"/download", other.Plaintext, "")
+	testutil.Status(t, code, body, http.StatusNotFound)
+
+	code, header, body := ts.request(t, http.MethodGet, reportPath+"/download", token.Plaintext, "")
+	testutil.Status(t, code, body, http.StatusOK)
+	testutil.Equal(t, header.Get("Content-Type"), "text/csv")
+	testutil.StringContains(t, string(body), "sci-fi,1,")
+}
+
+// TestReportTableRender tests that report tables are rendered with a header row in CSV and as an
+// array of objects in JSON.
+func TestReportTableRender(t *testing.T) {
+	table := &reportTable{
+		columns: []string{"day", "user_id", "requests"},
+		rows: [][]interface{}{
+			{"2022-06-01", int64(1), int64(3)},
+			{"2022-06-02", int64(2), int64(5)},
+		},
+	}
+
+	tests := []struct {
+		format string
+		want   string
+	}{
+		{"csv", "day,user_id,requests\n2022-06-01,1,3\n2022-06-02,2,5\n"},
+		{"json", `[{"day":"2022-06-01","requests":3,"user_id":1},{"day":"2022-06-02","requests":5,"user_id":2}]`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := table.render(&buf, tt.format); err != nil {
+				t.Fatal(err)
+			}
+
+			got := buf.String()
+			if tt.format == "json" {
+				var compacted bytes.Buffer
+				if err := json.Compact(&compacted, buf.Bytes()); err != nil {
+					t.Fatal(err)
+				}
+				got = compacted.String()
+			}
+			testutil.Equal(t, got, tt.want)
+		})
+	}
+
+	err := table.render(&bytes.Buffer{}, "xml")
+	if err == nil {
+		t.Error("want an error for an unsupported format")
+	}
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/codeaucafe/snippetbox/greenlight/internal/data"
+	"github.com/codeaucafe/snippetbox/greenlight/internal/testutil"
+)
+
+// TestReviews tests creating, updating and deleting reviews through the
+// "/v1/movies/:id/reviews" endpoints, and the average rating on the movie.
+func TestReviews(t *testing.T) {
+	app, fx := newTestDBApp(t)
+	ts := newTestServer(app.routes())
+	defer ts.Close()
+
+	movie := fx.Movie()
+	alice := fx.Token(fx.User(nil, "movies:read"), data.ScopeAuthentication)
+	bob := fx.Token(fx.User(nil, "movies:read"), data.ScopeAuthentication)
+
+	reviewsPath := fmt.Sprintf("/v1/movies/%d/reviews", movie.ID)
+
+	averageRating := func() *float64 {
+		code, _, body := ts.request(t, http.MethodGet, fmt.Sprintf("/v1/movies/%d", movie.ID), alice.Plaintext, "")
+		testutil.Status(t, code, body, http.StatusOK)
+
+		var got struct {
+			Movie data.Movie `json:"movie"`
+		}
+		testutil.DecodeJSON(t, body, &got)
+
+		return got.Movie.AverageRating
+	}
+
+	if rating := averageRating(); rating != nil {
+		t.Fatalf("got average_rating %v; want null", *rating)
+	}
+
+	code, _, body := ts.request(t, http.MethodPost, reviewsPath, alice.Plaintext, `{"rating": 8, "body": "Great"}`)
+	testutil.Status(t, code, body, http.StatusCreated)
+
+	code, _, body = ts.request(t, http.MethodPost, reviewsPath, bob.Plaintext, `{"rating": 5}`)
+	testutil.Status(t, code, body, http.StatusCreated)
+
+	// Each user can only review a movie once, and ratings must be between 1 and 10.
+	code, _, body = ts.request(t, http.MethodPost, reviewsPath, alice.Plaintext, `{"rating": 9}`)
+	testutil.Status(t, code, body, http.StatusUnprocessableEntity)
+
+	code, _, body = ts.request(t, http.MethodPatch, reviewsPath, bob.Plaintext, `{"rating": 11}`)
+	testutil.Status(t, code, body, http.StatusUnprocessableEntity)
+
+	testutil.Equal(t, *averageRating(), 6.5)
+
+	code, _, body = ts.request(t, http.MethodPatch, reviewsPath, bob.Plaintext, `{"rating": 10}`)
+	testutil.Status(t, code, body, http.StatusOK)
+
+	testutil.Equal(t, *averageRating(), 9.0)
+
+	code, _, body = ts.request(t, http.MethodDelete, reviewsPath, alice.Plaintext, "")
+	testutil.Status(t, code, body, http.StatusOK)
+
+	code, _, body = ts.request(t, http.MethodGet, reviewsPath, alice.Plaintext, "")
+	testutil.Status(t, code, body, http.StatusOK)
+
+	var list struct {
+		Reviews []data.Review `json:"reviews"`
+	}
+	testutil.DecodeJSON(t, body, &list)
+
+	testutil.Equal(t, len(list.Reviews), 1)
+	testutil.Equal(t, list.Reviews[0].Rating, 10)
+
+	code, _, body = ts.request(t, http.MethodGet, "/v1/movies/999999/reviews", alice.Plaintext, "")
+	testutil.Status(t, code, body, http.StatusNotFound)
+}
+
+// TestModerateReview tests that new reviews are approved straight away or held for a moderator,
+// depending on the auto-approve setting and the blocked words filter.
+func TestModerateReview(t *testing.T) {
+	tests := []struct {
+		name        string
+		autoApprove bool
+		body        string
+		wantStatus  string
+		wantNote    string
+	}{
+		{name: "auto-approved", autoApprove: true, body: "A classic.", wantStatus: data.ReviewStatusApproved},
+		{name: "moderated", autoApprove: false, body: "A classic.", wantStatus: data.ReviewStatusPending},
+		{name: "blocked word", autoApprove: true, body: "What a DARN mess.", wantStatus: data.ReviewStatusPending,
+			wantNote: "contains a blocked word"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApp()
+			app.config.reviews.autoApprove = tt.autoApprove
+			app.reviewFilters = []reviewFilter{blockedWordsFilter([]string{"darn", "ass"})}
+
+			review := &data.Review{Rating: 5, Body: tt.body}
+			app.moderateReview(review)
+
+			testutil.Equal(t, review.Status, tt.wantStatus)
+			testutil.Equal(t, review.ModerationNote, tt.wantNote)
+		})
+	}
+}
+
+// TestModerationQueue tests that pending reviews are hidden until a moderator approves them, and
+// that the moderator can only make the decisions allowed by the review's status, and that their
+// decision stands until the review's body is edited.
+func TestModerationQueue(t *testing.T) {
+	app, fx := newTestDBApp(t)
+	app.config.reviews.autoApprove = false
+
+	ts := newTestServer(app.routes())
+	defer ts.Close()
+
+	movie := fx.Movie()
+	author := fx.Token(fx.User(nil, "movies:read"), data.ScopeAuthentication)
+	moderator := fx.Token(fx.User(nil, "reviews:moderate"), data.ScopeAuthentication)
+
+	reviewsPath := fmt.Sprintf("/v1/movies/%d/reviews", movie.ID)
+
+	code, _, body := ts.request(t, http.MethodPost, reviewsPath, author.Plaintext, `{"rating": 7, "body": "Fine"}`)
+	testutil.Status(t, code, body, http.StatusCreated)
+
+	var created struct {
+		Review data.Review `json:"review"`
+	}
+	testutil.DecodeJSON(t, body, &created)
+	testutil.Equal(t, created.Review.Status, data.ReviewStatusPending)
+
+	listed := func(path, token string) int {
+		t.Helper()
+
+		code, _, body := ts.request(t, http.MethodGet, path, token, "")
+		testutil.Status(t, code, body, http.StatusOK)
+
+		var got struct {
+			Reviews []data.Review `json:"reviews"`
+		}
+		testutil.DecodeJSON(t, body, &got)
+
+		return len(got.Reviews)
+	}
+
+	testutil.Equal(t, listed(reviewsPath, author.Plaintext), 0)
+	testutil.Equal(t, listed("/v1/admin/reviews", moderator.Plaintext), 1)
+
+	moderatePath := fmt.Sprintf("/v1/admin/reviews/%d", created.Review.ID)
+
+	code, _, body = ts.request(t, http.MethodPatch, moderatePath, moderator.Plaintext, `{"status": "approved"}`)
+	testutil.Status(t, code, body, http.StatusOK)
+
+	testutil.Equal(t, listed(reviewsPath, author.Plaintext), 1)
+	testutil.Equal(t, listed("/v1/admin/reviews", moderator.Plaintext), 0)
+
+	// The review has already been approved.
+	code, _, body = ts.request(t, http.MethodPatch, moderatePath, moderator.Plaintext, `{"status": "approved"}`)
+	testutil.Status(t, code, body, http.StatusUnprocessableEntity)
+
+	// Changing the rating keeps the moderator's decision, but changing the body doesn't.
+	moderatedBy := func() *int64 {
+		t.Helper()
+
+		review, err := app.models.Reviews.Get(context.Background(), created.Review.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return review.ModeratedBy
+	}
+
+	code, _, body = ts.request(t, http.MethodPatch, reviewsPath, author.Plaintext, `{"rating": 8}`)
+	testutil.Status(t, code, body, http.StatusOK)
+	testutil.Equal(t, listed(reviewsPath, author.Plaintext), 1)
+	testutil.Equal(t, moderatedBy() != nil, true)
+
+	code, _, body = ts.request(t, http.MethodPatch, reviewsPath, author.Plaintext, `{"body": "Better than I thought"}`)
+	testutil.Status(t, code, body, http.StatusOK)
+	testutil.Equal(t, listed(reviewsPath, author.Plaintext), 0)
+	testutil.Equal(t, moderatedBy() == nil, true)
+}
+
+// TestAbuseReports tests reporting a review, and that the moderators are emailed about the first
+// open report of a review and can close its reports together.
+func TestAbuseReports(t *testing.T) {
+	app, fx := newTestDBApp(t)
+	ts := newTestServer(app.routes())
+	defer ts.Close()
+
+	movie := fx.Movie()
+	author := fx.Token(fx.User(nil, "movies:read"), data.ScopeAuthentication)
+	alice := fx.Token(fx.User(nil, "movies:read"), data.ScopeAuthentication)
+	bob := fx.Token(fx.User(nil, "movies:read"), data.ScopeAuthentication)
+	moderator := fx.Token(fx.User(nil, "reviews:moderate"), data.ScopeAuthentication)
+
+	code, _, body := ts.request(t, http.MethodPost, fmt.Sprintf("/v1/movies/%d/reviews", movie.ID),
+		author.Plaintext, `{"rating": 1, "body": "Buy cheap watches"}`)
+	testutil.Status(t, code, body, http.StatusCreated)
+
+	var created struct {
+		Review data.Review `json:"review"`
+	}
+	testutil.DecodeJSON(t, body, &created)
+
+	reportPath := fmt.Sprintf("/v1/reviews/%d/report", created.Review.ID)
+
+	code, _, body = ts.request(t, http.MethodPost, reportPath, alice.Plaintext, `{"reason": "spam"}`)
+	testutil.Status(t, code, body, http.StatusCreated)
+
+	var report struct {
+		Report data.AbuseReport `json:"report"`
+	}
+	testutil.DecodeJSON(t, body, &report)
+
+	// Each user can only report a review once, and authors can't report their own reviews.
+	code, _, body = ts.request(t, http.MethodPost, reportPath, alice.Plaintext, `{"reason": "offensive"}`)
+	testutil.Status(t, code, body, http.StatusUnprocessableEntity)
+
+	code, _, body = ts.request(t, http.MethodPost, reportPath, author.Plaintext, `{"reason": "spam"}`)
+	testutil.Status(t, code, body, http.StatusUnprocessableEntity)
+
+	code, _, body = ts.request(t, http.MethodPost, reportPath, bob.Plaintext, `{"reason": "other", "details": "Ads"}`)
+	testutil.Status(t, code, body, http.StatusCreated)
+
+	// Only the first report emails the moderator.
+	testutil.Equal(t, app.processOutbox(), 1)
+
+	code, _, body = ts.request(t, http.MethodGet, "/v1/admin/abuse-reports", moderator.Plaintext, "")
+	testutil.Status(t, code, body, http.StatusOK)
+
+	var queue struct {
+		Reports []data.AbuseReport `json:"reports"`
+	}
+	testutil.DecodeJSON(t, body, &queue)
+	testutil.Equal(t, len(queue.Reports), 2)
+	testutil.Equal(t, queue.Reports[0].Review.Body, "Buy cheap watches")
+
+	resolvePath := fmt.Sprintf("/v1/admin/abuse-reports/%d", report.Report.ID)
+
+	code, _, body = ts.request(t, http.MethodPatch, resolvePath, moderator.Plaintext, `{"status": "resolved"}`)
+	testutil.Status(t, code, body, http.StatusOK)
+
+	var resolved struct {
+		Closed int `json:"closed"`
+	}
+	testutil.DecodeJSON(t, body, &resolved)
+	testutil.Equal(t, resolved.Closed, 2)
+
+	code, _, body = ts.request(t, http.MethodPatch, resolvePath, moderator.Plaintext, `{"status": "dismissed"}`)
+	testutil.Status(t, code, body, http.StatusUnprocessableEntity)
+}
@@ -0,0 +1,655 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/codeaucafe/snippetbox/greenlight/internal/data"
+)
+
+// rateLimitClass is the class of rate limit applied to a route. Every request is subject to
+// the default rate limit (see rateLimit()), and routes in a stricter class are subject to a
+// second, shared, limit as well.
+type rateLimitClass int
+
+const (
+	// rateLimitDefault routes are only subject to the default rate limit.
+	rateLimitDefault rateLimitClass = iota
+	// rateLimitAuth routes are the endpoints which check passwords or tokens, or which send
+	// emails, and are also subject to the -limiter-auth-rps and -limiter-auth-burst limit.
+	rateLimitAuth
+	// rateLimitSearch routes are the unauthenticated public search endpoints, which are also
+	// subject to the -search-rps and -search-burst limit and the -search-daily-quota quota, and
+	// which turn away requests that look like they come from bots.
+	rateLimitSearch
+)
+
+// String returns the name of the rate limit class, as shown by the routes subcommand.
+func (c rateLimitClass) String() string {
+	switch c {
+	case rateLimitAuth:
+		return "auth"
+	case rateLimitSearch:
+		return "search"
+	default:
+		return "default"
+	}
+}
+
+// routePriority is the priority of a route's traffic. Low priority routes are the first to be
+// turned away while the application is shedding load (see loadShedder).
+type routePriority int
+
+const (
+	// priorityNormal routes are always served.
+	priorityNormal routePriority = iota
+	// priorityLow routes are the expensive list and search endpoints, which are sent a 503
+	// Service Unavailable response while load is being shed.
+	priorityLow
+)
+
+// String returns the name of the priority, as shown by the routes subcommand.
+func (p routePriority) String() string {
+	switch p {
+	case priorityLow:
+		return "low"
+	default:
+		return "normal"
+	}
+}
+
+// route describes a single endpoint: the method and path it's served on, its handler, and the
+// middleware that applies to it. The route tables (see routeTable()) are the single place that
+// endpoints are declared, and they're used to register the endpoints with the router, to build
+// the Cache-Control policies, and to generate the routes listing and OpenAPI document.
+type route struct {
+	method  string
+	path    string
+	handler http.HandlerFunc
+	// summary is a short description of the endpoint, used in the OpenAPI document.
+	summary string
+	// permission is the permission code which the user must have to call the endpoint. If it's
+	// empty and activated is true, then any activated user can call it, and if both are unset
+	// then anyone can call it.
+	permission string
+	activated  bool
+	// cors is the CORS policy for the route. The zero value means the default policy.
+	cors corsPolicy
+	// cache is the Cache-Control policy for successful responses. The zero value means
+	// no-store.
+	cache string
+	// etag is whether the route supports conditional GET requests, with an ETag on successful
+	// responses and a 304 Not Modified response when the client's copy is current (see
+	// conditionalGET()).
+	etag bool
+	// rateLimit is the class of rate limit that applies to the route.
+	rateLimit rateLimitClass
+	// priority is the priority of the route's traffic while load is being shed.
+	priority routePriority
+	// fields holds the fields of the route's resources which clients can select with the fields
+	// query string parameter, for a partial response (see selectableFields()). If it's nil then
+	// the route doesn't support partial responses.
+	fields []string
+	// query and body describe the route's query string parameters and JSON request body, for the
+	// OpenAPI document. When request validation is enabled, requests are checked against them
+	// before the handler runs (see validateRequest()). Parameters which aren't described aren't
+	// checked, and neither is the body of a route without a body schema. Every route which reads a
+	// JSON body has a body schema; the bulk import and poster upload don't, as their bodies
+	// aren't JSON objects.
+	query []openAPIParameter
+	body  *openAPISchema
+}
+
+// pattern returns the route pattern, such as "GET /v1/movies/:id".
+func (rt route) pattern() string {
+	return rt.method + " " + rt.path
+}
+
+// access returns a description of who can call the route.
+func (rt route) access() string {
+	switch {
+	case rt.permission != "":
+		return rt.permission
+	case rt.activated:
+		return "activated"
+	default:
+		return "public"
+	}
+}
+
+// routeTable returns the routes served by the public listener, apart from the operational
+// routes (see operationalRouteTable()).
+func (app *application) routeTable() []route {
+	// Define the CORS policies for our route groups. Public read endpoints can be called from
+	// any of the public origins (any origin by default), while the token endpoints are restricted
+	// to the first-party web app origins. Routes which aren't given a policy use the default
+	// policy built from the -cors-trusted-origins flag.
+	publicCORS := newCORSPolicy(app.config.cors.publicOrigins)
+	firstPartyCORS := newCORSPolicy(app.config.cors.firstPartyOrigins)
+
+	// The catalog routes need the movies:read permission, so their responses can only be cached
+	// by the client's own cache, for the -cache-catalog-max-age duration. Only the anonymous
+	// routes, such as the public search, are cached publicly.
+	catalog := cachePrivate(app.config.cache.catalogMaxAge)
+
+	// The GraphQL resolvers are backed by the same models as the REST endpoints.
+	graphqlExec := app.newGraphQLExecutor()
+
+	// The public search results are cached for longer, for the -search-max-age duration, as
+	// the endpoint is open to everyone.
+	search := cachePublic(app.config.search.maxAge)
+
+	// The request bodies of the movie endpoints. Runtimes can be given as a number of minutes or
+	// as a string in one of several formats (see data.Runtime), so their schema allows any value.
+	limits := app.config.movieLimits
+	movie := func() *openAPISchema {
+		return objectSchema(map[string]*openAPISchema{
+			"title":        stringSchema(limits.MaxTitleBytes),
+			"year":         integerSchema(int64(limits.EarliestYear)),
+			"runtime":      {},
+			"release_date": formatSchema("date").nullable(),
+			"genres":       arraySchema(stringSchema(0), 1, limits.MaxGenres).unique(),
+		})
+	}
+	review := func() *openAPISchema {
+		return objectSchema(map[string]*openAPISchema{
+			"rating": integerSchema(1).atMost(10),
+			"body":   textSchema(10_000),
+		})
+	}
+	password := func() *openAPISchema {
+		return &openAPISchema{Type: "string", MinLength: intPtr(8), MaxLength: intPtr(72)}
+	}
+	credentials := func() *openAPISchema {
+		return objectSchema(map[string]*openAPISchema{
+			"email":    formatSchema("email"),
+			"password": password(),
+		}).required("email", "password")
+	}
+	person := func() *openAPISchema {
+		return objectSchema(map[string]*openAPISchema{
+			"name":       stringSchema(500),
+			"birth_year": integerSchema(0),
+			"bio":        textSchema(10_000),
+		})
+	}
+
+	// The request bodies which hold a single token, such as an activation token, or a single
+	// email address. The password confirmations aren't checked against the password rules, as
+	// the handlers report a password which doesn't match in their own way.
+	token := func(name string) *openAPISchema {
+		return objectSchema(map[string]*openAPISchema{name: stringSchema(26)}).required(name)
+	}
+	email := func() *openAPISchema {
+		return objectSchema(map[string]*openAPISchema{"email": formatSchema("email")}).required("email")
+	}
+
+	// Search filters are trees of predicates (see data.SearchFilter), which the handlers check
+	// for themselves, so only their type is described.
+	filter := func() *openAPISchema {
+		return objectSchema(nil)
+	}
+
+	return []route{
+		// Movies
+		{method: http.MethodGet, path: "/v1/movies", handler: app.listMoviesHandler, summary: "List movies",
+			permission: "movies:read", cors: publicCORS, cache: catalog, priority: priorityLow, fields: movieFields,
+			query: queryParams(map[string]*openAPISchema{
+				"title":     textSchema(limits.MaxTitleBytes),
+				"genres":    arraySchema(stringSchema(0), 0, 0),
+				"page":      integerSchema(1).atMost(10_000_000),
+				"page_size": integerSchema(1).atMost(100),
+			})},
+		{method: http.MethodPost, path: "/v1/movies", handler: app.createMovieHandler, summary: "Create a movie",
+			permission: "movies:write", body: movie().required("title", "year", "runtime", "genres")},
+		{method: http.MethodPost, path: "/v1/movies/bulk", handler: app.bulkImportMoviesHandler,
+			summary: "Import movies from NDJSON, CSV or a JSON array", permission: "movies:write"},
+		{method: http.MethodGet, path: "/v1/movies/events", handler: app.movieEventsHandler,
+			summary: "Stream movie changes as server-sent events", permission: "movies:read", cache: cacheNoStore},
+		{method: http.MethodGet, path: "/v1/movies/export", handler: app.exportMoviesHandler,
+			summary: "Export movies as NDJSON or CSV", permission: "movies:read", priority: priorityLow},
+		{method: http.MethodPost, path: "/v1/movies/search", handler: app.searchMoviesHandler, summary: "Search movies",
+			permission: "movies:read", cors: publicCORS, priority: priorityLow, fields: movieFields,
+			body: objectSchema(map[string]*openAPISchema{
+				"filter":    filter(),
+				"sort":      textSchema(20),
+				"page":      integerSchema(0).atMost(10_000_000),
+				"page_size": integerSchema(0).atMost(100),
+			})},
+		{method: http.MethodGet, path: "/v1/movies/search", handler: app.textSearchMoviesHandler,
+			summary: "Search movie titles", permission: "movies:read", cors: publicCORS, cache: catalog,
+			priority: priorityLow},
+		{method: http.MethodGet, path: "/v1/movies/:id", handler: app.showMovieHandler, summary: "Show a movie",
+			permission: "movies:read", cors: publicCORS, cache: catalog, etag: true, fields: movieDetailFields},
+		{method: http.MethodPatch, path: "/v1/movies/:id", handler: app.updateMovieHandler, summary: "Update a movie",
+			permission: "movies:write", body: movie()},
+		{method: http.MethodDelete, path: "/v1/movies/:id", handler: app.deleteMovieHandler, summary: "Move a movie to the trash",
+			permission: "movies:write"},
+		{method: http.MethodGet, path: "/v1/movies/trash", handler: app.listTrashHandler,
+			summary: "List the movies in the trash", permission: "movies:write"},
+		{method: http.MethodPost, path: "/v1/movies/:id/restore", handler: app.restoreMovieHandler,
+			summary: "Restore a movie from the trash", permission: "movies:write"},
+
+		// Reviews. Anyone who can read the movies can review them, and the PATCH and DELETE
+		// endpoints act on the current user's own review.
+		{method: http.MethodGet, path: "/v1/movies/:id/reviews", handler: app.listReviewsHandler,
+			summary: "List the reviews of a movie", permission: "movies:read", cors: publicCORS, priority: priorityLow},
+		{method: http.MethodPost, path: "/v1/movies/:id/reviews", handler: app.createReviewHandler,
+			summary: "Review a movie", permission: "movies:read", body: review().required("rating")},
+		{method: http.MethodPatch, path: "/v1/movies/:id/reviews", handler: app.updateReviewHandler,
+			summary: "Update your review of a movie", permission: "movies:read", body: review()},
+		{method: http.MethodDelete, path: "/v1/movies/:id/reviews", handler: app.deleteReviewHandler,
+			summary: "Delete your review of a movie", permission: "movies:read"},
+		{method: http.MethodPost, path: "/v1/reviews/:id/report", handler: app.reportReviewHandler,
+			summary: "Report a review which breaks the rules", permission: "movies:read",
+			body: objectSchema(map[string]*openAPISchema{
+				"reason":  enumSchema(data.AbuseReportReasons...),
+				"details": textSchema(1000),
+			}).required("reason")},
+
+		// GraphQL. The endpoint reads the same data as the movie and review endpoints above, so it
+		// needs the same permission.
+		{method: http.MethodGet, path: "/v1/graphql", handler: app.graphqlHandler(graphqlExec),
+			summary: "Run a GraphQL query given in the query string", permission: "movies:read", cache: cacheNoStore},
+		{method: http.MethodPost, path: "/v1/graphql", handler: app.graphqlHandler(graphqlExec),
+			summary: "Run a GraphQL query", permission: "movies:read",
+			body: objectSchema(map[string]*openAPISchema{
+				"query":         stringSchema(0),
+				"operationName": textSchema(200).nullable(),
+				"variables":     objectSchema(nil).nullable(),
+				"extensions":    objectSchema(nil).nullable(),
+			}).required("query")},
+		{method: http.MethodGet, path: "/v1/graphql/schema", handler: app.graphqlSchemaHandler,
+			summary: "Show the GraphQL schema", permission: "movies:read"},
+
+		// Credits
+		{method: http.MethodGet, path: "/v1/movies/:id/credits", handler: app.showCreditsHandler,
+			summary: "List the cast and crew of a movie", permission: "movies:read", cors: publicCORS, cache: catalog},
+		{method: http.MethodPut, path: "/v1/movies/:id/credits", handler: app.replaceCreditsHandler,
+			summary: "Replace the cast and crew of a movie", permission: "movies:write",
+			body: objectSchema(map[string]*openAPISchema{
+				"credits": arraySchema(objectSchema(map[string]*openAPISchema{
+					"person_id": integerSchema(1),
+					"role":      enumSchema(data.CreditRoles...),
+					"character": textSchema(500),
+					"billing":   integerSchema(0),
+				}).required("person_id", "role"), 0, 0),
+			}).required("credits")},
+
+		// Posters
+		{method: http.MethodGet, path: "/v1/movies/:id/poster", handler: app.showPosterHandler,
+			summary: "Download a movie's poster", permission: "movies:read", cors: publicCORS},
+		{method: http.MethodPost, path: "/v1/movies/:id/poster", handler: app.uploadPosterHandler,
+			summary: "Upload a movie's poster", permission: "movies:write"},
+		{method: http.MethodDelete, path: "/v1/movies/:id/poster", handler: app.deletePosterHandler,
+			summary: "Remove a movie's poster", permission: "movies:write"},
+
+		// Release notifications. Users can subscribe to a movie which hasn't been released yet, and
+		// are notified when it is.
+		{method: http.MethodPut, path: "/v1/movies/:id/subscription", handler: app.subscribeMovieHandler,
+			summary: "Get notified when a movie is released", permission: "movies:read"},
+		{method: http.MethodDelete, path: "/v1/movies/:id/subscription", handler: app.unsubscribeMovieHandler,
+			summary: "Stop waiting for a movie to be released", permission: "movies:read"},
+
+		// People
+		{method: http.MethodGet, path: "/v1/people", handler: app.listPeopleHandler, summary: "List people",
+			permission: "movies:read", cors: publicCORS, cache: catalog, priority: priorityLow},
+		{method: http.MethodPost, path: "/v1/people", handler: app.createPersonHandler, summary: "Create a person",
+			permission: "movies:write", body: person().required("name")},
+		{method: http.MethodGet, path: "/v1/people/:id", handler: app.showPersonHandler, summary: "Show a person",
+			permission: "movies:read", cors: publicCORS, cache: catalog},
+		{method: http.MethodPatch, path: "/v1/people/:id", handler: app.updatePersonHandler, summary: "Update a person",
+			permission: "movies:write", body: person()},
+		{method: http.MethodDelete, path: "/v1/people/:id", handler: app.deletePersonHandler, summary: "Delete a person",
+			permission: "movies:write"},
+
+		// Genres
+		{method: http.MethodGet, path: "/v1/genres", handler: app.listGenresHandler, summary: "List genres",
+			permission: "movies:read", cors: publicCORS, cache: catalog},
+		{method: http.MethodGet, path: "/v1/genres/:id/movies", handler: app.listGenreMoviesHandler,
+			summary: "List the movies in a genre", permission: "movies:read", cors: publicCORS, cache: catalog,
+			priority: priorityLow},
+
+		// Stats
+		{method: http.MethodGet, path: "/v1/stats/genres", handler: app.genreStatsHandler, summary: "Show genre statistics",
+			permission: "movies:read", cors: publicCORS, cache: catalog, priority: priorityLow},
+		{method: http.MethodGet, path: "/v1/stats/trending", handler: app.trendingMoviesHandler, summary: "List trending movies",
+			permission: "movies:read", cors: publicCORS, cache: catalog, priority: priorityLow},
+
+		// Public search
+		{method: http.MethodGet, path: "/v1/search", handler: app.publicSearchHandler,
+			summary: "Search movie titles without authenticating", cors: publicCORS, cache: search,
+			rateLimit: rateLimitSearch, priority: priorityLow},
+
+		// Events
+		{method: http.MethodGet, path: "/v1/events/replay", handler: app.replayEventsHandler,
+			summary: "Replay the domain events since a cursor", permission: "movies:read"},
+
+		// Announcements
+		{method: http.MethodGet, path: "/v1/announcements", handler: app.listAnnouncementsHandler,
+			summary: "List the current announcements", cors: publicCORS, cache: cacheNoCache},
+
+		// Status page
+		{method: http.MethodGet, path: "/v1/status", handler: app.statusHandler,
+			summary: "Show the uptime, error rate and incidents for a status page", cors: publicCORS,
+			cache: cacheNoCache,
+			query: queryParams(map[string]*openAPISchema{"days": integerSchema(1).atMost(statusMaxDays)})},
+
+		// Users
+		{method: http.MethodPost, path: "/v1/users", handler: app.registerUserHandler, summary: "Register a user",
+			rateLimit: rateLimitAuth, body: credentials().required("name").withProperty("name", stringSchema(500))},
+		{method: http.MethodPut, path: "/v1/users/activated", handler: app.activateUserHandler, summary: "Activate a user",
+			rateLimit: rateLimitAuth, body: token("token")},
+		{method: http.MethodPut, path: "/v1/users/password", handler: app.updateUserPasswordHandler,
+			summary: "Reset a password with a password reset token", rateLimit: rateLimitAuth,
+			body: token("token").withProperty("password", password()).required("password")},
+		{method: http.MethodPut, path: "/v1/users/email-confirm", handler: app.confirmUserEmailHandler,
+			summary: "Confirm a new email address", rateLimit: rateLimitAuth, body: token("token")},
+		{method: http.MethodPut, path: "/v1/users/restored", handler: app.restoreUserHandler,
+			summary: "Restore a deleted account", rateLimit: rateLimitAuth, body: token("token")},
+
+		{method: http.MethodDelete, path: "/v1/users/me", handler: app.deleteCurrentUserHandler,
+			summary: "Delete your account", activated: true, rateLimit: rateLimitAuth,
+			body: objectSchema(map[string]*openAPISchema{"password": stringSchema(0)})},
+
+		{method: http.MethodPatch, path: "/v1/users/me/email", handler: app.updateUserEmailHandler,
+			summary: "Change your email address", activated: true, rateLimit: rateLimitAuth,
+			body: email().withProperty("password", stringSchema(0))},
+
+		{method: http.MethodGet, path: "/v1/users/me/recently-viewed", handler: app.recentlyViewedHandler,
+			summary: "List recently viewed movies", activated: true, priority: priorityLow},
+
+		{method: http.MethodGet, path: "/v1/users/me/searches", handler: app.listSavedSearchesHandler,
+			summary: "List saved searches", activated: true},
+		{method: http.MethodPost, path: "/v1/users/me/searches", handler: app.createSavedSearchHandler,
+			summary: "Save a search", activated: true,
+			body: objectSchema(map[string]*openAPISchema{
+				"name":   stringSchema(100),
+				"filter": filter(),
+				"notify": booleanSchema(),
+			}).required("name", "filter")},
+		{method: http.MethodGet, path: "/v1/users/me/searches/:id", handler: app.showSavedSearchHandler,
+			summary: "Show a saved search", activated: true},
+		{method: http.MethodDelete, path: "/v1/users/me/searches/:id", handler: app.deleteSavedSearchHandler,
+			summary: "Delete a saved search", activated: true},
+		{method: http.MethodGet, path: "/v1/users/me/searches/:id/results", handler: app.savedSearchResultsHandler,
+			summary: "List the results of a saved search", activated: true, priority: priorityLow},
+
+		{method: http.MethodPut, path: "/v1/users/me/announcements", handler: app.subscribeAnnouncementsHandler,
+			summary: "Subscribe to announcements by email", activated: true},
+		{method: http.MethodDelete, path: "/v1/users/me/announcements", handler: app.unsubscribeAnnouncementsHandler,
+			summary: "Unsubscribe from announcements by email", activated: true},
+
+		{method: http.MethodGet, path: "/v1/users/me/notifications", handler: app.listNotificationsHandler,
+			summary: "List in-app notifications", activated: true},
+		{method: http.MethodPut, path: "/v1/users/me/notifications/:id/read", handler: app.readNotificationHandler,
+			summary: "Mark a notification as read", activated: true},
+		{method: http.MethodGet, path: "/v1/users/me/notification-preferences",
+			handler: app.showNotificationPreferencesHandler, summary: "Show notification preferences", activated: true},
+		{method: http.MethodPut, path: "/v1/users/me/notification-preferences",
+			handler: app.updateNotificationPreferencesHandler, summary: "Update notification preferences",
+			activated: true,
+			body: objectSchema(map[string]*openAPISchema{
+				"email":  booleanSchema(),
+				"in_app": booleanSchema(),
+			})},
+		{method: http.MethodGet, path: "/v1/ws", handler: app.notificationSocketHandler,
+			summary: "Receive in-app notifications over a WebSocket", activated: true, cache: cacheNoStore,
+			query: queryParams(map[string]*openAPISchema{"ticket": stringSchema(26)})},
+
+		{method: http.MethodGet, path: "/v1/users/me/digest", handler: app.showDigestHandler,
+			summary: "Show weekly digest settings", activated: true},
+		{method: http.MethodPut, path: "/v1/users/me/digest", handler: app.updateDigestHandler,
+			summary: "Update weekly digest settings", activated: true,
+			body: objectSchema(map[string]*openAPISchema{
+				"subscribed":      booleanSchema(),
+				"favorite_genres": arraySchema(stringSchema(0), 0, limits.MaxGenres).unique().nullable(),
+			})},
+		{method: http.MethodGet, path: "/v1/digest/unsubscribe", handler: app.unsubscribeDigestHandler,
+			summary: "Unsubscribe from the weekly digest with a signed link", rateLimit: rateLimitAuth,
+			query: queryParams(map[string]*openAPISchema{"token": stringSchema(0)})},
+		{method: http.MethodPost, path: "/v1/digest/unsubscribe", handler: app.unsubscribeDigestHandler,
+			summary: "Unsubscribe from the weekly digest with one click", rateLimit: rateLimitAuth,
+			query: queryParams(map[string]*openAPISchema{"token": stringSchema(0)})},
+
+		{method: http.MethodGet, path: "/v1/users/me/api-keys", handler: app.listAPIKeysHandler,
+			summary: "List API keys", activated: true},
+		{method: http.MethodPost, path: "/v1/users/me/api-keys", handler: app.createAPIKeyHandler,
+			summary: "Create an API key for signing requests", activated: true,
+			body: objectSchema(map[string]*openAPISchema{"name": stringSchema(100)}).required("name")},
+		{method: http.MethodDelete, path: "/v1/users/me/api-keys/:id", handler: app.deleteAPIKeyHandler,
+			summary: "Delete an API key", activated: true},
+
+		{method: http.MethodGet, path: "/v1/users/me/exports", handler: app.listExportsHandler,
+			summary: "List scheduled exports", activated: true},
+		{method: http.MethodPost, path: "/v1/users/me/exports", handler: app.createExportHandler,
+			summary: "Schedule an export", activated: true,
+			body: objectSchema(map[string]*openAPISchema{
+				"name":      stringSchema(100),
+				"filter":    filter(),
+				"format":    enumSchema(data.ExportFormats...),
+				"frequency": enumSchema(data.ExportFrequencies...),
+				"new_only":  booleanSchema().nullable(),
+			}).required("name", "filter", "format", "frequency")},
+		{method: http.MethodDelete, path: "/v1/users/me/exports/:id", handler: app.deleteExportHandler,
+			summary: "Delete a scheduled export", activated: true},
+		{method: http.MethodGet, path: "/v1/users/me/exports/:id/download", handler: app.downloadExportHandler,
+			summary: "Download the latest run of a scheduled export", activated: true},
+
+		// User management
+		{method: http.MethodGet, path: "/v1/users", handler: app.listUsersHandler,
+			summary: "List users", permission: "users:admin"},
+		{method: http.MethodGet, path: "/v1/users/:id", handler: app.showUserHandler,
+			summary: "Show a user", permission: "users:admin"},
+		{method: http.MethodPatch, path: "/v1/users/:id", handler: app.updateUserHandler,
+			summary: "Activate or deactivate a user", permission: "users:admin",
+			body: objectSchema(map[string]*openAPISchema{"activated": booleanSchema()})},
+		{method: http.MethodDelete, path: "/v1/users/:id", handler: app.deleteUserHandler,
+			summary: "Delete a user", permission: "users:admin"},
+
+		// Webhooks
+		{method: http.MethodGet, path: "/v1/webhooks/:id/deliveries", handler: app.listOwnWebhookDeliveriesHandler,
+			summary: "List the deliveries to a webhook you registered", activated: true,
+			query: queryParams(map[string]*openAPISchema{
+				"status": enumSchema(data.WebhookDeliveryPending, data.WebhookDeliveryDelivered,
+					data.WebhookDeliveryFailed),
+				"page":      integerSchema(1).atMost(10_000_000),
+				"page_size": integerSchema(1).atMost(100),
+			})},
+
+		// Reports
+		{method: http.MethodPost, path: "/v1/reports", handler: app.createReportHandler, summary: "Request a report",
+			activated: true,
+			body: objectSchema(map[string]*openAPISchema{
+				"type":   enumSchema(reportTypeNames()...),
+				"format": enumSchema(data.ReportFormats...),
+				"params": objectSchema(nil).nullable(),
+			}).required("type")},
+		{method: http.MethodGet, path: "/v1/reports/:id", handler: app.showReportHandler, summary: "Show a report",
+			activated: true},
+		{method: http.MethodGet, path: "/v1/reports/:id/download", handler: app.downloadReportHandler,
+			summary: "Download a report", activated: true},
+
+		// Storage
+		{method: http.MethodGet, path: "/v1/storage/*key", handler: app.downloadObjectHandler,
+			summary: "Download a file with a signed URL"},
+
+		// Tasks
+		{method: http.MethodGet, path: "/v1/tasks/:id", handler: app.showTaskHandler,
+			summary: "Show the status of a task", activated: true},
+
+		// Tokens
+		{method: http.MethodPost, path: "/v1/tokens/authentication", handler: app.createAuthenticationTokenHandler,
+			summary: "Create an authentication token", cors: firstPartyCORS, rateLimit: rateLimitAuth,
+			body: credentials()},
+		{method: http.MethodPost, path: "/v1/tokens/refresh", handler: app.refreshTokenHandler,
+			summary: "Exchange a refresh token for new tokens", cors: firstPartyCORS, rateLimit: rateLimitAuth,
+			body: token("refresh_token")},
+		{method: http.MethodPost, path: "/v1/tokens/activation", handler: app.createActivationTokenHandler,
+			summary: "Email a new activation token", cors: firstPartyCORS, rateLimit: rateLimitAuth, body: email()},
+		{method: http.MethodPost, path: "/v1/tokens/password-reset", handler: app.createPasswordResetTokenHandler,
+			summary: "Email a password reset token", cors: firstPartyCORS, rateLimit: rateLimitAuth, body: email()},
+		{method: http.MethodPost, path: "/v1/tokens/websocket", handler: app.createSocketTicketHandler,
+			summary: "Create a ticket for a WebSocket connection", activated: true, cors: firstPartyCORS},
+	}
+}
+
+// registerRoutes registers the routes with the router, wrapping each handler in the
+// middleware that the route asks for.
+func (app *application) registerRoutes(cr *corsRouter, routes []route) {
+	// The stricter rate limits are shared by all of the routes in their class, so that a client
+	// can't get around them by spreading its requests across the routes.
+	authLimiter := app.newRateLimiter("auth", func() (bool, float64, int) {
+		return app.settings.get().LimiterEnabled, app.config.limiter.authRPS, app.config.limiter.authBurst
+	})
+	searchLimiter := app.newPublicSearchLimiter()
+
+	wrap := func(rt route) (corsPolicy, http.HandlerFunc) {
+		handler := rt.handler
+
+		// Requests are validated against the route's schemas after the authentication and
+		// permission checks, so that clients without access aren't told what a valid request
+		// looks like.
+		if app.config.openapi.validate {
+			handler = app.validateRequest(rt, handler)
+		}
+
+		if rt.etag {
+			handler = app.conditionalGET(handler)
+		}
+
+		if rt.fields != nil {
+			handler = app.selectableFields(rt.fields, handler)
+		}
+
+		switch {
+		case rt.permission != "":
+			handler = app.requirePermissions(rt.permission, handler)
+		case rt.activated:
+			handler = app.requireActivatedUser(handler)
+		}
+
+		switch rt.rateLimit {
+		case rateLimitAuth:
+			handler = authLimiter.limit(handler).ServeHTTP
+		case rateLimitSearch:
+			handler = app.detectBots(searchLimiter.limit(handler))
+		}
+
+		if rt.priority == priorityLow {
+			handler = app.shedLoad(handler)
+		}
+
+		policy := rt.cors
+		if policy.trustedOrigins == nil {
+			policy = cr.fallback
+		}
+
+		return policy, handler
+	}
+
+	// Register the static routes which clash with a wildcard route first, as they're served
+	// through the wildcard path, and then the rest.
+	registered := make(map[string]bool)
+
+	for _, rt := range routes {
+		if wildcard, ok := literalWildcard(rt, routes); ok {
+			policy, handler := wrap(rt)
+			cr.handleLiteral(policy, rt.method, rt.path, wildcard, handler)
+			registered[rt.pattern()] = true
+		}
+	}
+
+	for _, rt := range routes {
+		if !registered[rt.pattern()] {
+			policy, handler := wrap(rt)
+			cr.handleWithPolicy(policy, rt.method, rt.path, handler)
+		}
+	}
+}
+
+// literalWildcard reports whether a route has a static segment which clashes with a wildcard
+// segment of another route for the same method, such as "POST /v1/movies/search" and "POST
+// /v1/movies/:id/reviews", or "GET /v1/users/me/searches" and "GET /v1/users/:id". httprouter
+// can't register both, so the route with the static segment has to be served through the path
+// that's returned, with the wildcard in place of the static segment (here "/v1/movies/:id" and
+// "/v1/users/:id/searches").
+func literalWildcard(rt route, routes []route) (string, bool) {
+	segments := strings.Split(rt.path, "/")
+
+	for i, segment := range segments {
+		if strings.HasPrefix(segment, ":") || strings.HasPrefix(segment, "*") {
+			continue
+		}
+
+		prefix := strings.Join(segments[:i], "/")
+
+		for _, other := range routes {
+			if other.method != rt.method {
+				continue
+			}
+
+			otherSegments := strings.Split(other.path, "/")
+			if len(otherSegments) <= i || !strings.HasPrefix(otherSegments[i], ":") {
+				continue
+			}
+
+			if strings.Join(otherSegments[:i], "/") == prefix {
+				wildcard := append(append([]string{}, segments[:i]...), otherSegments[i])
+				return strings.Join(append(wildcard, segments[i+1:]...), "/"), true
+			}
+		}
+	}
+
+	return "", false
+}
+
+// cachePolicies returns the Cache-Control policies for the routes, keyed by route pattern, for
+// the cacheControl middleware. Routes without a policy aren't included, so they get no-store.
+func cachePolicies(routes []route) map[string]string {
+	policies := map[string]string{}
+
+	for _, rt := range routes {
+		if rt.cache != "" {
+			policies[rt.pattern()] = rt.cache
+		}
+	}
+
+	return policies
+}
+
+// runRoutesCommand runs the "routes" subcommand, which lists every route served by the public
+// listener, along with who can call it, the rate limit, priority and Cache-Control policies that
+// apply to it. The operational routes are listed too, with the listener that serves them.
+func runRoutesCommand(cfg config, w io.Writer) error {
+	app := &application{config: cfg}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+
+	fmt.Fprintln(tw, "METHOD\tPATH\tACCESS\tRATE LIMIT\tPRIORITY\tCACHE\tLISTENER")
+
+	list := func(routes []route, listener string) {
+		for _, rt := range routes {
+			cache := rt.cache
+			if cache == "" {
+				cache = cacheNoStore
+			}
+
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", rt.method, rt.path, rt.access(), rt.rateLimit, rt.priority,
+				cache, listener)
+		}
+	}
+
+	operational := "public"
+	if cfg.admin.addr != "" {
+		operational = "admin"
+	}
+
+	list(app.routeTable(), "public")
+	list(app.operationalRouteTable(), operational)
+
+	return tw.Flush()
+}
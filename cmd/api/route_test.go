@@ -0,0 +1,222 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+
+	"github.com/codeaucafe/snippetbox/greenlight/internal/data"
+	"github.com/codeaucafe/snippetbox/greenlight/internal/testutil"
+)
+
+// TestRegisterRoutes tests that every route in the route tables can be registered together, and
+// that each route gets the access checks and rate limit class it declares.
+func TestRegisterRoutes(t *testing.T) {
+	app := newTestApp()
+	app.config.limiter.authRPS = 1
+	app.config.limiter.authBurst = 1
+
+	settings := app.settings.get()
+	settings.LimiterEnabled = true
+	app.settings.set(settings)
+
+	routes := append(app.routeTable(), app.operationalRouteTable()...)
+
+	cr := newCORSRouter(httprouter.New(), app.defaultCORSPolicy())
+	app.registerRoutes(cr, routes)
+
+	send := func(method, path string) int {
+		rr := httptest.NewRecorder()
+		r := app.contextSetUser(httptest.NewRequest(method, path, nil), data.AnonymousUser)
+		cr.ServeHTTP(rr, r)
+		return rr.Code
+	}
+
+	// Routes which require a permission or an activated user reject anonymous users.
+	testutil.Equal(t, send(http.MethodGet, "/v1/movies/1"), http.StatusUnauthorized)
+	testutil.Equal(t, send(http.MethodGet, "/v1/users/me/searches"), http.StatusUnauthorized)
+
+	// The auth rate limit is shared by every route in the class, so the second request is
+	// rejected even though it's to a different route.
+	testutil.Equal(t, send(http.MethodPut, "/v1/users/activated") != http.StatusTooManyRequests, true)
+	testutil.Equal(t, send(http.MethodPost, "/v1/tokens/authentication"), http.StatusTooManyRequests)
+
+	policies := cachePolicies(routes)
+	testutil.Equal(t, policies["GET /v1/healthcheck"], cacheNoCache)
+	testutil.Equal(t, policies["GET /v1/movies/:id"], cachePrivate(app.config.cache.catalogMaxAge))
+	testutil.Equal(t, policies["POST /v1/movies"], "")
+
+	// Shared caches would serve the responses of routes which need a permission to anyone.
+	for _, rt := range routes {
+		if (rt.permission != "" || rt.activated) && strings.HasPrefix(rt.cache, "public") {
+			t.Errorf("%s %s needs a permission, but has the public cache policy %q", rt.method, rt.path, rt.cache)
+		}
+	}
+
+	// Every write route which reads a JSON body describes it, so that it's in the OpenAPI
+	// document and checked by the request validation. These routes take no body, or one which
+	// isn't JSON.
+	noBody := map[string]bool{
+		"POST /v1/movies/bulk":                    true,
+		"POST /v1/movies/:id/restore":             true,
+		"POST /v1/movies/:id/poster":              true,
+		"PUT /v1/movies/:id/subscription":         true,
+		"PUT /v1/users/me/announcements":          true,
+		"PUT /v1/users/me/notifications/:id/read": true,
+		"POST /v1/digest/unsubscribe":             true,
+		"POST /v1/tokens/websocket":               true,
+		"POST /v1/admin/stats/refresh":            true,
+		"POST /v1/admin/backups":                  true,
+	}
+
+	for _, rt := range routes {
+		write := rt.method == http.MethodPost || rt.method == http.MethodPut || rt.method == http.MethodPatch
+		if write && rt.body == nil && !noBody[rt.pattern()] {
+			t.Errorf("%s has no body schema", rt.pattern())
+		}
+	}
+}
+
+// TestLoadShedding checks that the low priority routes are sent a 503 Service Unavailable response
+// while the database probes are slow or failing, that the other routes are still served, and
+// that shedding stops once the probes recover.
+func TestLoadShedding(t *testing.T) {
+	app := newTestApp()
+	app.shedder = newLoadShedder(2, 100*time.Millisecond, 0.5)
+
+	cr := newCORSRouter(httprouter.New(), app.defaultCORSPolicy())
+	app.registerRoutes(cr, append(app.routeTable(), app.operationalRouteTable()...))
+
+	send := func(method, path string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		r := app.contextSetUser(httptest.NewRequest(method, path, nil), data.AnonymousUser)
+		cr.ServeHTTP(rr, r)
+		return rr
+	}
+
+	testutil.Equal(t, send(http.MethodGet, "/v1/movies").Code, http.StatusUnauthorized)
+
+	// One slow probe out of two pushes the average latency over the threshold.
+	app.shedder.record(10*time.Millisecond, nil)
+	testutil.Equal(t, app.shedder.record(time.Second, nil), true)
+
+	rr := send(http.MethodGet, "/v1/movies")
+	testutil.Equal(t, rr.Code, http.StatusServiceUnavailable)
+	testutil.Equal(t, rr.Header().Get("Retry-After"), "30")
+	testutil.Equal(t, send(http.MethodPost, "/v1/movies/search").Code, http.StatusServiceUnavailable)
+
+	// The other routes are still served.
+	testutil.Equal(t, send(http.MethodGet, "/v1/movies/1").Code, http.StatusUnauthorized)
+	testutil.Equal(t, send(http.MethodPost, "/v1/tokens/authentication").Code != http.StatusServiceUnavailable, true)
+	testutil.Equal(t, send(http.MethodGet, "/v1/healthcheck").Code, http.StatusOK)
+
+	// Shedding stops once the slow probe has left the window.
+	testutil.Equal(t, app.shedder.record(10*time.Millisecond, nil), false)
+	testutil.Equal(t, app.shedder.record(10*time.Millisecond, nil), true)
+	testutil.Equal(t, send(http.MethodGet, "/v1/movies").Code, http.StatusUnauthorized)
+
+	// A single failure out of two is at the error rate threshold, which isn't above it.
+	app.shedder.record(10*time.Millisecond, errors.New("connection refused"))
+	testutil.Equal(t, app.shedder.active(), false)
+
+	app.shedder.record(0, errors.New("connection refused"))
+	testutil.Equal(t, app.shedder.active(), true)
+
+	latency, errorRate := app.shedder.stats()
+	testutil.Equal(t, latency, time.Duration(0))
+	testutil.Equal(t, errorRate, 1.0)
+}
+
+// TestLiteralRoutes tests that routes with a static segment which clashes with a wildcard route
+// are served through the wildcard path, alongside the wildcard routes themselves, and still get
+// their own parameters.
+func TestLiteralRoutes(t *testing.T) {
+	app := newTestApp()
+
+	handler := func(name string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte(name))
+		}
+	}
+
+	routes := []route{
+		{method: http.MethodPost, path: "/v1/movies/:id/reviews", handler: handler("reviews")},
+		{method: http.MethodPost, path: "/v1/movies/search", handler: handler("search")},
+		{method: http.MethodGet, path: "/v1/movies/:id", handler: handler("show")},
+		{method: http.MethodGet, path: "/v1/movies/popular", handler: handler("popular")},
+		{method: http.MethodGet, path: "/v1/users/me/searches/:id", handler: func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte("search " + httprouter.ParamsFromContext(r.Context()).ByName("id")))
+		}},
+		{method: http.MethodGet, path: "/v1/users/:id", handler: handler("user")},
+	}
+
+	wildcard, ok := literalWildcard(routes[1], routes)
+	testutil.Equal(t, ok, true)
+	testutil.Equal(t, wildcard, "/v1/movies/:id")
+
+	wildcard, ok = literalWildcard(routes[4], routes)
+	testutil.Equal(t, ok, true)
+	testutil.Equal(t, wildcard, "/v1/users/:id/searches/:id")
+
+	router := httprouter.New()
+	router.NotFound = http.HandlerFunc(app.notFoundResponse)
+
+	cr := newCORSRouter(router, app.defaultCORSPolicy())
+	app.registerRoutes(cr, routes)
+
+	tests := []struct {
+		method   string
+		path     string
+		wantCode int
+		wantBody string
+		// wantPattern is the route pattern recorded for our middleware.
+		wantPattern string
+	}{
+		{http.MethodPost, "/v1/movies/search", http.StatusOK, "search", "POST /v1/movies/search"},
+		{http.MethodPost, "/v1/movies/1/reviews", http.StatusOK, "reviews", "POST /v1/movies/:id/reviews"},
+		{http.MethodPost, "/v1/movies/1", http.StatusNotFound, "", ""},
+		{http.MethodGet, "/v1/movies/popular", http.StatusOK, "popular", "GET /v1/movies/popular"},
+		{http.MethodGet, "/v1/movies/1", http.StatusOK, "show", "GET /v1/movies/:id"},
+		{http.MethodGet, "/v1/users/me/searches/7", http.StatusOK, "search 7", "GET /v1/users/me/searches/:id"},
+		{http.MethodGet, "/v1/users/1/searches/7", http.StatusNotFound, "", ""},
+		{http.MethodGet, "/v1/users/1", http.StatusOK, "user", "GET /v1/users/:id"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.path, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			r, info := app.contextSetRouteInfo(httptest.NewRequest(tt.method, tt.path, nil))
+			cr.ServeHTTP(rr, r)
+
+			testutil.Equal(t, rr.Code, tt.wantCode)
+			testutil.Equal(t, info.pattern, tt.wantPattern)
+			if tt.wantBody != "" {
+				testutil.Equal(t, rr.Body.String(), tt.wantBody)
+			}
+		})
+	}
+}
+
+// TestOpenAPIPath tests the conversion of httprouter paths to OpenAPI paths.
+func TestOpenAPIPath(t *testing.T) {
+	path, params := openAPIPath("/v1/users/me/searches/:id/results")
+
+	testutil.Equal(t, path, "/v1/users/me/searches/{id}/results")
+	testutil.Equal(t, len(params), 1)
+	testutil.Equal(t, params[0].Name, "id")
+	testutil.Equal(t, params[0].Schema.Type, "integer")
+
+	path, params = openAPIPath("/v1/movies/:id/reviews")
+
+	testutil.Equal(t, params[0].Schema.Type, "string")
+
+	path, params = openAPIPath("/v1/movies")
+
+	testutil.Equal(t, path, "/v1/movies")
+	testutil.Equal(t, len(params), 0)
+}
@@ -1,7 +1,6 @@
 package main
 
 import (
-	"expvar"
 	"net/http"
 
 	"github.com/julienschmidt/httprouter"
@@ -19,26 +18,25 @@ func (app *application) routes() http.Handler {
 	// error handler for 405 Method Not Allowed responses
 	router.MethodNotAllowed = http.HandlerFunc(app.methodNotAllowedResponse)
 
-	// healthcheck
-	router.HandlerFunc(http.MethodGet, "/v1/healthcheck", app.healthcheckHandler)
-
-	// application metrics handler
-	router.Handler(http.MethodGet, "/debug/vars", expvar.Handler())
-
-	// Movies handlers. Note, that these movie endpoints use the `requireActivatedUser` middleware.
-	router.HandlerFunc(http.MethodGet, "/v1/movies", app.requirePermissions("movies:read", app.listMoviesHandler))
-	router.HandlerFunc(http.MethodPost, "/v1/movies", app.requirePermissions("movies:write", app.createMovieHandler))
-	router.HandlerFunc(http.MethodGet, "/v1/movies/:id", app.requirePermissions("movies:read", app.showMovieHandler))
-	router.HandlerFunc(http.MethodPatch, "/v1/movies/:id", app.requirePermissions("movies:write", app.updateMovieHandler))
-	router.HandlerFunc(http.MethodDelete, "/v1/movies/:id", app.requirePermissions("movies:write", app.deleteMovieHandler))
-
-	// Users handlers
-	router.HandlerFunc(http.MethodPost, "/v1/users", app.registerUserHandler)
-	router.HandlerFunc(http.MethodPut, "/v1/users/activated", app.activateUserHandler)
-
-	// Tokens handlers
-	router.HandlerFunc(http.MethodPost, "/v1/tokens/authentication", app.createAuthenticationTokenHandler)
-
-	// Wrap the router with the panic recovery middleware and rate limit middleware.
-	return app.metrics(app.recoverPanic(app.enableCORS(app.rateLimit(app.authenticate(router)))))
+	// Wrap the router in a corsRouter so that each route can be registered alongside its
+	// CORS policy. Routes which aren't given a policy use the default policy built from the
+	// -cors-trusted-origins flag.
+	cr := newCORSRouter(router, app.defaultCORSPolicy())
+
+	// The routes are declared in the route tables (see route.go). The healthcheck, metrics and
+	// admin routes are only served here if the admin listener isn't enabled.
+	routes := app.routeTable()
+	if app.config.admin.addr == "" {
+		routes = append(routes, app.operationalRouteTable()...)
+	}
+
+	app.registerRoutes(cr, routes)
+
+	// Wrap the router with the panic recovery middleware and rate limit middleware. Every route
+	// gets no-store Cache-Control header unless its route declares a cache policy, and responses
+	// are shaped for the API version that the client asks for (see negotiateResponse). The
+	// Prometheus metrics are recorded by route (see instrument), and each request is traced
+	// (see trace). Large enough responses are gzipped for clients which accept it (see compress),
+	// and the strict security headers are set in production (see securityHeaders).
+	return app.metrics(app.instrument(app.requestID(app.trace(app.logRequest(app.securityHeaders(app.recoverPanic(app.compress(app.cacheControl(cachePolicies(routes), app.enableCORS(app.negotiateResponse(app.maintenanceMode(app.rateLimit(app.authenticate(app.rateLimitUsers(app.enforceQuota(app.meterUsage(router)))))))))))))))))
 }
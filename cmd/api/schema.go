@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/codeaucafe/snippetbox/greenlight/internal/jsonlog"
+	"github.com/codeaucafe/snippetbox/greenlight/migrations"
+)
+
+// The schema check modes for the -schema-check flag. In strict mode the application refuses to
+// start if the database is behind the schema the binary was built for, in warn mode it logs the
+// mismatch and carries on, and in off mode the check is skipped altogether.
+const (
+	schemaCheckStrict = "strict"
+	schemaCheckWarn   = "warn"
+	schemaCheckOff    = "off"
+)
+
+// schemaVersioner looks up the version of the database schema, and whether the last migration
+// failed part way through. It's satisfied by data.SystemModel.
+type schemaVersioner interface {
+	SchemaVersion(ctx context.Context) (int, bool, error)
+}
+
+// checkSchemaVersion compares the version of the database schema against the newest migration
+// embedded in the binary. This catches a forgotten `make db/migrations/up` at startup, rather
+// than as a stream of 500 errors about missing columns once requests start coming in.
+//
+// A database which is behind the binary, or whose last migration failed part way through, is an
+// error in strict mode. A database which is *ahead* of the binary is only ever logged as a
+// warning, because that's normal while older instances are being replaced during a deploy.
+func checkSchemaVersion(mode string, system schemaVersioner, logger *jsonlog.Logger) error {
+	if mode == schemaCheckOff {
+		return nil
+	}
+
+	expected, err := migrations.Latest()
+	if err != nil {
+		return err
+	}
+
+	version, dirty, err := system.SchemaVersion(context.Background())
+	if err != nil {
+		return err
+	}
+
+	properties := map[string]string{
+		"database_version": strconv.Itoa(version),
+		"expected_version": strconv.Itoa(expected),
+	}
+
+	var mismatch error
+
+	switch {
+	case dirty:
+		mismatch = fmt.Errorf("database schema version %d is dirty, fix the failed migration and force the version", version)
+	case version < expected:
+		mismatch = fmt.Errorf("database schema version %d is behind the expected version %d, run the migrations", version, expected)
+	case version > expected:
+		logger.PrintInfo("WARNING: database schema is ahead of this version of the application", properties)
+		return nil
+	default:
+		logger.PrintInfo("database schema version is up to date", properties)
+		return nil
+	}
+
+	if mode == schemaCheckWarn {
+		logger.PrintError(mismatch, properties)
+		return nil
+	}
+
+	return mismatch
+}
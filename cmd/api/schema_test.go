@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/codeaucafe/snippetbox/greenlight/internal/jsonlog"
+	"github.com/codeaucafe/snippetbox/greenlight/internal/testutil"
+	"github.com/codeaucafe/snippetbox/greenlight/migrations"
+)
+
+// fakeSchema is a schemaVersioner which returns a fixed schema version.
+type fakeSchema struct {
+	version int
+	dirty   bool
+}
+
+func (s fakeSchema) SchemaVersion(context.Context) (int, bool, error) {
+	return s.version, s.dirty, nil
+}
+
+// TestCheckSchemaVersion tests that each schema state stops the application from starting or is
+// only logged, depending on the -schema-check mode.
+func TestCheckSchemaVersion(t *testing.T) {
+	latest, err := migrations.Latest()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	schemas := map[string]fakeSchema{
+		"dirty":  {version: latest, dirty: true},
+		"behind": {version: latest - 1},
+		"ahead":  {version: latest + 1},
+		"equal":  {version: latest},
+	}
+
+	// wantLevel is the level of the log entry written when the check doesn't fail, or "" when
+	// nothing is logged.
+	tests := []struct {
+		mode      string
+		schema    string
+		wantErr   bool
+		wantLevel string
+	}{
+		{schemaCheckStrict, "dirty", true, ""},
+		{schemaCheckStrict, "behind", true, ""},
+		{schemaCheckStrict, "ahead", false, "INFO"},
+		{schemaCheckStrict, "equal", false, "INFO"},
+		{schemaCheckWarn, "dirty", false, "ERROR"},
+		{schemaCheckWarn, "behind", false, "ERROR"},
+		{schemaCheckWarn, "ahead", false, "INFO"},
+		{schemaCheckWarn, "equal", false, "INFO"},
+		{schemaCheckOff, "dirty", false, ""},
+		{schemaCheckOff, "behind", false, ""},
+		{schemaCheckOff, "ahead", false, ""},
+		{schemaCheckOff, "equal", false, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s %s", tt.mode, tt.schema), func(t *testing.T) {
+			var buf bytes.Buffer
+			logger := jsonlog.NewLogger(&buf, jsonlog.LevelInfo)
+
+			err := checkSchemaVersion(tt.mode, schemas[tt.schema], logger)
+			testutil.Equal(t, err != nil, tt.wantErr)
+
+			if tt.wantLevel == "" {
+				testutil.Equal(t, buf.Len(), 0)
+				return
+			}
+
+			var entry struct {
+				Level string `json:"level"`
+			}
+			if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+				t.Fatal(err)
+			}
+			testutil.Equal(t, entry.Level, tt.wantLevel)
+		})
+	}
+}
+
+// TestLatestMigration tests that the latest migration version is found from the embedded files,
+// and that there are no gaps in the numbering.
+func TestLatestMigration(t *testing.T) {
+	latest, err := migrations.Latest()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	scripts, err := migrations.UpScripts()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testutil.Equal(t, latest > 0, true)
+	testutil.Equal(t, latest, len(scripts))
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/codeaucafe/snippetbox/greenlight/internal/data"
+	"github.com/codeaucafe/snippetbox/greenlight/internal/validator"
+)
+
+// createSavedSearchHandler handles the "POST /v1/users/me/searches" endpoint and saves a named
+// search filter (in the same format as for "POST /v1/movies/search") for the current user.
+func (app *application) createSavedSearchHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Name   string             `json:"name"`
+		Filter *data.SearchFilter `json:"filter"`
+		Notify bool               `json:"notify"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if input.Filter == nil {
+		v.AddError("filter", "must be provided")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	search := &data.SavedSearch{
+		UserID: app.contextGetUser(r).ID,
+		Name:   input.Name,
+		Filter: *input.Filter,
+		Notify: input.Notify,
+	}
+
+	if data.ValidateSavedSearch(v, search); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Searches.Insert(r.Context(), search)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"search": search}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// listSavedSearchesHandler handles the "GET /v1/users/me/searches" endpoint and returns all of
+// the current user's saved searches.
+func (app *application) listSavedSearchesHandler(w http.ResponseWriter, r *http.Request) {
+	searches, err := app.models.Searches.GetAllForUser(r.Context(), app.contextGetUser(r).ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"searches": searches}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// showSavedSearchHandler handles the "GET /v1/users/me/searches/:id" endpoint.
+func (app *application) showSavedSearchHandler(w http.ResponseWriter, r *http.Request) {
+	search, ok := app.getSavedSearch(w, r)
+	if !ok {
+		return
+	}
+
+	err := app.writeJSON(w, http.StatusOK, envelope{"search": search}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// deleteSavedSearchHandler handles the "DELETE /v1/users/me/searches/:id" endpoint.
+func (app *application) deleteSavedSearchHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	err = app.models.Searches.Delete(r.Context(), id, app.contextGetUser(r).ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "search successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// savedSearchResultsHandler handles the "GET /v1/users/me/searches/:id/results" endpoint. It
+// re-runs a saved search, supporting the same page, page_size and sort query string parameters
+// as "GET /v1/movies".
+func (app *application) savedSearchResultsHandler(w http.ResponseWriter, r *http.Request) {
+	search, ok := app.getSavedSearch(w, r)
+	if !ok {
+		return
+	}
+
+	v := validator.New()
+	qs := r.URL.Query()
+
+	filters := data.Filters{
+		Page:     app.readInt(qs, "page", 1, v),
+		PageSize: app.readInt(qs, "page_size", 20, v),
+		Sort:     app.readStrings(qs, "sort", "id"),
+		SortSafeList: []string{
+			"id", "title", "year", "runtime",
+			"-id", "-title", "-year", "-runtime",
+		},
+	}
+
+	if data.ValidateFilters(v, filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	movies, metadata, err := app.models.Movies.Search(r.Context(), search.Filter, filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"movies": movies, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// getSavedSearch reads the ID parameter from the request and fetches the matching saved search
+// for the current user. If the search can't be found (or belongs to someone else), or anything
+// else goes wrong, it sends the error response and returns false.
+func (app *application) getSavedSearch(w http.ResponseWriter, r *http.Request) (*data.SavedSearch, bool) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return nil, false
+	}
+
+	search, err := app.models.Searches.Get(r.Context(), id, app.contextGetUser(r).ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil, false
+	}
+
+	return search, true
+}
+
+// notifySavedSearches checks every saved search with notifications enabled for movies which have
+// been added since it was last checked, and tells the owner about any new matches: by email with
+// a list of the matches, in the app, or both, depending on their notification preferences.
+func (app *application) notifySavedSearches() {
+	job := startJob("saved_search_notifications")
+	defer job.finish()
+
+	notifications, err := app.models.Searches.GetAllForNotification(context.Background())
+	if err != nil {
+		job.fail()
+		app.logger.PrintError(err, nil)
+		return
+	}
+
+	// Fetch the new matches in ID order, so that if there are more than fit in a single email the
+	// rest are picked up the next time round.
+	filters := data.Filters{Page: 1, PageSize: 50, Sort: "id", SortSafeList: []string{"id"}}
+
+	for _, notification := range notifications {
+		search := notification.Search
+
+		movies, _, err := app.models.Movies.Search(context.Background(), search.NewMatchesFilter(), filters)
+		if err != nil {
+			job.fail()
+			app.logger.PrintError(err, nil)
+			continue
+		}
+
+		if len(movies) == 0 {
+			continue
+		}
+
+		if notification.Preferences.Email {
+			err = app.sendEmail(notification.Email, "saved_search_matches.tmpl", map[string]interface{}{
+				"searchID":   search.ID,
+				"searchName": search.Name,
+				"movies":     movies,
+			})
+			if err != nil {
+				job.fail()
+				app.logger.PrintError(err, nil)
+				continue
+			}
+		}
+
+		if notification.Preferences.InApp {
+			searchID := search.ID
+
+			err = app.models.Notifications.Insert(context.Background(), &data.Notification{
+				UserID:        search.UserID,
+				Kind:          data.NotificationSavedSearchMatches,
+				Message:       fmt.Sprintf("%d new movies match your saved search %q", len(movies), search.Name),
+				SavedSearchID: &searchID,
+			})
+			if err != nil {
+				job.fail()
+				app.logger.PrintError(err, nil)
+				continue
+			}
+		}
+
+		err = app.models.Searches.UpdateLastMovieID(context.Background(), search.ID, movies[len(movies)-1].ID)
+		if err != nil {
+			job.fail()
+			app.logger.PrintError(err, nil)
+		}
+	}
+}
+
+// notifySavedSearchesPeriodically calls notifySavedSearches() once every interval, as long as this
+// instance is the leader (so that users aren't emailed once per instance). It runs until the
+// application exits.
+func (app *application) notifySavedSearchesPeriodically(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+
+		if !app.isLeader() {
+			continue
+		}
+
+		app.notifySavedSearches()
+	}
+}
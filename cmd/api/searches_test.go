@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/codeaucafe/snippetbox/greenlight/internal/data"
+	"github.com/codeaucafe/snippetbox/greenlight/internal/mailer"
+	"github.com/codeaucafe/snippetbox/greenlight/internal/testutil"
+)
+
+// TestSavedSearches tests saving a search and re-running it, that only its owner can see it, and
+// that the owner is emailed once about the movies which match it after it was saved.
+func TestSavedSearches(t *testing.T) {
+	app, fx := newTestDBApp(t)
+	ts := newTestServer(app.routes())
+	defer ts.Close()
+
+	existing := fx.Movie(func(m *data.Movie) { m.Year = 2005 })
+	user := fx.User(nil, "movies:read")
+	owner := fx.Token(user, data.ScopeAuthentication)
+	other := fx.Token(fx.User(nil, "movies:read"), data.ScopeAuthentication)
+
+	code, _, body := ts.request(t, http.MethodPost, "/v1/users/me/searches", owner.Plaintext, `{"name": "Recent"}`)
+	testutil.Status(t, code, body, http.StatusUnprocessableEntity)
+
+	code, _, body = ts.request(t, http.MethodPost, "/v1/users/me/searches", owner.Plaintext,
+		`{"name": "Recent", "filter": {"field": "year", "op": "gte", "value": 2000}, "notify": true}`)
+	testutil.Status(t, code, body, http.StatusCreated)
+
+	var created struct {
+		Search data.SavedSearch `json:"search"`
+	}
+	testutil.DecodeJSON(t, body, &created)
+
+	searchPath := fmt.Sprintf("/v1/users/me/searches/%d", created.Search.ID)
+
+	code, _, body = ts.request(t, http.MethodGet, searchPath, other.Plaintext, "")
+	testutil.Status(t, code, body, http.StatusNotFound)
+
+	results := func() []data.Movie {
+		t.Helper()
+
+		code, _, body := ts.request(t, http.MethodGet, searchPath+"/results", owner.Plaintext, "")
+		testutil.Status(t, code, body, http.StatusOK)
+
+		var got struct {
+			Movies []data.Movie `json:"movies"`
+		}
+		testutil.DecodeJSON(t, body, &got)
+		return got.Movies
+	}
+
+	testutil.Equal(t, len(results()), 1)
+
+	// The movies which already matched when the search was saved aren't new matches.
+	recorder := app.mailer.(*mailer.Recorder)
+
+	app.notifySavedSearches()
+	testutil.Equal(t, len(recorder.SentTo(user.Email)), 0)
+
+	added := fx.Movie(func(m *data.Movie) { m.Title = "Brand New"; m.Year = 2010 })
+	fx.Movie(func(m *data.Movie) { m.Year = 1990 })
+
+	app.notifySavedSearches()
+	app.notifySavedSearches()
+
+	emails := recorder.SentTo(user.Email)
+	testutil.Equal(t, len(emails), 1)
+	testutil.Equal(t, emails[0].Template, "saved_search_matches.tmpl")
+	testutil.StringContains(t, emails[0].PlainBody, added.Title)
+
+	ids := []int64{}
+	for _, movie := range results() {
+		ids = append(ids, movie.ID)
+	}
+	testutil.Equal(t, fmt.Sprint(ids), fmt.Sprint([]int64{existing.ID, added.ID}))
+
+	code, _, body = ts.request(t, http.MethodDelete, searchPath, other.Plaintext, "")
+	testutil.Status(t, code, body, http.StatusNotFound)
+
+	code, _, body = ts.request(t, http.MethodDelete, searchPath, owner.Plaintext, "")
+	testutil.Status(t, code, body, http.StatusOK)
+
+	code, _, body = ts.request(t, http.MethodGet, searchPath, owner.Plaintext, "")
+	testutil.Status(t, code, body, http.StatusNotFound)
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/codeaucafe/snippetbox/greenlight/internal/data"
+	"github.com/codeaucafe/snippetbox/greenlight/internal/jsonlog"
+	"github.com/codeaucafe/snippetbox/greenlight/internal/storage"
+	"github.com/codeaucafe/snippetbox/greenlight/migrations"
+	"github.com/redis/go-redis/v9"
+)
+
+// The statuses of a self-check. A failed check means that the application won't work properly,
+// and a warning means that something needs looking at but the application can carry on.
+const (
+	selfCheckOK      = "ok"
+	selfCheckWarn    = "warn"
+	selfCheckFail    = "fail"
+	selfCheckSkipped = "skipped"
+)
+
+// selfCheckMaxClockSkew is how far the application's clock can be from the database server's
+// before the clock check fails. Token expiry times and the timestamps of signed requests both
+// rely on the clock being right.
+const selfCheckMaxClockSkew = 5 * time.Second
+
+// selfCheckResult is the outcome of one self-check.
+type selfCheckResult struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// selfCheckReport is the outcome of all of the self-checks. Its status is the worst status of
+// any check (skipped checks count as ok).
+type selfCheckReport struct {
+	Status  string            `json:"status"`
+	Version string            `json:"version"`
+	Checks  []selfCheckResult `json:"checks"`
+}
+
+// selfChecker runs the checklist of things which the application needs from its environment.
+// The checks are run and logged at startup, and the -check flag runs them on their own and
+// exits, so that a CI smoke test or deployment can find out whether an environment is usable
+// without starting the server. The redis client is nil if Redis isn't configured.
+type selfChecker struct {
+	cfg   config
+	db    *sql.DB
+	redis *redis.Client
+	store storage.Store
+}
+
+// run runs all of the self-checks and returns the report.
+func (c selfChecker) run() selfCheckReport {
+	checks := []struct {
+		name string
+		run  func() (string, string)
+	}{
+		{"database", c.checkDatabase},
+		{"migrations", c.checkMigrations},
+		{"smtp", c.checkSMTP},
+		{"redis", c.checkRedis},
+		{"clock", c.checkClock},
+		{"storage", c.checkStorage},
+	}
+
+	report := selfCheckReport{Status: selfCheckOK, Version: version}
+
+	for _, check := range checks {
+		status, detail := check.run()
+
+		report.Checks = append(report.Checks, selfCheckResult{Name: check.name, Status: status, Detail: detail})
+
+		switch {
+		case status == selfCheckFail:
+			report.Status = selfCheckFail
+		case status == selfCheckWarn && report.Status == selfCheckOK:
+			report.Status = selfCheckWarn
+		}
+	}
+
+	return report
+}
+
+// checkDatabase checks that the database can be reached.
+func (c selfChecker) checkDatabase() (string, string) {
+	err := pingDB(c.db, c.cfg.db.connectTimeout)
+	if err != nil {
+		return selfCheckFail, err.Error()
+	}
+
+	return selfCheckOK, ""
+}
+
+// checkMigrations checks that the database schema is the version this binary was built for, in
+// the same way as checkSchemaVersion(). A schema which is behind only fails the check in strict
+// mode, as the application won't start then.
+func (c selfChecker) checkMigrations() (string, string) {
+	expected, err := migrations.Latest()
+	if err != nil {
+		return selfCheckFail, err.Error()
+	}
+
+	version, dirty, err := data.SystemModel{DB: c.db}.SchemaVersion(context.Background())
+	if err != nil {
+		return selfCheckFail, err.Error()
+	}
+
+	detail := fmt.Sprintf("database version %d, expected version %d", version, expected)
+
+	switch {
+	case dirty:
+		return selfCheckFail, detail + ", dirty"
+	case version < expected && c.cfg.schemaCheck == schemaCheckStrict:
+		return selfCheckFail, detail
+	case version != expected:
+		return selfCheckWarn, detail
+	default:
+		return selfCheckOK, detail
+	}
+}
+
+// checkSMTP checks that a connection can be made to the SMTP server. It doesn't log in, so it
+// doesn't catch wrong credentials.
+func (c selfChecker) checkSMTP() (string, string) {
+	addr := net.JoinHostPort(c.cfg.smtp.host, strconv.Itoa(c.cfg.smtp.port))
+
+	conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
+	if err != nil {
+		return selfCheckFail, err.Error()
+	}
+
+	_ = conn.Close()
+
+	return selfCheckOK, addr
+}
+
+// checkRedis checks that Redis can be reached, if it's configured. It only warns if it can't, as
+// the features which use Redis fall back to working without it.
+func (c selfChecker) checkRedis() (string, string) {
+	if c.redis == nil {
+		return selfCheckSkipped, "not configured"
+	}
+
+	err := pingRedis(c.redis, 5*time.Second)
+	if err != nil {
+		return selfCheckWarn, err.Error() + " (falling back)"
+	}
+
+	return selfCheckOK, ""
+}
+
+// checkClock checks that the application's clock agrees with the database server's to within
+// selfCheckMaxClockSkew.
+func (c selfChecker) checkClock() (string, string) {
+	before := time.Now()
+
+	dbNow, err := data.SystemModel{DB: c.db}.Now(context.Background())
+	if err != nil {
+		return selfCheckFail, err.Error()
+	}
+
+	// Compare against the middle of the query, to allow for the time it took.
+	local := before.Add(time.Since(before) / 2)
+
+	skew := local.Sub(dbNow)
+	detail := fmt.Sprintf("%s from the database clock", skew.Round(time.Millisecond))
+
+	if skew > selfCheckMaxClockSkew || skew < -selfCheckMaxClockSkew {
+		return selfCheckFail, detail
+	}
+
+	return selfCheckOK, detail
+}
+
+// checkStorage checks that an object can be written to, read back from and deleted from the
+// object store, where the application keeps the files it writes, such as reports, exports and
+// backups.
+func (c selfChecker) checkStorage() (string, string) {
+	if c.store == nil {
+		return selfCheckFail, "object storage isn't open"
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	key := fmt.Sprintf("selfcheck/%d", time.Now().UnixNano())
+	content := "greenlight self-check"
+
+	_, err := c.store.Put(ctx, key, strings.NewReader(content), "text/plain")
+	if err != nil {
+		return selfCheckFail, err.Error()
+	}
+
+	body, _, err := c.store.Get(ctx, key)
+	if err != nil {
+		return selfCheckFail, err.Error()
+	}
+
+	got, err := io.ReadAll(body)
+	_ = body.Close()
+	if err != nil {
+		return selfCheckFail, err.Error()
+	}
+
+	err = c.store.Delete(ctx, key)
+	if err != nil {
+		return selfCheckFail, err.Error()
+	}
+
+	if string(got) != content {
+		return selfCheckFail, "object read back doesn't match the one written"
+	}
+
+	return selfCheckOK, c.cfg.storage.driver
+}
+
+// logSelfChecks runs the self-checks and logs the result of each one. Failures are logged as
+// errors, but don't stop the application from starting.
+func logSelfChecks(c selfChecker, logger *jsonlog.Logger) {
+	report := c.run()
+
+	for _, check := range report.Checks {
+		properties := map[string]string{
+			"check":  check.Name,
+			"status": check.Status,
+			"detail": check.Detail,
+		}
+
+		if check.Status == selfCheckFail {
+			logger.PrintError(fmt.Errorf("self-check %s failed", check.Name), properties)
+			continue
+		}
+
+		logger.PrintInfo("self-check", properties)
+	}
+}
+
+// runSelfCheckCommand runs the self-checks for the -check flag, writes the report to w as JSON,
+// and returns the exit status: 1 if any check failed, and 0 otherwise.
+func runSelfCheckCommand(cfg config, w io.Writer) int {
+	c := selfChecker{cfg: cfg}
+
+	store, err := openStorage(cfg)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	c.store = store
+
+	db, err := openTracedDB(cfg.db.dsn)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	defer func() {
+		_ = db.Close()
+	}()
+
+	c.db = db
+
+	if cfg.redis.url != "" {
+		opts, err := redis.ParseURL(cfg.redis.url)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+
+		c.redis = redis.NewClient(opts)
+
+		defer func() {
+			_ = c.redis.Close()
+		}()
+	}
+
+	report := c.run()
+
+	js, err := json.MarshalIndent(report, "", "\t")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	fmt.Fprintln(w, string(js))
+
+	if report.Status == selfCheckFail {
+		return 1
+	}
+
+	return 0
+}
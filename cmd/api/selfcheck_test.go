@@ -0,0 +1,37 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/codeaucafe/snippetbox/greenlight/internal/storage"
+	"github.com/codeaucafe/snippetbox/greenlight/internal/testutil"
+)
+
+// TestSelfChecks tests the self-checks which don't need a database or other servers.
+func TestSelfChecks(t *testing.T) {
+	c := selfChecker{}
+
+	// The check fails without an object store.
+	status, _ := c.checkStorage()
+	testutil.Equal(t, status, selfCheckFail)
+
+	store, err := storage.NewLocal(t.TempDir(), "http://localhost/v1/storage", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.store = store
+	status, _ = c.checkStorage()
+	testutil.Equal(t, status, selfCheckOK)
+
+	// The probe object is deleted again.
+	objects, err := store.List(context.Background(), "selfcheck/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.Equal(t, len(objects), 0)
+
+	status, _ = c.checkRedis()
+	testutil.Equal(t, status, selfCheckSkipped)
+}
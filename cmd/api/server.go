@@ -8,21 +8,54 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
 	"syscall"
 	"time"
+
+	"github.com/codeaucafe/snippetbox/greenlight/internal/validator"
 )
 
+// newServer returns an HTTP server for the given address and handler, using the timeouts from
+// the config struct.
+func (app *application) newServer(addr string, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ErrorLog:          log.New(app.logger, "", 0),
+		IdleTimeout:       app.config.server.idleTimeout,
+		ReadTimeout:       app.config.server.readTimeout,
+		ReadHeaderTimeout: app.config.server.readHeaderTimeout,
+		WriteTimeout:      app.config.server.writeTimeout,
+	}
+}
+
 func (app *application) serve() error {
 	// Declare an HTTP server using the same settings as in our main() function.
-	srv := &http.Server{
-		Addr:         fmt.Sprintf(":%d", app.config.port),
-		Handler:      app.routes(),
-		ErrorLog:     log.New(app.logger, "", 0),
-		IdleTimeout:  time.Minute,
-		ReadTimeout:  10 * time.Second,
-		WriteTimeout: 30 * time.Second,
+	srv := app.newServer(fmt.Sprintf(":%d", app.config.port), app.routes())
+
+	// If the admin listener is enabled, declare a second HTTP server for it. It's shut down
+	// after the public server, so that the healthcheck and metrics stay available while the
+	// public server drains.
+	var adminSrv *http.Server
+	if app.config.admin.addr != "" {
+		adminSrv = app.newServer(app.config.admin.addr, app.adminRoutes())
 	}
 
+	// Start the hub which pushes in-app notifications to the WebSocket connections. It's stopped
+	// once the connections have been closed during the shutdown.
+	stopHub := app.startNotificationHub()
+
+	// When the server starts shutting down, notify any streaming connections so that they can
+	// send a final event to their clients and close within the grace period.
+	srv.RegisterOnShutdown(func() {
+		if n := app.streams.closeAll(); n > 0 {
+			app.logger.PrintInfo("closing streaming connections", map[string]string{
+				"streams": strconv.Itoa(n),
+				"grace":   app.config.shutdown.streamGrace.String(),
+			})
+		}
+	})
+
 	// Create a shutdownError channel. We will use this to receive any errors returned
 	// by the graceful Shutdown() function.
 	shutdownError := make(chan error)
@@ -48,17 +81,39 @@ func (app *application) serve() error {
 			"signal": s.String(),
 		})
 
-		// Create a context with a 5-second timeout.
-		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		// Create a context with a 5-second timeout, plus the grace period that we give streaming
+		// connections to finish.
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second+app.config.shutdown.streamGrace)
 		defer cancel()
 
 		// call Shutdown on the server, and only send on the shutdownError channel if it returns
-		// an error
+		// an error. Shutdown() stops accepting new connections and then runs the function we
+		// registered with RegisterOnShutdown(), which tells the streaming handlers to finish up.
 		err := srv.Shutdown(ctx)
 		if err != nil {
 			shutdownError <- err
 		}
 
+		if adminSrv != nil {
+			err := adminSrv.Shutdown(ctx)
+			if err != nil {
+				shutdownError <- err
+			}
+		}
+
+		// Shutdown() doesn't wait for hijacked connections, such as WebSockets, so wait for any
+		// remaining streams separately.
+		if remaining := app.streams.wait(ctx); remaining > 0 {
+			app.logger.PrintInfo("abandoned streaming connections", map[string]string{
+				"streams": strconv.Itoa(remaining),
+			})
+		}
+
+		stopHub()
+
+		// Give up leadership of the scheduled jobs, so that another instance can take over.
+		app.stepDown()
+
 		// Log a message to say that we're waiting for any background goroutines to complete
 		// their tasks.
 		app.logger.PrintInfo("completing background tasks", map[string]string{
@@ -69,10 +124,33 @@ func (app *application) serve() error {
 		// until the background goroutines have finished. Then we return nil on the shutdownError
 		// channel to indicate that the shutdown as compleeted without any issues.
 		app.wg.Wait()
+
+		// Write any usage which has been metered and any movie views which have been counted
+		// since the last flush, so that they aren't lost.
+		app.flushUsage()
+		app.flushViews()
+
 		shutdownError <- nil
 
 	}()
 
+	// Start the admin server in a background goroutine. If it can't listen on its address then
+	// there's no point carrying on without it, so we exit.
+	if adminSrv != nil {
+		app.logger.PrintInfo("starting admin server", map[string]string{
+			"addr": adminSrv.Addr,
+		})
+
+		go func() {
+			err := adminSrv.ListenAndServe()
+			if !errors.Is(err, http.ErrServerClosed) {
+				app.logger.PrintFatal(err, map[string]string{
+					"addr": adminSrv.Addr,
+				})
+			}
+		}()
+	}
+
 	// Log a "starting server" message.
 	app.logger.PrintInfo("starting server", map[string]string{
 		"addr": srv.Addr,
@@ -104,3 +182,27 @@ func (app *application) serve() error {
 
 	return nil
 }
+
+// validateServerTimeouts checks the HTTP server timeouts for validateConfig(). Every timeout must
+// be positive, because a zero value means "no timeout" to http.Server and a single slow client
+// could then hold a connection open forever. The read header timeout is part of the read
+// timeout, so it can't be any longer.
+func validateServerTimeouts(v *validator.Validator, cfg config) {
+	timeouts := []struct {
+		flag  string
+		value time.Duration
+	}{
+		{"server-idle-timeout", cfg.server.idleTimeout},
+		{"server-read-timeout", cfg.server.readTimeout},
+		{"server-read-header-timeout", cfg.server.readHeaderTimeout},
+		{"server-write-timeout", cfg.server.writeTimeout},
+	}
+
+	for _, t := range timeouts {
+		v.Check(t.value > 0, t.flag, fmt.Sprintf("must be greater than zero, got %s", t.value))
+	}
+
+	v.Check(cfg.server.readHeaderTimeout <= cfg.server.readTimeout, "server-read-header-timeout",
+		fmt.Sprintf("must not be longer than server-read-timeout (%s), got %s",
+			cfg.server.readTimeout, cfg.server.readHeaderTimeout))
+}
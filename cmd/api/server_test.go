@@ -0,0 +1,45 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/codeaucafe/snippetbox/greenlight/internal/validator"
+)
+
+func TestValidateServerTimeouts(t *testing.T) {
+	valid := func() config {
+		var cfg config
+		cfg.server.idleTimeout = time.Minute
+		cfg.server.readTimeout = 10 * time.Second
+		cfg.server.readHeaderTimeout = 5 * time.Second
+		cfg.server.writeTimeout = 30 * time.Second
+		return cfg
+	}
+
+	tests := []struct {
+		name    string
+		modify  func(cfg *config)
+		wantErr bool
+	}{
+		{"Defaults", func(cfg *config) {}, false},
+		{"Long write timeout", func(cfg *config) { cfg.server.writeTimeout = 10 * time.Minute }, false},
+		{"Header timeout equal to read timeout", func(cfg *config) { cfg.server.readHeaderTimeout = 10 * time.Second }, false},
+		{"Zero idle timeout", func(cfg *config) { cfg.server.idleTimeout = 0 }, true},
+		{"Negative write timeout", func(cfg *config) { cfg.server.writeTimeout = -time.Second }, true},
+		{"Header timeout longer than read timeout", func(cfg *config) { cfg.server.readHeaderTimeout = time.Minute }, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := valid()
+			tt.modify(&cfg)
+
+			v := validator.New()
+			validateServerTimeouts(v, cfg)
+			if v.Valid() == tt.wantErr {
+				t.Errorf("got errors %v; want error: %t", v.Errors, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/codeaucafe/snippetbox/greenlight/internal/data"
+	"github.com/codeaucafe/snippetbox/greenlight/internal/jsonlog"
+	"github.com/codeaucafe/snippetbox/greenlight/internal/validator"
+)
+
+// runtimeSettings holds the settings which can be changed at runtime through the admin settings
+// endpoint. It is read on every request by our middleware, so access is protected by a mutex.
+type runtimeSettings struct {
+	mu       sync.RWMutex
+	settings data.Settings
+}
+
+// newRuntimeSettings returns a new runtimeSettings instance holding the given settings.
+func newRuntimeSettings(settings data.Settings) *runtimeSettings {
+	return &runtimeSettings{settings: settings}
+}
+
+// get returns a copy of the current settings.
+func (rs *runtimeSettings) get() data.Settings {
+	rs.mu.RLock()
+	defer rs.mu.RUnlock()
+
+	return rs.settings
+}
+
+// set replaces the current settings.
+func (rs *runtimeSettings) set(settings data.Settings) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	rs.settings = settings
+}
+
+// settingsFromConfig returns the runtime settings described by the command-line flags. These are
+// used until settings have been saved to the database.
+func settingsFromConfig(cfg config) data.Settings {
+	return data.Settings{
+		LimiterRPS:         cfg.limiter.rps,
+		LimiterBurst:       cfg.limiter.burst,
+		LimiterEnabled:     cfg.limiter.enabled,
+		MaintenanceMode:    false,
+		LogLevel:           "info",
+		CORSTrustedOrigins: cfg.cors.trustedOrigins,
+	}
+}
+
+// applySettings makes the given settings the current ones, and applies any which need more than
+// just storing (such as the log level).
+func (app *application) applySettings(settings data.Settings) {
+	app.settings.set(settings)
+
+	level, err := jsonlog.ParseLevel(settings.LogLevel)
+	if err != nil {
+		app.logger.PrintError(err, nil)
+		return
+	}
+
+	app.logger.SetLevel(level)
+}
+
+// loadSettings applies the runtime settings stored in the database, if there are any.
+func (app *application) loadSettings() error {
+	settings, err := app.models.Settings.Get(context.Background())
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			return nil
+		default:
+			return err
+		}
+	}
+
+	app.applySettings(*settings)
+
+	return nil
+}
+
+// refreshSettings polls the database for changes to the runtime settings made through another
+// instance of the application, and applies them. It runs until the application exits.
+func (app *application) refreshSettings(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+
+		settings, err := app.models.Settings.Get(context.Background())
+		if err != nil {
+			if !errors.Is(err, data.ErrRecordNotFound) {
+				app.logger.PrintError(err, nil)
+			}
+			continue
+		}
+
+		// Only apply the settings if they've been changed since we last saw them.
+		if settings.Version != app.settings.get().Version {
+			app.applySettings(*settings)
+
+			app.logger.PrintInfo("runtime settings refreshed", map[string]string{
+				"version": strconv.Itoa(int(settings.Version)),
+			})
+		}
+	}
+}
+
+// showSettingsHandler handles the "GET /v1/admin/settings" endpoint and returns the current
+// runtime settings.
+func (app *application) showSettingsHandler(w http.ResponseWriter, r *http.Request) {
+	settings := app.settings.get()
+
+	err := app.writeJSON(w, http.StatusOK, envelope{"settings": settings}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// updateSettingsHandler handles the "PATCH /v1/admin/settings" endpoint. It saves the updated
+// settings to the database, applies them immediately, and writes an audit log entry recording
+// who made the change along with the settings before and after.
+func (app *application) updateSettingsHandler(w http.ResponseWriter, r *http.Request) {
+	// Use pointers for the fields, so that we can use their zero values of nil as part of the
+	// partial update logic, in the same way as for movies.
+	var input struct {
+		LimiterRPS         *float64 `json:"limiter_rps"`
+		LimiterBurst       *int     `json:"limiter_burst"`
+		LimiterEnabled     *bool    `json:"limiter_enabled"`
+		MaintenanceMode    *bool    `json:"maintenance_mode"`
+		LogLevel           *string  `json:"log_level"`
+		CORSTrustedOrigins []string `json:"cors_trusted_origins"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	before := app.settings.get()
+	settings := before
+
+	if input.LimiterRPS != nil {
+		settings.LimiterRPS = *input.LimiterRPS
+	}
+
+	if input.LimiterBurst != nil {
+		settings.LimiterBurst = *input.LimiterBurst
+	}
+
+	if input.LimiterEnabled != nil {
+		settings.LimiterEnabled = *input.LimiterEnabled
+	}
+
+	if input.MaintenanceMode != nil {
+		settings.MaintenanceMode = *input.MaintenanceMode
+	}
+
+	if input.LogLevel != nil {
+		settings.LogLevel = *input.LogLevel
+	}
+
+	if input.CORSTrustedOrigins != nil {
+		settings.CORSTrustedOrigins = input.CORSTrustedOrigins
+	}
+
+	v := validator.New()
+
+	if data.ValidateSettings(v, &settings); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	// Save the settings. The version check means that if another admin (or another instance of
+	// the application) saved different settings since we loaded ours, we get an edit conflict.
+	err = app.models.Settings.Save(r.Context(), &settings, user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.applySettings(settings)
+
+	// Write the audit log entry for the change.
+	beforeJSON, _ := json.Marshal(before)
+	afterJSON, _ := json.Marshal(settings)
+
+	app.logger.PrintInfo("runtime settings updated", requestLogProperties(r, map[string]string{
+		"user_id": strconv.FormatInt(user.ID, 10),
+		"before":  string(beforeJSON),
+		"after":   string(afterJSON),
+	}))
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"settings": settings}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
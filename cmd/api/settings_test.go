@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/codeaucafe/snippetbox/greenlight/internal/data"
+	"github.com/codeaucafe/snippetbox/greenlight/internal/testutil"
+)
+
+// TestSettings tests the "/v1/admin/settings" endpoints: that only admins can change the runtime
+// settings, that invalid settings are rejected, and that saved settings are stored and applied
+// straight away.
+func TestSettings(t *testing.T) {
+	app, fx := newTestDBApp(t)
+	ts := newTestServer(app.routes())
+	defer ts.Close()
+
+	admin := fx.Token(fx.User(nil, "settings:admin"), data.ScopeAuthentication)
+	user := fx.Token(fx.User(nil, "movies:read"), data.ScopeAuthentication)
+
+	update := `{"limiter_rps": 5, "limiter_burst": 10, "maintenance_mode": true, "log_level": "error"}`
+
+	code, _, body := ts.request(t, http.MethodPatch, "/v1/admin/settings", user.Plaintext, update)
+	testutil.Status(t, code, body, http.StatusForbidden)
+
+	code, _, body = ts.request(t, http.MethodPatch, "/v1/admin/settings", admin.Plaintext,
+		`{"limiter_rps": 5, "limiter_burst": 10, "log_level": "loud"}`)
+	testutil.Status(t, code, body, http.StatusUnprocessableEntity)
+
+	code, _, body = ts.request(t, http.MethodPatch, "/v1/admin/settings", admin.Plaintext, update)
+	testutil.Status(t, code, body, http.StatusOK)
+
+	var got struct {
+		Settings data.Settings `json:"settings"`
+	}
+	testutil.DecodeJSON(t, body, &got)
+	testutil.Equal(t, got.Settings.MaintenanceMode, true)
+	testutil.Equal(t, got.Settings.LogLevel, "error")
+
+	saved, err := app.models.Settings.Get(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.Equal(t, saved.LimiterBurst, 10)
+
+	// Maintenance mode applies to the rest of the API straight away, but the admin endpoints are
+	// exempt so that it can be turned off again.
+	code, _, body = ts.request(t, http.MethodGet, "/v1/movies", user.Plaintext, "")
+	testutil.Status(t, code, body, http.StatusServiceUnavailable)
+
+	code, _, body = ts.request(t, http.MethodPatch, "/v1/admin/settings", admin.Plaintext, `{"maintenance_mode": false}`)
+	testutil.Status(t, code, body, http.StatusOK)
+
+	code, _, body = ts.request(t, http.MethodGet, "/v1/movies", user.Plaintext, "")
+	testutil.Status(t, code, body, http.StatusOK)
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	// loadSheddingActive is 1 while low priority requests are being shed, and 0 otherwise.
+	loadSheddingActive = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "greenlight",
+		Name:      "load_shedding_active",
+		Help:      "Whether low priority requests are being shed (1) or not (0).",
+	})
+
+	// loadShedRequests counts the low priority requests which were sent a 503 Service
+	// Unavailable response because load was being shed.
+	loadShedRequests = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "greenlight",
+		Name:      "load_shed_requests_total",
+		Help:      "Number of low priority requests rejected while shedding load.",
+	})
+)
+
+// shedSample is the outcome of a single database probe.
+type shedSample struct {
+	latency time.Duration
+	failed  bool
+}
+
+// loadShedder decides whether low priority traffic should be shed, based on a sliding window of
+// database probes. Load is shed while the average latency of the successful probes in the window
+// is above maxLatency, or the fraction of failed probes is above maxErrorRate, so that the
+// database's capacity is kept for the authentication, health and write endpoints.
+type loadShedder struct {
+	maxLatency   time.Duration
+	maxErrorRate float64
+
+	mu       sync.Mutex
+	samples  []shedSample
+	next     int
+	full     bool
+	shedding bool
+}
+
+// newLoadShedder returns a new loadShedder which keeps the last window probes.
+func newLoadShedder(window int, maxLatency time.Duration, maxErrorRate float64) *loadShedder {
+	return &loadShedder{
+		maxLatency:   maxLatency,
+		maxErrorRate: maxErrorRate,
+		samples:      make([]shedSample, window),
+	}
+}
+
+// record adds the outcome of a probe to the window and re-evaluates whether load should be shed.
+// It returns true if the shedding state changed.
+func (s *loadShedder) record(latency time.Duration, err error) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.samples[s.next] = shedSample{latency: latency, failed: err != nil}
+	s.next = (s.next + 1) % len(s.samples)
+	if s.next == 0 {
+		s.full = true
+	}
+
+	latency, errorRate := s.statsLocked()
+	shedding := latency > s.maxLatency || errorRate > s.maxErrorRate
+
+	changed := shedding != s.shedding
+	s.shedding = shedding
+
+	if shedding {
+		loadSheddingActive.Set(1)
+	} else {
+		loadSheddingActive.Set(0)
+	}
+
+	return changed
+}
+
+// active reports whether load is being shed.
+func (s *loadShedder) active() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.shedding
+}
+
+// stats returns the average latency of the successful probes in the window, and the fraction of
+// the probes which failed.
+func (s *loadShedder) stats() (time.Duration, float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.statsLocked()
+}
+
+// statsLocked does the work of stats(). The caller must hold s.mu.
+func (s *loadShedder) statsLocked() (time.Duration, float64) {
+	n := s.next
+	if s.full {
+		n = len(s.samples)
+	}
+
+	if n == 0 {
+		return 0, 0
+	}
+
+	var total time.Duration
+	var succeeded, failed int
+
+	for _, sample := range s.samples[:n] {
+		if sample.failed {
+			failed++
+			continue
+		}
+		total += sample.latency
+		succeeded++
+	}
+
+	var latency time.Duration
+	if succeeded > 0 {
+		latency = total / time.Duration(succeeded)
+	}
+
+	return latency, float64(failed) / float64(n)
+}
+
+// monitorLoadPeriodically probes the database once every interval and records the outcome in
+// app.shedder, logging when load shedding starts and stops. It runs until the application exits.
+func (app *application) monitorLoadPeriodically(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+
+		latency, err := app.models.System.Ping(context.Background(), app.config.health.dbTimeout)
+
+		if !app.shedder.record(latency, err) {
+			continue
+		}
+
+		avgLatency, errorRate := app.shedder.stats()
+		properties := map[string]string{
+			"db_latency":    avgLatency.String(),
+			"db_error_rate": fmt.Sprintf("%.2f", errorRate),
+		}
+
+		if app.shedder.active() {
+			app.logger.PrintError(fmt.Errorf("shedding low priority requests"), properties)
+		} else {
+			app.logger.PrintInfo("stopped shedding low priority requests", properties)
+		}
+	}
+}
+
+// shedLoad is middleware for the low priority routes, which sends a 503 Service Unavailable
+// response instead of calling the handler while load is being shed.
+func (app *application) shedLoad(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if app.shedder != nil && app.shedder.active() {
+			loadShedRequests.Inc()
+			app.loadSheddingResponse(w, r)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	}
+}
+
+// loadSheddingHealthCheck returns a health check which reports the application as degraded while
+// load is being shed.
+func (app *application) loadSheddingHealthCheck() healthCheck {
+	return healthCheck{
+		name: "load_shedding",
+		run: func() error {
+			if !app.shedder.active() {
+				return nil
+			}
+
+			latency, errorRate := app.shedder.stats()
+			return fmt.Errorf("%w: shedding low priority requests (database latency %s, error rate %.2f)",
+				errHealthDegraded, latency, errorRate)
+		},
+	}
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/codeaucafe/snippetbox/greenlight/internal/data"
+	"github.com/codeaucafe/snippetbox/greenlight/internal/validator"
+)
+
+// statsMetrics publishes the outcome of the materialized view refreshes in the expvar handler,
+// in the same way as healthMetrics.
+var statsMetrics = expvar.NewMap("materialized_views")
+
+// recentViewKey identifies a movie viewed by a particular user.
+type recentViewKey struct {
+	userID  int64
+	movieID int64
+}
+
+// viewCounter counts the number of times each movie is viewed, and the time each authenticated
+// user last viewed it, in memory. This means that we only write to the database once per flush
+// interval rather than on every request.
+type viewCounter struct {
+	mu     sync.Mutex
+	views  map[int64]int64
+	recent map[recentViewKey]time.Time
+}
+
+// newViewCounter returns a new, empty viewCounter.
+func newViewCounter() *viewCounter {
+	return &viewCounter{
+		views:  make(map[int64]int64),
+		recent: make(map[recentViewKey]time.Time),
+	}
+}
+
+// add records a view of a movie by a user. A user ID of 0 is used for anonymous users, whose
+// views count towards the trending movies but who have no recently viewed history.
+func (c *viewCounter) add(userID, movieID int64, viewedAt time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.views[movieID]++
+
+	if userID == 0 {
+		return
+	}
+
+	key := recentViewKey{userID: userID, movieID: movieID}
+	if viewedAt.After(c.recent[key]) {
+		c.recent[key] = viewedAt
+	}
+}
+
+// drain removes and returns all of the in-memory view counts and recent views.
+func (c *viewCounter) drain() (map[int64]int64, []*data.RecentView) {
+	c.mu.Lock()
+	views, recent := c.views, c.recent
+	c.views, c.recent = make(map[int64]int64), make(map[recentViewKey]time.Time)
+	c.mu.Unlock()
+
+	drained := make([]*data.RecentView, 0, len(recent))
+	for key, viewedAt := range recent {
+		drained = append(drained, &data.RecentView{UserID: key.userID, MovieID: key.movieID, ViewedAt: viewedAt})
+	}
+
+	return views, drained
+}
+
+// restore adds view counts and recent views back to the counter after a failed flush.
+func (c *viewCounter) restore(views map[int64]int64, recent []*data.RecentView) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for movieID, count := range views {
+		c.views[movieID] += count
+	}
+
+	for _, view := range recent {
+		key := recentViewKey{userID: view.UserID, movieID: view.MovieID}
+		if view.ViewedAt.After(c.recent[key]) {
+			c.recent[key] = view.ViewedAt
+		}
+	}
+}
+
+// flushViews writes the in-memory view counts and recent views to the database. If either write
+// fails the data is restored to the counter, so that it is included in the next flush instead.
+func (app *application) flushViews() {
+	if app.views == nil {
+		return
+	}
+
+	job := startJob("flush_views")
+	defer job.finish()
+
+	views, recent := app.views.drain()
+
+	if len(views) > 0 {
+		err := app.models.Stats.AddViews(context.Background(), data.QuotaPeriodStart(data.QuotaPeriodDay, app.clock.Now()), views)
+		if err != nil {
+			job.fail()
+			app.logger.PrintError(err, nil)
+			app.views.restore(views, nil)
+		}
+	}
+
+	if len(recent) > 0 {
+		err := app.models.Recent.Add(context.Background(), recent)
+		if err != nil {
+			job.fail()
+			app.logger.PrintError(err, nil)
+			app.views.restore(nil, recent)
+		}
+	}
+}
+
+// flushViewsPeriodically calls flushViews() once every interval. It runs until the application
+// exits, and serve() flushes any remaining counts during a graceful shutdown.
+func (app *application) flushViewsPeriodically(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		app.flushViews()
+	}
+}
+
+// refreshStats refreshes each of the materialized views behind the stats endpoints, recording
+// the outcome in our metrics. The statsRefresh mutex makes sure that a manual refresh through the
+// admin endpoint doesn't run at the same time as the scheduled one.
+func (app *application) refreshStats() map[string]string {
+	app.statsRefresh.Lock()
+	defer app.statsRefresh.Unlock()
+
+	job := startJob("stats_refresh")
+	defer job.finish()
+
+	results := make(map[string]string, len(data.StatsViews))
+
+	for _, view := range data.StatsViews {
+		start := time.Now()
+		err := app.models.Stats.Refresh(context.Background(), view)
+		duration := time.Since(start)
+
+		statsMetrics.Add(view+"_refreshes", 1)
+		statsMetrics.Set(view+"_duration_ms", expvarInt(duration.Milliseconds()))
+
+		if err != nil {
+			job.fail()
+			app.logger.PrintError(err, map[string]string{"view": view})
+
+			statsMetrics.Add(view+"_failures", 1)
+			statsMetrics.Set(view+"_status", expvarString("failed"))
+			results[view] = err.Error()
+			continue
+		}
+
+		statsMetrics.Set(view+"_status", expvarString("ok"))
+		statsMetrics.Set(view+"_last_refresh", expvarInt(time.Now().Unix()))
+		results[view] = "ok"
+	}
+
+	return results
+}
+
+// refreshStatsPeriodically calls refreshStats() once every interval, as long as this instance is
+// the leader. It runs until the application exits.
+func (app *application) refreshStatsPeriodically(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+
+		// Write any buffered view counts first, so that they're included in the trending view.
+		app.flushViews()
+
+		if !app.isLeader() {
+			continue
+		}
+
+		app.refreshStats()
+	}
+}
+
+// genreStatsHandler handles the "GET /v1/stats/genres" endpoint and returns catalog statistics
+// for each genre. The statistics come from a materialized view, so they may be a few minutes out
+// of date.
+func (app *application) genreStatsHandler(w http.ResponseWriter, r *http.Request) {
+	genres, err := app.models.Stats.Genres(r.Context())
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"genres": genres}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// trendingMoviesHandler handles the "GET /v1/stats/trending" endpoint and returns the most viewed
+// movies over the last week. The number of movies can be set with the limit query string
+// parameter, which defaults to 20.
+func (app *application) trendingMoviesHandler(w http.ResponseWriter, r *http.Request) {
+	v := validator.New()
+
+	limit := app.readInt(r.URL.Query(), "limit", 20, v)
+
+	v.Check(limit > 0, "limit", "must be greater than 0")
+	v.Check(limit <= 100, "limit", "must be a maximum of 100")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	movies, err := app.models.Stats.Trending(r.Context(), limit)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"movies": movies}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// refreshStatsHandler handles the "POST /v1/admin/stats/refresh" endpoint. It refreshes the
+// materialized views immediately, rather than waiting for the next scheduled refresh, and
+// returns the outcome for each view.
+func (app *application) refreshStatsHandler(w http.ResponseWriter, r *http.Request) {
+	app.flushViews()
+	results := app.refreshStats()
+
+	err := app.writeJSON(w, http.StatusOK, envelope{"views": results}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// recentlyViewedHandler handles the "GET /v1/users/me/recently-viewed" endpoint and returns the
+// movies which the current user has viewed most recently, newest first. The number of movies can
+// be set with the limit query string parameter, which defaults to 20. Views are written to the
+// database in batches, so the most recent views may take up to a minute to appear.
+func (app *application) recentlyViewedHandler(w http.ResponseWriter, r *http.Request) {
+	v := validator.New()
+
+	limit := app.readInt(r.URL.Query(), "limit", 20, v)
+
+	v.Check(limit > 0, "limit", "must be greater than 0")
+	v.Check(limit <= data.MaxRecentlyViewed, "limit", fmt.Sprintf("must be a maximum of %d", data.MaxRecentlyViewed))
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	viewed, err := app.models.Recent.GetForUser(r.Context(), app.contextGetUser(r).ID, limit)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"recently_viewed": viewed}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
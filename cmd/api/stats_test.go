@@ -0,0 +1,186 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/codeaucafe/snippetbox/greenlight/internal/clock"
+	"github.com/codeaucafe/snippetbox/greenlight/internal/data"
+	"github.com/codeaucafe/snippetbox/greenlight/internal/testutil"
+)
+
+// TestStats tests that the genre stats and trending movies only change when their materialized
+// views are refreshed, and that the trending movies are ordered by their buffered view counts.
+func TestStats(t *testing.T) {
+	app, fx := newTestDBApp(t)
+	ts := newTestServer(app.routes())
+	defer ts.Close()
+
+	// The trending_movies view counts the views since CURRENT_DATE in the database, so the views
+	// need to be recorded against today rather than the fixed test time.
+	app.clock.(*clock.Mock).Set(time.Now())
+
+	token := fx.Token(fx.User(nil, "movies:read"), data.ScopeAuthentication)
+	admin := fx.Token(fx.User(nil, "stats:admin"), data.ScopeAuthentication)
+
+	popular := fx.Movie(func(m *data.Movie) { m.Genres = []string{"western"}; m.Runtime = 100 })
+	other := fx.Movie(func(m *data.Movie) { m.Genres = []string{"western"}; m.Runtime = 120 })
+
+	genres := func() map[string]data.GenreSummary {
+		t.Helper()
+
+		code, _, body := ts.request(t, http.MethodGet, "/v1/stats/genres", token.Plaintext, "")
+		testutil.Status(t, code, body, http.StatusOK)
+
+		var got struct {
+			Genres []data.GenreSummary `json:"genres"`
+		}
+		testutil.DecodeJSON(t, body, &got)
+
+		byName := map[string]data.GenreSummary{}
+		for _, genre := range got.Genres {
+			byName[genre.Genre] = genre
+		}
+		return byName
+	}
+
+	trending := func() []data.TrendingMovie {
+		t.Helper()
+
+		code, _, body := ts.request(t, http.MethodGet, "/v1/stats/trending?limit=2", token.Plaintext, "")
+		testutil.Status(t, code, body, http.StatusOK)
+
+		var got struct {
+			Movies []data.TrendingMovie `json:"movies"`
+		}
+		testutil.DecodeJSON(t, body, &got)
+		return got.Movies
+	}
+
+	for _, movie := range []*data.Movie{popular, popular, other} {
+		code, _, body := ts.request(t, http.MethodGet, fmt.Sprintf("/v1/movies/%d", movie.ID), token.Plaintext, "")
+		testutil.Status(t, code, body, http.StatusOK)
+	}
+
+	// Nothing changes until the views are refreshed.
+	testutil.Equal(t, genres()["western"].Movies, int64(0))
+	testutil.Equal(t, len(trending()), 0)
+
+	code, _, body := ts.request(t, http.MethodPost, "/v1/admin/stats/refresh", token.Plaintext, "")
+	testutil.Status(t, code, body, http.StatusForbidden)
+
+	code, _, body = ts.request(t, http.MethodPost, "/v1/admin/stats/refresh", admin.Plaintext, "")
+	testutil.Status(t, code, body, http.StatusOK)
+
+	var refreshed struct {
+		Views map[string]string `json:"views"`
+	}
+	testutil.DecodeJSON(t, body, &refreshed)
+
+	for _, view := range data.StatsViews {
+		testutil.Equal(t, refreshed.Views[view], "ok")
+	}
+
+	western := genres()["western"]
+	testutil.Equal(t, western.Movies, int64(2))
+	testutil.Equal(t, western.AverageRuntime, float64(110))
+
+	movies := trending()
+	testutil.Equal(t, len(movies), 2)
+	testutil.Equal(t, movies[0], data.TrendingMovie{ID: popular.ID, Title: popular.Title, Year: popular.Year, Views: 2})
+	testutil.Equal(t, movies[1].ID, other.ID)
+
+	code, _, body = ts.request(t, http.MethodGet, "/v1/stats/trending?limit=0", token.Plaintext, "")
+	testutil.Status(t, code, body, http.StatusUnprocessableEntity)
+}
+
+// TestViewCounter tests that the viewCounter counts every view, keeps the latest view of each
+// movie by each user, and gives back the data from a failed flush with restore.
+func TestViewCounter(t *testing.T) {
+	c := newViewCounter()
+
+	c.add(1, 10, testTime.Add(time.Minute))
+	c.add(1, 10, testTime)
+	c.add(2, 10, testTime)
+	c.add(0, 20, testTime)
+
+	views, recent := c.drain()
+	testutil.Equal(t, fmt.Sprint(views), fmt.Sprint(map[int64]int64{10: 3, 20: 1}))
+	testutil.Equal(t, len(recent), 2)
+
+	for _, view := range recent {
+		if view.UserID == 1 {
+			testutil.Equal(t, view.ViewedAt, testTime.Add(time.Minute))
+		}
+	}
+
+	empty, none := c.drain()
+	testutil.Equal(t, len(empty)+len(none), 0)
+
+	c.add(1, 10, testTime)
+	c.restore(views, recent)
+
+	views, recent = c.drain()
+	testutil.Equal(t, fmt.Sprint(views), fmt.Sprint(map[int64]int64{10: 4, 20: 1}))
+	testutil.Equal(t, len(recent), 2)
+}
+
+// TestRecentlyViewed tests that the movies a user views show up in their recently viewed list,
+// newest first, once the buffered views have been flushed.
+func TestRecentlyViewed(t *testing.T) {
+	app, fx := newTestDBApp(t)
+	ts := newTestServer(app.routes())
+	defer ts.Close()
+
+	token := fx.Token(fx.User(nil, "movies:read"), data.ScopeAuthentication)
+	other := fx.Token(fx.User(nil, "movies:read"), data.ScopeAuthentication)
+
+	first, second := fx.Movie(), fx.Movie()
+
+	view := func(movie *data.Movie) {
+		t.Helper()
+
+		app.clock.(*clock.Mock).Advance(time.Minute)
+
+		code, _, body := ts.request(t, http.MethodGet, fmt.Sprintf("/v1/movies/%d", movie.ID), token.Plaintext, "")
+		testutil.Status(t, code, body, http.StatusOK)
+	}
+
+	recentlyViewed := func(plaintext string) []int64 {
+		t.Helper()
+
+		code, _, body := ts.request(t, http.MethodGet, "/v1/users/me/recently-viewed", plaintext, "")
+		testutil.Status(t, code, body, http.StatusOK)
+
+		var got struct {
+			RecentlyViewed []data.RecentlyViewedMovie `json:"recently_viewed"`
+		}
+		testutil.DecodeJSON(t, body, &got)
+
+		ids := []int64{}
+		for _, rv := range got.RecentlyViewed {
+			ids = append(ids, rv.Movie.ID)
+		}
+		return ids
+	}
+
+	view(first)
+	view(second)
+
+	// Views are only written to the database when they're flushed.
+	testutil.Equal(t, len(recentlyViewed(token.Plaintext)), 0)
+
+	app.flushViews()
+	testutil.Equal(t, fmt.Sprint(recentlyViewed(token.Plaintext)), fmt.Sprint([]int64{second.ID, first.ID}))
+
+	view(first)
+	app.flushViews()
+	testutil.Equal(t, fmt.Sprint(recentlyViewed(token.Plaintext)), fmt.Sprint([]int64{first.ID, second.ID}))
+
+	testutil.Equal(t, len(recentlyViewed(other.Plaintext)), 0)
+
+	code, _, body := ts.request(t, http.MethodGet, "/v1/users/me/recently-viewed?limit=1000", token.Plaintext, "")
+	testutil.Status(t, code, body, http.StatusUnprocessableEntity)
+}
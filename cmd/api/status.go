@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/codeaucafe/snippetbox/greenlight/internal/data"
+	"github.com/codeaucafe/snippetbox/greenlight/internal/validator"
+)
+
+// statusMaxDays is the most days of history that the status page can show. Heartbeats older than
+// this are deleted.
+const statusMaxDays = 90
+
+// statusHandler handles the "GET /v1/status" endpoint, which returns the data for a public status
+// page: the overall status, the uptime and error rate over the last 30 days (or the number of
+// days in the days query string parameter, up to 90) along with a breakdown by day, and the
+// incidents posted by admins in that time. Uptime is worked out from the heartbeats written by
+// the API processes each minute, and the error rate from the server errors in the metered usage,
+// so both only cover the time since those were first recorded.
+func (app *application) statusHandler(w http.ResponseWriter, r *http.Request) {
+	v := validator.New()
+
+	days := app.readInt(r.URL.Query(), "days", 30, v)
+
+	v.Check(days >= 1 && days <= statusMaxDays, "days", "must be between 1 and 90")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	now := app.clock.Now()
+	from := now.AddDate(0, 0, -(days - 1))
+
+	history, err := app.models.Status.GetDays(r.Context(), from, now)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	incidents, err := app.models.Incidents.GetRecent(r.Context(), data.QuotaPeriodStart(data.QuotaPeriodDay, from))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// The overall status is the impact of the most severe ongoing incident. GetRecent() returns
+	// the ongoing incidents first, most severe first, so it's the first incident if that one's
+	// ongoing.
+	status := data.StatusOperational
+	if len(incidents) > 0 && incidents[0].ResolvedAt == nil {
+		status = incidents[0].Impact
+	}
+
+	summary := data.SummarizeStatus(history)
+
+	err = app.writeJSON(w, http.StatusOK, envelope{
+		"status":     status,
+		"uptime":     summary.Uptime,
+		"error_rate": summary.ErrorRate,
+		"days":       history,
+		"incidents":  incidents,
+	}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// createIncidentHandler handles the "POST /v1/admin/incidents" endpoint and posts an incident on
+// the status page. It starts at started_at (or straight away), and is ongoing until it's resolved
+// with "PATCH /v1/admin/incidents/:id", unless resolved_at is given.
+func (app *application) createIncidentHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Title      string     `json:"title"`
+		Message    string     `json:"message"`
+		Impact     string     `json:"impact"`
+		StartedAt  *time.Time `json:"started_at"`
+		ResolvedAt *time.Time `json:"resolved_at"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	incident := &data.Incident{
+		CreatedBy:  &user.ID,
+		Title:      input.Title,
+		Message:    input.Message,
+		Impact:     input.Impact,
+		StartedAt:  app.clock.Now(),
+		ResolvedAt: input.ResolvedAt,
+	}
+
+	if input.StartedAt != nil {
+		incident.StartedAt = *input.StartedAt
+	}
+
+	v := validator.New()
+
+	if data.ValidateIncident(v, incident); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Incidents.Insert(r.Context(), incident)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"incident": incident}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// updateIncidentHandler handles the "PATCH /v1/admin/incidents/:id" endpoint, which posts an
+// update to an incident, such as a new message or impact. Setting resolved to true resolves the
+// incident as of now, and setting it to false reopens it.
+func (app *application) updateIncidentHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	incident, err := app.models.Incidents.Get(r.Context(), id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	var input struct {
+		Title     *string    `json:"title"`
+		Message   *string    `json:"message"`
+		Impact    *string    `json:"impact"`
+		StartedAt *time.Time `json:"started_at"`
+		Resolved  *bool      `json:"resolved"`
+	}
+
+	err = app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	if input.Title != nil {
+		incident.Title = *input.Title
+	}
+	if input.Message != nil {
+		incident.Message = *input.Message
+	}
+	if input.Impact != nil {
+		incident.Impact = *input.Impact
+	}
+	if input.StartedAt != nil {
+		incident.StartedAt = *input.StartedAt
+	}
+
+	// Resolving an incident which is already resolved keeps the time it was resolved at.
+	if input.Resolved != nil {
+		switch {
+		case !*input.Resolved:
+			incident.ResolvedAt = nil
+		case incident.ResolvedAt == nil:
+			now := app.clock.Now()
+			incident.ResolvedAt = &now
+		}
+	}
+
+	v := validator.New()
+
+	if data.ValidateIncident(v, incident); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Incidents.Update(r.Context(), incident)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"incident": incident}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// deleteIncidentHandler handles the "DELETE /v1/admin/incidents/:id" endpoint, for incidents
+// which were posted by mistake.
+func (app *application) deleteIncidentHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	err = app.models.Incidents.Delete(r.Context(), id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "incident successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// recordHeartbeat records that the API is up this minute, for the uptime on the status page.
+func (app *application) recordHeartbeat() {
+	job := startJob("status_heartbeat")
+	defer job.finish()
+
+	err := app.models.Status.RecordHeartbeat(context.Background(), app.clock.Now(), statusMaxDays*24*time.Hour)
+	if err != nil {
+		job.fail()
+		app.logger.PrintError(err, nil)
+	}
+}
+
+// recordHeartbeatsPeriodically calls recordHeartbeat() once every interval. Every API process
+// runs it, so that the uptime reflects whether any of them were serving requests. It runs until
+// the application exits.
+func (app *application) recordHeartbeatsPeriodically(interval time.Duration) {
+	for {
+		app.recordHeartbeat()
+		time.Sleep(interval)
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/codeaucafe/snippetbox/greenlight/internal/clock"
+	"github.com/codeaucafe/snippetbox/greenlight/internal/data"
+	"github.com/codeaucafe/snippetbox/greenlight/internal/testutil"
+)
+
+// TestStatus tests that the status page data is worked out from the heartbeats and the metered
+// server errors, and that it shows the incidents posted by admins, with the overall status
+// following the ongoing ones.
+func TestStatus(t *testing.T) {
+	app, fx := newTestDBApp(t)
+	ts := newTestServer(app.routes())
+	defer ts.Close()
+
+	admin := fx.Token(fx.User(nil, "status:admin"), data.ScopeAuthentication)
+
+	// Heartbeats for two minutes in a row, and then a minute without one.
+	app.recordHeartbeat()
+	app.clock.(*clock.Mock).Advance(time.Minute)
+	app.recordHeartbeat()
+	app.clock.(*clock.Mock).Advance(2 * time.Minute)
+
+	err := app.models.Usage.Add(context.Background(), []*data.UsageRecord{{
+		Day:      data.QuotaPeriodStart(data.QuotaPeriodDay, app.clock.Now()),
+		Endpoint: "GET /v1/movies",
+		Requests: 200,
+		Errors:   1,
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type status struct {
+		Status    string            `json:"status"`
+		Uptime    *float64          `json:"uptime"`
+		ErrorRate *float64          `json:"error_rate"`
+		Days      []data.StatusDay  `json:"days"`
+		Incidents []json.RawMessage `json:"incidents"`
+	}
+
+	code, _, body := ts.request(t, http.MethodGet, "/v1/status?days=7", "", "")
+	testutil.Status(t, code, body, http.StatusOK)
+
+	var got status
+	testutil.DecodeJSON(t, body, &got)
+
+	testutil.Equal(t, got.Status, data.StatusOperational)
+	testutil.Equal(t, *got.Uptime, 66.67)
+	testutil.Equal(t, *got.ErrorRate, 0.5)
+	testutil.Equal(t, len(got.Days), 7)
+	testutil.Equal(t, got.Days[0].Uptime == nil, true)
+	testutil.Equal(t, got.Days[6].Requests, int64(200))
+
+	code, _, body = ts.request(t, http.MethodPost, "/v1/admin/incidents", admin.Plaintext,
+		`{"title": "Database outage", "message": "We're looking into it.", "impact": "major_outage"}`)
+	testutil.Status(t, code, body, http.StatusCreated)
+
+	var created struct {
+		Incident data.Incident `json:"incident"`
+	}
+	testutil.DecodeJSON(t, body, &created)
+
+	code, _, body = ts.request(t, http.MethodGet, "/v1/status", "", "")
+	testutil.Status(t, code, body, http.StatusOK)
+	testutil.DecodeJSON(t, body, &got)
+	testutil.Equal(t, got.Status, "major_outage")
+
+	code, _, body = ts.request(t, http.MethodPatch, fmt.Sprintf("/v1/admin/incidents/%d", created.Incident.ID),
+		admin.Plaintext, `{"message": "Fixed.", "resolved": true}`)
+	testutil.Status(t, code, body, http.StatusOK)
+
+	code, _, body = ts.request(t, http.MethodGet, "/v1/status", "", "")
+	testutil.Status(t, code, body, http.StatusOK)
+	testutil.DecodeJSON(t, body, &got)
+	testutil.Equal(t, got.Status, data.StatusOperational)
+	testutil.Equal(t, len(got.Incidents), 1)
+
+	code, _, body = ts.request(t, http.MethodGet, "/v1/status?days=91", "", "")
+	testutil.Status(t, code, body, http.StatusUnprocessableEntity)
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/codeaucafe/snippetbox/greenlight/internal/storage"
+	"github.com/julienschmidt/httprouter"
+)
+
+// storageCleanupTimeout is how long the orphan cleanup can spend on each key prefix.
+const storageCleanupTimeout = 10 * time.Minute
+
+// storagePutTimeout is how long a rendered file, such as a report or an export, can take to be
+// written to storage.
+const storagePutTimeout = time.Minute
+
+// storageOwners maps each key prefix in object storage to the function which reports whether an
+// object under it is still referenced, for the orphan cleanup. Each new kind of stored file
+// (posters, avatars and so on) should be added here, under its own prefix. Database backups,
+// under "backups/", aren't referenced by anything and are pruned by the backup retention instead,
+// so they must never be added.
+func (app *application) storageOwners() map[string]func(ctx context.Context, key string) (bool, error) {
+	return map[string]func(ctx context.Context, key string) (bool, error){
+		"reports/": app.models.Reports.ArtifactInUse,
+		"exports/": app.models.Exports.ArtifactInUse,
+		"posters/": app.models.Movies.PosterInUse,
+	}
+}
+
+// openStorage opens the object store described by the storage settings.
+func openStorage(cfg config) (storage.Store, error) {
+	return storage.Open(storage.Config{
+		Driver:    cfg.storage.driver,
+		Dir:       cfg.storage.dir,
+		BaseURL:   cfg.storage.baseURL,
+		Secret:    cfg.storage.urlSecret,
+		Bucket:    cfg.storage.bucket,
+		Endpoint:  cfg.storage.endpoint,
+		Region:    cfg.storage.region,
+		AccessKey: cfg.storage.accessKey,
+		SecretKey: cfg.storage.secretKey,
+		Insecure:  cfg.storage.insecure,
+	})
+}
+
+// putObject writes the output of write to the object with the given key as it's produced, so that
+// the whole file never has to be held in memory. write is run in its own goroutine, writing to a
+// pipe which the store reads from. If write fails then so does the upload, and no object is left
+// behind.
+func (app *application) putObject(ctx context.Context, key, contentType string, write func(w io.Writer) error) (*storage.Object, error) {
+	pr, pw := io.Pipe()
+
+	go func() {
+		pw.CloseWithError(write(pw))
+	}()
+
+	object, err := app.storage.Put(ctx, key, pr, contentType)
+
+	// If the store gave up before reading everything, this stops write from blocking forever.
+	pr.CloseWithError(err)
+
+	return object, err
+}
+
+// signedURL returns a signed URL for downloading the object with the given key, which is valid
+// for the configured expiry.
+func (app *application) signedURL(r *http.Request, key string) (string, error) {
+	return app.storage.SignedURL(r.Context(), key, app.config.storage.signedURLExpiry)
+}
+
+// sendObject streams an object from storage to the client, as a file download with the given
+// file name.
+func (app *application) sendObject(w http.ResponseWriter, r *http.Request, key, filename string) {
+	body, object, err := app.storage.Get(r.Context(), key)
+	if err != nil {
+		switch {
+		case errors.Is(err, storage.ErrNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	defer func() {
+		if err := body.Close(); err != nil {
+			app.logError(r, err)
+		}
+	}()
+
+	w.Header().Set("Content-Type", object.ContentType)
+	w.Header().Set("Content-Length", strconv.FormatInt(object.Size, 10))
+	if filename != "" {
+		w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`"`)
+	}
+
+	_, err = io.Copy(w, body)
+	if err != nil {
+		app.logError(r, err)
+	}
+}
+
+// downloadObjectHandler handles the "GET /v1/storage/*key" endpoint, which serves the signed URLs
+// of the local storage driver. The URL's signature stands in for authentication, so anyone with
+// the URL can download the object until it expires. The bucket drivers' signed URLs point at the
+// bucket instead, so with them this endpoint always responds with 404 Not Found.
+func (app *application) downloadObjectHandler(w http.ResponseWriter, r *http.Request) {
+	local, ok := app.storage.(*storage.Local)
+	if !ok {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	key := strings.TrimPrefix(httprouter.ParamsFromContext(r.Context()).ByName("key"), "/")
+	if !storage.ValidKey(key) {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	qs := r.URL.Query()
+
+	err := local.Verify(key, qs.Get("expires"), qs.Get("signature"))
+	if err != nil {
+		app.invalidSignedURLResponse(w, r)
+		return
+	}
+
+	app.sendObject(w, r, key, "")
+}
+
+// cleanupStorage deletes the objects in storage which nothing refers to any more, such as the
+// rendered reports of deleted accounts, once they're older than the configured orphan age.
+func (app *application) cleanupStorage() {
+	job := startJob("storage_cleanup")
+	defer job.finish()
+
+	for prefix, inUse := range app.storageOwners() {
+		ctx, cancel := context.WithTimeout(context.Background(), storageCleanupTimeout)
+		deleted, err := storage.Sweep(ctx, app.storage, app.clock, prefix, app.config.storage.orphanAge, inUse)
+		cancel()
+
+		if err != nil {
+			job.fail()
+			app.logger.PrintError(err, map[string]string{"prefix": prefix})
+		}
+
+		if deleted > 0 {
+			app.logger.PrintInfo("deleted orphaned storage objects", map[string]string{
+				"prefix": prefix,
+				"count":  strconv.Itoa(deleted),
+			})
+		}
+	}
+}
+
+// cleanupStoragePeriodically calls cleanupStorage() once every interval, as long as this
+// instance is the leader. It runs until the application exits.
+func (app *application) cleanupStoragePeriodically(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+
+		if !app.isLeader() {
+			continue
+		}
+
+		app.cleanupStorage()
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/codeaucafe/snippetbox/greenlight/internal/clock"
+	"github.com/codeaucafe/snippetbox/greenlight/internal/data"
+	"github.com/codeaucafe/snippetbox/greenlight/internal/storage"
+	"github.com/codeaucafe/snippetbox/greenlight/internal/testutil"
+	"github.com/julienschmidt/httprouter"
+)
+
+// TestLocalStorage tests that objects written to the local storage driver can be downloaded with
+// their signed URLs, that tampered and expired URLs are rejected, and that the orphan cleanup only
+// deletes the objects which nothing refers to.
+func TestLocalStorage(t *testing.T) {
+	app := newTestApp()
+	app.config.storage.signedURLExpiry = time.Minute
+
+	local, err := storage.NewLocal(t.TempDir(), "/v1/storage", "testing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	local.Clock = app.clock
+	app.storage = local
+
+	mock := app.clock.(*clock.Mock)
+
+	cr := newCORSRouter(httprouter.New(), app.defaultCORSPolicy())
+	app.registerRoutes(cr, append(app.routeTable(), app.operationalRouteTable()...))
+
+	get := func(target string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		r := app.contextSetUser(httptest.NewRequest(http.MethodGet, target, nil), data.AnonymousUser)
+		cr.ServeHTTP(rr, r)
+		return rr
+	}
+
+	ctx := context.Background()
+
+	for _, key := range []string{"reports/1.csv", "reports/2.csv", "other/3.json"} {
+		_, err := local.Put(ctx, key, strings.NewReader("title,year\nCasablanca,1942\n"), "text/csv")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	signed, err := local.SignedURL(ctx, "reports/1.csv", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := get(signed)
+	testutil.Status(t, rr.Code, rr.Body.Bytes(), http.StatusOK)
+	testutil.Equal(t, rr.Body.String(), "title,year\nCasablanca,1942\n")
+	testutil.StringContains(t, rr.Header().Get("Content-Type"), "text/csv")
+
+	// The signature only covers the key it was made for.
+	testutil.Equal(t, get(strings.Replace(signed, "1.csv", "2.csv", 1)).Code, http.StatusForbidden)
+
+	// The URL expires once the clock passes its expiry time.
+	mock.Advance(2 * time.Minute)
+	testutil.Equal(t, get(signed).Code, http.StatusForbidden)
+
+	_, err = local.SignedURL(ctx, "../secrets", time.Minute)
+	testutil.Equal(t, errors.Is(err, storage.ErrInvalidKey), true)
+
+	objects, err := local.List(ctx, "reports/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.Equal(t, len(objects), 2)
+
+	// Objects younger than the minimum age are left alone, whether or not they are referenced.
+	unused := func(context.Context, string) (bool, error) { return false, nil }
+
+	deleted, err := storage.Sweep(ctx, local, app.clock, "", time.Hour, unused)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.Equal(t, deleted, 0)
+
+	// Once they're old enough, only the objects which aren't referenced are deleted.
+	mock.Advance(time.Hour)
+
+	deleted, err = storage.Sweep(ctx, local, app.clock, "reports/", time.Hour, func(_ context.Context, key string) (bool, error) {
+		return key == "reports/1.csv", nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.Equal(t, deleted, 1)
+
+	_, _, err = local.Get(ctx, "reports/2.csv")
+	testutil.Equal(t, errors.Is(err, storage.ErrNotFound), true)
+
+	signed, err = local.SignedURL(ctx, "reports/1.csv", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.Equal(t, get(signed).Code, http.StatusOK)
+
+	u, _ := url.Parse(signed)
+	testutil.Equal(t, u.Path, "/v1/storage/reports/1.csv")
+}
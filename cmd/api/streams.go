@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"sync"
+)
+
+// streamMetrics publishes the number of active and total streaming connections in the expvar
+// handler, by kind (sse, websocket, ndjson and so on). These are counted separately from the
+// regular requests, because a single long-lived stream would otherwise skew the request metrics.
+var streamMetrics = expvar.NewMap("streams")
+
+// streamTracker keeps track of the long-lived streaming responses, such as server-sent events,
+// WebSocket connections and large NDJSON exports. During a graceful shutdown the tracker tells
+// each stream that the server is closing, so that it can send a final event (or close frame) to
+// the client, and then gives the streams a grace period to finish.
+//
+// This is needed because http.Server.Shutdown() doesn't know about hijacked connections like
+// WebSockets at all, and would otherwise wait for an open-ended stream until its timeout.
+type streamTracker struct {
+	mu      sync.Mutex
+	wg      sync.WaitGroup
+	active  int
+	closing chan struct{}
+	closed  bool
+}
+
+// newStreamTracker returns a new streamTracker.
+func newStreamTracker() *streamTracker {
+	return &streamTracker{closing: make(chan struct{})}
+}
+
+// track registers a new stream of the given kind. Streaming handlers should call it before they
+// start writing, watch the returned closing channel alongside their own events, and call done
+// when the stream ends. For example:
+//
+//	closing, done := app.streams.track("sse")
+//	defer done()
+//
+//	for {
+//		select {
+//		case <-closing:
+//			// Send a final event telling the client to reconnect elsewhere, then return.
+//		case event := <-events:
+//			// Send the event.
+//		}
+//	}
+//
+// If the server is already shutting down then the closing channel is already closed.
+func (t *streamTracker) track(kind string) (<-chan struct{}, func()) {
+	t.mu.Lock()
+	t.active++
+	t.wg.Add(1)
+	t.mu.Unlock()
+
+	streamMetrics.Add("active_"+kind, 1)
+	streamMetrics.Add("total_"+kind, 1)
+
+	var once sync.Once
+
+	done := func() {
+		once.Do(func() {
+			t.mu.Lock()
+			t.active--
+			t.mu.Unlock()
+
+			streamMetrics.Add("active_"+kind, -1)
+			t.wg.Done()
+		})
+	}
+
+	return t.closing, done
+}
+
+// closeAll tells every stream that the server is shutting down, and returns the number of
+// streams which were open. It's safe to call more than once.
+func (t *streamTracker) closeAll() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if !t.closed {
+		close(t.closing)
+		t.closed = true
+	}
+
+	return t.active
+}
+
+// wait blocks until all of the streams have finished or the context is done, and returns the
+// number of streams which are still open.
+func (t *streamTracker) wait(ctx context.Context) int {
+	finished := make(chan struct{})
+
+	go func() {
+		t.wg.Wait()
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+	case <-ctx.Done():
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.active
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// TestStreamTracker checks that closeAll notifies open streams, and that wait returns once they
+// have finished or the context is done.
+func TestStreamTracker(t *testing.T) {
+	tracker := newStreamTracker()
+
+	closing, done := tracker.track("sse")
+	_, stuck := tracker.track("websocket")
+
+	go func() {
+		<-closing
+		done()
+	}()
+
+	if n := tracker.closeAll(); n != 2 {
+		t.Fatalf("closeAll() = %d; want 2", n)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	if remaining := tracker.wait(ctx); remaining != 1 {
+		t.Fatalf("wait() = %d; want 1", remaining)
+	}
+
+	stuck()
+	stuck()
+
+	if remaining := tracker.wait(context.Background()); remaining != 0 {
+		t.Fatalf("wait() = %d; want 0", remaining)
+	}
+
+	// Streams which start after the shutdown has begun are told to close straight away.
+	closing, done = tracker.track("sse")
+	defer done()
+
+	select {
+	case <-closing:
+	default:
+		t.Fatal("closing channel is open after closeAll()")
+	}
+}
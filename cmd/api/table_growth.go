@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	// tableRows is the approximate number of rows in each of the watched tables, as of the last
+	// table growth check.
+	tableRows = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "greenlight",
+		Name:      "table_rows",
+		Help:      "Approximate number of rows in the table, by table.",
+	}, []string{"table"})
+
+	// tableSize is the size on disk of each of the watched tables, including their indexes, as of
+	// the last table growth check.
+	tableSize = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "greenlight",
+		Name:      "table_size_bytes",
+		Help:      "Size of the table on disk, including its indexes, by table.",
+	}, []string{"table"})
+
+	// tableLimitExceeded is 1 for each watched table which is over one of its soft limits, by
+	// table and limit ("rows" or "size"), and 0 otherwise.
+	tableLimitExceeded = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "greenlight",
+		Name:      "table_limit_exceeded",
+		Help:      "Whether the table is over its soft limit (1) or not (0), by table and limit.",
+	}, []string{"table", "limit"})
+)
+
+// errTableOverLimit is logged when a watched table is over one of its soft limits.
+var errTableOverLimit = errors.New("table is over its soft limit, check that its retention is working")
+
+// tableLimits is a flag.Value holding a limit for each of a set of tables, written as space
+// separated table=limit pairs, such as "tokens=1000000 events=5000000". A limit of 0 means that
+// the table is measured but never warned about.
+type tableLimits map[string]int64
+
+// String returns the limits in the same form that Set accepts, sorted by table.
+func (l tableLimits) String() string {
+	pairs := make([]string, 0, len(l))
+	for table, limit := range l {
+		pairs = append(pairs, table+"="+strconv.FormatInt(limit, 10))
+	}
+	sort.Strings(pairs)
+
+	return strings.Join(pairs, " ")
+}
+
+// Set replaces the limits with those in val.
+func (l *tableLimits) Set(val string) error {
+	limits := tableLimits{}
+
+	for _, pair := range strings.Fields(val) {
+		table, limit, ok := strings.Cut(pair, "=")
+		if !ok || table == "" {
+			return fmt.Errorf("invalid table limit %q: must be table=limit", pair)
+		}
+
+		n, err := strconv.ParseInt(limit, 10, 64)
+		if err != nil || n < 0 {
+			return fmt.Errorf("invalid table limit %q: the limit must be a whole number", pair)
+		}
+
+		limits[table] = n
+	}
+
+	*l = limits
+	return nil
+}
+
+// watchedTables returns the tables which the table growth check measures: every table with a
+// row or size limit, sorted by name.
+func (app *application) watchedTables() []string {
+	seen := map[string]bool{}
+	var tables []string
+
+	for _, limits := range []tableLimits{app.config.tableGrowth.maxRows, app.config.tableGrowth.maxSizeMB} {
+		for table := range limits {
+			if !seen[table] {
+				seen[table] = true
+				tables = append(tables, table)
+			}
+		}
+	}
+
+	sort.Strings(tables)
+	return tables
+}
+
+// checkTableGrowth measures the watched tables, publishes their row counts and sizes as metrics,
+// and logs a warning for each one which is over its -table-growth-max-rows or
+// -table-growth-max-size-mb soft limit. Nothing is done about a table which is over its limit:
+// the limits are there to catch a table which is growing without bound, such as when a retention
+// job has stopped running or been misconfigured, long before it becomes a problem.
+func (app *application) checkTableGrowth() {
+	tables := app.watchedTables()
+	if len(tables) == 0 {
+		return
+	}
+
+	job := startJob("table_growth")
+	defer job.finish()
+
+	stats, err := app.models.System.TableStats(context.Background(), tables)
+	if err != nil {
+		job.fail()
+		app.logger.PrintError(err, nil)
+		return
+	}
+
+	for _, s := range stats {
+		tableRows.WithLabelValues(s.Name).Set(float64(s.Rows))
+		tableSize.WithLabelValues(s.Name).Set(float64(s.Bytes))
+
+		maxRows := app.config.tableGrowth.maxRows[s.Name]
+		maxBytes := app.config.tableGrowth.maxSizeMB[s.Name] << 20
+
+		app.reportTableLimit(s.Name, "rows", s.Rows, maxRows)
+		app.reportTableLimit(s.Name, "size", s.Bytes, maxBytes)
+	}
+}
+
+// reportTableLimit records whether a table's measurement is over its limit, logging an error if
+// it is, and returns whether it is. A limit of 0 is never exceeded.
+func (app *application) reportTableLimit(table, limit string, value, max int64) bool {
+	if max == 0 || value <= max {
+		tableLimitExceeded.WithLabelValues(table, limit).Set(0)
+		return false
+	}
+
+	tableLimitExceeded.WithLabelValues(table, limit).Set(1)
+
+	app.logger.PrintError(errTableOverLimit, map[string]string{
+		"table": table,
+		"limit": limit,
+		"value": strconv.FormatInt(value, 10),
+		"max":   strconv.FormatInt(max, 10),
+	})
+
+	return true
+}
+
+// checkTableGrowthPeriodically calls checkTableGrowth() once every interval, as long as this
+// instance is the leader. It runs until the application exits.
+func (app *application) checkTableGrowthPeriodically(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+
+		if !app.isLeader() {
+			continue
+		}
+
+		app.checkTableGrowth()
+	}
+}
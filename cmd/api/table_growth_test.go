@@ -0,0 +1,35 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/codeaucafe/snippetbox/greenlight/internal/testutil"
+)
+
+// TestTableLimits tests that the table limit flags are parsed, that every table with a limit is
+// watched, and that a table is only reported as over a limit when it has one.
+func TestTableLimits(t *testing.T) {
+	var rows tableLimits
+
+	if err := rows.Set("tokens=100  events=0"); err != nil {
+		t.Fatal(err)
+	}
+	testutil.Equal(t, rows.String(), "events=0 tokens=100")
+
+	for _, val := range []string{"tokens", "=5", "tokens=-1", "tokens=1e6"} {
+		if err := new(tableLimits).Set(val); err == nil {
+			t.Errorf("Set(%q): want an error", val)
+		}
+	}
+
+	app := newTestApp()
+	app.config.tableGrowth.maxRows = rows
+	app.config.tableGrowth.maxSizeMB = tableLimits{"events": 5, "outbox": 1}
+
+	testutil.Equal(t, len(app.watchedTables()), 3)
+	testutil.Equal(t, app.watchedTables()[1], "outbox")
+
+	testutil.Equal(t, app.reportTableLimit("tokens", "rows", 101, rows["tokens"]), true)
+	testutil.Equal(t, app.reportTableLimit("tokens", "rows", 100, rows["tokens"]), false)
+	testutil.Equal(t, app.reportTableLimit("events", "rows", 1_000_000, rows["events"]), false)
+}
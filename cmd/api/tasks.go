@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/codeaucafe/snippetbox/greenlight/internal/data"
+)
+
+// taskStaleAfter is how long a task can be running without a progress update before another
+// worker assumes it has been abandoned and runs it again.
+const taskStaleAfter = 15 * time.Minute
+
+// taskKind describes a kind of long-running task. The run function does the work, calling
+// progress with the percentage complete as it goes, and returns the location of the results.
+type taskKind struct {
+	run func(app *application, task *data.Task, progress func(int)) (string, error)
+}
+
+// taskKinds holds the kinds of task which can be run by the task workers, keyed by the kind
+// stored in the tasks table. Endpoints which start a long-running operation should queue a task
+// of one of these kinds, and respond with taskAcceptedResponse().
+var taskKinds = map[string]taskKind{
+	data.TaskKindReport:        {run: (*application).runReportTask},
+	data.TaskKindDuplicateScan: {run: (*application).runDuplicateScanTask},
+	data.TaskKindBackup:        {run: (*application).runBackupTask},
+}
+
+// taskAcceptedResponse sends a 202 Accepted response for an endpoint which has queued a task.
+// The task is added to the env under the "task" key, alongside anything else the endpoint wants
+// to return, and the Location header points to where the client can poll for its status.
+func (app *application) taskAcceptedResponse(w http.ResponseWriter, r *http.Request, task *data.Task, env envelope) {
+	if env == nil {
+		env = envelope{}
+	}
+	env["task"] = task
+
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/v1/tasks/%d", task.ID))
+
+	err := app.writeJSON(w, http.StatusAccepted, env, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// showTaskHandler handles the "GET /v1/tasks/:id" endpoint and returns the status, progress and
+// any error of one of the current user's tasks, and the location of its results once it has
+// completed.
+func (app *application) showTaskHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	task, err := app.models.Tasks.Get(r.Context(), id, app.contextGetUser(r).ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"task": task}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// runTaskWorker claims and runs queued tasks one at a time, polling for new tasks once every
+// interval when the queue is empty. It runs until the application exits.
+func (app *application) runTaskWorker(pollInterval time.Duration) {
+	for {
+		task, err := app.models.Tasks.ClaimNext(context.Background(), taskStaleAfter)
+		if err != nil {
+			if !errors.Is(err, data.ErrRecordNotFound) {
+				app.logger.PrintError(err, nil)
+			}
+
+			time.Sleep(pollInterval)
+			continue
+		}
+
+		app.runTask(task)
+	}
+}
+
+// runTask runs a single claimed task, recording the result (or the failure) against it.
+func (app *application) runTask(task *data.Task) {
+	properties := map[string]string{
+		"task_id": strconv.FormatInt(task.ID, 10),
+		"kind":    task.Kind,
+	}
+
+	job := startJob("task:" + task.Kind)
+	defer job.finish()
+
+	fail := func(err error) {
+		job.fail()
+		app.logger.PrintError(err, properties)
+
+		err = app.models.Tasks.Fail(context.Background(), task.ID, err.Error())
+		if err != nil {
+			app.logger.PrintError(err, properties)
+		}
+	}
+
+	// Recover any panic in the task, so that it fails the task rather than bringing down the
+	// worker.
+	defer func() {
+		if err := recover(); err != nil {
+			fail(fmt.Errorf("%s", err))
+		}
+	}()
+
+	kind, ok := taskKinds[task.Kind]
+	if !ok {
+		fail(fmt.Errorf("unknown task kind %q", task.Kind))
+		return
+	}
+
+	progress := func(percent int) {
+		err := app.models.Tasks.UpdateProgress(context.Background(), task.ID, percent)
+		if err != nil {
+			app.logger.PrintError(err, properties)
+		}
+	}
+
+	resultURL, err := kind.run(app, task, progress)
+	if err != nil {
+		fail(err)
+		return
+	}
+
+	err = app.models.Tasks.Complete(context.Background(), task.ID, resultURL)
+	if err != nil {
+		fail(err)
+		return
+	}
+
+	app.logger.PrintInfo("task completed", properties)
+}
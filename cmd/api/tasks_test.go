@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/codeaucafe/snippetbox/greenlight/internal/data"
+	"github.com/codeaucafe/snippetbox/greenlight/internal/testutil"
+)
+
+// TestReportTask tests that requesting a report queues a task, and that the task reports its
+// status through the "GET /v1/tasks/:id" endpoint and links to the report once it has run.
+func TestReportTask(t *testing.T) {
+	app, fx := newTestDBApp(t)
+	ts := newTestServer(app.routes())
+	defer ts.Close()
+
+	fx.Movie()
+	token := fx.Token(fx.User(nil, "movies:read"), data.ScopeAuthentication)
+	other := fx.Token(fx.User(nil, "movies:read"), data.ScopeAuthentication)
+
+	code, header, body := ts.request(t, http.MethodPost, "/v1/reports", token.Plaintext, `{"type": "catalog_summary"}`)
+	testutil.Status(t, code, body, http.StatusAccepted)
+
+	var accepted struct {
+		Task data.Task `json:"task"`
+	}
+	testutil.DecodeJSON(t, body, &accepted)
+
+	taskPath := fmt.Sprintf("/v1/tasks/%d", accepted.Task.ID)
+	testutil.Equal(t, header.Get("Location"), taskPath)
+	testutil.Equal(t, accepted.Task.Status, data.TaskStatusQueued)
+
+	// Tasks are private to the user who started them.
+	code, _, body = ts.request(t, http.MethodGet, taskPath, other.Plaintext, "")
+	testutil.Status(t, code, body, http.StatusNotFound)
+
+	task, err := app.models.Tasks.ClaimNext(context.Background(), taskStaleAfter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	app.runTask(task)
+
+	code, _, body = ts.request(t, http.MethodGet, taskPath, token.Plaintext, "")
+	testutil.Status(t, code, body, http.StatusOK)
+
+	var shown struct {
+		Task data.Task `json:"task"`
+	}
+	testutil.DecodeJSON(t, body, &shown)
+
+	testutil.Equal(t, shown.Task.Status, data.TaskStatusCompleted)
+	testutil.Equal(t, shown.Task.Progress, 100)
+
+	code, _, body = ts.request(t, http.MethodGet, shown.Task.ResultURL, token.Plaintext, "")
+	testutil.Status(t, code, body, http.StatusOK)
+}
+
+// TestBackupTask tests that starting a backup queues a task, and that another backup can't be
+// started until it has finished.
+func TestBackupTask(t *testing.T) {
+	app, fx := newTestDBApp(t)
+	ts := newTestServer(app.routes())
+	defer ts.Close()
+
+	token := fx.Token(fx.User(nil, "backups:admin"), data.ScopeAuthentication)
+
+	code, header, body := ts.request(t, http.MethodPost, "/v1/admin/backups", token.Plaintext, "")
+	testutil.Status(t, code, body, http.StatusAccepted)
+
+	var accepted struct {
+		Task data.Task `json:"task"`
+	}
+	testutil.DecodeJSON(t, body, &accepted)
+
+	testutil.Equal(t, header.Get("Location"), fmt.Sprintf("/v1/tasks/%d", accepted.Task.ID))
+	testutil.Equal(t, accepted.Task.Kind, data.TaskKindBackup)
+
+	code, _, body = ts.request(t, http.MethodPost, "/v1/admin/backups", token.Plaintext, "")
+	testutil.Status(t, code, body, http.StatusConflict)
+}
@@ -4,9 +4,22 @@ import (
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/codeaucafe/snippetbox/greenlight/internal/clock"
+	"github.com/codeaucafe/snippetbox/greenlight/internal/data"
+	"github.com/codeaucafe/snippetbox/greenlight/internal/jsonlog"
+	"github.com/codeaucafe/snippetbox/greenlight/internal/mailer"
+	"github.com/codeaucafe/snippetbox/greenlight/internal/storage"
+	"github.com/codeaucafe/snippetbox/greenlight/internal/testutil"
 )
 
+// testTime is the time that the mock clock used by test applications starts at. Tests can move
+// it with app.clock.(*clock.Mock).Advance().
+var testTime = time.Date(2022, time.June, 1, 12, 0, 0, 0, time.UTC)
+
 // Define a custom testServer type which anonymously embeds a httptest.Server instance.
 type testServer struct {
 	*httptest.Server
@@ -16,12 +29,69 @@ type testServer struct {
 // containing mocked dependencies to be used for testing.
 func newTestApp() *application {
 	app := new(application)
-	cfg := config{env: "testing"}
+	cfg := config{env: "testing", movieLimits: data.DefaultMovieLimits}
 	app.config = cfg
+	app.logger = jsonlog.NewLogger(io.Discard, jsonlog.LevelFatal)
+	app.clock = clock.NewMock(testTime)
+	app.settings = newRuntimeSettings(settingsFromConfig(cfg))
 
 	return app
 }
 
+// newTestDBApp returns an instance of the application struct which is fully wired to a fresh
+// test database, along with fixture factories for that database. Tests which use it are skipped
+// unless the GREENLIGHT_TEST_DB_DSN environment variable is set (see testutil.NewDB). Emails are
+// captured by a mailer.Recorder, which tests can get at with app.mailer.(*mailer.Recorder).
+func newTestDBApp(t *testing.T) (*application, *testutil.Fixtures) {
+	db := testutil.NewDB(t)
+
+	cfg := config{env: "testing", movieLimits: data.DefaultMovieLimits}
+	cfg.cursor.secret = "testing"
+	cfg.reviews.autoApprove = true
+	cfg.tokens.accessTTL = 15 * time.Minute
+	cfg.tokens.refreshTTL = 30 * 24 * time.Hour
+	cfg.tokens.passwordResetTTL = 45 * time.Minute
+	cfg.signing.maxSkew = 5 * time.Minute
+	cfg.signing.secret = "testing"
+	cfg.accounts.deletionGracePeriod = 30 * 24 * time.Hour
+	cfg.storage.signedURLExpiry = 15 * time.Minute
+	cfg.posters.maxSizeMB = 1
+	cfg.digest.unsubscribeURL = "http://localhost/v1/digest/unsubscribe"
+	cfg.digest.unsubscribeSecret = "testing"
+	cfg.webhooks.allowPrivate = true
+
+	encoder, err := newEnvelopeEncoder("default")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	app := &application{
+		config:   cfg,
+		logger:   jsonlog.NewLogger(io.Discard, jsonlog.LevelFatal),
+		clock:    clock.NewMock(testTime),
+		models:   data.NewModels(db),
+		mailer:   mailer.NewRecorder(),
+		envelope: encoder,
+		views:    newViewCounter(),
+		streams:  newStreamTracker(),
+	}
+
+	app.webhookClient = newWebhookClient(cfg)
+
+	local, err := storage.NewLocal(t.TempDir(), "/v1/storage", "testing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	local.Clock = app.clock
+	app.storage = local
+
+	app.healthChecks = app.defaultHealthChecks()
+	app.settings = newRuntimeSettings(settingsFromConfig(cfg))
+	app.models.SetClock(app.clock)
+
+	return app, testutil.NewFixtures(t, app.models)
+}
+
 // Create a newTestServer helper which initializes and returns a new instance of our
 // custom testServer type.
 func newTestServer(h http.Handler) *testServer {
@@ -58,3 +128,45 @@ func (ts *testServer) get(t *testing.T, urlPath string) (int, http.Header, []byt
 
 	return rs.StatusCode, rs.Header, body
 }
+
+// request makes a request with the given method, URL path and body (which can be empty) to the
+// test server. If token isn't empty then it is sent as a bearer token in the Authorization
+// header. It returns the response status code, headers, and body.
+func (ts *testServer) request(t *testing.T, method, urlPath, token, body string) (int, http.Header, []byte) {
+	return ts.requestWithHeaders(t, method, urlPath, token, body, nil)
+}
+
+// requestWithHeaders is like request, but also sends the given headers with the request.
+func (ts *testServer) requestWithHeaders(t *testing.T, method, urlPath, token, body string,
+	headers http.Header) (int, http.Header, []byte) {
+	req, err := http.NewRequest(method, ts.URL+urlPath, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for key, values := range headers {
+		req.Header[key] = values
+	}
+
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	rs, err := ts.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() {
+		if err := rs.Body.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	rsBody, err := io.ReadAll(rs.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return rs.StatusCode, rs.Header, rsBody
+}
@@ -3,7 +3,6 @@ package main
 import (
 	"errors"
 	"net/http"
-	"time"
 
 	"github.com/codeaucafe/snippetbox/greenlight/internal/data"
 	"github.com/codeaucafe/snippetbox/greenlight/internal/validator"
@@ -36,7 +35,7 @@ func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter,
 	// Lookup the user record based on the email address. If no matching user was found, then we
 	// call the app.invalidCredentialsResponse() helper to send a 501 Unauthorized response to
 	// the client.
-	user, err := app.models.Users.GetByEmail(input.Email)
+	user, err := app.models.Users.GetByEmail(r.Context(), input.Email)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -61,16 +60,217 @@ func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter,
 		return
 	}
 
-	// Otherwise, if the password is correct, we generate a new token with a 24-hour expiry time
-	// and the scope 'authentication'.
-	token, err := app.models.Tokens.New(user.ID, 24*time.Hour, data.ScopeAuthentication)
+	// Otherwise, if the password is correct, we generate a new authentication token, valid for the
+	// -token-access-ttl duration (24 hours by default), along with a longer-lived refresh token
+	// which the client can exchange for a new pair of tokens at POST /v1/tokens/refresh, rather
+	// than sending the user's credentials again. In jwt mode the authentication token is a JWT
+	// rather than a stored token.
+	access, refresh, err := app.models.Tokens.NewPair(r.Context(), user.ID, app.statefulAccessTTL(), app.config.tokens.refreshTTL)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
-	// Encode the token to JSON and send it in the response along with a 201 Created status code.
-	err = app.writeJSON(w, http.StatusCreated, envelope{"authentication_token": token}, nil)
+	access, err = app.issueAccessToken(r.Context(), access, refresh)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidCredentialsResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// Encode the tokens to JSON and send them in the response along with a 201 Created status
+	// code.
+	err = app.writeJSON(w, http.StatusCreated, envelope{"authentication_token": access, "refresh_token": refresh}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// refreshTokenHandler exchanges a refresh token for a new authentication token and a new refresh
+// token. Each refresh token can only be used once, and if a used refresh token is presented
+// again then all of the user's tokens are revoked (see data.TokenModel.Rotate()). JWT
+// authentication tokens are only revoked by a password reset, so otherwise in jwt mode those
+// stay valid until they expire.
+func (app *application) refreshTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	data.ValidateRefreshTokenPlaintext(v, input.RefreshToken)
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	access, refresh, err := app.models.Tokens.Rotate(r.Context(), input.RefreshToken, app.statefulAccessTTL(), app.config.tokens.refreshTTL)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidRefreshTokenResponse(w, r)
+		case errors.Is(err, data.ErrRefreshTokenReused):
+			app.logger.PrintInfo("refresh token reused, revoked all tokens for the user", requestLogProperties(r, nil))
+			app.invalidRefreshTokenResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	access, err = app.issueAccessToken(r.Context(), access, refresh)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidRefreshTokenResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"authentication_token": access, "refresh_token": refresh}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// createPasswordResetTokenHandler handles the "POST /v1/tokens/password-reset" endpoint and emails
+// a password reset token to the given address, which can then be used with "PUT
+// /v1/users/password" to set a new password. The response is the same whether or not there's a
+// user with the address, so that the endpoint can't be used to find out who has an account.
+func (app *application) createPasswordResetTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Email string `json:"email"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if data.ValidateEmail(v, input.Email); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// The per-address limit is applied whether or not the user exists, for the same reason.
+	if !app.allowEmail(w, r, input.Email) {
+		return
+	}
+
+	message := envelope{"message": "if a user with that email address exists, an email will be sent to them " +
+		"containing password reset instructions"}
+
+	user, err := app.models.Users.GetByEmail(r.Context(), input.Email)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			err = app.writeJSON(w, http.StatusAccepted, message, nil)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+			}
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// The token is stored along with the email in one transaction, and the email is sent by the
+	// outbox workers, in the same way as the welcome email.
+	email := func(token *data.Token) *data.OutboxEmail {
+		return &data.OutboxEmail{
+			Recipient: user.Email,
+			Template:  "token_password_reset.tmpl",
+			Data: map[string]interface{}{
+				"passwordResetToken": token.Plaintext,
+				"ttl":                app.config.tokens.passwordResetTTL.String(),
+			},
+			Secret: []string{"passwordResetToken"},
+		}
+	}
+
+	_, err = app.models.Tokens.NewPasswordReset(r.Context(), user.ID, app.config.tokens.passwordResetTTL, email)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusAccepted, message, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// createActivationTokenHandler handles the "POST /v1/tokens/activation" endpoint and emails a new
+// activation token to the given address, for users who lost their welcome email or let its token
+// expire. The new token replaces any earlier ones. As with password resets, the response is the
+// same whether or not there's a user with the address, or they're already activated, so that the
+// endpoint can't be used to find out who has an account.
+func (app *application) createActivationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Email string `json:"email"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if data.ValidateEmail(v, input.Email); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	if !app.allowEmail(w, r, input.Email) {
+		return
+	}
+
+	message := envelope{"message": "if an inactive user with that email address exists, an email will be sent " +
+		"to them containing activation instructions"}
+
+	user, err := app.models.Users.GetByEmail(r.Context(), input.Email)
+	if err != nil && !errors.Is(err, data.ErrRecordNotFound) {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if err == nil && !user.Activated {
+		email := func(token *data.Token) *data.OutboxEmail {
+			return &data.OutboxEmail{
+				Recipient: user.Email,
+				Template:  "token_activation.tmpl",
+				Data: map[string]interface{}{
+					"activationToken": token.Plaintext,
+				},
+				Secret: []string{"activationToken"},
+			}
+		}
+
+		_, err = app.models.Tokens.NewActivation(r.Context(), user.ID, activationTokenTTL, email)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	err = app.writeJSON(w, http.StatusAccepted, message, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
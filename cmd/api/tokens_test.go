@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/codeaucafe/snippetbox/greenlight/internal/testutil"
+)
+
+// tokenPair is the response body from the token endpoints.
+type tokenPair struct {
+	AuthenticationToken struct {
+		Token string `json:"token"`
+	} `json:"authentication_token"`
+	RefreshToken struct {
+		Token string `json:"token"`
+	} `json:"refresh_token"`
+}
+
+// TestRefreshToken tests that a refresh token can be exchanged for new tokens exactly once, and
+// that presenting it again revokes every token for the user.
+func TestRefreshToken(t *testing.T) {
+	app, fx := newTestDBApp(t)
+	ts := newTestServer(app.routes())
+	defer ts.Close()
+
+	user := fx.User(nil, "movies:read")
+
+	code, _, body := ts.request(t, http.MethodPost, "/v1/tokens/authentication", "",
+		fmt.Sprintf(`{"email": %q, "password": %q}`, user.Email, testutil.Password))
+	testutil.Status(t, code, body, http.StatusCreated)
+
+	var login tokenPair
+	testutil.DecodeJSON(t, body, &login)
+
+	refresh := func(token string) (int, []byte, tokenPair) {
+		code, _, body := ts.request(t, http.MethodPost, "/v1/tokens/refresh", "", fmt.Sprintf(`{"refresh_token": %q}`, token))
+
+		var pair tokenPair
+		if code == http.StatusCreated {
+			testutil.DecodeJSON(t, body, &pair)
+		}
+
+		return code, body, pair
+	}
+
+	code, body, rotated := refresh(login.RefreshToken.Token)
+	testutil.Status(t, code, body, http.StatusCreated)
+
+	// The new authentication token works.
+	code, _, body = ts.request(t, http.MethodGet, "/v1/movies", rotated.AuthenticationToken.Token, "")
+	testutil.Status(t, code, body, http.StatusOK)
+
+	// Refresh tokens can't be used as authentication tokens.
+	code, _, body = ts.request(t, http.MethodGet, "/v1/movies", rotated.RefreshToken.Token, "")
+	testutil.Status(t, code, body, http.StatusUnauthorized)
+
+	// Reusing the original refresh token fails, and revokes the tokens from the rotation too.
+	code, body, _ = refresh(login.RefreshToken.Token)
+	testutil.Status(t, code, body, http.StatusUnauthorized)
+
+	code, _, body = ts.request(t, http.MethodGet, "/v1/movies", rotated.AuthenticationToken.Token, "")
+	testutil.Status(t, code, body, http.StatusUnauthorized)
+
+	code, body, _ = refresh(rotated.RefreshToken.Token)
+	testutil.Status(t, code, body, http.StatusUnauthorized)
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/XSAM/otelsql"
+	"github.com/codeaucafe/snippetbox/greenlight/internal/data"
+	"github.com/felixge/httpsnoop"
+	"go.opentelemetry.io/contrib/propagators/b3"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.12.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName is the name of the tracer used for the spans that Greenlight creates itself. The
+// SQL query spans are created by otelsql with its own tracer.
+const tracerName = "github.com/codeaucafe/snippetbox/greenlight"
+
+// tracer returns the tracer for Greenlight's own spans. It's looked up from the global tracer
+// provider each time, so that it's a no-op until setupTracing() has installed a real provider.
+func tracer() trace.Tracer {
+	return otel.Tracer(tracerName)
+}
+
+// incomingPropagator reads the trace context from the headers of incoming requests: the W3C
+// traceparent and tracestate headers, the W3C baggage header, and the B3 headers (in either the
+// single or multiple header format) sent by older Zipkin-instrumented services. If a request has
+// both W3C and B3 headers then the W3C ones win, since they're extracted last.
+var incomingPropagator = propagation.NewCompositeTextMapPropagator(b3.New(), propagation.TraceContext{},
+	propagation.Baggage{})
+
+// setupTracing installs a global tracer provider which exports spans with OTLP over HTTP to the
+// -tracing-endpoint collector (such as Jaeger or Tempo), sampling -tracing-sample-ratio of the
+// traces. If the endpoint is empty then tracing is disabled, and the global no-op provider is
+// left in place. The returned function flushes any spans which haven't been exported yet, and
+// should be called before the application exits.
+//
+// The global propagator, which writes the trace context into outgoing calls and the SQL query
+// comments (see openTracedDB), is installed whether or not tracing is enabled, so that the trace
+// of a request from another service is passed on even if we don't export any spans of our own.
+// It only writes the W3C headers: B3 is accepted from incoming requests, but not passed on.
+func setupTracing(cfg config) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{},
+		propagation.Baggage{}))
+
+	if cfg.tracing.endpoint == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	// The endpoint has already been checked by validateConfig().
+	endpoint, err := url.Parse(cfg.tracing.endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	options := []otlptracehttp.Option{otlptracehttp.WithEndpoint(endpoint.Host)}
+	if endpoint.Path != "" && endpoint.Path != "/" {
+		options = append(options, otlptracehttp.WithURLPath(endpoint.Path))
+	}
+	if endpoint.Scheme == "http" {
+		options = append(options, otlptracehttp.WithInsecure())
+	}
+
+	exporter, err := otlptracehttp.New(context.Background(), options...)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(
+		semconv.SchemaURL,
+		semconv.ServiceNameKey.String("greenlight"),
+		semconv.ServiceVersionKey.String(version),
+		semconv.DeploymentEnvironmentKey.String(cfg.env),
+	))
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.tracing.sampleRatio))),
+	)
+
+	otel.SetTracerProvider(provider)
+
+	return provider.Shutdown, nil
+}
+
+// openTracedDB opens a database connection pool whose queries are traced. Each query gets a span,
+// which is a child of the span in the context the query is run with, so the queries made with a
+// request's context show up inside the request's trace. The spans for fetching rows and resetting
+// connections are left out, as they would swamp the query spans.
+//
+// The trace context is also appended to each of those queries as an SQL comment, in the
+// sqlcommenter format (such as /*traceparent='00-...-01'*/), so that a query seen in
+// pg_stat_activity or the slow query log can be traced back to the request which made it. Queries
+// run with context.Background() don't have a trace context, so they're left as they are.
+func openTracedDB(dsn string) (*sql.DB, error) {
+	return otelsql.Open("postgres", dsn,
+		otelsql.WithAttributes(semconv.DBSystemPostgreSQL),
+		otelsql.WithSQLCommenter(true),
+		otelsql.WithSpanOptions(otelsql.SpanOptions{
+			OmitConnResetSession: true,
+			OmitConnPrepare:      true,
+			OmitRows:             true,
+		}),
+	)
+}
+
+// trace is middleware which starts a server span for each request, and adds it to the request
+// context so that the spans started while handling the request (such as the SQL query spans)
+// are part of the request's trace. The span is named after the matched route pattern, like the
+// Prometheus metrics (see instrument), and requests which fail with a 5xx status are marked as
+// errors.
+//
+// If the request carries a trace context from the service which called us (see
+// incomingPropagator), the span joins that trace, and the caller's sampling decision is
+// followed. Even when tracing is disabled, the caller's trace ID is kept in the request context,
+// so that it's logged and passed on to the database.
+func (app *application) trace(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r, route := app.contextSetRouteInfo(r)
+
+		ctx := incomingPropagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+
+		ctx, span := tracer().Start(ctx, "HTTP "+r.Method,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				semconv.HTTPMethodKey.String(r.Method),
+				semconv.HTTPTargetKey.String(r.URL.Path),
+				attribute.String("http.request_id", data.RequestIDFromContext(r.Context())),
+			),
+		)
+		defer span.End()
+
+		metrics := httpsnoop.CaptureMetrics(next, w, r.WithContext(ctx))
+
+		if route.pattern != "" {
+			span.SetName(route.pattern)
+			span.SetAttributes(semconv.HTTPRouteKey.String(route.pattern))
+		}
+
+		span.SetAttributes(semconv.HTTPStatusCodeKey.Int(metrics.Code))
+		if metrics.Code >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, strconv.Itoa(metrics.Code))
+		}
+	})
+}
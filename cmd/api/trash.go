@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/codeaucafe/snippetbox/greenlight/internal/data"
+	"github.com/codeaucafe/snippetbox/greenlight/internal/validator"
+)
+
+// listTrashHandler handles the "GET /v1/movies/trash" endpoint and returns a page of the deleted
+// movies which can still be restored, most recently deleted first, along with when each one was
+// deleted and when it will be purged.
+func (app *application) listTrashHandler(w http.ResponseWriter, r *http.Request) {
+	v := validator.New()
+	qs := r.URL.Query()
+
+	filters := data.Filters{
+		Page:         app.readInt(qs, "page", 1, v),
+		PageSize:     app.readInt(qs, "page_size", 20, v),
+		Sort:         "id",
+		SortSafeList: []string{"id"},
+	}
+
+	if data.ValidateFilters(v, filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	movies, metadata, err := app.models.Movies.GetAllDeleted(r.Context(), filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	type trashedMovie struct {
+		*data.Movie
+		PurgeAt time.Time `json:"purge_at"`
+	}
+
+	trash := make([]trashedMovie, len(movies))
+	for i, movie := range movies {
+		trash[i] = trashedMovie{Movie: movie, PurgeAt: movie.DeletedAt.Add(app.config.trash.retention)}
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"movies": trash, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// restoreMovieHandler handles the "POST /v1/movies/:id/restore" endpoint and takes a movie out of
+// the trash, as it was when it was deleted. It responds with 404 Not Found if the movie isn't in
+// the trash, which includes movies which have already been purged.
+func (app *application) restoreMovieHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readMovieIDParam(r)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	movie, err := app.models.Movies.Restore(r.Context(), id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	headers := make(http.Header)
+	headers.Set("ETag", movieETag(movie))
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"movie": movie}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// purgeDeletedMovies removes the movies which have been in the trash for longer than the
+// retention period set by the -movie-trash-retention flag.
+func (app *application) purgeDeletedMovies() {
+	job := startJob("purge_deleted_movies")
+	defer job.finish()
+
+	purged, err := app.models.Movies.PurgeDeleted(context.Background(), app.clock.Now().Add(-app.config.trash.retention))
+	if err != nil {
+		job.fail()
+		app.logger.PrintError(err, nil)
+		return
+	}
+
+	if purged > 0 {
+		app.logger.PrintInfo("purged deleted movies", map[string]string{
+			"count": strconv.FormatInt(purged, 10),
+		})
+	}
+}
+
+// purgeDeletedMoviesPeriodically calls purgeDeletedMovies() once every interval, as long as this
+// instance is the leader. It runs until the application exits.
+func (app *application) purgeDeletedMoviesPeriodically(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+
+		if !app.isLeader() {
+			continue
+		}
+
+		app.purgeDeletedMovies()
+	}
+}
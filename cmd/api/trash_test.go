@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/codeaucafe/snippetbox/greenlight/internal/clock"
+	"github.com/codeaucafe/snippetbox/greenlight/internal/data"
+	"github.com/codeaucafe/snippetbox/greenlight/internal/testutil"
+)
+
+// TestMovieTrash tests that deleting a movie moves it to the trash, where it's hidden from the
+// movie endpoints but can be restored, and that it's purged once the retention period has passed.
+func TestMovieTrash(t *testing.T) {
+	app, fx := newTestDBApp(t)
+	app.config.trash.retention = 30 * 24 * time.Hour
+	ts := newTestServer(app.routes())
+	defer ts.Close()
+
+	writer := fx.Token(fx.User(nil, "movies:read", "movies:write"), data.ScopeAuthentication)
+	movie := fx.Movie()
+
+	moviePath := fmt.Sprintf("/v1/movies/%d", movie.ID)
+	restorePath := moviePath + "/restore"
+
+	code, _, body := ts.request(t, http.MethodDelete, moviePath, writer.Plaintext, "")
+	testutil.Status(t, code, body, http.StatusOK)
+
+	code, _, body = ts.request(t, http.MethodGet, moviePath, writer.Plaintext, "")
+	testutil.Status(t, code, body, http.StatusNotFound)
+
+	code, _, body = ts.request(t, http.MethodDelete, moviePath, writer.Plaintext, "")
+	testutil.Status(t, code, body, http.StatusNotFound)
+
+	var trash struct {
+		Movies []struct {
+			ID        int64      `json:"id"`
+			DeletedAt *time.Time `json:"deleted_at"`
+		} `json:"movies"`
+	}
+
+	code, _, body = ts.request(t, http.MethodGet, "/v1/movies/trash", writer.Plaintext, "")
+	testutil.Status(t, code, body, http.StatusOK)
+	testutil.DecodeJSON(t, body, &trash)
+	testutil.Equal(t, len(trash.Movies), 1)
+	testutil.Equal(t, trash.Movies[0].ID, movie.ID)
+
+	code, _, body = ts.request(t, http.MethodPost, restorePath, writer.Plaintext, "")
+	testutil.Status(t, code, body, http.StatusOK)
+
+	code, _, body = ts.request(t, http.MethodGet, moviePath, writer.Plaintext, "")
+	testutil.Status(t, code, body, http.StatusOK)
+
+	code, _, body = ts.request(t, http.MethodPost, restorePath, writer.Plaintext, "")
+	testutil.Status(t, code, body, http.StatusNotFound)
+
+	// Once the retention period has passed, the movie is purged and can't be restored.
+	code, _, body = ts.request(t, http.MethodDelete, moviePath, writer.Plaintext, "")
+	testutil.Status(t, code, body, http.StatusOK)
+
+	app.clock.(*clock.Mock).Set(time.Now().Add(31 * 24 * time.Hour))
+	app.purgeDeletedMovies()
+
+	code, _, body = ts.request(t, http.MethodPost, restorePath, writer.Plaintext, "")
+	testutil.Status(t, code, body, http.StatusNotFound)
+
+	code, _, body = ts.request(t, http.MethodGet, "/v1/movies/trash", writer.Plaintext, "")
+	testutil.Status(t, code, body, http.StatusOK)
+	testutil.DecodeJSON(t, body, &trash)
+	testutil.Equal(t, len(trash.Movies), 0)
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/felixge/httpsnoop"
+
+	"github.com/codeaucafe/snippetbox/greenlight/internal/data"
+	"github.com/codeaucafe/snippetbox/greenlight/internal/validator"
+)
+
+// usageKey identifies a single row in the usage_stats table.
+type usageKey struct {
+	day      time.Time
+	userID   int64
+	endpoint string
+}
+
+// usageMeter aggregates the usage of each user and endpoint in memory, so that we only write to
+// the database once per flush interval rather than once per request.
+type usageMeter struct {
+	mu      sync.Mutex
+	records map[usageKey]*data.UsageRecord
+}
+
+// newUsageMeter returns a new, empty usageMeter.
+func newUsageMeter() *usageMeter {
+	return &usageMeter{records: make(map[usageKey]*data.UsageRecord)}
+}
+
+// add adds the given record to the in-memory totals.
+func (m *usageMeter) add(record data.UsageRecord) {
+	key := usageKey{day: record.Day, userID: record.UserID, endpoint: record.Endpoint}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	totals, ok := m.records[key]
+	if !ok {
+		totals = &data.UsageRecord{Day: record.Day, UserID: record.UserID, Endpoint: record.Endpoint}
+		m.records[key] = totals
+	}
+
+	totals.Requests += record.Requests
+	totals.Errors += record.Errors
+	totals.BytesIn += record.BytesIn
+	totals.BytesOut += record.BytesOut
+}
+
+// drain removes and returns all of the in-memory totals.
+func (m *usageMeter) drain() []*data.UsageRecord {
+	m.mu.Lock()
+	records := m.records
+	m.records = make(map[usageKey]*data.UsageRecord)
+	m.mu.Unlock()
+
+	drained := make([]*data.UsageRecord, 0, len(records))
+	for _, record := range records {
+		drained = append(drained, record)
+	}
+
+	return drained
+}
+
+// meterUsage records the number of requests, the number of server errors and the bandwidth used
+// by each user on each endpoint. It must run after the authenticate middleware so that the user
+// is known.
+func (app *application) meterUsage(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if app.usage == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		r, route := app.contextSetRouteInfo(r)
+
+		// Use httpsnoop to capture the number of bytes written in the response body, in the same
+		// way as our metrics middleware.
+		metrics := httpsnoop.CaptureMetrics(next, w, r)
+
+		endpoint := route.pattern
+		if endpoint == "" {
+			endpoint = "unmatched"
+		}
+
+		var bytesIn int64
+		if r.ContentLength > 0 {
+			bytesIn = r.ContentLength
+		}
+
+		var errors int64
+		if metrics.Code >= http.StatusInternalServerError {
+			errors = 1
+		}
+
+		app.usage.add(data.UsageRecord{
+			Day:      data.QuotaPeriodStart(data.QuotaPeriodDay, app.clock.Now()),
+			UserID:   app.contextGetUser(r).ID,
+			Endpoint: endpoint,
+			Requests: 1,
+			Errors:   errors,
+			BytesIn:  bytesIn,
+			BytesOut: metrics.Written,
+		})
+	})
+}
+
+// flushUsage writes the in-memory usage totals to the database. If the write fails the totals
+// are added back to the meter, so that they are included in the next flush instead.
+func (app *application) flushUsage() {
+	if app.usage == nil {
+		return
+	}
+
+	job := startJob("flush_usage")
+	defer job.finish()
+
+	records := app.usage.drain()
+	if len(records) == 0 {
+		return
+	}
+
+	err := app.models.Usage.Add(context.Background(), records)
+	if err != nil {
+		job.fail()
+		app.logger.PrintError(err, nil)
+
+		for _, record := range records {
+			app.usage.add(*record)
+		}
+	}
+}
+
+// flushUsagePeriodically calls flushUsage() once every interval. It runs until the application
+// exits, and serve() flushes any remaining totals during a graceful shutdown.
+func (app *application) flushUsagePeriodically(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		app.flushUsage()
+	}
+}
+
+// showUsageHandler handles the "GET /v1/admin/usage" endpoint and returns a usage report, so
+// that operators can identify heavy consumers of the API. The report can be filtered with the
+// from, to (both YYYY-MM-DD, defaulting to the last 30 days) and user_id query string
+// parameters, and grouped by any combination of day, user and endpoint.
+func (app *application) showUsageHandler(w http.ResponseWriter, r *http.Request) {
+	v := validator.New()
+	qs := r.URL.Query()
+
+	today := data.QuotaPeriodStart(data.QuotaPeriodDay, app.clock.Now())
+
+	filters := data.UsageFilters{
+		From:    app.readDate(qs, "from", today.AddDate(0, 0, -30), v),
+		To:      app.readDate(qs, "to", today, v),
+		UserID:  int64(app.readInt(qs, "user_id", 0, v)),
+		GroupBy: app.readCSV(qs, "group_by", []string{"user"}),
+		Limit:   app.readInt(qs, "limit", 100, v),
+	}
+
+	if data.ValidateUsageFilters(v, filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// Make sure that any usage recorded by this instance is included in the report.
+	app.flushUsage()
+
+	usage, err := app.models.Usage.GetReport(r.Context(), filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"usage": usage}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
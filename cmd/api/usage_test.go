@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/codeaucafe/snippetbox/greenlight/internal/data"
+	"github.com/codeaucafe/snippetbox/greenlight/internal/testutil"
+)
+
+// TestUsageMeter tests that usageMeter adds up the usage of each user and endpoint, and that
+// drain empties it.
+func TestUsageMeter(t *testing.T) {
+	app := newTestApp()
+	app.usage = newUsageMeter()
+
+	handler := app.meterUsage(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		setRoutePattern(r, r.Method, r.URL.Path)
+		if r.URL.Path == "/fail" {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		_, _ = w.Write([]byte("hello"))
+	}))
+
+	for _, path := range []string{"/ok", "/ok", "/fail"} {
+		rr := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, path, strings.NewReader("abc"))
+		handler.ServeHTTP(rr, app.contextSetUser(r, &data.User{ID: 1}))
+	}
+
+	records := app.usage.drain()
+	testutil.Equal(t, len(records), 2)
+
+	got := map[string]data.UsageRecord{}
+	for _, record := range records {
+		got[record.Endpoint] = *record
+	}
+
+	testutil.Equal(t, got["POST /ok"], data.UsageRecord{Day: time.Date(2022, 6, 1, 0, 0, 0, 0, time.UTC), UserID: 1,
+		Endpoint: "POST /ok", Requests: 2, BytesIn: 6, BytesOut: 10})
+	testutil.Equal(t, got["POST /fail"].Errors, int64(1))
+
+	testutil.Equal(t, len(app.usage.drain()), 0)
+}
+
+// TestUsageReport tests that the usage recorded by the meter shows up in the
+// "GET /v1/admin/usage" report.
+func TestUsageReport(t *testing.T) {
+	app, fx := newTestDBApp(t)
+	app.usage = newUsageMeter()
+
+	ts := newTestServer(app.routes())
+	defer ts.Close()
+
+	user := fx.User(nil, "movies:read")
+	token := fx.Token(user, data.ScopeAuthentication)
+	admin := fx.Token(fx.User(nil, "usage:admin"), data.ScopeAuthentication)
+
+	for i := 0; i < 2; i++ {
+		code, _, body := ts.request(t, http.MethodGet, "/v1/movies", token.Plaintext, "")
+		testutil.Status(t, code, body, http.StatusOK)
+	}
+
+	code, _, body := ts.request(t, http.MethodGet,
+		fmt.Sprintf("/v1/admin/usage?group_by=user,endpoint&user_id=%d", user.ID), admin.Plaintext, "")
+	testutil.Status(t, code, body, http.StatusOK)
+
+	var got struct {
+		Usage []data.UsageReportRow `json:"usage"`
+	}
+	testutil.DecodeJSON(t, body, &got)
+
+	testutil.Equal(t, len(got.Usage), 1)
+	testutil.Equal(t, got.Usage[0].UserID, user.ID)
+	testutil.Equal(t, got.Usage[0].Endpoint, "GET /v1/movies")
+	testutil.Equal(t, got.Usage[0].Requests, int64(2))
+	testutil.Equal(t, got.Usage[0].BytesOut > 0, true)
+
+	code, _, body = ts.request(t, http.MethodGet, "/v1/admin/usage?group_by=nonsense", admin.Plaintext, "")
+	testutil.Status(t, code, body, http.StatusUnprocessableEntity)
+}
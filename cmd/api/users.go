@@ -1,14 +1,21 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/codeaucafe/snippetbox/greenlight/internal/data"
 	"github.com/codeaucafe/snippetbox/greenlight/internal/validator"
 )
 
+// activationTokenTTL is the lifetime of the activation tokens sent in the welcome email and by
+// "POST /v1/tokens/activation". The email templates tell the user that it's 3 days.
+const activationTokenTTL = 3 * 24 * time.Hour
+
 func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Request) {
 	// Create an anonymous struct to hold the expected data from the request body.
 	var input struct {
@@ -51,8 +58,28 @@ func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
-	// Insert the user data into the database.
-	err = app.models.Users.Insert(user)
+	// Registering sends an email to the address, so it's subject to the per-address limit.
+	if !app.allowEmail(w, r, user.Email) {
+		return
+	}
+
+	// Insert the user data into the database, along with the "movies:read" permission, an
+	// activation token, and the welcome email. These are all written in one transaction, and the
+	// email is added to the outbox rather than sent straight away, so that it is retried by the
+	// outbox workers until it is delivered.
+	welcome := func(token *data.Token) *data.OutboxEmail {
+		return &data.OutboxEmail{
+			Recipient: user.Email,
+			Template:  "user_welcome.tmpl",
+			Data: map[string]interface{}{
+				"activationToken": token.Plaintext,
+				"userID":          user.ID,
+			},
+			Secret: []string{"activationToken"},
+		}
+	}
+
+	_, err = app.models.Users.Register(r.Context(), user, []string{"movies:read"}, activationTokenTTL, welcome)
 	if err != nil {
 		switch {
 		// If we get an ErrDuplicateEmail error, use the v.AddError() method to manually add
@@ -67,42 +94,6 @@ func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
-	// Add the "movies:read" permission for the new user.
-	err = app.models.Permissions.AddForUser(user.ID, "movies:read")
-	if err != nil {
-		app.serverErrorResponse(w, r, err)
-		return
-	}
-
-	// After the user record has been created in the database, generate a new activation
-	// token for the user.
-	token, err := app.models.Tokens.New(user.ID, 3*24*time.Hour, data.ScopeActivation)
-	if err != nil {
-		app.serverErrorResponse(w, r, err)
-		return
-	}
-
-	// Launch a goroutine which runs an anonymous function that sends the welcome email using
-	// the background helper function.
-	app.background(func() {
-		// Create map to act as a 'holding structure' for the data we send to the weclome email
-		// template.
-		data := map[string]interface{}{
-			"activationToken": token.Plaintext,
-			"userID":          user.ID,
-		}
-
-		// Call the Send() method on our Mailer, passing in the user's email address, name of the
-		// template file, and the data map containing the activationToken and the user's ID.
-		err = app.mailer.Send(user.Email, "user_welcome.tmpl", data)
-		if err != nil {
-			// Importantly, if there is an error sending the email then we log the error
-			// instead of raising a server error like before when we handled
-			// the email send functionality without a goroutine
-			app.logger.PrintError(err, nil)
-		}
-	})
-
 	// Note that we also change this to send the client a 202 Accepted status code which
 	// indicates that the request has been accepted for processing, but the processing has
 	// not been completed.
@@ -137,7 +128,7 @@ func (app *application) activateUserHandler(w http.ResponseWriter, r *http.Reque
 	// Retrieve the details of the user associated with the token using the GetForToken() method.
 	// If no matching record is found, then we let the client know that the token they provided
 	// is not valid.
-	user, err := app.models.Users.GetForToken(data.ScopeActivation, input.TokenPlaintext)
+	user, err := app.models.Users.GetForToken(r.Context(), data.ScopeActivation, input.TokenPlaintext)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -154,7 +145,7 @@ func (app *application) activateUserHandler(w http.ResponseWriter, r *http.Reque
 
 	// Save the updated user record in our database, checking for any edit conflicts in the same
 	// way that we did for our move records.
-	err = app.models.Users.Update(user)
+	err = app.models.Users.Update(r.Context(), user)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrEditConflict):
@@ -166,14 +157,491 @@ func (app *application) activateUserHandler(w http.ResponseWriter, r *http.Reque
 	}
 
 	// If everything went successfully above, then delete all activation tokens for the user.
-	err = app.models.Tokens.DeleteAllForUser(data.ScopeActivation, user.ID)
+	err = app.models.Tokens.DeleteAllForUser(r.Context(), data.ScopeActivation, user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"user": user}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// listUsersHandler handles the "GET /v1/users" endpoint and returns a page of the users,
+// filtered by the email, activated and permission query string parameters.
+func (app *application) listUsersHandler(w http.ResponseWriter, r *http.Request) {
+	v := validator.New()
+	qs := r.URL.Query()
+
+	userFilters := data.UserFilters{
+		Email:      app.readStrings(qs, "email", ""),
+		Activated:  app.readBool(qs, "activated", v),
+		Permission: app.readStrings(qs, "permission", ""),
+	}
+
+	filters := data.Filters{
+		Page:     app.readInt(qs, "page", 1, v),
+		PageSize: app.readInt(qs, "page_size", 20, v),
+		Sort:     app.readStrings(qs, "sort", "id"),
+		SortSafeList: []string{
+			"id", "created_at", "name", "email",
+			"-id", "-created_at", "-name", "-email",
+		},
+	}
+
+	if data.ValidateFilters(v, filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	users, metadata, err := app.models.Users.GetAll(r.Context(), userFilters, filters)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
+	err = app.writeJSON(w, http.StatusOK, envelope{"users": users, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// showUserHandler handles the "GET /v1/users/:id" endpoint and returns a user along with
+// the permissions they have been granted.
+func (app *application) showUserHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.getUser(w, r)
+	if !ok {
+		return
+	}
+
+	permissions, err := app.models.Permissions.GetAllForUser(r.Context(), user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"user": user, "permissions": permissions}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// updateUserHandler handles the "PATCH /v1/users/:id" endpoint and activates or
+// deactivates a user. Deactivating a user logs them out (see data.UserModel.SetActivated()).
+// Admins can't deactivate themselves, so that they can't lock themselves out by mistake.
+func (app *application) updateUserHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.getUser(w, r)
+	if !ok {
+		return
+	}
+
+	var input struct {
+		Activated *bool `json:"activated"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	v.Check(input.Activated != nil, "activated", "must be provided")
+	v.Check(input.Activated == nil || *input.Activated || user.ID != app.contextGetUser(r).ID, "activated",
+		"you can't deactivate your own account")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Users.SetActivated(r.Context(), user, *input.Activated)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
 	err = app.writeJSON(w, http.StatusOK, envelope{"user": user}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
 }
+
+// deleteUserHandler handles the "DELETE /v1/users/:id" endpoint and deletes a user. As
+// with deactivation, admins can't delete their own account through this endpoint.
+func (app *application) deleteUserHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	if id == app.contextGetUser(r).ID {
+		v := validator.New()
+		v.AddError("id", "you can't delete your own account")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Users.Delete(r.Context(), id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "user successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// getUser reads the ID parameter from the request and fetches the matching user. If the user
+// can't be found, or anything else goes wrong, it sends the error response and returns false.
+func (app *application) getUser(w http.ResponseWriter, r *http.Request) (*data.User, bool) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return nil, false
+	}
+
+	user, err := app.models.Users.Get(r.Context(), id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil, false
+	}
+
+	return user, true
+}
+
+// updateUserPasswordHandler handles the "PUT /v1/users/password" endpoint and sets a new password
+// for the user who was emailed the password reset token. The token can only be used once, and
+// all of the user's authentication and refresh tokens are revoked, so they have to log in again
+// with the new password (see data.UserModel.ResetPassword()).
+func (app *application) updateUserPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Password       string `json:"password"`
+		TokenPlaintext string `json:"token"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	data.ValidatePasswordPlaintext(v, input.Password)
+	data.ValidateTokenPlaintext(v, input.TokenPlaintext)
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	_, err = app.models.Users.ResetPassword(r.Context(), input.TokenPlaintext, input.Password)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("token", "invalid or expired password reset token")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "your password was successfully reset"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// emailChangeTokenTTL is the lifetime of the tokens sent to confirm a new email address.
+const emailChangeTokenTTL = 24 * time.Hour
+
+// updateUserEmailHandler handles the "PATCH /v1/users/me/email" endpoint and starts changing the
+// current user's email address. The user has to give their password, so that a stolen
+// authentication token can't be used to take over the account. The new address is held as the
+// user's pending address, and a confirmation token is emailed to it: the change is only made
+// once the token is sent to "PUT /v1/users/email-confirm", which proves that the address is
+// theirs. Until then they keep using their current address.
+func (app *application) updateUserEmailHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Email    string `json:"email"`
+		Password string `json:"password"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	v := validator.New()
+
+	data.ValidateEmail(v, input.Email)
+	data.ValidatePasswordPlaintext(v, input.Password)
+	v.Check(!strings.EqualFold(input.Email, user.Email), "email", "must be different from your current email address")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	match, err := user.Password.Matches(input.Password)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if !match {
+		v.AddError("password", "is incorrect")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	if !app.allowEmail(w, r, input.Email) {
+		return
+	}
+
+	confirm := func(token *data.Token) *data.OutboxEmail {
+		return &data.OutboxEmail{
+			Recipient: input.Email,
+			Template:  "token_email_change.tmpl",
+			Data: map[string]interface{}{
+				"emailChangeToken": token.Plaintext,
+			},
+			Secret: []string{"emailChangeToken"},
+		}
+	}
+
+	_, err = app.models.Users.StageEmailChange(r.Context(), user.ID, input.Email, emailChangeTokenTTL, confirm)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrDuplicateEmail):
+			v.AddError("email", "a user with this email address already exists")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	message := envelope{"message": "an email will be sent to your new address containing instructions to confirm it"}
+
+	err = app.writeJSON(w, http.StatusAccepted, message, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// confirmUserEmailHandler handles the "PUT /v1/users/email-confirm" endpoint and completes an
+// email address change with the token which was sent to the new address. A notice is emailed to
+// the old address, so that the user finds out if someone else has changed it.
+func (app *application) confirmUserEmailHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		TokenPlaintext string `json:"token"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if data.ValidateTokenPlaintext(v, input.TokenPlaintext); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	notice := func(user *data.User, oldEmail string) *data.OutboxEmail {
+		return &data.OutboxEmail{
+			Recipient: oldEmail,
+			Template:  "user_email_changed.tmpl",
+			Data: map[string]interface{}{
+				"newEmail": user.Email,
+			},
+		}
+	}
+
+	user, err := app.models.Users.ConfirmEmailChange(r.Context(), input.TokenPlaintext, notice)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("token", "invalid or expired email change token")
+			app.failedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, data.ErrDuplicateEmail):
+			v.AddError("email", "a user with this email address already exists")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"user": user}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// deleteCurrentUserHandler handles the "DELETE /v1/users/me" endpoint and deletes the account of
+// the authenticated user, who must confirm it with their password. The account is kept for the
+// grace period set by the -account-deletion-grace-period flag, and the user is emailed a token
+// which can be sent to "PUT /v1/users/restored" to restore it until then. After that it's purged
+// by purgeDeletedUsersPeriodically(), along with everything which belongs to the user.
+func (app *application) deleteCurrentUserHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Password string `json:"password"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	v := validator.New()
+
+	if data.ValidatePasswordPlaintext(v, input.Password); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	match, err := user.Password.Matches(input.Password)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if !match {
+		v.AddError("password", "is incorrect")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	gracePeriod := app.config.accounts.deletionGracePeriod
+
+	notice := func(token *data.Token) *data.OutboxEmail {
+		return &data.OutboxEmail{
+			Recipient: user.Email,
+			Template:  "user_deleted.tmpl",
+			Data: map[string]interface{}{
+				"accountRestoreToken": token.Plaintext,
+				"purgeAt":             token.Expiry.Format(time.RFC1123),
+			},
+			Secret: []string{"accountRestoreToken"},
+		}
+	}
+
+	_, err = app.models.Users.SoftDelete(r.Context(), user.ID, gracePeriod, notice)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	message := envelope{"message": "your account has been deleted; an email will be sent to you containing " +
+		"instructions to restore it within " + gracePeriod.String()}
+
+	err = app.writeJSON(w, http.StatusAccepted, message, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// restoreUserHandler handles the "PUT /v1/users/restored" endpoint and restores a deleted account
+// with the token which was emailed when it was deleted. The user's tokens were revoked when the
+// account was deleted, so they have to log in again afterwards.
+func (app *application) restoreUserHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		TokenPlaintext string `json:"token"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if data.ValidateTokenPlaintext(v, input.TokenPlaintext); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user, err := app.models.Users.Restore(r.Context(), input.TokenPlaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("token", "invalid or expired account restore token")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"user": user}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// purgeDeletedUsers removes the accounts which were deleted longer ago than the grace period.
+func (app *application) purgeDeletedUsers() {
+	job := startJob("purge_deleted_users")
+	defer job.finish()
+
+	purged, err := app.models.Users.PurgeDeleted(context.Background(), app.clock.Now().Add(-app.config.accounts.deletionGracePeriod))
+	if err != nil {
+		job.fail()
+		app.logger.PrintError(err, nil)
+		return
+	}
+
+	if purged > 0 {
+		app.logger.PrintInfo("purged deleted accounts", map[string]string{
+			"count": strconv.FormatInt(purged, 10),
+		})
+	}
+}
+
+// purgeDeletedUsersPeriodically calls purgeDeletedUsers() once every interval, as long as this
+// instance is the leader. It runs until the application exits.
+func (app *application) purgeDeletedUsersPeriodically(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+
+		if !app.isLeader() {
+			continue
+		}
+
+		app.purgeDeletedUsers()
+	}
+}
@@ -0,0 +1,402 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/codeaucafe/snippetbox/greenlight/internal/clock"
+	"github.com/codeaucafe/snippetbox/greenlight/internal/data"
+	"github.com/codeaucafe/snippetbox/greenlight/internal/mailer"
+	"github.com/codeaucafe/snippetbox/greenlight/internal/testutil"
+)
+
+// TestRegisterAndActivateUser tests the registration flow end-to-end: registering sends a welcome
+// email containing an activation token, and the token can then be used to activate the account.
+func TestRegisterAndActivateUser(t *testing.T) {
+	app, _ := newTestDBApp(t)
+	ts := newTestServer(app.routes())
+	defer ts.Close()
+
+	code, _, body := ts.request(t, http.MethodPost, "/v1/users", "",
+		`{"name": "Alice Smith", "email": "alice@example.com", "password": "pa55word1234"}`)
+	testutil.Status(t, code, body, http.StatusAccepted)
+
+	// The welcome email is queued in the outbox, so deliver it before checking.
+	testutil.Equal(t, app.processOutbox(), 1)
+
+	emails := app.mailer.(*mailer.Recorder).SentTo("alice@example.com")
+	testutil.Equal(t, len(emails), 1)
+	testutil.Equal(t, emails[0].Template, "user_welcome.tmpl")
+
+	token, ok := emails[0].Data.(map[string]interface{})["activationToken"].(string)
+	if !ok {
+		t.Fatalf("welcome email data has no activation token: %#v", emails[0].Data)
+	}
+	testutil.StringContains(t, emails[0].PlainBody, token)
+
+	code, _, body = ts.request(t, http.MethodPut, "/v1/users/activated", "", fmt.Sprintf(`{"token": %q}`, token))
+	testutil.Status(t, code, body, http.StatusOK)
+	testutil.StringContains(t, string(body), `"activated": true`)
+
+	// Registering again with the same email address fails, and doesn't queue another email.
+	code, _, body = ts.request(t, http.MethodPost, "/v1/users", "",
+		`{"name": "Alice Smith", "email": "alice@example.com", "password": "pa55word1234"}`)
+	testutil.Status(t, code, body, http.StatusUnprocessableEntity)
+	testutil.Equal(t, app.processOutbox(), 0)
+
+	// The activation token can only be used once.
+	code, _, body = ts.request(t, http.MethodPut, "/v1/users/activated", "", fmt.Sprintf(`{"token": %q}`, token))
+	testutil.Status(t, code, body, http.StatusUnprocessableEntity)
+}
+
+// TestRegisterEmailRateLimit tests that the emails sent to an address are rate limited
+// independently of the client's IP address, and that the limits are purged once they're full.
+func TestRegisterEmailRateLimit(t *testing.T) {
+	app, _ := newTestDBApp(t)
+	app.config.limiter.authRPS = 100
+	app.config.limiter.authBurst = 100
+	app.config.limiter.emailInterval = time.Hour
+	app.config.limiter.emailBurst = 1
+
+	settings := app.settings.get()
+	settings.LimiterEnabled = true
+	settings.LimiterRPS = 100
+	settings.LimiterBurst = 100
+	app.settings.set(settings)
+
+	ts := newTestServer(app.routes())
+	defer ts.Close()
+
+	register := func(password string) (int, http.Header, []byte) {
+		return ts.request(t, http.MethodPost, "/v1/users", "",
+			fmt.Sprintf(`{"name": "Alice Smith", "email": "alice@example.com", "password": %q}`, password))
+	}
+
+	code, _, body := register("pa55word1234")
+	testutil.Status(t, code, body, http.StatusAccepted)
+
+	code, header, body := register("pa55word5678")
+	testutil.Status(t, code, body, http.StatusTooManyRequests)
+	testutil.Equal(t, header.Get("Retry-After"), "3600")
+
+	// Once the interval has passed, the address gets another token.
+	app.clock.(*clock.Mock).Advance(time.Hour)
+
+	code, _, body = register("pa55word5678")
+	testutil.Status(t, code, body, http.StatusUnprocessableEntity)
+
+	// The address's bucket is only purged once it has filled up again.
+	count := func() int {
+		t.Helper()
+
+		var n int
+		err := app.models.EmailLimits.DB.QueryRow("SELECT COUNT(*) FROM email_rate_limits").Scan(&n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+
+	app.purgeEmailLimits()
+	testutil.Equal(t, count(), 1)
+
+	app.clock.(*clock.Mock).Advance(time.Hour + time.Second)
+	app.purgeEmailLimits()
+	testutil.Equal(t, count(), 0)
+}
+
+// TestAdminUsers tests the user management endpoints: listing users with filters, and that
+// deactivating a user logs them out.
+func TestAdminUsers(t *testing.T) {
+	app, fx := newTestDBApp(t)
+	ts := newTestServer(app.routes())
+	defer ts.Close()
+
+	admin := fx.User(nil, "users:admin")
+	adminToken := fx.Token(admin, data.ScopeAuthentication)
+
+	user := fx.User(func(u *data.User) { u.Email = "deactivate.me@example.com" }, "movies:read")
+	userToken := fx.Token(user, data.ScopeAuthentication)
+
+	code, _, body := ts.request(t, http.MethodGet, "/v1/users?email=DEACTIVATE&activated=true",
+		adminToken.Plaintext, "")
+	testutil.Status(t, code, body, http.StatusOK)
+
+	var list struct {
+		Users []*data.User `json:"users"`
+	}
+	testutil.DecodeJSON(t, body, &list)
+
+	testutil.Equal(t, len(list.Users), 1)
+	testutil.Equal(t, list.Users[0].ID, user.ID)
+
+	userPath := fmt.Sprintf("/v1/users/%d", user.ID)
+
+	code, _, body = ts.request(t, http.MethodPatch, userPath, adminToken.Plaintext, `{"activated": false}`)
+	testutil.Status(t, code, body, http.StatusOK)
+
+	code, _, body = ts.request(t, http.MethodGet, "/v1/movies", userToken.Plaintext, "")
+	testutil.Status(t, code, body, http.StatusUnauthorized)
+
+	// Admins can't lock themselves out.
+	code, _, body = ts.request(t, http.MethodPatch, fmt.Sprintf("/v1/users/%d", admin.ID),
+		adminToken.Plaintext, `{"activated": false}`)
+	testutil.Status(t, code, body, http.StatusUnprocessableEntity)
+
+	code, _, body = ts.request(t, http.MethodDelete, userPath, adminToken.Plaintext, "")
+	testutil.Status(t, code, body, http.StatusOK)
+
+	code, _, body = ts.request(t, http.MethodGet, userPath, adminToken.Plaintext, "")
+	testutil.Status(t, code, body, http.StatusNotFound)
+}
+
+// TestPasswordReset tests the password reset flow end-to-end: requesting a reset emails a token,
+// and the token can be used once to set a new password, which logs the user out everywhere,
+// including the JWT authentication tokens issued before the reset.
+func TestPasswordReset(t *testing.T) {
+	app, fx := newTestDBApp(t)
+	app.config.jwt.secret = strings.Repeat("s", 32)
+	ts := newTestServer(app.routes())
+	defer ts.Close()
+
+	user := fx.User(nil, "movies:read")
+	session := fx.Token(user, data.ScopeAuthentication)
+
+	stored, err := app.models.Users.Get(context.Background(), user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jwtSession, err := app.newJWT(stored)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Unknown addresses get the same response, but no email.
+	code, _, body := ts.request(t, http.MethodPost, "/v1/tokens/password-reset", "", `{"email": "nobody@example.com"}`)
+	testutil.Status(t, code, body, http.StatusAccepted)
+	testutil.Equal(t, app.processOutbox(), 0)
+
+	code, _, body = ts.request(t, http.MethodPost, "/v1/tokens/password-reset", "",
+		fmt.Sprintf(`{"email": %q}`, user.Email))
+	testutil.Status(t, code, body, http.StatusAccepted)
+	testutil.Equal(t, app.processOutbox(), 1)
+
+	emails := app.mailer.(*mailer.Recorder).SentTo(user.Email)
+	testutil.Equal(t, len(emails), 1)
+	testutil.Equal(t, emails[0].Template, "token_password_reset.tmpl")
+
+	token, ok := emails[0].Data.(map[string]interface{})["passwordResetToken"].(string)
+	if !ok {
+		t.Fatalf("password reset email data has no token: %#v", emails[0].Data)
+	}
+	testutil.StringContains(t, emails[0].PlainBody, token)
+
+	reset := fmt.Sprintf(`{"password": "n3wpa55word", "token": %q}`, token)
+
+	code, _, body = ts.request(t, http.MethodPut, "/v1/users/password", "", reset)
+	testutil.Status(t, code, body, http.StatusOK)
+
+	// The token can only be used once, and the old session has been revoked.
+	code, _, body = ts.request(t, http.MethodPut, "/v1/users/password", "", reset)
+	testutil.Status(t, code, body, http.StatusUnprocessableEntity)
+
+	code, _, body = ts.request(t, http.MethodGet, "/v1/users/me/recently-viewed", session.Plaintext, "")
+	testutil.Status(t, code, body, http.StatusUnauthorized)
+
+	// In jwt mode the JWT from before the reset is rejected, while one issued after it works.
+	app.config.auth.mode = authModeJWT
+
+	code, _, body = ts.request(t, http.MethodGet, "/v1/users/me/recently-viewed", jwtSession.Plaintext, "")
+	testutil.Status(t, code, body, http.StatusUnauthorized)
+
+	code, _, body = ts.request(t, http.MethodPost, "/v1/tokens/authentication", "",
+		fmt.Sprintf(`{"email": %q, "password": "n3wpa55word"}`, user.Email))
+	testutil.Status(t, code, body, http.StatusCreated)
+
+	var tokens struct {
+		AuthenticationToken data.Token `json:"authentication_token"`
+	}
+	testutil.DecodeJSON(t, body, &tokens)
+
+	code, _, body = ts.request(t, http.MethodGet, "/v1/users/me/recently-viewed", tokens.AuthenticationToken.Plaintext, "")
+	testutil.Status(t, code, body, http.StatusOK)
+}
+
+// TestResendActivationToken tests that an inactive user can ask for a new activation token, which
+// replaces their old one, and that activated users aren't sent one.
+func TestResendActivationToken(t *testing.T) {
+	app, fx := newTestDBApp(t)
+	ts := newTestServer(app.routes())
+	defer ts.Close()
+
+	inactive := fx.User(func(u *data.User) { u.Activated = false })
+	old := fx.Token(inactive, data.ScopeActivation)
+	active := fx.User(nil)
+
+	code, _, body := ts.request(t, http.MethodPost, "/v1/tokens/activation", "",
+		fmt.Sprintf(`{"email": %q}`, active.Email))
+	testutil.Status(t, code, body, http.StatusAccepted)
+	testutil.Equal(t, app.processOutbox(), 0)
+
+	code, _, body = ts.request(t, http.MethodPost, "/v1/tokens/activation", "",
+		fmt.Sprintf(`{"email": %q}`, inactive.Email))
+	testutil.Status(t, code, body, http.StatusAccepted)
+	testutil.Equal(t, app.processOutbox(), 1)
+
+	emails := app.mailer.(*mailer.Recorder).SentTo(inactive.Email)
+	testutil.Equal(t, len(emails), 1)
+	testutil.Equal(t, emails[0].Template, "token_activation.tmpl")
+
+	token, ok := emails[0].Data.(map[string]interface{})["activationToken"].(string)
+	if !ok {
+		t.Fatalf("activation email data has no token: %#v", emails[0].Data)
+	}
+
+	// The old token has been replaced by the new one.
+	code, _, body = ts.request(t, http.MethodPut, "/v1/users/activated", "", fmt.Sprintf(`{"token": %q}`, old.Plaintext))
+	testutil.Status(t, code, body, http.StatusUnprocessableEntity)
+
+	code, _, body = ts.request(t, http.MethodPut, "/v1/users/activated", "", fmt.Sprintf(`{"token": %q}`, token))
+	testutil.Status(t, code, body, http.StatusOK)
+}
+
+// TestChangeEmail tests the email change flow end-to-end: the new address is only used once it's
+// confirmed with the token sent to it, and the old address is told about the change.
+func TestChangeEmail(t *testing.T) {
+	app, fx := newTestDBApp(t)
+	ts := newTestServer(app.routes())
+	defer ts.Close()
+
+	user := fx.User(nil, "movies:read")
+	session := fx.Token(user, data.ScopeAuthentication)
+	other := fx.User(nil)
+
+	// The password has to be given, and the address can't belong to another user.
+	code, _, body := ts.request(t, http.MethodPatch, "/v1/users/me/email", session.Plaintext,
+		`{"email": "new@example.com", "password": "wrongpa55word"}`)
+	testutil.Status(t, code, body, http.StatusUnprocessableEntity)
+
+	code, _, body = ts.request(t, http.MethodPatch, "/v1/users/me/email", session.Plaintext,
+		fmt.Sprintf(`{"email": %q, "password": %q}`, other.Email, testutil.Password))
+	testutil.Status(t, code, body, http.StatusUnprocessableEntity)
+
+	code, _, body = ts.request(t, http.MethodPatch, "/v1/users/me/email", session.Plaintext,
+		fmt.Sprintf(`{"email": "new@example.com", "password": %q}`, testutil.Password))
+	testutil.Status(t, code, body, http.StatusAccepted)
+	testutil.Equal(t, app.processOutbox(), 1)
+
+	emails := app.mailer.(*mailer.Recorder).SentTo("new@example.com")
+	testutil.Equal(t, len(emails), 1)
+
+	token, ok := emails[0].Data.(map[string]interface{})["emailChangeToken"].(string)
+	if !ok {
+		t.Fatalf("email change email data has no token: %#v", emails[0].Data)
+	}
+
+	// The old address still works until the change is confirmed.
+	got, err := app.models.Users.GetByEmail(context.Background(), user.Email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.Equal(t, got.ID, user.ID)
+
+	confirm := fmt.Sprintf(`{"token": %q}`, token)
+
+	code, _, body = ts.request(t, http.MethodPut, "/v1/users/email-confirm", "", confirm)
+	testutil.Status(t, code, body, http.StatusOK)
+	testutil.StringContains(t, string(body), `"email": "new@example.com"`)
+
+	testutil.Equal(t, app.processOutbox(), 1)
+	testutil.Equal(t, len(app.mailer.(*mailer.Recorder).SentTo(user.Email)), 1)
+
+	// The token can only be used once.
+	code, _, body = ts.request(t, http.MethodPut, "/v1/users/email-confirm", "", confirm)
+	testutil.Status(t, code, body, http.StatusUnprocessableEntity)
+}
+
+// TestDeleteAccount tests account deletion end-to-end: a deleted account is logged out and can't
+// log in, it can be restored with the emailed token until the grace period is over, and it's
+// purged after that, along with its personal fields in the audit log.
+func TestDeleteAccount(t *testing.T) {
+	app, fx := newTestDBApp(t)
+	ts := newTestServer(app.routes())
+	defer ts.Close()
+
+	user := fx.User(nil, "movies:read")
+	session := fx.Token(user, data.ScopeAuthentication)
+	login := fmt.Sprintf(`{"email": %q, "password": %q}`, user.Email, testutil.Password)
+
+	code, _, body := ts.request(t, http.MethodDelete, "/v1/users/me", session.Plaintext, `{"password": "wrongpa55word"}`)
+	testutil.Status(t, code, body, http.StatusUnprocessableEntity)
+
+	code, _, body = ts.request(t, http.MethodDelete, "/v1/users/me", session.Plaintext,
+		fmt.Sprintf(`{"password": %q}`, testutil.Password))
+	testutil.Status(t, code, body, http.StatusAccepted)
+
+	// The account's tokens are revoked and it can't log in.
+	code, _, body = ts.request(t, http.MethodGet, "/v1/users/me/searches", session.Plaintext, "")
+	testutil.Status(t, code, body, http.StatusUnauthorized)
+
+	code, _, body = ts.request(t, http.MethodPost, "/v1/tokens/authentication", "", login)
+	testutil.Status(t, code, body, http.StatusUnauthorized)
+
+	testutil.Equal(t, app.processOutbox(), 1)
+
+	emails := app.mailer.(*mailer.Recorder).SentTo(user.Email)
+	testutil.Equal(t, len(emails), 1)
+
+	token, ok := emails[0].Data.(map[string]interface{})["accountRestoreToken"].(string)
+	if !ok {
+		t.Fatalf("account deletion email data has no token: %#v", emails[0].Data)
+	}
+
+	restore := fmt.Sprintf(`{"token": %q}`, token)
+
+	code, _, body = ts.request(t, http.MethodPut, "/v1/users/restored", "", restore)
+	testutil.Status(t, code, body, http.StatusOK)
+
+	code, _, body = ts.request(t, http.MethodPost, "/v1/tokens/authentication", "", login)
+	testutil.Status(t, code, body, http.StatusCreated)
+
+	// The token can only be used once.
+	code, _, body = ts.request(t, http.MethodPut, "/v1/users/restored", "", restore)
+	testutil.Status(t, code, body, http.StatusUnprocessableEntity)
+
+	// Once the grace period is over the account is purged.
+	notice := func(*data.Token) *data.OutboxEmail { return &data.OutboxEmail{Recipient: user.Email} }
+
+	_, err := app.models.Users.SoftDelete(context.Background(), user.ID, app.config.accounts.deletionGracePeriod, notice)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	purged, err := app.models.Users.PurgeDeleted(context.Background(), testTime.Add(-time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.Equal(t, purged, int64(0))
+
+	purged, err = app.models.Users.PurgeDeleted(context.Background(), testTime)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.Equal(t, purged, int64(1))
+
+	// The account's history is kept in the audit log, but not its email address.
+	var entries, withEmail int
+
+	err = app.models.Users.DB.QueryRow(`
+		SELECT COUNT(*), COUNT(*) FILTER (WHERE changes ? 'email')
+		FROM audit_log
+		WHERE resource_type = 'users' AND resource_id = $1`, user.ID).Scan(&entries, &withEmail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.Equal(t, entries > 0, true)
+	testutil.Equal(t, withEmail, 0)
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/julienschmidt/httprouter"
+
+	"github.com/codeaucafe/snippetbox/greenlight/internal/validator"
+)
+
+// validateRequest checks a request against the parameters and body described in the route's
+// OpenAPI schemas before the handler runs, and sends a 422 Unprocessable Entity response listing
+// the problems if there are any, in the same format as the handlers' own validation errors. It
+// wraps the handlers when the -openapi-validate flag is set.
+//
+// The handlers still run their own validation, as they don't rely on this being enabled. Bodies
+// which aren't valid JSON are passed through to the handler, so that readJSON() reports them
+// with a 400 Bad Request response as usual.
+func (app *application) validateRequest(rt route, next http.HandlerFunc) http.HandlerFunc {
+	_, pathParams := openAPIPath(rt.path)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		v := validator.New()
+
+		params := httprouter.ParamsFromContext(r.Context())
+		for _, param := range pathParams {
+			validateParam(v, param, params.ByName(param.Name), true)
+		}
+
+		qs := r.URL.Query()
+		for _, param := range rt.query {
+			validateParam(v, param, qs.Get(param.Name), qs.Has(param.Name))
+		}
+
+		if rt.body != nil {
+			body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 1_048_576))
+			if err != nil {
+				app.badRequestResponse(w, r, decodeJSONError(err, 1_048_576))
+				return
+			}
+
+			// Put the body back, so that the handler can read it.
+			r.Body = io.NopCloser(bytes.NewReader(body))
+
+			dec := json.NewDecoder(bytes.NewReader(body))
+			dec.UseNumber()
+
+			var value interface{}
+			if dec.Decode(&value) == nil {
+				validateValue(v, rt.body, "", value)
+			}
+		}
+
+		if !v.Valid() {
+			app.failedValidationResponse(w, r, v.Errors)
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+// validateParam checks a path or query string parameter against its schema. Parameters are
+// strings, so they're converted to the schema's type first, with arrays given as comma separated
+// values, in the same way as the readInt(), readBool() and readCSV() helpers.
+func validateParam(v *validator.Validator, param openAPIParameter, s string, present bool) {
+	if !present || s == "" {
+		if param.Required {
+			v.AddError(param.Name, "must be provided")
+		}
+		return
+	}
+
+	value, ok := parseParam(param.Schema, s)
+	if !ok {
+		v.AddError(param.Name, typeMessage(param.Schema.Type))
+		return
+	}
+
+	validateValue(v, param.Schema, param.Name, value)
+}
+
+// parseParam converts a parameter value to the type of its schema, as it would have been decoded
+// from JSON. It returns false if the value isn't of that type.
+func parseParam(schema *openAPISchema, s string) (interface{}, bool) {
+	switch schema.Type {
+	case "integer", "number":
+		if _, err := strconv.ParseFloat(s, 64); err != nil {
+			return nil, false
+		}
+		return json.Number(s), true
+	case "boolean":
+		b, err := strconv.ParseBool(s)
+		return b, err == nil
+	case "array":
+		var values []interface{}
+		for _, item := range strings.Split(s, ",") {
+			value, ok := parseParam(schema.Items, item)
+			if !ok {
+				return nil, false
+			}
+			values = append(values, value)
+		}
+		return values, true
+	default:
+		return s, true
+	}
+}
+
+// validateValue checks a value decoded from JSON (with numbers decoded as json.Number) against a
+// schema, recording any problems in v under key. The properties of objects are recorded under
+// their own names, prefixed with the key of the object they're in (if any), as in
+// "filter.field". The items of arrays are recorded under the key of the array, as the handlers'
+// own checks on them are.
+func validateValue(v *validator.Validator, schema *openAPISchema, key string, value interface{}) {
+	if key == "" {
+		key = "body"
+	}
+
+	if value == nil {
+		v.Check(schema.Nullable, key, "must not be null")
+		return
+	}
+
+	switch schema.Type {
+	case "string":
+		s, ok := value.(string)
+		if !ok {
+			v.AddError(key, typeMessage(schema.Type))
+			return
+		}
+		validateString(v, schema, key, s)
+
+	case "integer", "number":
+		n, ok := value.(json.Number)
+		if !ok {
+			v.AddError(key, typeMessage(schema.Type))
+			return
+		}
+		validateNumber(v, schema, key, n)
+
+	case "boolean":
+		_, ok := value.(bool)
+		v.Check(ok, key, typeMessage(schema.Type))
+
+	case "array":
+		items, ok := value.([]interface{})
+		if !ok {
+			v.AddError(key, typeMessage(schema.Type))
+			return
+		}
+		validateArray(v, schema, key, items)
+
+	case "object":
+		fields, ok := value.(map[string]interface{})
+		if !ok {
+			v.AddError(key, typeMessage(schema.Type))
+			return
+		}
+
+		prefix := ""
+		if key != "body" {
+			prefix = key + "."
+		}
+
+		for _, name := range schema.Required {
+			_, ok := fields[name]
+			v.Check(ok, prefix+name, "must be provided")
+		}
+
+		for name, field := range fields {
+			if property, ok := schema.Properties[name]; ok {
+				validateValue(v, property, prefix+name, field)
+			}
+		}
+	}
+}
+
+// validateString checks a string against the string keywords of a schema. Lengths are in
+// characters, as in JSON Schema, rather than the bytes that the handlers count.
+func validateString(v *validator.Validator, schema *openAPISchema, key, s string) {
+	length := utf8.RuneCountInString(s)
+
+	if schema.MinLength != nil && length < *schema.MinLength {
+		if *schema.MinLength == 1 {
+			v.AddError(key, "must be provided")
+		} else {
+			v.AddError(key, fmt.Sprintf("must be at least %d characters long", *schema.MinLength))
+		}
+	}
+
+	if schema.MaxLength != nil {
+		v.Check(length <= *schema.MaxLength, key,
+			fmt.Sprintf("must not be more than %d characters long", *schema.MaxLength))
+	}
+
+	if schema.Enum != nil {
+		v.Check(validator.In(s, schema.Enum...), key, "must be one of "+listValues(schema.Enum))
+	}
+
+	if schema.Pattern != "" {
+		v.Check(schemaPattern(schema.Pattern).MatchString(s), key, "must match the pattern "+schema.Pattern)
+	}
+
+	switch schema.Format {
+	case "date":
+		_, err := time.Parse("2006-01-02", s)
+		v.Check(err == nil, key, "must be a date in the format YYYY-MM-DD")
+	case "date-time":
+		_, err := time.Parse(time.RFC3339, s)
+		v.Check(err == nil, key, "must be a date and time in the RFC 3339 format")
+	case "email":
+		v.Check(validator.Matches(s, validator.EmailRX), key, "must be a valid email address")
+	}
+}
+
+// validateNumber checks a number against the number keywords of a schema.
+func validateNumber(v *validator.Validator, schema *openAPISchema, key string, n json.Number) {
+	if schema.Type == "integer" {
+		i, err := n.Int64()
+		if err != nil {
+			v.AddError(key, typeMessage(schema.Type))
+			return
+		}
+
+		switch {
+		case schema.Minimum != nil && schema.Maximum != nil:
+			v.Check(i >= *schema.Minimum && i <= *schema.Maximum, key,
+				fmt.Sprintf("must be between %d and %d", *schema.Minimum, *schema.Maximum))
+		case schema.Minimum != nil:
+			v.Check(i >= *schema.Minimum, key, fmt.Sprintf("must be at least %d", *schema.Minimum))
+		case schema.Maximum != nil:
+			v.Check(i <= *schema.Maximum, key, fmt.Sprintf("must be at most %d", *schema.Maximum))
+		}
+		return
+	}
+
+	f, err := n.Float64()
+	if err != nil {
+		v.AddError(key, typeMessage(schema.Type))
+		return
+	}
+
+	if schema.Minimum != nil {
+		v.Check(f >= float64(*schema.Minimum), key, fmt.Sprintf("must be at least %d", *schema.Minimum))
+	}
+	if schema.Maximum != nil {
+		v.Check(f <= float64(*schema.Maximum), key, fmt.Sprintf("must be at most %d", *schema.Maximum))
+	}
+}
+
+// validateArray checks an array, and each of its items, against a schema.
+func validateArray(v *validator.Validator, schema *openAPISchema, key string, items []interface{}) {
+	if schema.MinItems != nil {
+		v.Check(len(items) >= *schema.MinItems, key, fmt.Sprintf("must contain at least %d items", *schema.MinItems))
+	}
+
+	if schema.MaxItems != nil {
+		v.Check(len(items) <= *schema.MaxItems, key,
+			fmt.Sprintf("must not contain more than %d items", *schema.MaxItems))
+	}
+
+	if schema.Unique {
+		seen := make(map[string]bool, len(items))
+
+		for _, item := range items {
+			js, _ := json.Marshal(item)
+			v.Check(!seen[string(js)], key, "must not contain duplicate values")
+			seen[string(js)] = true
+		}
+	}
+
+	if schema.Items != nil {
+		for _, item := range items {
+			validateValue(v, schema.Items, key, item)
+		}
+	}
+}
+
+// typeMessage returns the error message for a value which isn't of the schema's type.
+func typeMessage(schemaType string) string {
+	switch schemaType {
+	case "integer", "array", "object":
+		return "must be an " + schemaType
+	default:
+		return "must be a " + schemaType
+	}
+}
+
+// listValues lists the values for an error message, as in "a, b or c".
+func listValues(values []string) string {
+	if len(values) == 1 {
+		return values[0]
+	}
+
+	return strings.Join(values[:len(values)-1], ", ") + " or " + values[len(values)-1]
+}
+
+// schemaPatterns caches the compiled patterns of the schemas, which are fixed when the route
+// tables are built.
+var schemaPatterns sync.Map
+
+// schemaPattern returns the compiled regular expression for a schema pattern.
+func schemaPattern(pattern string) *regexp.Regexp {
+	if rx, ok := schemaPatterns.Load(pattern); ok {
+		return rx.(*regexp.Regexp)
+	}
+
+	rx := regexp.MustCompile(pattern)
+	schemaPatterns.Store(pattern, rx)
+
+	return rx
+}
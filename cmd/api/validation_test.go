@@ -0,0 +1,77 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/codeaucafe/snippetbox/greenlight/internal/testutil"
+)
+
+// TestValidateRequest tests that requests are checked against the query string parameters and
+// body described by their route before the handler runs, and that the handler can still read the
+// body of a valid request.
+func TestValidateRequest(t *testing.T) {
+	app := newTestApp()
+
+	rt := route{
+		method: http.MethodPost,
+		path:   "/v1/movies",
+		query: queryParams(map[string]*openAPISchema{
+			"page":   integerSchema(1).atMost(100),
+			"genres": arraySchema(stringSchema(0), 0, 0),
+		}),
+		body: objectSchema(map[string]*openAPISchema{
+			"title":        stringSchema(10),
+			"year":         integerSchema(1888),
+			"release_date": formatSchema("date").nullable(),
+			"genres":       arraySchema(stringSchema(0), 1, 2).unique(),
+		}).required("title", "year"),
+	}
+
+	handler := app.validateRequest(rt, func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		_, _ = w.Write(body)
+	})
+
+	tests := []struct {
+		name     string
+		query    string
+		body     string
+		wantCode int
+		wantBody string
+	}{
+		{"valid", "?page=2&genres=drama,comedy", `{"title": "Moana", "year": 2016, "release_date": null}`,
+			http.StatusOK, `{"title": "Moana", "year": 2016, "release_date": null}`},
+		{"missing field", "", `{"title": "Moana"}`, http.StatusUnprocessableEntity, `"year": "must be provided"`},
+		{"wrong type", "", `{"title": "Moana", "year": "2016"}`, http.StatusUnprocessableEntity,
+			`"year": "must be an integer"`},
+		{"too small", "", `{"title": "Moana", "year": 1000}`, http.StatusUnprocessableEntity,
+			`"year": "must be at least 1888"`},
+		{"too long", "", `{"title": "Moana Moana Moana", "year": 2016}`, http.StatusUnprocessableEntity,
+			`"title": "must not be more than 10 characters long"`},
+		{"not nullable", "", `{"title": null, "year": 2016}`, http.StatusUnprocessableEntity,
+			`"title": "must not be null"`},
+		{"bad format", "", `{"title": "Moana", "year": 2016, "release_date": "16/11/2016"}`,
+			http.StatusUnprocessableEntity, `"release_date": "must be a date in the format YYYY-MM-DD"`},
+		{"duplicates", "", `{"title": "Moana", "year": 2016, "genres": ["drama", "drama"]}`,
+			http.StatusUnprocessableEntity, `"genres": "must not contain duplicate values"`},
+		{"bad query", "?page=abc", `{"title": "Moana", "year": 2016}`, http.StatusUnprocessableEntity,
+			`"page": "must be an integer"`},
+		{"query out of range", "?page=101", `{"title": "Moana", "year": 2016}`, http.StatusUnprocessableEntity,
+			`"page": "must be between 1 and 100"`},
+		{"malformed JSON", "", `{"title": `, http.StatusOK, `{"title": `},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			handler(rr, httptest.NewRequest(http.MethodPost, "/v1/movies"+tt.query, strings.NewReader(tt.body)))
+
+			testutil.Equal(t, rr.Code, tt.wantCode)
+			testutil.StringContains(t, rr.Body.String(), tt.wantBody)
+		})
+	}
+}
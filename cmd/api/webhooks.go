@@ -0,0 +1,465 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/codeaucafe/snippetbox/greenlight/internal/data"
+	"github.com/codeaucafe/snippetbox/greenlight/internal/validator"
+	"github.com/codeaucafe/snippetbox/greenlight/internal/webhook"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.12.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	// webhookBatchSize is the number of webhook deliveries claimed by a worker at once.
+	webhookBatchSize = 20
+	// webhookLease is how long a worker has to send the deliveries it has claimed before they are
+	// sent again by another worker. It must be comfortably longer than a batch of requests which
+	// all run up to the -webhook-timeout flag.
+	webhookLease = 10 * time.Minute
+)
+
+// webhookMetrics publishes the number of webhook deliveries sent ("delivered"), the number of
+// failed delivery attempts ("retries"), and the number of deliveries given up on ("failed").
+var webhookMetrics = expvar.NewMap("webhooks")
+
+// createWebhookHandler handles the "POST /v1/admin/webhooks" endpoint and registers a webhook,
+// which is sent a signed POST request for each event of the given types. If no secret is given
+// then one is generated, and the response is the only time that it's shown.
+func (app *application) createWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		URL        string   `json:"url"`
+		Secret     string   `json:"secret"`
+		EventTypes []string `json:"event_types"`
+		Active     *bool    `json:"active"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	webhook := &data.Webhook{
+		CreatedBy:  &user.ID,
+		URL:        input.URL,
+		Secret:     input.Secret,
+		EventTypes: input.EventTypes,
+		Active:     true,
+	}
+
+	if input.Active != nil {
+		webhook.Active = *input.Active
+	}
+
+	v := validator.New()
+
+	if data.ValidateWebhook(v, webhook, app.config.webhooks.allowPrivate); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Webhooks.Insert(r.Context(), webhook)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/v1/admin/webhooks/%d", webhook.ID))
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"webhook": webhook}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// listWebhooksHandler handles the "GET /v1/admin/webhooks" endpoint and returns every webhook,
+// without their secrets.
+func (app *application) listWebhooksHandler(w http.ResponseWriter, r *http.Request) {
+	webhooks, err := app.models.Webhooks.GetAll(r.Context())
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"webhooks": webhooks}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// updateWebhookHandler handles the "PATCH /v1/admin/webhooks/:id" endpoint, which changes the URL
+// or event types of a webhook, or pauses it by setting active to false. Deliveries to a paused
+// webhook are still queued, and are sent once it's active again. The secret can't be changed;
+// to rotate it, register a new webhook and then delete the old one.
+func (app *application) updateWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	webhook, err := app.models.Webhooks.Get(r.Context(), id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	var input struct {
+		URL        *string  `json:"url"`
+		EventTypes []string `json:"event_types"`
+		Active     *bool    `json:"active"`
+	}
+
+	err = app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	if input.URL != nil {
+		webhook.URL = *input.URL
+	}
+	if input.EventTypes != nil {
+		webhook.EventTypes = input.EventTypes
+	}
+	if input.Active != nil {
+		webhook.Active = *input.Active
+	}
+
+	v := validator.New()
+
+	if data.ValidateWebhook(v, webhook, app.config.webhooks.allowPrivate); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Webhooks.Update(r.Context(), webhook)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"webhook": webhook}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// deleteWebhookHandler handles the "DELETE /v1/admin/webhooks/:id" endpoint. The webhook's
+// deliveries are deleted along with it, including any which haven't been sent yet.
+func (app *application) deleteWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	err = app.models.Webhooks.Delete(r.Context(), id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "webhook successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// listWebhookDeliveriesHandler handles the "GET /v1/admin/webhooks/:id/deliveries" endpoint and
+// returns a paginated log of the deliveries to a webhook, newest first by default, with the
+// status code, latency and error of the last attempt at each. The status query string parameter
+// filters them to those which are pending, delivered or failed.
+func (app *application) listWebhookDeliveriesHandler(w http.ResponseWriter, r *http.Request) {
+	app.listWebhookDeliveries(w, r, false)
+}
+
+// listOwnWebhookDeliveriesHandler handles the "GET /v1/webhooks/:id/deliveries" endpoint, which
+// returns the same log as listWebhookDeliveriesHandler to the user who registered the webhook,
+// so that they can check on it without the webhooks:admin permission. Other users are sent a 404
+// Not Found response.
+func (app *application) listOwnWebhookDeliveriesHandler(w http.ResponseWriter, r *http.Request) {
+	app.listWebhookDeliveries(w, r, true)
+}
+
+// listWebhookDeliveries writes the deliveries to the webhook in the URL. If onlyOwn is true, the
+// webhook must have been registered by the user making the request.
+func (app *application) listWebhookDeliveries(w http.ResponseWriter, r *http.Request, onlyOwn bool) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	v := validator.New()
+	qs := r.URL.Query()
+
+	status := app.readStrings(qs, "status", "")
+
+	filters := data.Filters{
+		Page:         app.readInt(qs, "page", 1, v),
+		PageSize:     app.readInt(qs, "page_size", 20, v),
+		Sort:         app.readStrings(qs, "sort", "-id"),
+		SortSafeList: []string{"id", "-id"},
+	}
+
+	data.ValidateWebhookDeliveryStatus(v, status)
+
+	if data.ValidateFilters(v, filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	hook, err := app.models.Webhooks.Get(r.Context(), id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if onlyOwn {
+		user := app.contextGetUser(r)
+
+		if hook.CreatedBy == nil || *hook.CreatedBy != user.ID {
+			app.notFoundResponse(w, r)
+			return
+		}
+	}
+
+	deliveries, metadata, err := app.models.Webhooks.GetDeliveries(r.Context(), id, status, filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"deliveries": deliveries, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// processWebhooks claims a batch of webhook deliveries which are due and sends them. Failed
+// deliveries are retried with the same exponential backoff as the outbox, up to
+// data.MaxWebhookAttempts times. It returns the number of deliveries claimed.
+func (app *application) processWebhooks() int {
+	job := startJob("webhooks")
+	defer job.finish()
+
+	deliveries, err := app.models.Webhooks.ClaimDue(context.Background(), webhookBatchSize, webhookLease)
+	if err != nil {
+		job.fail()
+		app.logger.PrintError(err, nil)
+		return 0
+	}
+
+	for _, delivery := range deliveries {
+		properties := map[string]string{
+			"delivery_id": strconv.FormatInt(delivery.ID, 10),
+			"webhook_id":  strconv.FormatInt(delivery.WebhookID, 10),
+			"event_type":  delivery.EventType,
+			"attempt":     strconv.Itoa(delivery.Attempts),
+		}
+
+		start := time.Now()
+		status, err := app.sendWebhook(delivery)
+		latency := time.Since(start)
+
+		if err != nil {
+			app.logger.PrintInfo(fmt.Sprintf("webhook delivery failed: %s", err), properties)
+
+			if delivery.Attempts >= data.MaxWebhookAttempts {
+				webhookMetrics.Add("failed", 1)
+			} else {
+				webhookMetrics.Add("retries", 1)
+			}
+
+			var responseStatus *int
+			if status != 0 {
+				responseStatus = &status
+			}
+
+			err = app.models.Webhooks.Retry(context.Background(), delivery, outboxBackoff(delivery.Attempts), responseStatus,
+				latency, err)
+			if err != nil {
+				job.fail()
+				app.logger.PrintError(err, properties)
+			}
+			continue
+		}
+
+		webhookMetrics.Add("delivered", 1)
+
+		err = app.models.Webhooks.MarkDelivered(context.Background(), delivery, status, latency)
+		if err != nil {
+			job.fail()
+			app.logger.PrintError(err, properties)
+		}
+	}
+
+	return len(deliveries)
+}
+
+// sendWebhook sends a signed POST request with the payload of a delivery to its webhook, and
+// returns the status code of the response, or 0 if there wasn't one. Any response other than a
+// 2xx is an error. Redirects aren't followed, as the signature is only meant for the URL which
+// was registered.
+//
+// The request is sent in a client span which continues the trace of the request that caused the
+// delivery, and the traceparent and tracestate headers are passed on to the webhook, so that its
+// receiver can join the trace too.
+func (app *application) sendWebhook(delivery *data.WebhookDelivery) (status int, err error) {
+	ctx := otel.GetTextMapPropagator().Extract(context.Background(), propagation.MapCarrier(delivery.TraceContext))
+
+	ctx, span := tracer().Start(ctx, "webhook "+delivery.EventType,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			semconv.HTTPMethodKey.String(http.MethodPost),
+			attribute.Int64("webhook.id", delivery.WebhookID),
+			attribute.Int64("webhook.delivery_id", delivery.ID),
+			attribute.Int("webhook.attempt", delivery.Attempts),
+		),
+	)
+	defer func() {
+		if status != 0 {
+			span.SetAttributes(semconv.HTTPStatusCodeKey.Int(status))
+		}
+		if err != nil {
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, delivery.URL, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return 0, err
+	}
+
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+
+	timestamp := strconv.FormatInt(app.clock.Now().Unix(), 10)
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "Greenlight-Webhooks/"+version)
+	req.Header.Set(webhook.EventHeader, delivery.EventType)
+	req.Header.Set(webhook.DeliveryHeader, strconv.FormatInt(delivery.ID, 10))
+	req.Header.Set(webhook.TimestampHeader, timestamp)
+	req.Header.Set(webhook.SignatureHeader, webhook.Sign(delivery.Secret, timestamp, delivery.Payload))
+
+	res, err := app.webhookClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+
+	// Drain (some of) the body, so that the connection can be reused.
+	_, _ = io.Copy(io.Discard, io.LimitReader(res.Body, 64*1024))
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return res.StatusCode, fmt.Errorf("webhook responded with status %d", res.StatusCode)
+	}
+
+	return res.StatusCode, nil
+}
+
+// newWebhookClient returns the HTTP client which webhook requests are sent with. Unless the
+// -webhook-allow-private flag is set, it refuses to connect to addresses which aren't public (see
+// webhook.CheckDial), and it doesn't use a proxy, so that the check applies to the webhook itself.
+func newWebhookClient(cfg config) *http.Client {
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	if !cfg.webhooks.allowPrivate {
+		dialer.Control = webhook.CheckDial
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+
+	return &http.Client{
+		Transport: transport,
+		Timeout:   cfg.webhooks.timeout,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// processWebhooksPeriodically sends webhook deliveries until the application exits. As with the
+// outbox, if a full batch was claimed there may be more deliveries waiting, so it carries on
+// straight away, and otherwise it waits for the poll interval.
+func (app *application) processWebhooksPeriodically(interval time.Duration) {
+	for {
+		if app.processWebhooks() < webhookBatchSize {
+			time.Sleep(interval)
+		}
+	}
+}
+
+// purgeWebhookDeliveries removes the delivered and failed webhook deliveries which are older than
+// the retention period set by the -webhook-delivery-retention flag.
+func (app *application) purgeWebhookDeliveries() {
+	job := startJob("purge_webhook_deliveries")
+	defer job.finish()
+
+	purged, err := app.models.Webhooks.PurgeDeliveries(context.Background(), app.clock.Now().Add(-app.config.webhooks.retention))
+	if err != nil {
+		job.fail()
+		app.logger.PrintError(err, nil)
+		return
+	}
+
+	if purged > 0 {
+		app.logger.PrintInfo("purged webhook deliveries", map[string]string{
+			"count": strconv.FormatInt(purged, 10),
+		})
+	}
+}
+
+// purgeWebhookDeliveriesPeriodically calls purgeWebhookDeliveries() once every interval, as long
+// as this instance is the leader. It runs until the application exits.
+func (app *application) purgeWebhookDeliveriesPeriodically(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+
+		if !app.isLeader() {
+			continue
+		}
+
+		app.purgeWebhookDeliveries()
+	}
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/codeaucafe/snippetbox/greenlight/internal/data"
+	"github.com/codeaucafe/snippetbox/greenlight/internal/testutil"
+	"github.com/codeaucafe/snippetbox/greenlight/internal/validator"
+	"github.com/codeaucafe/snippetbox/greenlight/internal/webhook"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+)
+
+// TestWebhooks tests that events are sent to the webhooks which subscribe to them, signed with
+// the webhook's secret, and that the delivery log records both the deliveries which were accepted
+// and those which will be retried.
+func TestWebhooks(t *testing.T) {
+	app, fx := newTestDBApp(t)
+	ts := newTestServer(app.routes())
+	defer ts.Close()
+
+	admin := fx.Token(fx.User(nil, "webhooks:admin", "movies:write"), data.ScopeAuthentication)
+
+	received := make(chan *http.Request, 10)
+	bodies := make(chan []byte, 10)
+
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received <- r
+		bodies <- body
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer receiver.Close()
+
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer broken.Close()
+
+	type webhookResponse struct {
+		Webhook data.Webhook `json:"webhook"`
+	}
+
+	register := func(url string) data.Webhook {
+		code, _, body := ts.request(t, http.MethodPost, "/v1/admin/webhooks", admin.Plaintext,
+			fmt.Sprintf(`{"url": %q, "event_types": ["movie.created", "user.registered"]}`, url))
+		testutil.Status(t, code, body, http.StatusCreated)
+
+		var got webhookResponse
+		testutil.DecodeJSON(t, body, &got)
+		return got.Webhook
+	}
+
+	working := register(receiver.URL)
+	failing := register(broken.URL)
+
+	if working.Secret == "" {
+		t.Fatal("got no generated secret")
+	}
+
+	code, _, body := ts.request(t, http.MethodPost, "/v1/admin/webhooks", admin.Plaintext,
+		`{"url": "ftp://example.com", "event_types": ["movie.watched"]}`)
+	testutil.Status(t, code, body, http.StatusUnprocessableEntity)
+
+	// Webhooks can't point at private addresses unless -webhook-allow-private is set.
+	app.config.webhooks.allowPrivate = false
+	code, _, body = ts.request(t, http.MethodPost, "/v1/admin/webhooks", admin.Plaintext,
+		`{"url": "http://169.254.169.254/latest/meta-data", "event_types": ["movie.created"]}`)
+	testutil.Status(t, code, body, http.StatusUnprocessableEntity)
+	app.config.webhooks.allowPrivate = true
+
+	code, _, body = ts.request(t, http.MethodPost, "/v1/movies", admin.Plaintext,
+		`{"title": "Moana", "year": 2016, "runtime": "107 mins", "genres": ["animation"]}`)
+	testutil.Status(t, code, body, http.StatusCreated)
+
+	testutil.Equal(t, app.processWebhooks(), 2)
+
+	r := <-received
+	payload := <-bodies
+
+	testutil.Equal(t, r.Header.Get(webhook.EventHeader), data.EventMovieCreated)
+	err := webhook.VerifySignature(working.Secret, r.Header, payload, time.Now(), webhook.DefaultTolerance)
+	if err != nil {
+		t.Errorf("got signature error %v", err)
+	}
+
+	var event struct {
+		Type string     `json:"type"`
+		Data data.Movie `json:"data"`
+	}
+	if err := json.Unmarshal(payload, &event); err != nil {
+		t.Fatal(err)
+	}
+
+	testutil.Equal(t, event.Type, data.EventMovieCreated)
+	testutil.Equal(t, event.Data.Title, "Moana")
+
+	type deliveries struct {
+		Deliveries []data.WebhookDelivery `json:"deliveries"`
+	}
+
+	code, _, body = ts.request(t, http.MethodGet, fmt.Sprintf("/v1/admin/webhooks/%d/deliveries", working.ID),
+		admin.Plaintext, "")
+	testutil.Status(t, code, body, http.StatusOK)
+
+	var got deliveries
+	testutil.DecodeJSON(t, body, &got)
+	testutil.Equal(t, len(got.Deliveries), 1)
+	testutil.Equal(t, got.Deliveries[0].Status, data.WebhookDeliveryDelivered)
+	testutil.Equal(t, *got.Deliveries[0].ResponseStatus, http.StatusNoContent)
+	if got.Deliveries[0].LatencyMS == nil {
+		t.Error("got no latency")
+	}
+
+	// The admin who registered the webhook can also see its deliveries without the admin
+	// permission, but other users can't.
+	code, _, body = ts.request(t, http.MethodGet, fmt.Sprintf("/v1/webhooks/%d/deliveries", working.ID),
+		admin.Plaintext, "")
+	testutil.Status(t, code, body, http.StatusOK)
+
+	other := fx.Token(fx.User(nil), data.ScopeAuthentication)
+	code, _, body = ts.request(t, http.MethodGet, fmt.Sprintf("/v1/webhooks/%d/deliveries", working.ID),
+		other.Plaintext, "")
+	testutil.Status(t, code, body, http.StatusNotFound)
+
+	// The failed delivery is waiting to be retried, so it isn't claimed again straight away.
+	code, _, body = ts.request(t, http.MethodGet,
+		fmt.Sprintf("/v1/admin/webhooks/%d/deliveries?status=pending", failing.ID), admin.Plaintext, "")
+	testutil.Status(t, code, body, http.StatusOK)
+	testutil.DecodeJSON(t, body, &got)
+	testutil.Equal(t, len(got.Deliveries), 1)
+	testutil.Equal(t, got.Deliveries[0].Attempts, 1)
+	testutil.Equal(t, *got.Deliveries[0].ResponseStatus, http.StatusServiceUnavailable)
+	testutil.Equal(t, app.processWebhooks(), 0)
+
+	stats, err := app.models.Webhooks.Stats(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.Equal(t, stats.Depth, int64(1))
+
+	// Paused webhooks aren't sent new events, but the others still are.
+	code, _, body = ts.request(t, http.MethodPatch, fmt.Sprintf("/v1/admin/webhooks/%d", working.ID),
+		admin.Plaintext, `{"active": false}`)
+	testutil.Status(t, code, body, http.StatusOK)
+
+	code, _, body = ts.request(t, http.MethodPost, "/v1/users", "",
+		`{"name": "Alice", "email": "alice@example.com", "password": "pa55word1234"}`)
+	testutil.Status(t, code, body, http.StatusAccepted)
+
+	testutil.Equal(t, app.processWebhooks(), 1)
+	testutil.Equal(t, len(received), 0)
+}
+
+// TestSendWebhookTracePropagation checks that a webhook request continues the trace of the request
+// which caused the delivery, by passing its traceparent header on to the webhook.
+func TestSendWebhookTracePropagation(t *testing.T) {
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+
+	previous := otel.GetTextMapPropagator()
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	defer otel.SetTextMapPropagator(previous)
+
+	traceparents := make(chan string, 1)
+
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparents <- r.Header.Get("traceparent")
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer receiver.Close()
+
+	app := newTestApp()
+	app.config.webhooks.timeout = 5 * time.Second
+	app.config.webhooks.allowPrivate = true
+	app.webhookClient = newWebhookClient(app.config)
+
+	status, err := app.sendWebhook(&data.WebhookDelivery{
+		ID:        1,
+		WebhookID: 1,
+		EventType: data.EventMovieCreated,
+		Payload:   []byte(`{}`),
+		URL:       receiver.URL,
+		Secret:    "0123456789abcdef",
+		TraceContext: map[string]string{
+			"traceparent": "00-" + traceID + "-00f067aa0ba902b7-01",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.Equal(t, status, http.StatusNoContent)
+
+	traceparent := <-traceparents
+	testutil.StringContains(t, traceparent, "-"+traceID+"-")
+}
+
+// TestVerifyWebhookSignature checks that a receiver can verify the signature of a webhook request
+// with webhook.VerifySignature, and that it rejects requests which were tampered with, signed with
+// another secret, or sent too long ago.
+func TestVerifyWebhookSignature(t *testing.T) {
+	const secret = "0123456789abcdef"
+
+	type request struct {
+		header http.Header
+		body   []byte
+	}
+
+	requests := make(chan request, 1)
+
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		requests <- request{header: r.Header, body: body}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer receiver.Close()
+
+	app := newTestApp()
+	app.config.webhooks.timeout = 5 * time.Second
+	app.config.webhooks.allowPrivate = true
+	app.webhookClient = newWebhookClient(app.config)
+
+	_, err := app.sendWebhook(&data.WebhookDelivery{
+		ID:        1,
+		WebhookID: 1,
+		EventType: data.EventMovieCreated,
+		Payload:   []byte(`{"type":"movie.created"}`),
+		URL:       receiver.URL,
+		Secret:    secret,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := <-requests
+	now := app.clock.Now()
+
+	tests := []struct {
+		name   string
+		secret string
+		body   string
+		now    time.Time
+		want   error
+	}{
+		{name: "valid", secret: secret, body: string(req.body), now: now},
+		{name: "tampered body", secret: secret, body: `{"type":"movie.deleted"}`, now: now,
+			want: webhook.ErrInvalidSignature},
+		{name: "wrong secret", secret: "fedcba9876543210", body: string(req.body), now: now,
+			want: webhook.ErrInvalidSignature},
+		{name: "replayed", secret: secret, body: string(req.body), now: now.Add(time.Hour),
+			want: webhook.ErrStaleTimestamp},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := webhook.VerifySignature(tt.secret, req.header, []byte(tt.body), tt.now, webhook.DefaultTolerance)
+			if !errors.Is(err, tt.want) {
+				t.Errorf("got error %v; want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+// TestWebhookPrivateAddresses checks that webhook URLs which point at private, loopback or
+// internal addresses are rejected, and that requests aren't sent to a private address even if
+// the URL passed validation.
+func TestWebhookPrivateAddresses(t *testing.T) {
+	tests := []struct {
+		url  string
+		want bool
+	}{
+		{url: "https://hooks.example.com/greenlight", want: true},
+		{url: "https://93.184.216.34/hook", want: true},
+		{url: "https://[2606:2800:220:1:248:1893:25c8:1946]/hook", want: true},
+		{url: "http://localhost:8080/hook"},
+		{url: "http://api.localhost/hook"},
+		{url: "http://metadata.google.internal/computeMetadata/v1"},
+		{url: "http://printer.local/hook"},
+		{url: "http://intranet/hook"},
+		{url: "http://127.0.0.1/hook"},
+		{url: "http://10.0.0.8/hook"},
+		{url: "http://172.16.4.2/hook"},
+		{url: "http://192.168.1.1/hook"},
+		{url: "http://100.64.0.1/hook"},
+		{url: "http://169.254.169.254/latest/meta-data"},
+		{url: "http://0.0.0.0/hook"},
+		{url: "http://[::1]/hook"},
+		{url: "http://[fd00::1]/hook"},
+		{url: "http://[::ffff:127.0.0.1]/hook"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.url, func(t *testing.T) {
+			v := validator.New()
+			data.ValidateWebhook(v, &data.Webhook{URL: tt.url, EventTypes: []string{data.EventMovieCreated}}, false)
+			testutil.Equal(t, v.Valid(), tt.want)
+		})
+	}
+
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("got a request to a private address")
+	}))
+	defer receiver.Close()
+
+	app := newTestApp()
+	app.config.webhooks.timeout = 5 * time.Second
+	app.webhookClient = newWebhookClient(app.config)
+
+	_, err := app.sendWebhook(&data.WebhookDelivery{
+		ID:        1,
+		WebhookID: 1,
+		EventType: data.EventMovieCreated,
+		Payload:   []byte(`{}`),
+		URL:       receiver.URL,
+		Secret:    "0123456789abcdef",
+	})
+	if !errors.Is(err, webhook.ErrPrivateAddress) {
+		t.Errorf("got error %v; want %v", err, webhook.ErrPrivateAddress)
+	}
+}
@@ -0,0 +1,421 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	"golang.org/x/net/websocket"
+
+	"github.com/codeaucafe/snippetbox/greenlight/internal/data"
+	"github.com/codeaucafe/snippetbox/greenlight/internal/validator"
+)
+
+const (
+	// socketBuffer is the number of notifications which can be waiting to be sent on a
+	// WebSocket connection. A connection which falls further behind than this is closed, and the
+	// client can list the notifications it missed when it reconnects.
+	socketBuffer = 64
+	// socketPingInterval is how often a ping frame is sent on a connection, so that proxies
+	// don't close it while it's idle, and so that we notice clients which have gone away.
+	socketPingInterval = 30 * time.Second
+	// socketWriteTimeout is how long a single write to a connection can take before the
+	// connection is given up on.
+	socketWriteTimeout = 10 * time.Second
+	// socketTicketTTL is how long a WebSocket ticket can be used for. It only needs to last until
+	// the client opens the connection.
+	socketTicketTTL = 30 * time.Second
+
+	// WebSocket close codes (RFC 6455 section 7.4.1).
+	socketCloseGoingAway     = 1001
+	socketCloseTryAgainLater = 1013
+)
+
+// hubMetrics publishes the number of users with an open WebSocket connection, and the number of
+// notifications pushed to them, in the expvar handler.
+var hubMetrics = expvar.NewMap("notification_hub")
+
+// notificationHub passes in-app notifications on to the WebSocket connections of the users they
+// are for. A single goroutine (see run()) owns the set of connections, so the connections
+// register and unregister with it, and notifications are published to it, over channels.
+//
+// The notifications are published by relayNotifications(), which listens for the notifications
+// announced on the data.NotificationsChannel. They reach every instance of the application that
+// way, wherever the notification was added, so each user gets their notifications on whichever
+// instance they're connected to.
+type notificationHub struct {
+	register   chan *hubClient
+	unregister chan *hubClient
+	notify     chan *data.Notification
+	quit       chan struct{}
+	done       chan struct{}
+}
+
+// hubClient is a WebSocket connection registered with the hub. Its send channel is closed when
+// the hub drops it, either because it fell behind or because the hub has stopped.
+type hubClient struct {
+	userID int64
+	send   chan *data.Notification
+}
+
+// newNotificationHub returns a new notificationHub. Its run() method must be started before it's
+// used.
+func newNotificationHub() *notificationHub {
+	return &notificationHub{
+		register:   make(chan *hubClient),
+		unregister: make(chan *hubClient),
+		notify:     make(chan *data.Notification),
+		quit:       make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+}
+
+// run passes notifications on to the registered connections until the hub is stopped. Sending
+// never waits for a connection: one whose buffer is full is dropped.
+func (h *notificationHub) run() {
+	defer close(h.done)
+
+	clients := make(map[int64]map[*hubClient]struct{})
+
+	drop := func(c *hubClient) {
+		if _, ok := clients[c.userID][c]; !ok {
+			return
+		}
+
+		delete(clients[c.userID], c)
+		if len(clients[c.userID]) == 0 {
+			delete(clients, c.userID)
+		}
+
+		close(c.send)
+		hubMetrics.Add("connections", -1)
+	}
+
+	for {
+		select {
+		case c := <-h.register:
+			if clients[c.userID] == nil {
+				clients[c.userID] = make(map[*hubClient]struct{})
+			}
+			clients[c.userID][c] = struct{}{}
+			hubMetrics.Add("connections", 1)
+
+		case c := <-h.unregister:
+			drop(c)
+
+		case n := <-h.notify:
+			for c := range clients[n.UserID] {
+				select {
+				case c.send <- n:
+					hubMetrics.Add("pushed", 1)
+				default:
+					drop(c)
+					hubMetrics.Add("dropped", 1)
+				}
+			}
+
+		case <-h.quit:
+			for _, set := range clients {
+				for c := range set {
+					drop(c)
+				}
+			}
+			return
+		}
+	}
+}
+
+// subscribe registers a connection for the user's notifications. If the hub has stopped then the
+// returned client's send channel is already closed.
+func (h *notificationHub) subscribe(userID int64) *hubClient {
+	c := &hubClient{userID: userID, send: make(chan *data.Notification, socketBuffer)}
+
+	select {
+	case h.register <- c:
+	case <-h.done:
+		close(c.send)
+	}
+
+	return c
+}
+
+// unsubscribe unregisters a connection. It's safe to call after the hub has dropped it.
+func (h *notificationHub) unsubscribe(c *hubClient) {
+	select {
+	case h.unregister <- c:
+	case <-h.done:
+	}
+}
+
+// publish passes a notification on to the user's connections, if they have any.
+func (h *notificationHub) publish(n *data.Notification) {
+	select {
+	case h.notify <- n:
+	case <-h.done:
+	}
+}
+
+// stop drops every connection and stops the hub, and waits for it to finish.
+func (h *notificationHub) stop() {
+	close(h.quit)
+	<-h.done
+}
+
+// startNotificationHub starts the notification hub, along with a goroutine which relays the
+// notifications announced by PostgreSQL to it. It's called by serve(), which calls the returned
+// function to stop both once the WebSocket connections have been closed.
+func (app *application) startNotificationHub() func() {
+	app.hub = newNotificationHub()
+	go app.hub.run()
+
+	// The listener has a connection of its own, which it re-establishes if it's lost.
+	listener := pq.NewListener(app.config.db.dsn, time.Second, time.Minute,
+		func(event pq.ListenerEventType, err error) {
+			if err != nil {
+				app.logger.PrintError(err, map[string]string{"listener": data.NotificationsChannel})
+			}
+		})
+
+	relayed := make(chan struct{})
+
+	go func() {
+		defer close(relayed)
+		app.relayNotifications(listener)
+	}()
+
+	return func() {
+		_ = listener.Close()
+		<-relayed
+		app.hub.stop()
+	}
+}
+
+// relayNotifications listens for the notifications announced on the data.NotificationsChannel,
+// and publishes each of them to the hub, until the listener is closed.
+func (app *application) relayNotifications(listener *pq.Listener) {
+	// Listen() waits until the listener has connected, so it's called here rather than in
+	// startNotificationHub(), so that the server isn't held up by the database.
+	err := listener.Listen(data.NotificationsChannel)
+	if err != nil {
+		app.logger.PrintError(err, map[string]string{"listener": data.NotificationsChannel})
+		return
+	}
+
+	// Ping the connection now and then, so that we notice if it's been lost even when there
+	// aren't any notifications.
+	ping := time.NewTicker(90 * time.Second)
+	defer ping.Stop()
+
+	for {
+		select {
+		case n, ok := <-listener.Notify:
+			if !ok {
+				return
+			}
+
+			// A nil notification means that the connection was re-established. Any
+			// notifications announced while it was down aren't pushed, but the users can
+			// still list them.
+			if n == nil {
+				continue
+			}
+
+			notification, err := data.ParseNotificationPayload(n.Extra)
+			if err != nil {
+				app.logger.PrintError(err, map[string]string{"listener": data.NotificationsChannel})
+				continue
+			}
+
+			app.hub.publish(notification)
+
+		case <-ping.C:
+			go func() {
+				_ = listener.Ping()
+			}()
+		}
+	}
+}
+
+// createSocketTicketHandler handles the "POST /v1/tokens/websocket" endpoint, and returns a
+// ticket which authenticates a single WebSocket connection, in the ticket query string parameter
+// of "GET /v1/ws". Browsers can't send an Authorization header when they open a WebSocket, so
+// they get a ticket with their bearer token first. Tickets expire after socketTicketTTL and can
+// only be used once.
+func (app *application) createSocketTicketHandler(w http.ResponseWriter, r *http.Request) {
+	ticket, err := app.models.Tokens.New(r.Context(), app.contextGetUser(r).ID, socketTicketTTL, data.ScopeWebSocket)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"ticket": ticket}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// isWebSocketUpgrade reports whether the request asks to be upgraded to a WebSocket connection.
+func isWebSocketUpgrade(r *http.Request) bool {
+	return strings.EqualFold(r.Header.Get("Upgrade"), "websocket")
+}
+
+// authenticateSocketTicket authenticates a WebSocket upgrade request with a ticket from
+// createSocketTicketHandler, and then calls the next handler in the chain. The ticket is used
+// up, whether or not the connection succeeds.
+func (app *application) authenticateSocketTicket(w http.ResponseWriter, r *http.Request, next http.Handler, ticket string) {
+	v := validator.New()
+
+	if data.ValidateTokenPlaintext(v, ticket); !v.Valid() {
+		app.invalidAuthenticationTokenResponse(w, r)
+		return
+	}
+
+	userID, err := app.models.Tokens.Consume(r.Context(), data.ScopeWebSocket, ticket)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidAuthenticationTokenResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	user, err := app.models.Users.Get(r.Context(), userID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidAuthenticationTokenResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	next.ServeHTTP(w, app.contextSetUser(r, user))
+}
+
+// notificationSocketHandler handles the "GET /v1/ws" endpoint, which upgrades the request to a
+// WebSocket connection and pushes the current user's in-app notifications down it as they are
+// added, as text messages like:
+//
+//	{"type": "notification", "notification": {"id": 1, "kind": "movie_released", ...}}
+//
+// The connection is authenticated by the Authorization header, in the same way as any other
+// request, or by a ticket (see createSocketTicketHandler), and anything the client sends is
+// ignored. Notifications are only pushed while the client is connected, and aren't marked as
+// read, so clients should list the unread notifications when they (re)connect.
+//
+// The server closes the connection with a going away (1001) close frame when it shuts down, and
+// a try again later (1013) one if the client falls too far behind; in either case the client
+// should reconnect.
+func (app *application) notificationSocketHandler(w http.ResponseWriter, r *http.Request) {
+	if !isWebSocketUpgrade(r) {
+		w.Header().Set("Upgrade", "websocket")
+		app.errorResponse(w, r, http.StatusUpgradeRequired, "this endpoint only accepts WebSocket connections")
+		return
+	}
+
+	userID := app.contextGetUser(r).ID
+
+	server := websocket.Server{
+		// A ticket can be used from any page, so browsers are only allowed to connect from the
+		// first-party origins, like the token endpoints. Clients other than browsers don't
+		// have to send an origin.
+		Handshake: func(_ *websocket.Config, r *http.Request) error {
+			origin := r.Header.Get("Origin")
+			if origin != "" && !newCORSPolicy(app.config.cors.firstPartyOrigins).allowsOrigin(origin) {
+				return fmt.Errorf("websocket origin %q is not trusted", origin)
+			}
+			return nil
+		},
+		Handler: func(ws *websocket.Conn) {
+			app.serveNotificationSocket(ws, userID)
+		},
+	}
+
+	server.ServeHTTP(w, r)
+}
+
+// serveNotificationSocket pushes the user's notifications down the connection until the client
+// goes away, falls behind, or the server shuts down. The connection is closed once it returns.
+func (app *application) serveNotificationSocket(ws *websocket.Conn, userID int64) {
+	client := app.hub.subscribe(userID)
+	defer app.hub.unsubscribe(client)
+
+	closing, done := app.streams.track("websocket")
+	defer done()
+
+	// The server's read and write timeouts still apply to the connection after it has been
+	// hijacked, which would cut it off, so clear them. Each write sets a deadline of its own.
+	_ = ws.SetDeadline(time.Time{})
+
+	// Read and discard anything the client sends in the background. This also answers the
+	// client's pings, and tells us when the client closes the connection.
+	gone := make(chan struct{})
+
+	go func() {
+		defer close(gone)
+		_, _ = io.Copy(io.Discard, ws)
+	}()
+
+	ping := time.NewTicker(socketPingInterval)
+	defer ping.Stop()
+
+	for {
+		select {
+		case <-gone:
+			return
+		case <-closing:
+			_ = writeSocketClose(ws, socketCloseGoingAway)
+			return
+		case <-ping.C:
+			if err := writeSocketFrame(ws, websocket.PingFrame, nil); err != nil {
+				return
+			}
+		case n, ok := <-client.send:
+			if !ok {
+				_ = writeSocketClose(ws, socketCloseTryAgainLater)
+				return
+			}
+
+			js, err := json.Marshal(envelope{"type": "notification", "notification": n})
+			if err != nil {
+				app.logger.PrintError(err, nil)
+				return
+			}
+
+			if err := writeSocketFrame(ws, websocket.TextFrame, js); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// writeSocketFrame writes a single frame of the given type, giving up after socketWriteTimeout.
+// It must only be called from the goroutine which writes to the connection.
+func writeSocketFrame(ws *websocket.Conn, frameType byte, payload []byte) error {
+	err := ws.SetWriteDeadline(time.Now().Add(socketWriteTimeout))
+	if err != nil {
+		return err
+	}
+
+	ws.PayloadType = frameType
+	_, err = ws.Write(payload)
+	return err
+}
+
+// writeSocketClose writes a close frame with the given close code.
+func writeSocketClose(ws *websocket.Conn, code int) error {
+	payload := make([]byte, 2)
+	binary.BigEndian.PutUint16(payload, uint16(code))
+
+	return writeSocketFrame(ws, websocket.CloseFrame, payload)
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+
+	"github.com/codeaucafe/snippetbox/greenlight/internal/data"
+	"github.com/codeaucafe/snippetbox/greenlight/internal/testutil"
+)
+
+// TestNotificationSocket tests that a user's notifications are pushed down their WebSocket
+// connection, and nobody else's, and that the connection is closed when the server shuts down.
+func TestNotificationSocket(t *testing.T) {
+	app := newTestApp()
+	app.streams = newStreamTracker()
+	app.hub = newNotificationHub()
+
+	go app.hub.run()
+	defer app.hub.stop()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		app.notificationSocketHandler(w, app.contextSetUser(r, &data.User{ID: 1}))
+	}))
+	defer srv.Close()
+
+	app.config.cors.firstPartyOrigins = []string{srv.URL}
+
+	// Plain requests are told to upgrade.
+	res, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = res.Body.Close()
+	testutil.Equal(t, res.StatusCode, http.StatusUpgradeRequired)
+
+	// Browsers can only connect from the first-party origins.
+	_, err = websocket.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), "", "https://evil.example.com")
+	if err == nil {
+		t.Fatal("connected from an untrusted origin")
+	}
+
+	ws, err := websocket.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), "", srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+
+	// Wait for the connection to be registered with the hub, so that the notifications aren't
+	// published before it's listening.
+	for i := 0; i < 100; i++ {
+		if v := hubMetrics.Get("connections"); v != nil && v.String() == "1" {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	app.hub.publish(&data.Notification{ID: 1, UserID: 2, Kind: data.NotificationMovieReleased, Message: "Not yours"})
+	app.hub.publish(&data.Notification{ID: 2, UserID: 1, Kind: data.NotificationMovieReleased, Message: "Yours"})
+
+	_ = ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	var msg struct {
+		Type         string            `json:"type"`
+		Notification data.Notification `json:"notification"`
+	}
+	if err := websocket.JSON.Receive(ws, &msg); err != nil {
+		t.Fatal(err)
+	}
+
+	testutil.Equal(t, msg.Type, "notification")
+	testutil.Equal(t, msg.Notification.ID, int64(2))
+	testutil.Equal(t, msg.Notification.Message, "Yours")
+
+	// The close frame ends the stream.
+	app.streams.closeAll()
+
+	err = websocket.JSON.Receive(ws, &msg)
+	if !errors.Is(err, io.EOF) {
+		t.Fatalf("got %v; want EOF", err)
+	}
+}
+
+// TestNotificationSocketTicket tests that a WebSocket connection can be authenticated with a
+// ticket instead of an Authorization header, through the full middleware chain, and that each
+// ticket can only be used once.
+func TestNotificationSocketTicket(t *testing.T) {
+	app, fx := newTestDBApp(t)
+	app.hub = newNotificationHub()
+
+	go app.hub.run()
+	defer app.hub.stop()
+
+	ts := newTestServer(app.routes())
+	defer ts.Close()
+
+	app.config.cors.firstPartyOrigins = []string{ts.URL}
+
+	user := fx.User(nil)
+	session := fx.Token(user, data.ScopeAuthentication)
+
+	code, _, body := ts.request(t, http.MethodPost, "/v1/tokens/websocket", session.Plaintext, "")
+	testutil.Status(t, code, body, http.StatusCreated)
+
+	var created struct {
+		Ticket data.Token `json:"ticket"`
+	}
+	testutil.DecodeJSON(t, body, &created)
+
+	url := "ws" + strings.TrimPrefix(ts.URL, "http") + "/v1/ws?ticket=" + created.Ticket.Plaintext
+
+	ws, err := websocket.Dial(url, "", ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = ws.Close()
+
+	_, err = websocket.Dial(url, "", ts.URL)
+	if err == nil {
+		t.Fatal("connected twice with the same ticket")
+	}
+
+	// Without a ticket or an Authorization header the user is anonymous.
+	_, err = websocket.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/v1/ws", "", ts.URL)
+	if err == nil {
+		t.Fatal("connected without authenticating")
+	}
+}
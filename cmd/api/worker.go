@@ -0,0 +1,173 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/codeaucafe/snippetbox/greenlight/internal/data"
+)
+
+// The process modes for the -mode flag. An api process only serves HTTP requests, a worker
+// process only runs the background jobs, and an all process (the default) does both. This lets
+// the HTTP servers and the workers share one binary and config but be scaled independently.
+const (
+	modeAPI    = "api"
+	modeWorker = "worker"
+	modeAll    = "all"
+)
+
+// processRoles returns whether a process in the given mode serves HTTP requests, and whether it
+// runs the scheduled and queued background jobs.
+func processRoles(mode string) (serveHTTP, runJobs bool) {
+	return mode != modeWorker, mode != modeAPI
+}
+
+// backgroundLoop is one of the goroutines which a process runs until it exits. The name is only
+// used to tell them apart in tests.
+type backgroundLoop struct {
+	name string
+	run  func()
+}
+
+// backgroundLoops returns the background loops for the process's mode. API processes run the
+// loops behind the parts of the API which have been set up (such as app.views), and worker
+// processes run the scheduled and queued background jobs. All processes keep their runtime
+// settings up to date.
+func (app *application) backgroundLoops() []backgroundLoop {
+	cfg := app.config
+	serveHTTP, runJobs := processRoles(cfg.mode)
+
+	var loops []backgroundLoop
+
+	add := func(name string, run func()) {
+		loops = append(loops, backgroundLoop{name: name, run: run})
+	}
+
+	add("refresh_settings", func() { app.refreshSettings(cfg.settingsRefreshInterval) })
+
+	if serveHTTP {
+		// Keep an eye on the database, so that low priority requests are shed while it's
+		// struggling.
+		if app.shedder != nil {
+			add("monitor_load", func() { app.monitorLoadPeriodically(cfg.shedding.checkInterval) })
+		}
+
+		// Write the metered usage to the database.
+		if app.usage != nil {
+			add("flush_usage", func() { app.flushUsagePeriodically(cfg.usage.flushInterval) })
+		}
+
+		// Write the movie view counts to the database, and record heartbeats for the status page.
+		if app.views != nil {
+			add("flush_views", func() { app.flushViewsPeriodically(cfg.stats.viewsFlushInterval) })
+		}
+		add("record_heartbeats", func() { app.recordHeartbeatsPeriodically(cfg.status.heartbeatInterval) })
+
+		// Keep an eye on the CPU, so that compression can be skipped while it's constrained.
+		if app.cpu != nil {
+			add("monitor_cpu", app.monitorCPUPeriodically)
+		}
+	}
+
+	if !runJobs {
+		return loops
+	}
+
+	// Deliver the emails queued in the outbox.
+	add("process_outbox", func() { app.processOutboxPeriodically(cfg.outbox.pollInterval) })
+
+	// Send the webhook deliveries, and purge the delivery log.
+	add("process_webhooks", func() { app.processWebhooksPeriodically(cfg.webhooks.pollInterval) })
+	add("purge_webhook_deliveries", func() { app.purgeWebhookDeliveriesPeriodically(cfg.webhooks.purgeInterval) })
+
+	// Email users about new movies which match their saved searches.
+	add("notify_saved_searches", func() { app.notifySavedSearchesPeriodically(cfg.savedSearches.notifyInterval) })
+
+	// Notify users when the movies they subscribed to are released.
+	add("watch_movie_releases", func() { app.watchMovieReleases(cfg.releases.notifyInterval) })
+
+	// Email the announcements to their subscribers once they start.
+	add("send_announcement_emails", func() { app.sendAnnouncementEmailsPeriodically(cfg.announcements.emailInterval) })
+
+	// Email the weekly digests to the users who've opted in.
+	add("send_digests", func() { app.sendDigestsPeriodically(cfg.digest.interval) })
+
+	// Generate and email scheduled exports when they are due.
+	add("run_scheduled_exports", func() { app.runScheduledExportsPeriodically(cfg.exports.checkInterval) })
+
+	// The task workers run the long-running operations (such as generating reports) queued by
+	// the API endpoints.
+	for i := 0; i < cfg.tasks.workers; i++ {
+		add("task_worker", func() { app.runTaskWorker(cfg.tasks.pollInterval) })
+	}
+
+	// Purge the deleted accounts whose grace period has passed, and the movies which have been
+	// in the trash for longer than the retention period.
+	add("purge_deleted_users", func() { app.purgeDeletedUsersPeriodically(cfg.accounts.purgeInterval) })
+	add("purge_deleted_movies", func() { app.purgeDeletedMoviesPeriodically(cfg.trash.purgeInterval) })
+
+	// Delete the email rate limits which have filled up again.
+	add("purge_email_limits", func() { app.purgeEmailLimitsPeriodically(cfg.limiter.emailPurgeInterval) })
+
+	// Delete the objects in storage which nothing refers to any more.
+	add("cleanup_storage", func() { app.cleanupStoragePeriodically(cfg.storage.cleanupInterval) })
+
+	// Give ULIDs to the movies which don't have one yet.
+	add("backfill_ulids", func() { app.backfillULIDs(time.Second) })
+
+	// Keep the materialized views behind the stats endpoints up to date.
+	add("refresh_stats", func() { app.refreshStatsPeriodically(cfg.stats.refreshInterval) })
+
+	// Measure the tables with a soft limit, and warn about any which are growing past it.
+	add("check_table_growth", func() { app.checkTableGrowthPeriodically(cfg.tableGrowth.interval) })
+
+	return loops
+}
+
+// startBackgroundLoops starts the goroutines returned by backgroundLoops(). In processes which
+// run the background jobs, it first starts the leader election, as only the leader runs the
+// singleton scheduled jobs. If leader election is disabled then this instance always runs them,
+// which is only safe when there's a single worker.
+func (app *application) startBackgroundLoops() {
+	if _, runJobs := processRoles(app.config.mode); runJobs {
+		if app.config.leader.enabled {
+			app.leaderLock = data.NewLeaderLock(app.models.System.DB, schedulerLockKey)
+			go app.electLeaderPeriodically(app.config.leader.checkInterval)
+		} else {
+			app.setLeader(true)
+		}
+	}
+
+	for _, loop := range app.backgroundLoops() {
+		go loop.run()
+	}
+}
+
+// runWorker is used in place of serve() by worker processes. It blocks until the process
+// receives a SIGINT or SIGTERM signal, and then waits for any background tasks to complete
+// before returning, in the same way as the graceful shutdown of the HTTP server.
+func (app *application) runWorker() error {
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+
+	app.logger.PrintInfo("starting worker", map[string]string{
+		"env": app.config.env,
+	})
+
+	s := <-quit
+
+	app.logger.PrintInfo("caught signal", map[string]string{
+		"signal": s.String(),
+	})
+
+	app.stepDown()
+
+	app.logger.PrintInfo("completing background tasks", nil)
+	app.wg.Wait()
+
+	app.logger.PrintInfo("stopped worker", nil)
+
+	return nil
+}
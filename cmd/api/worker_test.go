@@ -0,0 +1,97 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/codeaucafe/snippetbox/greenlight/internal/testutil"
+)
+
+// TestProcessModes tests that each -mode only serves HTTP requests and runs the background loops
+// that it should.
+func TestProcessModes(t *testing.T) {
+	tests := []struct {
+		mode          string
+		wantServeHTTP bool
+		wantLoops     []string
+		wantNotLoops  []string
+	}{
+		{
+			mode:          modeAPI,
+			wantServeHTTP: true,
+			wantLoops:     []string{"refresh_settings", "flush_views", "record_heartbeats"},
+			wantNotLoops:  []string{"process_outbox", "task_worker", "refresh_stats"},
+		},
+		{
+			mode:          modeWorker,
+			wantServeHTTP: false,
+			wantLoops:     []string{"refresh_settings", "process_outbox", "task_worker", "refresh_stats"},
+			wantNotLoops:  []string{"flush_views", "record_heartbeats"},
+		},
+		{
+			mode:          modeAll,
+			wantServeHTTP: true,
+			wantLoops:     []string{"refresh_settings", "flush_views", "record_heartbeats", "process_outbox", "task_worker"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			app := newTestApp()
+			app.config.mode = tt.mode
+			app.config.tasks.workers = 2
+			app.views = newViewCounter()
+
+			serveHTTP, runJobs := processRoles(tt.mode)
+			testutil.Equal(t, serveHTTP, tt.wantServeHTTP)
+			testutil.Equal(t, runJobs, tt.mode != modeAPI)
+
+			counts := map[string]int{}
+			for _, loop := range app.backgroundLoops() {
+				counts[loop.name]++
+			}
+
+			for _, name := range tt.wantLoops {
+				if counts[name] == 0 {
+					t.Errorf("want the %s loop to run", name)
+				}
+			}
+
+			for _, name := range tt.wantNotLoops {
+				if counts[name] != 0 {
+					t.Errorf("want the %s loop not to run", name)
+				}
+			}
+
+			if runJobs {
+				testutil.Equal(t, counts["task_worker"], 2)
+			}
+		})
+	}
+
+	// The loops for the optional parts of the API only run when those parts are set up.
+	app := newTestApp()
+	app.config.mode = modeAPI
+
+	for _, loop := range app.backgroundLoops() {
+		switch loop.name {
+		case "monitor_load", "flush_usage", "flush_views", "monitor_cpu":
+			t.Errorf("want the %s loop not to run", loop.name)
+		}
+	}
+}
+
+// TestInvalidMode tests that an unknown -mode is rejected by the config validation.
+func TestInvalidMode(t *testing.T) {
+	var cfg config
+	cfg.mode = "both"
+
+	err := validateConfig(cfg, configSources{})
+
+	var cfgErr *configError
+	if !errors.As(err, &cfgErr) {
+		t.Fatalf("got error %v; want a *configError", err)
+	}
+
+	testutil.StringContains(t, err.Error(), `mode (default): must be one of api, worker, all, got "both"`)
+}
@@ -0,0 +1,305 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/lib/pq"
+
+	"github.com/codeaucafe/snippetbox/greenlight/internal/storage"
+)
+
+// keyPrefix, filePrefix and fileExt are used to name backup objects, so that we can find our own
+// backups in the object store (and never prune anything else).
+const (
+	keyPrefix  = "backups/"
+	filePrefix = "greenlight-"
+	fileExt    = ".dump"
+)
+
+// ErrNotFound is returned by Restore when the named backup doesn't exist.
+var ErrNotFound = errors.New("backup not found")
+
+// File describes a backup kept in the object store. Name is the backup's name without the
+// "backups/" key prefix, which is what Restore takes.
+type File struct {
+	Name      string    `json:"name"`
+	Size      int64     `json:"size"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Store creates, lists and restores backups of a PostgreSQL database, using the pg_dump and
+// pg_restore tools, and keeps them in an object store under the "backups/" prefix. Only the most
+// recent Retention backups are kept (a Retention of 0 keeps them all).
+type Store struct {
+	DSN       string
+	Objects   storage.Store
+	Retention int
+}
+
+// Backup streams a new backup of the database into the object store, using the pg_dump custom
+// format, and then prunes old backups according to the retention setting. It returns the
+// details of the new backup.
+func (s Store) Backup(ctx context.Context) (*File, error) {
+	name := filePrefix + time.Now().UTC().Format("20060102T150405Z") + fileExt
+
+	// The dump is piped straight into the store, rather than written to a local file first. If
+	// pg_dump fails then so does the upload, and the store never makes a partial object visible,
+	// so a failed backup never looks like a complete one.
+	pr, pw := io.Pipe()
+
+	go func() {
+		env, err := dsnEnv(s.DSN)
+		if err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+
+		pw.CloseWithError(run(ctx, env, nil, pw, "pg_dump", "--format=custom", "--no-owner"))
+	}()
+
+	object, err := s.Objects.Put(ctx, keyPrefix+name, pr, "application/octet-stream")
+
+	// If the store gave up before reading everything, this stops pg_dump from blocking forever.
+	pr.CloseWithError(err)
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.prune(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return &File{Name: name, Size: object.Size, CreatedAt: object.ModTime}, nil
+}
+
+// Restore restores the database from a backup. The backup can be given as the name of a backup in
+// the object store or as a path to a local file. Existing objects are dropped and recreated, so
+// this replaces the current contents of the database.
+func (s Store) Restore(ctx context.Context, backup string) error {
+	var r io.ReadCloser
+
+	if strings.ContainsRune(backup, os.PathSeparator) {
+		f, err := os.Open(backup)
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				return ErrNotFound
+			}
+			return err
+		}
+
+		r = f
+	} else {
+		body, _, err := s.Objects.Get(ctx, keyPrefix+backup)
+		if err != nil {
+			if errors.Is(err, storage.ErrNotFound) || errors.Is(err, storage.ErrInvalidKey) {
+				return ErrNotFound
+			}
+			return err
+		}
+
+		r = body
+	}
+
+	defer r.Close()
+
+	env, err := dsnEnv(s.DSN)
+	if err != nil {
+		return err
+	}
+
+	// Without a file name, pg_restore reads the backup from its standard input. It connects to
+	// the database named in the environment, as --dbname is only needed to restore elsewhere.
+	return run(ctx, env, r, nil, "pg_restore", "--clean", "--if-exists", "--no-owner", "--single-transaction")
+}
+
+// List returns the backups in the object store, newest first.
+func (s Store) List(ctx context.Context) ([]*File, error) {
+	objects, err := s.Objects.List(ctx, keyPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	files := []*File{}
+
+	for _, object := range objects {
+		name := strings.TrimPrefix(object.Key, keyPrefix)
+		if strings.Contains(name, "/") || !strings.HasPrefix(name, filePrefix) || !strings.HasSuffix(name, fileExt) {
+			continue
+		}
+
+		files = append(files, &File{Name: name, Size: object.Size, CreatedAt: object.ModTime})
+	}
+
+	// The names contain the UTC timestamp of the backup, so sorting them in reverse gives us the
+	// newest first.
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Name > files[j].Name
+	})
+
+	return files, nil
+}
+
+// prune removes all but the newest Retention backups.
+func (s Store) prune(ctx context.Context) error {
+	if s.Retention <= 0 {
+		return nil
+	}
+
+	files, err := s.List(ctx)
+	if err != nil {
+		return err
+	}
+
+	for i := s.Retention; i < len(files); i++ {
+		err := s.Objects.Delete(ctx, keyPrefix+files[i].Name)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// run runs an external command with the given extra environment variables and standard input
+// and output (either of which can be nil), including its stderr output in the error if it fails.
+// It's a variable so that tests can replace it.
+var run = func(ctx context.Context, env []string, stdin io.Reader, stdout io.Writer, name string, args ...string) error {
+	var stderr bytes.Buffer
+
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Env = append(os.Environ(), env...)
+	cmd.Stdin = stdin
+	cmd.Stdout = stdout
+	cmd.Stderr = &stderr
+
+	err := cmd.Run()
+	if err != nil {
+		return fmt.Errorf("%s: %w: %s", name, err, strings.TrimSpace(stderr.String()))
+	}
+
+	return nil
+}
+
+// dsnEnvVars maps the connection parameters in a DSN to the environment variables which libpq
+// reads them from.
+var dsnEnvVars = map[string]string{
+	"host":                 "PGHOST",
+	"hostaddr":             "PGHOSTADDR",
+	"port":                 "PGPORT",
+	"dbname":               "PGDATABASE",
+	"user":                 "PGUSER",
+	"password":             "PGPASSWORD",
+	"passfile":             "PGPASSFILE",
+	"connect_timeout":      "PGCONNECT_TIMEOUT",
+	"application_name":     "PGAPPNAME",
+	"sslmode":              "PGSSLMODE",
+	"sslcert":              "PGSSLCERT",
+	"sslkey":               "PGSSLKEY",
+	"sslrootcert":          "PGSSLROOTCERT",
+	"sslcrl":               "PGSSLCRL",
+	"target_session_attrs": "PGTARGETSESSIONATTRS",
+}
+
+// dsnEnv converts a DSN, in either the URL or the key=value form, to the environment variables
+// for pg_dump and pg_restore. Passing the connection parameters in the environment rather than
+// with --dbname keeps the password out of the command line, where any user on the host could
+// read it with ps.
+func dsnEnv(dsn string) ([]string, error) {
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		var err error
+
+		dsn, err = pq.ParseURL(dsn)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	params, err := parseDSN(dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	env := make([]string, 0, len(params))
+
+	for _, param := range params {
+		name, ok := dsnEnvVars[param[0]]
+		if !ok {
+			return nil, fmt.Errorf("unsupported connection parameter %q", param[0])
+		}
+
+		env = append(env, name+"="+param[1])
+	}
+
+	return env, nil
+}
+
+// parseDSN splits a key=value DSN into its key and value pairs, in order. Values can be quoted
+// with single quotes, and backslash escapes a quote or backslash, in the same way as for libpq.
+func parseDSN(dsn string) ([][2]string, error) {
+	var params [][2]string
+
+	r := []rune(dsn)
+
+	skipSpace := func(i int) int {
+		for i < len(r) && unicode.IsSpace(r[i]) {
+			i++
+		}
+		return i
+	}
+
+	for i := skipSpace(0); i < len(r); i = skipSpace(i) {
+		start := i
+		for i < len(r) && r[i] != '=' && !unicode.IsSpace(r[i]) {
+			i++
+		}
+		key := string(r[start:i])
+
+		i = skipSpace(i)
+		if key == "" || i == len(r) || r[i] != '=' {
+			return nil, fmt.Errorf("missing \"=\" after %q in connection string", key)
+		}
+		i = skipSpace(i + 1)
+
+		var value strings.Builder
+
+		quoted := i < len(r) && r[i] == '\''
+		if quoted {
+			i++
+		}
+
+		for ; i < len(r); i++ {
+			if quoted && r[i] == '\'' {
+				quoted = false
+				i++
+				break
+			}
+			if !quoted && unicode.IsSpace(r[i]) {
+				break
+			}
+			if r[i] == '\\' && i+1 < len(r) {
+				i++
+			}
+			value.WriteRune(r[i])
+		}
+
+		if quoted {
+			return nil, errors.New("unterminated quoted string in connection string")
+		}
+
+		params = append(params, [2]string{key, value.String()})
+	}
+
+	return params, nil
+}
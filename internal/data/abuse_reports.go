@@ -0,0 +1,375 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/codeaucafe/snippetbox/greenlight/internal/validator"
+	"github.com/lib/pq"
+)
+
+// ErrDuplicateAbuseReport is returned when a user tries to report a review which they have
+// already reported.
+var ErrDuplicateAbuseReport = errors.New("duplicate abuse report")
+
+// Statuses of an abuse report. A report is open until a moderator resolves it (the report was
+// justified and they've dealt with the review) or dismisses it (the review is fine).
+const (
+	AbuseReportStatusOpen      = "open"
+	AbuseReportStatusResolved  = "resolved"
+	AbuseReportStatusDismissed = "dismissed"
+)
+
+// AbuseReportStatuses holds the statuses which an abuse report can have.
+var AbuseReportStatuses = []string{AbuseReportStatusOpen, AbuseReportStatusResolved, AbuseReportStatusDismissed}
+
+// AbuseReportReasons holds the reasons which a user can give for reporting a review.
+var AbuseReportReasons = []string{"spam", "offensive", "spoilers", "other"}
+
+// AbuseReport represents a user's report that a review breaks the rules. Review is only filled in
+// when the reports are listed for moderators.
+type AbuseReport struct {
+	ID             int64      `json:"id"`
+	CreatedAt      time.Time  `json:"created_at"`
+	UpdatedAt      time.Time  `json:"updated_at"`
+	ReviewID       int64      `json:"review_id"`
+	UserID         int64      `json:"user_id"`
+	Reason         string     `json:"reason"`
+	Details        string     `json:"details,omitempty"`
+	Status         string     `json:"status"`
+	ResolutionNote string     `json:"resolution_note,omitempty"`
+	ResolvedBy     *int64     `json:"resolved_by,omitempty"`
+	ResolvedAt     *time.Time `json:"resolved_at,omitempty"`
+	Review         *Review    `json:"review,omitempty"`
+}
+
+// AbuseReportModel struct wraps a sql.DB connection pool and allows us to work with the
+// AbuseReport struct type and the abuse_reports table in our database.
+type AbuseReportModel struct {
+	DB       *sql.DB
+	InfoLog  *log.Logger
+	ErrorLog *log.Logger
+}
+
+// abuseReportColumns are the columns selected for an abuse report, in the order of the
+// destinations returned by abuseReportDest.
+const abuseReportColumns = `id, created_at, updated_at, review_id, user_id, reason, details, status,
+	resolution_note, resolved_by, resolved_at`
+
+// abuseReportDest returns the scan destinations for abuseReportColumns.
+func abuseReportDest(report *AbuseReport) []interface{} {
+	return []interface{}{
+		&report.ID,
+		&report.CreatedAt,
+		&report.UpdatedAt,
+		&report.ReviewID,
+		&report.UserID,
+		&report.Reason,
+		&report.Details,
+		&report.Status,
+		&report.ResolutionNote,
+		&report.ResolvedBy,
+		&report.ResolvedAt,
+	}
+}
+
+// Insert adds a new abuse report. If it's the only open report of the review, email is called to
+// build an email for each activated moderator (each user with the "reviews:moderate"
+// permission), and the emails are added to the outbox in the same transaction, so that
+// moderators are told about a reported review once rather than for every report of it. Two
+// reports made at the same moment may both notify the moderators, but a report is never missed.
+// ErrDuplicateAbuseReport is returned if the user has already reported the review, and
+// ErrRecordNotFound if the review doesn't exist.
+func (m AbuseReportModel) Insert(ctx context.Context, report *AbuseReport, email func(recipient string) *OutboxEmail) error {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	query := `
+		INSERT INTO abuse_reports (review_id, user_id, reason, details)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id, created_at, updated_at, status
+		`
+
+	args := []interface{}{report.ReviewID, report.UserID, report.Reason, report.Details}
+
+	err = tx.QueryRowContext(ctx, query, args...).Scan(&report.ID, &report.CreatedAt, &report.UpdatedAt,
+		&report.Status)
+	if err != nil {
+		switch {
+		case err.Error() == `pq: duplicate key value violates unique constraint "abuse_reports_review_id_user_id_key"`:
+			return ErrDuplicateAbuseReport
+		case err.Error() == `pq: insert or update on table "abuse_reports" violates foreign key constraint "abuse_reports_review_id_fkey"`:
+			return ErrRecordNotFound
+		default:
+			return err
+		}
+	}
+
+	err = newAudit(AuditCreate, "abuse_reports").record(ctx, tx, report.ID)
+	if err != nil {
+		return err
+	}
+
+	var open int
+
+	query = `
+		SELECT count(*)
+		FROM abuse_reports
+		WHERE review_id = $1 AND status = $2
+		`
+
+	err = tx.QueryRowContext(ctx, query, report.ReviewID, AbuseReportStatusOpen).Scan(&open)
+	if err != nil {
+		return err
+	}
+
+	if open == 1 && email != nil {
+		recipients, err := m.moderatorEmails(ctx, tx)
+		if err != nil {
+			return err
+		}
+
+		for _, recipient := range recipients {
+			err = insertOutboxMessage(ctx, tx, OutboxKindEmail, email(recipient))
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return tx.Commit()
+}
+
+// moderatorEmails returns the email addresses of the activated users who can moderate reviews.
+func (m AbuseReportModel) moderatorEmails(ctx context.Context, tx *sql.Tx) ([]string, error) {
+	query := `
+		SELECT users.email
+		FROM users
+		INNER JOIN users_permissions ON users_permissions.user_id = users.id
+		INNER JOIN permissions ON permissions.id = users_permissions.permission_id
+		WHERE permissions.code = 'reviews:moderate' AND users.activated AND users.deleted_at IS NULL
+		ORDER BY users.id
+		`
+
+	rows, err := tx.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			m.ErrorLog.Println(err)
+		}
+	}()
+
+	var emails []string
+
+	for rows.Next() {
+		var email string
+
+		err := rows.Scan(&email)
+		if err != nil {
+			return nil, err
+		}
+
+		emails = append(emails, email)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return emails, nil
+}
+
+// Get returns an abuse report by its ID. ErrRecordNotFound is returned if it doesn't exist.
+func (m AbuseReportModel) Get(ctx context.Context, id int64) (*AbuseReport, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := fmt.Sprintf(`
+		SELECT %s
+		FROM abuse_reports
+		WHERE id = $1`,
+		abuseReportColumns)
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	var report AbuseReport
+
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(abuseReportDest(&report)...)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &report, nil
+}
+
+// GetAll returns a page of the abuse reports with the given status, sorted according to the
+// filters, along with the review each one is about.
+func (m AbuseReportModel) GetAll(ctx context.Context, status string, filters Filters) ([]*AbuseReport, Metadata, error) {
+	// The review columns come from a subquery, so that they don't clash with the report's.
+	query := fmt.Sprintf(`
+		SELECT count(*) OVER(), a.*, r.*
+		FROM (SELECT %s FROM abuse_reports WHERE status = $1) a
+		INNER JOIN (SELECT %s FROM reviews) r ON r.id = a.review_id
+		ORDER BY a.%s %s, a.id ASC
+		LIMIT $2 OFFSET $3`,
+		abuseReportColumns, reviewColumns, filters.sortColumn(), filters.sortDirection())
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, status, filters.limit(), filters.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			m.ErrorLog.Println(err)
+		}
+	}()
+
+	totalRecords := 0
+	reports := []*AbuseReport{}
+
+	for rows.Next() {
+		var report AbuseReport
+
+		dest := append([]interface{}{&totalRecords}, abuseReportDest(&report)...)
+
+		report.Review, err = scanReview(rows, dest...)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		reports = append(reports, &report)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	return reports, calculateMetadata(totalRecords, filters.Page, filters.PageSize), nil
+}
+
+// Resolve closes an open abuse report with the report's status (resolved or dismissed) and
+// resolution note, recording the moderator who closed it. The other open reports of the same
+// review are closed along with it, since the moderator has dealt with the review, and each one
+// is recorded in the audit log. It returns the number of reports closed. ErrEditConflict is
+// returned if the report isn't open any more.
+func (m AbuseReportModel) Resolve(ctx context.Context, report *AbuseReport, moderatorID int64) (int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	// Lock the open reports of the review, so that they can be snapshotted for the audit log
+	// before they're closed.
+	query := `
+		SELECT id
+		FROM abuse_reports
+		WHERE review_id = $1 AND status = $2
+		ORDER BY id
+		FOR UPDATE
+		`
+
+	rows, err := tx.QueryContext(ctx, query, report.ReviewID, AbuseReportStatusOpen)
+	if err != nil {
+		return 0, err
+	}
+
+	var ids []int64
+	open := false
+
+	for rows.Next() {
+		var id int64
+
+		err := rows.Scan(&id)
+		if err != nil {
+			_ = rows.Close()
+			return 0, err
+		}
+
+		ids = append(ids, id)
+		open = open || id == report.ID
+	}
+
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+
+	if !open {
+		return 0, ErrEditConflict
+	}
+
+	changes := make([]*audit, len(ids))
+
+	for i, id := range ids {
+		changes[i] = newAudit(AuditUpdate, "abuse_reports")
+
+		err = changes[i].before(ctx, tx, id)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	query = `
+		UPDATE abuse_reports
+		SET status = $1, resolution_note = $2, resolved_by = $3, resolved_at = NOW(), updated_at = NOW()
+		WHERE id = ANY($4)
+		`
+
+	_, err = tx.ExecContext(ctx, query, report.Status, report.ResolutionNote, moderatorID, pq.Array(ids))
+	if err != nil {
+		return 0, err
+	}
+
+	for i, id := range ids {
+		err = changes[i].record(ctx, tx, id)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return 0, err
+	}
+
+	return int64(len(ids)), nil
+}
+
+// ValidateAbuseReport runs validation checks on the AbuseReport type.
+func ValidateAbuseReport(v *validator.Validator, report *AbuseReport) {
+	v.Check(validator.In(report.Reason, AbuseReportReasons...), "reason",
+		"must be one of spam, offensive, spoilers or other")
+	v.Check(report.Reason != "other" || report.Details != "", "details", "must be provided when the reason is other")
+	v.Check(len(report.Details) <= 1000, "details", "must not be more than 1000 bytes long")
+}
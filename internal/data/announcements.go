@@ -0,0 +1,375 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/codeaucafe/snippetbox/greenlight/internal/validator"
+	"github.com/lib/pq"
+)
+
+// AnnouncementSeverities holds the severities which an announcement can have, from least to most
+// severe.
+var AnnouncementSeverities = []string{"info", "warning", "critical"}
+
+// Announcement represents a message broadcast by an admin to the users of the API, such as
+// notice of planned maintenance. It's shown from StartsAt until EndsAt, or indefinitely if EndsAt
+// is nil. If Email is true, it's also emailed to the subscribers once it starts (see SendEmails).
+type Announcement struct {
+	ID        int64      `json:"id"`
+	CreatedAt time.Time  `json:"created_at"`
+	CreatedBy *int64     `json:"created_by,omitempty"`
+	Title     string     `json:"title"`
+	Body      string     `json:"body"`
+	Severity  string     `json:"severity"`
+	StartsAt  time.Time  `json:"starts_at"`
+	EndsAt    *time.Time `json:"ends_at,omitempty"`
+	Email     bool       `json:"email"`
+}
+
+// AnnouncementModel struct wraps a sql.DB connection pool and allows us to work with the
+// Announcement struct type and the announcements and announcement_subscriptions tables in our
+// database.
+type AnnouncementModel struct {
+	DB       *sql.DB
+	InfoLog  *log.Logger
+	ErrorLog *log.Logger
+}
+
+// Insert adds a new announcement, and records it in the audit log. The emails to the subscribers
+// aren't queued here, but by SendEmails once the announcement starts.
+func (m AnnouncementModel) Insert(ctx context.Context, announcement *Announcement) error {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	query := `
+		INSERT INTO announcements (created_by, title, body, severity, starts_at, ends_at, email)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING id, created_at
+		`
+
+	args := []interface{}{
+		announcement.CreatedBy,
+		announcement.Title,
+		announcement.Body,
+		announcement.Severity,
+		announcement.StartsAt,
+		announcement.EndsAt,
+		announcement.Email,
+	}
+
+	err = tx.QueryRowContext(ctx, query, args...).Scan(&announcement.ID, &announcement.CreatedAt)
+	if err != nil {
+		return err
+	}
+
+	err = newAudit(AuditCreate, "announcements").record(ctx, tx, announcement.ID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// SendEmails queues the emails for the next batch of up to limit subscribers of an announcement
+// which has started and still has subscribers to email. email is called to build the email for
+// each subscriber, and the emails are added to the outbox in the same transaction as the
+// announcement's progress is saved, so that each subscriber is emailed once. Announcements which
+// ended before they could be emailed are marked as done without sending anything. It returns
+// false if there were no announcements left to email.
+//
+// The announcement is locked with SKIP LOCKED, so that concurrent callers work on different
+// announcements rather than waiting for each other.
+func (m AnnouncementModel) SendEmails(ctx context.Context, now time.Time, limit int, email func(announcement *Announcement, recipient string) *OutboxEmail) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	query := `
+		SELECT id, created_at, created_by, title, body, severity, starts_at, ends_at, email, emailed_through
+		FROM announcements
+		WHERE email AND emailed_at IS NULL AND starts_at <= $1
+		ORDER BY starts_at, id
+		LIMIT 1
+		FOR UPDATE SKIP LOCKED
+		`
+
+	var (
+		announcement Announcement
+		after        int64
+	)
+
+	err = tx.QueryRowContext(ctx, query, now).Scan(
+		&announcement.ID,
+		&announcement.CreatedAt,
+		&announcement.CreatedBy,
+		&announcement.Title,
+		&announcement.Body,
+		&announcement.Severity,
+		&announcement.StartsAt,
+		&announcement.EndsAt,
+		&announcement.Email,
+		&after,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return false, nil
+		default:
+			return false, err
+		}
+	}
+
+	var recipients []announcementRecipient
+
+	if announcement.EndsAt == nil || announcement.EndsAt.After(now) {
+		recipients, err = m.subscribers(ctx, tx, after, limit)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	for _, recipient := range recipients {
+		err = insertOutboxMessage(ctx, tx, OutboxKindEmail, email(&announcement, recipient.email))
+		if err != nil {
+			return false, err
+		}
+
+		after = recipient.userID
+	}
+
+	// The announcement is done once a batch comes back short.
+	var emailedAt *time.Time
+	if len(recipients) < limit {
+		emailedAt = &now
+	}
+
+	query = `
+		UPDATE announcements
+		SET emailed_through = $1, emailed_at = $2
+		WHERE id = $3
+		`
+
+	_, err = tx.ExecContext(ctx, query, after, emailedAt, announcement.ID)
+	if err != nil {
+		return false, err
+	}
+
+	return true, tx.Commit()
+}
+
+// announcementRecipient is a subscriber to be emailed an announcement.
+type announcementRecipient struct {
+	userID int64
+	email  string
+}
+
+// subscribers returns up to limit of the activated users who have subscribed to announcements,
+// in order of ID, starting after the user with the given ID.
+func (m AnnouncementModel) subscribers(ctx context.Context, tx *sql.Tx, after int64, limit int) ([]announcementRecipient, error) {
+	query := `
+		SELECT users.id, users.email
+		FROM announcement_subscriptions
+		INNER JOIN users ON users.id = announcement_subscriptions.user_id
+		WHERE users.activated AND users.deleted_at IS NULL AND users.id > $1
+		ORDER BY users.id
+		LIMIT $2
+		`
+
+	rows, err := tx.QueryContext(ctx, query, after, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			m.ErrorLog.Println(err)
+		}
+	}()
+
+	var recipients []announcementRecipient
+
+	for rows.Next() {
+		var recipient announcementRecipient
+
+		err := rows.Scan(&recipient.userID, &recipient.email)
+		if err != nil {
+			return nil, err
+		}
+
+		recipients = append(recipients, recipient)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return recipients, nil
+}
+
+// GetActive returns the announcements which are showing at the given time, most severe first and
+// then newest first.
+func (m AnnouncementModel) GetActive(ctx context.Context, now time.Time) ([]*Announcement, error) {
+	query := `
+		SELECT id, created_at, created_by, title, body, severity, starts_at, ends_at, email
+		FROM announcements
+		WHERE starts_at <= $1 AND (ends_at IS NULL OR ends_at > $1)
+		ORDER BY array_position($2, severity) DESC, starts_at DESC, id DESC
+		`
+
+	return m.query(ctx, query, now, pq.Array(AnnouncementSeverities))
+}
+
+// GetAll returns every announcement, including those which have ended or haven't started yet,
+// newest first.
+func (m AnnouncementModel) GetAll(ctx context.Context) ([]*Announcement, error) {
+	query := `
+		SELECT id, created_at, created_by, title, body, severity, starts_at, ends_at, email
+		FROM announcements
+		ORDER BY starts_at DESC, id DESC
+		`
+
+	return m.query(ctx, query)
+}
+
+// query runs a query which returns announcements rows.
+func (m AnnouncementModel) query(ctx context.Context, query string, args ...interface{}) ([]*Announcement, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			m.ErrorLog.Println(err)
+		}
+	}()
+
+	announcements := []*Announcement{}
+
+	for rows.Next() {
+		var announcement Announcement
+
+		err := rows.Scan(
+			&announcement.ID,
+			&announcement.CreatedAt,
+			&announcement.CreatedBy,
+			&announcement.Title,
+			&announcement.Body,
+			&announcement.Severity,
+			&announcement.StartsAt,
+			&announcement.EndsAt,
+			&announcement.Email,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		announcements = append(announcements, &announcement)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return announcements, nil
+}
+
+// Delete removes an announcement, and records the deletion in the audit log. ErrRecordNotFound
+// is returned if it doesn't exist.
+func (m AnnouncementModel) Delete(ctx context.Context, id int64) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+
+	query := `
+		DELETE FROM announcements
+		WHERE id = $1
+		`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	return withAudit(ctx, m.DB, AuditDelete, "announcements", id, func(tx *sql.Tx) (int64, error) {
+		result, err := tx.ExecContext(ctx, query, id)
+		if err != nil {
+			return 0, err
+		}
+
+		rowsAffected, err := result.RowsAffected()
+		if err != nil {
+			return 0, err
+		}
+
+		if rowsAffected == 0 {
+			return 0, ErrRecordNotFound
+		}
+
+		return id, nil
+	})
+}
+
+// Subscribe opts a user in to receiving announcements by email. Subscribing again has no effect.
+func (m AnnouncementModel) Subscribe(ctx context.Context, userID int64) error {
+	query := `
+		INSERT INTO announcement_subscriptions (user_id)
+		VALUES ($1)
+		ON CONFLICT (user_id) DO NOTHING
+		`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, userID)
+	return err
+}
+
+// Unsubscribe opts a user out of receiving announcements by email.
+func (m AnnouncementModel) Unsubscribe(ctx context.Context, userID int64) error {
+	query := `
+		DELETE FROM announcement_subscriptions
+		WHERE user_id = $1
+		`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, userID)
+	return err
+}
+
+// ValidateAnnouncement runs validation checks on the Announcement type.
+func ValidateAnnouncement(v *validator.Validator, announcement *Announcement) {
+	v.Check(announcement.Title != "", "title", "must be provided")
+	v.Check(len(announcement.Title) <= 200, "title", "must not be more than 200 bytes long")
+
+	v.Check(announcement.Body != "", "body", "must be provided")
+	v.Check(len(announcement.Body) <= 5000, "body", "must not be more than 5000 bytes long")
+
+	v.Check(validator.In(announcement.Severity, AnnouncementSeverities...), "severity",
+		"must be one of info, warning or critical")
+
+	v.Check(announcement.EndsAt == nil || announcement.EndsAt.After(announcement.StartsAt), "ends_at",
+		"must be after starts_at")
+}
@@ -0,0 +1,299 @@
+package data
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base32"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/codeaucafe/snippetbox/greenlight/internal/validator"
+	"github.com/lib/pq"
+)
+
+var (
+	// ErrTooManyAPIKeys is returned when a user who already has MaxAPIKeysPerUser API keys tries
+	// to create another.
+	ErrTooManyAPIKeys = errors.New("too many api keys")
+	// ErrReplayedNonce is returned when a signed request uses a nonce which has already been used
+	// with the same API key.
+	ErrReplayedNonce = errors.New("replayed nonce")
+)
+
+// MaxAPIKeysPerUser is the number of API keys each user can have at once. The limit is enforced
+// by the api_keys_per_user_limit trigger, so this has to match the migration which creates it.
+const MaxAPIKeysPerUser = 10
+
+// APIKey represents a key which a machine client uses to sign its requests. The key ID is public
+// and is sent with each request, and the secret is only shown when the key is created. Secrets
+// aren't stored: each one is derived from the key ID with the server's signing secret, and only
+// its hash is kept.
+type APIKey struct {
+	ID         int64      `json:"id"`
+	CreatedAt  time.Time  `json:"created_at"`
+	UserID     int64      `json:"-"`
+	Name       string     `json:"name"`
+	KeyID      string     `json:"key_id"`
+	Secret     string     `json:"-"`
+	SecretHash []byte     `json:"-"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+}
+
+// APIKeyModel struct wraps a sql.DB connection pool and allows us to work with the APIKey struct
+// type and the api_keys table in our database.
+type APIKeyModel struct {
+	DB       *sql.DB
+	InfoLog  *log.Logger
+	ErrorLog *log.Logger
+}
+
+// randomKeyString returns a random base-32 string made from n random bytes, in the same way as
+// the plaintext of a token.
+func randomKeyString(n int) (string, error) {
+	b := make([]byte, n)
+
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+
+	return base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(b), nil
+}
+
+// apiKeySecret returns the secret of the API key with the given key ID, which is the HMAC-SHA256
+// of the key ID with the server's signing secret. Changing the signing secret changes every
+// key's secret, so all of the existing keys stop working.
+func apiKeySecret(signingSecret, keyID string) string {
+	mac := hmac.New(sha256.New, []byte(signingSecret))
+	mac.Write([]byte(keyID))
+
+	return base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(mac.Sum(nil))
+}
+
+// Insert generates the key ID of a new API key, derives its secret with signingSecret, and adds
+// it. Only the hash of the secret is stored. ErrTooManyAPIKeys is returned if the user already
+// has MaxAPIKeysPerUser keys. The key is recorded in the audit log, without its secret.
+func (m APIKeyModel) Insert(ctx context.Context, key *APIKey, signingSecret string) error {
+	keyID, err := randomKeyString(10)
+	if err != nil {
+		return err
+	}
+
+	key.KeyID = "gk_" + keyID
+	key.Secret = apiKeySecret(signingSecret, key.KeyID)
+
+	hash := sha256.Sum256([]byte(key.Secret))
+	key.SecretHash = hash[:]
+
+	query := `
+		INSERT INTO api_keys (user_id, name, key_id, secret_hash)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id, created_at
+		`
+
+	args := []interface{}{key.UserID, key.Name, key.KeyID, key.SecretHash}
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	err = withAudit(ctx, m.DB, AuditCreate, "api_keys", 0, func(tx *sql.Tx) (int64, error) {
+		err := tx.QueryRowContext(ctx, query, args...).Scan(&key.ID, &key.CreatedAt)
+		return key.ID, err
+	})
+	if err != nil {
+		var pqErr *pq.Error
+
+		switch {
+		case errors.As(err, &pqErr) && pqErr.Constraint == "api_keys_per_user_limit":
+			return ErrTooManyAPIKeys
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
+
+// GetAllForUser returns all of a user's API keys, oldest first. The secrets aren't included.
+func (m APIKeyModel) GetAllForUser(ctx context.Context, userID int64) ([]*APIKey, error) {
+	query := `
+		SELECT id, created_at, user_id, name, key_id, last_used_at
+		FROM api_keys
+		WHERE user_id = $1
+		ORDER BY id
+		`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			m.ErrorLog.Println(err)
+		}
+	}()
+
+	keys := []*APIKey{}
+
+	for rows.Next() {
+		var key APIKey
+
+		err := rows.Scan(&key.ID, &key.CreatedAt, &key.UserID, &key.Name, &key.KeyID, &key.LastUsedAt)
+		if err != nil {
+			return nil, err
+		}
+
+		keys = append(keys, &key)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+// GetForKeyID returns the API key with the given key ID, including its secret, which is derived
+// again with signingSecret, so that a signed request can be checked. ErrRecordNotFound is
+// returned if there isn't one, or if the key was created with a different signing secret.
+func (m APIKeyModel) GetForKeyID(ctx context.Context, keyID, signingSecret string) (*APIKey, error) {
+	query := `
+		SELECT id, created_at, user_id, name, key_id, secret_hash, last_used_at
+		FROM api_keys
+		WHERE key_id = $1
+		`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	var key APIKey
+
+	err := m.DB.QueryRowContext(ctx, query, keyID).Scan(&key.ID, &key.CreatedAt, &key.UserID, &key.Name,
+		&key.KeyID, &key.SecretHash, &key.LastUsedAt)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	key.Secret = apiKeySecret(signingSecret, key.KeyID)
+
+	hash := sha256.Sum256([]byte(key.Secret))
+	if subtle.ConstantTimeCompare(hash[:], key.SecretHash) != 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	return &key, nil
+}
+
+// UseNonce records that a signed request made with the API key used the given nonce, and when the
+// key was last used. The nonce is kept until expiresAt, which should be after the request's
+// timestamp stops being accepted, and ErrReplayedNonce is returned if it's already been used.
+// The key's expired nonces are removed at the same time.
+func (m APIKeyModel) UseNonce(ctx context.Context, key *APIKey, nonce string, now, expiresAt time.Time) error {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	query := `
+		DELETE FROM api_key_nonces
+		WHERE api_key_id = $1 AND expires_at <= $2
+		`
+
+	_, err = tx.ExecContext(ctx, query, key.ID, now)
+	if err != nil {
+		return err
+	}
+
+	query = `
+		INSERT INTO api_key_nonces (api_key_id, nonce, expires_at)
+		VALUES ($1, $2, $3)
+		ON CONFLICT DO NOTHING
+		`
+
+	result, err := tx.ExecContext(ctx, query, key.ID, nonce, expiresAt)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrReplayedNonce
+	}
+
+	query = `
+		UPDATE api_keys
+		SET last_used_at = $1
+		WHERE id = $2
+		`
+
+	_, err = tx.ExecContext(ctx, query, now, key.ID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Delete removes a specific API key belonging to a user, after which requests signed with it are
+// rejected. The deletion is recorded in the audit log.
+func (m APIKeyModel) Delete(ctx context.Context, id, userID int64) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+
+	query := `
+		DELETE FROM api_keys
+		WHERE id = $1 AND user_id = $2
+		`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	return withAudit(ctx, m.DB, AuditDelete, "api_keys", id, func(tx *sql.Tx) (int64, error) {
+		result, err := tx.ExecContext(ctx, query, id, userID)
+		if err != nil {
+			return 0, err
+		}
+
+		rowsAffected, err := result.RowsAffected()
+		if err != nil {
+			return 0, err
+		}
+
+		if rowsAffected == 0 {
+			return 0, ErrRecordNotFound
+		}
+
+		return id, nil
+	})
+}
+
+// ValidateAPIKey runs validation checks on the APIKey type.
+func ValidateAPIKey(v *validator.Validator, key *APIKey) {
+	v.Check(key.Name != "", "name", "must be provided")
+	v.Check(len(key.Name) <= 100, "name", "must not be more than 100 bytes long")
+}
@@ -0,0 +1,338 @@
+package data
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/codeaucafe/snippetbox/greenlight/internal/validator"
+)
+
+// Audit log actions.
+const (
+	AuditCreate  = "create"
+	AuditUpdate  = "update"
+	AuditDelete  = "delete"
+	AuditRestore = "restore"
+	// AuditPurge is recorded when a soft-deleted resource is removed for good once its retention
+	// period has passed. There's no user behind it, and its changes are empty, as the resource's
+	// last state was recorded when it was deleted.
+	AuditPurge = "purge"
+)
+
+// auditSnapshots holds the resource types which are audited, and for each one the query which
+// snapshots a resource as a JSON object, given its ID. Every write to these resources through
+// the models is recorded in the audit log, with the difference between the snapshots taken
+// before and after it. Secrets are left out of the snapshots: the users password hash is
+// replaced with a fingerprint, so that a password change still shows up, and API key and
+// webhook secrets are dropped. Bookkeeping tables which the application writes to on its own
+// account (such as tokens, the outbox, webhook deliveries and usage statistics) aren't audited.
+var auditSnapshots = map[string]string{
+	"movies":         `SELECT to_jsonb(movies) || jsonb_build_object('genres', ` + movieGenres + `) FROM movies WHERE id = $1`,
+	"credits":        `SELECT jsonb_build_object('credits', COALESCE(jsonb_agg(to_jsonb(credits) - 'id' - 'movie_id' ORDER BY role, billing, person_id), '[]')) FROM credits WHERE movie_id = $1`,
+	"reviews":        `SELECT to_jsonb(reviews) FROM reviews WHERE id = $1`,
+	"people":         `SELECT to_jsonb(people) FROM people WHERE id = $1`,
+	"users":          `SELECT to_jsonb(users) - 'password_hash' || jsonb_build_object('password', md5(password_hash)) FROM users WHERE id = $1`,
+	"permissions":    `SELECT jsonb_build_object('permissions', ARRAY(SELECT p.code FROM users_permissions up INNER JOIN permissions p ON p.id = up.permission_id WHERE up.user_id = $1 ORDER BY p.code))`,
+	"settings":       `SELECT to_jsonb(runtime_settings) FROM runtime_settings WHERE id = $1`,
+	"announcements":  `SELECT to_jsonb(announcements) FROM announcements WHERE id = $1`,
+	"api_keys":       `SELECT to_jsonb(api_keys) - 'secret' FROM api_keys WHERE id = $1`,
+	"abuse_reports":  `SELECT to_jsonb(abuse_reports) FROM abuse_reports WHERE id = $1`,
+	"saved_searches": `SELECT to_jsonb(saved_searches) FROM saved_searches WHERE id = $1`,
+	"exports":        `SELECT to_jsonb(scheduled_exports) FROM scheduled_exports WHERE id = $1`,
+	"incidents":      `SELECT to_jsonb(incidents) FROM incidents WHERE id = $1`,
+	"webhooks":       `SELECT to_jsonb(webhooks) - 'secret' FROM webhooks WHERE id = $1`,
+}
+
+// AuditResourceTypes returns the resource types which are audited, in alphabetical order.
+func AuditResourceTypes() []string {
+	types := make([]string, 0, len(auditSnapshots))
+	for resourceType := range auditSnapshots {
+		types = append(types, resourceType)
+	}
+
+	sort.Strings(types)
+	return types
+}
+
+// AuditChange is the value of one field of a resource before and after a write. Before is null
+// for a resource which was created, and After is null for one which was deleted.
+type AuditChange struct {
+	Before json.RawMessage `json:"before"`
+	After  json.RawMessage `json:"after"`
+}
+
+// AuditEntry is a record of a write to a resource: who made it (UserID is nil for writes made by
+// the application itself, or by anonymous requests such as a password reset), which request it
+// was part of, what was changed, and when. Changes holds only the fields which changed.
+type AuditEntry struct {
+	ID           int64                  `json:"id"`
+	CreatedAt    time.Time              `json:"created_at"`
+	UserID       *int64                 `json:"user_id"`
+	RequestID    string                 `json:"request_id,omitempty"`
+	Action       string                 `json:"action"`
+	ResourceType string                 `json:"resource_type"`
+	ResourceID   int64                  `json:"resource_id"`
+	Changes      map[string]AuditChange `json:"changes"`
+}
+
+// audit is a write which is being recorded in the audit log. It's the hook that the models use
+// to record their writes: the resource is snapshotted with before() ahead of the write, and again
+// with record() after it, in the same transaction, so that the entry is only recorded if the
+// write commits.
+type audit struct {
+	action       string
+	resourceType string
+	snapshot     map[string]json.RawMessage
+}
+
+// newAudit starts recording a write to a resource of one of the types in auditSnapshots.
+func newAudit(action, resourceType string) *audit {
+	return &audit{action: action, resourceType: resourceType}
+}
+
+// before snapshots the resource with the given ID as it was before the write. It isn't called
+// for creates, as there's nothing to snapshot.
+func (a *audit) before(ctx context.Context, tx *sql.Tx, id int64) error {
+	snapshot, err := auditSnapshot(ctx, tx, a.resourceType, id)
+	if err != nil {
+		return err
+	}
+
+	a.snapshot = snapshot
+	return nil
+}
+
+// record snapshots the resource with the given ID as it is after the write, and records the
+// fields which have changed in the audit log, along with the user and request ID in the context.
+// Nothing is recorded if nothing has changed.
+func (a *audit) record(ctx context.Context, tx *sql.Tx, id int64) error {
+	after, err := auditSnapshot(ctx, tx, a.resourceType, id)
+	if err != nil {
+		return err
+	}
+
+	changes := diffSnapshots(a.snapshot, after)
+	if len(changes) == 0 {
+		return nil
+	}
+
+	js, err := json.Marshal(changes)
+	if err != nil {
+		return err
+	}
+
+	query := `
+		INSERT INTO audit_log (user_id, request_id, action, resource_type, resource_id, changes)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		`
+
+	_, err = tx.ExecContext(ctx, query, actorID(ctx), RequestIDFromContext(ctx), a.action, a.resourceType, id, js)
+	return err
+}
+
+// withAudit runs fn in a transaction and records the write that it makes to a resource in the
+// audit log, in the same transaction. id is the ID of the resource, or 0 for a create, in which
+// case fn returns the ID of the resource it created. If fn returns an error then the transaction
+// is rolled back and the error is returned unchanged.
+func withAudit(ctx context.Context, db *sql.DB, action, resourceType string, id int64, fn func(tx *sql.Tx) (int64, error)) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	a := newAudit(action, resourceType)
+
+	if id != 0 {
+		err = a.before(ctx, tx, id)
+		if err != nil {
+			return err
+		}
+	}
+
+	id, err = fn(tx)
+	if err != nil {
+		return err
+	}
+
+	err = a.record(ctx, tx, id)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// auditSnapshot returns the fields of a resource as JSON values, or nil if it doesn't exist.
+func auditSnapshot(ctx context.Context, tx *sql.Tx, resourceType string, id int64) (map[string]json.RawMessage, error) {
+	query, ok := auditSnapshots[resourceType]
+	if !ok {
+		return nil, errors.New("audit: unknown resource type " + resourceType)
+	}
+
+	var js []byte
+
+	err := tx.QueryRowContext(ctx, query, id).Scan(&js)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, nil
+		default:
+			return nil, err
+		}
+	}
+
+	var snapshot map[string]json.RawMessage
+
+	err = json.Unmarshal(js, &snapshot)
+	if err != nil {
+		return nil, err
+	}
+
+	return snapshot, nil
+}
+
+// diffSnapshots returns the fields which differ between two snapshots of a resource. PostgreSQL
+// writes jsonb values in a canonical form, so equal values have identical JSON.
+func diffSnapshots(before, after map[string]json.RawMessage) map[string]AuditChange {
+	changes := make(map[string]AuditChange)
+
+	for field, value := range before {
+		if !bytes.Equal(value, after[field]) {
+			changes[field] = AuditChange{Before: value, After: nullJSON(after[field])}
+		}
+	}
+
+	for field, value := range after {
+		if _, ok := before[field]; !ok {
+			changes[field] = AuditChange{Before: json.RawMessage("null"), After: value}
+		}
+	}
+
+	return changes
+}
+
+// nullJSON returns the JSON value, or null if there isn't one.
+func nullJSON(value json.RawMessage) json.RawMessage {
+	if value == nil {
+		return json.RawMessage("null")
+	}
+
+	return value
+}
+
+// AuditFilters holds the filters for listing the audit log. Zero values mean no filter. From
+// and To are dates, and To is inclusive.
+type AuditFilters struct {
+	UserID       int64
+	ResourceType string
+	ResourceID   int64
+	From         time.Time
+	To           time.Time
+}
+
+// ValidateAuditFilters checks the audit log filters.
+func ValidateAuditFilters(v *validator.Validator, f AuditFilters) {
+	v.Check(f.ResourceType == "" || validator.In(f.ResourceType, AuditResourceTypes()...), "resource_type",
+		"invalid resource_type value")
+	v.Check(f.ResourceID >= 0, "resource_id", "must not be negative")
+	v.Check(f.ResourceID == 0 || f.ResourceType != "", "resource_type", "must be provided with resource_id")
+	v.Check(f.From.IsZero() || f.To.IsZero() || !f.To.Before(f.From), "to", "must not be before from")
+}
+
+// AuditModel struct wraps a sql.DB connection pool and allows us to work with the AuditEntry
+// struct type and the audit_log table in our database.
+type AuditModel struct {
+	DB       *sql.DB
+	InfoLog  *log.Logger
+	ErrorLog *log.Logger
+}
+
+// GetAll returns a page of the audit log entries which match the filters. Entries are only ever
+// appended, so sorting by ID sorts them in the order the writes were made.
+func (m AuditModel) GetAll(ctx context.Context, auditFilters AuditFilters, filters Filters) ([]*AuditEntry, Metadata, error) {
+	query := fmt.Sprintf(`
+		SELECT count(*) OVER(), id, created_at, user_id, request_id, action, resource_type, resource_id, changes
+		FROM audit_log
+		WHERE (user_id = $1 OR $1 = 0)
+		AND (resource_type = $2 OR $2 = '')
+		AND (resource_id = $3 OR $3 = 0)
+		AND (created_at >= $4 OR $4 IS NULL)
+		AND (created_at < $5 OR $5 IS NULL)
+		ORDER BY %s %s
+		LIMIT $6 OFFSET $7`,
+		filters.sortColumn(), filters.sortDirection())
+
+	var from, to *time.Time
+
+	if !auditFilters.From.IsZero() {
+		from = &auditFilters.From
+	}
+
+	if !auditFilters.To.IsZero() {
+		end := auditFilters.To.AddDate(0, 0, 1)
+		to = &end
+	}
+
+	args := []interface{}{auditFilters.UserID, auditFilters.ResourceType, auditFilters.ResourceID, from, to,
+		filters.limit(), filters.offset()}
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			m.ErrorLog.Println(err)
+		}
+	}()
+
+	totalRecords := 0
+	entries := []*AuditEntry{}
+
+	for rows.Next() {
+		var entry AuditEntry
+		var changes []byte
+
+		err := rows.Scan(
+			&totalRecords,
+			&entry.ID,
+			&entry.CreatedAt,
+			&entry.UserID,
+			&entry.RequestID,
+			&entry.Action,
+			&entry.ResourceType,
+			&entry.ResourceID,
+			&changes,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		err = json.Unmarshal(changes, &entry.Changes)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		entries = append(entries, &entry)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	return entries, calculateMetadata(totalRecords, filters.Page, filters.PageSize), nil
+}
@@ -0,0 +1,91 @@
+package data
+
+import "sync"
+
+// EventBroker is an in-process publish/subscribe broker for domain events. The movie model
+// publishes each event to it once the transaction which recorded the event has committed, and the
+// broker passes it on to every subscriber, such as the server-sent events stream.
+//
+// The broker only sees the writes made through this process. Subscribers which mustn't miss an
+// event (because they've reconnected, or because the write went through another instance of the
+// application) should catch up from EventModel, which holds every event in commit order.
+type EventBroker struct {
+	mu          sync.Mutex
+	subscribers map[*EventSubscription]struct{}
+}
+
+// EventSubscription is a subscription to the events published to an EventBroker.
+type EventSubscription struct {
+	broker *EventBroker
+	events chan *Event
+}
+
+// NewEventBroker returns a new EventBroker with no subscribers.
+func NewEventBroker() *EventBroker {
+	return &EventBroker{subscribers: make(map[*EventSubscription]struct{})}
+}
+
+// Subscribe starts a subscription to the events published from now on, which can buffer up to
+// buffer events. Publishing never waits for a subscriber: one which falls so far behind that its
+// buffer is full is unsubscribed, and its Events channel closed, so that it can catch up from the
+// events table instead. The subscription must be closed once it's no longer needed.
+func (b *EventBroker) Subscribe(buffer int) *EventSubscription {
+	s := &EventSubscription{broker: b, events: make(chan *Event, buffer)}
+
+	b.mu.Lock()
+	b.subscribers[s] = struct{}{}
+	b.mu.Unlock()
+
+	return s
+}
+
+// Publish passes the events on to every subscriber. It's safe to call on a nil broker, which
+// drops the events.
+func (b *EventBroker) Publish(events ...*Event) {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for s := range b.subscribers {
+		for _, event := range events {
+			select {
+			case s.events <- event:
+			default:
+				delete(b.subscribers, s)
+				close(s.events)
+			}
+
+			if _, ok := b.subscribers[s]; !ok {
+				break
+			}
+		}
+	}
+}
+
+// Subscribers returns the number of active subscriptions.
+func (b *EventBroker) Subscribers() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return len(b.subscribers)
+}
+
+// Events returns the channel that the subscription's events are sent on. It's closed if the
+// subscriber falls behind, or when the subscription is closed.
+func (s *EventSubscription) Events() <-chan *Event {
+	return s.events
+}
+
+// Close ends the subscription. It's safe to call more than once.
+func (s *EventSubscription) Close() {
+	s.broker.mu.Lock()
+	defer s.broker.mu.Unlock()
+
+	if _, ok := s.broker.subscribers[s]; ok {
+		delete(s.broker.subscribers, s)
+		close(s.events)
+	}
+}
@@ -0,0 +1,59 @@
+package data
+
+import (
+	"context"
+	"expvar"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// coalesceMetrics publishes, for each coalesced query, the number of requests made for it
+// ("<name>_requests"), the number of database queries actually run ("<name>_queries"), and the
+// number of requests which shared the result of a query started by another request
+// ("<name>_coalesced").
+var coalesceMetrics = expvar.NewMap("coalesced_queries")
+
+// queryGroup coalesces identical concurrent read queries, so that when many requests ask for the
+// same movie (or the same page of movies) at once, only one of them queries the database and the
+// rest share its result. Note that this means a request can receive the result of a query which
+// started just before it did, in the same way as it could if it had arrived slightly earlier.
+//
+// A nil *queryGroup is valid, and simply runs every query.
+type queryGroup struct {
+	group singleflight.Group
+}
+
+// newQueryGroup returns a new queryGroup.
+func newQueryGroup() *queryGroup {
+	return &queryGroup{}
+}
+
+// do runs fn, unless a call with the same name and key is already in flight, in which case it
+// waits for that call and returns its result instead. Callers receive the same value, so they
+// must copy it before handing it out if it can be modified.
+//
+// Since other callers may be waiting on it, fn is passed a context which keeps the values of ctx
+// (such as the trace of the request) but isn't canceled when ctx is.
+func (g *queryGroup) do(ctx context.Context, name, key string, fn func(ctx context.Context) (interface{}, error)) (interface{}, error) {
+	if g == nil {
+		return fn(ctx)
+	}
+
+	coalesceMetrics.Add(name+"_requests", 1)
+
+	// fn only runs in the goroutine of the first caller, so executed is only set for that
+	// caller and every other caller knows that it shared the result.
+	executed := false
+
+	v, err, _ := g.group.Do(name+":"+key, func() (interface{}, error) {
+		executed = true
+		coalesceMetrics.Add(name+"_queries", 1)
+		return fn(context.WithoutCancel(ctx))
+	})
+
+	if !executed {
+		coalesceMetrics.Add(name+"_coalesced", 1)
+	}
+
+	return v, err
+}
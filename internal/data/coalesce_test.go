@@ -0,0 +1,172 @@
+package data
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// coalesceCount returns the value of one of the coalesceMetrics counters.
+func coalesceCount(name string) int64 {
+	v, ok := coalesceMetrics.Get(name).(*expvar.Int)
+	if !ok {
+		return 0
+	}
+	return v.Value()
+}
+
+// queryNames makes the query names unique to each run of a test, as the metrics are global.
+var queryNames int64
+
+// uniqueQueryName returns a query name for a test which no other run has used.
+func uniqueQueryName(prefix string) string {
+	return fmt.Sprintf("%s_%d", prefix, atomic.AddInt64(&queryNames, 1))
+}
+
+// waitForRequests waits until n calls have been made to the named query, and then a little
+// longer so that they have all joined the call in flight.
+func waitForRequests(t *testing.T, name string, n int64) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for coalesceCount(name+"_requests") < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %d requests", n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+}
+
+// TestQueryGroupCoalesces tests that concurrent calls for the same key run the query once and all
+// get its result, and that the metrics count the requests, queries and shared results.
+func TestQueryGroupCoalesces(t *testing.T) {
+	const callers = 10
+
+	name := uniqueQueryName("test_coalesces")
+	g := newQueryGroup()
+	release := make(chan struct{})
+
+	var executions int32
+
+	fn := func(ctx context.Context) (interface{}, error) {
+		atomic.AddInt32(&executions, 1)
+		<-release
+		return &Movie{Title: "Shared"}, nil
+	}
+
+	results := make([]interface{}, callers)
+
+	var wg sync.WaitGroup
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			v, err := g.do(context.Background(), name, "42", fn)
+			if err != nil {
+				t.Error(err)
+			}
+			results[i] = v
+		}(i)
+	}
+
+	waitForRequests(t, name, callers)
+	close(release)
+	wg.Wait()
+
+	if got, want := atomic.LoadInt32(&executions), int32(1); got != want {
+		t.Errorf("want %v; got %v", want, got)
+	}
+
+	for _, v := range results {
+		if got, want := v.(*Movie), results[0].(*Movie); got != want {
+			t.Errorf("want %v; got %v", want, got)
+		}
+	}
+
+	if got, want := coalesceCount(name+"_requests"), int64(callers); got != want {
+		t.Errorf("want %v; got %v", want, got)
+	}
+	if got, want := coalesceCount(name+"_queries"), int64(1); got != want {
+		t.Errorf("want %v; got %v", want, got)
+	}
+	if got, want := coalesceCount(name+"_coalesced"), int64(callers-1); got != want {
+		t.Errorf("want %v; got %v", want, got)
+	}
+
+	// A nil queryGroup runs every query, without touching the metrics.
+	var none *queryGroup
+	_, err := none.do(context.Background(), name, "42", fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := atomic.LoadInt32(&executions), int32(2); got != want {
+		t.Errorf("want %v; got %v", want, got)
+	}
+	if got, want := coalesceCount(name+"_requests"), int64(callers); got != want {
+		t.Errorf("want %v; got %v", want, got)
+	}
+}
+
+// TestQueryGroupCancel tests that canceling the context of the caller which started a query
+// doesn't fail the query for the other callers waiting on it, and that the query still sees the
+// values of the caller's context.
+func TestQueryGroupCancel(t *testing.T) {
+	type contextKey string
+
+	name := uniqueQueryName("test_cancel")
+	g := newQueryGroup()
+	release := make(chan struct{})
+
+	fn := func(ctx context.Context) (interface{}, error) {
+		<-release
+
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		return ctx.Value(contextKey("trace")), nil
+	}
+
+	first, cancel := context.WithCancel(context.WithValue(context.Background(), contextKey("trace"), "abc"))
+
+	type result struct {
+		v   interface{}
+		err error
+	}
+	firstResult, secondResult := make(chan result, 1), make(chan result, 1)
+
+	go func() {
+		v, err := g.do(first, name, "42", fn)
+		firstResult <- result{v, err}
+	}()
+	waitForRequests(t, name, 1)
+
+	go func() {
+		v, err := g.do(context.Background(), name, "42", fn)
+		secondResult <- result{v, err}
+	}()
+	waitForRequests(t, name, 2)
+
+	cancel()
+	close(release)
+
+	for _, ch := range []chan result{firstResult, secondResult} {
+		r := <-ch
+		if r.err != nil {
+			t.Fatal(r.err)
+		}
+		if got, want := r.v.(string), "abc"; got != want {
+			t.Errorf("want %v; got %v", want, got)
+		}
+	}
+
+	if got, want := coalesceCount(name+"_queries"), int64(1); got != want {
+		t.Errorf("want %v; got %v", want, got)
+	}
+}
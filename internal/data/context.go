@@ -0,0 +1,55 @@
+package data
+
+import (
+	"context"
+)
+
+// contextKey is the type of the keys for the values that the data layer reads from a context.
+type contextKey string
+
+const (
+	// userContextKey is the key for the authenticated user making the request.
+	userContextKey = contextKey("user")
+	// requestIDContextKey is the key for the ID of the request.
+	requestIDContextKey = contextKey("request_id")
+)
+
+// ContextWithUser returns a copy of the context carrying the authenticated user making the
+// request (or AnonymousUser). The model methods which take a context read the user from it, so
+// that they can record who made a change without the handlers having to pass the user to every
+// call.
+func ContextWithUser(ctx context.Context, user *User) context.Context {
+	return context.WithValue(ctx, userContextKey, user)
+}
+
+// UserFromContext returns the user carried by the context, and whether there was one.
+func UserFromContext(ctx context.Context) (*User, bool) {
+	user, ok := ctx.Value(userContextKey).(*User)
+	return user, ok
+}
+
+// ContextWithRequestID returns a copy of the context carrying the ID of the request, so that the
+// data layer can tie the changes that it records back to the request which made them.
+func ContextWithRequestID(ctx context.Context, requestID string) context.Context {
+	return context.WithValue(ctx, requestIDContextKey, requestID)
+}
+
+// RequestIDFromContext returns the request ID carried by the context, or the empty string if
+// there isn't one.
+func RequestIDFromContext(ctx context.Context) string {
+	requestID, _ := ctx.Value(requestIDContextKey).(string)
+	return requestID
+}
+
+// actorID returns the ID of the authenticated user carried by the context, or nil if there isn't
+// one (for example, in a background job) or the user is anonymous. It's the value written to the
+// nullable created_by and updated_by columns.
+func actorID(ctx context.Context) *int64 {
+	user, ok := UserFromContext(ctx)
+	if !ok || user.IsAnonymous() {
+		return nil
+	}
+
+	id := user.ID
+	return &id
+}
@@ -0,0 +1,207 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/codeaucafe/snippetbox/greenlight/internal/validator"
+)
+
+// ErrUnknownPerson is returned when a movie is given a credit for a person who doesn't exist.
+var ErrUnknownPerson = errors.New("unknown person")
+
+// Roles which a person can be credited with on a movie. The cast are ordered by their billing,
+// and the other roles make up the crew.
+const (
+	CreditRoleCast     = "cast"
+	CreditRoleDirector = "director"
+	CreditRoleWriter   = "writer"
+	CreditRoleProducer = "producer"
+)
+
+// CreditRoles holds the roles which a person can be credited with.
+var CreditRoles = []string{CreditRoleCast, CreditRoleDirector, CreditRoleWriter, CreditRoleProducer}
+
+// maxCredits is the most credits that a movie can have.
+const maxCredits = 500
+
+// Credit is a person's credit on a movie: the role they had and, for the cast, the character
+// they played and their place in the billing.
+type Credit struct {
+	PersonID  int64  `json:"person_id"`
+	Name      string `json:"name"` // The person's name, which is read-only
+	Role      string `json:"role"`
+	Character string `json:"character,omitempty"`
+	// Billing is the order of the cast, starting at 1 for the top-billed actor. It's zero for
+	// the crew.
+	Billing int `json:"billing,omitempty"`
+}
+
+// CreditModel struct wraps a sql.DB connection pool and allows us to work with the Credit struct
+// type and the credits table in our database.
+type CreditModel struct {
+	DB       *sql.DB
+	InfoLog  *log.Logger
+	ErrorLog *log.Logger
+}
+
+// GetForMovie returns every credit on a movie: the cast in billing order, followed by the crew.
+func (m CreditModel) GetForMovie(ctx context.Context, movieID int64) ([]*Credit, error) {
+	return m.query(ctx, `
+		SELECT c.person_id, p.name, c.role, c.character, c.billing
+		FROM credits c
+		INNER JOIN people p ON p.id = c.person_id
+		WHERE c.movie_id = $1
+		ORDER BY c.role <> 'cast', c.billing, c.role, c.id`,
+		movieID)
+}
+
+// GetTopCast returns the first limit members of a movie's cast, in billing order.
+func (m CreditModel) GetTopCast(ctx context.Context, movieID int64, limit int) ([]*Credit, error) {
+	return m.query(ctx, fmt.Sprintf(`
+		SELECT c.person_id, p.name, c.role, c.character, c.billing
+		FROM credits c
+		INNER JOIN people p ON p.id = c.person_id
+		WHERE c.movie_id = $1 AND c.role = '%s'
+		ORDER BY c.billing, c.id
+		LIMIT $2`, CreditRoleCast),
+		movieID, limit)
+}
+
+// query runs a query which returns credits.
+func (m CreditModel) query(ctx context.Context, query string, args ...interface{}) ([]*Credit, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			m.ErrorLog.Println(err)
+		}
+	}()
+
+	credits := []*Credit{}
+
+	for rows.Next() {
+		var credit Credit
+
+		err := rows.Scan(&credit.PersonID, &credit.Name, &credit.Role, &credit.Character, &credit.Billing)
+		if err != nil {
+			return nil, err
+		}
+
+		credits = append(credits, &credit)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return credits, nil
+}
+
+// SetForMovie replaces every credit on a movie. The cast are billed in the order that they're
+// given, and the credits' Billing fields are filled in to match. The movie is given a new
+// version, recording the user in the context as the last user to change it, as its top-billed
+// cast are part of the movie. ErrRecordNotFound is returned if the movie doesn't exist, and
+// ErrUnknownPerson if one of the credits is for a person who doesn't.
+func (m CreditModel) SetForMovie(ctx context.Context, movieID int64, credits []*Credit) error {
+	if movieID < 1 {
+		return ErrRecordNotFound
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	change := newAudit(AuditUpdate, "credits")
+
+	err = change.before(ctx, tx, movieID)
+	if err != nil {
+		return err
+	}
+
+	var version int32
+
+	err = tx.QueryRowContext(ctx, `
+		UPDATE movies
+		SET version = version + 1, updated_by = $2
+		WHERE id = $1 AND deleted_at IS NULL
+		RETURNING version`,
+		movieID, actorID(ctx)).Scan(&version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrRecordNotFound
+		default:
+			return err
+		}
+	}
+
+	_, err = tx.ExecContext(ctx, "DELETE FROM credits WHERE movie_id = $1", movieID)
+	if err != nil {
+		return err
+	}
+
+	query := `
+		INSERT INTO credits (movie_id, person_id, role, character, billing)
+		VALUES ($1, $2, $3, $4, $5)
+		`
+
+	billing := 0
+
+	for _, credit := range credits {
+		credit.Billing = 0
+		if credit.Role == CreditRoleCast {
+			billing++
+			credit.Billing = billing
+		}
+
+		_, err = tx.ExecContext(ctx, query, movieID, credit.PersonID, credit.Role, credit.Character, credit.Billing)
+		if err != nil {
+			switch {
+			case err.Error() == `pq: insert or update on table "credits" violates foreign key constraint "credits_person_id_fkey"`:
+				return ErrUnknownPerson
+			default:
+				return err
+			}
+		}
+	}
+
+	err = change.record(ctx, tx, movieID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// ValidateCredits runs validation checks on the credits of a movie.
+func ValidateCredits(v *validator.Validator, credits []*Credit) {
+	v.Check(len(credits) <= maxCredits, "credits", fmt.Sprintf("must not contain more than %d credits", maxCredits))
+
+	for i, credit := range credits {
+		key := fmt.Sprintf("credits[%d]", i)
+
+		v.Check(credit.PersonID > 0, key+".person_id", "must be provided")
+		v.Check(validator.In(credit.Role, CreditRoles...), key+".role", "must be a valid role")
+		v.Check(len(credit.Character) <= 500, key+".character", "must not be more than 500 bytes long")
+		v.Check(credit.Character == "" || credit.Role == CreditRoleCast, key+".character",
+			"must only be provided for the cast")
+	}
+}
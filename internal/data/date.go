@@ -0,0 +1,70 @@
+package data
+
+import (
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// ErrInvalidDateFormat is returned when a JSON date isn't a "YYYY-MM-DD" string. This is used in
+// our Date.UnmarshalJSON() method.
+var ErrInvalidDateFormat = errors.New("invalid date format")
+
+// dateLayout is the layout of a Date in JSON and in the database.
+const dateLayout = "2006-01-02"
+
+// Date is a calendar date without a time of day, such as a movie's release date. It's written
+// as a "YYYY-MM-DD" string in JSON, and stored in a DATE column.
+type Date struct {
+	time.Time
+}
+
+// NewDate returns the date of t, in t's location.
+func NewDate(t time.Time) Date {
+	return Date{time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)}
+}
+
+// String returns the date in the "YYYY-MM-DD" format.
+func (d Date) String() string {
+	return d.Format(dateLayout)
+}
+
+// MarshalJSON encodes the date as a "YYYY-MM-DD" string.
+func (d Date) MarshalJSON() ([]byte, error) {
+	return []byte(strconv.Quote(d.String())), nil
+}
+
+// UnmarshalJSON decodes a "YYYY-MM-DD" string. It uses a pointer receiver, like
+// Runtime.UnmarshalJSON(), so that it can modify the receiver.
+func (d *Date) UnmarshalJSON(jsonValue []byte) error {
+	unquoted, err := strconv.Unquote(string(jsonValue))
+	if err != nil {
+		return ErrInvalidDateFormat
+	}
+
+	t, err := time.Parse(dateLayout, unquoted)
+	if err != nil {
+		return ErrInvalidDateFormat
+	}
+
+	d.Time = t
+	return nil
+}
+
+// Scan implements the sql.Scanner interface, so that DATE columns can be scanned into a Date.
+func (d *Date) Scan(src interface{}) error {
+	t, ok := src.(time.Time)
+	if !ok {
+		return fmt.Errorf("cannot scan %T into a Date", src)
+	}
+
+	*d = NewDate(t)
+	return nil
+}
+
+// Value implements the driver.Valuer interface, so that a Date can be written to a DATE column.
+func (d Date) Value() (driver.Value, error) {
+	return d.String(), nil
+}
@@ -0,0 +1,404 @@
+package data
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/codeaucafe/snippetbox/greenlight/internal/validator"
+	"github.com/lib/pq"
+)
+
+var (
+	// ErrUnknownGenre is returned when a user picks a favorite genre which doesn't exist.
+	ErrUnknownGenre = errors.New("unknown genre")
+
+	// ErrInvalidUnsubscribeToken is returned when a digest unsubscribe token is malformed or its
+	// signature doesn't match.
+	ErrInvalidUnsubscribeToken = errors.New("invalid unsubscribe token")
+)
+
+// DigestPeriod is how often subscribers are sent the digest.
+const DigestPeriod = 7 * 24 * time.Hour
+
+// DigestSettings holds whether a user is subscribed to the weekly digest, and the favorite genres
+// which its new movies are picked from.
+type DigestSettings struct {
+	Subscribed     bool       `json:"subscribed"`
+	FavoriteGenres []string   `json:"favorite_genres"`
+	LastSentAt     *time.Time `json:"last_sent_at,omitempty"`
+}
+
+// DigestRecipient is a subscriber whose digest is due, along with the time that the digest
+// covers activity since: when the last digest was sent, or when they subscribed.
+type DigestRecipient struct {
+	UserID int64
+	Name   string
+	Email  string
+	Since  time.Time
+}
+
+// DigestMovie is a movie which has been added in one of a subscriber's favorite genres. It's
+// stored in the digest email's outbox message, so its fields are named as the template uses them.
+type DigestMovie struct {
+	ID    int64  `json:"id"`
+	Title string `json:"title"`
+	Year  int32  `json:"year"`
+}
+
+// DigestReviewActivity is something that has happened to one of a subscriber's reviews: a
+// moderator has approved or rejected it (Status), or other users have reviewed the same movie
+// (NewReviews).
+type DigestReviewActivity struct {
+	MovieID    int64  `json:"movie_id"`
+	Title      string `json:"title"`
+	Status     string `json:"status"`
+	NewReviews int    `json:"new_reviews"`
+}
+
+// DigestModel struct wraps a sql.DB connection pool and allows us to work with the
+// digest_subscriptions and favorite_genres tables in our database.
+type DigestModel struct {
+	DB       *sql.DB
+	InfoLog  *log.Logger
+	ErrorLog *log.Logger
+}
+
+// Get returns a user's digest settings.
+func (m DigestModel) Get(ctx context.Context, userID int64) (*DigestSettings, error) {
+	query := `
+		SELECT EXISTS(SELECT 1 FROM digest_subscriptions WHERE user_id = $1),
+			(SELECT last_sent_at FROM digest_subscriptions WHERE user_id = $1),
+			ARRAY(SELECT g.name::text FROM favorite_genres f INNER JOIN genres g ON g.id = f.genre_id
+				WHERE f.user_id = $1 ORDER BY g.name)
+		`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	var settings DigestSettings
+
+	err := m.DB.QueryRowContext(ctx, query, userID).Scan(&settings.Subscribed, &settings.LastSentAt,
+		pq.Array(&settings.FavoriteGenres))
+	if err != nil {
+		return nil, err
+	}
+
+	return &settings, nil
+}
+
+// Update changes a user's digest settings: subscribing or unsubscribing them if subscribed isn't
+// nil, and replacing their favorite genres if genres isn't nil. A new subscriber's first digest
+// is sent a week after now. ErrUnknownGenre is returned if one of the genres doesn't exist.
+func (m DigestModel) Update(ctx context.Context, userID int64, subscribed *bool, genres []string, now time.Time) error {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	if subscribed != nil {
+		query := "DELETE FROM digest_subscriptions WHERE user_id = $1"
+		args := []interface{}{userID}
+
+		if *subscribed {
+			query = `
+				INSERT INTO digest_subscriptions (user_id, created_at)
+				VALUES ($1, $2)
+				ON CONFLICT (user_id) DO NOTHING`
+			args = append(args, now)
+		}
+
+		_, err = tx.ExecContext(ctx, query, args...)
+		if err != nil {
+			return err
+		}
+	}
+
+	if genres != nil {
+		_, err = tx.ExecContext(ctx, "DELETE FROM favorite_genres WHERE user_id = $1", userID)
+		if err != nil {
+			return err
+		}
+
+		result, err := tx.ExecContext(ctx, `
+			INSERT INTO favorite_genres (user_id, genre_id)
+			SELECT $1, id FROM genres WHERE name = ANY($2::citext[])`,
+			userID, pq.Array(genres))
+		if err != nil {
+			return err
+		}
+
+		added, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+
+		if int(added) != len(genres) {
+			return ErrUnknownGenre
+		}
+	}
+
+	return tx.Commit()
+}
+
+// GetDue returns up to limit of the activated subscribers whose digest was last sent (or who
+// subscribed) at or before the given time, oldest first.
+func (m DigestModel) GetDue(ctx context.Context, before time.Time, limit int) ([]*DigestRecipient, error) {
+	query := `
+		SELECT u.id, u.name, u.email, COALESCE(d.last_sent_at, d.created_at)
+		FROM digest_subscriptions d
+		INNER JOIN users u ON u.id = d.user_id
+		WHERE u.activated AND u.deleted_at IS NULL AND COALESCE(d.last_sent_at, d.created_at) <= $1
+		ORDER BY COALESCE(d.last_sent_at, d.created_at), u.id
+		LIMIT $2
+		`
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, before, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			m.ErrorLog.Println(err)
+		}
+	}()
+
+	recipients := []*DigestRecipient{}
+
+	for rows.Next() {
+		var r DigestRecipient
+
+		err := rows.Scan(&r.UserID, &r.Name, &r.Email, &r.Since)
+		if err != nil {
+			return nil, err
+		}
+
+		recipients = append(recipients, &r)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return recipients, nil
+}
+
+// NewMovies returns up to limit of the movies added since the given time in any of a user's
+// favorite genres, newest first.
+func (m DigestModel) NewMovies(ctx context.Context, userID int64, since time.Time, limit int) ([]*DigestMovie, error) {
+	query := `
+		SELECT m.id, m.title, m.year
+		FROM movies m
+		WHERE m.deleted_at IS NULL AND m.created_at > $2 AND m.id IN (
+			SELECT mg.movie_id FROM movie_genres mg
+			INNER JOIN favorite_genres f ON f.genre_id = mg.genre_id
+			WHERE f.user_id = $1)
+		ORDER BY m.id DESC
+		LIMIT $3
+		`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID, since, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			m.ErrorLog.Println(err)
+		}
+	}()
+
+	movies := []*DigestMovie{}
+
+	for rows.Next() {
+		var movie DigestMovie
+
+		err := rows.Scan(&movie.ID, &movie.Title, &movie.Year)
+		if err != nil {
+			return nil, err
+		}
+
+		movies = append(movies, &movie)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return movies, nil
+}
+
+// ReviewActivity returns what has happened to a user's reviews since the given time: for each
+// movie they've reviewed, whether a moderator has approved or rejected their review since then,
+// and how many approved reviews other users have written of it since then. Movies where nothing
+// has happened are left out.
+func (m DigestModel) ReviewActivity(ctx context.Context, userID int64, since time.Time) ([]*DigestReviewActivity, error) {
+	query := `
+		SELECT m.id, m.title,
+			CASE WHEN r.moderated_at > $2 THEN r.status ELSE '' END,
+			(SELECT count(*) FROM reviews o
+				WHERE o.movie_id = r.movie_id AND o.user_id <> $1 AND o.status = 'approved' AND o.created_at > $2)
+		FROM reviews r
+		INNER JOIN movies m ON m.id = r.movie_id
+		WHERE r.user_id = $1 AND m.deleted_at IS NULL
+		ORDER BY m.title, m.id
+		`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID, since)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			m.ErrorLog.Println(err)
+		}
+	}()
+
+	activity := []*DigestReviewActivity{}
+
+	for rows.Next() {
+		var a DigestReviewActivity
+
+		err := rows.Scan(&a.MovieID, &a.Title, &a.Status, &a.NewReviews)
+		if err != nil {
+			return nil, err
+		}
+
+		if a.Status != "" || a.NewReviews > 0 {
+			activity = append(activity, &a)
+		}
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return activity, nil
+}
+
+// MarkSent records that a user's digest has been sent at the given time, adding the digest email
+// to the outbox in the same transaction. If email is nil then there was nothing to tell the
+// user, and the digest is skipped until next week.
+func (m DigestModel) MarkSent(ctx context.Context, userID int64, sentAt time.Time, email *OutboxEmail) error {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	_, err = tx.ExecContext(ctx, "UPDATE digest_subscriptions SET last_sent_at = $1 WHERE user_id = $2",
+		sentAt, userID)
+	if err != nil {
+		return err
+	}
+
+	if email != nil {
+		err = insertOutboxMessage(ctx, tx, OutboxKindEmail, email)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// Unsubscribe removes a user's subscription to the digest, if they have one.
+func (m DigestModel) Unsubscribe(ctx context.Context, userID int64) error {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, "DELETE FROM digest_subscriptions WHERE user_id = $1", userID)
+	return err
+}
+
+// ValidateFavoriteGenres checks a user's choice of favorite genres.
+func ValidateFavoriteGenres(v *validator.Validator, genres []string, limits MovieLimits) {
+	v.Check(len(genres) <= limits.MaxGenres, "favorite_genres",
+		"must not contain more than "+strconv.Itoa(limits.MaxGenres)+" genres")
+	v.Check(validator.Unique(genres), "favorite_genres", "must not contain duplicate values")
+
+	for _, genre := range genres {
+		v.Check(strings.TrimSpace(genre) != "", "favorite_genres", "must not contain empty genres")
+	}
+}
+
+// EncodeUnsubscribeToken returns the token for a user's digest unsubscribe link, signed with
+// HMAC-SHA256 using the given secret in the same way as a pagination cursor. The token never
+// expires, so that the link in an old digest still works.
+func EncodeUnsubscribeToken(secret []byte, userID int64) string {
+	payload := []byte(strconv.FormatInt(userID, 10))
+	encoding := base64.RawURLEncoding
+
+	return encoding.EncodeToString(payload) + "." + encoding.EncodeToString(signUnsubscribe(secret, payload))
+}
+
+// DecodeUnsubscribeToken verifies the signature of a digest unsubscribe token and returns the ID
+// of the user it's for. ErrInvalidUnsubscribeToken is returned if the token is malformed or has
+// been tampered with.
+func DecodeUnsubscribeToken(secret []byte, token string) (int64, error) {
+	encoding := base64.RawURLEncoding
+
+	encodedPayload, encodedSignature, ok := strings.Cut(token, ".")
+	if !ok {
+		return 0, ErrInvalidUnsubscribeToken
+	}
+
+	payload, err := encoding.DecodeString(encodedPayload)
+	if err != nil {
+		return 0, ErrInvalidUnsubscribeToken
+	}
+
+	signature, err := encoding.DecodeString(encodedSignature)
+	if err != nil {
+		return 0, ErrInvalidUnsubscribeToken
+	}
+
+	if !hmac.Equal(signature, signUnsubscribe(secret, payload)) {
+		return 0, ErrInvalidUnsubscribeToken
+	}
+
+	userID, err := strconv.ParseInt(string(payload), 10, 64)
+	if err != nil || userID < 1 {
+		return 0, ErrInvalidUnsubscribeToken
+	}
+
+	return userID, nil
+}
+
+// signUnsubscribe returns the HMAC-SHA256 signature of an unsubscribe token's payload. The
+// payload is prefixed with the token's purpose, so that a signature made for something else
+// with the same secret can't be passed off as an unsubscribe token.
+func signUnsubscribe(secret, payload []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte("digest-unsubscribe:"))
+	mac.Write(payload)
+	return mac.Sum(nil)
+}
@@ -0,0 +1,233 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/codeaucafe/snippetbox/greenlight/internal/validator"
+	"github.com/lib/pq"
+)
+
+// Statuses of a duplicate candidate as it's reviewed. A candidate is confirmed if the movies are
+// duplicates, and dismissed if they aren't.
+const (
+	DuplicateStatusPending   = "pending"
+	DuplicateStatusConfirmed = "confirmed"
+	DuplicateStatusDismissed = "dismissed"
+)
+
+// DuplicateStatuses holds the statuses which a duplicate candidate can have.
+var DuplicateStatuses = []string{DuplicateStatusPending, DuplicateStatusConfirmed, DuplicateStatusDismissed}
+
+// duplicateScanBatchSize is the number of movies compared with the rest of the catalog by each
+// query of a duplicate scan. Scanning in batches keeps each query short and lets the scan report
+// its progress.
+const duplicateScanBatchSize = 1000
+
+// DuplicateCandidate is a pair of movies which the duplicate scan found to be probable
+// duplicates: their normalized titles and years match, and their runtimes are within the scan's
+// tolerance of each other. Movie always has the lower ID.
+type DuplicateCandidate struct {
+	ID                int64     `json:"id"`
+	CreatedAt         time.Time `json:"created_at"`
+	UpdatedAt         time.Time `json:"updated_at"`
+	Movie             *Movie    `json:"movie"`
+	Duplicate         *Movie    `json:"duplicate"`
+	RuntimeDifference int       `json:"runtime_difference"`
+	Status            string    `json:"status"`
+}
+
+// DuplicateModel struct wraps a sql.DB connection pool and allows us to work with the
+// DuplicateCandidate struct type and the duplicate_candidates table in our database.
+type DuplicateModel struct {
+	DB       *sql.DB
+	InfoLog  *log.Logger
+	ErrorLog *log.Logger
+}
+
+// normalizedTitle returns an SQL expression which normalizes the title in the given column for
+// comparison: it's lowercased, a leading article ("The Matrix") or trailing one ("Matrix, The")
+// is removed, and then everything but letters and digits is removed, so that both become
+// "matrix".
+func normalizedTitle(column string) string {
+	return fmt.Sprintf(
+		`regexp_replace(regexp_replace(regexp_replace(lower(%s), ',\s*(the|a|an)$', ''), '^(the|a|an)\s+', ''), '[^[:alnum:]]+', '', 'g')`,
+		column)
+}
+
+// Scan compares every movie in the catalog with the rest, and adds the pairs which are probable
+// duplicates to the review queue: pairs whose normalized titles and years match, and whose
+// runtimes are no more than tolerance minutes apart. Pairs which are already in the queue,
+// whatever their status, aren't added again. progress is called with the percentage complete
+// after each batch. It returns the number of pairs added.
+func (m DuplicateModel) Scan(ctx context.Context, tolerance int, progress func(int)) (int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	var maxID int64
+
+	err := m.DB.QueryRowContext(ctx, `SELECT COALESCE(MAX(id), 0) FROM movies`).Scan(&maxID)
+	if err != nil {
+		return 0, err
+	}
+
+	query := fmt.Sprintf(`
+		INSERT INTO duplicate_candidates (movie_id, duplicate_id, runtime_difference)
+		SELECT a.id, b.id, ABS(a.runtime - b.runtime)
+		FROM movies a
+		INNER JOIN movies b ON b.id > a.id
+			AND b.year = a.year
+			AND ABS(a.runtime - b.runtime) <= $3
+			AND %s = %s
+		WHERE a.id > $1 AND a.id <= $2 AND a.deleted_at IS NULL AND b.deleted_at IS NULL
+		ON CONFLICT (movie_id, duplicate_id) DO NOTHING`,
+		normalizedTitle("a.title"), normalizedTitle("b.title"))
+
+	var added int64
+
+	for start := int64(0); start < maxID; start += duplicateScanBatchSize {
+		end := start + duplicateScanBatchSize
+
+		rowsAffected, err := m.scanBatch(ctx, query, start, end, tolerance)
+		if err != nil {
+			return added, err
+		}
+
+		added += rowsAffected
+
+		if end > maxID {
+			end = maxID
+		}
+		progress(int(end * 100 / maxID))
+	}
+
+	return added, nil
+}
+
+// scanBatch runs the duplicate scan query for the movies with IDs in (start, end], and returns
+// the number of pairs it added.
+func (m DuplicateModel) scanBatch(ctx context.Context, query string, start, end int64, tolerance int) (int64, error) {
+	// Each batch compares its movies with the whole catalog, so it gets longer than the usual
+	// timeout.
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, start, end, tolerance)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
+
+// GetAll returns a page of the duplicate candidates with the given status, sorted according to
+// the filters, along with the pair of movies for each.
+func (m DuplicateModel) GetAll(ctx context.Context, status string, filters Filters) ([]*DuplicateCandidate, Metadata, error) {
+	query := fmt.Sprintf(`
+		SELECT count(*) OVER(), d.id, d.created_at, d.updated_at, d.runtime_difference, d.status,
+			a.id, a.created_at, a.title, a.year, a.runtime, %s, a.version,
+			b.id, b.created_at, b.title, b.year, b.runtime, %s, b.version
+		FROM duplicate_candidates d
+		INNER JOIN movies a ON a.id = d.movie_id
+		INNER JOIN movies b ON b.id = d.duplicate_id
+		WHERE d.status = $1 AND a.deleted_at IS NULL AND b.deleted_at IS NULL
+		ORDER BY d.%s %s, d.id ASC
+		LIMIT $2 OFFSET $3`,
+		genresOf("a"), genresOf("b"), filters.sortColumn(), filters.sortDirection())
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, status, filters.limit(), filters.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			m.ErrorLog.Println(err)
+		}
+	}()
+
+	totalRecords := 0
+	candidates := []*DuplicateCandidate{}
+
+	for rows.Next() {
+		candidate := DuplicateCandidate{Movie: &Movie{}, Duplicate: &Movie{}}
+
+		err := rows.Scan(
+			&totalRecords,
+			&candidate.ID,
+			&candidate.CreatedAt,
+			&candidate.UpdatedAt,
+			&candidate.RuntimeDifference,
+			&candidate.Status,
+			&candidate.Movie.ID,
+			&candidate.Movie.CreatedAt,
+			&candidate.Movie.Title,
+			&candidate.Movie.Year,
+			&candidate.Movie.Runtime,
+			pq.Array(&candidate.Movie.Genres),
+			&candidate.Movie.Version,
+			&candidate.Duplicate.ID,
+			&candidate.Duplicate.CreatedAt,
+			&candidate.Duplicate.Title,
+			&candidate.Duplicate.Year,
+			&candidate.Duplicate.Runtime,
+			pq.Array(&candidate.Duplicate.Genres),
+			&candidate.Duplicate.Version,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		candidates = append(candidates, &candidate)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	return candidates, calculateMetadata(totalRecords, filters.Page, filters.PageSize), nil
+}
+
+// UpdateStatus records the outcome of reviewing a duplicate candidate. ErrRecordNotFound is
+// returned if the candidate doesn't exist.
+func (m DuplicateModel) UpdateStatus(ctx context.Context, id int64, status string) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+
+	query := `
+		UPDATE duplicate_candidates
+		SET status = $1, updated_at = NOW()
+		WHERE id = $2
+		`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, status, id)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// ValidateDuplicateTolerance runs validation checks on the runtime tolerance of a duplicate scan.
+func ValidateDuplicateTolerance(v *validator.Validator, tolerance int) {
+	v.Check(tolerance >= 0, "runtime_tolerance", "must not be negative")
+	v.Check(tolerance <= 30, "runtime_tolerance", "must not be more than 30 minutes")
+}
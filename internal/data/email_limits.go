@@ -0,0 +1,104 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"math"
+	"time"
+)
+
+// EmailLimitModel struct wraps a sql.DB connection pool and allows us to work with the
+// email_rate_limits table in our database.
+type EmailLimitModel struct {
+	DB       *sql.DB
+	InfoLog  *log.Logger
+	ErrorLog *log.Logger
+}
+
+// Take takes a token from the token bucket for an email address, before an email is sent to it.
+// The bucket holds up to burst tokens and gains one token every interval. If the bucket is
+// empty, no token is taken, and Take returns how long it will be until the next token is added.
+// Otherwise it returns zero.
+//
+// The buckets are kept in the database rather than in memory (like the per-IP rate limiters),
+// so that the limit is shared by every instance of the application.
+func (m EmailLimitModel) Take(ctx context.Context, email string, interval time.Duration, burst int, now time.Time) (time.Duration, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	// Create a full bucket for the address if it doesn't have one, and then lock it, so that
+	// concurrent requests for the same address take tokens one at a time.
+	insert := `
+		INSERT INTO email_rate_limits (email, tokens, updated_at)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (email) DO NOTHING
+		`
+
+	_, err = tx.ExecContext(ctx, insert, email, burst, now)
+	if err != nil {
+		return 0, err
+	}
+
+	var (
+		tokens    float64
+		updatedAt time.Time
+	)
+
+	query := `
+		SELECT tokens, updated_at
+		FROM email_rate_limits
+		WHERE email = $1
+		FOR UPDATE
+		`
+
+	err = tx.QueryRowContext(ctx, query, email).Scan(&tokens, &updatedAt)
+	if err != nil {
+		return 0, err
+	}
+
+	// Add the tokens for the time since the bucket was last updated.
+	if elapsed := now.Sub(updatedAt); elapsed > 0 {
+		tokens = math.Min(float64(burst), tokens+elapsed.Seconds()/interval.Seconds())
+	}
+
+	if tokens < 1 {
+		return time.Duration((1 - tokens) * float64(interval)), nil
+	}
+
+	update := `
+		UPDATE email_rate_limits
+		SET tokens = $1, updated_at = $2
+		WHERE email = $3
+		`
+
+	_, err = tx.ExecContext(ctx, update, tokens-1, now, email)
+	if err != nil {
+		return 0, err
+	}
+
+	return 0, tx.Commit()
+}
+
+// Purge deletes the buckets which haven't been updated since before, and returns the number
+// deleted. The caller picks a time by which any bucket has filled up again, so that purging a
+// bucket doesn't change the limit, as Take creates a full bucket for an address without one.
+func (m EmailLimitModel) Purge(ctx context.Context, before time.Time) (int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, "DELETE FROM email_rate_limits WHERE updated_at < $1", before)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
@@ -0,0 +1,173 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"time"
+)
+
+// Types of domain event.
+const (
+	EventMovieCreated = "movie.created"
+	EventMovieUpdated = "movie.updated"
+	EventMovieDeleted = "movie.deleted"
+	// EventMovieRestored is recorded when a movie is restored from the trash. Its data is the
+	// movie, as for movie.created.
+	EventMovieRestored = "movie.restored"
+)
+
+// eventsLockKey is the key of the PostgreSQL advisory lock which serializes the transactions that
+// write events. A sequence hands out IDs in the order that rows are inserted rather than the order
+// that their transactions commit, so without the lock a consumer could read event 6 while event 5
+// was still uncommitted, and never see event 5. Holding the lock until commit means that events
+// become visible in ID order.
+const eventsLockKey = 4012002
+
+// Event is a domain event: a record of a change to a resource, such as a movie being updated.
+// Data holds the resource as it was after the change (or just its ID, if it was deleted).
+type Event struct {
+	ID         int64           `json:"id"`
+	CreatedAt  time.Time       `json:"created_at"`
+	Type       string          `json:"type"`
+	ResourceID int64           `json:"resource_id"`
+	Data       json.RawMessage `json:"data"`
+}
+
+// EventModel struct wraps a sql.DB connection pool and allows us to work with the Event struct
+// type and the events table in our database.
+type EventModel struct {
+	DB       *sql.DB
+	InfoLog  *log.Logger
+	ErrorLog *log.Logger
+}
+
+// insertEvent records an event as part of a transaction, so that it is only recorded if the
+// change it describes commits, and queues its delivery to the webhooks which subscribe to it in
+// the same transaction. data is marshalled to JSON. The recorded event is returned, so that it
+// can be published once the transaction has committed.
+func insertEvent(ctx context.Context, tx *sql.Tx, eventType string, resourceID int64, data interface{}) (*Event, error) {
+	js, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = tx.ExecContext(ctx, "SELECT pg_advisory_xact_lock($1)", eventsLockKey)
+	if err != nil {
+		return nil, err
+	}
+
+	query := `
+		INSERT INTO events (type, resource_id, data)
+		VALUES ($1, $2, $3)
+		RETURNING id, created_at
+		`
+
+	event := &Event{Type: eventType, ResourceID: resourceID, Data: js}
+
+	err = tx.QueryRowContext(ctx, query, eventType, resourceID, js).Scan(&event.ID, &event.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	err = enqueueWebhooks(ctx, tx, eventType, resourceID, js)
+	if err != nil {
+		return nil, err
+	}
+
+	return event, nil
+}
+
+// withEvent runs fn in a transaction and records the event that it describes in the same
+// transaction, and then publishes the event to the broker once the transaction has committed.
+// If fn returns an error then the transaction is rolled back and the error is returned unchanged.
+func withEvent(ctx context.Context, db *sql.DB, broker *EventBroker, fn func(tx *sql.Tx) (eventType string, resourceID int64, data interface{}, err error)) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	eventType, resourceID, data, err := fn(tx)
+	if err != nil {
+		return err
+	}
+
+	event, err := insertEvent(ctx, tx, eventType, resourceID, data)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	broker.Publish(event)
+	return nil
+}
+
+// LastID returns the ID of the most recent event, or 0 if there aren't any. Passing it to GetAfter
+// skips the events which have already happened.
+func (m EventModel) LastID(ctx context.Context) (int64, error) {
+	query := `
+		SELECT COALESCE(MAX(id), 0)
+		FROM events
+		`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	var id int64
+
+	err := m.DB.QueryRowContext(ctx, query).Scan(&id)
+	return id, err
+}
+
+// GetAfter returns up to limit events with IDs greater than after, oldest first. Passing the ID of
+// the last event from one call as after for the next pages through every event exactly once.
+func (m EventModel) GetAfter(ctx context.Context, after int64, limit int) ([]*Event, error) {
+	query := `
+		SELECT id, created_at, type, resource_id, data
+		FROM events
+		WHERE id > $1
+		ORDER BY id
+		LIMIT $2
+		`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, after, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			m.ErrorLog.Println(err)
+		}
+	}()
+
+	events := []*Event{}
+
+	for rows.Next() {
+		var event Event
+
+		err := rows.Scan(&event.ID, &event.CreatedAt, &event.Type, &event.ResourceID, &event.Data)
+		if err != nil {
+			return nil, err
+		}
+
+		events = append(events, &event)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return events, nil
+}
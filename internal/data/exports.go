@@ -0,0 +1,415 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/codeaucafe/snippetbox/greenlight/internal/validator"
+)
+
+// Formats and frequencies supported for scheduled exports.
+var (
+	ExportFormats     = []string{"csv", "json"}
+	ExportFrequencies = []string{"daily", "weekly", "monthly"}
+)
+
+// MaxExportRows is the maximum number of movies included in a single export.
+const MaxExportRows = 10_000
+
+// ScheduledExport represents a recurring export of the movies matching a search filter, which
+// is generated in the background and kept in object storage, under ArtifactKey, and the user who
+// scheduled it is emailed when it's ready. When NewOnly is set, each export only includes the
+// movies added since the previous one.
+type ScheduledExport struct {
+	ID          int64        `json:"id"`
+	CreatedAt   time.Time    `json:"created_at"`
+	UserID      int64        `json:"-"`
+	Name        string       `json:"name"`
+	Filter      SearchFilter `json:"filter"`
+	Format      string       `json:"format"`
+	Frequency   string       `json:"frequency"`
+	NewOnly     bool         `json:"new_only"`
+	LastMovieID int64        `json:"-"`
+	NextRunAt   time.Time    `json:"next_run_at"`
+	LastRunAt   *time.Time   `json:"last_run_at,omitempty"`
+	ArtifactKey string       `json:"-"`
+	Version     int32        `json:"version"`
+}
+
+// DueExport holds a scheduled export which is due to run, along with the email address of the
+// user who owns it.
+type DueExport struct {
+	Export *ScheduledExport
+	Email  string
+}
+
+// ExportModel struct wraps a sql.DB connection pool and allows us to work with the
+// ScheduledExport struct type and the scheduled_exports table in our database.
+type ExportModel struct {
+	DB       *sql.DB
+	InfoLog  *log.Logger
+	ErrorLog *log.Logger
+}
+
+// Insert adds a new scheduled export to the scheduled_exports table. As for saved searches, it
+// starts from the newest movie currently in the database.
+func (m ExportModel) Insert(ctx context.Context, export *ScheduledExport) error {
+	filter, err := json.Marshal(export.Filter)
+	if err != nil {
+		return err
+	}
+
+	query := `
+		INSERT INTO scheduled_exports (user_id, name, filter, format, frequency, new_only, next_run_at, last_movie_id)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, (SELECT COALESCE(MAX(id), 0) FROM movies))
+		RETURNING id, created_at, last_movie_id, version
+		`
+
+	args := []interface{}{
+		export.UserID,
+		export.Name,
+		filter,
+		export.Format,
+		export.Frequency,
+		export.NewOnly,
+		export.NextRunAt,
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	return withAudit(ctx, m.DB, AuditCreate, "exports", 0, func(tx *sql.Tx) (int64, error) {
+		err := tx.QueryRowContext(ctx, query, args...).Scan(
+			&export.ID,
+			&export.CreatedAt,
+			&export.LastMovieID,
+			&export.Version,
+		)
+		if err != nil {
+			return 0, err
+		}
+
+		return export.ID, nil
+	})
+}
+
+// GetAllForUser returns all of the scheduled exports belonging to a user, oldest first.
+func (m ExportModel) GetAllForUser(ctx context.Context, userID int64) ([]*ScheduledExport, error) {
+	query := `
+		SELECT id, created_at, user_id, name, filter, format, frequency, new_only, last_movie_id,
+			next_run_at, last_run_at, artifact_key, version
+		FROM scheduled_exports
+		WHERE user_id = $1
+		ORDER BY id
+		`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			m.ErrorLog.Println(err)
+		}
+	}()
+
+	exports := []*ScheduledExport{}
+
+	for rows.Next() {
+		export, err := scanScheduledExport(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		exports = append(exports, export)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return exports, nil
+}
+
+// GetDue returns the scheduled exports belonging to activated users which were due to run at or
+// before the given time.
+func (m ExportModel) GetDue(ctx context.Context, now time.Time) ([]*DueExport, error) {
+	query := `
+		SELECT e.id, e.created_at, e.user_id, e.name, e.filter, e.format, e.frequency, e.new_only,
+			e.last_movie_id, e.next_run_at, e.last_run_at, e.artifact_key, e.version, u.email
+		FROM scheduled_exports e
+		INNER JOIN users u ON u.id = e.user_id
+		WHERE e.next_run_at <= $1 AND u.activated = true AND u.deleted_at IS NULL
+		ORDER BY e.next_run_at
+		`
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, now)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			m.ErrorLog.Println(err)
+		}
+	}()
+
+	due := []*DueExport{}
+
+	for rows.Next() {
+		var email string
+
+		export, err := scanScheduledExport(rows, &email)
+		if err != nil {
+			return nil, err
+		}
+
+		due = append(due, &DueExport{Export: export, Email: email})
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return due, nil
+}
+
+// Claim records that a scheduled export is being run, moving its next run time on. The version
+// check means that when several instances of the application find the same due export, only one
+// of them claims it; the others get ErrEditConflict and should skip it.
+func (m ExportModel) Claim(ctx context.Context, export *ScheduledExport, now time.Time) error {
+	query := `
+		UPDATE scheduled_exports
+		SET next_run_at = $1, last_run_at = $2, version = version + 1
+		WHERE id = $3 AND version = $4
+		RETURNING version
+		`
+
+	next := NextExportRun(export.Frequency, export.NextRunAt, now)
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, next, now, export.ID, export.Version).Scan(&export.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+
+	export.NextRunAt, export.LastRunAt = next, &now
+
+	return nil
+}
+
+// UpdateLastMovieID records the highest movie ID which has been included in an export.
+func (m ExportModel) UpdateLastMovieID(ctx context.Context, id, lastMovieID int64) error {
+	query := `
+		UPDATE scheduled_exports
+		SET last_movie_id = $1
+		WHERE id = $2 AND last_movie_id < $1
+		`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, lastMovieID, id)
+	return err
+}
+
+// GetArtifactKey returns the key of the object which holds the most recent run of a specific
+// scheduled export belonging to a user. ErrRecordNotFound is returned if the export doesn't exist
+// or hasn't run yet.
+func (m ExportModel) GetArtifactKey(ctx context.Context, id, userID int64) (string, error) {
+	if id < 1 {
+		return "", ErrRecordNotFound
+	}
+
+	query := `
+		SELECT artifact_key
+		FROM scheduled_exports
+		WHERE id = $1 AND user_id = $2 AND artifact_key <> ''
+		`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	var key string
+
+	err := m.DB.QueryRowContext(ctx, query, id, userID).Scan(&key)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return "", ErrRecordNotFound
+		default:
+			return "", err
+		}
+	}
+
+	return key, nil
+}
+
+// SetArtifactKey records the key of the object which holds the most recent run of an export.
+func (m ExportModel) SetArtifactKey(ctx context.Context, id int64, key string) error {
+	query := `
+		UPDATE scheduled_exports
+		SET artifact_key = $1
+		WHERE id = $2
+		`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, key, id)
+	return err
+}
+
+// ArtifactInUse reports whether any scheduled export refers to the object with the given key.
+// It's used to find the objects left behind by earlier runs of an export, and by exports which
+// have been deleted.
+func (m ExportModel) ArtifactInUse(ctx context.Context, key string) (bool, error) {
+	query := `
+		SELECT EXISTS(SELECT 1 FROM scheduled_exports WHERE artifact_key = $1)
+		`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	var exists bool
+
+	err := m.DB.QueryRowContext(ctx, query, key).Scan(&exists)
+	return exists, err
+}
+
+// Delete removes a specific scheduled export belonging to a user.
+func (m ExportModel) Delete(ctx context.Context, id, userID int64) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+
+	query := `
+		DELETE FROM scheduled_exports
+		WHERE id = $1 AND user_id = $2
+		`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	return withAudit(ctx, m.DB, AuditDelete, "exports", id, func(tx *sql.Tx) (int64, error) {
+		result, err := tx.ExecContext(ctx, query, id, userID)
+		if err != nil {
+			return 0, err
+		}
+
+		rowsAffected, err := result.RowsAffected()
+		if err != nil {
+			return 0, err
+		}
+
+		if rowsAffected == 0 {
+			return 0, ErrRecordNotFound
+		}
+
+		return id, nil
+	})
+}
+
+// ExportFilter returns the filter for the movies to include in the next run of the export.
+func (e *ScheduledExport) ExportFilter() SearchFilter {
+	if !e.NewOnly {
+		return e.Filter
+	}
+
+	return SearchFilter{
+		And: []SearchFilter{
+			e.Filter,
+			{Field: "id", Op: "gt", Value: json.RawMessage(strconv.FormatInt(e.LastMovieID, 10))},
+		},
+	}
+}
+
+// NextExportRun returns the next time an export with the given frequency should run after the
+// previous scheduled run. If the application was down for a while and the next run would still
+// be in the past, it skips forward rather than running the export several times to catch up.
+func NextExportRun(frequency string, previous, now time.Time) time.Time {
+	next := previous
+
+	for !next.After(now) {
+		switch frequency {
+		case "daily":
+			next = next.AddDate(0, 0, 1)
+		case "weekly":
+			next = next.AddDate(0, 0, 7)
+		default:
+			next = next.AddDate(0, 1, 0)
+		}
+	}
+
+	return next
+}
+
+// ValidateScheduledExport runs validation checks on the ScheduledExport type.
+func ValidateScheduledExport(v *validator.Validator, export *ScheduledExport) {
+	v.Check(export.Name != "", "name", "must be provided")
+	v.Check(len(export.Name) <= 100, "name", "must not be more than 100 bytes long")
+	v.Check(validator.In(export.Format, ExportFormats...), "format", "must be one of csv or json")
+	v.Check(validator.In(export.Frequency, ExportFrequencies...), "frequency",
+		"must be one of daily, weekly or monthly")
+
+	ValidateSearchFilter(v, &export.Filter)
+}
+
+// scanScheduledExport scans a scheduled_exports row into a ScheduledExport, decoding the JSON
+// filter. Any extra destinations are scanned from the columns following the export ones.
+func scanScheduledExport(row interface{ Scan(...interface{}) error }, extra ...interface{}) (*ScheduledExport, error) {
+	var (
+		export    ScheduledExport
+		filter    []byte
+		lastRunAt sql.NullTime
+	)
+
+	dest := append([]interface{}{
+		&export.ID,
+		&export.CreatedAt,
+		&export.UserID,
+		&export.Name,
+		&filter,
+		&export.Format,
+		&export.Frequency,
+		&export.NewOnly,
+		&export.LastMovieID,
+		&export.NextRunAt,
+		&lastRunAt,
+		&export.ArtifactKey,
+		&export.Version,
+	}, extra...)
+
+	err := row.Scan(dest...)
+	if err != nil {
+		return nil, err
+	}
+
+	if lastRunAt.Valid {
+		export.LastRunAt = &lastRunAt.Time
+	}
+
+	err = json.Unmarshal(filter, &export.Filter)
+	if err != nil {
+		return nil, err
+	}
+
+	return &export, nil
+}
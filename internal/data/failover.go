@@ -0,0 +1,102 @@
+package data
+
+import (
+	"database/sql/driver"
+	"errors"
+	"expvar"
+	"io"
+	"net"
+
+	"github.com/lib/pq"
+)
+
+// ErrFailover is returned when a query fails because the database is failing over to a new
+// primary, for example because the old primary was shut down or the connection now points at a
+// read-only standby. It's wrapped around the underlying error, so both errors.Is(err, ErrFailover)
+// and errors.As(err, &pqErr) work on the returned error.
+var ErrFailover = errors.New("database failover in progress")
+
+// failoverMetrics publishes the number of reads which were retried because of a failover
+// ("<name>_retries"), and the number of queries which failed because of one ("errors").
+var failoverMetrics = expvar.NewMap("database_failover")
+
+// failoverCodes holds the PostgreSQL error codes which mean that the server we're connected to
+// is going away or can no longer accept writes.
+var failoverCodes = map[pq.ErrorCode]bool{
+	"57P01": true, // admin_shutdown
+	"57P02": true, // crash_shutdown
+	"57P03": true, // cannot_connect_now
+	"25006": true, // read_only_sql_transaction
+	"08000": true, // connection_exception
+	"08003": true, // connection_does_not_exist
+	"08006": true, // connection_failure
+}
+
+// isFailoverError returns true if the error means that the connection to the database was lost,
+// or that the server can no longer accept writes.
+func isFailoverError(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		return failoverCodes[pqErr.Code]
+	}
+
+	var netErr *net.OpError
+
+	return errors.Is(err, driver.ErrBadConn) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.As(err, &netErr)
+}
+
+// failoverError wraps the error with ErrFailover if it was caused by a failover, so that the
+// handlers can send a 503 Service Unavailable response rather than a 500. Any other error is
+// returned unchanged.
+func failoverError(err error) error {
+	if !isFailoverError(err) {
+		return err
+	}
+
+	failoverMetrics.Add("errors", 1)
+
+	return &failoverErr{cause: err}
+}
+
+// failoverErr is the error returned by failoverError. It matches ErrFailover, and unwraps to the
+// error which caused it.
+type failoverErr struct {
+	cause error
+}
+
+func (e *failoverErr) Error() string {
+	return ErrFailover.Error() + ": " + e.cause.Error()
+}
+
+func (e *failoverErr) Is(target error) bool {
+	return target == ErrFailover
+}
+
+func (e *failoverErr) Unwrap() error {
+	return e.cause
+}
+
+// retryRead runs an idempotent read query, and if it fails because of a failover runs it once
+// more. Connections which fail like this are marked as bad and discarded by database/sql (and
+// the pq driver), so the retry runs on a fresh connection to whichever server is now the
+// primary. It must only be used for reads, because a write may have been applied before the
+// connection was lost.
+func retryRead[T any](name string, fn func() (T, error)) (T, error) {
+	v, err := fn()
+	if !isFailoverError(err) {
+		return v, err
+	}
+
+	failoverMetrics.Add(name+"_retries", 1)
+
+	v, err = fn()
+
+	return v, failoverError(err)
+}
@@ -21,6 +21,9 @@ type Metadata struct {
 	FirstPage    int `json:"first_page,omitempty"`
 	LastPage     int `json:"last_page,omitempty"`
 	TotalRecords int `json:"total_records,omitempty"`
+	// NextCursor is the cursor for the next page of results, when keyset pagination is used. It's
+	// empty on the last page.
+	NextCursor string `json:"next_cursor,omitempty"`
 }
 
 // calculateMetadata calculates the appropriate pagination metadata values given the total number
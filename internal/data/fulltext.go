@@ -0,0 +1,123 @@
+package data
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/codeaucafe/snippetbox/greenlight/internal/validator"
+	"github.com/lib/pq"
+)
+
+// MovieMatch is a movie matching a full-text search, along with its relevance rank and its title
+// with the matching terms highlighted in <mark> tags.
+type MovieMatch struct {
+	Movie     *Movie  `json:"movie"`
+	Rank      float64 `json:"rank"`
+	Highlight string  `json:"highlight"`
+}
+
+// searchTerms splits a full-text search query into its terms. Anything other than letters and
+// digits separates terms, so the terms can't contain tsquery operators.
+func searchTerms(q string) []string {
+	return strings.FieldsFunc(strings.ToLower(q), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// prefixTSQuery returns a tsquery matching documents which contain every term of the query as a
+// prefix of a word, so that "star wa" matches "Star Wars".
+func prefixTSQuery(q string) string {
+	terms := searchTerms(q)
+
+	for i := range terms {
+		terms[i] += ":*"
+	}
+
+	return strings.Join(terms, " & ")
+}
+
+// htmlEscapedTitle is the movie's title with the characters which are special in HTML replaced
+// by entities. The text search parser treats the entities as single tokens, so they aren't
+// highlighted and don't change which words are.
+const htmlEscapedTitle = `replace(replace(replace(replace(replace(title, '&', '&amp;'), '<', '&lt;'), '>', '&gt;'), '"', '&quot;'), '''', '&#39;')`
+
+// ValidateTextQuery runs validation checks on a full-text search query.
+func ValidateTextQuery(v *validator.Validator, q string) {
+	v.Check(q != "", "q", "must be provided")
+	v.Check(len(q) <= 200, "q", "must not be more than 200 bytes long")
+	v.Check(q == "" || len(searchTerms(q)) > 0, "q", "must contain at least one word")
+}
+
+// TextSearch returns a page of the movies whose titles match a full-text search query, which
+// must have passed ValidateTextQuery, ordered by relevance. Each term of the query matches as a
+// prefix, and the results include the title with the matching terms highlighted. The title is
+// HTML-escaped before it's highlighted, so that the highlight is safe to use as HTML: only the
+// <mark> tags are markup.
+func (m MovieModel) TextSearch(ctx context.Context, q string, filters Filters) ([]*MovieMatch, Metadata, error) {
+	query := fmt.Sprintf(`
+		SELECT count(*) OVER(), id, COALESCE(ulid, ''), created_at, title, year, runtime, release_date, poster_key, %s, version, created_by, updated_by, %s,
+			ts_rank(search_vector, query) AS rank,
+			ts_headline('simple', %s, query, 'StartSel=<mark>, StopSel=</mark>, HighlightAll=true')
+		FROM movies, to_tsquery('simple', $1) AS query
+		WHERE search_vector @@ query AND deleted_at IS NULL
+		ORDER BY rank DESC, id ASC
+		LIMIT $2 OFFSET $3`,
+		movieGenres, movieAverageRating, htmlEscapedTitle)
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, prefixTSQuery(q), filters.limit(), filters.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			m.ErrorLog.Println(err)
+		}
+	}()
+
+	totalRecords := 0
+	matches := []*MovieMatch{}
+
+	for rows.Next() {
+		var (
+			movie Movie
+			match MovieMatch
+		)
+
+		err := rows.Scan(
+			&totalRecords,
+			&movie.ID,
+			&movie.ULID,
+			&movie.CreatedAt,
+			&movie.Title,
+			&movie.Year,
+			&movie.Runtime,
+			&movie.ReleaseDate,
+			moviePoster(&movie),
+			pq.Array(&movie.Genres),
+			&movie.Version,
+			&movie.CreatedBy,
+			&movie.UpdatedBy,
+			&movie.AverageRating,
+			&match.Rank,
+			&match.Highlight,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		match.Movie = &movie
+		matches = append(matches, &match)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	return matches, calculateMetadata(totalRecords, filters.Page, filters.PageSize), nil
+}
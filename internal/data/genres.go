@@ -0,0 +1,165 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Genre is a movie genre. Genres are created when a movie is first given them, and their names
+// are case-insensitive, so every movie in "Sci-Fi" shares the genre whichever way it was spelled.
+type Genre struct {
+	ID        int64     `json:"id"`
+	CreatedAt time.Time `json:"-"`
+	Name      string    `json:"name"`
+	Movies    int64     `json:"movies"` // The number of movies in the genre
+}
+
+// genresOf returns the SQL expression for the names of a movie's genres, in the order they were
+// given, where table is the name or alias of the movies table in the query.
+func genresOf(table string) string {
+	return fmt.Sprintf(`ARRAY(SELECT g.name::text FROM movie_genres mg INNER JOIN genres g ON g.id = mg.genre_id WHERE mg.movie_id = %s.id ORDER BY mg.position)`, table)
+}
+
+// movieGenres is the SQL expression for the names of a movie's genres, in queries which select
+// from the movies table without an alias.
+var movieGenres = genresOf("movies")
+
+// hasGenres returns the SQL condition matching the movies which are in every one of the genres
+// in the array parameter param (such as "$2"), or every movie if the array is empty. It looks
+// the movies up through the movie_genres table's genre index, rather than building the genres
+// array for each movie and comparing it.
+func hasGenres(param string) string {
+	return fmt.Sprintf(`(cardinality(%[1]s::citext[]) = 0 OR movies.id IN (
+			SELECT mg.movie_id FROM movie_genres mg INNER JOIN genres g ON g.id = mg.genre_id
+			WHERE g.name = ANY(%[1]s::citext[])
+			GROUP BY mg.movie_id
+			HAVING count(*) = cardinality(ARRAY(SELECT DISTINCT unnest(%[1]s::citext[])))))`, param)
+}
+
+// setMovieGenres replaces the genres of a movie with movie.Genres, as part of the transaction
+// which writes the movie, creating any genres which don't exist yet. movie.Genres is then updated
+// with the genres' names as they're stored, so that the movie is returned with the same spelling
+// of each genre as every other movie in it.
+func setMovieGenres(ctx context.Context, tx *sql.Tx, movie *Movie) error {
+	_, err := tx.ExecContext(ctx, `
+		INSERT INTO genres (name)
+		SELECT DISTINCT unnest($1::citext[])
+		ON CONFLICT (name) DO NOTHING`,
+		pq.Array(movie.Genres))
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, "DELETE FROM movie_genres WHERE movie_id = $1", movie.ID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO movie_genres (movie_id, genre_id, position)
+		SELECT $1::bigint, g.id, MIN(n.position)
+		FROM unnest($2::citext[]) WITH ORDINALITY AS n(name, position)
+		INNER JOIN genres g ON g.name = n.name
+		GROUP BY g.id`,
+		movie.ID, pq.Array(movie.Genres))
+	if err != nil {
+		return err
+	}
+
+	return tx.QueryRowContext(ctx, "SELECT "+movieGenres+" FROM movies WHERE id = $1", movie.ID).
+		Scan(pq.Array(&movie.Genres))
+}
+
+// GenreModel struct wraps a sql.DB connection pool and allows us to work with the Genre struct
+// type and the genres and movie_genres tables in our database.
+type GenreModel struct {
+	DB       *sql.DB
+	InfoLog  *log.Logger
+	ErrorLog *log.Logger
+}
+
+// Get returns the genre with the given ID, along with the number of movies in it.
+// ErrRecordNotFound is returned if there isn't one.
+func (m GenreModel) Get(ctx context.Context, id int64) (*Genre, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `
+		SELECT g.id, g.created_at, g.name, (SELECT count(*) FROM movie_genres mg INNER JOIN movies m ON m.id = mg.movie_id
+			WHERE mg.genre_id = g.id AND m.deleted_at IS NULL)
+		FROM genres g
+		WHERE g.id = $1
+		`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	var genre Genre
+
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(&genre.ID, &genre.CreatedAt, &genre.Name, &genre.Movies)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &genre, nil
+}
+
+// GetAll returns a page of the genres which have at least one movie, sorted according to the
+// filters, along with the number of movies in each.
+func (m GenreModel) GetAll(ctx context.Context, filters Filters) ([]*Genre, Metadata, error) {
+	query := fmt.Sprintf(`
+		SELECT count(*) OVER(), g.id, g.created_at, g.name, count(mg.movie_id) AS movies
+		FROM genres g
+		INNER JOIN movie_genres mg ON mg.genre_id = g.id
+		INNER JOIN movies m ON m.id = mg.movie_id
+		WHERE m.deleted_at IS NULL
+		GROUP BY g.id
+		ORDER BY %s %s, g.id ASC
+		LIMIT $1 OFFSET $2`,
+		filters.sortColumn(), filters.sortDirection())
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, filters.limit(), filters.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			m.ErrorLog.Println(err)
+		}
+	}()
+
+	totalRecords := 0
+	genres := []*Genre{}
+
+	for rows.Next() {
+		var genre Genre
+
+		err := rows.Scan(&totalRecords, &genre.ID, &genre.CreatedAt, &genre.Name, &genre.Movies)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		genres = append(genres, &genre)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	return genres, calculateMetadata(totalRecords, filters.Page, filters.PageSize), nil
+}
@@ -0,0 +1,94 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"sync"
+	"time"
+)
+
+// LeaderLock is a PostgreSQL session-level advisory lock, which is used to elect a single leader
+// among the running instances of the application. Advisory locks belong to a database
+// connection, so the lock holds its own dedicated connection from the pool for as long as it is
+// held. If the leader crashes or loses its connection then PostgreSQL releases the lock, and
+// another instance can take over.
+type LeaderLock struct {
+	DB  *sql.DB
+	Key int64
+
+	mu   sync.Mutex
+	conn *sql.Conn
+}
+
+// NewLeaderLock returns a new LeaderLock for the advisory lock with the given key.
+func NewLeaderLock(db *sql.DB, key int64) *LeaderLock {
+	return &LeaderLock{DB: db, Key: key}
+}
+
+// Hold tries to acquire the lock, or checks that it is still held if it was acquired by an
+// earlier call, and returns whether this instance is the leader. If the connection holding the
+// lock has failed then the lock is dropped, and false is returned along with the error.
+func (l *LeaderLock) Hold() (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	if l.conn != nil {
+		_, err := l.conn.ExecContext(ctx, "SELECT 1")
+		if err != nil {
+			l.closeConn()
+			return false, err
+		}
+
+		return true, nil
+	}
+
+	conn, err := l.DB.Conn(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	var acquired bool
+
+	err = conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock($1)", l.Key).Scan(&acquired)
+	if err != nil || !acquired {
+		_ = conn.Close()
+		return false, err
+	}
+
+	l.conn = conn
+
+	return true, nil
+}
+
+// Release releases the lock if it is held, so that another instance can take over straight away
+// rather than once the connection times out.
+func (l *LeaderLock) Release() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.conn == nil {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := l.conn.ExecContext(ctx, "SELECT pg_advisory_unlock($1)", l.Key)
+
+	l.closeConn()
+
+	return err
+}
+
+// closeConn closes the lock's connection. Returning driver.ErrBadConn from Raw() makes
+// database/sql discard the connection rather than put it back in the pool, so that a lock which
+// couldn't be released cleanly can never be left held by a pooled connection.
+func (l *LeaderLock) closeConn() {
+	_ = l.conn.Raw(func(interface{}) error { return driver.ErrBadConn })
+	_ = l.conn.Close()
+	l.conn = nil
+}
@@ -5,6 +5,8 @@ import (
 	"errors"
 	"log"
 	"os"
+
+	"github.com/codeaucafe/snippetbox/greenlight/internal/clock"
 )
 
 var (
@@ -17,10 +19,37 @@ var (
 
 // Models struct is a single convenient container to hold and represent all our database models.
 type Models struct {
-	Movies      MovieModel
-	Users       UserModel
-	Tokens      TokenModel
-	Permissions PermissionModel
+	Movies        MovieModel
+	Users         UserModel
+	Tokens        TokenModel
+	Permissions   PermissionModel
+	System        SystemModel
+	Settings      SettingsModel
+	Quotas        QuotaModel
+	Usage         UsageModel
+	Searches      SavedSearchModel
+	Exports       ExportModel
+	Reports       ReportModel
+	Stats         StatsModel
+	Recent        RecentlyViewedModel
+	Outbox        OutboxModel
+	Tasks         TaskModel
+	Reviews       ReviewModel
+	EmailLimits   EmailLimitModel
+	Announcements AnnouncementModel
+	Duplicates    DuplicateModel
+	AbuseReports  AbuseReportModel
+	APIKeys       APIKeyModel
+	Events        EventModel
+	Genres        GenreModel
+	People        PersonModel
+	Credits       CreditModel
+	Notifications NotificationModel
+	Digests       DigestModel
+	Audit         AuditModel
+	Status        StatusModel
+	Incidents     IncidentModel
+	Webhooks      WebhookModel
 }
 
 func NewModels(db *sql.DB) Models {
@@ -31,21 +60,167 @@ func NewModels(db *sql.DB) Models {
 			DB:       db,
 			InfoLog:  infoLog,
 			ErrorLog: errorLog,
+			flight:   newQueryGroup(),
+			Broker:   NewEventBroker(),
 		},
 		Users: UserModel{
 			DB:       db,
 			InfoLog:  infoLog,
 			ErrorLog: errorLog,
+			Clock:    clock.Real{},
 		},
 		Tokens: TokenModel{
 			DB:       db,
 			InfoLog:  infoLog,
 			ErrorLog: errorLog,
+			Clock:    clock.Real{},
 		},
 		Permissions: PermissionModel{
 			DB:       db,
 			InfoLog:  infoLog,
 			ErrorLog: errorLog,
 		},
+		System: SystemModel{
+			DB:       db,
+			InfoLog:  infoLog,
+			ErrorLog: errorLog,
+		},
+		Settings: SettingsModel{
+			DB:       db,
+			InfoLog:  infoLog,
+			ErrorLog: errorLog,
+		},
+		Quotas: QuotaModel{
+			DB:       db,
+			InfoLog:  infoLog,
+			ErrorLog: errorLog,
+		},
+		Usage: UsageModel{
+			DB:       db,
+			InfoLog:  infoLog,
+			ErrorLog: errorLog,
+		},
+		Searches: SavedSearchModel{
+			DB:       db,
+			InfoLog:  infoLog,
+			ErrorLog: errorLog,
+		},
+		Exports: ExportModel{
+			DB:       db,
+			InfoLog:  infoLog,
+			ErrorLog: errorLog,
+		},
+		Reports: ReportModel{
+			DB:       db,
+			InfoLog:  infoLog,
+			ErrorLog: errorLog,
+		},
+		Stats: StatsModel{
+			DB:       db,
+			InfoLog:  infoLog,
+			ErrorLog: errorLog,
+		},
+		Recent: RecentlyViewedModel{
+			DB:       db,
+			InfoLog:  infoLog,
+			ErrorLog: errorLog,
+		},
+		Outbox: OutboxModel{
+			DB:       db,
+			InfoLog:  infoLog,
+			ErrorLog: errorLog,
+		},
+		Tasks: TaskModel{
+			DB:       db,
+			InfoLog:  infoLog,
+			ErrorLog: errorLog,
+		},
+		Reviews: ReviewModel{
+			DB:       db,
+			InfoLog:  infoLog,
+			ErrorLog: errorLog,
+		},
+		EmailLimits: EmailLimitModel{
+			DB:       db,
+			InfoLog:  infoLog,
+			ErrorLog: errorLog,
+		},
+		Announcements: AnnouncementModel{
+			DB:       db,
+			InfoLog:  infoLog,
+			ErrorLog: errorLog,
+		},
+		Duplicates: DuplicateModel{
+			DB:       db,
+			InfoLog:  infoLog,
+			ErrorLog: errorLog,
+		},
+		AbuseReports: AbuseReportModel{
+			DB:       db,
+			InfoLog:  infoLog,
+			ErrorLog: errorLog,
+		},
+		APIKeys: APIKeyModel{
+			DB:       db,
+			InfoLog:  infoLog,
+			ErrorLog: errorLog,
+		},
+		Events: EventModel{
+			DB:       db,
+			InfoLog:  infoLog,
+			ErrorLog: errorLog,
+		},
+		Genres: GenreModel{
+			DB:       db,
+			InfoLog:  infoLog,
+			ErrorLog: errorLog,
+		},
+		People: PersonModel{
+			DB:       db,
+			InfoLog:  infoLog,
+			ErrorLog: errorLog,
+		},
+		Credits: CreditModel{
+			DB:       db,
+			InfoLog:  infoLog,
+			ErrorLog: errorLog,
+		},
+		Notifications: NotificationModel{
+			DB:       db,
+			InfoLog:  infoLog,
+			ErrorLog: errorLog,
+		},
+		Digests: DigestModel{
+			DB:       db,
+			InfoLog:  infoLog,
+			ErrorLog: errorLog,
+		},
+		Audit: AuditModel{
+			DB:       db,
+			InfoLog:  infoLog,
+			ErrorLog: errorLog,
+		},
+		Status: StatusModel{
+			DB:       db,
+			InfoLog:  infoLog,
+			ErrorLog: errorLog,
+		},
+		Incidents: IncidentModel{
+			DB:       db,
+			InfoLog:  infoLog,
+			ErrorLog: errorLog,
+		},
+		Webhooks: WebhookModel{
+			DB:       db,
+			InfoLog:  infoLog,
+			ErrorLog: errorLog,
+		},
 	}
 }
+
+// SetClock replaces the clock used by the models which work with expiry times, such as the token
+// expiry. It's used by tests to control time.
+func (m *Models) SetClock(c clock.Clock) {
+	m.Users.Clock = c
+	m.Tokens.Clock = c
+}
@@ -3,9 +3,12 @@ package data
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/codeaucafe/snippetbox/greenlight/internal/validator"
@@ -18,14 +21,74 @@ import (
 // value 0, then it will be considered empty and omitted -- and the MarshalJSON() method won't
 // be called.
 type Movie struct {
-	ID        int64     `json:"id"` // Unique integer ID for the movie
-	CreatedAt time.Time `json:"-"`  // Use the - directive to never export in JSON output
+	ID        int64     `json:"id"`             // Unique integer ID for the movie
+	ULID      string    `json:"ulid,omitempty"` // Public ID, usable in place of ID (see BackfillULIDs)
+	CreatedAt time.Time `json:"-"`              // Use the - directive to never export in JSON output
 	Title     string    `json:"title"`
 	Year      int32     `json:"year,omitempty"` // Movie release year0
 	Runtime   Runtime   `json:"runtime,omitempty"`
-	Genres    []string  `json:"genres,omitempty"`
-	Version   int32     `json:"version"` // The version number starts at 1 and is incremented each
+	// ReleaseDate is the date the movie is released, if it's known. Users can subscribe to be
+	// notified when a movie which hasn't been released yet comes out (see NotificationModel.Subscribe).
+	ReleaseDate *Date `json:"release_date,omitempty"`
+	// PosterKey is the storage key prefix of the movie's poster images, and PosterURL is where
+	// they can be downloaded from. Both are empty if the movie doesn't have a poster (see
+	// MovieModel.SetPoster).
+	PosterKey string   `json:"-"`
+	PosterURL string   `json:"poster_url,omitempty"`
+	Genres    []string `json:"genres,omitempty"`
+	Version   int32    `json:"version"` // The version number starts at 1 and is incremented each
 	// time the movie information is updated.
+	CreatedBy *int64 `json:"created_by"` // ID of the user who created the movie, if known
+	UpdatedBy *int64 `json:"updated_by"` // ID of the user who last changed the movie, if known
+	// AverageRating is the average rating of the movie's approved reviews, or nil if it hasn't
+	// been reviewed. It's calculated when the movie is read, so it isn't part of the movie's version.
+	AverageRating *float64 `json:"average_rating"`
+	// DeletedAt is when the movie was moved to the trash. It's only filled in for the movies
+	// returned by GetAllDeleted.
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+	// Cast holds the movie's top-billed cast. It's only filled in for the movie detail endpoint,
+	// and is read from the credits, so it's left empty by the MovieModel methods.
+	Cast []*Credit `json:"cast,omitempty"`
+}
+
+// movieAverageRating is the SQL expression for the average rating of a movie's approved reviews,
+// rounded to one decimal place. It's NULL for movies without any approved reviews.
+const movieAverageRating = `(SELECT ROUND(AVG(rating), 1) FROM reviews WHERE reviews.movie_id = movies.id AND reviews.status = 'approved')`
+
+// copy returns a deep copy of the movie.
+func (movie *Movie) copy() *Movie {
+	c := *movie
+	c.Genres = append([]string(nil), movie.Genres...)
+	c.CreatedBy = copyID(movie.CreatedBy)
+	c.UpdatedBy = copyID(movie.UpdatedBy)
+	if movie.ReleaseDate != nil {
+		date := *movie.ReleaseDate
+		c.ReleaseDate = &date
+	}
+	if movie.AverageRating != nil {
+		rating := *movie.AverageRating
+		c.AverageRating = &rating
+	}
+	if movie.DeletedAt != nil {
+		deletedAt := *movie.DeletedAt
+		c.DeletedAt = &deletedAt
+	}
+	c.Cast = nil
+	for _, credit := range movie.Cast {
+		credit := *credit
+		c.Cast = append(c.Cast, &credit)
+	}
+	return &c
+}
+
+// copyID returns a copy of a nullable ID.
+func copyID(id *int64) *int64 {
+	if id == nil {
+		return nil
+	}
+
+	c := *id
+	return &c
 }
 
 // MovieModel struct wraps a sql.DB connection pool and allows us to work with Movie struct type
@@ -34,32 +97,148 @@ type MovieModel struct {
 	DB       *sql.DB
 	InfoLog  *log.Logger
 	ErrorLog *log.Logger
+	// flight coalesces concurrent identical reads from Get and GetAll.
+	flight *queryGroup
+	// Broker is sent the movie.* events once the writes they describe have committed.
+	Broker *EventBroker
 }
 
 // Insert accepts a pointer to a movie struct, which should contain the data for the
-// new record and inserts the record into the movies table.
-func (m MovieModel) Insert(movie *Movie) error {
+// new record and inserts the record into the movies table. Like the other write methods, it
+// takes the request context, which carries the authenticated user and request ID (see
+// ContextWithUser()), and cancels the query if the request is cancelled. The user is recorded
+// as the creator of the movie.
+func (m MovieModel) Insert(ctx context.Context, movie *Movie) error {
 	query := `
-		INSERT INTO movies (title, year, runtime, genres) 
-		VALUES ($1, $2, $3, $4) 
-		RETURNING id, created_at, version
+		INSERT INTO movies (title, year, runtime, created_by, updated_by, ulid, release_date) 
+		VALUES ($1, $2, $3, $4, $4, $5, $6) 
+		RETURNING id, created_at, version, created_by, updated_by
 		`
 
-	// Create a context with a 3-second timeout.
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	// Create a context with a 3-second timeout, derived from the request context.
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 
 	// Create an args slice containing the values for the placeholder parameters from the movie
 	// struct. Declaring this slice immediately next to our SQL query helps to make it nice and
 	// clear *what values are being user where* in the query
-	args := []interface{}{movie.Title, movie.Year, movie.Runtime, pq.Array(movie.Genres)}
+	movie.ULID = newULID(time.Now())
+
+	args := []interface{}{movie.Title, movie.Year, movie.Runtime, actorID(ctx), movie.ULID, movie.ReleaseDate}
+
+	// Link the movie to its genres, and record a movie.created event, in the same transaction.
+	err := withEvent(ctx, m.DB, m.Broker, func(tx *sql.Tx) (string, int64, interface{}, error) {
+		err := tx.QueryRowContext(ctx, query, args...).Scan(&movie.ID, &movie.CreatedAt, &movie.Version,
+			&movie.CreatedBy, &movie.UpdatedBy)
+		if err != nil {
+			return "", 0, nil, err
+		}
+
+		err = setMovieGenres(ctx, tx, movie)
+		if err != nil {
+			return "", 0, nil, err
+		}
+
+		err = newAudit(AuditCreate, "movies").record(ctx, tx, movie.ID)
+		return EventMovieCreated, movie.ID, movie, err
+	})
+	return failoverError(err)
+}
+
+// InsertBatch adds a batch of movies in a single transaction, filling in the system-generated
+// fields of each one, so that either all of the movies are added or none of them are. It's used
+// by bulk imports, where inserting each movie in its own transaction would be far too slow.
+func (m MovieModel) InsertBatch(ctx context.Context, movies []*Movie) error {
+	query := `
+		INSERT INTO movies (title, year, runtime, created_by, updated_by, ulid, release_date)
+		VALUES ($1, $2, $3, $4, $4, $5, $6)
+		RETURNING id, created_at, version, created_by, updated_by
+		`
+
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return failoverError(err)
+	}
+
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	stmt, err := tx.PrepareContext(ctx, query)
+	if err != nil {
+		return failoverError(err)
+	}
+
+	defer func() {
+		if err := stmt.Close(); err != nil {
+			m.ErrorLog.Println(err)
+		}
+	}()
+
+	actor := actorID(ctx)
+	events := make([]*Event, 0, len(movies))
+
+	for _, movie := range movies {
+		movie.ULID = newULID(time.Now())
+
+		args := []interface{}{movie.Title, movie.Year, movie.Runtime, actor, movie.ULID, movie.ReleaseDate}
+
+		err := stmt.QueryRowContext(ctx, args...).Scan(&movie.ID, &movie.CreatedAt, &movie.Version,
+			&movie.CreatedBy, &movie.UpdatedBy)
+		if err != nil {
+			return failoverError(err)
+		}
+
+		err = setMovieGenres(ctx, tx, movie)
+		if err != nil {
+			return failoverError(err)
+		}
+
+		event, err := insertEvent(ctx, tx, EventMovieCreated, movie.ID, movie)
+		if err != nil {
+			return failoverError(err)
+		}
+
+		events = append(events, event)
+
+		err = newAudit(AuditCreate, "movies").record(ctx, tx, movie.ID)
+		if err != nil {
+			return failoverError(err)
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return failoverError(err)
+	}
 
-	return m.DB.QueryRowContext(ctx, query, args...).Scan(&movie.ID, &movie.CreatedAt, &movie.Version)
+	m.Broker.Publish(events...)
+	return nil
 }
 
 // Get fetches a record from the movies table and returns the corresponding Movie struct.
+// Concurrent calls for the same movie are coalesced into a single query, and each caller gets
+// its own copy of the movie so that it is free to modify it. The query is retried once if it
+// fails because of a database failover.
+func (m MovieModel) Get(ctx context.Context, id int64) (*Movie, error) {
+	v, err := m.flight.do(ctx, "movies_get", strconv.FormatInt(id, 10), func(ctx context.Context) (interface{}, error) {
+		return retryRead("movies_get", func() (*Movie, error) {
+			return m.get(ctx, id)
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return v.(*Movie).copy(), nil
+}
+
+// get fetches a record from the movies table and returns the corresponding Movie struct.
 // It cancels the query call if the SQL query does not finish within 3 seconds.
-func (m MovieModel) Get(id int64) (*Movie, error) {
+func (m MovieModel) get(ctx context.Context, id int64) (*Movie, error) {
 	// The PostgreSQL bigserial type that we're using for the movie ID starts auto-incrementing
 	// at 1 by default, so we know that no movies will have ID values less tan that.
 	// To avoid making an unnecessary database call,
@@ -68,18 +247,18 @@ func (m MovieModel) Get(id int64) (*Movie, error) {
 		return nil, ErrRecordNotFound
 	}
 
-	query := `
-		SELECT id, created_at, title, year, runtime, genres, version
-        FROM movies
- 		WHERE id = $1
- 		`
+	query := fmt.Sprintf(`
+		SELECT id, COALESCE(ulid, ''), created_at, title, year, runtime, release_date, poster_key, %s, version, created_by, updated_by, %s
+		FROM movies
+		WHERE id = $1 AND deleted_at IS NULL`,
+		movieGenres, movieAverageRating)
 
 	var movie Movie
 
 	// Use the context.WithTimeout() function to create a context.Context which carries a 3-second
-	// timeout deadline. Note, that we're using the empty context.Background() as the
-	// 'parent' context.
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	// timeout deadline. Note, that we're using the caller's ctx as the 'parent' context, so that
+	// the query is also canceled if the request is, and is traced as part of it.
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	// Defer cancel to make sure that we cancel the context before the Get() method returns
 	defer cancel()
 
@@ -87,12 +266,18 @@ func (m MovieModel) Get(id int64) (*Movie, error) {
 	// deadline ctx as the first argument.
 	err := m.DB.QueryRowContext(ctx, query, id).Scan(
 		&movie.ID,
+		&movie.ULID,
 		&movie.CreatedAt,
 		&movie.Title,
 		&movie.Year,
 		&movie.Runtime,
+		&movie.ReleaseDate,
+		moviePoster(&movie),
 		pq.Array(&movie.Genres),
-		&movie.Version)
+		&movie.Version,
+		&movie.CreatedBy,
+		&movie.UpdatedBy,
+		&movie.AverageRating)
 
 	// Handle any errors. If there was no matching movie found, Scan() will return a sql.ErrNoRows
 	// error. We check for this and return our custom ErrRecordNotFound error instead.
@@ -108,13 +293,95 @@ func (m MovieModel) Get(id int64) (*Movie, error) {
 	return &movie, nil
 }
 
-// Update updates a specific movie in the movies table.
-func (m MovieModel) Update(movie *Movie) error {
+// GetMany returns the movies with the given IDs which exist, keyed by ID, in a single query. It's
+// used to batch the lookups of many movies at once, such as the movies of a page of reviews.
+func (m MovieModel) GetMany(ctx context.Context, ids []int64) (map[int64]*Movie, error) {
+	query := fmt.Sprintf(`
+		SELECT id, COALESCE(ulid, ''), created_at, title, year, runtime, release_date, poster_key, %s, version, created_by, updated_by, %s
+		FROM movies
+		WHERE id = ANY($1) AND deleted_at IS NULL`,
+		movieGenres, movieAverageRating)
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, pq.Array(ids))
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			m.ErrorLog.Println(err)
+		}
+	}()
+
+	movies := make(map[int64]*Movie, len(ids))
+
+	for rows.Next() {
+		var movie Movie
+
+		err := rows.Scan(
+			&movie.ID,
+			&movie.ULID,
+			&movie.CreatedAt,
+			&movie.Title,
+			&movie.Year,
+			&movie.Runtime,
+			&movie.ReleaseDate,
+			moviePoster(&movie),
+			pq.Array(&movie.Genres),
+			&movie.Version,
+			&movie.CreatedBy,
+			&movie.UpdatedBy,
+			&movie.AverageRating)
+		if err != nil {
+			return nil, err
+		}
+
+		movies[movie.ID] = &movie
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return movies, nil
+}
+
+// GetID returns the ID of the movie with the given ULID, so that movies can be looked up by
+// either. ErrRecordNotFound is returned if there isn't one.
+func (m MovieModel) GetID(ctx context.Context, ulid string) (int64, error) {
+	query := `
+		SELECT id
+		FROM movies
+		WHERE ulid = $1`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	var id int64
+
+	err := m.DB.QueryRowContext(ctx, query, ulid).Scan(&id)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return 0, ErrRecordNotFound
+		default:
+			return 0, failoverError(err)
+		}
+	}
+
+	return id, nil
+}
+
+// Update updates a specific movie in the movies table, recording the user in the context as
+// the last user to change it.
+func (m MovieModel) Update(ctx context.Context, movie *Movie) error {
 	query := `
 		UPDATE movies
-		SET title = $1, year = $2, runtime = $3, genres = $4, version = version + 1
-		WHERE id = $5 AND version = $6
-		RETURNING version
+		SET title = $1, year = $2, runtime = $3, updated_by = $6, release_date = $7, version = version + 1
+		WHERE id = $4 AND version = $5 AND deleted_at IS NULL
+		RETURNING version, updated_by
 		`
 
 	// Create an args slice containing the values for the placeholder parameters.
@@ -122,94 +389,211 @@ func (m MovieModel) Update(movie *Movie) error {
 		movie.Title,
 		movie.Year,
 		movie.Runtime,
-		pq.Array(movie.Genres),
 		movie.ID,
 		movie.Version, // Add the expected movie version.
+		actorID(ctx),
+		movie.ReleaseDate,
 	}
 
-	// Create a context with a 3-second timeout.
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	// Create a context with a 3-second timeout, derived from the request context.
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 
-	// Execute the SQL query. If no matching row could be found, we know the movie version
-	// has changed (or the record has been deleted) and we return ErrEditConflict.
-	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&movie.Version)
+	// Execute the SQL query, replacing the movie's genres and recording a movie.updated event in
+	// the same transaction. If no matching row could be found, we know the movie version has
+	// changed (or the record has been deleted) and we return ErrEditConflict.
+	change := newAudit(AuditUpdate, "movies")
+
+	err := withEvent(ctx, m.DB, m.Broker, func(tx *sql.Tx) (string, int64, interface{}, error) {
+		err := change.before(ctx, tx, movie.ID)
+		if err != nil {
+			return "", 0, nil, err
+		}
+
+		err = tx.QueryRowContext(ctx, query, args...).Scan(&movie.Version, &movie.UpdatedBy)
+		if err != nil {
+			return "", 0, nil, err
+		}
+
+		err = setMovieGenres(ctx, tx, movie)
+		if err != nil {
+			return "", 0, nil, err
+		}
+
+		err = change.record(ctx, tx, movie.ID)
+		return EventMovieUpdated, movie.ID, movie, err
+	})
 	if err != nil {
 		switch {
 		case errors.Is(err, sql.ErrNoRows):
 			return ErrEditConflict
 		default:
-			return err
+			return failoverError(err)
 		}
 	}
 
 	return nil
 }
 
-// Delete is a placeholder method for deleting a specific record in the movies table.
-func (m MovieModel) Delete(id int64) error {
+// Delete moves a specific movie to the trash, by setting its deleted_at time, and records a
+// movie.deleted event. A movie in the trash is left out of everything else the MovieModel does,
+// as if it had been deleted, until it's restored with Restore or purged for good by PurgeDeleted.
+// Its version is bumped, so that requests made with an ETag from before it was deleted fail.
+func (m MovieModel) Delete(ctx context.Context, id int64) error {
 	// Return an ErrRecordNotFound error if the movie ID is less than 1
 	if id < 1 {
 		return ErrRecordNotFound
 	}
 
 	query := `
-		DELETE FROM movies
-		WHERE id = $1
+		UPDATE movies
+		SET deleted_at = NOW(), updated_by = $2, version = version + 1
+		WHERE id = $1 AND deleted_at IS NULL
 		`
 
-	// Create a context with a 3-second timeout.
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	// Create a context with a 3-second timeout, derived from the request context.
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 
-	// Execute the SQL query using the Exec() method,
-	// passing in the id variable as the value for the placeholder parameter. The Exec(
-	// ) method returns a sql.Result object.
-	result, err := m.DB.ExecContext(ctx, query, id)
-	if err != nil {
-		return err
+	// Execute the SQL query using the Exec() method, passing in the id variable as the value for
+	// the placeholder parameter, and record a movie.deleted event in the same transaction.
+	change := newAudit(AuditDelete, "movies")
+
+	err := withEvent(ctx, m.DB, m.Broker, func(tx *sql.Tx) (string, int64, interface{}, error) {
+		err := change.before(ctx, tx, id)
+		if err != nil {
+			return "", 0, nil, err
+		}
+
+		result, err := tx.ExecContext(ctx, query, id, actorID(ctx))
+		if err != nil {
+			return "", 0, nil, err
+		}
+
+		// Call the RowsAffected() method on the sql.Result object to get the number of rows
+		// affected by the query. If no rows were affected, we know that the movies table didn't
+		// contain a record with the provided ID (outside the trash) at the moment we tried to
+		// delete it. In that case we return an ErrRecordNotFound error.
+		rowsAffected, err := result.RowsAffected()
+		if err != nil {
+			return "", 0, nil, err
+		}
+
+		if rowsAffected == 0 {
+			return "", 0, nil, ErrRecordNotFound
+		}
+
+		err = change.record(ctx, tx, id)
+		return EventMovieDeleted, id, map[string]int64{"id": id}, err
+	})
+
+	return failoverError(err)
+}
+
+// DeleteVersion moves a specific movie to the trash in the same way as Delete, but only if it
+// still has the given version. If the movie has been updated or deleted since that version was
+// read, ErrEditConflict is returned.
+func (m MovieModel) DeleteVersion(ctx context.Context, id int64, version int32) error {
+	if id < 1 {
+		return ErrRecordNotFound
 	}
 
-	// Call the RowsAffected() method on the sql.Result
-	// object to get the number of rows affected by the query.
-	rowsAffected, err := result.RowsAffected()
+	query := `
+		UPDATE movies
+		SET deleted_at = NOW(), updated_by = $3, version = version + 1
+		WHERE id = $1 AND version = $2 AND deleted_at IS NULL
+		`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	change := newAudit(AuditDelete, "movies")
+
+	err := withEvent(ctx, m.DB, m.Broker, func(tx *sql.Tx) (string, int64, interface{}, error) {
+		err := change.before(ctx, tx, id)
+		if err != nil {
+			return "", 0, nil, err
+		}
+
+		result, err := tx.ExecContext(ctx, query, id, version, actorID(ctx))
+		if err != nil {
+			return "", 0, nil, err
+		}
+
+		rowsAffected, err := result.RowsAffected()
+		if err != nil {
+			return "", 0, nil, err
+		}
+
+		if rowsAffected == 0 {
+			return "", 0, nil, ErrEditConflict
+		}
+
+		err = change.record(ctx, tx, id)
+		return EventMovieDeleted, id, map[string]int64{"id": id}, err
+	})
+
+	return failoverError(err)
+}
+
+// moviePage holds the results of GetAll, so that they can be shared between coalesced calls.
+type moviePage struct {
+	movies   []*Movie
+	metadata Metadata
+}
+
+// GetAll returns a list of movies in the form of a string of Movie type based on a set of
+// provided filters. If createdBy isn't zero, only the movies created by that user are returned.
+// As for Get, concurrent calls with identical filters are coalesced into a single query, which
+// is retried once if it fails because of a database failover.
+func (m MovieModel) GetAll(ctx context.Context, title string, genres []string, createdBy int64, filters Filters) ([]*Movie, Metadata, error) {
+	key := FiltersFingerprint(title, strings.Join(genres, ","), strconv.FormatInt(createdBy, 10),
+		strconv.Itoa(filters.Page), strconv.Itoa(filters.PageSize), filters.Sort)
+
+	v, err := m.flight.do(ctx, "movies_get_all", key, func(ctx context.Context) (interface{}, error) {
+		return retryRead("movies_get_all", func() (*moviePage, error) {
+			movies, metadata, err := m.getAll(ctx, title, genres, createdBy, filters)
+			return &moviePage{movies: movies, metadata: metadata}, err
+		})
+	})
 	if err != nil {
-		return err
+		return nil, Metadata{}, err
 	}
 
-	// If no rows were affected,
-	// we know that the movies table didn't contain a record with the provided ID at the moment
-	// we tried to delete it. In that case we return an ErrRecordNotFound error.
-	if rowsAffected == 0 {
-		return ErrRecordNotFound
+	page := v.(*moviePage)
+
+	movies := make([]*Movie, len(page.movies))
+	for i, movie := range page.movies {
+		movies[i] = movie.copy()
 	}
 
-	return nil
+	return movies, page.metadata, nil
 }
 
-// GetAll returns a list of movies in the form of a string of Movie type based on a set of
-// provided filters.
-func (m MovieModel) GetAll(title string, genres []string, filters Filters) ([]*Movie, Metadata, error) {
+// getAll runs the query for GetAll.
+func (m MovieModel) getAll(ctx context.Context, title string, genres []string, createdBy int64, filters Filters) ([]*Movie, Metadata, error) {
 	// Add an ORDER BY clause and interpolate the sort column and direction using fmt.Sprintf.
 	// Importantly, notice that we also include a secondary sort on the movie ID to ensure
 	// a consistent ordering. Furthermore, we include LIMIT and OFFSET clauses with placeholder
 	// parameter values for pagination implementation. The window function is used to calculate
 	// the total filtered rows which will be used in our pagination metadata.
 	query := fmt.Sprintf(`
-		SELECT count(*) OVER(), id, created_at, title, year, runtime, genres, version
+		SELECT count(*) OVER(), id, COALESCE(ulid, ''), created_at, title, year, runtime, release_date, poster_key, %s, version, created_by, updated_by, %s
 		FROM movies
-		WHERE (to_tsvector('simple', title) @@ plainto_tsquery('simple', $1) OR $1 = '')
-		AND (genres @> $2 OR $2 = '{}')
+		WHERE deleted_at IS NULL
+		AND (search_vector @@ plainto_tsquery('simple', $1) OR $1 = '')
+		AND %s
+		AND (created_by = $5 OR $5 = 0)
 		ORDER BY %s %s, id ASC
 		LIMIT $3 OFFSET $4`,
-		filters.sortColumn(), filters.sortDirection())
+		movieGenres, movieAverageRating, hasGenres("$2"), filters.sortColumn(), filters.sortDirection())
 
 	// Create a context with a 3-second timeout.
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 
-	// Organize our four placeholder parameter values in a slice.
-	args := []interface{}{title, pq.Array(genres), filters.limit(), filters.offset()}
+	// Organize our placeholder parameter values in a slice.
+	args := []interface{}{title, pq.Array(genres), filters.limit(), filters.offset(), createdBy}
 
 	// Use QueryContext to execute the query. This returns a sql.Rows result set containing
 	// the result.
@@ -242,12 +626,18 @@ func (m MovieModel) GetAll(title string, genres []string, filters Filters) ([]*M
 		err := rows.Scan(
 			&totalRecords, // Scan the count from the window function into totalRecords.
 			&movie.ID,
+			&movie.ULID,
 			&movie.CreatedAt,
 			&movie.Title,
 			&movie.Year,
 			&movie.Runtime,
+			&movie.ReleaseDate,
+			moviePoster(&movie),
 			pq.Array(&movie.Genres),
 			&movie.Version,
+			&movie.CreatedBy,
+			&movie.UpdatedBy,
+			&movie.AverageRating,
 		)
 		if err != nil {
 			return nil, Metadata{}, err
@@ -271,16 +661,276 @@ func (m MovieModel) GetAll(title string, genres []string, filters Filters) ([]*M
 	return movies, metadata, nil
 }
 
-// ValidateMovie runs validation checks on the Movie type.
-func ValidateMovie(v *validator.Validator, movie *Movie) {
+// GetAllAfter returns a page of movies using keyset pagination rather than an offset: the page
+// starts after the position in the cursor (or at the start, if after is nil), and it returns the
+// cursor for the position of the last movie on the page, or nil if there are no more movies.
+// Instead of skipping over the earlier rows, the query compares the (sort column, id) tuple with
+// the cursor, which can use the index on the sort column, so deep pages are as cheap as the
+// first one.
+//
+// The cursor must have been created with the same sort order (see DecodeCursor). For the row
+// comparison to work, the id tie-breaker is sorted in the same direction as the sort column,
+// unlike GetAll, and the total number of records isn't counted.
+func (m MovieModel) GetAllAfter(ctx context.Context, title string, genres []string, createdBy int64, filters Filters, after *Cursor) ([]*Movie, *Cursor, error) {
+	page, err := retryRead("movies_get_after", func() (*keysetPage, error) {
+		return m.getAllAfter(ctx, title, genres, createdBy, filters, after)
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return page.movies, page.next, nil
+}
+
+// keysetPage holds the results of GetAllAfter.
+type keysetPage struct {
+	movies []*Movie
+	next   *Cursor
+}
+
+// getAllAfter runs the query for GetAllAfter.
+func (m MovieModel) getAllAfter(ctx context.Context, title string, genres []string, createdBy int64, filters Filters, after *Cursor) (*keysetPage, error) {
+	column, direction := filters.sortColumn(), filters.sortDirection()
+
+	args := []interface{}{title, pq.Array(genres), createdBy, filters.PageSize + 1}
+
+	// Only return the movies after the cursor's position in the sort order.
+	keyset := "true"
+	if after != nil {
+		key, err := after.sortKeyValue(column)
+		if err != nil {
+			return nil, err
+		}
+
+		operator := ">"
+		if direction == "DESC" {
+			operator = "<"
+		}
+
+		args = append(args, key, after.ID)
+		keyset = fmt.Sprintf("(%s, id) %s ($5, $6)", column, operator)
+	}
+
+	// Fetch one more movie than the page size, to find out whether there's another page.
+	query := fmt.Sprintf(`
+		SELECT id, COALESCE(ulid, ''), created_at, title, year, runtime, release_date, poster_key, %s, version, created_by, updated_by, %s
+		FROM movies
+		WHERE deleted_at IS NULL
+		AND (search_vector @@ plainto_tsquery('simple', $1) OR $1 = '')
+		AND %s
+		AND (created_by = $3 OR $3 = 0)
+		AND %s
+		ORDER BY %s %s, id %s
+		LIMIT $4`,
+		movieGenres, movieAverageRating, hasGenres("$2"), keyset, column, direction, direction)
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			m.ErrorLog.Println(err)
+		}
+	}()
+
+	movies := []*Movie{}
+
+	for rows.Next() {
+		var movie Movie
+
+		err := rows.Scan(
+			&movie.ID,
+			&movie.ULID,
+			&movie.CreatedAt,
+			&movie.Title,
+			&movie.Year,
+			&movie.Runtime,
+			&movie.ReleaseDate,
+			moviePoster(&movie),
+			pq.Array(&movie.Genres),
+			&movie.Version,
+			&movie.CreatedBy,
+			&movie.UpdatedBy,
+			&movie.AverageRating,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		movies = append(movies, &movie)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	page := &keysetPage{movies: movies}
+
+	if len(movies) > filters.PageSize {
+		page.movies = movies[:filters.PageSize]
+
+		last := page.movies[len(page.movies)-1]
+
+		key, err := last.sortKey(column)
+		if err != nil {
+			return nil, err
+		}
+
+		page.next = &Cursor{Sort: filters.Sort, SortKey: key, ID: last.ID}
+	}
+
+	return page, nil
+}
+
+// Stream calls fn with each of the movies matching the same title, genres and creator filters as
+// GetAll, in the sort order from filters (the page and page size are ignored). Unlike GetAll, the
+// movies are never all held in memory: lib/pq reads each row from the connection as rows.Next()
+// asks for it, so the result set is consumed row by row while fn writes each movie out. If fn
+// returns an error then streaming stops and that error is returned.
+//
+// There's no fixed timeout, since a full export of a large catalog can take a while, so ctx
+// should be the request's context, which cancels the query if the client goes away.
+func (m MovieModel) Stream(ctx context.Context, title string, genres []string, createdBy int64, filters Filters,
+	fn func(movie *Movie) error) error {
+	query := fmt.Sprintf(`
+		SELECT id, COALESCE(ulid, ''), created_at, title, year, runtime, release_date, poster_key, %s, version, created_by, updated_by, %s
+		FROM movies
+		WHERE deleted_at IS NULL
+		AND (search_vector @@ plainto_tsquery('simple', $1) OR $1 = '')
+		AND %s
+		AND (created_by = $3 OR $3 = 0)
+		ORDER BY %s %s, id ASC`,
+		movieGenres, movieAverageRating, hasGenres("$2"), filters.sortColumn(), filters.sortDirection())
+
+	rows, err := m.DB.QueryContext(ctx, query, title, pq.Array(genres), createdBy)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			m.ErrorLog.Println(err)
+		}
+	}()
+
+	for rows.Next() {
+		var movie Movie
+
+		err := rows.Scan(
+			&movie.ID,
+			&movie.ULID,
+			&movie.CreatedAt,
+			&movie.Title,
+			&movie.Year,
+			&movie.Runtime,
+			&movie.ReleaseDate,
+			moviePoster(&movie),
+			pq.Array(&movie.Genres),
+			&movie.Version,
+			&movie.CreatedBy,
+			&movie.UpdatedBy,
+			&movie.AverageRating,
+		)
+		if err != nil {
+			return err
+		}
+
+		err = fn(&movie)
+		if err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+// sortKey returns the value of the movie's sort column, encoded for a Cursor.
+func (movie *Movie) sortKey(column string) (json.RawMessage, error) {
+	switch column {
+	case "id":
+		return json.Marshal(movie.ID)
+	case "title":
+		return json.Marshal(movie.Title)
+	case "year":
+		return json.Marshal(movie.Year)
+	case "runtime":
+		return json.Marshal(int32(movie.Runtime))
+	default:
+		return nil, fmt.Errorf("unsupported sort column %q", column)
+	}
+}
+
+// CollectionVersion returns the version of the movie collection, which can be used to build an
+// ETag for a list of movies without fetching them. It's the last value of a sequence which is
+// advanced by every write to the movies or reviews tables (see the movies_collection_version
+// migration), so it covers the average ratings as well as the movies themselves. It's the same for
+// every filter, which means that a write invalidates the ETags of lists that the movie isn't in,
+// but it's read without scanning the matching movies on each request.
+//
+// The sequence is advanced when a write is made rather than when it's committed, so a list read
+// in between can be given the new version with the old contents. That list is only served stale
+// until the next write to the collection.
+func (m MovieModel) CollectionVersion(ctx context.Context) (string, error) {
+	query := `
+		SELECT CASE WHEN is_called THEN last_value ELSE 0 END
+		FROM movies_collection_version_seq
+		`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	var version int64
+
+	err := m.DB.QueryRowContext(ctx, query).Scan(&version)
+	if err != nil {
+		return "", err
+	}
+
+	return strconv.FormatInt(version, 10), nil
+}
+
+// MovieLimits holds the limits which ValidateMovie checks movies against. They're configurable
+// per deployment, so that (for example) a private catalog can include films from before 1888.
+type MovieLimits struct {
+	MaxTitleBytes int // The longest title allowed, in bytes
+	MaxGenres     int // The most genres that a movie can have
+	EarliestYear  int // The earliest release year allowed
+}
+
+// DefaultMovieLimits are the limits used unless a deployment configures its own.
+var DefaultMovieLimits = MovieLimits{
+	MaxTitleBytes: 500,
+	MaxGenres:     5,
+	EarliestYear:  1888,
+}
+
+// ValidateMovie runs validation checks on the Movie type, using the given limits.
+func ValidateMovie(v *validator.Validator, movie *Movie, limits MovieLimits) {
 	// Check movie.Title
 	v.Check(movie.Title != "", "title", "must be provided")
-	v.Check(len(movie.Title) <= 500, "title", "must not be more than 500 bytes long")
+	v.Check(len(movie.Title) <= limits.MaxTitleBytes, "title",
+		fmt.Sprintf("must not be more than %d bytes long", limits.MaxTitleBytes))
 
 	// Check movie.Year
 	v.Check(movie.Year != 0, "year", "must be provided")
-	v.Check(movie.Year >= 1888, "year", "must be greater than 1888")
-	v.Check(movie.Year <= int32(time.Now().Year()), "year", "must not be in the future")
+	v.Check(int(movie.Year) >= limits.EarliestYear, "year",
+		fmt.Sprintf("must be greater than %d", limits.EarliestYear))
+	// A movie which hasn't been released yet can have a year in the future, as long as it's no
+	// later than its release date.
+	latestYear := time.Now().Year()
+	if movie.ReleaseDate != nil && movie.ReleaseDate.Year() > latestYear {
+		latestYear = movie.ReleaseDate.Year()
+	}
+	v.Check(int(movie.Year) <= latestYear, "year", "must not be in the future")
+
+	// Check movie.ReleaseDate
+	if movie.ReleaseDate != nil {
+		v.Check(movie.ReleaseDate.Year() >= limits.EarliestYear, "release_date",
+			fmt.Sprintf("must be in %d or later", limits.EarliestYear))
+	}
 
 	// Check movie.Runtime
 	v.Check(movie.Runtime != 0, "runtime", "must be provided")
@@ -289,7 +939,15 @@ func ValidateMovie(v *validator.Validator, movie *Movie) {
 	// Check movie.Genres
 	v.Check(movie.Genres != nil, "genres", "must be provided")
 	v.Check(len(movie.Genres) >= 1, "genres", "must contain at least 1 genre")
-	v.Check(len(movie.Genres) <= 5, "genres", "must not contain more than 5 genres")
-	v.Check(validator.Unique(movie.Genres), "genres", "must not contain duplicate values")
+	v.Check(len(movie.Genres) <= limits.MaxGenres, "genres",
+		fmt.Sprintf("must not contain more than %d genres", limits.MaxGenres))
+
+	// Genre names are case-insensitive, so "Drama" and "drama" count as duplicates.
+	lowered := make([]string, len(movie.Genres))
+	for i, genre := range movie.Genres {
+		lowered[i] = strings.ToLower(genre)
+		v.Check(strings.TrimSpace(genre) != "", "genres", "must not contain blank values")
+	}
+	v.Check(validator.Unique(lowered), "genres", "must not contain duplicate values")
 
 }
@@ -0,0 +1,401 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// Kinds of notification.
+const (
+	// NotificationMovieReleased is sent to the users who subscribed to a movie before it was
+	// released, once it has been.
+	NotificationMovieReleased = "movie_released"
+	// NotificationSavedSearchMatches is sent to the owner of a saved search with notifications
+	// enabled when new movies match it.
+	NotificationSavedSearchMatches = "saved_search_matches"
+)
+
+// NotificationsChannel is the PostgreSQL NOTIFY channel that each new in-app notification is sent
+// on, once the transaction which added it has committed. Every instance of the application
+// listens on it, so that the notification can be pushed to the user's open connections wherever
+// they are.
+const NotificationsChannel = "notifications"
+
+// Notification is an in-app notification, which a user can list and mark as read. MovieID and
+// SavedSearchID refer to the movie or saved search that the notification is about, if any.
+type Notification struct {
+	ID            int64      `json:"id"`
+	CreatedAt     time.Time  `json:"created_at"`
+	UserID        int64      `json:"-"`
+	Kind          string     `json:"kind"`
+	Message       string     `json:"message"`
+	MovieID       *int64     `json:"movie_id,omitempty"`
+	SavedSearchID *int64     `json:"saved_search_id,omitempty"`
+	ReadAt        *time.Time `json:"read_at"`
+}
+
+// NotificationPreferences holds how a user wants to be notified: by email, in the app, or both.
+// Users who haven't set their preferences get both.
+type NotificationPreferences struct {
+	Email bool `json:"email"`
+	InApp bool `json:"in_app"`
+}
+
+// DefaultNotificationPreferences are the preferences of a user who hasn't set their own.
+var DefaultNotificationPreferences = NotificationPreferences{Email: true, InApp: true}
+
+// ReleasedMovie is a movie which has been released, as given to the function which builds the
+// email for each of its subscribers.
+type ReleasedMovie struct {
+	ID    int64
+	Title string
+	Year  int32
+}
+
+// NotificationModel struct wraps a sql.DB connection pool and allows us to work with the
+// notifications, notification_preferences and movie_subscriptions tables in our database.
+type NotificationModel struct {
+	DB       *sql.DB
+	InfoLog  *log.Logger
+	ErrorLog *log.Logger
+}
+
+// insertNotification adds an in-app notification as part of a transaction.
+func insertNotification(ctx context.Context, tx *sql.Tx, notification *Notification) error {
+	query := `
+		INSERT INTO notifications (user_id, kind, message, movie_id, saved_search_id)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id, created_at
+		`
+
+	args := []interface{}{notification.UserID, notification.Kind, notification.Message, notification.MovieID,
+		notification.SavedSearchID}
+
+	err := tx.QueryRowContext(ctx, query, args...).Scan(&notification.ID, &notification.CreatedAt)
+	if err != nil {
+		return err
+	}
+
+	// Announce the notification to the listeners. PostgreSQL only delivers it if the transaction
+	// commits. The payload is well under the 8000 byte limit, as messages are short.
+	payload, err := json.Marshal(notificationPayload{UserID: notification.UserID, Notification: notification})
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, "SELECT pg_notify($1, $2)", NotificationsChannel, string(payload))
+	return err
+}
+
+// notificationPayload is the payload of a message on the NotificationsChannel. The user ID is
+// included as it's left out of the notification's own JSON.
+type notificationPayload struct {
+	UserID int64 `json:"user_id"`
+	*Notification
+}
+
+// ParseNotificationPayload returns the notification sent as the payload of a message on the
+// NotificationsChannel.
+func ParseNotificationPayload(payload string) (*Notification, error) {
+	var p notificationPayload
+
+	err := json.Unmarshal([]byte(payload), &p)
+	if err != nil {
+		return nil, err
+	}
+
+	if p.Notification == nil {
+		return nil, errors.New("notification payload has no notification")
+	}
+
+	p.Notification.UserID = p.UserID
+
+	return p.Notification, nil
+}
+
+// Insert adds an in-app notification.
+func (m NotificationModel) Insert(ctx context.Context, notification *Notification) error {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	err = insertNotification(ctx, tx, notification)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// GetAllForUser returns a page of a user's notifications, newest first. If unreadOnly is true
+// then the notifications which have been read are left out.
+func (m NotificationModel) GetAllForUser(ctx context.Context, userID int64, unreadOnly bool, filters Filters) ([]*Notification, Metadata, error) {
+	query := `
+		SELECT count(*) OVER(), id, created_at, user_id, kind, message, movie_id, saved_search_id, read_at
+		FROM notifications
+		WHERE user_id = $1 AND (read_at IS NULL OR NOT $2)
+		ORDER BY id DESC
+		LIMIT $3 OFFSET $4`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID, unreadOnly, filters.limit(), filters.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			m.ErrorLog.Println(err)
+		}
+	}()
+
+	totalRecords := 0
+	notifications := []*Notification{}
+
+	for rows.Next() {
+		var n Notification
+
+		err := rows.Scan(&totalRecords, &n.ID, &n.CreatedAt, &n.UserID, &n.Kind, &n.Message, &n.MovieID,
+			&n.SavedSearchID, &n.ReadAt)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		notifications = append(notifications, &n)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	return notifications, calculateMetadata(totalRecords, filters.Page, filters.PageSize), nil
+}
+
+// MarkRead marks one of a user's notifications as read, if it isn't already.
+// ErrRecordNotFound is returned if the user doesn't have a notification with the given ID.
+func (m NotificationModel) MarkRead(ctx context.Context, id, userID int64) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+
+	query := `
+		UPDATE notifications
+		SET read_at = COALESCE(read_at, NOW())
+		WHERE id = $1 AND user_id = $2
+		`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, id, userID)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// GetPreferences returns a user's notification preferences, or the default preferences if they
+// haven't set any.
+func (m NotificationModel) GetPreferences(ctx context.Context, userID int64) (NotificationPreferences, error) {
+	query := `
+		SELECT email, in_app
+		FROM notification_preferences
+		WHERE user_id = $1
+		`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	var prefs NotificationPreferences
+
+	err := m.DB.QueryRowContext(ctx, query, userID).Scan(&prefs.Email, &prefs.InApp)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return DefaultNotificationPreferences, nil
+		default:
+			return NotificationPreferences{}, err
+		}
+	}
+
+	return prefs, nil
+}
+
+// SetPreferences replaces a user's notification preferences.
+func (m NotificationModel) SetPreferences(ctx context.Context, userID int64, prefs NotificationPreferences) error {
+	query := `
+		INSERT INTO notification_preferences (user_id, email, in_app)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (user_id) DO UPDATE SET email = EXCLUDED.email, in_app = EXCLUDED.in_app
+		`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, userID, prefs.Email, prefs.InApp)
+	return err
+}
+
+// Subscribe subscribes a user to be notified when a movie is released. Subscribing more than
+// once has no effect. ErrRecordNotFound is returned if the movie doesn't exist.
+func (m NotificationModel) Subscribe(ctx context.Context, userID, movieID int64) error {
+	query := `
+		INSERT INTO movie_subscriptions (user_id, movie_id)
+		VALUES ($1, $2)
+		ON CONFLICT (user_id, movie_id) DO NOTHING
+		`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, userID, movieID)
+	if err != nil {
+		switch {
+		case err.Error() == `pq: insert or update on table "movie_subscriptions" violates foreign key constraint "movie_subscriptions_movie_id_fkey"`:
+			return ErrRecordNotFound
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Unsubscribe removes a user's subscription to a movie, if they have one.
+func (m NotificationModel) Unsubscribe(ctx context.Context, userID, movieID int64) error {
+	query := `
+		DELETE FROM movie_subscriptions
+		WHERE user_id = $1 AND movie_id = $2
+		`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, userID, movieID)
+	return err
+}
+
+// NotifyReleased notifies the subscribers of the movies which have been released by the given
+// date, up to limit subscribers at a time, and returns how many were notified. If movieID isn't
+// 0 then only the subscribers of that movie are notified. A movie counts as released once its
+// release date has arrived; a movie without a release date hasn't been released, so its
+// subscribers carry on waiting until it's given one.
+//
+// Each subscriber is notified according to their preferences: in the app, and by an email built
+// by the email function, which is only sent to activated users. The notifications and emails
+// are added in the same transaction that removes the subscriptions, so each subscriber is
+// notified exactly once, and SKIP LOCKED means that concurrent calls never notify the same
+// subscriber.
+func (m NotificationModel) NotifyReleased(ctx context.Context, today Date, movieID int64, limit int, email func(recipient string, movie ReleasedMovie) *OutboxEmail) (int, error) {
+	query := `
+		SELECT s.user_id, m.id, m.title, m.year, u.email, u.activated AND u.deleted_at IS NULL,
+			COALESCE(p.email, true), COALESCE(p.in_app, true)
+		FROM movie_subscriptions s
+		INNER JOIN movies m ON m.id = s.movie_id
+		INNER JOIN users u ON u.id = s.user_id
+		LEFT JOIN notification_preferences p ON p.user_id = s.user_id
+		WHERE m.deleted_at IS NULL AND m.release_date <= $1 AND ($2 = 0 OR m.id = $2)
+		ORDER BY s.movie_id, s.user_id
+		LIMIT $3
+		FOR UPDATE OF s SKIP LOCKED
+		`
+
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	type subscriber struct {
+		userID int64
+		movie  ReleasedMovie
+		email  string
+		active bool
+		prefs  NotificationPreferences
+	}
+
+	rows, err := tx.QueryContext(ctx, query, today, movieID, limit)
+	if err != nil {
+		return 0, err
+	}
+
+	var subscribers []subscriber
+
+	for rows.Next() {
+		var s subscriber
+
+		err := rows.Scan(&s.userID, &s.movie.ID, &s.movie.Title, &s.movie.Year, &s.email, &s.active,
+			&s.prefs.Email, &s.prefs.InApp)
+		if err != nil {
+			_ = rows.Close()
+			return 0, err
+		}
+
+		subscribers = append(subscribers, s)
+	}
+
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for _, s := range subscribers {
+		_, err = tx.ExecContext(ctx, "DELETE FROM movie_subscriptions WHERE user_id = $1 AND movie_id = $2",
+			s.userID, s.movie.ID)
+		if err != nil {
+			return 0, err
+		}
+
+		if s.prefs.InApp {
+			movieID := s.movie.ID
+
+			err = insertNotification(ctx, tx, &Notification{
+				UserID:  s.userID,
+				Kind:    NotificationMovieReleased,
+				Message: fmt.Sprintf("%s (%d) has been released", s.movie.Title, s.movie.Year),
+				MovieID: &movieID,
+			})
+			if err != nil {
+				return 0, err
+			}
+		}
+
+		if s.prefs.Email && s.active {
+			err = insertOutboxMessage(ctx, tx, OutboxKindEmail, email(s.email, s.movie))
+			if err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	return len(subscribers), tx.Commit()
+}
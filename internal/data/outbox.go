@@ -0,0 +1,202 @@
+package data
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"time"
+)
+
+// OutboxKindEmail is the kind of outbox message which holds an email to send.
+const OutboxKindEmail = "email"
+
+// MaxOutboxAttempts is the number of times that delivery of an outbox message is attempted before
+// it is marked as failed.
+const MaxOutboxAttempts = 10
+
+// OutboxMessage is a message in the outbox, waiting to be delivered.
+type OutboxMessage struct {
+	ID       int64
+	Kind     string
+	Payload  json.RawMessage
+	Attempts int
+}
+
+// OutboxEmail is the payload of an email outbox message. It holds the arguments for
+// mailer.Send(). Secret lists the keys of Data which hold credentials, such as token plaintexts,
+// which are removed if the email is given up on, so that they aren't kept in the outbox.
+type OutboxEmail struct {
+	Recipient string                 `json:"recipient"`
+	Template  string                 `json:"template"`
+	Data      map[string]interface{} `json:"data"`
+	Secret    []string               `json:"secret,omitempty"`
+}
+
+// DecodeEmail decodes the payload of an email outbox message. Numbers in the data are decoded as
+// json.Number rather than float64, so that IDs are rendered in templates exactly as they were
+// written.
+func (msg *OutboxMessage) DecodeEmail() (*OutboxEmail, error) {
+	dec := json.NewDecoder(bytes.NewReader(msg.Payload))
+	dec.UseNumber()
+
+	var email OutboxEmail
+
+	err := dec.Decode(&email)
+	if err != nil {
+		return nil, err
+	}
+
+	return &email, nil
+}
+
+// QueueStats describes the backlog of a queue: the number of items waiting in it, and how long
+// the oldest of them has been waiting.
+type QueueStats struct {
+	Depth     int64
+	OldestAge time.Duration
+}
+
+// OutboxModel struct wraps a sql.DB connection pool and allows us to work with the outbox table.
+type OutboxModel struct {
+	DB       *sql.DB
+	InfoLog  *log.Logger
+	ErrorLog *log.Logger
+}
+
+// insertOutboxMessage adds a message to the outbox as part of a transaction, so that it is only
+// delivered if the rest of the transaction commits.
+func insertOutboxMessage(ctx context.Context, tx *sql.Tx, kind string, payload interface{}) error {
+	js, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	query := `
+		INSERT INTO outbox (kind, payload)
+		VALUES ($1, $2)
+		`
+
+	_, err = tx.ExecContext(ctx, query, kind, js)
+	return err
+}
+
+// ClaimDue claims up to limit messages which are due for delivery, and returns them. Each claimed
+// message has its attempts incremented and its next attempt pushed back by the lease duration,
+// so if the worker dies before it finishes then the message is delivered again once the lease
+// runs out. FOR UPDATE SKIP LOCKED means that workers in different instances of the application
+// never claim the same message.
+func (m OutboxModel) ClaimDue(ctx context.Context, limit int, lease time.Duration) ([]*OutboxMessage, error) {
+	query := `
+		UPDATE outbox
+		SET attempts = attempts + 1, next_attempt_at = NOW() + $1 * INTERVAL '1 second'
+		WHERE id IN (
+			SELECT id
+			FROM outbox
+			WHERE failed_at IS NULL AND next_attempt_at <= NOW()
+			ORDER BY id
+			FOR UPDATE SKIP LOCKED
+			LIMIT $2
+		)
+		RETURNING id, kind, payload, attempts
+		`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, lease.Seconds(), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			m.ErrorLog.Println(err)
+		}
+	}()
+
+	messages := []*OutboxMessage{}
+
+	for rows.Next() {
+		var msg OutboxMessage
+
+		err := rows.Scan(&msg.ID, &msg.Kind, &msg.Payload, &msg.Attempts)
+		if err != nil {
+			return nil, err
+		}
+
+		messages = append(messages, &msg)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return messages, nil
+}
+
+// Delete removes a message from the outbox once it has been delivered. Email payloads can hold
+// tokens, so we don't keep delivered messages around.
+func (m OutboxModel) Delete(ctx context.Context, id int64) error {
+	query := `
+		DELETE FROM outbox
+		WHERE id = $1
+		`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, id)
+	return err
+}
+
+// Retry records a failed delivery attempt, and schedules the next attempt after the given
+// backoff. Once the message has been attempted MaxOutboxAttempts times it is marked as failed
+// instead, and won't be attempted again. The secret data of a failed email is removed at the same
+// time, while the rest of it is kept to help work out what went wrong.
+func (m OutboxModel) Retry(ctx context.Context, msg *OutboxMessage, backoff time.Duration, deliveryErr error) error {
+	query := `
+		UPDATE outbox
+		SET last_error = $1,
+			next_attempt_at = NOW() + $2 * INTERVAL '1 second',
+			failed_at = CASE WHEN attempts >= $3 THEN NOW() END,
+			payload = CASE
+				WHEN attempts >= $3 AND payload ? 'secret' THEN jsonb_set(payload, '{data}',
+					(payload -> 'data') - ARRAY(SELECT jsonb_array_elements_text(payload -> 'secret')))
+				ELSE payload
+			END
+		WHERE id = $4
+		`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, deliveryErr.Error(), backoff.Seconds(), MaxOutboxAttempts, msg.ID)
+	return err
+}
+
+// Stats returns the number of messages waiting to be delivered, including those waiting to be
+// retried, and the age of the oldest of them. Messages which have been given up on aren't
+// counted.
+func (m OutboxModel) Stats(ctx context.Context) (QueueStats, error) {
+	query := `
+		SELECT count(*), COALESCE(EXTRACT(EPOCH FROM NOW() - MIN(created_at)), 0)
+		FROM outbox
+		WHERE failed_at IS NULL
+		`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	var stats QueueStats
+	var age float64
+
+	err := m.DB.QueryRowContext(ctx, query).Scan(&stats.Depth, &age)
+	if err != nil {
+		return QueueStats{}, err
+	}
+
+	stats.OldestAge = time.Duration(age * float64(time.Second))
+
+	return stats, nil
+}
@@ -0,0 +1,261 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/codeaucafe/snippetbox/greenlight/internal/validator"
+)
+
+// Person is one of the cast or crew who work on movies, such as an actor or a director. The
+// movies they worked on are linked to them by their credits (see Credit).
+type Person struct {
+	ID        int64     `json:"id"`
+	CreatedAt time.Time `json:"-"`
+	Name      string    `json:"name"`
+	BirthYear int32     `json:"birth_year,omitempty"` // Zero if it isn't known
+	Bio       string    `json:"bio,omitempty"`
+	Version   int32     `json:"version"`
+}
+
+// PersonModel struct wraps a sql.DB connection pool and allows us to work with the Person struct
+// type and the people table in our database.
+type PersonModel struct {
+	DB       *sql.DB
+	InfoLog  *log.Logger
+	ErrorLog *log.Logger
+}
+
+// touchCreditedMovies increments the version of every movie which the person is credited on, as
+// part of the transaction which changes the person. The movies include their top-billed cast,
+// so this makes sure that clients holding a copy of one of them see that it has changed.
+func touchCreditedMovies(ctx context.Context, tx *sql.Tx, personID int64) error {
+	_, err := tx.ExecContext(ctx, `
+		UPDATE movies
+		SET version = version + 1
+		WHERE id IN (SELECT movie_id FROM credits WHERE person_id = $1)`,
+		personID)
+	return err
+}
+
+// Insert adds a new person to the people table, filling in the system-generated fields, and
+// records it in the audit log as created by the user in the context.
+func (m PersonModel) Insert(ctx context.Context, person *Person) error {
+	query := `
+		INSERT INTO people (name, birth_year, bio)
+		VALUES ($1, $2, $3)
+		RETURNING id, created_at, version
+		`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	return withAudit(ctx, m.DB, AuditCreate, "people", 0, func(tx *sql.Tx) (int64, error) {
+		err := tx.QueryRowContext(ctx, query, person.Name, person.BirthYear, person.Bio).
+			Scan(&person.ID, &person.CreatedAt, &person.Version)
+		return person.ID, err
+	})
+}
+
+// Get returns the person with the given ID. ErrRecordNotFound is returned if there isn't one.
+func (m PersonModel) Get(ctx context.Context, id int64) (*Person, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `
+		SELECT id, created_at, name, birth_year, bio, version
+		FROM people
+		WHERE id = $1
+		`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	var person Person
+
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(&person.ID, &person.CreatedAt, &person.Name,
+		&person.BirthYear, &person.Bio, &person.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &person, nil
+}
+
+// GetAll returns a page of the people whose names match the name filter, in the same way that
+// movie titles are matched by MovieModel.GetAll, sorted according to the filters. An empty
+// name matches everyone.
+func (m PersonModel) GetAll(ctx context.Context, name string, filters Filters) ([]*Person, Metadata, error) {
+	query := fmt.Sprintf(`
+		SELECT count(*) OVER(), id, created_at, name, birth_year, bio, version
+		FROM people
+		WHERE (to_tsvector('simple', name) @@ plainto_tsquery('simple', $1) OR $1 = '')
+		ORDER BY %s %s, id ASC
+		LIMIT $2 OFFSET $3`,
+		filters.sortColumn(), filters.sortDirection())
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, name, filters.limit(), filters.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			m.ErrorLog.Println(err)
+		}
+	}()
+
+	totalRecords := 0
+	people := []*Person{}
+
+	for rows.Next() {
+		var person Person
+
+		err := rows.Scan(&totalRecords, &person.ID, &person.CreatedAt, &person.Name, &person.BirthYear,
+			&person.Bio, &person.Version)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		people = append(people, &person)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	return people, calculateMetadata(totalRecords, filters.Page, filters.PageSize), nil
+}
+
+// Update updates a person, using the version number for optimistic locking in the same way as
+// for movies. The movies they're credited on are given a new version too, as the person is
+// shown in their cast. ErrEditConflict is returned if the person has been changed or deleted
+// since they were read. Like the other write methods, it records the change in the audit log,
+// along with the user in the context.
+func (m PersonModel) Update(ctx context.Context, person *Person) error {
+	query := `
+		UPDATE people
+		SET name = $1, birth_year = $2, bio = $3, version = version + 1
+		WHERE id = $4 AND version = $5
+		RETURNING version
+		`
+
+	args := []interface{}{person.Name, person.BirthYear, person.Bio, person.ID, person.Version}
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	change := newAudit(AuditUpdate, "people")
+
+	err = change.before(ctx, tx, person.ID)
+	if err != nil {
+		return err
+	}
+
+	err = tx.QueryRowContext(ctx, query, args...).Scan(&person.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+
+	err = touchCreditedMovies(ctx, tx, person.ID)
+	if err != nil {
+		return err
+	}
+
+	err = change.record(ctx, tx, person.ID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Delete removes a person, along with their credits, and gives the movies they were credited on
+// a new version. ErrRecordNotFound is returned if there isn't a person with the given ID.
+func (m PersonModel) Delete(ctx context.Context, id int64) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	change := newAudit(AuditDelete, "people")
+
+	err = change.before(ctx, tx, id)
+	if err != nil {
+		return err
+	}
+
+	err = touchCreditedMovies(ctx, tx, id)
+	if err != nil {
+		return err
+	}
+
+	result, err := tx.ExecContext(ctx, "DELETE FROM people WHERE id = $1", id)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	err = change.record(ctx, tx, id)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// ValidatePerson runs validation checks on the Person type.
+func ValidatePerson(v *validator.Validator, person *Person) {
+	v.Check(person.Name != "", "name", "must be provided")
+	v.Check(len(person.Name) <= 500, "name", "must not be more than 500 bytes long")
+
+	v.Check(person.BirthYear == 0 || person.BirthYear >= 1800, "birth_year", "must be greater than 1800")
+	v.Check(person.BirthYear <= int32(time.Now().Year()), "birth_year", "must not be in the future")
+
+	v.Check(len(person.Bio) <= 10_000, "bio", "must not be more than 10000 bytes long")
+}
@@ -29,8 +29,16 @@ type PermissionModel struct {
 	ErrorLog *log.Logger
 }
 
-// GetAllForUser returns all permission codes for a specific user in a Permissions slice.
-func (m PermissionModel) GetAllForUser(userID int64) (Permissions, error) {
+// GetAllForUser returns all permission codes for a specific user in a Permissions slice. The
+// query is retried once if it fails because of a database failover.
+func (m PermissionModel) GetAllForUser(ctx context.Context, userID int64) (Permissions, error) {
+	return retryRead("permissions_get_all_for_user", func() (Permissions, error) {
+		return m.getAllForUser(ctx, userID)
+	})
+}
+
+// getAllForUser runs the query for GetAllForUser.
+func (m PermissionModel) getAllForUser(ctx context.Context, userID int64) (Permissions, error) {
 	query := `
 		SELECT permissions.code
 		FROM permissions
@@ -39,7 +47,7 @@ func (m PermissionModel) GetAllForUser(userID int64) (Permissions, error) {
 		WHERE users.id = $1
 		`
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 
 	rows, err := m.DB.QueryContext(ctx, query, userID)
@@ -72,16 +80,19 @@ func (m PermissionModel) GetAllForUser(userID int64) (Permissions, error) {
 	return permissions, nil
 }
 
-// AddForUser adds the provided codes for a specific user.
-func (m PermissionModel) AddForUser(userID int64, codes ...string) error {
+// AddForUser adds the provided codes for a specific user, and records the change to their
+// permissions in the audit log.
+func (m PermissionModel) AddForUser(ctx context.Context, userID int64, codes ...string) error {
 	query := `
 		INSERT INTO users_permissions
 		SELECT $1, permissions.id FROM permissions WHERE permissions.code = ANY($2)
 		`
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 
-	_, err := m.DB.ExecContext(ctx, query, userID, pq.Array(codes))
-	return err
+	return withAudit(ctx, m.DB, AuditUpdate, "permissions", userID, func(tx *sql.Tx) (int64, error) {
+		_, err := tx.ExecContext(ctx, query, userID, pq.Array(codes))
+		return userID, err
+	})
 }
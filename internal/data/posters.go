@@ -0,0 +1,119 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"path"
+	"time"
+)
+
+// posterScanner is a sql.Scanner which reads a movie's poster_key column, filling in both its
+// PosterKey and its PosterURL.
+type posterScanner struct {
+	movie *Movie
+}
+
+// moviePoster returns a sql.Scanner for the poster_key column of a movie, in the same way that
+// pq.Array() is used for its genres.
+func moviePoster(movie *Movie) sql.Scanner {
+	return posterScanner{movie: movie}
+}
+
+// Scan implements the sql.Scanner interface.
+func (s posterScanner) Scan(src interface{}) error {
+	var key sql.NullString
+
+	err := key.Scan(src)
+	if err != nil {
+		return err
+	}
+
+	s.movie.setPoster(key.String)
+	return nil
+}
+
+// setPoster sets the movie's poster key, and the URL that its poster is served from.
+func (movie *Movie) setPoster(key string) {
+	movie.PosterKey = key
+	movie.PosterURL = ""
+
+	if key != "" {
+		movie.PosterURL = fmt.Sprintf("/v1/movies/%d/poster", movie.ID)
+	}
+}
+
+// NewPosterKey returns the storage key prefix for a new poster for a movie, such as
+// "posters/42/01GXYZ...". Every upload gets a new prefix, so that the images of a poster never
+// change once they're stored, and can be cached for as long as the clients like.
+func NewPosterKey(movieID int64, t time.Time) string {
+	return fmt.Sprintf("posters/%d/%s", movieID, newULID(t))
+}
+
+// SetPoster replaces a movie's poster with the images stored under key, or removes it if key is
+// empty, recording the user in the context as the last user to change the movie. The poster is
+// part of the movie, so this bumps its version, and it only succeeds if the movie still has the
+// version it was read with: ErrEditConflict is returned if it doesn't.
+//
+// The images of the old poster are left in storage, and are deleted by the orphan cleanup (see
+// PosterInUse).
+func (m MovieModel) SetPoster(ctx context.Context, movie *Movie, key string) error {
+	query := `
+		UPDATE movies
+		SET poster_key = $1, updated_by = $2, version = version + 1
+		WHERE id = $3 AND version = $4 AND deleted_at IS NULL
+		RETURNING version, updated_by
+		`
+
+	args := []interface{}{key, actorID(ctx), movie.ID, movie.Version}
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	change := newAudit(AuditUpdate, "movies")
+
+	err := withEvent(ctx, m.DB, m.Broker, func(tx *sql.Tx) (string, int64, interface{}, error) {
+		err := change.before(ctx, tx, movie.ID)
+		if err != nil {
+			return "", 0, nil, err
+		}
+
+		err = tx.QueryRowContext(ctx, query, args...).Scan(&movie.Version, &movie.UpdatedBy)
+		if err != nil {
+			return "", 0, nil, err
+		}
+
+		movie.setPoster(key)
+
+		err = change.record(ctx, tx, movie.ID)
+		return EventMovieUpdated, movie.ID, movie, err
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return failoverError(err)
+		}
+	}
+
+	return nil
+}
+
+// PosterInUse reports whether the poster image stored under the given key still belongs to a
+// movie. Each poster's images are stored together under the movie's poster key, such as
+// "posters/42/01GXYZ.../medium", so the image is in use if its directory is a poster key.
+func (m MovieModel) PosterInUse(ctx context.Context, key string) (bool, error) {
+	query := `
+		SELECT EXISTS(SELECT 1 FROM movies WHERE poster_key = $1)
+		`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	var exists bool
+
+	err := m.DB.QueryRowContext(ctx, query, path.Dir(key)).Scan(&exists)
+	return exists, err
+}
@@ -0,0 +1,109 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"time"
+)
+
+// Quota periods which request counts are tracked for.
+const (
+	QuotaPeriodDay   = "day"
+	QuotaPeriodMonth = "month"
+)
+
+// QuotaUsage holds the number of requests a user has made in the current day and month.
+type QuotaUsage struct {
+	Day   int64
+	Month int64
+}
+
+// QuotaModel struct wraps a sql.DB connection pool and allows us to work with the
+// request_quotas table in our database.
+type QuotaModel struct {
+	DB       *sql.DB
+	InfoLog  *log.Logger
+	ErrorLog *log.Logger
+}
+
+// Increment records a request for a specific user, incrementing the counts for both the day and
+// the month containing the given time (in UTC), and returns the updated counts.
+func (m QuotaModel) Increment(ctx context.Context, userID int64, now time.Time) (QuotaUsage, error) {
+	query := `
+		INSERT INTO request_quotas (user_id, period, period_start, count)
+		VALUES ($1, $2, $3, 1), ($1, $4, $5, 1)
+		ON CONFLICT (user_id, period, period_start)
+			DO UPDATE SET count = request_quotas.count + 1
+		RETURNING period, count
+		`
+
+	args := []interface{}{
+		userID,
+		QuotaPeriodDay, QuotaPeriodStart(QuotaPeriodDay, now),
+		QuotaPeriodMonth, QuotaPeriodStart(QuotaPeriodMonth, now),
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return QuotaUsage{}, err
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			m.ErrorLog.Println(err)
+		}
+	}()
+
+	var usage QuotaUsage
+
+	for rows.Next() {
+		var (
+			period string
+			count  int64
+		)
+
+		err := rows.Scan(&period, &count)
+		if err != nil {
+			return QuotaUsage{}, err
+		}
+
+		switch period {
+		case QuotaPeriodDay:
+			usage.Day = count
+		case QuotaPeriodMonth:
+			usage.Month = count
+		}
+	}
+
+	if err = rows.Err(); err != nil {
+		return QuotaUsage{}, err
+	}
+
+	return usage, nil
+}
+
+// QuotaPeriodStart returns the start of the day or month (in UTC) containing the given time.
+func QuotaPeriodStart(period string, t time.Time) time.Time {
+	t = t.UTC()
+
+	if period == QuotaPeriodMonth {
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+	}
+
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+// QuotaPeriodReset returns the time at which the quota for the day or month containing the given
+// time resets.
+func QuotaPeriodReset(period string, t time.Time) time.Time {
+	start := QuotaPeriodStart(period, t)
+
+	if period == QuotaPeriodMonth {
+		return start.AddDate(0, 1, 0)
+	}
+
+	return start.AddDate(0, 0, 1)
+}
@@ -0,0 +1,159 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// MaxRecentlyViewed is the number of recently viewed movies kept for each user. Older views are
+// removed as new ones are added.
+const MaxRecentlyViewed = 50
+
+// RecentView records that a user viewed a movie at a particular time.
+type RecentView struct {
+	UserID   int64
+	MovieID  int64
+	ViewedAt time.Time
+}
+
+// RecentlyViewedMovie holds a movie which a user has viewed, along with when they last viewed it.
+type RecentlyViewedMovie struct {
+	ViewedAt time.Time `json:"viewed_at"`
+	Movie    *Movie    `json:"movie"`
+}
+
+// RecentlyViewedModel struct wraps a sql.DB connection pool and allows us to work with the
+// recently_viewed table in our database.
+type RecentlyViewedModel struct {
+	DB       *sql.DB
+	InfoLog  *log.Logger
+	ErrorLog *log.Logger
+}
+
+// Add records a batch of views in a single transaction, and trims the history of each user in
+// the batch to the most recent MaxRecentlyViewed movies.
+func (m RecentlyViewedModel) Add(ctx context.Context, views []*RecentView) error {
+	insert := `
+		INSERT INTO recently_viewed (user_id, movie_id, viewed_at)
+		SELECT $1, $2, $3
+		WHERE EXISTS (SELECT 1 FROM movies WHERE id = $2 AND deleted_at IS NULL)
+		ON CONFLICT (user_id, movie_id) DO UPDATE
+		SET viewed_at = GREATEST(recently_viewed.viewed_at, EXCLUDED.viewed_at)
+		`
+
+	trim := `
+		DELETE FROM recently_viewed
+		WHERE user_id = $1 AND movie_id NOT IN (
+			SELECT movie_id
+			FROM recently_viewed
+			WHERE user_id = $1
+			ORDER BY viewed_at DESC
+			LIMIT $2
+		)
+		`
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	stmt, err := tx.PrepareContext(ctx, insert)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := stmt.Close(); err != nil {
+			m.ErrorLog.Println(err)
+		}
+	}()
+
+	users := make(map[int64]bool)
+
+	for _, view := range views {
+		_, err = stmt.ExecContext(ctx, view.UserID, view.MovieID, view.ViewedAt)
+		if err != nil {
+			return err
+		}
+
+		users[view.UserID] = true
+	}
+
+	for userID := range users {
+		_, err = tx.ExecContext(ctx, trim, userID, MaxRecentlyViewed)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// GetForUser returns the movies which a user has viewed most recently, newest first.
+func (m RecentlyViewedModel) GetForUser(ctx context.Context, userID int64, limit int) ([]*RecentlyViewedMovie, error) {
+	query := fmt.Sprintf(`
+		SELECT rv.viewed_at, m.id, COALESCE(m.ulid, ''), m.created_at, m.title, m.year, m.runtime, %s, m.version
+		FROM recently_viewed rv
+		INNER JOIN movies m ON m.id = rv.movie_id
+		WHERE rv.user_id = $1 AND m.deleted_at IS NULL
+		ORDER BY rv.viewed_at DESC, m.id DESC
+		LIMIT $2`,
+		genresOf("m"))
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			m.ErrorLog.Println(err)
+		}
+	}()
+
+	viewed := []*RecentlyViewedMovie{}
+
+	for rows.Next() {
+		var (
+			rv    RecentlyViewedMovie
+			movie Movie
+		)
+
+		err := rows.Scan(
+			&rv.ViewedAt,
+			&movie.ID,
+			&movie.ULID,
+			&movie.CreatedAt,
+			&movie.Title,
+			&movie.Year,
+			&movie.Runtime,
+			pq.Array(&movie.Genres),
+			&movie.Version,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		rv.Movie = &movie
+		viewed = append(viewed, &rv)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return viewed, nil
+}
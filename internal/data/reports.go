@@ -0,0 +1,340 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"strconv"
+	"time"
+)
+
+// Statuses of a report as it moves through the report queue.
+const (
+	ReportStatusQueued    = "queued"
+	ReportStatusRunning   = "running"
+	ReportStatusCompleted = "completed"
+	ReportStatusFailed    = "failed"
+)
+
+// ReportFormats holds the formats which reports can be rendered in.
+var ReportFormats = []string{"csv", "json"}
+
+// Report represents a request for a report which is generated asynchronously by a task worker
+// (see TaskKindReport). The rendered report itself is kept in object storage, under ArtifactKey.
+type Report struct {
+	ID          int64             `json:"id"`
+	CreatedAt   time.Time         `json:"created_at"`
+	UpdatedAt   time.Time         `json:"updated_at"`
+	CompletedAt *time.Time        `json:"completed_at,omitempty"`
+	UserID      int64             `json:"-"`
+	Type        string            `json:"type"`
+	Format      string            `json:"format"`
+	Params      map[string]string `json:"params,omitempty"`
+	Status      string            `json:"status"`
+	Progress    int               `json:"progress"`
+	Error       string            `json:"error,omitempty"`
+	ArtifactKey string            `json:"-"`
+}
+
+// GenreSummary holds the catalog statistics for a single genre.
+type GenreSummary struct {
+	ID             int64   `json:"id,omitempty"` // The genre's ID, if it's known
+	Genre          string  `json:"genre"`
+	Movies         int64   `json:"movies"`
+	AverageRuntime float64 `json:"average_runtime"`
+	EarliestYear   int32   `json:"earliest_year"`
+	LatestYear     int32   `json:"latest_year"`
+}
+
+// ReportModel struct wraps a sql.DB connection pool and allows us to work with the Report struct
+// type and the reports table in our database.
+type ReportModel struct {
+	DB       *sql.DB
+	InfoLog  *log.Logger
+	ErrorLog *log.Logger
+}
+
+// Insert adds a new report, along with the task which generates it, in a single transaction. The
+// ID of the report is added to the params of the task.
+func (m ReportModel) Insert(ctx context.Context, report *Report, task *Task) error {
+	params, err := json.Marshal(report.Params)
+	if err != nil {
+		return err
+	}
+
+	query := `
+		INSERT INTO reports (user_id, type, format, params)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id, created_at, updated_at, status, progress
+		`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	err = tx.QueryRowContext(ctx, query, report.UserID, report.Type, report.Format, params).Scan(
+		&report.ID,
+		&report.CreatedAt,
+		&report.UpdatedAt,
+		&report.Status,
+		&report.Progress,
+	)
+	if err != nil {
+		return err
+	}
+
+	task.UserID = report.UserID
+	task.Kind = TaskKindReport
+	task.Params = map[string]string{"report_id": strconv.FormatInt(report.ID, 10)}
+
+	err = insertTask(ctx, tx, task)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Get returns a specific report belonging to a user. ErrRecordNotFound is returned if the report
+// doesn't exist or belongs to another user.
+func (m ReportModel) Get(ctx context.Context, id, userID int64) (*Report, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `
+		SELECT id, created_at, updated_at, completed_at, user_id, type, format, params, status,
+			progress, error, artifact_key
+		FROM reports
+		WHERE id = $1 AND user_id = $2
+		`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	report, err := scanReport(m.DB.QueryRowContext(ctx, query, id, userID))
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return report, nil
+}
+
+// GetArtifact returns the rendered contents of a completed report belonging to a user, for the
+// reports which were completed before rendered reports were moved to object storage (those
+// without an ArtifactKey).
+// ErrRecordNotFound is returned if there is no such report, or it hasn't completed yet.
+func (m ReportModel) GetArtifact(ctx context.Context, id, userID int64) ([]byte, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `
+		SELECT artifact
+		FROM reports
+		WHERE id = $1 AND user_id = $2 AND status = $3
+		`
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	var artifact []byte
+
+	err := m.DB.QueryRowContext(ctx, query, id, userID, ReportStatusCompleted).Scan(&artifact)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return artifact, nil
+}
+
+// Start marks a report as running and returns it, when the task which generates it is claimed
+// by a task worker. ErrRecordNotFound is returned if the report doesn't exist.
+func (m ReportModel) Start(ctx context.Context, id int64) (*Report, error) {
+	query := `
+		UPDATE reports
+		SET status = $1, progress = 0, updated_at = NOW()
+		WHERE id = $2
+		RETURNING id, created_at, updated_at, completed_at, user_id, type, format, params, status,
+			progress, error, artifact_key
+		`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	report, err := scanReport(m.DB.QueryRowContext(ctx, query, ReportStatusRunning, id))
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return report, nil
+}
+
+// UpdateProgress records the progress (as a percentage) of a running report.
+func (m ReportModel) UpdateProgress(ctx context.Context, id int64, progress int) error {
+	query := `
+		UPDATE reports
+		SET progress = $1, updated_at = NOW()
+		WHERE id = $2 AND status = $3
+		`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, progress, id, ReportStatusRunning)
+	return err
+}
+
+// Complete marks a report as completed, recording the key of the object which holds the rendered
+// report.
+func (m ReportModel) Complete(ctx context.Context, id int64, artifactKey string) error {
+	query := `
+		UPDATE reports
+		SET status = $1, progress = 100, artifact_key = $2, updated_at = NOW(), completed_at = NOW()
+		WHERE id = $3
+		`
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, ReportStatusCompleted, artifactKey, id)
+	return err
+}
+
+// ArtifactInUse reports whether any report refers to the object with the given key. It's used to
+// find the objects left behind by reports which have been deleted.
+func (m ReportModel) ArtifactInUse(ctx context.Context, key string) (bool, error) {
+	query := `
+		SELECT EXISTS(SELECT 1 FROM reports WHERE artifact_key = $1)
+		`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	var exists bool
+
+	err := m.DB.QueryRowContext(ctx, query, key).Scan(&exists)
+	return exists, err
+}
+
+// Fail marks a report as failed, recording a message describing the failure.
+func (m ReportModel) Fail(ctx context.Context, id int64, message string) error {
+	query := `
+		UPDATE reports
+		SET status = $1, error = $2, updated_at = NOW(), completed_at = NOW()
+		WHERE id = $3
+		`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, ReportStatusFailed, message, id)
+	return err
+}
+
+// GenreSummary returns catalog statistics for each genre, for the catalog summary report.
+func (m ReportModel) GenreSummary(ctx context.Context) ([]*GenreSummary, error) {
+	query := `
+		SELECT g.id, g.name, count(*), AVG(m.runtime), MIN(m.year), MAX(m.year)
+		FROM movie_genres mg
+		INNER JOIN genres g ON g.id = mg.genre_id
+		INNER JOIN movies m ON m.id = mg.movie_id
+		WHERE m.deleted_at IS NULL
+		GROUP BY g.id, g.name
+		ORDER BY count(*) DESC, g.name
+		`
+
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			m.ErrorLog.Println(err)
+		}
+	}()
+
+	summary := []*GenreSummary{}
+
+	for rows.Next() {
+		var genre GenreSummary
+
+		err := rows.Scan(&genre.ID, &genre.Genre, &genre.Movies, &genre.AverageRuntime, &genre.EarliestYear, &genre.LatestYear)
+		if err != nil {
+			return nil, err
+		}
+
+		summary = append(summary, &genre)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return summary, nil
+}
+
+// scanReport scans a reports row (without the artifact) into a Report.
+func scanReport(row interface{ Scan(...interface{}) error }) (*Report, error) {
+	var (
+		report      Report
+		completedAt sql.NullTime
+		params      []byte
+	)
+
+	err := row.Scan(
+		&report.ID,
+		&report.CreatedAt,
+		&report.UpdatedAt,
+		&completedAt,
+		&report.UserID,
+		&report.Type,
+		&report.Format,
+		&params,
+		&report.Status,
+		&report.Progress,
+		&report.Error,
+		&report.ArtifactKey,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if completedAt.Valid {
+		report.CompletedAt = &completedAt.Time
+	}
+
+	err = json.Unmarshal(params, &report.Params)
+	if err != nil {
+		return nil, err
+	}
+
+	return &report, nil
+}
@@ -0,0 +1,486 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/codeaucafe/snippetbox/greenlight/internal/validator"
+	"github.com/lib/pq"
+)
+
+// ErrDuplicateReview is returned when a user tries to review a movie which they have already
+// reviewed.
+var ErrDuplicateReview = errors.New("duplicate review")
+
+// Moderation statuses of a review. New and edited reviews are pending until a moderator
+// approves or rejects them, unless they're approved automatically. Only approved reviews are
+// shown to other users and count towards the movie's average rating.
+const (
+	ReviewStatusPending  = "pending"
+	ReviewStatusApproved = "approved"
+	ReviewStatusRejected = "rejected"
+)
+
+// ReviewStatuses holds the moderation statuses which a review can have.
+var ReviewStatuses = []string{ReviewStatusPending, ReviewStatusApproved, ReviewStatusRejected}
+
+// reviewTransitions holds the moderation decisions which a moderator can make for a review in
+// each status. Pending reviews can be approved or rejected, and the decision can be reversed
+// later, but only the author can send a review back to pending, by editing it.
+var reviewTransitions = map[string][]string{
+	ReviewStatusPending:  {ReviewStatusApproved, ReviewStatusRejected},
+	ReviewStatusApproved: {ReviewStatusRejected},
+	ReviewStatusRejected: {ReviewStatusApproved},
+}
+
+// Review represents a user's review of a movie. Each user can review a movie once, and then
+// change or delete their review.
+type Review struct {
+	ID        int64     `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	MovieID   int64     `json:"movie_id"`
+	UserID    int64     `json:"user_id"`
+	Rating    int       `json:"rating"` // Rating from 1 to 10
+	Body      string    `json:"body"`
+	// Status is the moderation status of the review, and ModerationNote is the reason given by
+	// the moderator (or the automatic filter) for their decision.
+	Status         string `json:"status"`
+	ModerationNote string `json:"moderation_note,omitempty"`
+	// ModeratedBy is the ID of the moderator who last approved or rejected the review, or nil
+	// if it hasn't been moderated by hand.
+	ModeratedBy *int64 `json:"-"`
+	Version     int32  `json:"version"`
+}
+
+// CanTransition reports whether a moderator can change the review's status to the given status.
+func (review *Review) CanTransition(status string) bool {
+	return validator.In(status, reviewTransitions[review.Status]...)
+}
+
+// ReviewModel struct wraps a sql.DB connection pool and allows us to work with the Review struct
+// type and the reviews table in our database.
+type ReviewModel struct {
+	DB       *sql.DB
+	InfoLog  *log.Logger
+	ErrorLog *log.Logger
+}
+
+// reviewColumns are the columns selected for a review, in the order that scanReview expects.
+const reviewColumns = `id, created_at, updated_at, movie_id, user_id, rating, body, status, moderation_note,
+	moderated_by, version`
+
+// scanReview scans a row of reviewColumns into a Review. Any extra destinations, such as the
+// total count of a paginated query, are scanned first.
+func scanReview(row interface{ Scan(...interface{}) error }, extra ...interface{}) (*Review, error) {
+	var review Review
+
+	dest := append(extra,
+		&review.ID,
+		&review.CreatedAt,
+		&review.UpdatedAt,
+		&review.MovieID,
+		&review.UserID,
+		&review.Rating,
+		&review.Body,
+		&review.Status,
+		&review.ModerationNote,
+		&review.ModeratedBy,
+		&review.Version,
+	)
+
+	err := row.Scan(dest...)
+	if err != nil {
+		return nil, err
+	}
+
+	return &review, nil
+}
+
+// Insert adds a new review to the reviews table, with the moderation status and note already
+// set on the review. ErrDuplicateReview is returned if the user has already reviewed the movie,
+// and ErrRecordNotFound if the movie doesn't exist. The review is recorded in the audit log, as
+// created by the user in the context.
+func (m ReviewModel) Insert(ctx context.Context, review *Review) error {
+	query := `
+		INSERT INTO reviews (movie_id, user_id, rating, body, status, moderation_note)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING id, created_at, updated_at, version
+		`
+
+	args := []interface{}{review.MovieID, review.UserID, review.Rating, review.Body, review.Status, review.ModerationNote}
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	err := withAudit(ctx, m.DB, AuditCreate, "reviews", 0, func(tx *sql.Tx) (int64, error) {
+		err := tx.QueryRowContext(ctx, query, args...).Scan(&review.ID, &review.CreatedAt, &review.UpdatedAt,
+			&review.Version)
+		return review.ID, err
+	})
+	if err != nil {
+		switch {
+		case err.Error() == `pq: duplicate key value violates unique constraint "reviews_movie_id_user_id_key"`:
+			return ErrDuplicateReview
+		case err.Error() == `pq: insert or update on table "reviews" violates foreign key constraint "reviews_movie_id_fkey"`:
+			return ErrRecordNotFound
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Get returns a review by its ID. ErrRecordNotFound is returned if the review doesn't exist.
+func (m ReviewModel) Get(ctx context.Context, id int64) (*Review, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := fmt.Sprintf(`
+		SELECT %s
+		FROM reviews
+		WHERE id = $1`,
+		reviewColumns)
+
+	return m.getOne(ctx, query, id)
+}
+
+// GetMany returns the reviews with the given IDs which exist, keyed by ID, in a single query,
+// whatever their moderation status. It's used to batch the lookups of many reviews at once.
+func (m ReviewModel) GetMany(ctx context.Context, ids []int64) (map[int64]*Review, error) {
+	query := fmt.Sprintf(`
+		SELECT %s
+		FROM reviews
+		WHERE id = ANY($1)`,
+		reviewColumns)
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, pq.Array(ids))
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			m.ErrorLog.Println(err)
+		}
+	}()
+
+	reviews := make(map[int64]*Review, len(ids))
+
+	for rows.Next() {
+		review, err := scanReview(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		reviews[review.ID] = review
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return reviews, nil
+}
+
+// GetForUser returns a user's review of a movie, whatever its moderation status.
+// ErrRecordNotFound is returned if the user hasn't reviewed the movie.
+func (m ReviewModel) GetForUser(ctx context.Context, movieID, userID int64) (*Review, error) {
+	if movieID < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := fmt.Sprintf(`
+		SELECT %s
+		FROM reviews
+		WHERE movie_id = $1 AND user_id = $2`,
+		reviewColumns)
+
+	return m.getOne(ctx, query, movieID, userID)
+}
+
+// getOne runs a query which returns a single review.
+func (m ReviewModel) getOne(ctx context.Context, query string, args ...interface{}) (*Review, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	review, err := scanReview(m.DB.QueryRowContext(ctx, query, args...))
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return review, nil
+}
+
+// GetAllForMovie returns a page of the approved reviews of a movie, sorted according to the
+// filters.
+func (m ReviewModel) GetAllForMovie(ctx context.Context, movieID int64, filters Filters) ([]*Review, Metadata, error) {
+	query := fmt.Sprintf(`
+		SELECT count(*) OVER(), %s
+		FROM reviews
+		WHERE movie_id = $1 AND status = $2
+		ORDER BY %s %s, id ASC
+		LIMIT $3 OFFSET $4`,
+		reviewColumns, filters.sortColumn(), filters.sortDirection())
+
+	return m.getPage(ctx, query, filters, movieID, ReviewStatusApproved)
+}
+
+// GetAllForMovies returns the same page of the approved reviews of each of the given movies, in
+// a single query, along with the pagination metadata for each movie. Movies without any approved
+// reviews are left out of both maps. It's used to batch the lookups of the reviews of many movies
+// at once.
+func (m ReviewModel) GetAllForMovies(ctx context.Context, movieIDs []int64, filters Filters) (map[int64][]*Review, map[int64]Metadata, error) {
+	query := fmt.Sprintf(`
+		SELECT total, %s
+		FROM (
+			SELECT count(*) OVER (PARTITION BY movie_id) AS total,
+				row_number() OVER (PARTITION BY movie_id ORDER BY %s %s, id ASC) AS position, %s
+			FROM reviews
+			WHERE movie_id = ANY($1) AND status = $2
+		) r
+		WHERE position > $3 AND position <= $3 + $4
+		ORDER BY movie_id, position`,
+		reviewColumns, filters.sortColumn(), filters.sortDirection(), reviewColumns)
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, pq.Array(movieIDs), ReviewStatusApproved, filters.offset(),
+		filters.limit())
+	if err != nil {
+		return nil, nil, err
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			m.ErrorLog.Println(err)
+		}
+	}()
+
+	reviews := make(map[int64][]*Review)
+	metadata := make(map[int64]Metadata)
+
+	for rows.Next() {
+		totalRecords := 0
+
+		review, err := scanReview(rows, &totalRecords)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		reviews[review.MovieID] = append(reviews[review.MovieID], review)
+		metadata[review.MovieID] = calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	return reviews, metadata, nil
+}
+
+// GetAllWithStatus returns a page of the reviews of every movie which have the given moderation
+// status, sorted according to the filters. It's used for the moderation queue.
+func (m ReviewModel) GetAllWithStatus(ctx context.Context, status string, filters Filters) ([]*Review, Metadata, error) {
+	query := fmt.Sprintf(`
+		SELECT count(*) OVER(), %s
+		FROM reviews
+		WHERE status = $1
+		ORDER BY %s %s, id ASC
+		LIMIT $2 OFFSET $3`,
+		reviewColumns, filters.sortColumn(), filters.sortDirection())
+
+	return m.getPage(ctx, query, filters, status)
+}
+
+// getPage runs a paginated query which returns reviews and their total count. The limit and
+// offset from the filters are added to the end of the args.
+func (m ReviewModel) getPage(ctx context.Context, query string, filters Filters, args ...interface{}) ([]*Review, Metadata, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	args = append(args, filters.limit(), filters.offset())
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			m.ErrorLog.Println(err)
+		}
+	}()
+
+	totalRecords := 0
+	reviews := []*Review{}
+
+	for rows.Next() {
+		review, err := scanReview(rows, &totalRecords)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		reviews = append(reviews, review)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	return reviews, calculateMetadata(totalRecords, filters.Page, filters.PageSize), nil
+}
+
+// Update updates a review by its author, including the moderation status and note which the
+// edit has been given, using the version number for optimistic locking in the same way as for
+// movies. ErrEditConflict is returned if the review has been changed or deleted since it was
+// read. The moderator who last decided on the review is kept unless ModeratedBy has been cleared,
+// which the handlers do when the edit has to be moderated again.
+func (m ReviewModel) Update(ctx context.Context, review *Review) error {
+	query := `
+		UPDATE reviews
+		SET rating = $1, body = $2, status = $3, moderation_note = $4, moderated_by = $5,
+			moderated_at = CASE WHEN $5::bigint IS NULL THEN NULL ELSE moderated_at END,
+			updated_at = NOW(), version = version + 1
+		WHERE id = $6 AND version = $7
+		RETURNING updated_at, version
+		`
+
+	args := []interface{}{
+		review.Rating,
+		review.Body,
+		review.Status,
+		review.ModerationNote,
+		review.ModeratedBy,
+		review.ID,
+		review.Version,
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	err := withAudit(ctx, m.DB, AuditUpdate, "reviews", review.ID, func(tx *sql.Tx) (int64, error) {
+		return review.ID, tx.QueryRowContext(ctx, query, args...).Scan(&review.UpdatedAt, &review.Version)
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Moderate records a moderator's decision on a review: its new status and the note explaining
+// it. It uses the version number for optimistic locking, so that a decision can't be made on a
+// version of the review which the moderator hasn't seen. ErrEditConflict is returned if the
+// review has been changed or deleted since it was read.
+func (m ReviewModel) Moderate(ctx context.Context, review *Review, moderatorID int64) error {
+	query := `
+		UPDATE reviews
+		SET status = $1, moderation_note = $2, moderated_by = $3, moderated_at = NOW(), updated_at = NOW(),
+			version = version + 1
+		WHERE id = $4 AND version = $5
+		RETURNING updated_at, version
+		`
+
+	args := []interface{}{review.Status, review.ModerationNote, moderatorID, review.ID, review.Version}
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	err := withAudit(ctx, m.DB, AuditUpdate, "reviews", review.ID, func(tx *sql.Tx) (int64, error) {
+		return review.ID, tx.QueryRowContext(ctx, query, args...).Scan(&review.UpdatedAt, &review.Version)
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+
+	review.ModeratedBy = &moderatorID
+
+	return nil
+}
+
+// DeleteForUser removes a user's review of a movie, and records the deletion in the audit log.
+// ErrRecordNotFound is returned if the user hasn't reviewed the movie.
+func (m ReviewModel) DeleteForUser(ctx context.Context, movieID, userID int64) error {
+	if movieID < 1 {
+		return ErrRecordNotFound
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	// Look the review up first, as the audit log needs its ID to snapshot it before it's deleted.
+	var id int64
+
+	err = tx.QueryRowContext(ctx, "SELECT id FROM reviews WHERE movie_id = $1 AND user_id = $2 FOR UPDATE",
+		movieID, userID).Scan(&id)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrRecordNotFound
+		default:
+			return err
+		}
+	}
+
+	change := newAudit(AuditDelete, "reviews")
+
+	err = change.before(ctx, tx, id)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, "DELETE FROM reviews WHERE id = $1", id)
+	if err != nil {
+		return err
+	}
+
+	err = change.record(ctx, tx, id)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// ValidateReview runs validation checks on the Review type.
+func ValidateReview(v *validator.Validator, review *Review) {
+	v.Check(review.Rating >= 1 && review.Rating <= 10, "rating", "must be between 1 and 10")
+	v.Check(len(review.Body) <= 10_000, "body", "must not be more than 10000 bytes long")
+}
+
+// ValidateModerationNote runs validation checks on the note a moderator gives for a decision.
+func ValidateModerationNote(v *validator.Validator, note string) {
+	v.Check(len(note) <= 1000, "note", "must not be more than 1000 bytes long")
+}
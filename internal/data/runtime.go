@@ -3,6 +3,7 @@ package data
 import (
 	"errors"
 	"fmt"
+	"math"
 	"strconv"
 	"strings"
 )
@@ -28,21 +29,117 @@ func (r Runtime) MarshalJSON() ([]byte, error) {
 	return []byte(quotedJSONValue), nil
 }
 
+// The formats which a Runtime can be written in. RuntimeFormatMins is the "<runtime> mins" string
+// used by MarshalJSON, RuntimeFormatMinutes is a plain number of minutes, and
+// RuntimeFormatISO8601 is an ISO 8601 duration, such as "PT1H47M". UnmarshalJSON accepts all
+// three.
+const (
+	RuntimeFormatMins    = "mins"
+	RuntimeFormatMinutes = "minutes"
+	RuntimeFormatISO8601 = "iso8601"
+)
+
+// RuntimeFormats holds the formats which a Runtime can be written in.
+var RuntimeFormats = []string{RuntimeFormatMins, RuntimeFormatMinutes, RuntimeFormatISO8601}
+
+// Format returns the runtime in the given format, as a value to be encoded to JSON. Unknown
+// formats fall back to RuntimeFormatMins.
+func (r Runtime) Format(format string) interface{} {
+	switch format {
+	case RuntimeFormatMinutes:
+		return int32(r)
+	case RuntimeFormatISO8601:
+		return r.ISO8601()
+	default:
+		return fmt.Sprintf("%d mins", r)
+	}
+}
+
+// ISO8601 returns the runtime as an ISO 8601 duration in hours and minutes, such as "PT1H47M".
+func (r Runtime) ISO8601() string {
+	hours, minutes := r/60, r%60
+
+	var b strings.Builder
+	b.WriteString("PT")
+
+	if hours > 0 {
+		fmt.Fprintf(&b, "%dH", hours)
+	}
+	if minutes > 0 || hours == 0 {
+		fmt.Fprintf(&b, "%dM", minutes)
+	}
+
+	return b.String()
+}
+
+// parseISO8601Runtime parses an ISO 8601 duration made up of hours and minutes, such as
+// "PT1H47M" or "PT107M", as a Runtime. Durations with any other components (such as days or
+// seconds) aren't accepted, since a runtime is a whole number of minutes.
+func parseISO8601Runtime(s string) (Runtime, error) {
+	if !strings.HasPrefix(s, "PT") || len(s) == len("PT") {
+		return 0, ErrInvalidRuntimeFormat
+	}
+
+	rest := strings.TrimPrefix(s, "PT")
+
+	var total int64
+
+	for _, unit := range []struct {
+		designator string
+		minutes    int64
+	}{{"H", 60}, {"M", 1}} {
+		number, after, found := strings.Cut(rest, unit.designator)
+		if !found {
+			continue
+		}
+
+		n, err := strconv.ParseInt(number, 10, 32)
+		if err != nil || n < 0 {
+			return 0, ErrInvalidRuntimeFormat
+		}
+
+		total += n * unit.minutes
+		rest = after
+	}
+
+	if rest != "" || total > math.MaxInt32 {
+		return 0, ErrInvalidRuntimeFormat
+	}
+
+	return Runtime(total), nil
+}
+
 // UnmarshalJSON ensures that Runtime satisfies the
 // json.Unmarshaler interface. IMPORTANT: because UnmarshalJSON() needs to modify the
 // receiver (our Runtime type), we must use a pointer receiver for this to work
 // correctly. Otherwise, we will only be modifying a copy (which is then discarded when
 // this method returns).
 func (r *Runtime) UnmarshalJSON(jsonValue []byte) error {
-	// We expect that the incoming JSON value will be a string in the format
-	// "<runtime> mins", and the first thing we need to do is remove the surrounding
-	// double-quotes from this string. If we can't unquote it, then we return the
+	// A plain number is the runtime in minutes.
+	if len(jsonValue) > 0 && jsonValue[0] != '"' {
+		i, err := strconv.ParseInt(string(jsonValue), 10, 32)
+		if err != nil {
+			return ErrInvalidRuntimeFormat
+		}
+
+		*r = Runtime(i)
+		return nil
+	}
+
+	// Otherwise we expect that the incoming JSON value will be a string, either an ISO 8601
+	// duration or in the format "<runtime> mins", and the first thing we need to do is remove
+	// the surrounding double-quotes from this string. If we can't unquote it, then we return the
 	// ErrInvalidRuntimeFormat error.
 	unquotedJSONValue, err := strconv.Unquote(string(jsonValue))
 	if err != nil {
 		return ErrInvalidRuntimeFormat
 	}
 
+	if strings.HasPrefix(unquotedJSONValue, "P") {
+		*r, err = parseISO8601Runtime(unquotedJSONValue)
+		return err
+	}
+
 	// Split the string to isolate the part containing the number.
 	parts := strings.Split(unquotedJSONValue, " ")
 
@@ -0,0 +1,291 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/codeaucafe/snippetbox/greenlight/internal/validator"
+)
+
+// SavedSearch represents a named search filter which a user has saved so that they can re-run it
+// later, and optionally be notified when new movies match it.
+type SavedSearch struct {
+	ID          int64        `json:"id"`
+	CreatedAt   time.Time    `json:"created_at"`
+	UserID      int64        `json:"-"`
+	Name        string       `json:"name"`
+	Filter      SearchFilter `json:"filter"`
+	Notify      bool         `json:"notify"`
+	LastMovieID int64        `json:"-"`
+	Version     int32        `json:"version"`
+}
+
+// SavedSearchNotification holds a saved search which has notifications enabled, along with the
+// email address and notification preferences of the user who owns it.
+type SavedSearchNotification struct {
+	Search      *SavedSearch
+	Email       string
+	Preferences NotificationPreferences
+}
+
+// SavedSearchModel struct wraps a sql.DB connection pool and allows us to work with the
+// SavedSearch struct type and the saved_searches table in our database.
+type SavedSearchModel struct {
+	DB       *sql.DB
+	InfoLog  *log.Logger
+	ErrorLog *log.Logger
+}
+
+// Insert adds a new saved search to the saved_searches table. The search starts from the newest
+// movie currently in the database, so that notifications are only sent for movies added after
+// the search was saved.
+func (m SavedSearchModel) Insert(ctx context.Context, search *SavedSearch) error {
+	filter, err := json.Marshal(search.Filter)
+	if err != nil {
+		return err
+	}
+
+	query := `
+		INSERT INTO saved_searches (user_id, name, filter, notify, last_movie_id)
+		VALUES ($1, $2, $3, $4, (SELECT COALESCE(MAX(id), 0) FROM movies))
+		RETURNING id, created_at, last_movie_id, version
+		`
+
+	args := []interface{}{search.UserID, search.Name, filter, search.Notify}
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	return withAudit(ctx, m.DB, AuditCreate, "saved_searches", 0, func(tx *sql.Tx) (int64, error) {
+		err := tx.QueryRowContext(ctx, query, args...).Scan(
+			&search.ID,
+			&search.CreatedAt,
+			&search.LastMovieID,
+			&search.Version,
+		)
+		if err != nil {
+			return 0, err
+		}
+
+		return search.ID, nil
+	})
+}
+
+// Get returns a specific saved search belonging to a user. ErrRecordNotFound is returned if the
+// search doesn't exist or belongs to another user, so that we don't reveal which IDs exist.
+func (m SavedSearchModel) Get(ctx context.Context, id, userID int64) (*SavedSearch, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `
+		SELECT id, created_at, user_id, name, filter, notify, last_movie_id, version
+		FROM saved_searches
+		WHERE id = $1 AND user_id = $2
+		`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	search, err := scanSavedSearch(m.DB.QueryRowContext(ctx, query, id, userID))
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return search, nil
+}
+
+// GetAllForUser returns all of the saved searches belonging to a user, oldest first.
+func (m SavedSearchModel) GetAllForUser(ctx context.Context, userID int64) ([]*SavedSearch, error) {
+	query := `
+		SELECT id, created_at, user_id, name, filter, notify, last_movie_id, version
+		FROM saved_searches
+		WHERE user_id = $1
+		ORDER BY id
+		`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			m.ErrorLog.Println(err)
+		}
+	}()
+
+	searches := []*SavedSearch{}
+
+	for rows.Next() {
+		search, err := scanSavedSearch(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		searches = append(searches, search)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return searches, nil
+}
+
+// GetAllForNotification returns every saved search which has notifications enabled and which
+// belongs to an activated user, along with the user's email address and notification preferences.
+func (m SavedSearchModel) GetAllForNotification(ctx context.Context) ([]*SavedSearchNotification, error) {
+	query := `
+		SELECT s.id, s.created_at, s.user_id, s.name, s.filter, s.notify, s.last_movie_id, s.version,
+			u.email, COALESCE(p.email, true), COALESCE(p.in_app, true)
+		FROM saved_searches s
+		INNER JOIN users u ON u.id = s.user_id
+		LEFT JOIN notification_preferences p ON p.user_id = s.user_id
+		WHERE s.notify = true AND u.activated = true AND u.deleted_at IS NULL
+		ORDER BY s.id
+		`
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			m.ErrorLog.Println(err)
+		}
+	}()
+
+	notifications := []*SavedSearchNotification{}
+
+	for rows.Next() {
+		n := SavedSearchNotification{}
+
+		n.Search, err = scanSavedSearch(rows, &n.Email, &n.Preferences.Email, &n.Preferences.InApp)
+		if err != nil {
+			return nil, err
+		}
+
+		notifications = append(notifications, &n)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return notifications, nil
+}
+
+// UpdateLastMovieID records the highest movie ID which has been checked against a saved search.
+func (m SavedSearchModel) UpdateLastMovieID(ctx context.Context, id, lastMovieID int64) error {
+	query := `
+		UPDATE saved_searches
+		SET last_movie_id = $1
+		WHERE id = $2 AND last_movie_id < $1
+		`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, lastMovieID, id)
+	return err
+}
+
+// Delete removes a specific saved search belonging to a user.
+func (m SavedSearchModel) Delete(ctx context.Context, id, userID int64) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+
+	query := `
+		DELETE FROM saved_searches
+		WHERE id = $1 AND user_id = $2
+		`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	return withAudit(ctx, m.DB, AuditDelete, "saved_searches", id, func(tx *sql.Tx) (int64, error) {
+		result, err := tx.ExecContext(ctx, query, id, userID)
+		if err != nil {
+			return 0, err
+		}
+
+		rowsAffected, err := result.RowsAffected()
+		if err != nil {
+			return 0, err
+		}
+
+		if rowsAffected == 0 {
+			return 0, ErrRecordNotFound
+		}
+
+		return id, nil
+	})
+}
+
+// NewMatchesFilter returns a filter matching the movies which satisfy the saved search and have
+// been added since it was last checked.
+func (s *SavedSearch) NewMatchesFilter() SearchFilter {
+	return SearchFilter{
+		And: []SearchFilter{
+			s.Filter,
+			{Field: "id", Op: "gt", Value: json.RawMessage(strconv.FormatInt(s.LastMovieID, 10))},
+		},
+	}
+}
+
+// ValidateSavedSearch runs validation checks on the SavedSearch type.
+func ValidateSavedSearch(v *validator.Validator, search *SavedSearch) {
+	v.Check(search.Name != "", "name", "must be provided")
+	v.Check(len(search.Name) <= 100, "name", "must not be more than 100 bytes long")
+
+	ValidateSearchFilter(v, &search.Filter)
+}
+
+// scanSavedSearch scans a saved_searches row into a SavedSearch, decoding the JSON filter. Any
+// extra destinations are scanned from the columns following the saved search ones.
+func scanSavedSearch(row interface{ Scan(...interface{}) error }, extra ...interface{}) (*SavedSearch, error) {
+	var (
+		search SavedSearch
+		filter []byte
+	)
+
+	dest := append([]interface{}{
+		&search.ID,
+		&search.CreatedAt,
+		&search.UserID,
+		&search.Name,
+		&filter,
+		&search.Notify,
+		&search.LastMovieID,
+		&search.Version,
+	}, extra...)
+
+	err := row.Scan(dest...)
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(filter, &search.Filter)
+	if err != nil {
+		return nil, err
+	}
+
+	return &search, nil
+}
@@ -0,0 +1,316 @@
+package data
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/codeaucafe/snippetbox/greenlight/internal/validator"
+	"github.com/lib/pq"
+)
+
+// MaxSearchComplexity is the maximum number of nodes (and/or/not operators plus field predicates)
+// allowed in a search filter, and MaxSearchDepth the maximum nesting depth. These stop clients
+// from sending filters which are expensive to plan and execute.
+const (
+	MaxSearchComplexity = 32
+	MaxSearchDepth      = 8
+)
+
+// searchField describes a movie field which can be used in a search filter predicate, along with
+// the operators which are supported for it.
+type searchField struct {
+	column string
+	kind   string // "string", "int" or "strings"
+	ops    []string
+	// vector is the tsvector column holding the full-text search document for the field, for
+	// the match operator.
+	vector string
+}
+
+// searchFields holds the fields which can be used in search filter predicates.
+var searchFields = map[string]searchField{
+	"id":      {column: "id", kind: "int", ops: []string{"eq", "ne", "lt", "lte", "gt", "gte", "in"}},
+	"title":   {column: "title", kind: "string", ops: []string{"eq", "ne", "match", "contains", "prefix"}, vector: "search_vector"},
+	"year":    {column: "year", kind: "int", ops: []string{"eq", "ne", "lt", "lte", "gt", "gte", "in"}},
+	"runtime": {column: "runtime", kind: "int", ops: []string{"eq", "ne", "lt", "lte", "gt", "gte", "in"}},
+	"genres":  {column: movieGenres + "::citext[]", kind: "strings", ops: []string{"contains", "overlaps"}},
+
+	"created_by": {column: "created_by", kind: "int", ops: []string{"eq", "ne", "in"}},
+	"updated_by": {column: "updated_by", kind: "int", ops: []string{"eq", "ne", "in"}},
+}
+
+// comparisonOperators maps the simple comparison operators to their SQL equivalent.
+var comparisonOperators = map[string]string{
+	"eq":  "=",
+	"ne":  "<>",
+	"lt":  "<",
+	"lte": "<=",
+	"gt":  ">",
+	"gte": ">=",
+}
+
+// SearchFilter is a node in a search filter document. Each node is exactly one of: an "and" or
+// "or" over a list of child filters, a "not" of a single child filter, or a predicate comparing a
+// field with a value. For example:
+//
+//	{"and": [
+//		{"field": "genres", "op": "contains", "value": ["drama"]},
+//		{"or": [
+//			{"field": "year", "op": "lt", "value": 1960},
+//			{"not": {"field": "runtime", "op": "gt", "value": 120}}
+//		]}
+//	]}
+type SearchFilter struct {
+	And   []SearchFilter  `json:"and,omitempty"`
+	Or    []SearchFilter  `json:"or,omitempty"`
+	Not   *SearchFilter   `json:"not,omitempty"`
+	Field string          `json:"field,omitempty"`
+	Op    string          `json:"op,omitempty"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+// ValidateSearchFilter runs validation checks on a SearchFilter, including the complexity limits.
+func ValidateSearchFilter(v *validator.Validator, f *SearchFilter) {
+	complexity := 0
+	f.validate(v, "filter", 1, &complexity)
+
+	v.Check(complexity <= MaxSearchComplexity, "filter",
+		fmt.Sprintf("must not contain more than %d operators and predicates", MaxSearchComplexity))
+}
+
+// validate checks a single node of the filter (and its children), adding any errors under the
+// given key, which holds the path to the node, such as "filter.and[1].not".
+func (f *SearchFilter) validate(v *validator.Validator, key string, depth int, complexity *int) {
+	*complexity++
+
+	if depth > MaxSearchDepth {
+		v.AddError(key, fmt.Sprintf("must not be nested more than %d levels deep", MaxSearchDepth))
+		return
+	}
+
+	// Count how many kinds of node have been set, as exactly one is allowed.
+	kinds := 0
+	for _, set := range []bool{f.And != nil, f.Or != nil, f.Not != nil, f.Field != ""} {
+		if set {
+			kinds++
+		}
+	}
+
+	if kinds != 1 {
+		v.AddError(key, `must contain exactly one of "and", "or", "not" or "field"`)
+		return
+	}
+
+	switch {
+	case f.And != nil || f.Or != nil:
+		children, name := f.And, "and"
+		if f.Or != nil {
+			children, name = f.Or, "or"
+		}
+
+		if len(children) == 0 {
+			v.AddError(key+"."+name, "must contain at least 1 filter")
+			return
+		}
+
+		for i := range children {
+			children[i].validate(v, fmt.Sprintf("%s.%s[%d]", key, name, i), depth+1, complexity)
+		}
+
+	case f.Not != nil:
+		f.Not.validate(v, key+".not", depth+1, complexity)
+
+	default:
+		field, ok := searchFields[f.Field]
+		if !ok {
+			v.AddError(key+".field", "invalid field")
+			return
+		}
+
+		if !validator.In(f.Op, field.ops...) {
+			v.AddError(key+".op", fmt.Sprintf("invalid operator for %s, must be one of %s",
+				f.Field, strings.Join(field.ops, ", ")))
+			return
+		}
+
+		if _, err := f.value(field); err != nil {
+			v.AddError(key+".value", err.Error())
+		}
+	}
+}
+
+// value decodes the predicate's value into the Go type expected by the field and operator.
+func (f *SearchFilter) value(field searchField) (interface{}, error) {
+	if len(f.Value) == 0 {
+		return nil, fmt.Errorf("must be provided")
+	}
+
+	switch {
+	case field.kind == "strings" || f.Op == "in":
+		if field.kind == "int" {
+			var values []int64
+			if err := json.Unmarshal(f.Value, &values); err != nil || len(values) == 0 {
+				return nil, fmt.Errorf("must be a non-empty array of integers")
+			}
+			return pq.Array(values), nil
+		}
+
+		var values []string
+		if err := json.Unmarshal(f.Value, &values); err != nil || len(values) == 0 {
+			return nil, fmt.Errorf("must be a non-empty array of strings")
+		}
+		return pq.Array(values), nil
+
+	case field.kind == "int":
+		var value int64
+		if err := json.Unmarshal(f.Value, &value); err != nil {
+			return nil, fmt.Errorf("must be an integer")
+		}
+		return value, nil
+
+	default:
+		var value string
+		if err := json.Unmarshal(f.Value, &value); err != nil || value == "" {
+			return nil, fmt.Errorf("must be a non-empty string")
+		}
+		return value, nil
+	}
+}
+
+// sql compiles the filter into a SQL boolean expression. The values are never interpolated into
+// the SQL; instead they are appended to args and referenced with placeholder parameters. This
+// must only be called on a filter which has passed ValidateSearchFilter.
+func (f *SearchFilter) sql(args *[]interface{}) string {
+	switch {
+	case f.And != nil || f.Or != nil:
+		children, joiner := f.And, " AND "
+		if f.Or != nil {
+			children, joiner = f.Or, " OR "
+		}
+
+		parts := make([]string, len(children))
+		for i := range children {
+			parts[i] = children[i].sql(args)
+		}
+
+		return "(" + strings.Join(parts, joiner) + ")"
+
+	case f.Not != nil:
+		return "(NOT " + f.Not.sql(args) + ")"
+	}
+
+	field := searchFields[f.Field]
+
+	value, err := f.value(field)
+	if err != nil {
+		// This should have been caught by ValidateSearchFilter, so it's a logic error in our
+		// codebase if we get here.
+		panic("unvalidated search filter: " + err.Error())
+	}
+
+	// The text of a contains or prefix filter on a string field is matched literally, so the
+	// LIKE wildcards in it are escaped.
+	if (f.Op == "contains" || f.Op == "prefix") && field.kind == "string" {
+		value = escapeLike(value.(string))
+	}
+
+	*args = append(*args, value)
+	placeholder := fmt.Sprintf("$%d", len(*args))
+
+	switch f.Op {
+	case "in":
+		return fmt.Sprintf("(%s = ANY(%s))", field.column, placeholder)
+	case "match":
+		return fmt.Sprintf("(%s @@ plainto_tsquery('simple', %s))", field.vector, placeholder)
+	case "contains":
+		if field.kind == "strings" {
+			return fmt.Sprintf("(%s @> %s)", field.column, placeholder)
+		}
+		return fmt.Sprintf("(%s ILIKE '%%' || %s || '%%' ESCAPE '\\')", field.column, placeholder)
+	case "prefix":
+		return fmt.Sprintf("(%s ILIKE %s || '%%' ESCAPE '\\')", field.column, placeholder)
+	case "overlaps":
+		return fmt.Sprintf("(%s && %s)", field.column, placeholder)
+	default:
+		return fmt.Sprintf("(%s %s %s)", field.column, comparisonOperators[f.Op], placeholder)
+	}
+}
+
+// likeEscaper escapes the characters which have a special meaning in a LIKE pattern whose escape
+// character is a backslash.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// escapeLike returns s escaped for use in a LIKE or ILIKE pattern with ESCAPE '\', so that it
+// only matches itself.
+func escapeLike(s string) string {
+	return likeEscaper.Replace(s)
+}
+
+// Search returns a page of the movies matching a search filter, which must have passed
+// ValidateSearchFilter. It works in the same way as GetAll, except that the WHERE clause is
+// compiled from the filter document.
+func (m MovieModel) Search(ctx context.Context, filter SearchFilter, filters Filters) ([]*Movie, Metadata, error) {
+	var args []interface{}
+	where := filter.sql(&args)
+
+	args = append(args, filters.limit(), filters.offset())
+
+	query := fmt.Sprintf(`
+		SELECT count(*) OVER(), id, COALESCE(ulid, ''), created_at, title, year, runtime, release_date, poster_key, %s, version, created_by, updated_by, %s
+		FROM movies
+		WHERE deleted_at IS NULL AND %s
+		ORDER BY %s %s, id ASC
+		LIMIT $%d OFFSET $%d`,
+		movieGenres, movieAverageRating, where, filters.sortColumn(), filters.sortDirection(), len(args)-1, len(args))
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			m.ErrorLog.Println(err)
+		}
+	}()
+
+	totalRecords := 0
+	movies := []*Movie{}
+
+	for rows.Next() {
+		var movie Movie
+
+		err := rows.Scan(
+			&totalRecords,
+			&movie.ID,
+			&movie.ULID,
+			&movie.CreatedAt,
+			&movie.Title,
+			&movie.Year,
+			&movie.Runtime,
+			&movie.ReleaseDate,
+			moviePoster(&movie),
+			pq.Array(&movie.Genres),
+			&movie.Version,
+			&movie.CreatedBy,
+			&movie.UpdatedBy,
+			&movie.AverageRating,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		movies = append(movies, &movie)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	return movies, calculateMetadata(totalRecords, filters.Page, filters.PageSize), nil
+}
@@ -0,0 +1,144 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/url"
+	"time"
+
+	"github.com/codeaucafe/snippetbox/greenlight/internal/validator"
+)
+
+// LogLevels holds the log levels which can be set at runtime through the settings.
+var LogLevels = []string{"info", "error", "fatal", "off"}
+
+// Settings holds the subset of the application configuration which is safe to change at runtime.
+// The values are stored as a single JSON document in the runtime_settings table, which only ever
+// contains one row.
+type Settings struct {
+	LimiterRPS         float64   `json:"limiter_rps"`
+	LimiterBurst       int       `json:"limiter_burst"`
+	LimiterEnabled     bool      `json:"limiter_enabled"`
+	MaintenanceMode    bool      `json:"maintenance_mode"`
+	LogLevel           string    `json:"log_level"`
+	CORSTrustedOrigins []string  `json:"cors_trusted_origins"`
+	UpdatedAt          time.Time `json:"updated_at"`
+	Version            int32     `json:"version"`
+}
+
+// SettingsModel struct wraps a sql.DB connection pool and allows us to work with the Settings
+// struct type and the runtime_settings table in our database.
+type SettingsModel struct {
+	DB       *sql.DB
+	InfoLog  *log.Logger
+	ErrorLog *log.Logger
+}
+
+// Get fetches the stored runtime settings. If the settings have never been saved, it returns an
+// ErrRecordNotFound error and the caller should fall back to the values from the config.
+func (m SettingsModel) Get(ctx context.Context) (*Settings, error) {
+	query := `
+		SELECT settings, updated_at, version
+		FROM runtime_settings
+		WHERE id = 1
+		`
+
+	var (
+		settings Settings
+		document []byte
+	)
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query).Scan(&document, &settings.UpdatedAt, &settings.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	// Decode the JSON document into the settings struct. Note that we then set the updated_at
+	// and version values from the columns again, as they are the source of truth for these.
+	updatedAt, version := settings.UpdatedAt, settings.Version
+
+	err = json.Unmarshal(document, &settings)
+	if err != nil {
+		return nil, err
+	}
+
+	settings.UpdatedAt, settings.Version = updatedAt, version
+
+	return &settings, nil
+}
+
+// Save stores the runtime settings, recording the ID of the user who changed them. Settings with
+// a version of 0 have never been saved, so we insert the row; otherwise we update it as long as
+// the version still matches. In both cases ErrEditConflict is returned if someone else saved
+// the settings first. The change is recorded in the audit log.
+func (m SettingsModel) Save(ctx context.Context, settings *Settings, userID int64) error {
+	document, err := json.Marshal(settings)
+	if err != nil {
+		return err
+	}
+
+	query := `
+		UPDATE runtime_settings
+		SET settings = $1, updated_at = NOW(), updated_by = $2, version = version + 1
+		WHERE id = 1 AND version = $3
+		RETURNING updated_at, version
+		`
+	args := []interface{}{document, userID, settings.Version}
+
+	if settings.Version == 0 {
+		query = `
+			INSERT INTO runtime_settings (id, settings, updated_by)
+			VALUES (1, $1, $2)
+			ON CONFLICT (id) DO NOTHING
+			RETURNING updated_at, version
+			`
+		args = args[:2]
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	err = withAudit(ctx, m.DB, AuditUpdate, "settings", 1, func(tx *sql.Tx) (int64, error) {
+		return 1, tx.QueryRowContext(ctx, query, args...).Scan(&settings.UpdatedAt, &settings.Version)
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ValidateSettings runs validation checks on the Settings type.
+func ValidateSettings(v *validator.Validator, settings *Settings) {
+	v.Check(settings.LimiterRPS > 0, "limiter_rps", "must be greater than zero")
+	v.Check(settings.LimiterBurst > 0, "limiter_burst", "must be greater than zero")
+	v.Check(validator.In(settings.LogLevel, LogLevels...), "log_level", "invalid log level")
+
+	for _, origin := range settings.CORSTrustedOrigins {
+		if origin == "*" {
+			continue
+		}
+
+		u, err := url.Parse(origin)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			v.AddError("cors_trusted_origins", "must only contain origins in the format scheme://host[:port]")
+			break
+		}
+	}
+}
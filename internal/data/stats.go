@@ -0,0 +1,176 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"time"
+
+	"github.com/codeaucafe/snippetbox/greenlight/internal/validator"
+)
+
+// StatsViews holds the names of the materialized views which back the stats endpoints. They are
+// refreshed periodically by a background job, and on demand through the admin endpoint.
+var StatsViews = []string{"movie_genre_stats", "trending_movies"}
+
+// TrendingMovie holds a movie along with the number of times it has been viewed over the last
+// week.
+type TrendingMovie struct {
+	ID    int64  `json:"id"`
+	Title string `json:"title"`
+	Year  int32  `json:"year"`
+	Views int64  `json:"views"`
+}
+
+// StatsModel struct wraps a sql.DB connection pool and allows us to work with the movie_views
+// table and the materialized views computed from it and the movies table.
+type StatsModel struct {
+	DB       *sql.DB
+	InfoLog  *log.Logger
+	ErrorLog *log.Logger
+}
+
+// Genres returns the catalog statistics for each genre, as of the last refresh of the
+// movie_genre_stats view.
+func (m StatsModel) Genres(ctx context.Context) ([]*GenreSummary, error) {
+	query := `
+		SELECT genre_id, genre, movies, average_runtime, earliest_year, latest_year
+		FROM movie_genre_stats
+		ORDER BY movies DESC, genre
+		`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			m.ErrorLog.Println(err)
+		}
+	}()
+
+	genres := []*GenreSummary{}
+
+	for rows.Next() {
+		var genre GenreSummary
+
+		err := rows.Scan(&genre.ID, &genre.Genre, &genre.Movies, &genre.AverageRuntime, &genre.EarliestYear, &genre.LatestYear)
+		if err != nil {
+			return nil, err
+		}
+
+		genres = append(genres, &genre)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return genres, nil
+}
+
+// Trending returns the most viewed movies over the last week, as of the last refresh of the
+// trending_movies view.
+func (m StatsModel) Trending(ctx context.Context, limit int) ([]*TrendingMovie, error) {
+	query := `
+		SELECT id, title, year, views
+		FROM trending_movies
+		ORDER BY views DESC, id
+		LIMIT $1
+		`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			m.ErrorLog.Println(err)
+		}
+	}()
+
+	movies := []*TrendingMovie{}
+
+	for rows.Next() {
+		var movie TrendingMovie
+
+		err := rows.Scan(&movie.ID, &movie.Title, &movie.Year, &movie.Views)
+		if err != nil {
+			return nil, err
+		}
+
+		movies = append(movies, &movie)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return movies, nil
+}
+
+// AddViews adds the given view counts (keyed by movie ID) to the totals for a day.
+func (m StatsModel) AddViews(ctx context.Context, day time.Time, views map[int64]int64) error {
+	query := `
+		INSERT INTO movie_views (movie_id, day, views)
+		SELECT $1, $2, $3
+		WHERE EXISTS (SELECT 1 FROM movies WHERE id = $1 AND deleted_at IS NULL)
+		ON CONFLICT (movie_id, day) DO UPDATE
+		SET views = movie_views.views + EXCLUDED.views
+		`
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	stmt, err := tx.PrepareContext(ctx, query)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := stmt.Close(); err != nil {
+			m.ErrorLog.Println(err)
+		}
+	}()
+
+	// Movies which have been deleted since they were viewed are skipped by the WHERE EXISTS
+	// clause, rather than failing the whole batch on the foreign key.
+	for movieID, count := range views {
+		_, err = stmt.ExecContext(ctx, movieID, day, count)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// Refresh recomputes a materialized view. It uses REFRESH MATERIALIZED VIEW CONCURRENTLY, so that
+// the stats endpoints can keep reading the old contents while the refresh runs.
+func (m StatsModel) Refresh(ctx context.Context, view string) error {
+	// The view name can't be a placeholder parameter, so check it against the known views as a
+	// failsafe in the same way as for sort columns.
+	if !validator.In(view, StatsViews...) {
+		panic("unknown materialized view: " + view)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Minute)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, "REFRESH MATERIALIZED VIEW CONCURRENTLY "+view)
+	return err
+}
@@ -0,0 +1,413 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"math"
+	"time"
+
+	"github.com/codeaucafe/snippetbox/greenlight/internal/validator"
+	"github.com/lib/pq"
+)
+
+// IncidentImpacts holds the impacts which an incident can have, from least to most severe.
+var IncidentImpacts = []string{"degraded_performance", "partial_outage", "major_outage"}
+
+// StatusOperational is the overall status shown on the status page while there are no ongoing
+// incidents. Otherwise the status is the impact of the most severe ongoing incident.
+const StatusOperational = "operational"
+
+// Incident represents an annotation posted by an admin on the status page, such as an outage and
+// its cause. It's ongoing until ResolvedAt is set.
+type Incident struct {
+	ID         int64      `json:"id"`
+	CreatedAt  time.Time  `json:"created_at"`
+	CreatedBy  *int64     `json:"created_by,omitempty"`
+	Title      string     `json:"title"`
+	Message    string     `json:"message"`
+	Impact     string     `json:"impact"`
+	StartedAt  time.Time  `json:"started_at"`
+	ResolvedAt *time.Time `json:"resolved_at"`
+	Version    int32      `json:"version"`
+}
+
+// StatusDay holds the uptime and error rate of the API on a single day (in UTC), as percentages
+// rounded to two decimal places. Uptime is nil for the days before heartbeats were first
+// recorded, and ErrorRate is nil for the days without any metered requests.
+type StatusDay struct {
+	Date      Date     `json:"date"`
+	Uptime    *float64 `json:"uptime"`
+	Requests  int64    `json:"requests"`
+	Errors    int64    `json:"errors"`
+	ErrorRate *float64 `json:"error_rate"`
+
+	// upMinutes and expectedMinutes are the minutes with a heartbeat, and the minutes which
+	// should have had one, which are totalled to work out the uptime over several days.
+	upMinutes       int64
+	expectedMinutes int64
+}
+
+// StatusSummary holds the uptime and error rate over a run of days, as percentages rounded to
+// two decimal places, or nil if there's nothing to work them out from.
+type StatusSummary struct {
+	Uptime    *float64 `json:"uptime"`
+	ErrorRate *float64 `json:"error_rate"`
+}
+
+// SummarizeStatus returns the uptime and error rate over all of the days.
+func SummarizeStatus(days []*StatusDay) StatusSummary {
+	var up, expected, requests, errors int64
+
+	for _, day := range days {
+		up += day.upMinutes
+		expected += day.expectedMinutes
+		requests += day.Requests
+		errors += day.Errors
+	}
+
+	return StatusSummary{Uptime: percentage(up, expected), ErrorRate: percentage(errors, requests)}
+}
+
+// percentage returns n as a percentage of total, rounded to two decimal places, or nil if total
+// is zero.
+func percentage(n, total int64) *float64 {
+	if total <= 0 {
+		return nil
+	}
+
+	p := math.Round(math.Min(float64(n)/float64(total), 1)*10_000) / 100
+	return &p
+}
+
+// StatusModel struct wraps a sql.DB connection pool and allows us to work with the
+// status_heartbeats table in our database, along with the usage_stats table which the error
+// rate is worked out from.
+type StatusModel struct {
+	DB       *sql.DB
+	InfoLog  *log.Logger
+	ErrorLog *log.Logger
+}
+
+// RecordHeartbeat records that the API was up during the minute containing the given time. Any
+// heartbeats from before the retention period are deleted at the same time, so that the table
+// stays small.
+func (m StatusModel) RecordHeartbeat(ctx context.Context, now time.Time, retention time.Duration) error {
+	query := `
+		WITH purged AS (
+			DELETE FROM status_heartbeats WHERE minute < $2
+		)
+		INSERT INTO status_heartbeats (minute)
+		VALUES ($1)
+		ON CONFLICT (minute) DO NOTHING
+		`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, now.UTC().Truncate(time.Minute), now.Add(-retention))
+	return err
+}
+
+// GetDays returns the uptime and error rate on each day from the day containing from up to and
+// including today, oldest first. The minute containing now isn't counted towards the uptime, as
+// its heartbeat may not have been recorded yet.
+func (m StatusModel) GetDays(ctx context.Context, from, now time.Time) ([]*StatusDay, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	var first sql.NullTime
+
+	err := m.DB.QueryRowContext(ctx, `SELECT MIN(minute) FROM status_heartbeats`).Scan(&first)
+	if err != nil {
+		return nil, err
+	}
+
+	query := `
+		SELECT day,
+			(SELECT count(*) FROM status_heartbeats
+			WHERE minute >= day AND minute < day + INTERVAL '1 day' AND minute < $3),
+			COALESCE(SUM(usage_stats.requests), 0),
+			COALESCE(SUM(usage_stats.errors), 0)
+		FROM generate_series($1::timestamptz, $2::timestamptz, INTERVAL '1 day') AS day
+		LEFT JOIN usage_stats ON usage_stats.day = (day AT TIME ZONE 'UTC')::date
+		GROUP BY day
+		ORDER BY day
+		`
+
+	end := now.UTC().Truncate(time.Minute)
+	today := QuotaPeriodStart(QuotaPeriodDay, now)
+
+	rows, err := m.DB.QueryContext(ctx, query, QuotaPeriodStart(QuotaPeriodDay, from), today, end)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			m.ErrorLog.Println(err)
+		}
+	}()
+
+	days := []*StatusDay{}
+
+	for rows.Next() {
+		var start time.Time
+		var day StatusDay
+
+		err := rows.Scan(&start, &day.upMinutes, &day.Requests, &day.Errors)
+		if err != nil {
+			return nil, err
+		}
+
+		day.Date = NewDate(start.UTC())
+
+		// The minutes which should have had a heartbeat are those from the start of the day, or
+		// from when heartbeats were first recorded, until the end of the day or now.
+		if first.Valid {
+			from := maxTime(start, first.Time)
+			to := minTime(start.Add(24*time.Hour), end)
+
+			if to.After(from) {
+				day.expectedMinutes = int64(to.Sub(from) / time.Minute)
+			}
+		}
+
+		day.Uptime = percentage(day.upMinutes, day.expectedMinutes)
+		day.ErrorRate = percentage(day.Errors, day.Requests)
+
+		days = append(days, &day)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return days, nil
+}
+
+// maxTime returns the later of two times.
+func maxTime(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+
+	return b
+}
+
+// minTime returns the earlier of two times.
+func minTime(a, b time.Time) time.Time {
+	if a.Before(b) {
+		return a
+	}
+
+	return b
+}
+
+// IncidentModel struct wraps a sql.DB connection pool and allows us to work with the Incident
+// struct type and the incidents table in our database.
+type IncidentModel struct {
+	DB       *sql.DB
+	InfoLog  *log.Logger
+	ErrorLog *log.Logger
+}
+
+// Insert adds a new incident, and records it in the audit log.
+func (m IncidentModel) Insert(ctx context.Context, incident *Incident) error {
+	query := `
+		INSERT INTO incidents (created_by, title, message, impact, started_at, resolved_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING id, created_at, version
+		`
+
+	args := []interface{}{
+		incident.CreatedBy,
+		incident.Title,
+		incident.Message,
+		incident.Impact,
+		incident.StartedAt,
+		incident.ResolvedAt,
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	return withAudit(ctx, m.DB, AuditCreate, "incidents", 0, func(tx *sql.Tx) (int64, error) {
+		err := tx.QueryRowContext(ctx, query, args...).Scan(&incident.ID, &incident.CreatedAt, &incident.Version)
+		if err != nil {
+			return 0, err
+		}
+
+		return incident.ID, nil
+	})
+}
+
+// Get returns a specific incident. ErrRecordNotFound is returned if it doesn't exist.
+func (m IncidentModel) Get(ctx context.Context, id int64) (*Incident, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `
+		SELECT id, created_at, created_by, title, message, impact, started_at, resolved_at, version
+		FROM incidents
+		WHERE id = $1
+		`
+
+	incidents, err := m.query(ctx, query, id)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(incidents) == 0 {
+		return nil, ErrRecordNotFound
+	}
+
+	return incidents[0], nil
+}
+
+// GetRecent returns the incidents which were ongoing at any time since the given time, along with
+// any which are still ongoing, most severe first and then newest first.
+func (m IncidentModel) GetRecent(ctx context.Context, since time.Time) ([]*Incident, error) {
+	query := `
+		SELECT id, created_at, created_by, title, message, impact, started_at, resolved_at, version
+		FROM incidents
+		WHERE resolved_at IS NULL OR resolved_at >= $1
+		ORDER BY resolved_at IS NULL DESC, array_position($2, impact) DESC, started_at DESC, id DESC
+		`
+
+	return m.query(ctx, query, since, pq.Array(IncidentImpacts))
+}
+
+// query runs a query which returns incidents rows.
+func (m IncidentModel) query(ctx context.Context, query string, args ...interface{}) ([]*Incident, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			m.ErrorLog.Println(err)
+		}
+	}()
+
+	incidents := []*Incident{}
+
+	for rows.Next() {
+		var incident Incident
+
+		err := rows.Scan(
+			&incident.ID,
+			&incident.CreatedAt,
+			&incident.CreatedBy,
+			&incident.Title,
+			&incident.Message,
+			&incident.Impact,
+			&incident.StartedAt,
+			&incident.ResolvedAt,
+			&incident.Version,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		incidents = append(incidents, &incident)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return incidents, nil
+}
+
+// Update updates an incident, such as to post a new message or to resolve it, and records the
+// change in the audit log. As for movies, the version number is checked to prevent lost updates,
+// and ErrEditConflict is returned if the incident has been changed (or deleted) since it was read.
+func (m IncidentModel) Update(ctx context.Context, incident *Incident) error {
+	query := `
+		UPDATE incidents
+		SET title = $1, message = $2, impact = $3, started_at = $4, resolved_at = $5, version = version + 1
+		WHERE id = $6 AND version = $7
+		RETURNING version
+		`
+
+	args := []interface{}{
+		incident.Title,
+		incident.Message,
+		incident.Impact,
+		incident.StartedAt,
+		incident.ResolvedAt,
+		incident.ID,
+		incident.Version,
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	return withAudit(ctx, m.DB, AuditUpdate, "incidents", incident.ID, func(tx *sql.Tx) (int64, error) {
+		err := tx.QueryRowContext(ctx, query, args...).Scan(&incident.Version)
+		if err != nil {
+			switch {
+			case errors.Is(err, sql.ErrNoRows):
+				return 0, ErrEditConflict
+			default:
+				return 0, err
+			}
+		}
+
+		return incident.ID, nil
+	})
+}
+
+// Delete removes an incident, and records the deletion in the audit log. ErrRecordNotFound is
+// returned if it doesn't exist.
+func (m IncidentModel) Delete(ctx context.Context, id int64) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+
+	query := `
+		DELETE FROM incidents
+		WHERE id = $1
+		`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	return withAudit(ctx, m.DB, AuditDelete, "incidents", id, func(tx *sql.Tx) (int64, error) {
+		result, err := tx.ExecContext(ctx, query, id)
+		if err != nil {
+			return 0, err
+		}
+
+		rowsAffected, err := result.RowsAffected()
+		if err != nil {
+			return 0, err
+		}
+
+		if rowsAffected == 0 {
+			return 0, ErrRecordNotFound
+		}
+
+		return id, nil
+	})
+}
+
+// ValidateIncident runs validation checks on the Incident type.
+func ValidateIncident(v *validator.Validator, incident *Incident) {
+	v.Check(incident.Title != "", "title", "must be provided")
+	v.Check(len(incident.Title) <= 200, "title", "must not be more than 200 bytes long")
+
+	v.Check(incident.Message != "", "message", "must be provided")
+	v.Check(len(incident.Message) <= 5000, "message", "must not be more than 5000 bytes long")
+
+	v.Check(validator.In(incident.Impact, IncidentImpacts...), "impact",
+		"must be one of degraded_performance, partial_outage or major_outage")
+
+	v.Check(incident.ResolvedAt == nil || !incident.ResolvedAt.Before(incident.StartedAt), "resolved_at",
+		"must not be before started_at")
+}
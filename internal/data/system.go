@@ -0,0 +1,122 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// SystemModel struct wraps a sql.DB connection pool and allows us to run queries which are about
+// the database itself rather than any particular table, such as health checks.
+type SystemModel struct {
+	DB       *sql.DB
+	InfoLog  *log.Logger
+	ErrorLog *log.Logger
+}
+
+// Ping checks that a connection to the database can be established within the given timeout,
+// and returns how long it took.
+func (m SystemModel) Ping(ctx context.Context, timeout time.Duration) (time.Duration, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	start := time.Now()
+	err := m.DB.PingContext(ctx)
+
+	return time.Since(start), err
+}
+
+// SchemaVersion returns the current version of the database schema, as recorded in the
+// schema_migrations table by the migrate tool, and whether the last migration failed part way
+// through (which the migrate tool calls "dirty"). If no migrations have been applied yet then
+// the version is 0.
+func (m SystemModel) SchemaVersion(ctx context.Context) (int, bool, error) {
+	query := `SELECT version, dirty FROM schema_migrations LIMIT 1`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	var version int
+	var dirty bool
+
+	err := m.DB.QueryRowContext(ctx, query).Scan(&version, &dirty)
+	if err != nil {
+		// The schema_migrations table is only created when migrate is first run, so a missing
+		// table means that no migrations have been applied.
+		var pqErr *pq.Error
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return 0, false, nil
+		case errors.As(err, &pqErr) && pqErr.Code == "42P01":
+			return 0, false, nil
+		default:
+			return 0, false, err
+		}
+	}
+
+	return version, dirty, nil
+}
+
+// Now returns the database server's current time, so that it can be compared with the
+// application's clock.
+func (m SystemModel) Now(ctx context.Context) (time.Time, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	var now time.Time
+
+	err := m.DB.QueryRowContext(ctx, `SELECT NOW()`).Scan(&now)
+	return now, err
+}
+
+// TableStats holds the size of a table, as measured by TableStats.
+type TableStats struct {
+	Name string
+	// Rows is PostgreSQL's count of the live rows in the table, which is kept up to date as
+	// rows are written, so it's cheap to read but only approximate.
+	Rows int64
+	// Bytes is the size of the table on disk, including its indexes and TOAST data.
+	Bytes int64
+}
+
+// TableStats returns the number of rows in each of the named tables and their size on disk.
+// Tables which don't exist are left out.
+func (m SystemModel) TableStats(ctx context.Context, tables []string) ([]TableStats, error) {
+	query := `
+		SELECT relname, n_live_tup, pg_total_relation_size(relid)
+		FROM pg_stat_user_tables
+		WHERE schemaname = current_schema() AND relname = ANY($1)
+		ORDER BY relname`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, pq.Array(tables))
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			m.ErrorLog.Println(err)
+		}
+	}()
+
+	var stats []TableStats
+
+	for rows.Next() {
+		var s TableStats
+
+		err := rows.Scan(&s.Name, &s.Rows, &s.Bytes)
+		if err != nil {
+			return nil, err
+		}
+
+		stats = append(stats, s)
+	}
+
+	return stats, rows.Err()
+}
@@ -0,0 +1,328 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"time"
+)
+
+// Statuses of a task as it moves through the task queue.
+const (
+	TaskStatusQueued    = "queued"
+	TaskStatusRunning   = "running"
+	TaskStatusCompleted = "completed"
+	TaskStatusFailed    = "failed"
+)
+
+// TaskKindReport is the kind of task which generates a report. Its params hold the ID of the
+// report in "report_id".
+const TaskKindReport = "report"
+
+// TaskKindDuplicateScan is the kind of task which scans the catalog for duplicate movies. Its
+// params hold the runtime tolerance of the scan in "runtime_tolerance".
+const TaskKindDuplicateScan = "duplicate_scan"
+
+// TaskKindBackup is the kind of task which backs up the database. It has no params, and only one
+// can be queued or running at a time (see InsertExclusive).
+const TaskKindBackup = "backup"
+
+// ErrTaskInProgress is returned by InsertExclusive when a task of the same kind is already queued
+// or running.
+var ErrTaskInProgress = errors.New("task already in progress")
+
+// Task represents a long-running operation which was queued by an endpoint and is run in the
+// background by a task worker. The endpoint returns the task straight away, and the client
+// polls "GET /v1/tasks/:id" for its status and progress. Once the task has completed, ResultURL
+// is the location of its results.
+type Task struct {
+	ID          int64             `json:"id"`
+	CreatedAt   time.Time         `json:"created_at"`
+	UpdatedAt   time.Time         `json:"updated_at"`
+	CompletedAt *time.Time        `json:"completed_at,omitempty"`
+	UserID      int64             `json:"-"`
+	Kind        string            `json:"kind"`
+	Params      map[string]string `json:"-"`
+	Status      string            `json:"status"`
+	Progress    int               `json:"progress"`
+	Error       string            `json:"error,omitempty"`
+	ResultURL   string            `json:"result_url,omitempty"`
+}
+
+// TaskModel struct wraps a sql.DB connection pool and allows us to work with the Task struct type
+// and the tasks table in our database.
+type TaskModel struct {
+	DB       *sql.DB
+	InfoLog  *log.Logger
+	ErrorLog *log.Logger
+}
+
+// insertTask adds a new task to the queue as part of a transaction, so that the task is only
+// run if the rest of the transaction (such as creating the resource it works on) commits.
+func insertTask(ctx context.Context, tx *sql.Tx, task *Task) error {
+	params, err := json.Marshal(task.Params)
+	if err != nil {
+		return err
+	}
+
+	query := `
+		INSERT INTO tasks (user_id, kind, params)
+		VALUES ($1, $2, $3)
+		RETURNING id, created_at, updated_at, status, progress
+		`
+
+	return tx.QueryRowContext(ctx, query, task.UserID, task.Kind, params).Scan(
+		&task.ID,
+		&task.CreatedAt,
+		&task.UpdatedAt,
+		&task.Status,
+		&task.Progress,
+	)
+}
+
+// Insert adds a new task to the queue.
+func (m TaskModel) Insert(ctx context.Context, task *Task) error {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	err = insertTask(ctx, tx, task)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// InsertExclusive adds a new task to the queue, unless a task of the same kind is already queued
+// or running, in which case ErrTaskInProgress is returned. It's for the operations which mustn't
+// overlap, such as backups. Inserts of the same kind are serialized with an advisory lock, so two
+// concurrent calls can't both find the queue empty.
+func (m TaskModel) InsertExclusive(ctx context.Context, task *Task) error {
+	query := `
+		SELECT EXISTS (
+			SELECT 1 FROM tasks
+			WHERE kind = $1 AND status IN ($2, $3)
+		)
+		`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	_, err = tx.ExecContext(ctx, "SELECT pg_advisory_xact_lock(hashtext('tasks:' || $1))", task.Kind)
+	if err != nil {
+		return err
+	}
+
+	var active bool
+
+	err = tx.QueryRowContext(ctx, query, task.Kind, TaskStatusQueued, TaskStatusRunning).Scan(&active)
+	if err != nil {
+		return err
+	}
+
+	if active {
+		return ErrTaskInProgress
+	}
+
+	err = insertTask(ctx, tx, task)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Get returns a specific task belonging to a user. ErrRecordNotFound is returned if the task
+// doesn't exist or belongs to another user.
+func (m TaskModel) Get(ctx context.Context, id, userID int64) (*Task, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `
+		SELECT id, created_at, updated_at, completed_at, user_id, kind, params, status, progress,
+			error, result_url
+		FROM tasks
+		WHERE id = $1 AND user_id = $2
+		`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	task, err := scanTask(m.DB.QueryRowContext(ctx, query, id, userID))
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return task, nil
+}
+
+// ClaimNext marks the oldest queued task as running and returns it, so that it can be run by a
+// task worker. Tasks which have been running without any progress updates for longer than
+// staleAfter are assumed to have been abandoned (for example, because the application was
+// restarted) and are claimed again. FOR UPDATE SKIP LOCKED means that workers in different
+// instances of the application never claim the same task. ErrRecordNotFound is returned if
+// there are no tasks waiting.
+func (m TaskModel) ClaimNext(ctx context.Context, staleAfter time.Duration) (*Task, error) {
+	query := `
+		UPDATE tasks
+		SET status = $1, progress = 0, updated_at = NOW()
+		WHERE id = (
+			SELECT id
+			FROM tasks
+			WHERE status = $2 OR (status = $1 AND updated_at < NOW() - $3 * INTERVAL '1 second')
+			ORDER BY id
+			FOR UPDATE SKIP LOCKED
+			LIMIT 1
+		)
+		RETURNING id, created_at, updated_at, completed_at, user_id, kind, params, status, progress,
+			error, result_url
+		`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	args := []interface{}{TaskStatusRunning, TaskStatusQueued, staleAfter.Seconds()}
+
+	task, err := scanTask(m.DB.QueryRowContext(ctx, query, args...))
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return task, nil
+}
+
+// Stats returns the number of tasks which are queued and waiting for a task worker, and the age
+// of the oldest of them.
+func (m TaskModel) Stats(ctx context.Context) (QueueStats, error) {
+	query := `
+		SELECT count(*), COALESCE(EXTRACT(EPOCH FROM NOW() - MIN(created_at)), 0)
+		FROM tasks
+		WHERE status = $1
+		`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	var stats QueueStats
+	var age float64
+
+	err := m.DB.QueryRowContext(ctx, query, TaskStatusQueued).Scan(&stats.Depth, &age)
+	if err != nil {
+		return QueueStats{}, err
+	}
+
+	stats.OldestAge = time.Duration(age * float64(time.Second))
+
+	return stats, nil
+}
+
+// UpdateProgress records the progress (as a percentage) of a running task.
+func (m TaskModel) UpdateProgress(ctx context.Context, id int64, progress int) error {
+	query := `
+		UPDATE tasks
+		SET progress = $1, updated_at = NOW()
+		WHERE id = $2 AND status = $3
+		`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, progress, id, TaskStatusRunning)
+	return err
+}
+
+// Complete marks a task as completed, recording the location of its results.
+func (m TaskModel) Complete(ctx context.Context, id int64, resultURL string) error {
+	query := `
+		UPDATE tasks
+		SET status = $1, progress = 100, result_url = $2, updated_at = NOW(), completed_at = NOW()
+		WHERE id = $3
+		`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, TaskStatusCompleted, resultURL, id)
+	return err
+}
+
+// Fail marks a task as failed, recording a message describing the failure.
+func (m TaskModel) Fail(ctx context.Context, id int64, message string) error {
+	query := `
+		UPDATE tasks
+		SET status = $1, error = $2, updated_at = NOW(), completed_at = NOW()
+		WHERE id = $3
+		`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, TaskStatusFailed, message, id)
+	return err
+}
+
+// scanTask scans a tasks row into a Task.
+func scanTask(row interface{ Scan(...interface{}) error }) (*Task, error) {
+	var (
+		task        Task
+		completedAt sql.NullTime
+		params      []byte
+	)
+
+	err := row.Scan(
+		&task.ID,
+		&task.CreatedAt,
+		&task.UpdatedAt,
+		&completedAt,
+		&task.UserID,
+		&task.Kind,
+		&params,
+		&task.Status,
+		&task.Progress,
+		&task.Error,
+		&task.ResultURL,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if completedAt.Valid {
+		task.CompletedAt = &completedAt.Time
+	}
+
+	err = json.Unmarshal(params, &task.Params)
+	if err != nil {
+		return nil, err
+	}
+
+	return &task, nil
+}
@@ -6,9 +6,11 @@ import (
 	"crypto/sha256"
 	"database/sql"
 	"encoding/base32"
+	"errors"
 	"log"
 	"time"
 
+	"github.com/codeaucafe/snippetbox/greenlight/internal/clock"
 	"github.com/codeaucafe/snippetbox/greenlight/internal/validator"
 )
 
@@ -16,8 +18,27 @@ import (
 const (
 	ScopeActivation     = "activation"
 	ScopeAuthentication = "authentication"
+	// ScopeRefresh is the scope of the long-lived tokens which are exchanged for a new
+	// authentication token (and a new refresh token) when the authentication token expires.
+	ScopeRefresh = "refresh"
+	// ScopePasswordReset is the scope of the single-use tokens which are emailed to a user so
+	// that they can set a new password.
+	ScopePasswordReset = "password-reset"
+	// ScopeEmailChange is the scope of the single-use tokens which are emailed to the new
+	// address when a user changes their email address, to confirm that it's theirs.
+	ScopeEmailChange = "email-change"
+	// ScopeAccountRestore is the scope of the tokens which are emailed to a user when they
+	// delete their account, so that they can restore it during the grace period.
+	ScopeAccountRestore = "account-restore"
+	// ScopeWebSocket is the scope of the short-lived, single-use tickets which authenticate a
+	// WebSocket connection, since browsers can't send an Authorization header with one.
+	ScopeWebSocket = "websocket"
 )
 
+// ErrRefreshTokenReused is returned by Rotate when a refresh token which has already been
+// rotated is presented again.
+var ErrRefreshTokenReused = errors.New("refresh token reused")
+
 type (
 	// Token represents a token record in our tokens table.
 	// Note, it includes plaintext and hashed version of the token.
@@ -35,23 +56,39 @@ type (
 		DB       *sql.DB
 		InfoLog  *log.Logger
 		ErrorLog *log.Logger
+		// Clock is used to calculate token expiry times.
+		Clock clock.Clock
 	}
 )
 
 // New creates a new token and inserts the token record into the tokens table.
-func (m TokenModel) New(userID int64, ttl time.Duration, scope string) (*Token, error) {
-	token, err := generateToken(userID, ttl, scope)
+func (m TokenModel) New(ctx context.Context, userID int64, ttl time.Duration, scope string) (*Token, error) {
+	token, err := generateToken(userID, ttl, scope, m.Clock.Now())
 	if err != nil {
 		return nil, err
 	}
 
-	err = m.Insert(token)
+	err = m.Insert(ctx, token)
 	return token, err
 
 }
 
 // Insert inserts a new token record into the tokens table.
-func (m TokenModel) Insert(token *Token) error {
+func (m TokenModel) Insert(ctx context.Context, token *Token) error {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	return failoverError(insertToken(ctx, m.DB, token))
+}
+
+// execer is implemented by both *sql.DB and *sql.Tx, so that insertToken can be used inside and
+// outside of a transaction.
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+// insertToken inserts a new token record into the tokens table.
+func insertToken(ctx context.Context, db execer, token *Token) error {
 	query := `
 		INSERT INTO tokens (hash, user_id, expiry, scope)
 		VALUES ($1, $2, $3, $4)
@@ -59,34 +96,286 @@ func (m TokenModel) Insert(token *Token) error {
 
 	args := []interface{}{token.Hash, token.UserID, token.Expiry, token.Scope}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	_, err := db.ExecContext(ctx, query, args...)
+	return err
+}
+
+// NewPair creates a new authentication token and refresh token for the user, and inserts them
+// both into the tokens table. If accessTTL is zero then only the refresh token is created, and
+// the access token returned is nil. This is used when authentication tokens are stateless JWTs,
+// which are issued by the caller and never stored.
+func (m TokenModel) NewPair(ctx context.Context, userID int64, accessTTL, refreshTTL time.Duration) (access, refresh *Token, err error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 
-	_, err := m.DB.ExecContext(ctx, query, args...)
-	return err
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, nil, failoverError(err)
+	}
+
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	access, refresh, err = m.insertPair(ctx, tx, userID, accessTTL, refreshTTL)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, nil, failoverError(err)
+	}
+
+	return access, refresh, nil
+}
+
+// insertPair generates a new authentication token (unless accessTTL is zero) and refresh token
+// for the user, and inserts them as part of a transaction.
+func (m TokenModel) insertPair(ctx context.Context, tx *sql.Tx, userID int64, accessTTL, refreshTTL time.Duration) (access, refresh *Token, err error) {
+	now := m.Clock.Now()
+
+	refresh, err = generateToken(userID, refreshTTL, ScopeRefresh, now)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	tokens := []*Token{refresh}
+
+	if accessTTL > 0 {
+		access, err = generateToken(userID, accessTTL, ScopeAuthentication, now)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		tokens = append(tokens, access)
+	}
+
+	for _, token := range tokens {
+		err = insertToken(ctx, tx, token)
+		if err != nil {
+			return nil, nil, failoverError(err)
+		}
+	}
+
+	return access, refresh, nil
+}
+
+// Rotate exchanges a refresh token for a new authentication token and refresh token. As for
+// NewPair, no authentication token is created if accessTTL is zero. The old
+// refresh token is marked as used rather than deleted, so that it can't be used again but we can
+// still recognise it until it expires.
+//
+// If a refresh token which has already been used is presented again, then either the client or
+// an attacker is holding a stolen copy of it, and we can't tell which. So we revoke every
+// authentication and refresh token for the user, forcing them to log in again with their
+// password, and return ErrRefreshTokenReused. If the refresh token doesn't exist or has expired
+// then ErrRecordNotFound is returned.
+func (m TokenModel) Rotate(ctx context.Context, refreshPlaintext string, accessTTL, refreshTTL time.Duration) (access, refresh *Token, err error) {
+	hash := sha256.Sum256([]byte(refreshPlaintext))
+	now := m.Clock.Now()
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, nil, failoverError(err)
+	}
+
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	// Mark the refresh token as used, as long as it hasn't been used already and hasn't
+	// expired. The row lock taken by the UPDATE means that if the same token is rotated twice
+	// concurrently, only one of the rotations can succeed.
+	query := `
+		UPDATE tokens
+		SET used_at = $3
+		WHERE hash = $1 AND scope = $2 AND used_at IS NULL AND expiry > $3
+		RETURNING user_id
+		`
+
+	var userID int64
+
+	err = tx.QueryRowContext(ctx, query, hash[:], ScopeRefresh, now).Scan(&userID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, nil, failoverError(err)
+	}
+
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil, m.checkReuse(ctx, tx, hash[:])
+	}
+
+	access, refresh, err = m.insertPair(ctx, tx, userID, accessTTL, refreshTTL)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, nil, failoverError(err)
+	}
+
+	return access, refresh, nil
+}
+
+// checkReuse is called by Rotate when a refresh token can't be rotated. If the token has already
+// been used, it revokes all of the user's authentication and refresh tokens and returns
+// ErrRefreshTokenReused. Otherwise, it returns ErrRecordNotFound.
+func (m TokenModel) checkReuse(ctx context.Context, tx *sql.Tx, hash []byte) error {
+	query := `
+		SELECT user_id
+		FROM tokens
+		WHERE hash = $1 AND scope = $2 AND used_at IS NOT NULL
+		`
+
+	var userID int64
+
+	err := tx.QueryRowContext(ctx, query, hash, ScopeRefresh).Scan(&userID)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrRecordNotFound
+		default:
+			return failoverError(err)
+		}
+	}
+
+	query = `
+		DELETE FROM tokens
+		WHERE user_id = $1 AND scope IN ($2, $3)
+		`
+
+	_, err = tx.ExecContext(ctx, query, userID, ScopeAuthentication, ScopeRefresh)
+	if err != nil {
+		return failoverError(err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return failoverError(err)
+	}
+
+	return ErrRefreshTokenReused
+}
+
+// NewPasswordReset creates a new password reset token for the user and adds the email built by
+// the email function to the outbox (see newEmailed).
+func (m TokenModel) NewPasswordReset(ctx context.Context, userID int64, ttl time.Duration, email func(*Token) *OutboxEmail) (*Token, error) {
+	return m.newEmailed(ctx, userID, ttl, ScopePasswordReset, email)
+}
+
+// NewActivation creates a new activation token for the user, to replace the one which was sent
+// in their welcome email, and adds the email built by the email function to the outbox (see
+// newEmailed).
+func (m TokenModel) NewActivation(ctx context.Context, userID int64, ttl time.Duration, email func(*Token) *OutboxEmail) (*Token, error) {
+	return m.newEmailed(ctx, userID, ttl, ScopeActivation, email)
+}
+
+// newEmailed creates a new token with the given scope, which is sent to the user by email. Any
+// tokens with the same scope which were issued to the user before are deleted in the same
+// transaction, so that only the most recently emailed token can be used. The email returned by
+// the email function, which is passed the new token, is added to the outbox in the same
+// transaction, in the same way as the welcome email in UserModel.Register().
+func (m TokenModel) newEmailed(ctx context.Context, userID int64, ttl time.Duration, scope string, email func(*Token) *OutboxEmail) (*Token, error) {
+	token, err := generateToken(userID, ttl, scope, m.Clock.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, failoverError(err)
+	}
+
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	query := `
+		DELETE FROM tokens
+		WHERE user_id = $1 AND scope = $2
+		`
+
+	_, err = tx.ExecContext(ctx, query, userID, scope)
+	if err != nil {
+		return nil, failoverError(err)
+	}
+
+	err = insertToken(ctx, tx, token)
+	if err != nil {
+		return nil, failoverError(err)
+	}
+
+	err = insertOutboxMessage(ctx, tx, OutboxKindEmail, email(token))
+	if err != nil {
+		return nil, failoverError(err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, failoverError(err)
+	}
+
+	return token, nil
+}
+
+// Consume deletes the unexpired token with the given scope and plaintext, so that it can't be
+// used again, and returns the ID of the user it belongs to. ErrRecordNotFound is returned if
+// there isn't one.
+func (m TokenModel) Consume(ctx context.Context, scope, tokenPlaintext string) (int64, error) {
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+
+	query := `
+		DELETE FROM tokens
+		WHERE hash = $1 AND scope = $2 AND expiry > $3
+		RETURNING user_id
+		`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	var userID int64
+
+	err := m.DB.QueryRowContext(ctx, query, tokenHash[:], scope, m.Clock.Now()).Scan(&userID)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return 0, ErrRecordNotFound
+		default:
+			return 0, failoverError(err)
+		}
+	}
+
+	return userID, nil
 }
 
 // DeleteAllForUser deletes all tokens for a specific user and scope.
-func (m TokenModel) DeleteAllForUser(scope string, userID int64) error {
+func (m TokenModel) DeleteAllForUser(ctx context.Context, scope string, userID int64) error {
 	query := `
 		DELETE FROM tokens
 		WHERE scope = $1 AND user_id = $2
 		`
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 
 	_, err := m.DB.ExecContext(ctx, query, scope, userID)
 	return err
 }
 
-func generateToken(userID int64, ttl time.Duration, scope string) (*Token, error) {
+func generateToken(userID int64, ttl time.Duration, scope string, now time.Time) (*Token, error) {
 	// Create a Token instance containing the user ID, expiry, and scope information.
 	// Notice that we add the provided ttl (time-to-live) duration parameter to the
 	// current time to get the expiry time.
 	token := &Token{
 		UserID: userID,
-		Expiry: time.Now().Add(ttl),
+		Expiry: now.Add(ttl),
 		Scope:  scope,
 	}
 
@@ -124,6 +413,15 @@ func generateToken(userID int64, ttl time.Duration, scope string) (*Token, error
 }
 
 func ValidateTokenPlaintext(v *validator.Validator, tokenPlaintext string) {
-	v.Check(tokenPlaintext != "", "token", "must be provided")
-	v.Check(len(tokenPlaintext) == 26, "token", "must be 26 bytes long")
+	validateTokenPlaintext(v, "token", tokenPlaintext)
+}
+
+// ValidateRefreshTokenPlaintext checks a refresh token given in the refresh_token field.
+func ValidateRefreshTokenPlaintext(v *validator.Validator, tokenPlaintext string) {
+	validateTokenPlaintext(v, "refresh_token", tokenPlaintext)
+}
+
+func validateTokenPlaintext(v *validator.Validator, key, tokenPlaintext string) {
+	v.Check(tokenPlaintext != "", key, "must be provided")
+	v.Check(len(tokenPlaintext) == 26, key, "must be 26 bytes long")
 }
@@ -0,0 +1,158 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// GetAllDeleted returns a page of the movies in the trash, most recently deleted first, along
+// with when each one was deleted.
+func (m MovieModel) GetAllDeleted(ctx context.Context, filters Filters) ([]*Movie, Metadata, error) {
+	query := fmt.Sprintf(`
+		SELECT count(*) OVER(), id, COALESCE(ulid, ''), created_at, title, year, runtime, release_date, poster_key, %s, version, created_by, updated_by, deleted_at
+		FROM movies
+		WHERE deleted_at IS NOT NULL
+		ORDER BY deleted_at DESC, id DESC
+		LIMIT $1 OFFSET $2`,
+		movieGenres)
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, filters.limit(), filters.offset())
+	if err != nil {
+		return nil, Metadata{}, failoverError(err)
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			m.ErrorLog.Println(err)
+		}
+	}()
+
+	totalRecords := 0
+	movies := []*Movie{}
+
+	for rows.Next() {
+		var movie Movie
+
+		err := rows.Scan(
+			&totalRecords,
+			&movie.ID,
+			&movie.ULID,
+			&movie.CreatedAt,
+			&movie.Title,
+			&movie.Year,
+			&movie.Runtime,
+			&movie.ReleaseDate,
+			moviePoster(&movie),
+			pq.Array(&movie.Genres),
+			&movie.Version,
+			&movie.CreatedBy,
+			&movie.UpdatedBy,
+			&movie.DeletedAt,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		movies = append(movies, &movie)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	return movies, calculateMetadata(totalRecords, filters.Page, filters.PageSize), nil
+}
+
+// Restore takes a movie out of the trash, recording the user in the context as the last user to
+// change it, and records a movie.restored event. It returns the restored movie, whose version
+// has been bumped. ErrRecordNotFound is returned if the movie isn't in the trash.
+func (m MovieModel) Restore(ctx context.Context, id int64) (*Movie, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := fmt.Sprintf(`
+		UPDATE movies
+		SET deleted_at = NULL, updated_by = $2, version = version + 1
+		WHERE id = $1 AND deleted_at IS NOT NULL
+		RETURNING id, COALESCE(ulid, ''), created_at, title, year, runtime, release_date, poster_key, %s, version, created_by, updated_by, %s`,
+		movieGenres, movieAverageRating)
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	var movie Movie
+
+	change := newAudit(AuditRestore, "movies")
+
+	err := withEvent(ctx, m.DB, m.Broker, func(tx *sql.Tx) (string, int64, interface{}, error) {
+		err := change.before(ctx, tx, id)
+		if err != nil {
+			return "", 0, nil, err
+		}
+
+		err = tx.QueryRowContext(ctx, query, id, actorID(ctx)).Scan(
+			&movie.ID,
+			&movie.ULID,
+			&movie.CreatedAt,
+			&movie.Title,
+			&movie.Year,
+			&movie.Runtime,
+			&movie.ReleaseDate,
+			moviePoster(&movie),
+			pq.Array(&movie.Genres),
+			&movie.Version,
+			&movie.CreatedBy,
+			&movie.UpdatedBy,
+			&movie.AverageRating)
+		if err != nil {
+			return "", 0, nil, err
+		}
+
+		err = change.record(ctx, tx, movie.ID)
+		return EventMovieRestored, movie.ID, &movie, err
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, failoverError(err)
+		}
+	}
+
+	return &movie, nil
+}
+
+// PurgeDeleted removes the movies which were moved to the trash at or before the given time for
+// good, along with everything which belongs to them (such as their reviews and credits), and
+// returns the number removed. Their movie.deleted events were recorded when they were deleted,
+// and each purge is recorded in the audit log.
+func (m MovieModel) PurgeDeleted(ctx context.Context, before time.Time) (int64, error) {
+	query := `
+		WITH purged AS (
+			DELETE FROM movies
+			WHERE deleted_at <= $1
+			RETURNING id
+		)
+		INSERT INTO audit_log (action, resource_type, resource_id, changes)
+		SELECT 'purge', 'movies', id, '{}' FROM purged
+		`
+
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, before)
+	if err != nil {
+		return 0, failoverError(err)
+	}
+
+	return result.RowsAffected()
+}
@@ -0,0 +1,92 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/oklog/ulid/v2"
+)
+
+// newULID returns a new ULID for a resource created at the given time. ULIDs are the public
+// identifiers of resources: unlike the bigserial IDs they can't be guessed or enumerated, since
+// 80 of their 128 bits are random, but they still sort in the order the resources were created.
+// The random part comes from crypto/rand for that reason, rather than the faster monotonic
+// source which the ulid package uses by default.
+func newULID(t time.Time) string {
+	return ulid.MustNew(ulid.Timestamp(t), rand.Reader).String()
+}
+
+// IsULID reports whether s is a well-formed ULID, such as "01ARZ3NDEKTSV4RRFFQ69G5FAV". It's
+// used to tell ULIDs apart from integer IDs where either can be given.
+func IsULID(s string) bool {
+	_, err := ulid.ParseStrict(s)
+	return err == nil
+}
+
+// BackfillULIDs gives a ULID to up to batchSize of the movies which were created before movies
+// had them, and returns the number of movies updated. The ULIDs use the movies' creation times,
+// so that they sort in the same order as the movies' IDs. It should be called until it returns
+// zero. Movies which were given a ULID in the meantime (by a concurrent backfill) are skipped,
+// and backfilling doesn't change a movie's version, since its content hasn't changed.
+func (m MovieModel) BackfillULIDs(ctx context.Context, batchSize int) (int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	query := `
+		SELECT id, created_at
+		FROM movies
+		WHERE ulid IS NULL
+		ORDER BY id
+		LIMIT $1
+		`
+
+	rows, err := m.DB.QueryContext(ctx, query, batchSize)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			m.ErrorLog.Println(err)
+		}
+	}()
+
+	var ids []int64
+	var ulids []string
+
+	for rows.Next() {
+		var id int64
+		var createdAt time.Time
+
+		err := rows.Scan(&id, &createdAt)
+		if err != nil {
+			return 0, err
+		}
+
+		ids = append(ids, id)
+		ulids = append(ulids, newULID(createdAt))
+	}
+
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+
+	if len(ids) == 0 {
+		return 0, nil
+	}
+
+	query = `
+		UPDATE movies
+		SET ulid = backfill.ulid
+		FROM unnest($1::bigint[], $2::text[]) AS backfill(id, ulid)
+		WHERE movies.id = backfill.id AND movies.ulid IS NULL
+		`
+
+	result, err := m.DB.ExecContext(ctx, query, pq.Array(ids), pq.Array(ulids))
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
@@ -4,11 +4,15 @@ import (
 	"context"
 	"crypto/sha256"
 	"database/sql"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"log"
 	"time"
 
+	"github.com/codeaucafe/snippetbox/greenlight/internal/clock"
 	"github.com/codeaucafe/snippetbox/greenlight/internal/validator"
+	"github.com/lib/pq"
 	"golang.org/x/crypto/bcrypt"
 )
 
@@ -29,6 +33,9 @@ type User struct {
 	Password  password  `json:"-"`
 	Activated bool      `json:"activated"`
 	Version   int       `json:"-"`
+	// TokenGeneration is carried in the user's JWT authentication tokens, which are only accepted
+	// while it matches. It's incremented when the user resets their password.
+	TokenGeneration int `json:"-"`
 }
 
 func (u *User) IsAnonymous() bool {
@@ -41,6 +48,8 @@ type UserModel struct {
 	DB       *sql.DB
 	InfoLog  *log.Logger
 	ErrorLog *log.Logger
+	// Clock is used to check whether tokens have expired.
+	Clock clock.Clock
 }
 
 // password tyep is a struct containing the plaintext and hashed version of a password for a User.
@@ -85,7 +94,7 @@ func (p *password) Matches(plaintextPassword string) (bool, error) {
 // created_at, and version fields are all automatically generated by our database, so we use use
 // the RETURNING clause to read them into the User struct after the insert. Also, we check
 // if our table already contains the same email address and if so return ErrDuplicateEmail error.
-func (m UserModel) Insert(user *User) error {
+func (m UserModel) Insert(ctx context.Context, user *User) error {
 	query := `
 		INSERT INTO users (name, email, password_hash, activated)
 		VALUES ($1, $2, $3, $4)
@@ -94,39 +103,152 @@ func (m UserModel) Insert(user *User) error {
 
 	args := []interface{}{user.Name, user.Email, user.Password.hash, user.Activated}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 
 	// If the table already contains a record with this email address, then when we try to
 	// perform the insert there will be a violation of the UNIQUE "users_email_key" constraint
 	// that we set up in the previous chapter. We check for this error specifically, and return
 	// ErrDuplicateEmail error instead.
-	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&user.ID, &user.CreatedAt, &user.Version)
+	err := withAudit(ctx, m.DB, AuditCreate, "users", 0, func(tx *sql.Tx) (int64, error) {
+		err := tx.QueryRowContext(ctx, query, args...).Scan(&user.ID, &user.CreatedAt, &user.Version)
+		return user.ID, err
+	})
 	if err != nil {
 		switch {
 		case err.Error() == `pq: duplicate key value violates unique constraint "users_email_key"`:
 			return ErrDuplicateEmail
 		default:
-			return err
+			return failoverError(err)
 		}
 	}
 
 	return nil
 }
 
+// Register creates a new user, grants it the given permissions, creates an activation token for
+// it, and adds the welcome email built by the welcome function to the outbox, all in a single
+// transaction, along with the user.registered webhook deliveries. This means that either all of
+// them happen or none of them do, so a user can never be left without an activation email. The
+// email itself is sent afterwards by the outbox workers, which retry until it is delivered.
+//
+// We use ON CONFLICT DO NOTHING rather than relying on the unique constraint error, so that
+// concurrent registrations for the same email address reliably get ErrDuplicateEmail without
+// aborting the transaction.
+func (m UserModel) Register(ctx context.Context, user *User, permissions []string, activationTTL time.Duration, welcome func(*Token) *OutboxEmail) (*Token, error) {
+	token, err := generateToken(0, activationTTL, ScopeActivation, m.Clock.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, failoverError(err)
+	}
+
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	query := `
+		INSERT INTO users (name, email, password_hash, activated)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (email) DO NOTHING
+		RETURNING id, created_at, version
+		`
+
+	args := []interface{}{user.Name, user.Email, user.Password.hash, user.Activated}
+
+	err = tx.QueryRowContext(ctx, query, args...).Scan(&user.ID, &user.CreatedAt, &user.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrDuplicateEmail
+		default:
+			return nil, failoverError(err)
+		}
+	}
+
+	query = `
+		INSERT INTO users_permissions
+		SELECT $1, permissions.id FROM permissions WHERE permissions.code = ANY($2)
+		`
+
+	_, err = tx.ExecContext(ctx, query, user.ID, pq.Array(permissions))
+	if err != nil {
+		return nil, failoverError(err)
+	}
+
+	err = newAudit(AuditCreate, "users").record(ctx, tx, user.ID)
+	if err != nil {
+		return nil, failoverError(err)
+	}
+
+	err = newAudit(AuditUpdate, "permissions").record(ctx, tx, user.ID)
+	if err != nil {
+		return nil, failoverError(err)
+	}
+
+	token.UserID = user.ID
+
+	query = `
+		INSERT INTO tokens (hash, user_id, expiry, scope)
+		VALUES ($1, $2, $3, $4)
+		`
+
+	_, err = tx.ExecContext(ctx, query, token.Hash, token.UserID, token.Expiry, token.Scope)
+	if err != nil {
+		return nil, failoverError(err)
+	}
+
+	err = insertOutboxMessage(ctx, tx, OutboxKindEmail, welcome(token))
+	if err != nil {
+		return nil, failoverError(err)
+	}
+
+	js, err := json.Marshal(user)
+	if err != nil {
+		return nil, err
+	}
+
+	err = enqueueWebhooks(ctx, tx, EventUserRegistered, user.ID, js)
+	if err != nil {
+		return nil, failoverError(err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, failoverError(err)
+	}
+
+	return token, nil
+}
+
 // GetByEmail retrieves the User details from the database based on the user's email address.
 // Because we have a UNIQUE constraint on the email column, this query will only return one record,
-// or none at all, upon which we return a ErrRecordNotFound error).
-func (m UserModel) GetByEmail(email string) (*User, error) {
+// or none at all, upon which we return a ErrRecordNotFound error). Users who have deleted their
+// account aren't returned, even during the grace period. The query is retried once if it fails
+// because of a database failover.
+func (m UserModel) GetByEmail(ctx context.Context, email string) (*User, error) {
+	return retryRead("users_get_by_email", func() (*User, error) {
+		return m.getByEmail(ctx, email)
+	})
+}
+
+// getByEmail runs the query for GetByEmail.
+func (m UserModel) getByEmail(ctx context.Context, email string) (*User, error) {
 	query := `
 		SELECT id, created_at, name, email, password_hash, activated, version
 		FROM users
-		WHERE email = $1
+		WHERE email = $1 AND deleted_at IS NULL
 		`
 
 	var user User
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 
 	err := m.DB.QueryRowContext(ctx, query, email).Scan(
@@ -151,10 +273,59 @@ func (m UserModel) GetByEmail(email string) (*User, error) {
 	return &user, nil
 }
 
+// Get retrieves the User details from the database based on the user's ID. It's used to look up
+// the user named by a JWT authentication token, so users who have deleted their account aren't
+// returned. The query is retried once if it fails because of a database failover.
+func (m UserModel) Get(ctx context.Context, id int64) (*User, error) {
+	return retryRead("users_get", func() (*User, error) {
+		return m.get(ctx, id)
+	})
+}
+
+// get runs the query for Get.
+func (m UserModel) get(ctx context.Context, id int64) (*User, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `
+		SELECT id, created_at, name, email, password_hash, activated, version, token_generation
+		FROM users
+		WHERE id = $1 AND deleted_at IS NULL
+		`
+
+	var user User
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(
+		&user.ID,
+		&user.CreatedAt,
+		&user.Name,
+		&user.Email,
+		&user.Password.hash,
+		&user.Activated,
+		&user.Version,
+		&user.TokenGeneration,
+	)
+
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &user, nil
+}
+
 // Update updates the details for a specific user in the users table. Note, we check against the
 // version field to help prevent any race conditions during the request cycle. Also, we check
 // for a violation of the "user_email_key" constraint.
-func (m UserModel) Update(user *User) error {
+func (m UserModel) Update(ctx context.Context, user *User) error {
 	query := `
 		UPDATE users
 		SET name = $1, email = $2, password_hash = $3, activated = $4, version = version + 1
@@ -171,10 +342,12 @@ func (m UserModel) Update(user *User) error {
 		user.Version,
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 
-	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&user.Version)
+	err := withAudit(ctx, m.DB, AuditUpdate, "users", user.ID, func(tx *sql.Tx) (int64, error) {
+		return user.ID, tx.QueryRowContext(ctx, query, args...).Scan(&user.Version)
+	})
 	if err != nil {
 		switch {
 		case err.Error() == `pq: duplicate key value violates unique constraint "users_email_key"`:
@@ -182,15 +355,23 @@ func (m UserModel) Update(user *User) error {
 		case errors.Is(err, sql.ErrNoRows):
 			return ErrEditConflict
 		default:
-			return err
+			return failoverError(err)
 		}
 	}
 
 	return nil
 }
 
-// GetForToken retrieves a user record from the users table for an associated token and token scope.
-func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error) {
+// GetForToken retrieves a user record from the users table for an associated token and token
+// scope. The query is retried once if it fails because of a database failover.
+func (m UserModel) GetForToken(ctx context.Context, tokenScope, tokenPlaintext string) (*User, error) {
+	return retryRead("users_get_for_token", func() (*User, error) {
+		return m.getForToken(ctx, tokenScope, tokenPlaintext)
+	})
+}
+
+// getForToken runs the query for GetForToken.
+func (m UserModel) getForToken(ctx context.Context, tokenScope, tokenPlaintext string) (*User, error) {
 	// Calculate the SHA-256 hash for the plaintext token provided by the client.
 	// Note, that this will return a byte *array* with length 32, not a slice.
 	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
@@ -198,7 +379,7 @@ func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error)
 	query := `
 		SELECT 
 			users.id, users.created_at, users.name, users.email, 
-			users.password_hash, users.activated, users.version
+			users.password_hash, users.activated, users.version, users.token_generation
 		FROM       users
         INNER JOIN tokens
 			ON users.id = tokens.user_id
@@ -208,16 +389,17 @@ func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error)
             -- that has the same SHA-256 hash that was found from our database. 
 			AND tokens.scope = $2
 			AND tokens.expiry > $3
+			AND users.deleted_at IS NULL
 		`
 
 	// Create a slice containing the query args. Note, that we use the [:] operator to get a slice
 	// containing the token hash, since the pq driver does not support passing in an array.
 	// Also, we pass the current time as the value to check against the token expiry.
-	args := []interface{}{tokenHash[:], tokenScope, time.Now()}
+	args := []interface{}{tokenHash[:], tokenScope, m.Clock.Now()}
 
 	var user User
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 
 	// Execute the query, scanning the return values into a User struct. If no matching record
@@ -230,6 +412,7 @@ func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error)
 		&user.Password.hash,
 		&user.Activated,
 		&user.Version,
+		&user.TokenGeneration,
 	)
 	if err != nil {
 		switch {
@@ -244,6 +427,688 @@ func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error)
 	return &user, nil
 }
 
+// ResetPassword sets a new password for the user who was issued a password reset token, and
+// returns the updated user. ErrRecordNotFound is returned if the token doesn't exist, has
+// expired, or has already been used.
+//
+// Everything happens in a single transaction. The token is deleted as it is consumed, and the
+// row lock taken by the DELETE means that if the same token is used twice concurrently only one
+// of the resets can succeed. Any other password reset tokens for the user are deleted too, along
+// with all of their authentication and refresh tokens and API keys, so that every session which
+// was opened with the old password has to log in again. The user's token generation is
+// incremented as well, which revokes their stateless JWT authentication tokens.
+func (m UserModel) ResetPassword(ctx context.Context, tokenPlaintext, plaintextPassword string) (*User, error) {
+	var user User
+
+	// Hash the new password before starting the transaction, since bcrypt is deliberately slow
+	// and we don't want to hold the locks while it runs.
+	err := user.Password.Set(plaintextPassword)
+	if err != nil {
+		return nil, err
+	}
+
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, failoverError(err)
+	}
+
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	query := `
+		DELETE FROM tokens
+		WHERE hash = $1 AND scope = $2 AND expiry > $3
+		RETURNING user_id
+		`
+
+	err = tx.QueryRowContext(ctx, query, tokenHash[:], ScopePasswordReset, m.Clock.Now()).Scan(&user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, failoverError(err)
+		}
+	}
+
+	change := newAudit(AuditUpdate, "users")
+
+	err = change.before(ctx, tx, user.ID)
+	if err != nil {
+		return nil, failoverError(err)
+	}
+
+	query = `
+		UPDATE users
+		SET password_hash = $1, version = version + 1, token_generation = token_generation + 1
+		WHERE id = $2
+		RETURNING created_at, name, email, activated, version, token_generation
+		`
+
+	err = tx.QueryRowContext(ctx, query, user.Password.hash, user.ID).Scan(
+		&user.CreatedAt,
+		&user.Name,
+		&user.Email,
+		&user.Activated,
+		&user.Version,
+		&user.TokenGeneration,
+	)
+	if err != nil {
+		return nil, failoverError(err)
+	}
+
+	query = `
+		DELETE FROM tokens
+		WHERE user_id = $1 AND scope = ANY($2)
+		`
+
+	scopes := []string{ScopeAuthentication, ScopeRefresh, ScopePasswordReset}
+
+	_, err = tx.ExecContext(ctx, query, user.ID, pq.Array(scopes))
+	if err != nil {
+		return nil, failoverError(err)
+	}
+
+	_, err = tx.ExecContext(ctx, "DELETE FROM api_keys WHERE user_id = $1", user.ID)
+	if err != nil {
+		return nil, failoverError(err)
+	}
+
+	err = change.record(ctx, tx, user.ID)
+	if err != nil {
+		return nil, failoverError(err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, failoverError(err)
+	}
+
+	return &user, nil
+}
+
+// StageEmailChange records email as the user's pending email address, which replaces their
+// current address once they confirm it with ConfirmEmailChange. It creates a confirmation token,
+// replacing any earlier one, and adds the email built by the confirm function, which should send
+// the token to the new address, to the outbox, all in a single transaction. ErrDuplicateEmail is
+// returned if another user already has the address.
+func (m UserModel) StageEmailChange(ctx context.Context, userID int64, email string, ttl time.Duration, confirm func(*Token) *OutboxEmail) (*Token, error) {
+	token, err := generateToken(userID, ttl, ScopeEmailChange, m.Clock.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, failoverError(err)
+	}
+
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	var taken bool
+
+	query := `SELECT EXISTS(SELECT 1 FROM users WHERE email = $1)`
+
+	err = tx.QueryRowContext(ctx, query, email).Scan(&taken)
+	if err != nil {
+		return nil, failoverError(err)
+	}
+
+	if taken {
+		return nil, ErrDuplicateEmail
+	}
+
+	change := newAudit(AuditUpdate, "users")
+
+	err = change.before(ctx, tx, userID)
+	if err != nil {
+		return nil, failoverError(err)
+	}
+
+	query = `
+		UPDATE users
+		SET pending_email = $1, version = version + 1
+		WHERE id = $2
+		`
+
+	_, err = tx.ExecContext(ctx, query, email, userID)
+	if err != nil {
+		return nil, failoverError(err)
+	}
+
+	query = `
+		DELETE FROM tokens
+		WHERE user_id = $1 AND scope = $2
+		`
+
+	_, err = tx.ExecContext(ctx, query, userID, ScopeEmailChange)
+	if err != nil {
+		return nil, failoverError(err)
+	}
+
+	err = insertToken(ctx, tx, token)
+	if err != nil {
+		return nil, failoverError(err)
+	}
+
+	err = insertOutboxMessage(ctx, tx, OutboxKindEmail, confirm(token))
+	if err != nil {
+		return nil, failoverError(err)
+	}
+
+	err = change.record(ctx, tx, userID)
+	if err != nil {
+		return nil, failoverError(err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, failoverError(err)
+	}
+
+	return token, nil
+}
+
+// ConfirmEmailChange replaces the email address of the user who was issued an email change
+// token with their pending address, and returns the updated user. The email built by the notice
+// function, which is passed the user and their old address, is added to the outbox, so that the
+// old address is told about the change. ErrRecordNotFound is returned if the token doesn't
+// exist, has expired, or has already been used, and ErrDuplicateEmail if another user has taken
+// the address since the change was staged.
+//
+// As with ResetPassword, the token is deleted as it's consumed in the same transaction as the
+// change, so it can only be used once.
+func (m UserModel) ConfirmEmailChange(ctx context.Context, tokenPlaintext string, notice func(user *User, oldEmail string) *OutboxEmail) (*User, error) {
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, failoverError(err)
+	}
+
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	var user User
+
+	query := `
+		DELETE FROM tokens
+		WHERE hash = $1 AND scope = $2 AND expiry > $3
+		RETURNING user_id
+		`
+
+	err = tx.QueryRowContext(ctx, query, tokenHash[:], ScopeEmailChange, m.Clock.Now()).Scan(&user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, failoverError(err)
+		}
+	}
+
+	var oldEmail string
+
+	query = `
+		SELECT email
+		FROM users
+		WHERE id = $1 AND pending_email IS NOT NULL
+		FOR UPDATE
+		`
+
+	err = tx.QueryRowContext(ctx, query, user.ID).Scan(&oldEmail)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, failoverError(err)
+		}
+	}
+
+	change := newAudit(AuditUpdate, "users")
+
+	err = change.before(ctx, tx, user.ID)
+	if err != nil {
+		return nil, failoverError(err)
+	}
+
+	query = `
+		UPDATE users
+		SET email = pending_email, pending_email = NULL, version = version + 1
+		WHERE id = $1
+		RETURNING created_at, name, email, activated, version
+		`
+
+	err = tx.QueryRowContext(ctx, query, user.ID).Scan(
+		&user.CreatedAt,
+		&user.Name,
+		&user.Email,
+		&user.Activated,
+		&user.Version,
+	)
+	if err != nil {
+		switch {
+		case err.Error() == `pq: duplicate key value violates unique constraint "users_email_key"`:
+			return nil, ErrDuplicateEmail
+		default:
+			return nil, failoverError(err)
+		}
+	}
+
+	err = insertOutboxMessage(ctx, tx, OutboxKindEmail, notice(&user, oldEmail))
+	if err != nil {
+		return nil, failoverError(err)
+	}
+
+	err = change.record(ctx, tx, user.ID)
+	if err != nil {
+		return nil, failoverError(err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, failoverError(err)
+	}
+
+	return &user, nil
+}
+
+// UserFilters holds the filters for listing users in the admin API, on top of the pagination
+// and sorting in Filters. Email matches any part of the address, case-insensitively, Activated
+// matches the activation status if it isn't nil, and Permission matches the users who have
+// been granted that permission code.
+type UserFilters struct {
+	Email      string
+	Activated  *bool
+	Permission string
+}
+
+// GetAll returns a page of the users which match the filters, sorted according to the filters.
+func (m UserModel) GetAll(ctx context.Context, userFilters UserFilters, filters Filters) ([]*User, Metadata, error) {
+	query := fmt.Sprintf(`
+		SELECT count(*) OVER(), id, created_at, name, email, activated, version
+		FROM users
+		WHERE (email ILIKE '%%' || $1 || '%%' ESCAPE '\\' OR $1 = '')
+		AND (activated = $2 OR $2 IS NULL)
+		AND (id IN (
+			SELECT users_permissions.user_id
+			FROM users_permissions
+			INNER JOIN permissions ON permissions.id = users_permissions.permission_id
+			WHERE permissions.code = $3
+		) OR $3 = '')
+		ORDER BY %s %s, id ASC
+		LIMIT $4 OFFSET $5`,
+		filters.sortColumn(), filters.sortDirection())
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	// Escape the LIKE wildcards in the email filter, so that they match literally.
+	args := []interface{}{escapeLike(userFilters.Email), userFilters.Activated, userFilters.Permission, filters.limit(), filters.offset()}
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			m.ErrorLog.Println(err)
+		}
+	}()
+
+	totalRecords := 0
+	users := []*User{}
+
+	for rows.Next() {
+		var user User
+
+		err := rows.Scan(
+			&totalRecords,
+			&user.ID,
+			&user.CreatedAt,
+			&user.Name,
+			&user.Email,
+			&user.Activated,
+			&user.Version,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		users = append(users, &user)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	return users, calculateMetadata(totalRecords, filters.Page, filters.PageSize), nil
+}
+
+// SetActivated activates or deactivates a user, checking the version to prevent a race with
+// other updates in the same way as Update. When a user is deactivated, their authentication
+// and refresh tokens and API keys are deleted in the same transaction, so that they're logged
+// out straight away. Stateless JWT authentication tokens aren't revoked, but every endpoint which
+// needs an activated user will reject them.
+func (m UserModel) SetActivated(ctx context.Context, user *User, activated bool) error {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return failoverError(err)
+	}
+
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	change := newAudit(AuditUpdate, "users")
+
+	err = change.before(ctx, tx, user.ID)
+	if err != nil {
+		return failoverError(err)
+	}
+
+	query := `
+		UPDATE users
+		SET activated = $1, version = version + 1
+		WHERE id = $2 AND version = $3
+		RETURNING version
+		`
+
+	err = tx.QueryRowContext(ctx, query, activated, user.ID, user.Version).Scan(&user.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return failoverError(err)
+		}
+	}
+
+	if !activated {
+		query = `
+			DELETE FROM tokens
+			WHERE user_id = $1 AND scope = ANY($2)
+			`
+
+		scopes := []string{ScopeAuthentication, ScopeRefresh}
+
+		_, err = tx.ExecContext(ctx, query, user.ID, pq.Array(scopes))
+		if err != nil {
+			return failoverError(err)
+		}
+
+		_, err = tx.ExecContext(ctx, "DELETE FROM api_keys WHERE user_id = $1", user.ID)
+		if err != nil {
+			return failoverError(err)
+		}
+	}
+
+	err = change.record(ctx, tx, user.ID)
+	if err != nil {
+		return failoverError(err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return failoverError(err)
+	}
+
+	user.Activated = activated
+
+	return nil
+}
+
+// SoftDelete deletes a user's account at their own request. The account is kept for a grace
+// period, during which it can be restored, and then removed for good by PurgeDeleted. Until then
+// the user is treated as if they didn't exist: all of their tokens are deleted, so they're
+// logged out everywhere, and they can't log in or be emailed. A restore token which lasts for
+// the grace period is created, and the email built by the notice function, which is passed the
+// token, is added to the outbox, all in the same transaction. ErrRecordNotFound is returned if
+// the user doesn't exist or has already been deleted.
+func (m UserModel) SoftDelete(ctx context.Context, userID int64, gracePeriod time.Duration, notice func(*Token) *OutboxEmail) (*Token, error) {
+	now := m.Clock.Now()
+
+	token, err := generateToken(userID, gracePeriod, ScopeAccountRestore, now)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, failoverError(err)
+	}
+
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	change := newAudit(AuditDelete, "users")
+
+	err = change.before(ctx, tx, userID)
+	if err != nil {
+		return nil, failoverError(err)
+	}
+
+	query := `
+		UPDATE users
+		SET deleted_at = $1, version = version + 1
+		WHERE id = $2 AND deleted_at IS NULL
+		`
+
+	result, err := tx.ExecContext(ctx, query, now, userID)
+	if err != nil {
+		return nil, failoverError(err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return nil, failoverError(err)
+	}
+
+	if rowsAffected == 0 {
+		return nil, ErrRecordNotFound
+	}
+
+	query = `
+		DELETE FROM tokens
+		WHERE user_id = $1
+		`
+
+	_, err = tx.ExecContext(ctx, query, userID)
+	if err != nil {
+		return nil, failoverError(err)
+	}
+
+	err = insertToken(ctx, tx, token)
+	if err != nil {
+		return nil, failoverError(err)
+	}
+
+	err = insertOutboxMessage(ctx, tx, OutboxKindEmail, notice(token))
+	if err != nil {
+		return nil, failoverError(err)
+	}
+
+	err = change.record(ctx, tx, userID)
+	if err != nil {
+		return nil, failoverError(err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, failoverError(err)
+	}
+
+	return token, nil
+}
+
+// Restore restores the account of the user who was issued an account restore token when they
+// deleted it, and returns the user. ErrRecordNotFound is returned if the token doesn't exist, has
+// expired (in which case the account is about to be purged), or has already been used. As with
+// ResetPassword, the token is deleted as it's consumed, so it can only be used once.
+func (m UserModel) Restore(ctx context.Context, tokenPlaintext string) (*User, error) {
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, failoverError(err)
+	}
+
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	var user User
+
+	query := `
+		DELETE FROM tokens
+		WHERE hash = $1 AND scope = $2 AND expiry > $3
+		RETURNING user_id
+		`
+
+	err = tx.QueryRowContext(ctx, query, tokenHash[:], ScopeAccountRestore, m.Clock.Now()).Scan(&user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, failoverError(err)
+		}
+	}
+
+	change := newAudit(AuditRestore, "users")
+
+	err = change.before(ctx, tx, user.ID)
+	if err != nil {
+		return nil, failoverError(err)
+	}
+
+	query = `
+		UPDATE users
+		SET deleted_at = NULL, version = version + 1
+		WHERE id = $1 AND deleted_at IS NOT NULL
+		RETURNING created_at, name, email, activated, version
+		`
+
+	err = tx.QueryRowContext(ctx, query, user.ID).Scan(
+		&user.CreatedAt,
+		&user.Name,
+		&user.Email,
+		&user.Activated,
+		&user.Version,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, failoverError(err)
+		}
+	}
+
+	err = change.record(ctx, tx, user.ID)
+	if err != nil {
+		return nil, failoverError(err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, failoverError(err)
+	}
+
+	return &user, nil
+}
+
+// userPersonalFields are the fields of the users audit snapshots which identify the user. They're
+// removed from the audit log when the user is purged, while the rest of their history is kept.
+var userPersonalFields = []string{"name", "email", "pending_email"}
+
+// PurgeDeleted removes the users who deleted their account at or before the given time, in the
+// same way as Delete, and returns the number removed. Their personal fields are scrubbed from
+// the audit log entries recorded for them, as the entries outlive the users.
+func (m UserModel) PurgeDeleted(ctx context.Context, before time.Time) (int64, error) {
+	query := `
+		WITH purged AS (
+			DELETE FROM users
+			WHERE deleted_at <= $1
+			RETURNING id
+		), scrubbed AS (
+			UPDATE audit_log
+			SET changes = changes - $2::text[]
+			WHERE resource_type = 'users' AND resource_id IN (SELECT id FROM purged) AND changes ?| $2
+		)
+		INSERT INTO audit_log (action, resource_type, resource_id, changes)
+		SELECT 'purge', 'users', id, '{}' FROM purged
+		`
+
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, before, pq.Array(userPersonalFields))
+	if err != nil {
+		return 0, failoverError(err)
+	}
+
+	return result.RowsAffected()
+}
+
+// Delete removes a user. Their tokens, permissions and other personal records are deleted along
+// with them by the foreign keys, while the movies and announcements they created are kept, with
+// their creator set to NULL. ErrRecordNotFound is returned if the user doesn't exist.
+func (m UserModel) Delete(ctx context.Context, id int64) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	err := withAudit(ctx, m.DB, AuditDelete, "users", id, func(tx *sql.Tx) (int64, error) {
+		result, err := tx.ExecContext(ctx, "DELETE FROM users WHERE id = $1", id)
+		if err != nil {
+			return 0, err
+		}
+
+		rowsAffected, err := result.RowsAffected()
+		if err != nil {
+			return 0, err
+		}
+
+		if rowsAffected == 0 {
+			return 0, ErrRecordNotFound
+		}
+
+		return id, nil
+	})
+
+	return failoverError(err)
+}
+
 // ValidateEmail checks that the Email field is not an empty string and that it matches the regex
 // for email addresses, validator.EmailRX.
 func ValidateEmail(v *validator.Validator, email string) {
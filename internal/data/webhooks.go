@@ -0,0 +1,570 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"time"
+
+	"github.com/lib/pq"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+
+	"github.com/codeaucafe/snippetbox/greenlight/internal/validator"
+	webhookpkg "github.com/codeaucafe/snippetbox/greenlight/internal/webhook"
+)
+
+// EventUserRegistered is sent to webhooks when a user registers. Unlike the movie events it isn't
+// recorded in the events table, as the event feed is readable by any user with the movies:read
+// permission, and its data (the user, without their password) is only for admins.
+const EventUserRegistered = "user.registered"
+
+// WebhookEventTypes holds the event types which webhooks can subscribe to.
+var WebhookEventTypes = []string{
+	EventMovieCreated,
+	EventMovieUpdated,
+	EventMovieDeleted,
+	EventMovieRestored,
+	EventUserRegistered,
+}
+
+// MaxWebhookAttempts is the number of times that a webhook delivery is attempted before it is
+// marked as failed.
+const MaxWebhookAttempts = 10
+
+// Webhook delivery statuses. A delivery is pending until it succeeds (delivered), or until it has
+// been attempted MaxWebhookAttempts times (failed).
+const (
+	WebhookDeliveryPending   = "pending"
+	WebhookDeliveryDelivered = "delivered"
+	WebhookDeliveryFailed    = "failed"
+)
+
+// Webhook is an endpoint registered by an admin, which is sent a signed POST request for each
+// event of the types it subscribes to. Secret is the key that the requests are signed with. It's
+// only returned when the webhook is created, and isn't read back by the other methods.
+type Webhook struct {
+	ID         int64     `json:"id"`
+	CreatedAt  time.Time `json:"created_at"`
+	CreatedBy  *int64    `json:"created_by"`
+	URL        string    `json:"url"`
+	Secret     string    `json:"secret,omitempty"`
+	EventTypes []string  `json:"event_types"`
+	Active     bool      `json:"active"`
+	Version    int       `json:"version"`
+}
+
+// WebhookDelivery is a request to send an event to a webhook, and the record of how it went.
+// ResponseStatus is the status code of the webhook's response to the last attempt, which is nil
+// if there hasn't been one or if the request failed without a response (LastError says why).
+// LatencyMS is how long the last attempt took, in milliseconds, or nil if there hasn't been one.
+type WebhookDelivery struct {
+	ID             int64           `json:"id"`
+	CreatedAt      time.Time       `json:"created_at"`
+	WebhookID      int64           `json:"webhook_id"`
+	EventType      string          `json:"event_type"`
+	Payload        json.RawMessage `json:"payload"`
+	Status         string          `json:"status"`
+	Attempts       int             `json:"attempts"`
+	NextAttemptAt  time.Time       `json:"next_attempt_at"`
+	LastAttemptAt  *time.Time      `json:"last_attempt_at"`
+	ResponseStatus *int            `json:"response_status"`
+	LatencyMS      *int64          `json:"latency_ms"`
+	LastError      string          `json:"last_error,omitempty"`
+	// URL and Secret are those of the webhook, which are filled in by ClaimDue() so that the
+	// delivery can be sent. TraceContext holds the trace context headers of the request which
+	// caused the delivery, so that the delivery can be part of the same trace.
+	URL          string            `json:"-"`
+	Secret       string            `json:"-"`
+	TraceContext map[string]string `json:"-"`
+}
+
+// enqueueWebhooks queues a delivery of an event to each active webhook which subscribes to its
+// type, as part of a transaction, so that the deliveries are only made if the change the event
+// describes commits. data is the event data, as JSON. The payload sent to the webhooks wraps it
+// with the event type, the ID of the resource and the time of the event. The trace context in ctx
+// is stored with the deliveries, as they're sent later by a worker which doesn't have it.
+func enqueueWebhooks(ctx context.Context, tx *sql.Tx, eventType string, resourceID int64, data []byte) error {
+	query := `
+		INSERT INTO webhook_deliveries (webhook_id, event_type, payload, trace_context)
+		SELECT id, $1, jsonb_build_object('type', $1::text, 'resource_id', $2::bigint, 'occurred_at', NOW(), 'data', $3::jsonb), $4
+		FROM webhooks
+		WHERE active AND $1 = ANY(event_types)
+		`
+
+	carrier := propagation.MapCarrier{}
+	otel.GetTextMapPropagator().Inject(ctx, carrier)
+
+	traceContext, err := json.Marshal(carrier)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, query, eventType, resourceID, data, traceContext)
+	return err
+}
+
+// WebhookModel struct wraps a sql.DB connection pool and allows us to work with the Webhook and
+// WebhookDelivery struct types and the webhooks and webhook_deliveries tables in our database.
+type WebhookModel struct {
+	DB       *sql.DB
+	InfoLog  *log.Logger
+	ErrorLog *log.Logger
+}
+
+// Insert adds a new webhook, and records it in the audit log. If the webhook doesn't have a secret
+// then a random one is generated for it.
+func (m WebhookModel) Insert(ctx context.Context, webhook *Webhook) error {
+	if webhook.Secret == "" {
+		secret, err := randomKeyString(32)
+		if err != nil {
+			return err
+		}
+
+		webhook.Secret = secret
+	}
+
+	query := `
+		INSERT INTO webhooks (created_by, url, secret, event_types, active)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id, created_at, version
+		`
+
+	args := []interface{}{
+		webhook.CreatedBy,
+		webhook.URL,
+		webhook.Secret,
+		pq.Array(webhook.EventTypes),
+		webhook.Active,
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	return withAudit(ctx, m.DB, AuditCreate, "webhooks", 0, func(tx *sql.Tx) (int64, error) {
+		err := tx.QueryRowContext(ctx, query, args...).Scan(&webhook.ID, &webhook.CreatedAt, &webhook.Version)
+		if err != nil {
+			return 0, err
+		}
+
+		return webhook.ID, nil
+	})
+}
+
+// Get returns a specific webhook, without its secret. ErrRecordNotFound is returned if it doesn't
+// exist.
+func (m WebhookModel) Get(ctx context.Context, id int64) (*Webhook, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `
+		SELECT id, created_at, created_by, url, event_types, active, version
+		FROM webhooks
+		WHERE id = $1
+		`
+
+	webhooks, err := m.query(ctx, query, id)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(webhooks) == 0 {
+		return nil, ErrRecordNotFound
+	}
+
+	return webhooks[0], nil
+}
+
+// GetAll returns every webhook, without their secrets, oldest first.
+func (m WebhookModel) GetAll(ctx context.Context) ([]*Webhook, error) {
+	query := `
+		SELECT id, created_at, created_by, url, event_types, active, version
+		FROM webhooks
+		ORDER BY id
+		`
+
+	return m.query(ctx, query)
+}
+
+// query runs a query which returns webhooks rows.
+func (m WebhookModel) query(ctx context.Context, query string, args ...interface{}) ([]*Webhook, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			m.ErrorLog.Println(err)
+		}
+	}()
+
+	webhooks := []*Webhook{}
+
+	for rows.Next() {
+		var webhook Webhook
+
+		err := rows.Scan(
+			&webhook.ID,
+			&webhook.CreatedAt,
+			&webhook.CreatedBy,
+			&webhook.URL,
+			pq.Array(&webhook.EventTypes),
+			&webhook.Active,
+			&webhook.Version,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		webhooks = append(webhooks, &webhook)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return webhooks, nil
+}
+
+// Update updates the URL, event types and active flag of a webhook, and records the change in the
+// audit log. The secret isn't changed. As for movies, the version number is checked to prevent
+// lost updates, and ErrEditConflict is returned if the webhook has been changed (or deleted)
+// since it was read. Deliveries which are already queued are sent to the new URL.
+func (m WebhookModel) Update(ctx context.Context, webhook *Webhook) error {
+	query := `
+		UPDATE webhooks
+		SET url = $1, event_types = $2, active = $3, version = version + 1
+		WHERE id = $4 AND version = $5
+		RETURNING version
+		`
+
+	args := []interface{}{
+		webhook.URL,
+		pq.Array(webhook.EventTypes),
+		webhook.Active,
+		webhook.ID,
+		webhook.Version,
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	return withAudit(ctx, m.DB, AuditUpdate, "webhooks", webhook.ID, func(tx *sql.Tx) (int64, error) {
+		err := tx.QueryRowContext(ctx, query, args...).Scan(&webhook.Version)
+		if err != nil {
+			switch {
+			case errors.Is(err, sql.ErrNoRows):
+				return 0, ErrEditConflict
+			default:
+				return 0, err
+			}
+		}
+
+		return webhook.ID, nil
+	})
+}
+
+// Delete removes a webhook, along with its deliveries, and records the deletion in the audit log.
+// ErrRecordNotFound is returned if it doesn't exist.
+func (m WebhookModel) Delete(ctx context.Context, id int64) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+
+	query := `
+		DELETE FROM webhooks
+		WHERE id = $1
+		`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	return withAudit(ctx, m.DB, AuditDelete, "webhooks", id, func(tx *sql.Tx) (int64, error) {
+		result, err := tx.ExecContext(ctx, query, id)
+		if err != nil {
+			return 0, err
+		}
+
+		rowsAffected, err := result.RowsAffected()
+		if err != nil {
+			return 0, err
+		}
+
+		if rowsAffected == 0 {
+			return 0, ErrRecordNotFound
+		}
+
+		return id, nil
+	})
+}
+
+// ClaimDue claims up to limit pending deliveries to active webhooks which are due to be sent, and
+// returns them along with the URL and secret of their webhook. As for the outbox, each claimed
+// delivery has its attempts incremented and its next attempt pushed back by the lease duration,
+// so if the worker dies before it finishes then the delivery is sent again once the lease runs
+// out, and FOR UPDATE SKIP LOCKED means that workers in different instances of the application
+// never claim the same delivery. Deliveries to inactive webhooks wait until they're reactivated.
+func (m WebhookModel) ClaimDue(ctx context.Context, limit int, lease time.Duration) ([]*WebhookDelivery, error) {
+	query := `
+		UPDATE webhook_deliveries d
+		SET attempts = d.attempts + 1, last_attempt_at = NOW(), next_attempt_at = NOW() + $1 * INTERVAL '1 second'
+		FROM webhooks w
+		WHERE w.id = d.webhook_id AND d.id IN (
+			SELECT id
+			FROM webhook_deliveries
+			WHERE status = 'pending' AND next_attempt_at <= NOW()
+			AND webhook_id IN (SELECT id FROM webhooks WHERE active)
+			ORDER BY id
+			FOR UPDATE SKIP LOCKED
+			LIMIT $2
+		)
+		RETURNING d.id, d.webhook_id, d.event_type, d.payload, d.attempts, w.url, w.secret, d.trace_context
+		`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, lease.Seconds(), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			m.ErrorLog.Println(err)
+		}
+	}()
+
+	deliveries := []*WebhookDelivery{}
+
+	for rows.Next() {
+		var delivery WebhookDelivery
+		var traceContext []byte
+
+		err := rows.Scan(
+			&delivery.ID,
+			&delivery.WebhookID,
+			&delivery.EventType,
+			&delivery.Payload,
+			&delivery.Attempts,
+			&delivery.URL,
+			&delivery.Secret,
+			&traceContext,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		err = json.Unmarshal(traceContext, &delivery.TraceContext)
+		if err != nil {
+			return nil, err
+		}
+
+		deliveries = append(deliveries, &delivery)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return deliveries, nil
+}
+
+// MarkDelivered records that a delivery was accepted by the webhook with the given status code,
+// and how long the request took.
+func (m WebhookModel) MarkDelivered(ctx context.Context, delivery *WebhookDelivery, responseStatus int, latency time.Duration) error {
+	query := `
+		UPDATE webhook_deliveries
+		SET status = 'delivered', response_status = $1, latency_ms = $2, last_error = ''
+		WHERE id = $3
+		`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, responseStatus, latency.Milliseconds(), delivery.ID)
+	return err
+}
+
+// Retry records a failed delivery attempt, along with the status code of the webhook's response
+// (or nil if there wasn't one) and how long the attempt took, and schedules the next attempt after
+// the given backoff. Once the delivery has been attempted MaxWebhookAttempts times it is marked as
+// failed instead, and won't be attempted again.
+func (m WebhookModel) Retry(ctx context.Context, delivery *WebhookDelivery, backoff time.Duration, responseStatus *int,
+	latency time.Duration, deliveryErr error) error {
+	query := `
+		UPDATE webhook_deliveries
+		SET response_status = $1,
+			latency_ms = $2,
+			last_error = $3,
+			next_attempt_at = NOW() + $4 * INTERVAL '1 second',
+			status = CASE WHEN attempts >= $5 THEN 'failed' ELSE 'pending' END
+		WHERE id = $6
+		`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, responseStatus, latency.Milliseconds(), deliveryErr.Error(),
+		backoff.Seconds(), MaxWebhookAttempts, delivery.ID)
+	return err
+}
+
+// GetDeliveries returns the deliveries to a webhook, optionally only those with the given status,
+// along with the pagination metadata. The sort is by ID, newest first by default.
+func (m WebhookModel) GetDeliveries(ctx context.Context, webhookID int64, status string, filters Filters) ([]*WebhookDelivery, Metadata, error) {
+	query := fmt.Sprintf(`
+		SELECT count(*) OVER(), id, created_at, webhook_id, event_type, payload, status, attempts,
+			next_attempt_at, last_attempt_at, response_status, latency_ms, last_error
+		FROM webhook_deliveries
+		WHERE webhook_id = $1
+		AND (status = $2 OR $2 = '')
+		ORDER BY %s %s
+		LIMIT $3 OFFSET $4`,
+		filters.sortColumn(), filters.sortDirection())
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, webhookID, status, filters.limit(), filters.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			m.ErrorLog.Println(err)
+		}
+	}()
+
+	totalRecords := 0
+	deliveries := []*WebhookDelivery{}
+
+	for rows.Next() {
+		var delivery WebhookDelivery
+
+		err := rows.Scan(
+			&totalRecords,
+			&delivery.ID,
+			&delivery.CreatedAt,
+			&delivery.WebhookID,
+			&delivery.EventType,
+			&delivery.Payload,
+			&delivery.Status,
+			&delivery.Attempts,
+			&delivery.NextAttemptAt,
+			&delivery.LastAttemptAt,
+			&delivery.ResponseStatus,
+			&delivery.LatencyMS,
+			&delivery.LastError,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		deliveries = append(deliveries, &delivery)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	return deliveries, calculateMetadata(totalRecords, filters.Page, filters.PageSize), nil
+}
+
+// Stats returns the number of deliveries waiting to be sent, including those waiting to be
+// retried, and the age of the oldest of them. Deliveries to paused webhooks aren't counted, as
+// they aren't expected to be sent until the webhook is active again.
+func (m WebhookModel) Stats(ctx context.Context) (QueueStats, error) {
+	query := `
+		SELECT count(*), COALESCE(EXTRACT(EPOCH FROM NOW() - MIN(d.created_at)), 0)
+		FROM webhook_deliveries d
+		INNER JOIN webhooks w ON w.id = d.webhook_id
+		WHERE d.status = 'pending' AND w.active
+		`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	var stats QueueStats
+	var age float64
+
+	err := m.DB.QueryRowContext(ctx, query).Scan(&stats.Depth, &age)
+	if err != nil {
+		return QueueStats{}, err
+	}
+
+	stats.OldestAge = time.Duration(age * float64(time.Second))
+
+	return stats, nil
+}
+
+// PurgeDeliveries removes the delivered and failed deliveries which were created before the given
+// time, and returns how many were removed. Pending deliveries are kept, however old they are.
+func (m WebhookModel) PurgeDeliveries(ctx context.Context, before time.Time) (int64, error) {
+	query := `
+		DELETE FROM webhook_deliveries
+		WHERE status <> 'pending' AND created_at < $1
+		`
+
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, before)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
+
+// ValidateWebhook runs validation checks on the Webhook type. Unless allowPrivate is true, the URL
+// must not point at a private, loopback or internal address, so that webhooks can't be used to
+// make requests to the services on the application's own network. Hostnames are only checked by
+// name here, as they can resolve differently later; the addresses they resolve to are checked
+// again when each request is sent (see webhook.CheckDial).
+func ValidateWebhook(v *validator.Validator, webhook *Webhook, allowPrivate bool) {
+	u, err := url.Parse(webhook.URL)
+	v.Check(webhook.URL != "", "url", "must be provided")
+	v.Check(len(webhook.URL) <= 2000, "url", "must not be more than 2000 bytes long")
+	v.Check(err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "", "url",
+		"must be an absolute http or https URL")
+
+	if err == nil && u.Host != "" && !allowPrivate {
+		host := u.Hostname()
+
+		private := webhookpkg.InternalHost(host)
+		if ip := net.ParseIP(host); ip != nil {
+			private = !webhookpkg.PublicIP(ip)
+		}
+
+		v.Check(!private, "url", "must not point at a private, loopback or internal address")
+	}
+
+	v.Check(webhook.Secret == "" || len(webhook.Secret) >= 16, "secret", "must be at least 16 bytes long")
+	v.Check(len(webhook.Secret) <= 200, "secret", "must not be more than 200 bytes long")
+
+	v.Check(len(webhook.EventTypes) > 0, "event_types", "must contain at least 1 event type")
+	v.Check(validator.Unique(webhook.EventTypes), "event_types", "must not contain duplicate values")
+
+	for _, eventType := range webhook.EventTypes {
+		if !validator.In(eventType, WebhookEventTypes...) {
+			v.AddError("event_types", "must only contain movie.created, movie.updated, movie.deleted, "+
+				"movie.restored or user.registered")
+			break
+		}
+	}
+}
+
+// ValidateWebhookDeliveryStatus checks the status filter for the deliveries of a webhook.
+func ValidateWebhookDeliveryStatus(v *validator.Validator, status string) {
+	v.Check(status == "" || validator.In(status, WebhookDeliveryPending, WebhookDeliveryDelivered,
+		WebhookDeliveryFailed), "status", "must be one of pending, delivered or failed")
+}
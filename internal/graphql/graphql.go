@@ -0,0 +1,61 @@
+// Package graphql holds the GraphQL schema served by the API, in schema.graphqls, and the
+// executor which gqlgen generates for it. The resolvers live with the rest of the handlers, in
+// cmd/api, and implement the ResolverRoot interface.
+package graphql
+
+//go:generate go run github.com/99designs/gqlgen@v0.17.36 generate --config gqlgen.yml
+
+import (
+	_ "embed"
+	"errors"
+	"io"
+	"strconv"
+
+	"github.com/99designs/gqlgen/graphql"
+	"github.com/codeaucafe/snippetbox/greenlight/internal/data"
+)
+
+// SDL is the schema in the GraphQL schema definition language, as published for client code
+// generators.
+//
+//go:embed schema.graphqls
+var SDL string
+
+// MoviePage is a page of movies, along with its pagination metadata.
+type MoviePage struct {
+	Items    []*data.Movie
+	Metadata data.Metadata
+}
+
+// ReviewPage is a page of a movie's reviews, along with its pagination metadata.
+type ReviewPage struct {
+	Items    []*data.Review
+	Metadata data.Metadata
+}
+
+// MarshalInt64ID writes an int64 ID, such as a movie's ID, as an ID. IDs are always serialized
+// as strings.
+func MarshalInt64ID(id int64) graphql.Marshaler {
+	return graphql.WriterFunc(func(w io.Writer) {
+		_, _ = io.WriteString(w, strconv.Quote(strconv.FormatInt(id, 10)))
+	})
+}
+
+// UnmarshalInt64ID reads an ID argument as an int64. IDs can be given as strings or integers, and
+// anything else is an error.
+func UnmarshalInt64ID(v interface{}) (int64, error) {
+	switch v := v.(type) {
+	case string:
+		id, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return 0, errors.New("ID must be an integer")
+		}
+		return id, nil
+	case int:
+		return int64(v), nil
+	case int64:
+		return v, nil
+	default:
+		return graphql.UnmarshalInt64(v)
+	}
+}
@@ -2,9 +2,11 @@ package jsonlog
 
 import (
 	"encoding/json"
+	"fmt"
 	"io"
 	"os"
 	"runtime/debug"
+	"strings"
 	"sync"
 	"time"
 )
@@ -35,6 +37,21 @@ func (l Level) String() string {
 	}
 }
 
+// ParseLevel returns the Level for a case-insensitive level name, such as "info" or "ERROR".
+func ParseLevel(name string) (Level, error) {
+	for _, level := range []Level{LevelInfo, LevelError, LevelFatal} {
+		if strings.EqualFold(name, level.String()) {
+			return level, nil
+		}
+	}
+
+	if strings.EqualFold(name, "off") {
+		return LevelOff, nil
+	}
+
+	return LevelInfo, fmt.Errorf("unknown log level %q", name)
+}
+
 // Logger is the custom logger. It holds the output destination that the log entries will be
 // written to, the minimum severity level that log entries will be written for, and a mutex
 // for coordination the writes.
@@ -53,6 +70,15 @@ func NewLogger(out io.Writer, minLevel Level) *Logger {
 	}
 }
 
+// SetLevel changes the minimum severity level that log entries will be written for. It is safe
+// to call while other goroutines are writing log entries.
+func (l *Logger) SetLevel(minLevel Level) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.minLevel = minLevel
+}
+
 // PrintInfo is a helper that writes Info level log entries.
 func (l *Logger) PrintInfo(message string, properties map[string]string) {
 	l.print(LevelInfo, message, properties)
@@ -72,8 +98,13 @@ func (l *Logger) PrintFatal(err error, properties map[string]string) {
 // print is an internal method for writing a log entry.
 func (l *Logger) print(level Level, message string, properties map[string]string) (int, error) {
 	// If the severity level of the log entry is below the minimum severity for the logger
-	// then return with no further action
-	if level < l.minLevel {
+	// then return with no further action. We hold the mutex while reading the minimum level,
+	// because it can be changed at runtime with SetLevel().
+	l.mu.Lock()
+	minLevel := l.minLevel
+	l.mu.Unlock()
+
+	if level < minLevel {
 		return 0, nil
 	}
 
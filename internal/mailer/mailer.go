@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"embed"
 	"html/template"
+	"io"
 	"time"
 
 	"github.com/go-mail/mail/v2"
@@ -16,35 +17,54 @@ import (
 //go:embed "templates"
 var templateFS embed.FS
 
-// Mailer contains a mail.Dialer instance (used to connect to an SMTP server)
+// Mailer is the interface used by the application to send emails. The SMTPMailer sends them for
+// real, and the Recorder captures them in memory for tests.
+type Mailer interface {
+	Send(recipient, templateFile string, data interface{}, attachments ...Attachment) error
+}
+
+// SMTPMailer contains a mail.Dialer instance (used to connect to an SMTP server)
 // and the sender information for our emails (the name and address we want the email to be from,
 // such as "Alice Smith <alice@example.com>").
-type Mailer struct {
+type SMTPMailer struct {
 	dialer *mail.Dialer
 	sender string
 }
 
 // New initializes a new mail.Dialer instance with the given SMTP server settings and a 5-second
-// timeout whenever we send an email. It returns a Mailer instance containing the dialer and sender
-// information.
-func New(host string, port int, username, password, sender string) Mailer {
+// timeout whenever we send an email. It returns a SMTPMailer instance containing the dialer and
+// sender information.
+func New(host string, port int, username, password, sender string) SMTPMailer {
 	dialer := mail.NewDialer(host, port, username, password)
 	dialer.Timeout = 5 * time.Second
 
-	return Mailer{
+	return SMTPMailer{
 		dialer: dialer,
 		sender: sender,
 	}
 }
 
-// Send takes a recipient email address, name of a template file, and any dynamic data and
-// sends the executed template as an email.
-func (m Mailer) Send(recipient, templateFile string, data interface{}) error {
+// Attachment holds a file to be attached to an email.
+type Attachment struct {
+	Filename string
+	Data     []byte
+}
+
+// message holds the subject and bodies of an email, rendered from one of our templates.
+type message struct {
+	subject   string
+	plainBody string
+	htmlBody  string
+}
+
+// render executes the "subject", "plainBody" and "htmlBody" templates in a template file with the
+// given dynamic data.
+func render(templateFile string, data interface{}) (*message, error) {
 	// Use the ParseFS() method to parse the required template file from the embedded
 	// file system.
 	tmpl, err := template.New("email").ParseFS(templateFS, "templates/"+templateFile)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	// Execute the named template "subject", passing in the dynamic data and storing the
@@ -52,7 +72,7 @@ func (m Mailer) Send(recipient, templateFile string, data interface{}) error {
 	subject := new(bytes.Buffer)
 	err = tmpl.ExecuteTemplate(subject, "subject", data)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	// Execute the named template "plainBody" and store in the result in a plainBody
@@ -60,12 +80,27 @@ func (m Mailer) Send(recipient, templateFile string, data interface{}) error {
 	plainBody := new(bytes.Buffer)
 	err = tmpl.ExecuteTemplate(plainBody, "plainBody", data)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	// Execute the named template "htmlBody" similar to above.
 	htmlBody := new(bytes.Buffer)
 	err = tmpl.ExecuteTemplate(htmlBody, "htmlBody", data)
+	if err != nil {
+		return nil, err
+	}
+
+	return &message{
+		subject:   subject.String(),
+		plainBody: plainBody.String(),
+		htmlBody:  htmlBody.String(),
+	}, nil
+}
+
+// Send takes a recipient email address, name of a template file, and any dynamic data and
+// sends the executed template as an email, along with any attachments.
+func (m SMTPMailer) Send(recipient, templateFile string, data interface{}, attachments ...Attachment) error {
+	rendered, err := render(templateFile, data)
 	if err != nil {
 		return err
 	}
@@ -78,9 +113,19 @@ func (m Mailer) Send(recipient, templateFile string, data interface{}) error {
 	msg := mail.NewMessage()
 	msg.SetHeader("To", recipient)
 	msg.SetHeader("From", m.sender)
-	msg.SetHeader("Subject", subject.String())
-	msg.SetBody("text/plain", plainBody.String())
-	msg.AddAlternative("text/html", htmlBody.String())
+	msg.SetHeader("Subject", rendered.subject)
+	msg.SetBody("text/plain", rendered.plainBody)
+	msg.AddAlternative("text/html", rendered.htmlBody)
+
+	// Attach any files. We set a copy function which writes the data directly, rather than
+	// attaching a reader, because the message may be written more than once if we need to retry.
+	for _, attachment := range attachments {
+		data := attachment.Data
+		msg.Attach(attachment.Filename, mail.SetCopyFunc(func(w io.Writer) error {
+			_, err := w.Write(data)
+			return err
+		}))
+	}
 
 	// Try sending the email up to 3 times before aborting and returning the final error. We sleep
 	// for 500 ms between each attempt. Note, we check for send failure with `if nil == err`
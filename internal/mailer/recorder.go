@@ -0,0 +1,76 @@
+package mailer
+
+import (
+	"sync"
+)
+
+// Email is an email captured by the Recorder. It holds the inputs to Send() along with the
+// rendered subject and bodies, so that tests can assert on either.
+type Email struct {
+	Recipient   string
+	Template    string
+	Data        interface{}
+	Subject     string
+	PlainBody   string
+	HTMLBody    string
+	Attachments []Attachment
+}
+
+// Recorder is a Mailer which renders emails in the same way as the SMTPMailer, but records them
+// in memory instead of sending them. It's used in tests to check the emails sent by the
+// registration and activation flows. It's safe for concurrent use, because emails are usually
+// sent from background goroutines.
+type Recorder struct {
+	mu     sync.Mutex
+	emails []Email
+}
+
+// NewRecorder returns a new, empty Recorder.
+func NewRecorder() *Recorder {
+	return &Recorder{}
+}
+
+// Send renders the email and records it. Like the SMTPMailer, it returns an error if the
+// template can't be rendered, so tests catch broken templates.
+func (r *Recorder) Send(recipient, templateFile string, data interface{}, attachments ...Attachment) error {
+	rendered, err := render(templateFile, data)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.emails = append(r.emails, Email{
+		Recipient:   recipient,
+		Template:    templateFile,
+		Data:        data,
+		Subject:     rendered.subject,
+		PlainBody:   rendered.plainBody,
+		HTMLBody:    rendered.htmlBody,
+		Attachments: attachments,
+	})
+
+	return nil
+}
+
+// Sent returns a copy of the emails recorded so far, in the order they were sent.
+func (r *Recorder) Sent() []Email {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return append([]Email(nil), r.emails...)
+}
+
+// SentTo returns the emails recorded so far for the given recipient.
+func (r *Recorder) SentTo(recipient string) []Email {
+	var emails []Email
+
+	for _, email := range r.Sent() {
+		if email.Recipient == recipient {
+			emails = append(emails, email)
+		}
+	}
+
+	return emails
+}
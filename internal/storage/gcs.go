@@ -0,0 +1,12 @@
+package storage
+
+// gcsEndpoint is the endpoint of the Google Cloud Storage XML API, which is compatible with the
+// S3 API.
+const gcsEndpoint = "storage.googleapis.com"
+
+// NewGCS returns a Store for a Google Cloud Storage bucket. It uses the interoperable XML API,
+// so accessKey and secretKey must be an HMAC key of a service account which can read and write
+// the bucket, rather than a JSON service account key.
+func NewGCS(bucket, accessKey, secretKey string) (*S3, error) {
+	return NewS3(gcsEndpoint, "auto", bucket, accessKey, secretKey, true)
+}
@@ -0,0 +1,288 @@
+package storage
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/fs"
+	"mime"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/codeaucafe/snippetbox/greenlight/internal/clock"
+)
+
+// tmpPrefix is used to name the temporary files which objects are written to before they're
+// renamed into place, so that List can skip them.
+const tmpPrefix = ".tmp-"
+
+var (
+	// ErrSignatureInvalid is returned by Local.Verify when a signed URL has been tampered with.
+	ErrSignatureInvalid = errors.New("storage: invalid signature")
+	// ErrSignatureExpired is returned by Local.Verify when a signed URL has expired.
+	ErrSignatureExpired = errors.New("storage: signature expired")
+)
+
+// Local is a Store which keeps objects as files in a local directory, with each key used as the
+// path of the file relative to Dir. There's nowhere to record the content type of an object, so
+// it's worked out from the extension of its key instead.
+//
+// Local signed URLs point at BaseURL, with the key appended, and carry an expiry time and an
+// HMAC-SHA256 signature made with Secret. The application has to serve them itself, checking
+// them with Verify.
+type Local struct {
+	Dir     string
+	BaseURL string
+	Secret  string
+	// Clock is used for the expiry times of signed URLs and the modification times of objects.
+	Clock clock.Clock
+}
+
+// NewLocal returns a Local store which keeps its objects in dir, creating the directory if it
+// doesn't exist.
+func NewLocal(dir, baseURL, secret string) (*Local, error) {
+	err := os.MkdirAll(dir, 0o750)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Local{Dir: dir, BaseURL: strings.TrimSuffix(baseURL, "/"), Secret: secret, Clock: clock.Real{}}, nil
+}
+
+// path returns the path of the file which holds the object with the given key.
+func (l *Local) path(key string) (string, error) {
+	if !ValidKey(key) {
+		return "", ErrInvalidKey
+	}
+
+	return filepath.Join(l.Dir, filepath.FromSlash(key)), nil
+}
+
+// Put writes r to a temporary file next to the object's file, and renames it into place once
+// it's complete. The file's modification time is set from the store's clock, so that the age of
+// the object agrees with the clock used by Sweep.
+func (l *Local) Put(ctx context.Context, key string, r io.Reader, contentType string) (*Object, error) {
+	name, err := l.path(key)
+	if err != nil {
+		return nil, err
+	}
+
+	err = os.MkdirAll(filepath.Dir(name), 0o750)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(name), tmpPrefix+"*")
+	if err != nil {
+		return nil, err
+	}
+
+	// Remove the temporary file if anything goes wrong. Once it's been renamed this fails
+	// harmlessly.
+	defer func() {
+		_ = os.Remove(f.Name())
+	}()
+
+	_, err = io.Copy(f, contextReader{ctx: ctx, r: r})
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+
+	err = f.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	now := l.Clock.Now()
+
+	err = os.Chtimes(f.Name(), now, now)
+	if err != nil {
+		return nil, err
+	}
+
+	err = os.Rename(f.Name(), name)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := os.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return l.object(key, info), nil
+}
+
+// Get opens the object's file.
+func (l *Local) Get(ctx context.Context, key string) (io.ReadCloser, *Object, error) {
+	name, err := l.path(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	f, err := os.Open(name)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil, ErrNotFound
+		}
+		return nil, nil, err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return nil, nil, err
+	}
+
+	if info.IsDir() {
+		_ = f.Close()
+		return nil, nil, ErrNotFound
+	}
+
+	return f, l.object(key, info), nil
+}
+
+// Delete removes the object's file.
+func (l *Local) Delete(ctx context.Context, key string) error {
+	name, err := l.path(key)
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(name)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	return nil
+}
+
+// List walks the directory for the files whose keys start with prefix.
+func (l *Local) List(ctx context.Context, prefix string) ([]*Object, error) {
+	objects := []*Object{}
+
+	err := filepath.WalkDir(l.Dir, func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(l.Dir, name)
+		if err != nil {
+			return err
+		}
+
+		key := filepath.ToSlash(rel)
+
+		if d.IsDir() {
+			// Skip the directories which can't hold any matching keys.
+			if key != "." && !strings.HasPrefix(key+"/", prefix) && !strings.HasPrefix(prefix, key+"/") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if strings.HasPrefix(d.Name(), tmpPrefix) || !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+
+		objects = append(objects, l.object(key, info))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].Key < objects[j].Key
+	})
+
+	return objects, nil
+}
+
+// SignedURL returns BaseURL with the key appended, and the expiry time and signature in the
+// query string.
+func (l *Local) SignedURL(ctx context.Context, key string, expiry time.Duration) (string, error) {
+	if !ValidKey(key) {
+		return "", ErrInvalidKey
+	}
+
+	expires := strconv.FormatInt(l.Clock.Now().Add(expiry).Unix(), 10)
+
+	qs := url.Values{}
+	qs.Set("expires", expires)
+	qs.Set("signature", l.sign(key, expires))
+
+	return l.BaseURL + "/" + (&url.URL{Path: key}).EscapedPath() + "?" + qs.Encode(), nil
+}
+
+// Verify checks the expires and signature query string parameters of a signed URL for the
+// object with the given key. ErrSignatureInvalid is returned if the signature doesn't match, and
+// ErrSignatureExpired if the URL has expired.
+func (l *Local) Verify(key, expires, signature string) error {
+	if !hmac.Equal([]byte(signature), []byte(l.sign(key, expires))) {
+		return ErrSignatureInvalid
+	}
+
+	unix, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil {
+		return ErrSignatureInvalid
+	}
+
+	if l.Clock.Now().Unix() > unix {
+		return ErrSignatureExpired
+	}
+
+	return nil
+}
+
+// sign returns the hex-encoded HMAC-SHA256 of the key and expiry time.
+func (l *Local) sign(key, expires string) string {
+	mac := hmac.New(sha256.New, []byte(l.Secret))
+	mac.Write([]byte(key + "\n" + expires))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// object returns the Object for a file.
+func (l *Local) object(key string, info fs.FileInfo) *Object {
+	contentType := mime.TypeByExtension(path.Ext(key))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	return &Object{Key: key, Size: info.Size(), ContentType: contentType, ModTime: info.ModTime()}
+}
+
+// contextReader wraps an io.Reader so that a long copy stops once the context is done.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (cr contextReader) Read(p []byte) (int, error) {
+	if err := cr.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return cr.r.Read(p)
+}
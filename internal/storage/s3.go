@@ -0,0 +1,133 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"github.com/codeaucafe/snippetbox/greenlight/internal/clock"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// S3 is a Store which keeps objects in a bucket of Amazon S3, or of any service with an
+// S3-compatible API (such as MinIO). Objects are uploaded with multipart uploads, so their size
+// doesn't need to be known in advance, and signed URLs are S3 presigned GET URLs.
+type S3 struct {
+	client *minio.Client
+	bucket string
+	// Clock is used for the modification times of the objects returned by Put. Presigned URLs
+	// are signed with the real time, as the bucket checks them against its own clock.
+	Clock clock.Clock
+}
+
+// NewS3 returns an S3 store for the bucket at endpoint (such as "s3.amazonaws.com"), using the
+// given access key. If the access key is empty then the credentials are taken from the standard
+// AWS environment variables, or the instance's IAM role.
+func NewS3(endpoint, region, bucket, accessKey, secretKey string, secure bool) (*S3, error) {
+	creds := credentials.NewStaticV4(accessKey, secretKey, "")
+	if accessKey == "" {
+		creds = credentials.NewChainCredentials([]credentials.Provider{
+			&credentials.EnvAWS{},
+			&credentials.IAM{},
+		})
+	}
+
+	client, err := minio.New(endpoint, &minio.Options{
+		Creds:  creds,
+		Secure: secure,
+		Region: region,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &S3{client: client, bucket: bucket, Clock: clock.Real{}}, nil
+}
+
+// Put streams r to the bucket.
+func (s *S3) Put(ctx context.Context, key string, r io.Reader, contentType string) (*Object, error) {
+	if !ValidKey(key) {
+		return nil, ErrInvalidKey
+	}
+
+	info, err := s.client.PutObject(ctx, s.bucket, key, r, -1, minio.PutObjectOptions{ContentType: contentType})
+	if err != nil {
+		return nil, err
+	}
+
+	return &Object{Key: key, Size: info.Size, ContentType: contentType, ModTime: s.Clock.Now()}, nil
+}
+
+// Get fetches the object's details, and then opens it for reading.
+func (s *S3) Get(ctx context.Context, key string) (io.ReadCloser, *Object, error) {
+	if !ValidKey(key) {
+		return nil, nil, ErrInvalidKey
+	}
+
+	obj, err := s.client.GetObject(ctx, s.bucket, key, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, nil, s.error(err)
+	}
+
+	// GetObject doesn't make a request until the object is read or stat'd, so this is where
+	// a missing object shows up.
+	info, err := obj.Stat()
+	if err != nil {
+		_ = obj.Close()
+		return nil, nil, s.error(err)
+	}
+
+	return obj, objectFromInfo(info), nil
+}
+
+// Delete removes the object from the bucket.
+func (s *S3) Delete(ctx context.Context, key string) error {
+	if !ValidKey(key) {
+		return ErrInvalidKey
+	}
+
+	return s.client.RemoveObject(ctx, s.bucket, key, minio.RemoveObjectOptions{})
+}
+
+// List lists the objects in the bucket whose keys start with prefix.
+func (s *S3) List(ctx context.Context, prefix string) ([]*Object, error) {
+	objects := []*Object{}
+
+	for info := range s.client.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{Prefix: prefix, Recursive: true}) {
+		if info.Err != nil {
+			return nil, info.Err
+		}
+
+		objects = append(objects, objectFromInfo(info))
+	}
+
+	return objects, nil
+}
+
+// SignedURL returns a presigned GET URL for the object.
+func (s *S3) SignedURL(ctx context.Context, key string, expiry time.Duration) (string, error) {
+	if !ValidKey(key) {
+		return "", ErrInvalidKey
+	}
+
+	u, err := s.client.PresignedGetObject(ctx, s.bucket, key, expiry, nil)
+	if err != nil {
+		return "", err
+	}
+
+	return u.String(), nil
+}
+
+// error converts the "no such key" error response into ErrNotFound.
+func (s *S3) error(err error) error {
+	if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+		return ErrNotFound
+	}
+	return err
+}
+
+// objectFromInfo converts the details of an object returned by the S3 API into an Object.
+func objectFromInfo(info minio.ObjectInfo) *Object {
+	return &Object{Key: info.Key, Size: info.Size, ContentType: info.ContentType, ModTime: info.LastModified}
+}
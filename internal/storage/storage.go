@@ -0,0 +1,162 @@
+// Package storage provides a common interface for storing files (report artifacts, exports,
+// posters and so on) as objects, along with drivers which keep them in a local directory, in an
+// S3 bucket or in a Google Cloud Storage bucket.
+//
+// Objects are named by keys, which are slash-separated paths such as "reports/42.csv". Reads and
+// writes are streamed, so that large objects never have to be held in memory, and objects can be
+// handed to clients with signed URLs, which allow anyone holding them to download the object until
+// they expire.
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/codeaucafe/snippetbox/greenlight/internal/clock"
+)
+
+// Drivers holds the names of the storage drivers which can be passed to Open.
+var Drivers = []string{"local", "s3", "gcs"}
+
+// ErrNotFound is returned when an object doesn't exist.
+var ErrNotFound = errors.New("storage: object not found")
+
+// ErrInvalidKey is returned when a key isn't valid (see ValidKey).
+var ErrInvalidKey = errors.New("storage: invalid key")
+
+// Object describes a stored object.
+type Object struct {
+	Key         string    `json:"key"`
+	Size        int64     `json:"size"`
+	ContentType string    `json:"content_type,omitempty"`
+	ModTime     time.Time `json:"mod_time"`
+}
+
+// Store is implemented by each of the storage drivers.
+type Store interface {
+	// Put writes the contents of r to the object with the given key, replacing it if it already
+	// exists. The object only becomes visible once r has been read to the end, so a failed write
+	// never leaves a partial object behind.
+	Put(ctx context.Context, key string, r io.Reader, contentType string) (*Object, error)
+
+	// Get opens the object with the given key for reading. The caller must close the returned
+	// io.ReadCloser. ErrNotFound is returned if the object doesn't exist.
+	Get(ctx context.Context, key string) (io.ReadCloser, *Object, error)
+
+	// Delete removes the object with the given key. Deleting an object which doesn't exist isn't
+	// an error.
+	Delete(ctx context.Context, key string) error
+
+	// List returns the objects whose keys start with prefix, in key order.
+	List(ctx context.Context, prefix string) ([]*Object, error)
+
+	// SignedURL returns a URL which can be used to download the object with the given key,
+	// without any other credentials, until expiry has passed.
+	SignedURL(ctx context.Context, key string, expiry time.Duration) (string, error)
+}
+
+// Config holds the settings for Open. Dir, BaseURL and Secret are used by the local driver, and
+// the rest by the S3 and GCS drivers (for GCS, AccessKey and SecretKey are an HMAC key of a
+// service account). Clock is used by every driver, and defaults to clock.Real.
+type Config struct {
+	Driver    string
+	Dir       string
+	BaseURL   string
+	Secret    string
+	Bucket    string
+	Endpoint  string
+	Region    string
+	AccessKey string
+	SecretKey string
+	Insecure  bool
+	Clock     clock.Clock
+}
+
+// Open returns a Store for the driver named in cfg.Driver.
+func Open(cfg Config) (Store, error) {
+	c := cfg.Clock
+	if c == nil {
+		c = clock.Real{}
+	}
+
+	switch cfg.Driver {
+	case "local":
+		l, err := NewLocal(cfg.Dir, cfg.BaseURL, cfg.Secret)
+		if err != nil {
+			return nil, err
+		}
+		l.Clock = c
+		return l, nil
+	case "s3":
+		s, err := NewS3(cfg.Endpoint, cfg.Region, cfg.Bucket, cfg.AccessKey, cfg.SecretKey, !cfg.Insecure)
+		if err != nil {
+			return nil, err
+		}
+		s.Clock = c
+		return s, nil
+	case "gcs":
+		s, err := NewGCS(cfg.Bucket, cfg.AccessKey, cfg.SecretKey)
+		if err != nil {
+			return nil, err
+		}
+		s.Clock = c
+		return s, nil
+	default:
+		return nil, fmt.Errorf("storage: unknown driver %q", cfg.Driver)
+	}
+}
+
+// ValidKey reports whether key can be used to name an object. A key is a relative,
+// slash-separated path without any empty, "." or ".." elements, so that the same keys work in a
+// local directory and in a bucket.
+func ValidKey(key string) bool {
+	if key == "" || len(key) > 1024 || strings.HasPrefix(key, "/") || strings.ContainsAny(key, "\\\x00") {
+		return false
+	}
+
+	return path.Clean(key) == key && !strings.HasPrefix(key, "../") && key != ".." && key != "."
+}
+
+// Sweep implements lifecycle cleanup: it deletes the objects under prefix which are older than
+// minAge and which inUse reports are no longer referenced, such as the artifact of a report which
+// has since been deleted. The minimum age stops objects which have just been written, and whose
+// references haven't been saved yet, from being swept away. Ages are measured against the time
+// from c. It returns the number of objects deleted.
+func Sweep(ctx context.Context, store Store, c clock.Clock, prefix string, minAge time.Duration, inUse func(ctx context.Context, key string) (bool, error)) (int, error) {
+	objects, err := store.List(ctx, prefix)
+	if err != nil {
+		return 0, err
+	}
+
+	cutoff := c.Now().Add(-minAge)
+	deleted := 0
+
+	for _, object := range objects {
+		if object.ModTime.After(cutoff) {
+			continue
+		}
+
+		used, err := inUse(ctx, object.Key)
+		if err != nil {
+			return deleted, err
+		}
+
+		if used {
+			continue
+		}
+
+		err = store.Delete(ctx, object.Key)
+		if err != nil {
+			return deleted, err
+		}
+
+		deleted++
+	}
+
+	return deleted, nil
+}
@@ -0,0 +1,46 @@
+package testutil
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// Equal fails the test if got and want aren't equal.
+func Equal[T comparable](t testing.TB, got, want T) {
+	t.Helper()
+
+	if got != want {
+		t.Errorf("got: %v; want: %v", got, want)
+	}
+}
+
+// StringContains fails the test if got doesn't contain the substring want.
+func StringContains(t testing.TB, got, want string) {
+	t.Helper()
+
+	if !strings.Contains(got, want) {
+		t.Errorf("got: %q; expected to contain: %q", got, want)
+	}
+}
+
+// Status fails the test immediately if the response status code isn't want, including the
+// response body in the failure message to make it easier to see what went wrong.
+func Status(t testing.TB, got int, body []byte, want int) {
+	t.Helper()
+
+	if got != want {
+		t.Fatalf("got status: %d %s; want: %d %s\n%s", got, http.StatusText(got), want, http.StatusText(want), body)
+	}
+}
+
+// DecodeJSON decodes a JSON response body into dst, failing the test if it can't be decoded.
+func DecodeJSON(t testing.TB, body []byte, dst interface{}) {
+	t.Helper()
+
+	err := json.Unmarshal(body, dst)
+	if err != nil {
+		t.Fatalf("decoding response body: %s\n%s", err, body)
+	}
+}
@@ -0,0 +1,112 @@
+package testutil
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/codeaucafe/snippetbox/greenlight/internal/data"
+)
+
+// Password is the plaintext password given to every user created by the fixture factories.
+const Password = "pa55word1234"
+
+// sequence is used to make the emails and titles of fixture records unique.
+var sequence int64
+
+// Fixtures creates records in a test database. Each factory method fills in sensible defaults,
+// which can be overridden by passing functions that modify the record before it is inserted:
+//
+//	fx := testutil.NewFixtures(t, models)
+//	movie := fx.Movie(func(m *data.Movie) { m.Year = 1999 })
+//	user := fx.User(nil, "movies:read")
+//	token := fx.Token(user, data.ScopeAuthentication)
+type Fixtures struct {
+	t      testing.TB
+	models data.Models
+}
+
+// NewFixtures returns a new Fixtures for the given models.
+func NewFixtures(t testing.TB, models data.Models) *Fixtures {
+	return &Fixtures{t: t, models: models}
+}
+
+// Movie inserts a new movie and returns it.
+func (f *Fixtures) Movie(overrides ...func(*data.Movie)) *data.Movie {
+	f.t.Helper()
+
+	movie := &data.Movie{
+		Title:   fmt.Sprintf("Test Movie %d", next()),
+		Year:    2020,
+		Runtime: 120,
+		Genres:  []string{"drama"},
+	}
+
+	for _, override := range overrides {
+		override(movie)
+	}
+
+	err := f.models.Movies.Insert(context.Background(), movie)
+	if err != nil {
+		f.t.Fatal(err)
+	}
+
+	return movie
+}
+
+// User inserts a new activated user with the password Password, grants it the given
+// permissions, and returns it. The override function can be nil.
+func (f *Fixtures) User(override func(*data.User), permissions ...string) *data.User {
+	f.t.Helper()
+
+	n := next()
+
+	user := &data.User{
+		Name:      fmt.Sprintf("Test User %d", n),
+		Email:     fmt.Sprintf("user%d@example.com", n),
+		Activated: true,
+	}
+
+	err := user.Password.Set(Password)
+	if err != nil {
+		f.t.Fatal(err)
+	}
+
+	if override != nil {
+		override(user)
+	}
+
+	err = f.models.Users.Insert(context.Background(), user)
+	if err != nil {
+		f.t.Fatal(err)
+	}
+
+	if len(permissions) > 0 {
+		err = f.models.Permissions.AddForUser(context.Background(), user.ID, permissions...)
+		if err != nil {
+			f.t.Fatal(err)
+		}
+	}
+
+	return user
+}
+
+// Token inserts a new token with the given scope for a user, valid for a day, and returns it.
+// The token's Plaintext field holds the value to send to the API.
+func (f *Fixtures) Token(user *data.User, scope string) *data.Token {
+	f.t.Helper()
+
+	token, err := f.models.Tokens.New(context.Background(), user.ID, 24*time.Hour, scope)
+	if err != nil {
+		f.t.Fatal(err)
+	}
+
+	return token
+}
+
+// next returns the next number in the fixture sequence.
+func next() int64 {
+	return atomic.AddInt64(&sequence, 1)
+}
@@ -0,0 +1,61 @@
+package testutil
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// RedisURLEnv is the name of the environment variable holding the URL of the Redis server used
+// for Redis tests. For example, to run the tests against a server in Docker:
+//
+//	$ docker run -d -p 6380:6379 redis:7
+//	$ export GREENLIGHT_TEST_REDIS_URL='redis://localhost:6380/0'
+//	$ go test ./...
+//
+// Tests share the server, so they should use keys of their own, such as with RandomKey.
+const RedisURLEnv = "GREENLIGHT_TEST_REDIS_URL"
+
+// NewRedis returns a client for the test Redis server, which is closed when the test finishes. If
+// the GREENLIGHT_TEST_REDIS_URL environment variable isn't set then the test is skipped, so that
+// `go test ./...` still works without a Redis server.
+func NewRedis(t testing.TB) *redis.Client {
+	t.Helper()
+
+	url := os.Getenv(RedisURLEnv)
+	if url == "" {
+		t.Skipf("%s not set, skipping redis test", RedisURLEnv)
+	}
+
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := redis.NewClient(opts)
+
+	t.Cleanup(func() {
+		_ = client.Close()
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	err = client.Ping(ctx).Err()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return client
+}
+
+// RandomKey returns a random key with the given prefix, so that tests sharing a Redis server
+// don't see each other's keys.
+func RandomKey(t testing.TB, prefix string) string {
+	t.Helper()
+
+	return prefix + randomHex(t, 8)
+}
@@ -0,0 +1,123 @@
+// Package webhook defines how webhook requests are signed, so that the application which sends them
+// and the receivers which check them share the same scheme, and which addresses they may be sent to.
+package webhook
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// The headers sent with each webhook request. The delivery ID is the same for every attempt at a
+// delivery, so receivers can use it to ignore repeats. The timestamp is in Unix seconds, and the
+// signature is the hex-encoded HMAC-SHA256 of the timestamp and the body, separated by a newline,
+// with the webhook's secret (see Sign).
+const (
+	EventHeader     = "Greenlight-Event"
+	DeliveryHeader  = "Greenlight-Delivery"
+	TimestampHeader = "Greenlight-Timestamp"
+	SignatureHeader = "Greenlight-Signature"
+)
+
+// DefaultTolerance is how far the timestamp of a webhook request can be from the receiver's clock
+// before VerifySignature rejects it, which limits how long a captured request can be replayed for.
+const DefaultTolerance = 5 * time.Minute
+
+var (
+	// ErrInvalidSignature is returned by VerifySignature when a request isn't signed with the secret.
+	ErrInvalidSignature = errors.New("webhook: invalid signature")
+	// ErrStaleTimestamp is returned by VerifySignature when a request's timestamp is missing or too
+	// far from the current time.
+	ErrStaleTimestamp = errors.New("webhook: timestamp outside of the tolerance")
+)
+
+// Sign returns the signature of a webhook request with the given timestamp and body.
+func Sign(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("\n"))
+	mac.Write(body)
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifySignature checks that a webhook request with the given headers and body was signed with
+// the secret, and that its timestamp is within tolerance of now. The signatures are compared in
+// constant time. Receivers should read the whole body before calling it, and check the delivery
+// ID themselves if they need to ignore repeated deliveries.
+func VerifySignature(secret string, header http.Header, body []byte, now time.Time, tolerance time.Duration) error {
+	timestamp := header.Get(TimestampHeader)
+
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return ErrStaleTimestamp
+	}
+
+	skew := now.Sub(time.Unix(seconds, 0))
+	if skew > tolerance || skew < -tolerance {
+		return ErrStaleTimestamp
+	}
+
+	want := Sign(secret, timestamp, body)
+	if !hmac.Equal([]byte(header.Get(SignatureHeader)), []byte(want)) {
+		return ErrInvalidSignature
+	}
+
+	return nil
+}
+
+// ErrPrivateAddress is returned when a webhook request would be sent to an address which isn't
+// public (see PublicIP).
+var ErrPrivateAddress = errors.New("webhook: refusing to connect to a private address")
+
+// sharedAddressSpace is the carrier-grade NAT range (RFC 6598), which isn't covered by
+// net.IP.IsPrivate.
+var sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// PublicIP reports whether ip is a public unicast address. Loopback, private, carrier-grade NAT,
+// link-local (which includes the cloud metadata endpoints), multicast and unspecified addresses
+// aren't, so that a webhook can't be used to reach the services on the application's own network.
+func PublicIP(ip net.IP) bool {
+	return ip != nil && ip.IsGlobalUnicast() && !ip.IsPrivate() && !sharedAddressSpace.Contains(ip)
+}
+
+// InternalHost reports whether host is a name which only resolves inside a private network, such
+// as localhost, or a name under the .localhost, .local or .internal domains.
+func InternalHost(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+
+	if host == "localhost" || !strings.Contains(host, ".") {
+		return true
+	}
+
+	for _, suffix := range []string{".localhost", ".local", ".internal"} {
+		if strings.HasSuffix(host, suffix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// CheckDial is a net.Dialer Control function which refuses to connect to an address which isn't
+// public. As it's run on the resolved address, it also stops hostnames which resolve to private
+// addresses, including those which only do so after the webhook has been validated.
+func CheckDial(_, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+
+	if !PublicIP(net.ParseIP(host)) {
+		return ErrPrivateAddress
+	}
+
+	return nil
+}
@@ -0,0 +1,3 @@
+DELETE FROM permissions WHERE code = 'settings:admin';
+
+DROP TABLE IF EXISTS runtime_settings;
@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS runtime_settings
+(
+	id         INTEGER PRIMARY KEY CHECK (id = 1),
+	settings   JSONB                       NOT NULL,
+	updated_at TIMESTAMP(0) WITH TIME ZONE NOT NULL DEFAULT NOW(),
+	updated_by BIGINT REFERENCES users ON DELETE SET NULL,
+	version    INTEGER                     NOT NULL DEFAULT 1
+);
+
+INSERT INTO permissions (code)
+VALUES ('settings:admin');
@@ -0,0 +1,8 @@
+CREATE TABLE IF NOT EXISTS request_quotas
+(
+	user_id      BIGINT  NOT NULL REFERENCES users ON DELETE CASCADE,
+	period       TEXT    NOT NULL,
+	period_start DATE    NOT NULL,
+	count        BIGINT  NOT NULL DEFAULT 0,
+	PRIMARY KEY (user_id, period, period_start)
+);
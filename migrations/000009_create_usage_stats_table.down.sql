@@ -0,0 +1,3 @@
+DELETE FROM permissions WHERE code = 'usage:admin';
+
+DROP TABLE IF EXISTS usage_stats;
@@ -0,0 +1,16 @@
+-- Note that user_id is 0 for anonymous requests, so there is no foreign key on it.
+CREATE TABLE IF NOT EXISTS usage_stats
+(
+	day       DATE   NOT NULL,
+	user_id   BIGINT NOT NULL,
+	endpoint  TEXT   NOT NULL,
+	requests  BIGINT NOT NULL DEFAULT 0,
+	bytes_in  BIGINT NOT NULL DEFAULT 0,
+	bytes_out BIGINT NOT NULL DEFAULT 0,
+	PRIMARY KEY (day, user_id, endpoint)
+);
+
+CREATE INDEX IF NOT EXISTS usage_stats_user_id_idx ON usage_stats (user_id);
+
+INSERT INTO permissions (code)
+VALUES ('usage:admin');
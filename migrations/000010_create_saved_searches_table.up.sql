@@ -0,0 +1,15 @@
+-- last_movie_id records the highest movie ID which has already been checked against the search,
+-- so that notifications are only sent for movies added since then.
+CREATE TABLE IF NOT EXISTS saved_searches
+(
+	id            BIGSERIAL PRIMARY KEY,
+	created_at    TIMESTAMP(0) WITH TIME ZONE NOT NULL DEFAULT NOW(),
+	user_id       BIGINT  NOT NULL REFERENCES users ON DELETE CASCADE,
+	name          TEXT    NOT NULL,
+	filter        JSONB   NOT NULL,
+	notify        BOOLEAN NOT NULL DEFAULT false,
+	last_movie_id BIGINT  NOT NULL DEFAULT 0,
+	version       INTEGER NOT NULL DEFAULT 1
+);
+
+CREATE INDEX IF NOT EXISTS saved_searches_user_id_idx ON saved_searches (user_id);
@@ -0,0 +1,18 @@
+CREATE TABLE IF NOT EXISTS scheduled_exports
+(
+	id            BIGSERIAL PRIMARY KEY,
+	created_at    TIMESTAMP(0) WITH TIME ZONE NOT NULL DEFAULT NOW(),
+	user_id       BIGINT  NOT NULL REFERENCES users ON DELETE CASCADE,
+	name          TEXT    NOT NULL,
+	filter        JSONB   NOT NULL,
+	format        TEXT    NOT NULL,
+	frequency     TEXT    NOT NULL,
+	new_only      BOOLEAN NOT NULL DEFAULT true,
+	last_movie_id BIGINT  NOT NULL DEFAULT 0,
+	next_run_at   TIMESTAMP(0) WITH TIME ZONE NOT NULL,
+	last_run_at   TIMESTAMP(0) WITH TIME ZONE,
+	version       INTEGER NOT NULL DEFAULT 1
+);
+
+CREATE INDEX IF NOT EXISTS scheduled_exports_user_id_idx ON scheduled_exports (user_id);
+CREATE INDEX IF NOT EXISTS scheduled_exports_next_run_at_idx ON scheduled_exports (next_run_at);
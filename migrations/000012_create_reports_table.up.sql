@@ -0,0 +1,19 @@
+-- The rendered report is stored in the artifact column once the report has completed.
+CREATE TABLE IF NOT EXISTS reports
+(
+	id           BIGSERIAL PRIMARY KEY,
+	created_at   TIMESTAMP(0) WITH TIME ZONE NOT NULL DEFAULT NOW(),
+	updated_at   TIMESTAMP(0) WITH TIME ZONE NOT NULL DEFAULT NOW(),
+	completed_at TIMESTAMP(0) WITH TIME ZONE,
+	user_id      BIGINT  NOT NULL REFERENCES users ON DELETE CASCADE,
+	type         TEXT    NOT NULL,
+	format       TEXT    NOT NULL,
+	params       JSONB   NOT NULL DEFAULT '{}',
+	status       TEXT    NOT NULL DEFAULT 'queued',
+	progress     INTEGER NOT NULL DEFAULT 0,
+	error        TEXT    NOT NULL DEFAULT '',
+	artifact     BYTEA
+);
+
+CREATE INDEX IF NOT EXISTS reports_user_id_idx ON reports (user_id);
+CREATE INDEX IF NOT EXISTS reports_status_idx ON reports (status);
@@ -0,0 +1,5 @@
+DELETE FROM permissions WHERE code = 'stats:admin';
+
+DROP MATERIALIZED VIEW IF EXISTS trending_movies;
+DROP MATERIALIZED VIEW IF EXISTS movie_genre_stats;
+DROP TABLE IF EXISTS movie_views;
@@ -0,0 +1,31 @@
+CREATE TABLE IF NOT EXISTS movie_views
+(
+	movie_id BIGINT NOT NULL REFERENCES movies ON DELETE CASCADE,
+	day      DATE   NOT NULL,
+	views    BIGINT NOT NULL DEFAULT 0,
+	PRIMARY KEY (movie_id, day)
+);
+
+CREATE MATERIALIZED VIEW IF NOT EXISTS movie_genre_stats AS
+SELECT genre, count(*) AS movies, AVG(runtime)::float8 AS average_runtime, MIN(year) AS earliest_year,
+	MAX(year) AS latest_year
+FROM movies, unnest(genres) AS genre
+GROUP BY genre;
+
+-- A unique index is needed for the view to be refreshed with REFRESH MATERIALIZED VIEW
+-- CONCURRENTLY, which doesn't block reads while it runs.
+CREATE UNIQUE INDEX IF NOT EXISTS movie_genre_stats_genre_idx ON movie_genre_stats (genre);
+
+CREATE MATERIALIZED VIEW IF NOT EXISTS trending_movies AS
+SELECT m.id, m.title, m.year, SUM(v.views)::bigint AS views
+FROM movie_views v
+INNER JOIN movies m ON m.id = v.movie_id
+WHERE v.day >= CURRENT_DATE - 7
+GROUP BY m.id, m.title, m.year
+ORDER BY views DESC
+LIMIT 100;
+
+CREATE UNIQUE INDEX IF NOT EXISTS trending_movies_id_idx ON trending_movies (id);
+
+INSERT INTO permissions (code)
+VALUES ('stats:admin');
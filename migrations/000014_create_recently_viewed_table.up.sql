@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS recently_viewed
+(
+	user_id   BIGINT NOT NULL REFERENCES users ON DELETE CASCADE,
+	movie_id  BIGINT NOT NULL REFERENCES movies ON DELETE CASCADE,
+	viewed_at TIMESTAMP(0) WITH TIME ZONE NOT NULL,
+	PRIMARY KEY (user_id, movie_id)
+);
+
+CREATE INDEX IF NOT EXISTS recently_viewed_user_id_viewed_at_idx ON recently_viewed (user_id, viewed_at DESC);
@@ -0,0 +1,16 @@
+-- The outbox holds messages (such as emails) which are written in the same transaction as the
+-- change that causes them, and delivered afterwards by the outbox workers. Messages are deleted
+-- once they've been delivered, and marked as failed after too many attempts.
+CREATE TABLE IF NOT EXISTS outbox
+(
+	id              BIGSERIAL PRIMARY KEY,
+	created_at      TIMESTAMP(0) WITH TIME ZONE NOT NULL DEFAULT NOW(),
+	kind            TEXT    NOT NULL,
+	payload         JSONB   NOT NULL,
+	attempts        INTEGER NOT NULL DEFAULT 0,
+	next_attempt_at TIMESTAMP(0) WITH TIME ZONE NOT NULL DEFAULT NOW(),
+	last_error      TEXT    NOT NULL DEFAULT '',
+	failed_at       TIMESTAMP(0) WITH TIME ZONE
+);
+
+CREATE INDEX IF NOT EXISTS outbox_next_attempt_at_idx ON outbox (next_attempt_at) WHERE failed_at IS NULL;
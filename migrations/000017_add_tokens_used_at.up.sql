@@ -0,0 +1,2 @@
+ALTER TABLE tokens
+	ADD COLUMN IF NOT EXISTS used_at TIMESTAMP(0) WITH TIME ZONE;
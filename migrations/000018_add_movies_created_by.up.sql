@@ -0,0 +1,5 @@
+ALTER TABLE movies
+	ADD COLUMN IF NOT EXISTS created_by BIGINT REFERENCES users ON DELETE SET NULL,
+	ADD COLUMN IF NOT EXISTS updated_by BIGINT REFERENCES users ON DELETE SET NULL;
+
+CREATE INDEX IF NOT EXISTS movies_created_by_idx ON movies (created_by);
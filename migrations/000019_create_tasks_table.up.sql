@@ -0,0 +1,28 @@
+-- Tasks track the long-running operations (such as generating a report) which are queued by an
+-- endpoint and run in the background by the task workers. The result_url column holds the
+-- location of the results once the task has completed.
+CREATE TABLE IF NOT EXISTS tasks
+(
+	id           BIGSERIAL PRIMARY KEY,
+	created_at   TIMESTAMP(0) WITH TIME ZONE NOT NULL DEFAULT NOW(),
+	updated_at   TIMESTAMP(0) WITH TIME ZONE NOT NULL DEFAULT NOW(),
+	completed_at TIMESTAMP(0) WITH TIME ZONE,
+	user_id      BIGINT  NOT NULL REFERENCES users ON DELETE CASCADE,
+	kind         TEXT    NOT NULL,
+	params       JSONB   NOT NULL DEFAULT '{}',
+	status       TEXT    NOT NULL DEFAULT 'queued',
+	progress     INTEGER NOT NULL DEFAULT 0,
+	error        TEXT    NOT NULL DEFAULT '',
+	result_url   TEXT    NOT NULL DEFAULT ''
+);
+
+CREATE INDEX IF NOT EXISTS tasks_user_id_idx ON tasks (user_id);
+CREATE INDEX IF NOT EXISTS tasks_status_idx ON tasks (status);
+
+-- Reports used to be queued in the reports table itself, and picked up from there by the report
+-- workers. Queue a task for each report which hadn't been generated yet, so that the task workers
+-- pick them up instead of leaving them queued forever.
+INSERT INTO tasks (created_at, updated_at, user_id, kind, params)
+SELECT created_at, updated_at, user_id, 'report', jsonb_build_object('report_id', id::text)
+FROM reports
+WHERE status IN ('queued', 'running');
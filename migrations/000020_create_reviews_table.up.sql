@@ -0,0 +1,17 @@
+-- Each user can review a movie once, so the unique constraint on (movie_id, user_id) also serves
+-- as the index for looking up a movie's reviews.
+CREATE TABLE IF NOT EXISTS reviews
+(
+	id         BIGSERIAL PRIMARY KEY,
+	created_at TIMESTAMP(0) WITH TIME ZONE NOT NULL DEFAULT NOW(),
+	updated_at TIMESTAMP(0) WITH TIME ZONE NOT NULL DEFAULT NOW(),
+	movie_id   BIGINT  NOT NULL REFERENCES movies ON DELETE CASCADE,
+	user_id    BIGINT  NOT NULL REFERENCES users ON DELETE CASCADE,
+	rating     INTEGER NOT NULL,
+	body       TEXT    NOT NULL DEFAULT '',
+	version    INTEGER NOT NULL DEFAULT 1,
+	CONSTRAINT reviews_rating_check CHECK (rating BETWEEN 1 AND 10),
+	CONSTRAINT reviews_movie_id_user_id_key UNIQUE (movie_id, user_id)
+);
+
+CREATE INDEX IF NOT EXISTS reviews_user_id_idx ON reviews (user_id);
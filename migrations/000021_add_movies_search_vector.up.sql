@@ -0,0 +1,10 @@
+-- search_vector holds the full-text search document for each movie, so that it's computed once
+-- when the movie is written rather than on every search. It replaces the expression index on the
+-- title from 000003_add_movies_indexes.
+ALTER TABLE movies
+	ADD COLUMN IF NOT EXISTS search_vector tsvector
+		GENERATED ALWAYS AS (to_tsvector('simple', title)) STORED;
+
+CREATE INDEX IF NOT EXISTS movies_search_vector_idx ON movies USING GIN (search_vector);
+
+DROP INDEX IF EXISTS movies_title_idx;
@@ -0,0 +1,9 @@
+-- email_rate_limits holds a token bucket for each email address that the application sends
+-- emails to on request (such as activation emails), so that a victim's address can't be
+-- mail-bombed from many client IP addresses.
+CREATE TABLE IF NOT EXISTS email_rate_limits
+(
+	email      CITEXT PRIMARY KEY,
+	tokens     DOUBLE PRECISION            NOT NULL,
+	updated_at TIMESTAMP(0) WITH TIME ZONE NOT NULL
+);
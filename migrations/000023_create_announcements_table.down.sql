@@ -0,0 +1,4 @@
+DELETE FROM permissions WHERE code = 'announcements:admin';
+
+DROP TABLE IF EXISTS announcement_subscriptions;
+DROP TABLE IF EXISTS announcements;
@@ -0,0 +1,26 @@
+-- Announcements are shown between starts_at and ends_at, or indefinitely from starts_at if
+-- ends_at is NULL.
+CREATE TABLE IF NOT EXISTS announcements
+(
+	id         BIGSERIAL PRIMARY KEY,
+	created_at TIMESTAMP(0) WITH TIME ZONE NOT NULL DEFAULT NOW(),
+	created_by BIGINT REFERENCES users ON DELETE SET NULL,
+	title      TEXT NOT NULL,
+	body       TEXT NOT NULL,
+	severity   TEXT NOT NULL,
+	starts_at  TIMESTAMP(0) WITH TIME ZONE NOT NULL,
+	ends_at    TIMESTAMP(0) WITH TIME ZONE,
+	CONSTRAINT announcements_window_check CHECK (ends_at IS NULL OR ends_at > starts_at)
+);
+
+CREATE INDEX IF NOT EXISTS announcements_starts_at_idx ON announcements (starts_at);
+
+-- The users who have opted in to receiving announcements by email.
+CREATE TABLE IF NOT EXISTS announcement_subscriptions
+(
+	user_id    BIGINT PRIMARY KEY REFERENCES users ON DELETE CASCADE,
+	created_at TIMESTAMP(0) WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+
+INSERT INTO permissions (code)
+VALUES ('announcements:admin');
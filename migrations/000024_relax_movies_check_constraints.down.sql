@@ -0,0 +1,13 @@
+ALTER TABLE movies
+	DROP CONSTRAINT IF EXISTS movies_year_check;
+
+ALTER TABLE movies
+	ADD CONSTRAINT
+		movies_year_check CHECK (year BETWEEN 1888 AND DATE_PART('year', NOW()));
+
+ALTER TABLE movies
+	DROP CONSTRAINT IF EXISTS genres_length_check;
+
+ALTER TABLE movies
+	ADD CONSTRAINT
+		genres_length_check CHECK (ARRAY_LENGTH(genres, 1) BETWEEN 1 AND 5);
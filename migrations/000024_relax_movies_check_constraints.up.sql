@@ -0,0 +1,15 @@
+-- The earliest release year and the maximum number of genres are configured per deployment and
+-- checked by the application, so the database only enforces the limits which always apply.
+ALTER TABLE movies
+	DROP CONSTRAINT IF EXISTS movies_year_check;
+
+ALTER TABLE movies
+	ADD CONSTRAINT
+		movies_year_check CHECK (year BETWEEN 1 AND DATE_PART('year', NOW()));
+
+ALTER TABLE movies
+	DROP CONSTRAINT IF EXISTS genres_length_check;
+
+ALTER TABLE movies
+	ADD CONSTRAINT
+		genres_length_check CHECK (ARRAY_LENGTH(genres, 1) >= 1);
@@ -0,0 +1,3 @@
+DELETE FROM permissions WHERE code = 'duplicates:admin';
+
+DROP TABLE IF EXISTS duplicate_candidates;
@@ -0,0 +1,21 @@
+-- Duplicate candidates are pairs of movies which the duplicate scan found to be probable
+-- duplicates of each other, waiting for an admin to review them. The lower ID is always stored
+-- in movie_id, so that each pair is only stored once, and reviewed pairs are kept so that the
+-- next scan doesn't add them to the queue again.
+CREATE TABLE IF NOT EXISTS duplicate_candidates
+(
+	id                 BIGSERIAL PRIMARY KEY,
+	created_at         TIMESTAMP(0) WITH TIME ZONE NOT NULL DEFAULT NOW(),
+	updated_at         TIMESTAMP(0) WITH TIME ZONE NOT NULL DEFAULT NOW(),
+	movie_id           BIGINT  NOT NULL REFERENCES movies ON DELETE CASCADE,
+	duplicate_id       BIGINT  NOT NULL REFERENCES movies ON DELETE CASCADE,
+	runtime_difference INTEGER NOT NULL,
+	status             TEXT    NOT NULL DEFAULT 'pending',
+	CONSTRAINT duplicate_candidates_order_check CHECK (movie_id < duplicate_id),
+	CONSTRAINT duplicate_candidates_pair_key UNIQUE (movie_id, duplicate_id)
+);
+
+CREATE INDEX IF NOT EXISTS duplicate_candidates_status_idx ON duplicate_candidates (status);
+
+INSERT INTO permissions (code)
+VALUES ('duplicates:admin');
@@ -0,0 +1,10 @@
+DELETE FROM permissions WHERE code = 'reviews:moderate';
+
+DROP INDEX IF EXISTS reviews_pending_idx;
+
+ALTER TABLE reviews
+	DROP CONSTRAINT IF EXISTS reviews_status_check,
+	DROP COLUMN IF EXISTS moderated_at,
+	DROP COLUMN IF EXISTS moderated_by,
+	DROP COLUMN IF EXISTS moderation_note,
+	DROP COLUMN IF EXISTS status;
@@ -0,0 +1,18 @@
+-- Reviews are moderated: only approved reviews are shown and count towards a movie's average
+-- rating. The existing reviews were all published, so they're approved, but new reviews start
+-- out pending unless the application approves them straight away.
+ALTER TABLE reviews
+	ADD COLUMN IF NOT EXISTS status          TEXT NOT NULL DEFAULT 'approved',
+	ADD COLUMN IF NOT EXISTS moderation_note TEXT NOT NULL DEFAULT '',
+	ADD COLUMN IF NOT EXISTS moderated_by    BIGINT REFERENCES users ON DELETE SET NULL,
+	ADD COLUMN IF NOT EXISTS moderated_at    TIMESTAMP(0) WITH TIME ZONE;
+
+ALTER TABLE reviews
+	ALTER COLUMN status SET DEFAULT 'pending',
+	ADD CONSTRAINT reviews_status_check CHECK (status IN ('pending', 'approved', 'rejected'));
+
+-- The moderation queue only ever looks at the pending reviews.
+CREATE INDEX IF NOT EXISTS reviews_pending_idx ON reviews (created_at) WHERE status = 'pending';
+
+INSERT INTO permissions (code)
+VALUES ('reviews:moderate');
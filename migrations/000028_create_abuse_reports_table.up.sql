@@ -0,0 +1,23 @@
+-- Users can report a review which breaks the rules. Each user can report a review once, and the
+-- report stays open until a moderator resolves or dismisses it.
+CREATE TABLE IF NOT EXISTS abuse_reports
+(
+	id              BIGSERIAL PRIMARY KEY,
+	created_at      TIMESTAMP(0) WITH TIME ZONE NOT NULL DEFAULT NOW(),
+	updated_at      TIMESTAMP(0) WITH TIME ZONE NOT NULL DEFAULT NOW(),
+	review_id       BIGINT NOT NULL REFERENCES reviews ON DELETE CASCADE,
+	user_id         BIGINT NOT NULL REFERENCES users ON DELETE CASCADE,
+	reason          TEXT   NOT NULL,
+	details         TEXT   NOT NULL DEFAULT '',
+	status          TEXT   NOT NULL DEFAULT 'open',
+	resolution_note TEXT   NOT NULL DEFAULT '',
+	resolved_by     BIGINT REFERENCES users ON DELETE SET NULL,
+	resolved_at     TIMESTAMP(0) WITH TIME ZONE,
+	CONSTRAINT abuse_reports_status_check CHECK (status IN ('open', 'resolved', 'dismissed')),
+	CONSTRAINT abuse_reports_review_id_user_id_key UNIQUE (review_id, user_id)
+);
+
+CREATE INDEX IF NOT EXISTS abuse_reports_user_id_idx ON abuse_reports (user_id);
+
+-- The report queue only ever looks at the open reports.
+CREATE INDEX IF NOT EXISTS abuse_reports_open_idx ON abuse_reports (created_at) WHERE status = 'open';
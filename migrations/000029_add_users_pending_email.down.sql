@@ -0,0 +1,4 @@
+DELETE FROM tokens WHERE scope = 'email-change';
+
+ALTER TABLE users
+	DROP COLUMN IF EXISTS pending_email;
@@ -0,0 +1,5 @@
+-- A user's new email address is held in pending_email until they confirm it with the token
+-- which was sent to it. The address is checked against the other users' when the change is staged,
+-- and again when it's confirmed, so it isn't unique.
+ALTER TABLE users
+	ADD COLUMN IF NOT EXISTS pending_email CITEXT;
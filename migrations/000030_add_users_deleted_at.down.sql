@@ -0,0 +1,6 @@
+DELETE FROM tokens WHERE scope = 'account-restore';
+
+DROP INDEX IF EXISTS users_deleted_at_idx;
+
+ALTER TABLE users
+	DROP COLUMN IF EXISTS deleted_at;
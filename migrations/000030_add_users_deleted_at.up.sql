@@ -0,0 +1,7 @@
+-- Users who delete their account are soft-deleted: deleted_at is set, and the account is purged
+-- once the grace period has passed, unless they restore it first. The index is only used to find
+-- the accounts to purge.
+ALTER TABLE users
+	ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMP(0) WITH TIME ZONE;
+
+CREATE INDEX IF NOT EXISTS users_deleted_at_idx ON users (deleted_at) WHERE deleted_at IS NOT NULL;
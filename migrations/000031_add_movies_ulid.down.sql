@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS movies_ulid_idx;
+
+ALTER TABLE movies
+	DROP COLUMN IF EXISTS ulid;
@@ -0,0 +1,7 @@
+-- ULIDs are the public identifiers of movies. The column is nullable because existing movies are
+-- given their ULIDs by a background job after the migration has run, rather than by the migration
+-- itself, so that a large table isn't locked while they're generated.
+ALTER TABLE movies
+	ADD COLUMN IF NOT EXISTS ulid TEXT;
+
+CREATE UNIQUE INDEX IF NOT EXISTS movies_ulid_idx ON movies (ulid);
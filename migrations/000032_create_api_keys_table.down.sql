@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS api_key_nonces;
+
+DROP TABLE IF EXISTS api_keys;
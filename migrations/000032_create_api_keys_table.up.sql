@@ -0,0 +1,25 @@
+-- API keys let machine clients sign their requests instead of sending a bearer token. Unlike
+-- tokens, the secret is stored as it is, rather than hashed, because the server needs it to
+-- check each request's HMAC signature.
+CREATE TABLE IF NOT EXISTS api_keys
+(
+	id           BIGSERIAL PRIMARY KEY,
+	created_at   TIMESTAMP(0) WITH TIME ZONE NOT NULL DEFAULT NOW(),
+	user_id      BIGINT NOT NULL REFERENCES users ON DELETE CASCADE,
+	name         TEXT   NOT NULL,
+	key_id       TEXT   NOT NULL UNIQUE,
+	secret       TEXT   NOT NULL,
+	last_used_at TIMESTAMP(0) WITH TIME ZONE
+);
+
+CREATE INDEX IF NOT EXISTS api_keys_user_id_idx ON api_keys (user_id);
+
+-- The nonces of recent signed requests, which are kept until the requests' timestamps are too
+-- old to be accepted anyway, so that each signed request can only be used once.
+CREATE TABLE IF NOT EXISTS api_key_nonces
+(
+	api_key_id BIGINT NOT NULL REFERENCES api_keys ON DELETE CASCADE,
+	nonce      TEXT   NOT NULL,
+	expires_at TIMESTAMP(0) WITH TIME ZONE NOT NULL,
+	PRIMARY KEY (api_key_id, nonce)
+);
@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS reports_artifact_key_idx;
+
+ALTER TABLE reports DROP COLUMN IF EXISTS artifact_key;
@@ -0,0 +1,5 @@
+-- Rendered reports are kept in object storage, and artifact_key holds the key of the object.
+-- Reports completed before then still have their rendered report in the artifact column.
+ALTER TABLE reports ADD COLUMN IF NOT EXISTS artifact_key TEXT NOT NULL DEFAULT '';
+
+CREATE INDEX IF NOT EXISTS reports_artifact_key_idx ON reports (artifact_key) WHERE artifact_key <> '';
@@ -0,0 +1,12 @@
+-- The events table is the log of domain events, such as a movie being created, which is written
+-- in the same transaction as the change it describes. Events are written one transaction at a
+-- time (see insertEvent), so their IDs are in commit order and consumers can page through them
+-- by ID without ever missing one.
+CREATE TABLE IF NOT EXISTS events
+(
+	id          BIGSERIAL PRIMARY KEY,
+	created_at  TIMESTAMP(0) WITH TIME ZONE NOT NULL DEFAULT NOW(),
+	type        TEXT   NOT NULL,
+	resource_id BIGINT NOT NULL,
+	data        JSONB  NOT NULL DEFAULT '{}'
+);
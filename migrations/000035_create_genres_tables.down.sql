@@ -0,0 +1,33 @@
+ALTER TABLE movies
+	ADD COLUMN IF NOT EXISTS genres TEXT[] NOT NULL DEFAULT '{}';
+
+UPDATE movies m
+SET genres = ARRAY(
+	SELECT g.name::text
+	FROM movie_genres mg
+	INNER JOIN genres g ON g.id = mg.genre_id
+	WHERE mg.movie_id = m.id
+	ORDER BY mg.position);
+
+ALTER TABLE movies
+	ALTER COLUMN genres DROP DEFAULT;
+
+ALTER TABLE movies
+	ADD CONSTRAINT
+		genres_length_check CHECK (ARRAY_LENGTH(genres, 1) >= 1);
+
+CREATE INDEX IF NOT EXISTS movies_genres_idx
+	ON movies USING GIN (genres);
+
+DROP MATERIALIZED VIEW IF EXISTS movie_genre_stats;
+
+CREATE MATERIALIZED VIEW IF NOT EXISTS movie_genre_stats AS
+SELECT genre, count(*) AS movies, AVG(runtime)::float8 AS average_runtime, MIN(year) AS earliest_year,
+	MAX(year) AS latest_year
+FROM movies, unnest(genres) AS genre
+GROUP BY genre;
+
+CREATE UNIQUE INDEX IF NOT EXISTS movie_genre_stats_genre_idx ON movie_genre_stats (genre);
+
+DROP TABLE IF EXISTS movie_genres;
+DROP TABLE IF EXISTS genres;
@@ -0,0 +1,60 @@
+-- Genres used to be a TEXT[] column on each movie, so the same genre could be spelled several
+-- ways and there was nowhere to keep anything about a genre itself. They're now rows of the
+-- genres table, which movies refer to through the movie_genres join table. Genre names are
+-- case-insensitive, so "Sci-Fi" and "sci-fi" are the same genre.
+CREATE TABLE IF NOT EXISTS genres
+(
+	id         BIGSERIAL PRIMARY KEY,
+	created_at TIMESTAMP(0) WITH TIME ZONE NOT NULL DEFAULT NOW(),
+	name       CITEXT UNIQUE               NOT NULL
+);
+
+-- position is the genre's place in the movie's list of genres, which is kept in the order it
+-- was given.
+CREATE TABLE IF NOT EXISTS movie_genres
+(
+	movie_id BIGINT  NOT NULL REFERENCES movies ON DELETE CASCADE,
+	genre_id BIGINT  NOT NULL REFERENCES genres ON DELETE CASCADE,
+	position INTEGER NOT NULL,
+	PRIMARY KEY (movie_id, genre_id)
+);
+
+CREATE INDEX IF NOT EXISTS movie_genres_genre_id_idx ON movie_genres (genre_id);
+
+-- Copy the existing genres across. Where a genre has been spelled in different ways, the
+-- spelling used by the oldest movie becomes its name.
+INSERT INTO genres (name)
+SELECT DISTINCT ON (lower(g.name)) g.name
+FROM movies m
+CROSS JOIN LATERAL unnest(m.genres) AS g(name)
+ORDER BY lower(g.name), m.id
+ON CONFLICT (name) DO NOTHING;
+
+INSERT INTO movie_genres (movie_id, genre_id, position)
+SELECT m.id, g.id, MIN(n.position)
+FROM movies m
+CROSS JOIN LATERAL unnest(m.genres) WITH ORDINALITY AS n(name, position)
+INNER JOIN genres g ON g.name = n.name::citext
+GROUP BY m.id, g.id
+ON CONFLICT (movie_id, genre_id) DO NOTHING;
+
+-- The genre statistics view is rebuilt from the join table, and now includes each genre's ID.
+DROP MATERIALIZED VIEW IF EXISTS movie_genre_stats;
+
+CREATE MATERIALIZED VIEW IF NOT EXISTS movie_genre_stats AS
+SELECT g.id AS genre_id, g.name::text AS genre, count(*) AS movies, AVG(m.runtime)::float8 AS average_runtime,
+	MIN(m.year) AS earliest_year, MAX(m.year) AS latest_year
+FROM movie_genres mg
+INNER JOIN genres g ON g.id = mg.genre_id
+INNER JOIN movies m ON m.id = mg.movie_id
+GROUP BY g.id, g.name;
+
+CREATE UNIQUE INDEX IF NOT EXISTS movie_genre_stats_genre_id_idx ON movie_genre_stats (genre_id);
+
+ALTER TABLE movies
+	DROP CONSTRAINT IF EXISTS genres_length_check;
+
+DROP INDEX IF EXISTS movies_genres_idx;
+
+ALTER TABLE movies
+	DROP COLUMN IF EXISTS genres;
@@ -0,0 +1,31 @@
+-- People are the actors, directors and other cast and crew who work on movies.
+CREATE TABLE IF NOT EXISTS people
+(
+	id         BIGSERIAL PRIMARY KEY,
+	created_at TIMESTAMP(0) WITH TIME ZONE NOT NULL DEFAULT NOW(),
+	name       TEXT    NOT NULL,
+	birth_year INTEGER NOT NULL DEFAULT 0,
+	bio        TEXT    NOT NULL DEFAULT '',
+	version    INTEGER NOT NULL DEFAULT 1
+);
+
+CREATE INDEX IF NOT EXISTS people_name_idx
+	ON people USING GIN (to_tsvector('simple', name));
+
+-- credits links people to the movies they worked on and the role they had. A person can have
+-- several credits on the same movie, such as an actor who also directed it, or who played two
+-- characters. billing is the order of the cast, starting at 1 for the top-billed actor, and is
+-- 0 for the crew.
+CREATE TABLE IF NOT EXISTS credits
+(
+	id        BIGSERIAL PRIMARY KEY,
+	movie_id  BIGINT  NOT NULL REFERENCES movies ON DELETE CASCADE,
+	person_id BIGINT  NOT NULL REFERENCES people ON DELETE CASCADE,
+	role      TEXT    NOT NULL,
+	character TEXT    NOT NULL DEFAULT '',
+	billing   INTEGER NOT NULL DEFAULT 0,
+	CONSTRAINT credits_role_check CHECK (role IN ('cast', 'director', 'writer', 'producer'))
+);
+
+CREATE INDEX IF NOT EXISTS credits_movie_id_idx ON credits (movie_id, billing);
+CREATE INDEX IF NOT EXISTS credits_person_id_idx ON credits (person_id);
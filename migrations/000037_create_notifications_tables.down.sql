@@ -0,0 +1,6 @@
+DROP TABLE IF EXISTS notification_preferences;
+DROP TABLE IF EXISTS notifications;
+DROP TABLE IF EXISTS movie_subscriptions;
+
+ALTER TABLE movies
+	DROP COLUMN IF EXISTS release_date;
@@ -0,0 +1,42 @@
+-- release_date is the date a movie comes out, if it's known. It's NULL for most movies, which
+-- were released long ago and only have a year.
+ALTER TABLE movies
+	ADD COLUMN IF NOT EXISTS release_date DATE;
+
+-- movie_subscriptions holds the users waiting to be notified when a movie is released. Each
+-- subscription is removed once the user has been notified.
+CREATE TABLE IF NOT EXISTS movie_subscriptions
+(
+	user_id    BIGINT NOT NULL REFERENCES users ON DELETE CASCADE,
+	movie_id   BIGINT NOT NULL REFERENCES movies ON DELETE CASCADE,
+	created_at TIMESTAMP(0) WITH TIME ZONE NOT NULL DEFAULT NOW(),
+	PRIMARY KEY (user_id, movie_id)
+);
+
+CREATE INDEX IF NOT EXISTS movie_subscriptions_movie_id_idx ON movie_subscriptions (movie_id);
+
+-- notifications holds the in-app notifications, which users list and mark as read. The movie
+-- or saved search a notification is about is kept as a link only, so deleting either keeps the
+-- notification.
+CREATE TABLE IF NOT EXISTS notifications
+(
+	id              BIGSERIAL PRIMARY KEY,
+	created_at      TIMESTAMP(0) WITH TIME ZONE NOT NULL DEFAULT NOW(),
+	user_id         BIGINT NOT NULL REFERENCES users ON DELETE CASCADE,
+	kind            TEXT   NOT NULL,
+	message         TEXT   NOT NULL,
+	movie_id        BIGINT REFERENCES movies ON DELETE SET NULL,
+	saved_search_id BIGINT REFERENCES saved_searches ON DELETE SET NULL,
+	read_at         TIMESTAMP(0) WITH TIME ZONE
+);
+
+CREATE INDEX IF NOT EXISTS notifications_user_id_idx ON notifications (user_id, id);
+
+-- notification_preferences holds how each user wants to be notified. Users without a row get
+-- both email and in-app notifications.
+CREATE TABLE IF NOT EXISTS notification_preferences
+(
+	user_id BIGINT PRIMARY KEY REFERENCES users ON DELETE CASCADE,
+	email   BOOLEAN NOT NULL DEFAULT true,
+	in_app  BOOLEAN NOT NULL DEFAULT true
+);
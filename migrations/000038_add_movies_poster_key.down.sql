@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS movies_poster_key_idx;
+
+ALTER TABLE movies
+	DROP COLUMN IF EXISTS poster_key;
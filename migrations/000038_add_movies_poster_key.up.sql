@@ -0,0 +1,7 @@
+-- poster_key is the storage key prefix that a movie's poster images are stored under, or empty
+-- if it doesn't have a poster. The index is used by the orphan cleanup to find the images which
+-- no longer belong to a movie.
+ALTER TABLE movies
+	ADD COLUMN IF NOT EXISTS poster_key TEXT NOT NULL DEFAULT '';
+
+CREATE INDEX IF NOT EXISTS movies_poster_key_idx ON movies (poster_key) WHERE poster_key <> '';
@@ -0,0 +1,29 @@
+DROP MATERIALIZED VIEW IF EXISTS trending_movies;
+
+CREATE MATERIALIZED VIEW IF NOT EXISTS trending_movies AS
+SELECT m.id, m.title, m.year, SUM(v.views)::bigint AS views
+FROM movie_views v
+INNER JOIN movies m ON m.id = v.movie_id
+WHERE v.day >= CURRENT_DATE - 7
+GROUP BY m.id, m.title, m.year
+ORDER BY views DESC
+LIMIT 100;
+
+CREATE UNIQUE INDEX IF NOT EXISTS trending_movies_id_idx ON trending_movies (id);
+
+DROP MATERIALIZED VIEW IF EXISTS movie_genre_stats;
+
+CREATE MATERIALIZED VIEW IF NOT EXISTS movie_genre_stats AS
+SELECT g.id AS genre_id, g.name::text AS genre, count(*) AS movies, AVG(m.runtime)::float8 AS average_runtime,
+	MIN(m.year) AS earliest_year, MAX(m.year) AS latest_year
+FROM movie_genres mg
+INNER JOIN genres g ON g.id = mg.genre_id
+INNER JOIN movies m ON m.id = mg.movie_id
+GROUP BY g.id, g.name;
+
+CREATE UNIQUE INDEX IF NOT EXISTS movie_genre_stats_genre_id_idx ON movie_genre_stats (genre_id);
+
+DROP INDEX IF EXISTS movies_deleted_at_idx;
+
+ALTER TABLE movies
+	DROP COLUMN IF EXISTS deleted_at;
@@ -0,0 +1,33 @@
+-- Deleted movies are soft-deleted: deleted_at is set, which moves the movie to the trash, where
+-- it can be restored until it's purged once the trash retention period has passed.
+ALTER TABLE movies
+	ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMP(0) WITH TIME ZONE;
+
+CREATE INDEX IF NOT EXISTS movies_deleted_at_idx ON movies (deleted_at) WHERE deleted_at IS NOT NULL;
+
+-- The statistics views are rebuilt to leave out the movies in the trash.
+DROP MATERIALIZED VIEW IF EXISTS movie_genre_stats;
+
+CREATE MATERIALIZED VIEW IF NOT EXISTS movie_genre_stats AS
+SELECT g.id AS genre_id, g.name::text AS genre, count(*) AS movies, AVG(m.runtime)::float8 AS average_runtime,
+	MIN(m.year) AS earliest_year, MAX(m.year) AS latest_year
+FROM movie_genres mg
+INNER JOIN genres g ON g.id = mg.genre_id
+INNER JOIN movies m ON m.id = mg.movie_id
+WHERE m.deleted_at IS NULL
+GROUP BY g.id, g.name;
+
+CREATE UNIQUE INDEX IF NOT EXISTS movie_genre_stats_genre_id_idx ON movie_genre_stats (genre_id);
+
+DROP MATERIALIZED VIEW IF EXISTS trending_movies;
+
+CREATE MATERIALIZED VIEW IF NOT EXISTS trending_movies AS
+SELECT m.id, m.title, m.year, SUM(v.views)::bigint AS views
+FROM movie_views v
+INNER JOIN movies m ON m.id = v.movie_id
+WHERE v.day >= CURRENT_DATE - 7 AND m.deleted_at IS NULL
+GROUP BY m.id, m.title, m.year
+ORDER BY views DESC
+LIMIT 100;
+
+CREATE UNIQUE INDEX IF NOT EXISTS trending_movies_id_idx ON trending_movies (id);
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS favorite_genres;
+DROP TABLE IF EXISTS digest_subscriptions;
@@ -0,0 +1,18 @@
+-- digest_subscriptions holds the users who've opted in to the weekly digest email. last_sent_at
+-- is NULL until their first digest is sent, which is a week after they subscribed.
+CREATE TABLE IF NOT EXISTS digest_subscriptions
+(
+	user_id      BIGINT PRIMARY KEY REFERENCES users ON DELETE CASCADE,
+	created_at   TIMESTAMP(0) WITH TIME ZONE NOT NULL DEFAULT NOW(),
+	last_sent_at TIMESTAMP(0) WITH TIME ZONE
+);
+
+-- favorite_genres holds the genres each user wants to hear about new movies in.
+CREATE TABLE IF NOT EXISTS favorite_genres
+(
+	user_id  BIGINT NOT NULL REFERENCES users ON DELETE CASCADE,
+	genre_id BIGINT NOT NULL REFERENCES genres ON DELETE CASCADE,
+	PRIMARY KEY (user_id, genre_id)
+);
+
+CREATE INDEX IF NOT EXISTS favorite_genres_genre_id_idx ON favorite_genres (genre_id);
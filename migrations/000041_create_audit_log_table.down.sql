@@ -0,0 +1,3 @@
+DELETE FROM permissions WHERE code = 'audit:admin';
+
+DROP TABLE IF EXISTS audit_log;
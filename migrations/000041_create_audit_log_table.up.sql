@@ -0,0 +1,22 @@
+-- audit_log records every write to the audited resources (see auditSnapshots in the data
+-- package): who made it, in which request, and the fields that changed. It's kept for compliance,
+-- so user_id and resource_id aren't foreign keys: the entries outlive the users and resources
+-- they refer to.
+CREATE TABLE IF NOT EXISTS audit_log
+(
+	id            BIGSERIAL PRIMARY KEY,
+	created_at    TIMESTAMP(0) WITH TIME ZONE NOT NULL DEFAULT NOW(),
+	user_id       BIGINT,
+	request_id    TEXT   NOT NULL DEFAULT '',
+	action        TEXT   NOT NULL,
+	resource_type TEXT   NOT NULL,
+	resource_id   BIGINT NOT NULL,
+	changes       JSONB  NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS audit_log_created_at_idx ON audit_log (created_at);
+CREATE INDEX IF NOT EXISTS audit_log_user_id_idx ON audit_log (user_id, id);
+CREATE INDEX IF NOT EXISTS audit_log_resource_idx ON audit_log (resource_type, resource_id, id);
+
+INSERT INTO permissions (code)
+VALUES ('audit:admin');
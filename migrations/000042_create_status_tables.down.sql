@@ -0,0 +1,8 @@
+DELETE FROM permissions WHERE code = 'status:admin';
+
+DROP TABLE IF EXISTS incidents;
+
+ALTER TABLE usage_stats
+	DROP COLUMN IF EXISTS errors;
+
+DROP TABLE IF EXISTS status_heartbeats;
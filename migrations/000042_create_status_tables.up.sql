@@ -0,0 +1,33 @@
+-- status_heartbeats holds one row for each minute in which at least one API process was up and
+-- serving requests. The API processes write a heartbeat several times a minute, so a missing
+-- minute means that the API was down, and uptime is the share of minutes with a heartbeat.
+CREATE TABLE IF NOT EXISTS status_heartbeats
+(
+	minute TIMESTAMP(0) WITH TIME ZONE PRIMARY KEY
+);
+
+-- Server errors are metered along with the other usage, so that the error rate can be worked out
+-- for the status page.
+ALTER TABLE usage_stats
+	ADD COLUMN IF NOT EXISTS errors BIGINT NOT NULL DEFAULT 0;
+
+-- Incidents are posted by admins to annotate the status page, such as with an outage and its
+-- cause. An incident is ongoing until resolved_at is set.
+CREATE TABLE IF NOT EXISTS incidents
+(
+	id          BIGSERIAL PRIMARY KEY,
+	created_at  TIMESTAMP(0) WITH TIME ZONE NOT NULL DEFAULT NOW(),
+	created_by  BIGINT REFERENCES users ON DELETE SET NULL,
+	title       TEXT    NOT NULL,
+	message     TEXT    NOT NULL,
+	impact      TEXT    NOT NULL,
+	started_at  TIMESTAMP(0) WITH TIME ZONE NOT NULL,
+	resolved_at TIMESTAMP(0) WITH TIME ZONE,
+	version     INTEGER NOT NULL DEFAULT 1,
+	CONSTRAINT incidents_window_check CHECK (resolved_at IS NULL OR resolved_at >= started_at)
+);
+
+CREATE INDEX IF NOT EXISTS incidents_started_at_idx ON incidents (started_at);
+
+INSERT INTO permissions (code)
+VALUES ('status:admin');
@@ -0,0 +1,40 @@
+-- Webhooks are endpoints registered by admins, which are sent a signed POST request for each
+-- event of the types they subscribe to. The secret is kept in plain text, as it's needed to sign
+-- the requests.
+CREATE TABLE IF NOT EXISTS webhooks
+(
+	id          BIGSERIAL PRIMARY KEY,
+	created_at  TIMESTAMP(0) WITH TIME ZONE NOT NULL DEFAULT NOW(),
+	created_by  BIGINT REFERENCES users ON DELETE SET NULL,
+	url         TEXT    NOT NULL,
+	secret      TEXT    NOT NULL,
+	event_types TEXT[]  NOT NULL,
+	active      BOOLEAN NOT NULL DEFAULT TRUE,
+	version     INTEGER NOT NULL DEFAULT 1
+);
+
+-- webhook_deliveries is both the queue of requests waiting to be sent to the webhooks and the log
+-- of the requests which have been sent. A delivery is written in the same transaction as the event
+-- that causes it, and is pending until it succeeds (delivered) or runs out of attempts (failed).
+CREATE TABLE IF NOT EXISTS webhook_deliveries
+(
+	id              BIGSERIAL PRIMARY KEY,
+	created_at      TIMESTAMP(0) WITH TIME ZONE NOT NULL DEFAULT NOW(),
+	webhook_id      BIGINT  NOT NULL REFERENCES webhooks ON DELETE CASCADE,
+	event_type      TEXT    NOT NULL,
+	payload         JSONB   NOT NULL,
+	status          TEXT    NOT NULL DEFAULT 'pending',
+	attempts        INTEGER NOT NULL DEFAULT 0,
+	next_attempt_at TIMESTAMP(0) WITH TIME ZONE NOT NULL DEFAULT NOW(),
+	last_attempt_at TIMESTAMP(0) WITH TIME ZONE,
+	response_status INTEGER,
+	last_error      TEXT    NOT NULL DEFAULT ''
+);
+
+CREATE INDEX IF NOT EXISTS webhook_deliveries_next_attempt_at_idx ON webhook_deliveries (next_attempt_at)
+	WHERE status = 'pending';
+CREATE INDEX IF NOT EXISTS webhook_deliveries_webhook_id_idx ON webhook_deliveries (webhook_id, id);
+CREATE INDEX IF NOT EXISTS webhook_deliveries_created_at_idx ON webhook_deliveries (created_at);
+
+INSERT INTO permissions (code)
+VALUES ('webhooks:admin');
@@ -0,0 +1,8 @@
+DROP TRIGGER IF EXISTS api_keys_per_user_limit ON api_keys;
+DROP FUNCTION IF EXISTS api_keys_per_user_limit();
+
+-- The secrets can't be recovered from their hashes, so the keys are removed.
+DELETE FROM api_keys;
+
+ALTER TABLE api_keys DROP COLUMN IF EXISTS secret_hash;
+ALTER TABLE api_keys ADD COLUMN IF NOT EXISTS secret TEXT NOT NULL;
@@ -0,0 +1,31 @@
+-- API key secrets are no longer stored. Each secret is derived from the key ID with the
+-- -signature-secret flag, so that it can be worked out again to check a request's signature, and
+-- only its SHA-256 hash is kept, to check that the secret was derived with the current signing
+-- secret. The existing keys have random secrets which can't be derived, so they're removed and
+-- their owners need to create new ones.
+DELETE FROM api_keys;
+
+ALTER TABLE api_keys DROP COLUMN IF EXISTS secret;
+ALTER TABLE api_keys ADD COLUMN IF NOT EXISTS secret_hash BYTEA NOT NULL;
+
+-- Each user can have at most 10 API keys, which matches MaxAPIKeysPerUser. The user's row is
+-- locked before counting their keys, so that concurrent inserts can't both pass the check.
+CREATE OR REPLACE FUNCTION api_keys_per_user_limit() RETURNS TRIGGER AS
+$$
+BEGIN
+	PERFORM 1 FROM users WHERE id = NEW.user_id FOR UPDATE;
+
+	IF (SELECT count(*) FROM api_keys WHERE user_id = NEW.user_id) >= 10 THEN
+		RAISE EXCEPTION 'too many api keys'
+			USING ERRCODE = 'check_violation', CONSTRAINT = 'api_keys_per_user_limit';
+	END IF;
+
+	RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER api_keys_per_user_limit
+	BEFORE INSERT
+	ON api_keys
+	FOR EACH ROW
+EXECUTE FUNCTION api_keys_per_user_limit();
@@ -0,0 +1 @@
+-- The removed data can't be restored, so there's nothing to do.
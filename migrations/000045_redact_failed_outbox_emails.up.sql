@@ -0,0 +1,6 @@
+-- Emails which have been given up on have their secret data removed, but the ones which failed
+-- before that could hold token plaintexts. Their data can't be told apart, so all of it is
+-- removed.
+UPDATE outbox
+SET payload = payload - 'data'
+WHERE failed_at IS NOT NULL AND kind = 'email';
@@ -0,0 +1,2 @@
+ALTER TABLE webhook_deliveries
+	DROP COLUMN IF EXISTS trace_context;
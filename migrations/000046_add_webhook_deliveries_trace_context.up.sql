@@ -0,0 +1,4 @@
+-- The trace context (the W3C traceparent and tracestate headers) of the request which caused each
+-- delivery, so that the worker can carry the trace on to the webhook.
+ALTER TABLE webhook_deliveries
+	ADD COLUMN IF NOT EXISTS trace_context JSONB NOT NULL DEFAULT '{}';
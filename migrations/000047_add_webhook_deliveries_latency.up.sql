@@ -0,0 +1,3 @@
+-- How long the last attempt at each delivery took, in milliseconds.
+ALTER TABLE webhook_deliveries
+	ADD COLUMN IF NOT EXISTS latency_ms BIGINT;
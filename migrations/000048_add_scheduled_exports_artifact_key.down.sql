@@ -0,0 +1,2 @@
+ALTER TABLE scheduled_exports
+	DROP COLUMN IF EXISTS artifact_key;
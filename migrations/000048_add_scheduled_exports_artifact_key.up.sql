@@ -0,0 +1,3 @@
+-- The key of the object in storage which holds the most recent run of each export.
+ALTER TABLE scheduled_exports
+	ADD COLUMN IF NOT EXISTS artifact_key TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,5 @@
+-- The generation of each user's JWT authentication tokens. It's carried in the tokens' "gen"
+-- claim and incremented when the user resets their password, which revokes the tokens issued
+-- before the reset.
+ALTER TABLE users
+	ADD COLUMN IF NOT EXISTS token_generation INTEGER NOT NULL DEFAULT 1;
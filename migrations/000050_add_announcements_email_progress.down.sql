@@ -0,0 +1,6 @@
+DROP INDEX IF EXISTS announcements_email_pending_idx;
+
+ALTER TABLE announcements
+	DROP COLUMN IF EXISTS emailed_at,
+	DROP COLUMN IF EXISTS emailed_through,
+	DROP COLUMN IF EXISTS email;
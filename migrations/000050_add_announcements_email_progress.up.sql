@@ -0,0 +1,9 @@
+-- Whether each announcement is emailed to the subscribers once it starts, and how far the
+-- emails have got: the ID of the last subscriber emailed, and when the last batch was queued.
+ALTER TABLE announcements
+	ADD COLUMN IF NOT EXISTS email BOOLEAN NOT NULL DEFAULT false,
+	ADD COLUMN IF NOT EXISTS emailed_through BIGINT NOT NULL DEFAULT 0,
+	ADD COLUMN IF NOT EXISTS emailed_at TIMESTAMP(0) WITH TIME ZONE;
+
+CREATE INDEX IF NOT EXISTS announcements_email_pending_idx ON announcements (starts_at)
+	WHERE email AND emailed_at IS NULL;
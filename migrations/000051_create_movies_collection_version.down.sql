@@ -0,0 +1,4 @@
+DROP TRIGGER IF EXISTS movies_collection_version ON reviews;
+DROP TRIGGER IF EXISTS movies_collection_version ON movies;
+DROP FUNCTION IF EXISTS bump_movies_collection_version();
+DROP SEQUENCE IF EXISTS movies_collection_version_seq;
@@ -0,0 +1,26 @@
+-- movies_collection_version_seq is advanced by every statement that writes to the movies or
+-- reviews tables, so that the movie list endpoint can build its ETag from the sequence's last
+-- value rather than by scanning the movies and reviews on each request (see
+-- MovieModel.CollectionVersion). A sequence is used rather than a counter row because nextval()
+-- never waits on other transactions, so concurrent writes aren't serialized behind one row lock.
+CREATE SEQUENCE IF NOT EXISTS movies_collection_version_seq;
+
+CREATE OR REPLACE FUNCTION bump_movies_collection_version() RETURNS TRIGGER AS
+$$
+BEGIN
+	PERFORM nextval('movies_collection_version_seq');
+	RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER movies_collection_version
+	AFTER INSERT OR UPDATE OR DELETE OR TRUNCATE
+	ON movies
+	FOR EACH STATEMENT
+EXECUTE FUNCTION bump_movies_collection_version();
+
+CREATE TRIGGER movies_collection_version
+	AFTER INSERT OR UPDATE OR DELETE OR TRUNCATE
+	ON reviews
+	FOR EACH STATEMENT
+EXECUTE FUNCTION bump_movies_collection_version();
@@ -0,0 +1,70 @@
+// Package migrations embeds the SQL migration files, so that the application binary knows which
+// version of the database schema it was built for.
+package migrations
+
+import (
+	"embed"
+	"io/fs"
+	"strconv"
+	"strings"
+)
+
+// files holds the up and down migration files. They're applied with the migrate tool, and the
+// application only uses them to work out the latest version.
+//
+//go:embed *.sql
+var files embed.FS
+
+// Latest returns the version number of the newest migration, which is the schema version that
+// the application expects the database to be at. Migration files are named in the format
+// 000001_create_movies_table.up.sql, so the version is the number before the first underscore.
+func Latest() (int, error) {
+	entries, err := fs.ReadDir(files, ".")
+	if err != nil {
+		return 0, err
+	}
+
+	latest := 0
+
+	for _, entry := range entries {
+		prefix, _, found := strings.Cut(entry.Name(), "_")
+		if !found {
+			continue
+		}
+
+		version, err := strconv.Atoi(prefix)
+		if err != nil {
+			return 0, err
+		}
+
+		if version > latest {
+			latest = version
+		}
+	}
+
+	return latest, nil
+}
+
+// UpScripts returns the contents of each of the up migration files, in version order. It's used
+// by the test harness to build a fresh database without needing the migrate tool.
+func UpScripts() ([]string, error) {
+	// fs.Glob returns the matches in lexical order, and the zero-padded version numbers mean
+	// that's also version order.
+	names, err := fs.Glob(files, "*.up.sql")
+	if err != nil {
+		return nil, err
+	}
+
+	scripts := make([]string, 0, len(names))
+
+	for _, name := range names {
+		script, err := fs.ReadFile(files, name)
+		if err != nil {
+			return nil, err
+		}
+
+		scripts = append(scripts, string(script))
+	}
+
+	return scripts, nil
+}